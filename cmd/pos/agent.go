@@ -3,6 +3,7 @@ package main
 import (
         "context"
         "encoding/json"
+        "errors"
         "fmt"
         "net/http"
         "strconv"
@@ -11,10 +12,13 @@ import (
 
         "github.com/spf13/cobra"
 
+        "termpos/internal/api"
         "termpos/internal/auth"
         "termpos/internal/db"
+        "termpos/internal/events"
         "termpos/internal/handlers"
         "termpos/internal/models"
+        "termpos/internal/webhook"
 )
 
 // initAgentCommand sets up the agent mode server command
@@ -22,7 +26,31 @@ func initAgentCommand() {
         var agentCmd = &cobra.Command{
                 Use:   "agent",
                 Short: "Start the agent mode server",
-                Long:  `Start an HTTP server that receives POS commands remotely.`,
+                Long: `Start an HTTP server that receives POS commands remotely.
+
+Access tokens are signed with the secret in TERMPOS_JWT_SECRET, which must be at least
+32 bytes long. To rotate it, list several keys in TERMPOS_JWT_KEYS as "kid:secret"
+pairs separated by commas. The first key signs new tokens, or the one named by
+TERMPOS_JWT_KID, and the others are only used to verify tokens signed before the
+rotation. The server does not start without a secret.
+
+The REST API under /api/v1 covers products, categories, suppliers, locations, batches,
+customers, staff, sales, settings and audit logs. Lists take limit, cursor and sort
+parameters, PATCH requests change only the fields they contain, and errors are returned
+as {"error": {"code", "message", "fields"}}. The OpenAPI document describing every
+endpoint is served at /openapi.json.
+
+Requests that change data may carry an Idempotency-Key header. A retry with the same key
+gets the response to the first request instead of being applied again, for as long as
+the idempotency retention setting (24 hours by default).
+
+GET /events streams sales, refunds, low stock alerts and shifts as server-sent events.
+Subscribers need the event:stream permission and only receive the events their other
+permissions allow; the types parameter limits the stream to some events, e.g.
+?types=sale.created,refund.created. A client reconnecting with a Last-Event-ID header
+first receives the events it missed, for up to 7 days.
+
+The server also sends queued webhook deliveries; see "pos webhook".`,
                 RunE: func(cmd *cobra.Command, args []string) error {
                         fmt.Printf("Starting agent mode server on port %d...\n", port)
                         return startAgentServer(port)
@@ -32,51 +60,63 @@ func initAgentCommand() {
         rootCmd.AddCommand(agentCmd)
 }
 
-// authMiddleware checks if the request has a valid authentication token
+// approvalHeader carries a supervisor approval token for restricted actions
+const approvalHeader = "X-Approval-Token"
+
+// authMiddleware checks if the request has a valid access token or API key
 func authMiddleware(next http.HandlerFunc, permission string) http.HandlerFunc {
         return func(w http.ResponseWriter, r *http.Request) {
-                // Get token from Authorization header
-                authHeader := r.Header.Get("Authorization")
-                if authHeader == "" {
-                        http.Error(w, "Authorization header required", http.StatusUnauthorized)
+                if apiKey := requestAPIKey(r); apiKey != "" {
+                        user, key, err := authenticateAPIKey(r, apiKey)
+                        if err != nil {
+                                authError(w, r, err.Error(), http.StatusUnauthorized)
+                                return
+                        }
+
+                        // Every request made with a key is audited, including refused ones
+                        rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+                        if auth.HasPermission(user, permission) {
+                                next(rec, requestAs(r, user))
+                        } else {
+                                authError(rec, r, "Unauthorized: API key is not scoped for this request", http.StatusForbidden)
+                        }
+                        auditAPIKeyRequest(r, key, rec.status)
                         return
                 }
 
-                // Expected format: "Bearer <token>"
-                parts := strings.Split(authHeader, " ")
-                if len(parts) != 2 || parts[0] != "Bearer" {
-                        http.Error(w, "Invalid authorization format, expected 'Bearer <token>'", http.StatusUnauthorized)
-                        return
-                }
-
-                // Extract the token
-                tokenString := parts[1]
-
-                // Validate the JWT token
-                claims, err := auth.ValidateJWT(tokenString)
+                user, _, err := authenticateRequest(r)
                 if err != nil {
-                        http.Error(w, fmt.Sprintf("Invalid token: %v", err), http.StatusUnauthorized)
+                        authError(w, r, err.Error(), http.StatusUnauthorized)
                         return
                 }
 
                 // Check if user has required permission
-                user := models.User{
-                        ID:       claims.UserID,
-                        Username: claims.Username,
-                        Role:     models.Role(claims.Role),
-                }
-
-                if !auth.HasPermission(&user, permission) {
-                        http.Error(w, "Unauthorized: insufficient permissions", http.StatusForbidden)
+                if !auth.HasPermission(user, permission) {
+                        authError(w, r, "Unauthorized: insufficient permissions", http.StatusForbidden)
                         return
                 }
 
-                // Store user information in request context for later use
-                ctx := context.WithValue(r.Context(), "user", &user)
-                
-                // Call the next handler with the updated context
-                next(w, r.WithContext(ctx))
+                // Call the next handler as the user
+                next(w, requestAs(r, user))
+        }
+}
+
+// requestAs returns the request made as user. The user is stored in the request context
+// for handlers, along with the actor that changes made by the request are audited as.
+func requestAs(r *http.Request, user *models.User) *http.Request {
+        ctx := context.WithValue(r.Context(), "user", user)
+        ctx = db.WithActor(ctx, db.Actor{Username: user.Username, Source: db.SourceAPI, IPAddress: r.RemoteAddr})
+        return r.WithContext(ctx)
+}
+
+// authError writes an authentication or authorization failure. Requests to the
+// versioned API get its JSON error envelope.
+func authError(w http.ResponseWriter, r *http.Request, message string, status int) {
+        if strings.HasPrefix(r.URL.Path, api.Prefix+"/") {
+                api.WriteError(w, status, message)
+                return
         }
+        http.Error(w, message, status)
 }
 
 // Handle authentication routes
@@ -88,7 +128,10 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 
         var creds struct {
                 Username string `json:"username"`
-                Password string `json:"password"`
+                Password    string `json:"password"`
+                PIN         string `json:"pin"`
+                NewPassword string `json:"new_password"`
+                OTP         string `json:"otp"`
         }
 
         if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
@@ -96,32 +139,73 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        session, err := auth.Login(creds.Username, creds.Password, db.GetUserByUsername, db.UpdateLastLogin)
+        secret, usePIN := creds.Password, false
+        if creds.PIN != "" {
+                secret, usePIN = creds.PIN, true
+        }
+
+        session, err := authenticate(creds.Username, secret, usePIN, creds.OTP, r.RemoteAddr)
+        if errors.Is(err, auth.ErrTwoFactorRequired) {
+                // Ask the client to repeat the login with otp
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusUnauthorized)
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                        "error":               err.Error(),
+                        "two_factor_required": true,
+                })
+                return
+        }
         if err != nil {
                 http.Error(w, fmt.Sprintf("Authentication failed: %v", err), http.StatusUnauthorized)
                 return
         }
 
-        // Generate JWT token
-        jwtToken, err := auth.GenerateJWT(session.UserID, session.Username, string(session.Role))
-        if err != nil {
-                http.Error(w, fmt.Sprintf("Failed to generate token: %v", err), http.StatusInternalServerError)
+        if session.PasswordChangeRequired {
+                if creds.NewPassword == "" {
+                        // Ask the client to repeat the login with new_password
+                        w.Header().Set("Content-Type", "application/json")
+                        w.WriteHeader(http.StatusForbidden)
+                        json.NewEncoder(w).Encode(map[string]interface{}{
+                                "error":                    auth.ErrPasswordChangeRequired.Error(),
+                                "password_change_required": true,
+                        })
+                        return
+                }
+
+                user, err := db.GetUserByID(session.UserID)
+                if err != nil {
+                        http.Error(w, fmt.Sprintf("Failed to retrieve user: %v", err), http.StatusInternalServerError)
+                        return
+                }
+                if err := setUserPassword(user, creds.NewPassword, false); err != nil {
+                        http.Error(w, fmt.Sprintf("Password change failed: %v", err), http.StatusBadRequest)
+                        return
+                }
+                session.PasswordChangeRequired = false
+                auth.SaveSession()
+                db.AddAuditLog(session.Username, db.ActionUserMod, "user", fmt.Sprintf("%d", session.UserID),
+                        fmt.Sprintf("User %s changed their password", session.Username), "", "", r.RemoteAddr, "")
+        }
+
+        if session.TwoFactorSetupRequired {
+                // Enrollment is done at the terminal, so no token is issued until then
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusForbidden)
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                        "error":                     auth.ErrTwoFactorSetupRequired.Error(),
+                        "two_factor_setup_required": true,
+                })
                 return
         }
 
-        // Return the token and user information
-        response := map[string]interface{}{
-                "token": jwtToken,
-                "user": map[string]interface{}{
-                        "id":       session.UserID,
-                        "username": session.Username,
-                        "role":     session.Role,
-                },
-                "expires_in": 86400, // 24 hours in seconds
+        refreshToken, err := newRefreshToken(session.UserID, r.RemoteAddr)
+        if err != nil {
+                http.Error(w, fmt.Sprintf("Failed to generate token: %v", err), http.StatusInternalServerError)
+                return
         }
 
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(response)
+        user := &models.User{ID: session.UserID, Username: session.Username, Role: session.Role}
+        issueTokens(w, user, refreshToken)
 }
 
 // productHandler handles requests based on HTTP method and required permissions
@@ -202,12 +286,38 @@ func salesHandler(w http.ResponseWriter, r *http.Request) {
         }
 }
 
+// saleByIDHandler handles actions on a single sale, e.g. POST /sales/{id}/refund
+func saleByIDHandler(w http.ResponseWriter, r *http.Request) {
+        parts := strings.Split(strings.Trim(r.URL.Path[len("/sales/"):], "/"), "/")
+        if len(parts) != 2 || parts[1] != "refund" {
+                http.Error(w, "Not found", http.StatusNotFound)
+                return
+        }
+
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        saleID, err := strconv.Atoi(parts[0])
+        if err != nil {
+                http.Error(w, "Invalid sale ID", http.StatusBadRequest)
+                return
+        }
+
+        handleRefundSale(w, r, saleID)
+}
+
 func startAgentServer(port int) error {
         fmt.Println("Starting Agent server...")
         
         // Initialize JWT authentication
         fmt.Println("Initializing JWT authentication...")
-        auth.InitJWT()
+        if err := auth.InitJWT(); err != nil {
+                return fmt.Errorf("cannot start agent mode: %w", err)
+        }
+        kid, keys := auth.JWTKeyIDs()
+        fmt.Printf("Signing tokens with key %s (%d key(s) loaded)\n", kid, keys)
         
         fmt.Println("Setting up HTTP routes...")
         
@@ -220,14 +330,21 @@ func startAgentServer(port int) error {
         
         // Authentication endpoints (public)
         http.HandleFunc("/auth/login", handleLogin)
+        http.HandleFunc("/auth/refresh", handleRefresh)
+        http.HandleFunc("/auth/logout", handleLogout)
         
-        // Protected routes - requires authentication + specific permissions
+        // Protected routes - requires authentication + specific permissions. Routes that
+        // change data accept an Idempotency-Key header so clients can safely retry them.
         // Product routes
-        http.HandleFunc("/products", authMiddleware(productHandler, "product:read"))
-        http.HandleFunc("/products/", authMiddleware(productByIDHandler, "product:read"))
+        http.HandleFunc("/products", authMiddleware(api.Idempotent(productHandler), "product:read"))
+        http.HandleFunc("/products/", authMiddleware(api.Idempotent(productByIDHandler), "product:read"))
         
         // Sales routes
-        http.HandleFunc("/sales", authMiddleware(salesHandler, "sale:read"))
+        http.HandleFunc("/sales", authMiddleware(api.Idempotent(salesHandler), "sale:read"))
+        http.HandleFunc("/sales/", authMiddleware(api.Idempotent(saleByIDHandler), "sale:create"))
+        
+        // Supervisor approvals for restricted actions
+        http.HandleFunc("/approvals", authMiddleware(api.Idempotent(handleRequestApproval), "sale:create"))
         
         // Report routes - all require report:generate permission
         http.HandleFunc("/reports/sales", authMiddleware(handleSalesReport, "report:generate"))
@@ -236,6 +353,27 @@ func startAgentServer(port int) error {
         http.HandleFunc("/reports/summary", authMiddleware(handleSummaryReport, "report:generate"))
         http.HandleFunc("/reports/top", authMiddleware(handleTopProductsReport, "report:generate"))
         http.HandleFunc("/reports/daily", authMiddleware(handleDailySalesReport, "report:generate"))
+        http.HandleFunc("/reports/staff", authMiddleware(handleStaffReport, "report:generate"))
+
+        // Versioned REST API; each of its routes is authorized with its own permission
+        apiServer := api.NewServer(authMiddleware)
+        http.Handle(api.Prefix+"/", apiServer)
+
+        // OpenAPI document describing every route above (public)
+        http.HandleFunc("/openapi.json", apiServer.ServeOpenAPI)
+
+        // Live feed of sales, refunds, low stock and shifts, filtered by the subscriber's
+        // permissions
+        bus := events.NewBus()
+        if err := bus.Start(); err != nil {
+                return fmt.Errorf("cannot start the event feed: %w", err)
+        }
+        go bus.Run(context.Background())
+        http.HandleFunc("/events", authMiddleware(bus.ServeSSE, models.PermissionEventStream))
+
+        // Send queued webhook deliveries in the background
+        fmt.Println("Starting webhook dispatcher...")
+        go webhook.NewDispatcher().Run(context.Background())
 
         // Start the server
         addr := fmt.Sprintf("0.0.0.0:%d", port)
@@ -263,7 +401,7 @@ func handleAddProduct(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        id, err := handlers.AddProduct(product)
+        id, err := handlers.AddProduct(r.Context(), product)
         if err != nil {
                 http.Error(w, fmt.Sprintf("Failed to add product: %v", err), http.StatusInternalServerError)
                 return
@@ -317,7 +455,7 @@ func handleUpdateProductStock(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        if err := handlers.UpdateProductStock(id, data.Stock); err != nil {
+        if err := handlers.UpdateProductStock(r.Context(), id, data.Stock); err != nil {
                 http.Error(w, fmt.Sprintf("Failed to update stock: %v", err), http.StatusInternalServerError)
                 return
         }
@@ -346,7 +484,27 @@ func handleAddSale(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        id, err := handlers.RecordSale(sale)
+        // Price overrides and large discounts need an approval token unless the user holds the permission
+        restricted, err := handlers.SaleRestrictedActions(sale)
+        if err != nil {
+                http.Error(w, fmt.Sprintf("Failed to record sale: %v", err), http.StatusBadRequest)
+                return
+        }
+        approvalToken, ok := authorizeRestrictedActions(w, r, restricted)
+        if !ok {
+                return
+        }
+
+        // Attribute the sale to the authenticated user, on the terminal named by the client
+        user := r.Context().Value("user").(*models.User)
+        sale.TerminalID = r.Header.Get("X-Terminal-ID")
+        handlers.AttributeSale(&sale, user.ID)
+
+        id, err := handlers.RecordApprovedSale(r.Context(), sale, approvalToken)
+        if errors.Is(err, db.ErrApprovalInvalid) {
+                http.Error(w, fmt.Sprintf("Invalid approval: %v", err), http.StatusForbidden)
+                return
+        }
         if err != nil {
                 http.Error(w, fmt.Sprintf("Failed to record sale: %v", err), http.StatusInternalServerError)
                 return
@@ -357,6 +515,109 @@ func handleAddSale(w http.ResponseWriter, r *http.Request) {
         json.NewEncoder(w).Encode(map[string]int{"id": id})
 }
 
+// handleRefundSale refunds a sale, requiring an approval token if the user lacks sale:refund
+func handleRefundSale(w http.ResponseWriter, r *http.Request, saleID int) {
+        var data struct {
+                Reason string `json:"reason"`
+        }
+        if r.ContentLength != 0 {
+                if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+                        http.Error(w, "Invalid request body", http.StatusBadRequest)
+                        return
+                }
+        }
+
+        approvalToken, ok := authorizeRestrictedActions(w, r, []models.RestrictedAction{handlers.RefundRestrictedAction(saleID)})
+        if !ok {
+                return
+        }
+
+        err := handlers.RefundSale(r.Context(), saleID, approvalToken, data.Reason)
+        if errors.Is(err, db.ErrApprovalInvalid) {
+                http.Error(w, fmt.Sprintf("Invalid approval: %v", err), http.StatusForbidden)
+                return
+        }
+        if err != nil {
+                http.Error(w, fmt.Sprintf("Failed to refund sale: %v", err), http.StatusConflict)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{"id": saleID, "status": "refunded"})
+}
+
+// handleRequestApproval verifies a supervisor's credentials and issues an approval token
+// for the restricted actions returned in an earlier "approval required" response
+func handleRequestApproval(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        var req struct {
+                Supervisor string                    `json:"supervisor"`
+                Password   string                    `json:"password"`
+                Reason     string                    `json:"reason"`
+                Actions    []models.RestrictedAction `json:"actions"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request body", http.StatusBadRequest)
+                return
+        }
+
+        for _, a := range req.Actions {
+                if !models.IsRegisteredPermission(a.Permission) || a.Resource == "" {
+                        http.Error(w, fmt.Sprintf("Invalid action: %s", a.Permission), http.StatusBadRequest)
+                        return
+                }
+        }
+
+        token, approval, err := handlers.RequestApproval(r.Context(), req.Actions, req.Supervisor, req.Password, req.Reason)
+        if err != nil {
+                http.Error(w, fmt.Sprintf("Approval failed: %v", err), http.StatusForbidden)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "token":       token,
+                "approved_by": approval.ApprovedBy,
+                "expires_at":  approval.ExpiresAt,
+        })
+}
+
+// authorizeRestrictedActions checks that the user may perform the restricted actions, requiring
+// the approval token from the X-Approval-Token header if needed. It writes an error response and
+// returns false if the request must not proceed, otherwise it returns the token for the action
+// to use up in its transaction, or "" if no approval is needed.
+func authorizeRestrictedActions(w http.ResponseWriter, r *http.Request, actions []models.RestrictedAction) (string, bool) {
+        user, ok := r.Context().Value("user").(*models.User)
+        if !ok {
+                http.Error(w, "Unauthorized: insufficient permissions", http.StatusForbidden)
+                return "", false
+        }
+
+        if len(auth.PendingApprovals(user, actions)) == 0 {
+                return "", true
+        }
+
+        token := r.Header.Get(approvalHeader)
+        if token == "" {
+                // Tell the client exactly what to get approved, so it can request a token from /approvals
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusForbidden)
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                        "error":   auth.ErrApprovalRequired.Error(),
+                        "header":  approvalHeader,
+                        "actions": actions,
+                })
+                return "", false
+        }
+
+        return token, true
+}
+
 func handleSalesReport(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodGet {
                 http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -530,3 +791,68 @@ func handleDailySalesReport(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(response)
 }
+
+// handleStaffReport returns sales, refund, discount and commission figures per cashier.
+// The optional start_date and end_date query parameters limit the period (YYYY-MM-DD).
+func handleStaffReport(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        startDate := r.URL.Query().Get("start_date")
+        endDate := r.URL.Query().Get("end_date")
+        for _, date := range []string{startDate, endDate} {
+                if date == "" {
+                        continue
+                }
+                if _, err := time.Parse("2006-01-02", date); err != nil {
+                        http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+                        return
+                }
+        }
+
+        results, err := db.GetStaffPerformance(startDate, endDate)
+        if err != nil {
+                http.Error(w, fmt.Sprintf("Failed to get staff report: %v", err), http.StatusInternalServerError)
+                return
+        }
+
+        var items []map[string]interface{}
+        var totalRevenue, totalCommission float64
+        var totalTransactions int
+        for _, p := range results {
+                totalRevenue += p.Revenue
+                totalCommission += p.Commission
+                totalTransactions += p.Transactions
+
+                items = append(items, map[string]interface{}{
+                        "userId":              p.UserID,
+                        "username":            p.Username,
+                        "role":                p.Role,
+                        "transactions":        p.Transactions,
+                        "revenue":             p.Revenue,
+                        "items":               p.Items,
+                        "averageBasket":       p.AverageBasket(),
+                        "itemsPerTransaction": p.ItemsPerTransaction(),
+                        "refunds":             p.Refunds,
+                        "refundRate":          p.RefundRate(),
+                        "discountedSales":     p.DiscountedSales,
+                        "discountRate":        p.DiscountRate(),
+                        "discountTotal":       p.DiscountTotal,
+                        "commission":          p.Commission,
+                })
+        }
+
+        response := map[string]interface{}{
+                "startDate":         startDate,
+                "endDate":           endDate,
+                "items":             items,
+                "totalRevenue":      totalRevenue,
+                "totalTransactions": totalTransactions,
+                "totalCommission":   totalCommission,
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+        "encoding/json"
+        "errors"
+        "fmt"
+        "net/http"
+        "strings"
+        "time"
+
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/models"
+)
+
+// bearerToken extracts the token from a "Bearer <token>" Authorization header
+func bearerToken(r *http.Request) (string, error) {
+        authHeader := r.Header.Get("Authorization")
+        if authHeader == "" {
+                return "", fmt.Errorf("Authorization header required")
+        }
+
+        // Expected format: "Bearer <token>"
+        parts := strings.Split(authHeader, " ")
+        if len(parts) != 2 || parts[0] != "Bearer" {
+                return "", fmt.Errorf("Invalid authorization format, expected 'Bearer <token>'")
+        }
+
+        return parts[1], nil
+}
+
+// authenticateRequest validates the access token of a request and returns the user it was
+// issued to. Tokens that were logged out, or issued before the user's tokens were revoked,
+// are rejected, and the user's current role is used rather than the one in the token.
+func authenticateRequest(r *http.Request) (*models.User, *auth.Claims, error) {
+        tokenString, err := bearerToken(r)
+        if err != nil {
+                return nil, nil, err
+        }
+
+        claims, err := auth.ValidateJWT(tokenString)
+        if err != nil {
+                return nil, nil, fmt.Errorf("Invalid token: %v", err)
+        }
+
+        revoked, err := db.IsAccessTokenRevoked(claims.ID)
+        if err != nil {
+                return nil, nil, err
+        }
+        if revoked {
+                return nil, nil, fmt.Errorf("Invalid token: token has been revoked")
+        }
+
+        user, err := db.GetUserByID(claims.UserID)
+        if err != nil || !user.Active {
+                return nil, nil, fmt.Errorf("Invalid token: user account is not active")
+        }
+
+        security, err := db.GetUserSecurity(user.ID)
+        if err != nil {
+                return nil, nil, err
+        }
+        if security.TokenRevoked(claims.IssuedAt.Time) {
+                return nil, nil, fmt.Errorf("Invalid token: token has been revoked")
+        }
+
+        return &user, claims, nil
+}
+
+// apiKeyHeader carries an API key for clients that do not send it as a bearer token
+const apiKeyHeader = "X-API-Key"
+
+// requestAPIKey returns the API key a request was made with, if any
+func requestAPIKey(r *http.Request) string {
+        if key := r.Header.Get(apiKeyHeader); key != "" {
+                return key
+        }
+        if token, err := bearerToken(r); err == nil && strings.HasPrefix(token, models.APIKeyPrefix) {
+                return token
+        }
+        return ""
+}
+
+// authenticateAPIKey checks the API key of a request and records its use. The returned
+// user is limited to the key's scopes.
+func authenticateAPIKey(r *http.Request, apiKey string) (*models.User, models.APIKey, error) {
+        key, err := db.UseAPIKey(auth.HashToken(apiKey), r.RemoteAddr)
+        if err != nil {
+                return nil, models.APIKey{}, err
+        }
+        return key.User(), key, nil
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+        http.ResponseWriter
+        status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+        rec.status = status
+        rec.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses, such as /events
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+        return rec.ResponseWriter
+}
+
+// auditAPIKeyRequest records a request made with an API key in the audit log
+func auditAPIKeyRequest(r *http.Request, key models.APIKey, status int) {
+        db.AddAuditLog(key.Username(), db.ActionAccess, "api_key", fmt.Sprintf("%d", key.ID),
+                fmt.Sprintf("%s %s with API key %s: %d %s", r.Method, r.URL.Path, key.Name, status, http.StatusText(status)),
+                "", "", r.RemoteAddr, fmt.Sprintf("prefix=%s", key.Prefix))
+}
+
+// issueTokens responds with a new access token and refresh token for a user. A refresh
+// token rotated from an earlier one keeps its family, a new login starts one.
+func issueTokens(w http.ResponseWriter, user *models.User, refreshToken string) {
+        security := securitySettings()
+
+        userSecurity, err := db.GetUserSecurity(user.ID)
+        if err != nil {
+                http.Error(w, fmt.Sprintf("Failed to generate token: %v", err), http.StatusInternalServerError)
+                return
+        }
+        issuedAt := userSecurity.TokenIssueTime(time.Now())
+
+        accessToken, claims, err := auth.GenerateJWTAt(user.ID, user.Username, string(user.Role), issuedAt, security.AccessTokenTTL())
+        if err != nil {
+                http.Error(w, fmt.Sprintf("Failed to generate token: %v", err), http.StatusInternalServerError)
+                return
+        }
+
+        response := map[string]interface{}{
+                "token":         accessToken,
+                "access_token":  accessToken,
+                "refresh_token": refreshToken,
+                "token_type":    "Bearer",
+                "expires_in":    int(time.Until(claims.ExpiresAt.Time).Seconds()),
+                "user": map[string]interface{}{
+                        "id":       user.ID,
+                        "username": user.Username,
+                        "role":     user.Role,
+                },
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(response)
+}
+
+// newRefreshToken stores a refresh token for a user that starts a new family
+func newRefreshToken(userID int, ipAddress string) (string, error) {
+        token, err := auth.GenerateToken("rft_")
+        if err != nil {
+                return "", err
+        }
+        familyID, err := auth.GenerateToken("")
+        if err != nil {
+                return "", err
+        }
+
+        expiresAt := time.Now().Add(securitySettings().RefreshTokenTTL())
+        if err := db.CreateRefreshToken(userID, auth.HashToken(token), familyID, ipAddress, expiresAt); err != nil {
+                return "", err
+        }
+        return token, nil
+}
+
+// handleRefresh exchanges a refresh token for a new access token and refresh token
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        var body struct {
+                RefreshToken string `json:"refresh_token"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+                http.Error(w, "refresh_token is required", http.StatusBadRequest)
+                return
+        }
+
+        newToken, err := auth.GenerateToken("rft_")
+        if err != nil {
+                http.Error(w, fmt.Sprintf("Failed to generate token: %v", err), http.StatusInternalServerError)
+                return
+        }
+
+        expiresAt := time.Now().Add(securitySettings().RefreshTokenTTL())
+        userID, err := db.RotateRefreshToken(auth.HashToken(body.RefreshToken), auth.HashToken(newToken), r.RemoteAddr, expiresAt)
+        if errors.Is(err, db.ErrRefreshTokenReused) {
+                username := fmt.Sprintf("user %d", userID)
+                if user, err := db.GetUserByID(userID); err == nil {
+                        username = user.Username
+                }
+                db.AddAuditLog(username, db.ActionLogout, "user", fmt.Sprintf("%d", userID),
+                        fmt.Sprintf("Refresh token reuse detected for %s, tokens from that login revoked", username), "", "", r.RemoteAddr, "")
+                http.Error(w, err.Error(), http.StatusUnauthorized)
+                return
+        }
+        if errors.Is(err, db.ErrRefreshTokenInvalid) {
+                http.Error(w, err.Error(), http.StatusUnauthorized)
+                return
+        }
+        if err != nil {
+                http.Error(w, fmt.Sprintf("Failed to refresh token: %v", err), http.StatusInternalServerError)
+                return
+        }
+
+        user, err := db.GetUserByID(userID)
+        if err != nil || !user.Active {
+                http.Error(w, "User account is not active", http.StatusUnauthorized)
+                return
+        }
+
+        issueTokens(w, &user, newToken)
+}
+
+// handleLogout revokes the access token of the request and, when given, the refresh token
+// of the same login. With "all" every token issued to the user is revoked.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        user, claims, err := authenticateRequest(r)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusUnauthorized)
+                return
+        }
+
+        var body struct {
+                RefreshToken string `json:"refresh_token"`
+                All          bool   `json:"all"`
+        }
+        if r.ContentLength != 0 {
+                if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+                        http.Error(w, "Invalid request body", http.StatusBadRequest)
+                        return
+                }
+        }
+
+        if err := db.RevokeAccessToken(claims.ID, user.ID, claims.ExpiresAt.Time); err != nil {
+                http.Error(w, fmt.Sprintf("Failed to log out: %v", err), http.StatusInternalServerError)
+                return
+        }
+
+        description := fmt.Sprintf("User %s logged out of the agent API", user.Username)
+        if body.All {
+                if err := db.RevokeUserTokens(user.ID); err != nil {
+                        http.Error(w, fmt.Sprintf("Failed to log out: %v", err), http.StatusInternalServerError)
+                        return
+                }
+                description = fmt.Sprintf("User %s logged out of every agent API session", user.Username)
+        } else if body.RefreshToken != "" {
+                if err := db.RevokeRefreshToken(user.ID, auth.HashToken(body.RefreshToken)); err != nil {
+                        http.Error(w, fmt.Sprintf("Failed to log out: %v", err), http.StatusInternalServerError)
+                        return
+                }
+        }
+
+        db.AddAuditLog(user.Username, db.ActionLogout, "user", fmt.Sprintf("%d", user.ID), description, "", "", r.RemoteAddr, "")
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{"status": "logged out"})
+}
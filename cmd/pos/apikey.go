@@ -0,0 +1,199 @@
+package main
+
+import (
+        "fmt"
+        "os"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/olekukonko/tablewriter"
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/models"
+)
+
+var (
+        apiKeyCmd = &cobra.Command{
+                Use:   "apikey",
+                Short: "Manage API keys for integrations",
+                Long: `API keys let integrations such as an e-commerce sync or a dashboard call the agent
+API without logging in as a person. Send the key in the X-API-Key header, or as a
+bearer token in the Authorization header.
+
+A key can only do what its scopes allow. Scopes are permission names, and you can only
+grant scopes you hold yourself. Every request made with a key is recorded in the audit
+log under apikey:<name>.`,
+        }
+
+        apiKeyCreateCmd = &cobra.Command{
+                Use:   "create [name]",
+                Short: "Create an API key",
+                Long: `Create an API key, for example:
+
+  pos apikey create webshop --scopes products:read,sales:create --expires 90d
+
+The key is only shown once. Use --expires never for a key that does not expire.`,
+                Args: cobra.ExactArgs(1),
+                RunE: runAPIKeyCreate,
+        }
+
+        apiKeyListCmd = &cobra.Command{
+                Use:   "list",
+                Short: "List API keys",
+                Args:  cobra.NoArgs,
+                RunE:  runAPIKeyList,
+        }
+
+        apiKeyRevokeCmd = &cobra.Command{
+                Use:   "revoke [key_id]",
+                Short: "Revoke an API key",
+                Args:  cobra.ExactArgs(1),
+                RunE:  runAPIKeyRevoke,
+        }
+)
+
+// runAPIKeyCreate handles the apikey create command
+func runAPIKeyCreate(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("apikey:manage"); err != nil {
+                return err
+        }
+        session := auth.GetCurrentUser()
+
+        name := strings.TrimSpace(args[0])
+        if name == "" {
+                return fmt.Errorf("API key name cannot be empty")
+        }
+
+        scopeList, _ := cmd.Flags().GetString("scopes")
+        scopes, err := models.ParseScopes(scopeList)
+        if err != nil {
+                return err
+        }
+
+        // A key cannot do more than the person who created it
+        creator := &models.User{ID: session.UserID, Username: session.Username, Role: session.Role}
+        for _, scope := range scopes {
+                if !auth.HasPermission(creator, scope) {
+                        return fmt.Errorf("you cannot grant the %s scope because you do not have that permission", scope)
+                }
+        }
+
+        expires, _ := cmd.Flags().GetString("expires")
+        lifetime, err := models.ParseKeyLifetime(expires)
+        if err != nil {
+                return err
+        }
+
+        secret, err := auth.GenerateToken(models.APIKeyPrefix)
+        if err != nil {
+                return err
+        }
+
+        key := models.APIKey{
+                Name:      name,
+                Prefix:    models.APIKeyDisplayPrefix(secret),
+                Scopes:    scopes,
+                CreatedBy: session.Username,
+        }
+        if lifetime > 0 {
+                key.ExpiresAt = time.Now().Add(lifetime)
+        }
+
+        key, err = db.CreateAPIKey(key, auth.HashToken(secret))
+        if err != nil {
+                return err
+        }
+
+        LogAPIKeyAction(session, db.ActionCreate, key.ID, fmt.Sprintf("Created API key %s with scopes %s", key.Name, strings.Join(key.Scopes, ",")), nil, key)
+
+        fmt.Printf("API key %d created for %s\n", key.ID, key.Name)
+        fmt.Printf("Scopes:  %s\n", strings.Join(key.Scopes, ", "))
+        fmt.Printf("Expires: %s\n", formatKeyExpiry(key))
+        fmt.Printf("\n  %s\n\n", secret)
+        fmt.Println("Store the key now, it cannot be shown again.")
+        return nil
+}
+
+// formatKeyExpiry describes when an API key expires
+func formatKeyExpiry(key models.APIKey) string {
+        if key.ExpiresAt.IsZero() {
+                return "never"
+        }
+        return key.ExpiresAt.Format("2006-01-02 15:04")
+}
+
+// runAPIKeyList handles the apikey list command
+func runAPIKeyList(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("apikey:manage"); err != nil {
+                return err
+        }
+
+        keys, err := db.ListAPIKeys()
+        if err != nil {
+                return err
+        }
+        if len(keys) == 0 {
+                fmt.Println("No API keys found")
+                return nil
+        }
+
+        now := time.Now()
+        table := tablewriter.NewWriter(os.Stdout)
+        table.SetHeader([]string{"ID", "Name", "Key", "Scopes", "Status", "Expires", "Last Used", "Created By"})
+        table.SetBorder(false)
+        for _, k := range keys {
+                lastUsed := "never"
+                if !k.LastUsedAt.IsZero() {
+                        lastUsed = fmt.Sprintf("%s from %s", k.LastUsedAt.Format("2006-01-02 15:04"), k.LastUsedIP)
+                }
+                table.Append([]string{
+                        strconv.Itoa(k.ID),
+                        k.Name,
+                        k.Prefix + "...",
+                        strings.Join(k.Scopes, ", "),
+                        k.Status(now),
+                        formatKeyExpiry(k),
+                        lastUsed,
+                        k.CreatedBy,
+                })
+        }
+        table.Render()
+        return nil
+}
+
+// runAPIKeyRevoke handles the apikey revoke command
+func runAPIKeyRevoke(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("apikey:manage"); err != nil {
+                return err
+        }
+        session := auth.GetCurrentUser()
+
+        id, err := strconv.Atoi(args[0])
+        if err != nil {
+                return fmt.Errorf("invalid key ID: %w", err)
+        }
+
+        key, err := db.GetAPIKey(id)
+        if err != nil {
+                return err
+        }
+        if err := db.RevokeAPIKey(id); err != nil {
+                return err
+        }
+
+        LogAPIKeyAction(session, db.ActionUpdate, key.ID, fmt.Sprintf("Revoked API key %s", key.Name), key, nil)
+        fmt.Printf("API key %d (%s) revoked\n", key.ID, key.Name)
+        return nil
+}
+
+func init() {
+        rootCmd.AddCommand(apiKeyCmd)
+        apiKeyCmd.AddCommand(apiKeyCreateCmd)
+        apiKeyCmd.AddCommand(apiKeyListCmd)
+        apiKeyCmd.AddCommand(apiKeyRevokeCmd)
+
+        apiKeyCreateCmd.Flags().String("scopes", "", "Comma-separated permissions the key may use, e.g. products:read,sales:create")
+        apiKeyCreateCmd.Flags().String("expires", "90d", "How long the key is valid, e.g. 90d, 12h or never")
+}
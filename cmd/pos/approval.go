@@ -0,0 +1,203 @@
+package main
+
+import (
+        "bufio"
+        "fmt"
+        "os"
+        "strconv"
+        "strings"
+
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/handlers"
+        "termpos/internal/models"
+)
+
+var (
+        // Approve command flags
+        approveFor      string
+        approveReason   string
+        approveDiscount float64
+        approvePrice    float64
+)
+
+// approveCmd represents the approve command
+var approveCmd = &cobra.Command{
+        Use:   "approve",
+        Short: "Issue supervisor approvals for restricted actions",
+        Long: `Issue a single-use approval token that lets another user perform one restricted
+action, such as a refund, price override or large discount. The token is bound to
+that user and action and expires after the configured approval timeout.
+
+Cashiers can also get approval at their own terminal: the restricted command asks
+for a supervisor's username and password.`,
+}
+
+// approveRefundCmd issues an approval for refunding a sale
+var approveRefundCmd = &cobra.Command{
+        Use:   "refund [sale_id]",
+        Short: "Approve a refund",
+        Long:  `Issue an approval token for another user to refund a sale.`,
+        Args:  cobra.ExactArgs(1),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                saleID, err := strconv.Atoi(args[0])
+                if err != nil {
+                        return fmt.Errorf("invalid sale ID: %w", err)
+                }
+
+                return issueApproval([]models.RestrictedAction{handlers.RefundRestrictedAction(saleID)})
+        },
+}
+
+// approveSaleCmd issues an approval for a sale with a price override or large discount
+var approveSaleCmd = &cobra.Command{
+        Use:   "sale [product_id] [quantity]",
+        Short: "Approve a price override or large discount",
+        Long: `Issue an approval token for another user to sell a product with a price override
+or a discount above the configured limit. The price, discount and quantity must match
+the sale exactly, for example:
+
+  pos approve sale 3 2 --discount 15 --for alice
+  pos sell 3 2 --discount 15 --approval apv_...`,
+        Args: cobra.ExactArgs(2),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                productID, err := strconv.Atoi(args[0])
+                if err != nil {
+                        return fmt.Errorf("invalid product ID: %w", err)
+                }
+
+                quantity, err := strconv.Atoi(args[1])
+                if err != nil {
+                        return fmt.Errorf("invalid quantity: %w", err)
+                }
+
+                actions, err := handlers.SaleRestrictedActions(models.Sale{
+                        ProductID:      productID,
+                        Quantity:       quantity,
+                        DiscountAmount: approveDiscount,
+                        PriceOverride:  approvePrice,
+                })
+                if err != nil {
+                        return err
+                }
+                if len(actions) == 0 {
+                        fmt.Println("This sale does not need supervisor approval")
+                        return nil
+                }
+
+                return issueApproval(actions)
+        },
+}
+
+// issueApproval issues an approval token from the logged in supervisor to the user given by --for
+func issueApproval(actions []models.RestrictedAction) error {
+        session := auth.GetCurrentUser()
+        if session == nil {
+                return fmt.Errorf("you must be logged in to approve actions")
+        }
+
+        for _, a := range actions {
+                if err := auth.RequirePermission(a.Permission); err != nil {
+                        return fmt.Errorf("you don't have permission to approve %s", a.Description)
+                }
+        }
+
+        if approveFor == "" {
+                return fmt.Errorf("specify the user the approval is for with --for")
+        }
+        if approveFor == session.Username {
+                return fmt.Errorf("you don't need an approval for your own actions")
+        }
+        if _, err := db.GetUserByUsername(approveFor); err != nil {
+                return fmt.Errorf("user '%s' not found", approveFor)
+        }
+
+        token, approval, err := handlers.IssueApproval(auditContext(session), actions, approveFor, approveReason)
+        if err != nil {
+                return err
+        }
+
+        fmt.Printf("Approved for %s:\n", approveFor)
+        for _, a := range actions {
+                fmt.Printf("  - %s\n", a.Description)
+        }
+        fmt.Printf("\nApproval token (single use, expires %s):\n%s\n", approval.ExpiresAt.Format("15:04:05"), token)
+        return nil
+}
+
+// requireApproval checks whether the current user may perform the restricted actions and,
+// if not, asks for a supervisor's credentials unless an approval token was given. It returns
+// the token for the action to use up, or "" if no approval is needed.
+func requireApproval(actions []models.RestrictedAction, token, reason string) (string, error) {
+        session := auth.GetCurrentUser()
+        if session == nil {
+                return "", fmt.Errorf("you must be logged in to perform this action")
+        }
+
+        user := models.User{
+                ID:       session.UserID,
+                Username: session.Username,
+                Role:     session.Role,
+        }
+
+        pending := auth.PendingApprovals(&user, actions)
+        if len(pending) == 0 {
+                return "", nil
+        }
+
+        if token == "" {
+                var err error
+                token, err = promptSupervisorApproval(actions, pending, reason)
+                if err != nil {
+                        return "", err
+                }
+        }
+
+        return token, nil
+}
+
+// promptSupervisorApproval asks a supervisor to enter their credentials and returns an approval token
+func promptSupervisorApproval(actions, pending []models.RestrictedAction, reason string) (string, error) {
+        fmt.Println("Supervisor approval required for:")
+        for _, a := range pending {
+                fmt.Printf("  - %s\n", a.Description)
+        }
+
+        reader := bufio.NewReader(os.Stdin)
+
+        fmt.Print("Supervisor username: ")
+        supervisor, err := reader.ReadString('\n')
+        if err != nil {
+                return "", fmt.Errorf("failed to read username: %w", err)
+        }
+        supervisor = strings.TrimSpace(supervisor)
+        if supervisor == "" {
+                return "", fmt.Errorf("approval cancelled")
+        }
+
+        fmt.Print("Supervisor password: ")
+        password, err := reader.ReadString('\n')
+        if err != nil {
+                return "", fmt.Errorf("failed to read password: %w", err)
+        }
+        password = strings.TrimSpace(password)
+
+        token, _, err := handlers.RequestApproval(auditContext(auth.GetCurrentUser()), actions, supervisor, password, reason)
+        if err != nil {
+                return "", fmt.Errorf("approval failed: %w", err)
+        }
+
+        return token, nil
+}
+
+func init() {
+        rootCmd.AddCommand(approveCmd)
+        approveCmd.AddCommand(approveRefundCmd)
+        approveCmd.AddCommand(approveSaleCmd)
+
+        approveCmd.PersistentFlags().StringVar(&approveFor, "for", "", "Username of the user the approval is for")
+        approveCmd.PersistentFlags().StringVar(&approveReason, "reason", "", "Reason for the approval")
+        approveSaleCmd.Flags().Float64Var(&approveDiscount, "discount", 0, "Discount amount being approved")
+        approveSaleCmd.Flags().Float64Var(&approvePrice, "price", 0, "Unit price override being approved")
+}
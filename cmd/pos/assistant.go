@@ -11,7 +11,6 @@ import (
 
         "termpos/internal/assistant"
         "termpos/internal/auth"
-        "termpos/internal/db"
 )
 
 // initAssistantCommand sets up the AI assistant mode command
@@ -63,7 +62,7 @@ func startAssistantMode() error {
                 password = strings.TrimSpace(scanner.Text())
                 
                 // Attempt login
-                _, err := auth.Login(username, password, db.GetUserByUsername, db.UpdateLastLogin)
+                _, err := authenticateInteractive(username, password, false)
                 if err != nil {
                         fmt.Printf("Login failed: %v\n", err)
                         return err
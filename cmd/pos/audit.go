@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
 	"termpos/internal/auth"
 	"termpos/internal/db"
+	"termpos/internal/syslog"
 )
 
 var (
@@ -24,8 +29,15 @@ var (
 	auditExport    string
 	auditPurge     int
 	auditStats     bool
+	auditArchives  string
+	auditEncrypt   bool
+	auditFormat    string
 )
 
+// auditKeyEnv names the environment variable holding the key audit checkpoints are signed
+// and verified with
+const auditKeyEnv = "TERMPOS_AUDIT_KEY"
+
 // auditCmd represents the audit command for managing and viewing audit logs
 var auditCmd = &cobra.Command{
 	Use:   "audit",
@@ -153,11 +165,17 @@ var auditViewCmd = &cobra.Command{
 		fmt.Printf("ID: %d\n", targetLog.ID)
 		fmt.Printf("Timestamp: %s\n", targetLog.Timestamp.Format(time.RFC3339))
 		fmt.Printf("User: %s\n", targetLog.Username)
+		if targetLog.ApprovedBy != "" {
+			fmt.Printf("Approved By: %s\n", targetLog.ApprovedBy)
+		}
 		fmt.Printf("Action: %s\n", targetLog.Action)
 		fmt.Printf("Resource Type: %s\n", targetLog.ResourceType)
 		fmt.Printf("Resource ID: %s\n", targetLog.ResourceID)
 		fmt.Printf("Description: %s\n", targetLog.Description)
 		
+		if targetLog.Source != "" {
+			fmt.Printf("Source: %s\n", targetLog.Source)
+		}
 		if targetLog.IPAddress != "" {
 			fmt.Printf("IP Address: %s\n", targetLog.IPAddress)
 		}
@@ -185,9 +203,12 @@ var auditViewCmd = &cobra.Command{
 // auditExportCmd exports audit logs
 var auditExportCmd = &cobra.Command{
 	Use:   "export [filepath]",
-	Short: "Export audit logs to a JSON file",
-	Long:  `Export audit logs to a JSON file with optional filtering by date range.`,
-	Args:  cobra.ExactArgs(1),
+	Short: "Export audit logs to a JSON, JSON lines or CSV file",
+	Long: `Export audit logs with the same filters as "pos audit list", oldest first. Entries
+are written as they are read, so large logs can be exported. The format is taken from
+--format, or from the file extension (.json, .jsonl or .csv). Use - as the filepath to
+write to standard output.`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		// Check if user has permission
 		session := auth.GetCurrentUser()
@@ -196,23 +217,51 @@ var auditExportCmd = &cobra.Command{
 			return
 		}
 
-		filepath := args[0]
-		err := db.ExportAuditLogs(filepath, auditStartDate, auditEndDate)
+		path := args[0]
+		format := auditFormat
+		if format == "" {
+			format = strings.TrimPrefix(filepath.Ext(path), ".")
+			if path == "-" || format == "" {
+				format = db.AuditExportJSON
+			}
+		}
+
+		out := os.Stdout
+		if path != "-" {
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				fmt.Printf("Error exporting audit logs: %v\n", err)
+				return
+			}
+			defer file.Close()
+			out = file
+		}
+
+		count, err := db.ExportAuditLogs(out, format, auditUsername, db.AuditAction(auditAction), auditResource, auditStartDate, auditEndDate)
 		if err != nil {
-			fmt.Printf("Error exporting audit logs: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Error exporting audit logs: %v\n", err)
 			return
 		}
 
-		fmt.Printf("Audit logs exported to %s\n", filepath)
+		if path != "-" {
+			fmt.Printf("%d audit logs exported to %s\n", count, path)
+		}
 	},
 }
 
-// auditPurgeCmd removes old audit logs
+// auditPurgeCmd archives and removes old audit logs
 var auditPurgeCmd = &cobra.Command{
 	Use:   "purge [days]",
-	Short: "Remove audit logs older than specified days",
-	Long:  `Delete audit logs that are older than the specified number of days.`,
-	Args:  cobra.ExactArgs(1),
+	Short: "Archive audit logs and remove those past their retention",
+	Long: `Archive the audit logs that may be past their retention to compressed JSON lines
+segment files in the archive directory, encrypted with POS_ENCRYPTION_KEY if --encrypt
+is set, then delete the archived entries whose retention expired.
+
+Retention is set per action with "pos audit retention set"; days, if given, is the
+retention of the actions without a policy of their own. The head of each segment is
+recorded, so "pos audit verify" still checks the remaining entries and, while the
+segment files are kept, the archived ones.`,
+	Args: cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		// Check if user has permission
 		session := auth.GetCurrentUser()
@@ -222,19 +271,33 @@ var auditPurgeCmd = &cobra.Command{
 		}
 
 		// Parse days
-		days, err := strconv.Atoi(args[0])
+		days := 0
+		if len(args) > 0 {
+			var err error
+			days, err = strconv.Atoi(args[0])
+			if err != nil {
+				fmt.Printf("Error: Invalid number of days: %v\n", err)
+				return
+			}
+
+			if days <= 0 {
+				fmt.Println("Error: Number of days must be positive")
+				return
+			}
+		}
+
+		shortest, err := db.ShortestAuditRetention(days)
 		if err != nil {
-			fmt.Printf("Error: Invalid number of days: %v\n", err)
+			fmt.Printf("Error reading retention policies: %v\n", err)
 			return
 		}
-
-		if days <= 0 {
-			fmt.Println("Error: Number of days must be positive")
+		if shortest == 0 {
+			fmt.Println("Error: No retention policy is set, pass the number of days or use \"pos audit retention set\"")
 			return
 		}
 
 		// Confirm action with user
-		fmt.Printf("WARNING: This will permanently delete audit logs older than %d days.\n", days)
+		fmt.Printf("WARNING: This will archive audit logs older than %d days to %s and delete those past their retention from the database.\n", shortest, auditArchives)
 		fmt.Print("Are you sure you want to continue? (y/N): ")
 		var confirm string
 		fmt.Scanln(&confirm)
@@ -243,17 +306,293 @@ var auditPurgeCmd = &cobra.Command{
 			return
 		}
 
-		// Purge old logs
-		count, err := db.PurgeOldAuditLogs(days)
+		// Archive, then purge old logs
+		opts := db.AuditArchiveOptions{Dir: auditArchives, Encrypt: auditEncrypt}
+		archives, err := db.ArchiveAuditLogs(time.Now().AddDate(0, 0, -shortest), opts, session.Username)
+		if err != nil && err != db.ErrNoAuditLogsToArchive {
+			fmt.Printf("Error archiving audit logs: %v\n", err)
+			return
+		}
+		for _, archive := range archives {
+			fmt.Printf("Archived entries %d to %d to %s (sha256 %s)\n", archive.FirstID, archive.LastID, archive.File, archive.SHA256)
+		}
+		if len(archives) > 0 {
+			head := archives[len(archives)-1]
+			fmt.Printf("Chain head: entry %d, %s\n", head.LastID, head.HeadHash)
+		}
+
+		count, err := db.ApplyAuditRetention(time.Now(), days, session.Username)
 		if err != nil {
 			fmt.Printf("Error purging audit logs: %v\n", err)
 			return
 		}
 
-		fmt.Printf("Successfully purged %d audit logs older than %d days\n", count, days)
+		fmt.Printf("Successfully purged %d audit logs past their retention\n", count)
 	},
 }
 
+// auditRetentionCmd shows and sets how long audit logs are kept
+var auditRetentionCmd = &cobra.Command{
+	Use:   "retention",
+	Short: "Show audit log retention policies",
+	Long: `Show how many days the audit logs of each action are kept before "pos audit purge"
+removes them. Actions without a policy follow the default policy.`,
+	Args: cobra.NoArgs,
+	RunE: runAuditRetentionList,
+}
+
+var auditRetentionSetCmd = &cobra.Command{
+	Use:   "set [action] [days]",
+	Short: "Set how many days the audit logs of an action are kept",
+	Long: `Set how many days the audit logs of an action are kept, e.g. "login 90" or
+"settings_change 2555". Use "default" as the action to set the retention of actions
+without a policy of their own.`,
+	Args: cobra.ExactArgs(2),
+	RunE: runAuditRetentionSet,
+}
+
+var auditRetentionRemoveCmd = &cobra.Command{
+	Use:   "remove [action]",
+	Short: "Remove the retention policy of an action",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runAuditRetentionRemove,
+}
+
+// auditForwardCmd forwards the audit log to syslog
+var auditForwardCmd = &cobra.Command{
+	Use:   "forward [address]",
+	Short: "Forward the audit log to syslog",
+	Long: `Send new audit log entries to a syslog receiver as RFC 5424 messages, until
+interrupted. The address is unix:///dev/log, or another path, for the local syslog
+daemon, or udp://host:514 or tcp://host:601 for a collector.
+
+The last entry sent is recorded under --name, so a restarted forwarder resumes where it
+stopped. A forwarder that never ran starts from the end of the log, or from its start
+with --from-start.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runAuditForward,
+}
+
+// runAuditRetentionList handles the audit retention command
+func runAuditRetentionList(cmd *cobra.Command, args []string) error {
+	if err := auth.RequirePermission("audit:view"); err != nil {
+		return err
+	}
+
+	policies, err := db.ListAuditRetention()
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		fmt.Println("No retention policies, audit logs are kept until purged")
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Action", "Days", "Updated By", "Updated"})
+	table.SetBorder(false)
+	for _, p := range policies {
+		table.Append([]string{string(p.Action), strconv.Itoa(p.Days), p.UpdatedBy, p.UpdatedAt.Format("2006-01-02 15:04")})
+	}
+	table.Render()
+	return nil
+}
+
+// runAuditRetentionSet handles the audit retention set command
+func runAuditRetentionSet(cmd *cobra.Command, args []string) error {
+	if err := auth.RequirePermission("audit:purge"); err != nil {
+		return err
+	}
+	session := auth.GetCurrentUser()
+
+	days, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid number of days: %w", err)
+	}
+	if err := db.SetAuditRetention(db.AuditAction(args[0]), days, session.Username); err != nil {
+		return err
+	}
+
+	fmt.Printf("Audit logs of %s are kept for %d days\n", args[0], days)
+	return nil
+}
+
+// runAuditRetentionRemove handles the audit retention remove command
+func runAuditRetentionRemove(cmd *cobra.Command, args []string) error {
+	if err := auth.RequirePermission("audit:purge"); err != nil {
+		return err
+	}
+	session := auth.GetCurrentUser()
+
+	if err := db.RemoveAuditRetention(db.AuditAction(args[0]), session.Username); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed the retention policy of %s\n", args[0])
+	return nil
+}
+
+// runAuditForward handles the audit forward command
+func runAuditForward(cmd *cobra.Command, args []string) error {
+	if err := auth.RequirePermission("audit:export"); err != nil {
+		return err
+	}
+
+	w, err := syslog.Dial(args[0])
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	name, _ := cmd.Flags().GetString("name")
+	fromStart, _ := cmd.Flags().GetBool("from-start")
+	forwarder := syslog.NewForwarder(name, w)
+	if err := forwarder.Start(fromStart); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Forwarding audit logs to %s, press Ctrl+C to stop\n", args[0])
+	forwarder.Run(ctx)
+	return nil
+}
+
+// auditVerifyCmd checks the audit log for modified and missing entries
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify the audit log has not been tampered with",
+	Long: `Verify the hash chain of the audit log. Each entry carries a hash of its content and
+of the entry before it, so an entry that was edited, or entries that were deleted
+or inserted, break the chain. Archived entries are checked from their archive files.
+
+With --checkpoints, also check that the log still matches the signed checkpoints of
+"pos audit checkpoint", which detects a chain that was rewritten as a whole. The
+checkpoints are verified with the key in ` + auditKeyEnv + `.`,
+	Args: cobra.NoArgs,
+	RunE: runAuditVerify,
+}
+
+// auditCheckpointCmd exports signed checkpoints of the audit log
+var auditCheckpointCmd = &cobra.Command{
+	Use:   "checkpoint [file]",
+	Short: "Append a signed checkpoint of the audit log to a file",
+	Long: `Append a checkpoint of the head of the audit chain to a JSON lines file, signed with
+the key in ` + auditKeyEnv + `. Keep the file away from the database, for example on
+another machine, so it can show the log was not rewritten since.
+
+With --every, keep appending a checkpoint at that interval until interrupted.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runAuditCheckpoint,
+}
+
+// loadAuditKey returns the key audit checkpoints are signed with
+func loadAuditKey() ([]byte, error) {
+	key := os.Getenv(auditKeyEnv)
+	if key == "" {
+		return nil, fmt.Errorf("%s must be set to sign and verify audit checkpoints", auditKeyEnv)
+	}
+	if len(key) < auth.MinJWTSecretLength {
+		return nil, fmt.Errorf("%s must be at least %d bytes long", auditKeyEnv, auth.MinJWTSecretLength)
+	}
+	return []byte(key), nil
+}
+
+// runAuditVerify handles the audit verify command
+func runAuditVerify(cmd *cobra.Command, args []string) error {
+	if err := auth.RequirePermission("audit:view"); err != nil {
+		return err
+	}
+
+	var checkpoints []db.AuditCheckpoint
+	if path, _ := cmd.Flags().GetString("checkpoints"); path != "" {
+		key, err := loadAuditKey()
+		if err != nil {
+			return err
+		}
+		if checkpoints, err = db.ReadAuditCheckpoints(path); err != nil {
+			return err
+		}
+		for i, cp := range checkpoints {
+			if err := cp.VerifySignature(key); err != nil {
+				return fmt.Errorf("checkpoint %d of %s: %w", i+1, path, err)
+			}
+		}
+	}
+
+	archiveDir, _ := cmd.Flags().GetString("archive-dir")
+	result, err := db.VerifyAuditChain(archiveDir, checkpoints)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checked %d audit log entries and %d archived entries\n", result.Entries, result.Archived)
+	if len(checkpoints) > 0 {
+		fmt.Printf("Checked %d checkpoints\n", len(checkpoints))
+	}
+	fmt.Printf("Chain head: entry %d, %s\n", result.HeadID, result.HeadHash)
+	if result.OK() {
+		fmt.Println("The audit log is intact")
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Entry", "Problem", "Detail"})
+	table.SetBorder(false)
+	for _, p := range result.Problems {
+		table.Append([]string{fmt.Sprintf("%d", p.ID), p.Kind, p.Detail})
+	}
+	table.Render()
+
+	return fmt.Errorf("the audit log failed verification with %d problems", len(result.Problems))
+}
+
+// runAuditCheckpoint handles the audit checkpoint command
+func runAuditCheckpoint(cmd *cobra.Command, args []string) error {
+	if err := auth.RequirePermission("audit:export"); err != nil {
+		return err
+	}
+	key, err := loadAuditKey()
+	if err != nil {
+		return err
+	}
+
+	checkpoint := func() error {
+		cp, err := db.NewAuditCheckpoint(key)
+		if err != nil {
+			return err
+		}
+		if err := db.AppendAuditCheckpoint(args[0], cp); err != nil {
+			return err
+		}
+		fmt.Printf("Checkpoint of entry %d (%s) appended to %s\n", cp.LastID, cp.Hash, args[0])
+		return nil
+	}
+
+	every, _ := cmd.Flags().GetDuration("every")
+	if every <= 0 {
+		return checkpoint()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	fmt.Printf("Appending a checkpoint every %s, press Ctrl+C to stop\n", every)
+	for {
+		if err := checkpoint(); err != nil {
+			fmt.Fprintf(os.Stderr, "audit: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
 // auditStatsCmd shows statistics about audit logs
 var auditStatsCmd = &cobra.Command{
 	Use:   "stats",
@@ -317,6 +656,12 @@ func init() {
 	auditCmd.AddCommand(auditExportCmd)
 	auditCmd.AddCommand(auditPurgeCmd)
 	auditCmd.AddCommand(auditStatsCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+	auditCmd.AddCommand(auditCheckpointCmd)
+	auditCmd.AddCommand(auditRetentionCmd)
+	auditRetentionCmd.AddCommand(auditRetentionSetCmd)
+	auditRetentionCmd.AddCommand(auditRetentionRemoveCmd)
+	auditCmd.AddCommand(auditForwardCmd)
 
 	// Add flags to audit list command
 	auditListCmd.Flags().StringVar(&auditStartDate, "start", "", "Start date (YYYY-MM-DD)")
@@ -330,4 +675,21 @@ func init() {
 	// Add flags to audit export command
 	auditExportCmd.Flags().StringVar(&auditStartDate, "start", "", "Start date (YYYY-MM-DD)")
 	auditExportCmd.Flags().StringVar(&auditEndDate, "end", "", "End date (YYYY-MM-DD)")
-}
\ No newline at end of file
+	auditExportCmd.Flags().StringVar(&auditUsername, "user", "", "Filter by username")
+	auditExportCmd.Flags().StringVar(&auditAction, "action", "", "Filter by action type")
+	auditExportCmd.Flags().StringVar(&auditResource, "resource", "", "Filter by resource type")
+	auditExportCmd.Flags().StringVar(&auditFormat, "format", "", "Export format: json, jsonl or csv")
+
+	// Add flags to audit purge and verify commands
+	auditPurgeCmd.Flags().StringVar(&auditArchives, "archive-dir", "audit-archive", "Directory the purged audit logs are archived to")
+	auditPurgeCmd.Flags().BoolVar(&auditEncrypt, "encrypt", false, "Encrypt the archive segments with POS_ENCRYPTION_KEY")
+	auditVerifyCmd.Flags().String("archive-dir", "", "Directory to read archive files from, if they were moved")
+	auditVerifyCmd.Flags().String("checkpoints", "", "File of signed checkpoints to check the log against")
+
+	// Add flags to audit checkpoint command
+	auditCheckpointCmd.Flags().Duration("every", 0, "Keep appending a checkpoint at this interval")
+
+	// Add flags to audit forward command
+	auditForwardCmd.Flags().String("name", "syslog", "Name the position of the forwarder is recorded under")
+	auditForwardCmd.Flags().Bool("from-start", false, "Start from the oldest entry if the forwarder never ran")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+        "context"
         "fmt"
         "strconv"
 
@@ -12,6 +13,17 @@ import (
 // Integrates audit logging with POS system actions
 // This file adds audit log helpers and integration points
 
+// auditContext returns a context whose changes are audited as made by the session's user
+// from the command line. Changes made through internal/db are recorded there, the Log
+// helpers below are for actions that do not go through it.
+func auditContext(session *auth.Session) context.Context {
+        actor := db.Actor{Source: db.SourceCLI}
+        if session != nil {
+                actor.Username = session.Username
+        }
+        return db.WithActor(context.Background(), actor)
+}
+
 // LogProductAction logs product management actions
 func LogProductAction(session *auth.Session, action db.AuditAction, productID int, description string, oldData, newData interface{}) error {
         if session == nil {
@@ -39,6 +51,25 @@ func LogUserAction(session *auth.Session, action db.AuditAction, userID int, des
         return db.LogDataChange(username, action, "user", strconv.Itoa(userID), description, oldData, newData)
 }
 
+
+// LogAPIKeyAction logs API keys being created and revoked
+func LogAPIKeyAction(session *auth.Session, action db.AuditAction, keyID int, description string, oldData, newData interface{}) error {
+        username := "system"
+        if session != nil {
+                username = session.Username
+        }
+        return db.LogDataChange(username, action, "api_key", strconv.Itoa(keyID), description, oldData, newData)
+}
+
+// LogWebhookAction logs webhooks being added and removed
+func LogWebhookAction(session *auth.Session, action db.AuditAction, webhookID int, description string, oldData, newData interface{}) error {
+        username := "system"
+        if session != nil {
+                username = session.Username
+        }
+        return db.LogDataChange(username, action, "webhook", strconv.Itoa(webhookID), description, oldData, newData)
+}
+
 // LogLoginAction logs login attempts
 func LogLoginAction(username string, success bool, ipAddress string) error {
         action := db.ActionLogin
@@ -293,4 +324,4 @@ func initAuditIntegration() {
         // deleteProductCmd.Run = deleteProductWithAudit
         // updateProductCmd.Run = updateProductWithAudit
         // sellCmd.Run = sellWithAudit
-}
\ No newline at end of file
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+        "errors"
         "fmt"
         "os"
         "path/filepath"
+        "sort"
         "strings"
         "time"
 
+        "github.com/olekukonko/tablewriter"
         "github.com/spf13/cobra"
         "termpos/internal/auth"
+        "termpos/internal/backup"
         "termpos/internal/db"
         "termpos/internal/security"
 )
@@ -25,6 +29,14 @@ var (
         restoreFromPath  string
         scheduleBackup   bool
         scheduleInterval int
+
+        // Archived changes flags
+        archiveDir      string
+        archiveBase     bool
+        archiveEncrypt  bool
+        archiveKeep     int
+        restoreTo       string
+        restoreOutput   string
 )
 
 // enhancedBackupCmd represents the enhanced backup command
@@ -33,7 +45,11 @@ var enhancedBackupCmd = &cobra.Command{
         Short: "Create an enhanced backup with encryption",
         Long: `Create a backup of the POS database with encryption and enhanced options.
 This command allows for database encryption, compression, verification, 
-and rotation of backups.`,
+and rotation of backups.
+
+Backups are archives holding a snapshot of the database and a manifest with its schema
+version, row counts and SHA-256 checksum. They can be compressed with gzip and encrypted
+with AES-GCM, with a key derived from --password or wrapped by the master key.`,
         Args: cobra.MaximumNArgs(1),
         Run: func(cmd *cobra.Command, args []string) {
                 // Check if user has permission
@@ -66,9 +82,9 @@ and rotation of backups.`,
                 // Generate backup filename with timestamp
                 timestamp := time.Now().Format("20060102_150405")
                 if backupName == "" {
-                        backupName = fmt.Sprintf("pos_backup_%s.db", timestamp)
-                } else if !filepath.IsAbs(backupName) && !strings.HasSuffix(backupName, ".db") {
-                        backupName = backupName + ".db"
+                        backupName = fmt.Sprintf("pos_backup_%s%s", timestamp, backup.Extension)
+                } else if !filepath.IsAbs(backupName) && !strings.HasSuffix(backupName, backup.Extension) {
+                        backupName = backupName + backup.Extension
                 }
 
                 backupFilepath := filepath.Join(backupPath, backupName)
@@ -81,6 +97,10 @@ and rotation of backups.`,
                                         fmt.Printf("Warning: Failed to initialize encryption: %v\n", err)
                                         fmt.Println("Proceeding with unencrypted backup")
                                         encryptBackup = false
+                                } else if security.IsEphemeralKey() {
+                                        fmt.Printf("Warning: %v\n", security.ErrEphemeralKey)
+                                        fmt.Println("Proceeding with unencrypted backup")
+                                        encryptBackup = false
                                 }
                         }
                 }
@@ -94,44 +114,25 @@ and rotation of backups.`,
                         }
                 }
 
-                // Perform backup
+                // Perform backup, streaming the snapshot through compression and encryption
                 fmt.Println("Creating backup...")
-                err := db.BackupDatabaseViaVacuum(backupFilepath)
+                manifest, err := backup.Create(backupFilepath, backup.Manifest{
+                        AppVersion: Version,
+                        CreatedBy:  session.Username,
+                }, backup.Options{
+                        Compress: backupCompress,
+                        Encrypt:  encryptBackup,
+                        Password: backupPassword,
+                })
                 if err != nil {
                         fmt.Printf("Error creating backup: %v\n", err)
                         return
                 }
 
-                // Encrypt backup if requested
-                if encryptBackup {
-                        fmt.Println("Encrypting backup...")
-                        err = encryptBackupFile(backupFilepath, backupPassword)
-                        if err != nil {
-                                fmt.Printf("Error encrypting backup: %v\n", err)
-                                // Continue with unencrypted backup
-                        } else {
-                                // Rename to indicate encryption
-                                encryptedPath := backupFilepath + ".enc"
-                                if err := os.Rename(backupFilepath+".tmp", encryptedPath); err != nil {
-                                        fmt.Printf("Error finalizing encrypted backup: %v\n", err)
-                                } else {
-                                        backupFilepath = encryptedPath
-                                }
-                        }
-                }
-
-                // Compress backup if requested
-                if backupCompress {
-                        fmt.Println("Compressing backup...")
-                        // Compression logic would go here
-                        // For now, we'll just simulate it with a message
-                        fmt.Println("Compression not yet implemented")
-                }
-
                 // Verify backup if requested
                 if backupVerify {
                         fmt.Println("Verifying backup...")
-                        if err := verifyBackup(backupFilepath, encryptBackup); err != nil {
+                        if err := verifyBackup(backupFilepath, backupPassword); err != nil {
                                 fmt.Printf("Backup verification failed: %v\n", err)
                         } else {
                                 fmt.Println("Backup verified successfully")
@@ -177,12 +178,7 @@ and rotation of backups.`,
                                 settings.Backup.KeepBackupCount = backupRetention
 
                                 // Save settings
-                                username := "system"
-                                if session != nil {
-                                        username = session.Username
-                                }
-                                
-                                if err := db.SaveSettings(settings, username); err != nil {
+                                if err := db.SaveSettings(auditContext(session), settings); err != nil {
                                         fmt.Printf("Error scheduling backups: %v\n", err)
                                 } else {
                                         fmt.Printf("Automatic backups scheduled every %d hours\n", scheduleInterval)
@@ -194,12 +190,7 @@ and rotation of backups.`,
                 settings, err := db.GetSettings()
                 if err == nil {
                         settings.Backup.LastBackupTime = time.Now().Format(time.RFC3339)
-                        username := "system"
-                        if session != nil {
-                                username = session.Username
-                        }
-                        
-                        if err := db.SaveSettings(settings, username); err != nil {
+                        if err := db.SaveSettings(auditContext(session), settings); err != nil {
                                 fmt.Printf("Warning: Could not update last backup time: %v\n", err)
                         }
                 }
@@ -207,8 +198,8 @@ and rotation of backups.`,
                 // Log the backup creation in audit log
                 if session != nil {
                         description := fmt.Sprintf("Created backup at %s", backupFilepath)
-                        additionalInfo := fmt.Sprintf("encrypted=%t,compressed=%t,verified=%t",
-                                encryptBackup, backupCompress, backupVerify)
+                        additionalInfo := fmt.Sprintf("encrypted=%t,compressed=%t,verified=%t,sha256=%s",
+                                encryptBackup, backupCompress, backupVerify, manifest.SHA256)
                         
                         db.AddAuditLog(
                                 session.Username,
@@ -227,74 +218,43 @@ and rotation of backups.`,
         },
 }
 
-// encryptBackupFile encrypts a backup file
-func encryptBackupFile(filepath string, password string) error {
-        // Read the backup file
-        data, err := os.ReadFile(filepath)
-        if err != nil {
-                return fmt.Errorf("failed to read backup file: %w", err)
-        }
-
-        // Set custom encryption key if provided
-        if password != "" {
-                // For simplicity, we're not implementing custom password handling
-                // In a real implementation, you would use the password to derive a key
-                fmt.Println("Custom password encryption not implemented, using default key")
-        }
-
-        // Encrypt the data
-        encrypted, err := security.Encrypt(string(data))
-        if err != nil {
-                return fmt.Errorf("failed to encrypt backup: %w", err)
-        }
-
-        // Write to temporary file
-        tempFile := filepath + ".tmp"
-        err = os.WriteFile(tempFile, []byte(encrypted), 0644)
-        if err != nil {
-                return fmt.Errorf("failed to write encrypted backup: %w", err)
+// verifyBackup verifies a backup file: the checksum and manifest of a backup archive, and
+// the integrity of the database it holds or of an older plain or encrypted backup
+func verifyBackup(path string, password string) error {
+        if backup.IsArchive(path) {
+                _, err := backup.Verify(path, password)
+                return err
         }
 
-        return nil
-}
-
-// verifyBackup verifies a backup file
-func verifyBackup(filepath string, isEncrypted bool) error {
-        // For encrypted backups, try to decrypt
-        if isEncrypted {
-                // Read the encrypted backup
-                data, err := os.ReadFile(filepath)
+        // Older encrypted backups are decrypted to a temporary copy first
+        if filepath.Ext(path) == ".enc" {
+                temp, err := os.CreateTemp("", "termpos-verify-*.db")
                 if err != nil {
-                        return fmt.Errorf("failed to read encrypted backup: %w", err)
+                        return fmt.Errorf("failed to create temporary file: %w", err)
                 }
+                temp.Close()
+                defer os.Remove(temp.Name())
 
-                // Try to decrypt (this verifies the encryption is valid)
-                _, err = security.Decrypt(string(data))
-                if err != nil {
+                if err := decryptBackup(path, temp.Name()); err != nil {
                         return fmt.Errorf("backup verification failed (invalid encryption): %w", err)
                 }
+                path = temp.Name()
         }
 
-        // For all backups, check file integrity
-        // In a real implementation, you might check SQLite database integrity as well
-        fileInfo, err := os.Stat(filepath)
-        if err != nil {
-                return fmt.Errorf("failed to access backup file: %w", err)
-        }
-
-        if fileInfo.Size() == 0 {
-                return fmt.Errorf("backup file is empty")
-        }
-
-        return nil
+        _, err := db.InspectDatabaseFile(path)
+        return err
 }
 
 // restoreBackupCmd restores a database from a backup
 var restoreBackupCmd = &cobra.Command{
         Use:   "restore [path]",
         Short: "Restore database from a backup",
-        Long:  `Restore the POS database from a backup file, with support for encrypted backups.`,
-        Args:  cobra.ExactArgs(1),
+        Long: `Restore the POS database from a backup file, with support for encrypted backups.
+
+With --to, the database is instead rebuilt as it was at a time from the changes archived
+by 'pos backup archive'. It is written to a new file and checked against the checksum
+chain of the archived changes, and can then be restored like a backup file.`,
+        Args:  cobra.MaximumNArgs(1),
         Run: func(cmd *cobra.Command, args []string) {
                 // Check if user has permission
                 session := auth.GetCurrentUser()
@@ -303,7 +263,24 @@ var restoreBackupCmd = &cobra.Command{
                         return
                 }
 
+                // Point-in-time recovery from archived changes
+                if restoreTo != "" {
+                        if len(args) > 0 {
+                                fmt.Println("Error: --to restores archived changes, give their directory with --dir")
+                                return
+                        }
+                        if err := restoreToTime(session); err != nil {
+                                fmt.Printf("Error restoring archived changes: %v\n", err)
+                        }
+                        return
+                }
+                if len(args) == 0 {
+                        fmt.Println("Error: A backup file is required")
+                        return
+                }
+
                 backupPath := args[0]
+                source := backupPath
 
                 // Check if file exists
                 if _, err := os.Stat(backupPath); os.IsNotExist(err) {
@@ -311,7 +288,8 @@ var restoreBackupCmd = &cobra.Command{
                         return
                 }
 
-                // Check if it's an encrypted backup
+                // Check if it's an archive or an older encrypted backup
+                isArchive := backup.IsArchive(backupPath)
                 isEncrypted := false
                 if filepath.Ext(backupPath) == ".enc" {
                         isEncrypted = true
@@ -328,13 +306,40 @@ var restoreBackupCmd = &cobra.Command{
                         return
                 }
 
+                // Extract the database from an archive, checking it against its manifest
+                if isArchive {
+                        fmt.Println("Verifying backup...")
+                        if err := verifyBackup(backupPath, backupPassword); err != nil {
+                                fmt.Printf("Error verifying backup: %v\n", err)
+                                return
+                        }
+
+                        extracted, err := os.CreateTemp(filepath.Dir(db.GetDatabasePath()), ".restore-*.db")
+                        if err != nil {
+                                fmt.Printf("Error extracting backup: %v\n", err)
+                                return
+                        }
+                        _, err = backup.Extract(backupPath, backupPassword, extracted)
+                        if closeErr := extracted.Close(); err == nil {
+                                err = closeErr
+                        }
+                        if err != nil {
+                                os.Remove(extracted.Name())
+                                fmt.Printf("Error extracting backup: %v\n", err)
+                                return
+                        }
+
+                        // Use extracted file for restore
+                        backupPath = extracted.Name()
+                }
+
                 // Handle encrypted backup
                 if isEncrypted {
                         fmt.Println("Detected encrypted backup file")
                         
                         // Decrypt the backup
                         decryptedPath := backupPath + ".decrypted"
-                        if err := decryptBackup(backupPath, decryptedPath, backupPassword); err != nil {
+                        if err := decryptBackup(backupPath, decryptedPath); err != nil {
                                 fmt.Printf("Error decrypting backup: %v\n", err)
                                 return
                         }
@@ -357,7 +362,7 @@ var restoreBackupCmd = &cobra.Command{
 
                 // Log the restore operation in audit log
                 if session != nil {
-                        description := fmt.Sprintf("Restored database from backup at %s", backupPath)
+                        description := fmt.Sprintf("Restored database from backup at %s", source)
                         db.AddAuditLog(
                                 session.Username,
                                 db.ActionBackup,
@@ -372,7 +377,7 @@ var restoreBackupCmd = &cobra.Command{
                 }
 
                 // Clean up temporary decrypted file
-                if isEncrypted {
+                if isEncrypted || isArchive {
                         if err := os.Remove(backupPath); err != nil {
                                 fmt.Printf("Warning: Failed to clean up temporary decrypted file: %v\n", err)
                         }
@@ -382,29 +387,23 @@ var restoreBackupCmd = &cobra.Command{
         },
 }
 
-// decryptBackup decrypts a backup file
-func decryptBackup(encryptedPath, decryptedPath, password string) error {
+// decryptBackup decrypts a backup written by earlier versions, which always encrypted
+// backups with the master key
+func decryptBackup(encryptedPath, decryptedPath string) error {
         // Read the encrypted backup
         data, err := os.ReadFile(encryptedPath)
         if err != nil {
                 return fmt.Errorf("failed to read encrypted backup: %w", err)
         }
 
-        // Set custom decryption key if provided
-        if password != "" {
-                // For simplicity, we're not implementing custom password handling
-                // In a real implementation, you would use the password to derive a key
-                fmt.Println("Custom password decryption not implemented, using default key")
-        }
-
         // Decrypt the data
-        decrypted, err := security.Decrypt(string(data))
+        decrypted, err := decryptBackupData(data)
         if err != nil {
                 return fmt.Errorf("failed to decrypt backup: %w", err)
         }
 
         // Write to output file
-        err = os.WriteFile(decryptedPath, []byte(decrypted), 0644)
+        err = os.WriteFile(decryptedPath, decrypted, 0644)
         if err != nil {
                 return fmt.Errorf("failed to write decrypted backup: %w", err)
         }
@@ -471,7 +470,8 @@ var listBackupsCmd = &cobra.Command{
                         filename := file.Name()
                         if !strings.HasPrefix(filename, "pos_backup_") && 
                            !strings.HasSuffix(filename, ".db") && 
-                           !strings.HasSuffix(filename, ".enc") {
+                           !strings.HasSuffix(filename, ".enc") &&
+                           !strings.HasSuffix(filename, backup.Extension) {
                                 continue
                         }
 
@@ -486,6 +486,14 @@ var listBackupsCmd = &cobra.Command{
                         backupType := "Standard"
                         if strings.HasSuffix(filename, ".enc") {
                                 backupType = "Encrypted"
+                        } else if header, err := backup.ReadHeader(filepath.Join(backupPath, filename)); err == nil {
+                                backupType = "Archive"
+                                if header.Compressed {
+                                        backupType += ", gzip"
+                                }
+                                if header.Encryption != backup.EncryptionNone {
+                                        backupType += ", encrypted with " + header.Encryption.String()
+                                }
                         }
 
                         // Format size
@@ -513,13 +521,204 @@ var listBackupsCmd = &cobra.Command{
         },
 }
 
+// backupsCmd groups commands that work with backup files
+var backupsCmd = &cobra.Command{
+        Use:   "backup",
+        Short: "Work with backup files",
+}
+
+// backupVerifyCmd checks a backup file without restoring it
+var backupVerifyCmd = &cobra.Command{
+        Use:   "verify [path]",
+        Short: "Verify a backup file",
+        Long: `Verify a backup file without restoring it. The checksum of a backup archive is
+checked against its manifest, then the database it holds is decrypted to a temporary
+copy, checked with PRAGMA integrity_check and compared with the schema version and
+row counts recorded in the manifest. Older backups are checked for integrity only.`,
+        Args: cobra.ExactArgs(1),
+        RunE: runBackupVerify,
+}
+
+// runBackupVerify handles the backup verify command
+func runBackupVerify(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("setting:restore"); err != nil {
+                return err
+        }
+        path := args[0]
+
+        if !backup.IsArchive(path) {
+                if err := verifyBackup(path, ""); err != nil {
+                        return fmt.Errorf("backup verification failed: %w", err)
+                }
+                fmt.Printf("%s passed the integrity check, it has no manifest to verify\n", path)
+                return nil
+        }
+
+        manifest, err := backup.Verify(path, backupPassword)
+        if err != nil {
+                return fmt.Errorf("backup verification failed: %w", err)
+        }
+
+        fmt.Printf("%s verified successfully\n\n", path)
+        fmt.Printf("Created:        %s by %s\n", manifest.CreatedAt.Local().Format("2006-01-02 15:04:05"), manifest.CreatedBy)
+        fmt.Printf("App Version:    %s\n", manifest.AppVersion)
+        fmt.Printf("Schema Version: %d\n", manifest.SchemaVersion)
+        fmt.Printf("Size:           %.2f MB\n", float64(manifest.Size)/(1024*1024))
+        fmt.Printf("SHA-256:        %s\n\n", manifest.SHA256)
+
+        tables := make([]string, 0, len(manifest.Tables))
+        for table := range manifest.Tables {
+                tables = append(tables, table)
+        }
+        sort.Strings(tables)
+
+        table := tablewriter.NewWriter(os.Stdout)
+        table.SetHeader([]string{"Table", "Rows"})
+        for _, name := range tables {
+                table.Append([]string{name, fmt.Sprintf("%d", manifest.Tables[name])})
+        }
+        table.Render()
+        return nil
+}
+
+// backupArchiveCmd archives the changes to the database since the last archive
+var backupArchiveCmd = &cobra.Command{
+        Use:   "archive",
+        Short: "Archive the changes since the last archive for point-in-time recovery",
+        Long: `Archive the pages of the database that changed since the last archive, the same pages
+a WAL checkpoint writes to the database. Run it every few minutes, from cron for
+example, so 'pos restore --to' can rebuild the database as it was at any archived time.
+
+Changes are archived in chains. The first archive of a chain holds the whole database,
+and each one after it records the checksum of the database before and after it. Start
+a new chain with --base, daily for example, to keep chains short.`,
+        Args: cobra.NoArgs,
+        RunE: runBackupArchive,
+}
+
+// runBackupArchive handles the backup archive command
+func runBackupArchive(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("setting:backup"); err != nil {
+                return err
+        }
+        session := auth.GetCurrentUser()
+
+        if archiveEncrypt && security.IsEphemeralKey() {
+                return fmt.Errorf("cannot encrypt archived changes: %w", security.ErrEphemeralKey)
+        }
+
+        dir := archiveDirectory()
+        segment, err := backup.ArchiveChanges(dir, backup.Segment{
+                AppVersion: Version,
+                CreatedBy:  session.Username,
+        }, backup.Options{
+                Compress: true,
+                Encrypt:  archiveEncrypt,
+        }, archiveBase)
+        if errors.Is(err, backup.ErrNoChanges) {
+                fmt.Println("No changes since the last archive")
+                return nil
+        }
+        if err != nil {
+                return err
+        }
+
+        if segment.Sequence == 0 {
+                fmt.Printf("Started chain %s in %s with all %d pages of the database\n", segment.Chain, dir, segment.PageCount)
+        } else {
+                fmt.Printf("Archived %d changed pages of %d as segment %d of chain %s\n", segment.Pages, segment.PageCount, segment.Sequence, segment.Chain)
+        }
+
+        if archiveKeep > 0 {
+                removed, err := backup.PruneChains(dir, archiveKeep)
+                if err != nil {
+                        return err
+                }
+                if removed > 0 {
+                        fmt.Printf("Removed %d old chains, keeping %d\n", removed, archiveKeep)
+                }
+        }
+        return nil
+}
+
+// archiveDirectory returns the directory changes are archived to, by default in the
+// backup directory
+func archiveDirectory() string {
+        if archiveDir != "" {
+                return archiveDir
+        }
+        backupPath := "./backups"
+        if settings, err := db.GetSettings(); err == nil && settings.Backup.BackupPath != "" {
+                backupPath = settings.Backup.BackupPath
+        }
+        return filepath.Join(backupPath, "wal")
+}
+
+// recoveryTimeLayouts are the layouts accepted by restore --to, in local time
+var recoveryTimeLayouts = []string{
+        "2006-01-02T15:04",
+        "2006-01-02T15:04:05",
+        "2006-01-02 15:04",
+        "2006-01-02 15:04:05",
+}
+
+// parseRecoveryTime parses the time given to restore --to
+func parseRecoveryTime(value string) (time.Time, error) {
+        if t, err := time.Parse(time.RFC3339, value); err == nil {
+                return t, nil
+        }
+        for _, layout := range recoveryTimeLayouts {
+                if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+                        return t, nil
+                }
+        }
+        return time.Time{}, fmt.Errorf("invalid time %q, use YYYY-MM-DDTHH:MM", value)
+}
+
+// restoreToTime rebuilds the database as it was at the time given to restore --to into a
+// new file
+func restoreToTime(session *auth.Session) error {
+        until, err := parseRecoveryTime(restoreTo)
+        if err != nil {
+                return err
+        }
+        dir := archiveDirectory()
+        output := restoreOutput
+        if output == "" {
+                output = filepath.Join(filepath.Dir(db.GetDatabasePath()), fmt.Sprintf("pos_restored_%s.db", until.Format("20060102_150405")))
+        }
+
+        fmt.Printf("Replaying changes archived in %s up to %s...\n", dir, until.Format("2006-01-02 15:04:05"))
+        segment, err := backup.RestoreTo(dir, until, output, backupPassword)
+        if err != nil {
+                return err
+        }
+
+        db.AddAuditLog(
+                session.Username,
+                db.ActionRestore,
+                "database",
+                "restore",
+                fmt.Sprintf("Rebuilt the database as of %s to %s", segment.CreatedAt.Format(time.RFC3339), output),
+                "",
+                "",
+                "",
+                fmt.Sprintf("chain=%s,segment=%d,sha256=%s", segment.Chain, segment.Sequence, segment.SHA256),
+        )
+
+        fmt.Printf("Rebuilt the database as of %s, segment %d of chain %s, to %s\n",
+                segment.CreatedAt.Local().Format("2006-01-02 15:04:05"), segment.Sequence, segment.Chain, output)
+        fmt.Printf("The checksum chain and integrity check passed. Run 'pos restore %s' to use it.\n", output)
+        return nil
+}
+
 func init() {
         // Enhanced backup command
         rootCmd.AddCommand(enhancedBackupCmd)
         enhancedBackupCmd.Flags().BoolVar(&encryptBackup, "encrypt", false, "Encrypt the backup")
-        enhancedBackupCmd.Flags().StringVar(&backupPassword, "password", "", "Password for encryption (if not provided, uses system key)")
+        enhancedBackupCmd.Flags().StringVar(&backupPassword, "password", "", "Password to derive the encryption key from (if not provided, uses the master key)")
         enhancedBackupCmd.Flags().BoolVar(&backupRotate, "rotate", true, "Rotate backups (delete old ones)")
-        enhancedBackupCmd.Flags().BoolVar(&backupCompress, "compress", false, "Compress the backup")
+        enhancedBackupCmd.Flags().BoolVar(&backupCompress, "compress", false, "Compress the backup with gzip (zstd is not supported yet)")
         enhancedBackupCmd.Flags().BoolVar(&backupVerify, "verify", true, "Verify the backup after creation")
         enhancedBackupCmd.Flags().StringVar(&backupName, "name", "", "Custom backup filename")
         enhancedBackupCmd.Flags().IntVar(&backupRetention, "keep", 0, "Number of backups to keep (0 = use settings)")
@@ -528,8 +727,36 @@ func init() {
 
         // Restore command
         rootCmd.AddCommand(restoreBackupCmd)
-        restoreBackupCmd.Flags().StringVar(&backupPassword, "password", "", "Password for decryption (if not provided, uses system key)")
+        restoreBackupCmd.Flags().StringVar(&backupPassword, "password", "", "Password of a password protected backup")
+        restoreBackupCmd.Flags().StringVar(&restoreTo, "to", "", "Rebuild the database as it was at a time (YYYY-MM-DDTHH:MM) from archived changes")
+        restoreBackupCmd.Flags().StringVar(&restoreOutput, "output", "", "File to rebuild the database into with --to (default pos_restored_<time>.db)")
 
         // List backups command
         rootCmd.AddCommand(listBackupsCmd)
-}
\ No newline at end of file
+
+        // Backup verify command
+        rootCmd.AddCommand(backupsCmd)
+        backupsCmd.AddCommand(backupVerifyCmd)
+        backupVerifyCmd.Flags().StringVar(&backupPassword, "password", "", "Password of a password protected backup")
+
+        // Backup archive command
+        backupsCmd.AddCommand(backupArchiveCmd)
+        backupArchiveCmd.Flags().StringVar(&archiveDir, "dir", "", "Directory to archive changes to (default wal in the backup directory)")
+        backupArchiveCmd.Flags().BoolVar(&archiveBase, "base", false, "Start a new chain with the whole database")
+        backupArchiveCmd.Flags().BoolVar(&archiveEncrypt, "encrypt", false, "Encrypt the archived changes with the master key")
+        backupArchiveCmd.Flags().IntVar(&archiveKeep, "keep", 0, "Number of chains to keep (0 = keep all)")
+        restoreBackupCmd.Flags().StringVar(&archiveDir, "dir", "", "Directory of archived changes for --to (default wal in the backup directory)")
+}
+
+// decryptBackupData decrypts the contents of an encrypted backup, including backups
+// encrypted with the master key by earlier versions
+func decryptBackupData(data []byte) ([]byte, error) {
+        if security.IsEnvelope(data) {
+                return security.DecryptEnvelope(data)
+        }
+        decrypted, err := security.Decrypt(string(data))
+        if err != nil {
+                return nil, err
+        }
+        return []byte(decrypted), nil
+}
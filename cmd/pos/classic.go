@@ -54,7 +54,7 @@ func initClassicCommands() {
                                 Description:       productDescription,
                         }
 
-                        id, err := handlers.AddProduct(product)
+                        id, err := handlers.AddProduct(auditContext(auth.GetCurrentUser()), product)
                         if err != nil {
                                 return fmt.Errorf("failed to add product: %w", err)
                         }
@@ -159,7 +159,7 @@ func initClassicCommands() {
                                 return fmt.Errorf("invalid quantity: %w", err)
                         }
 
-                        if err := handlers.UpdateProductStock(id, quantity); err != nil {
+                        if err := handlers.UpdateProductStock(auditContext(auth.GetCurrentUser()), id, quantity); err != nil {
                                 return fmt.Errorf("failed to update stock: %w", err)
                         }
 
@@ -172,11 +172,15 @@ func initClassicCommands() {
         var sellCmd = &cobra.Command{
                 Use:   "sell [product_id] [quantity]",
                 Short: "Sell a product",
-                Long:  `Record a sale of a product with the specified quantity.`,
+                Long:  `Record a sale of a product with the specified quantity.
+
+With --client-ref, the sale is recorded once per reference: running the command again
+with the same reference and sale prints the ID of the sale already recorded, and reusing
+the reference for a different sale is refused.`,
                 Args:  cobra.ExactArgs(2),
                 RunE: func(cmd *cobra.Command, args []string) error {
                         // Check if user is authorized to create sales
-                        if err := auth.RequirePermission("sales:create"); err != nil {
+                        if err := auth.RequirePermission("sale:create"); err != nil {
                                 return err
                         }
                         
@@ -207,9 +211,15 @@ func initClassicCommands() {
                         applyLoyalty, _ := cmd.Flags().GetBool("apply-loyalty")
                         pointsUsed, _ := cmd.Flags().GetInt("points-used")
                         rewardID, _ := cmd.Flags().GetInt("reward-id")
+                        if redeemID, _ := cmd.Flags().GetInt("redeem"); redeemID > 0 {
+                                rewardID = redeemID
+                        }
                         
                         // If we want to disable loyalty features for this transaction
                         if !applyLoyalty {
+                                if rewardID > 0 {
+                                        return fmt.Errorf("cannot redeem a reward with --apply-loyalty=false")
+                                }
                                 customerID = 0
                                 pointsUsed = 0
                                 rewardID = 0
@@ -235,13 +245,52 @@ func initClassicCommands() {
                                 PointsUsed:        pointsUsed,
                                 RewardID:          rewardID,
                         }
+                        sale.PriceOverride, _ = cmd.Flags().GetFloat64("price")
+
+                        // A sale retried with the same client reference is only recorded once
+                        session := auth.GetCurrentUser()
+                        clientRef, _ := cmd.Flags().GetString("client-ref")
+                        if clientRef != "" {
+                                existingID, err := beginClientRef(session.Username, clientRef, sale)
+                                if err != nil {
+                                        return err
+                                }
+                                if existingID > 0 {
+                                        fmt.Printf("Sale already recorded with ID: %d (client reference %s)\n", existingID, clientRef)
+                                        return nil
+                                }
+                                defer releaseClientRef(session.Username, clientRef)
+                        }
 
-                        id, err := handlers.RecordSale(sale)
+                        // Price overrides and large discounts need supervisor approval
+                        // unless the current user holds the permission themselves
+                        restricted, err := handlers.SaleRestrictedActions(sale)
                         if err != nil {
                                 return fmt.Errorf("failed to record sale: %w", err)
                         }
+                        approvalToken, _ := cmd.Flags().GetString("approval")
+                        approvalToken, err = requireApproval(restricted, approvalToken, notes)
+                        if err != nil {
+                                return err
+                        }
+
+                        // Attribute the sale to the logged in cashier and this terminal
+                        handlers.AttributeSale(&sale, session.UserID)
+
+                        id, err := handlers.RecordApprovedSale(auditContext(session), sale, approvalToken)
+                        if err != nil {
+                                return fmt.Errorf("failed to record sale: %w", err)
+                        }
+                        if clientRef != "" {
+                                if err := completeClientRef(session.Username, clientRef, id); err != nil {
+                                        fmt.Printf("Warning: Failed to store client reference %s: %v\n", clientRef, err)
+                                }
+                        }
 
                         fmt.Printf("Sale recorded successfully with ID: %d\n", id)
+                        if rewardID > 0 {
+                                fmt.Printf("Loyalty reward %d redeemed with this sale\n", rewardID)
+                        }
                         
                         // Print receipt if requested
                         if printReceipt {
@@ -268,7 +317,7 @@ func initClassicCommands() {
         var reportCmd = &cobra.Command{
                 Use:   "report [type]",
                 Short: "Generate a report",
-                Long:  `Generate various reports: "sales", "inventory", "revenue", "summary", "top", "daily", "profit", "category", "trends"`,
+                Long:  `Generate various reports: "sales", "inventory", "revenue", "summary", "top", "daily", "profit", "category", "trends", "labour", "staff"`,
                 Args:  cobra.ExactArgs(1),
                 RunE: func(cmd *cobra.Command, args []string) error {
                         // Check if user is authorized to generate reports
@@ -297,6 +346,10 @@ func initClassicCommands() {
                                 return generateCategorySalesReport(cmd)
                         case "trends", "trend":
                                 return generateSalesTrendsReport(cmd)
+                        case "labour", "labor":
+                                return generateLabourReport(cmd)
+                        case "staff", "cashier", "cashiers":
+                                return generateStaffReport(cmd)
                         default:
                                 return fmt.Errorf("unknown report type: %s", reportType)
                         }
@@ -314,12 +367,16 @@ func initClassicCommands() {
         sellCmd.Flags().String("notes", "", "Additional notes for the sale")
         sellCmd.Flags().Bool("print-receipt", false, "Print receipt after sale")
         sellCmd.Flags().Bool("email-receipt", false, "Email receipt to customer")
+        sellCmd.Flags().Float64("price", 0.0, "Override the unit price (requires supervisor approval for cashiers)")
+        sellCmd.Flags().String("approval", "", "Supervisor approval token for a price override or large discount")
+        sellCmd.Flags().String("client-ref", "", "Client reference for the sale; retrying with the same reference does not record it twice")
         
         // Add customer loyalty related flags
         sellCmd.Flags().Int("customer-id", 0, "Customer ID for loyalty program")
         sellCmd.Flags().Bool("apply-loyalty", true, "Apply loyalty discount if eligible")
         sellCmd.Flags().Int("points-used", 0, "Loyalty points to apply to this purchase")
         sellCmd.Flags().Int("reward-id", 0, "Loyalty reward ID to redeem with this purchase")
+        sellCmd.Flags().Int("redeem", 0, "Redeem a loyalty reward by ID, applying its discount and deducting points with the sale")
         
         // Add report-related flags to the report command
         reportCmd.Flags().Bool("detailed", false, "Show detailed report with discount and tax information")
@@ -354,7 +411,7 @@ func generateSalesReport(cmd *cobra.Command) error {
         if detailed {
                 // Enhanced sales report with discount, tax, and payment info
                 table := tablewriter.NewWriter(cmd.OutOrStdout())
-                table.SetHeader([]string{"ID", "Product", "Qty", "Subtotal", "Discount", "Tax", "Total", "Payment", "Receipt", "Date"})
+                table.SetHeader([]string{"ID", "Product", "Qty", "Subtotal", "Discount", "Tax", "Total", "Payment", "Cashier", "Receipt", "Date"})
                 table.SetBorder(false)
 
                 for _, s := range sales {
@@ -380,6 +437,7 @@ func generateSalesReport(cmd *cobra.Command) error {
                                 taxStr,
                                 fmt.Sprintf("$%.2f", s.Total),
                                 s.PaymentMethod,
+                                s.Username,
                                 s.ReceiptNumber,
                                 s.SaleDate.Format("2006-01-02 15:04"),
                         })
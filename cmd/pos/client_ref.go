@@ -0,0 +1,74 @@
+package main
+
+import (
+        "encoding/json"
+        "errors"
+        "fmt"
+        "net/http"
+
+        "termpos/internal/db"
+        "termpos/internal/models"
+)
+
+// Sales made with "sell --client-ref" share the idempotency keys of the agent API,
+// under a method and path no HTTP request uses
+const (
+        clientRefMethod = "CLI"
+        clientRefPath   = "sell"
+)
+
+// beginClientRef claims a client reference for a sale. It returns the ID of the sale
+// already recorded with the reference, or zero if the sale should be recorded now. In
+// that case the reference is completed with completeClientRef once the sale is recorded,
+// or released with releaseClientRef if it fails.
+func beginClientRef(username, ref string, sale models.Sale) (int, error) {
+        body, err := json.Marshal(sale)
+        if err != nil {
+                return 0, fmt.Errorf("failed to encode sale: %w", err)
+        }
+
+        settings, err := db.GetSettings()
+        if err != nil {
+                return 0, fmt.Errorf("failed to load settings: %w", err)
+        }
+
+        earlier, started, err := db.BeginIdempotentRequest(db.IdempotentRequest{
+                Scope:       username,
+                Key:         ref,
+                Method:      clientRefMethod,
+                Path:        clientRefPath,
+                RequestHash: db.IdempotencyHash(clientRefMethod, clientRefPath, body),
+        }, settings.System.IdempotencyRetention())
+        switch {
+        case errors.Is(err, db.ErrIdempotencyKeyReused):
+                return 0, fmt.Errorf("client reference %s was already used for a different sale", ref)
+        case errors.Is(err, db.ErrIdempotencyInProgress):
+                return 0, fmt.Errorf("a sale with client reference %s is still being recorded", ref)
+        case err != nil:
+                return 0, err
+        case started:
+                return 0, nil
+        }
+
+        var recorded struct {
+                ID int `json:"id"`
+        }
+        if err := json.Unmarshal(earlier.Response, &recorded); err != nil {
+                return 0, fmt.Errorf("failed to read the sale recorded with client reference %s: %w", ref, err)
+        }
+        return recorded.ID, nil
+}
+
+// completeClientRef records the sale made with a client reference
+func completeClientRef(username, ref string, saleID int) error {
+        body, _ := json.Marshal(map[string]int{"id": saleID})
+        return db.CompleteIdempotentRequest(username, ref, http.StatusCreated, "application/json", "", body)
+}
+
+// releaseClientRef frees a client reference whose sale was not recorded. It does nothing
+// once the reference is completed.
+func releaseClientRef(username, ref string) {
+        if err := db.ReleaseIdempotentRequest(username, ref); err != nil {
+                fmt.Printf("Warning: Failed to release client reference %s: %v\n", ref, err)
+        }
+}
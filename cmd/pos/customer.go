@@ -79,7 +79,7 @@ var customerAddCmd = &cobra.Command{
                 }
                 
                 // Add customer
-                id, err := db.AddCustomer(customer)
+                id, err := db.AddCustomer(auditContext(auth.GetCurrentUser()), customer)
                 if err != nil {
                         fmt.Printf("Error adding customer: %v\n", err)
                         return
@@ -185,7 +185,7 @@ var customerUpdateCmd = &cobra.Command{
                 }
                 
                 // Update customer
-                err = db.UpdateCustomer(customer)
+                err = db.UpdateCustomer(auditContext(auth.GetCurrentUser()), customer)
                 if err != nil {
                         fmt.Printf("Error updating customer: %v\n", err)
                         return
@@ -225,7 +225,7 @@ var customerDeleteCmd = &cobra.Command{
                 }
                 
                 // Delete customer
-                err = db.DeleteCustomer(id)
+                err = db.DeleteCustomer(auditContext(auth.GetCurrentUser()), id)
                 if err != nil {
                         fmt.Printf("Error deleting customer: %v\n", err)
                         return
@@ -391,7 +391,7 @@ var customerAddPointsCmd = &cobra.Command{
                 customer.LoyaltyTier = models.GetLoyaltyTierName(customer.LoyaltyPoints)
                 
                 // Save customer
-                err = db.UpdateCustomer(customer)
+                err = db.UpdateCustomer(auditContext(auth.GetCurrentUser()), customer)
                 if err != nil {
                         fmt.Printf("Error updating customer points: %v\n", err)
                         return
@@ -493,7 +493,7 @@ var customerRedeemRewardCmd = &cobra.Command{
                 }
                 
                 // Redeem reward
-                reward, err := db.RedeemLoyaltyReward(customerID, rewardID)
+                reward, err := db.RedeemLoyaltyReward(auditContext(auth.GetCurrentUser()), customerID, rewardID)
                 if err != nil {
                         fmt.Printf("Error redeeming reward: %v\n", err)
                         return
@@ -511,7 +511,7 @@ var customerRedeemRewardCmd = &cobra.Command{
                 }
                 
                 fmt.Printf("Reward value: %s, Valid for: %d days\n", value, reward.ValidDays)
-                fmt.Println("Use during checkout to apply the reward")
+                fmt.Printf("Use during checkout to apply the reward: pos sell [product_id] [quantity] --customer-id %d --redeem %d\n", customer.ID, reward.ID)
         },
 }
 
@@ -703,7 +703,7 @@ var customerLinkSaleCmd = &cobra.Command{
                 }
                 
                 // Link the sale
-                err = db.LinkSaleToCustomer(saleID, customerID, pointsEarned, 0, 0)
+                err = db.LinkSaleToCustomer(auditContext(auth.GetCurrentUser()), saleID, customerID, pointsEarned, 0, 0)
                 if err != nil {
                         fmt.Printf("Error linking sale to customer: %v\n", err)
                         return
@@ -757,6 +757,13 @@ func displayCustomerDetails(customer models.Customer) {
         if customer.PreferredProducts != "" {
                 fmt.Printf("Preferred Products: %s\n", customer.PreferredProducts)
         }
+        
+        fmt.Printf("Email Marketing: %s\n", formatConsent(customer.EmailConsent, customer.EmailConsentAt))
+        fmt.Printf("SMS Marketing: %s\n", formatConsent(customer.SMSConsent, customer.SMSConsentAt))
+        
+        if customer.IsAnonymized() {
+                fmt.Printf("Anonymized: %s\n", customer.AnonymizedAt.Format("2006-01-02 15:04:05"))
+        }
 }
 
 func init() {
@@ -0,0 +1,192 @@
+package main
+
+import (
+        "fmt"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/db"
+)
+
+var (
+        // Customer privacy command flags
+        customerExportOutput string
+)
+
+// customerConsentCmd shows or changes a customer's marketing consent
+var customerConsentCmd = &cobra.Command{
+        Use:   "consent [id] [email|sms] [grant|withdraw]",
+        Short: "View or change marketing consent",
+        Long: `View a customer's marketing consent, or grant/withdraw consent for a channel.
+Consent changes are timestamped and recorded in the audit log.`,
+        Args: cobra.RangeArgs(1, 3),
+        Run: func(cmd *cobra.Command, args []string) {
+                id, err := strconv.Atoi(args[0])
+                if err != nil {
+                        fmt.Println("Error: ID must be a number")
+                        return
+                }
+
+                // Show current consent when no change is requested
+                if len(args) == 1 {
+                        if err := auth.RequirePermission("customer:read"); err != nil {
+                                fmt.Println("Error: You don't have permission to view customers")
+                                return
+                        }
+
+                        customer, err := db.GetCustomer(id)
+                        if err != nil {
+                                fmt.Printf("Error: %v\n", err)
+                                return
+                        }
+
+                        fmt.Printf("Marketing consent for customer ID %d:\n", customer.ID)
+                        fmt.Printf("  Email: %s\n", formatConsent(customer.EmailConsent, customer.EmailConsentAt))
+                        fmt.Printf("  SMS:   %s\n", formatConsent(customer.SMSConsent, customer.SMSConsentAt))
+                        return
+                }
+
+                if len(args) != 3 {
+                        fmt.Println("Error: specify both a channel (email or sms) and grant or withdraw")
+                        return
+                }
+
+                // Check permissions
+                if err := auth.RequirePermission("customer:update"); err != nil {
+                        fmt.Println("Error: You don't have permission to update customers")
+                        return
+                }
+
+                channel := strings.ToLower(args[1])
+                var granted bool
+                switch strings.ToLower(args[2]) {
+                case "grant":
+                        granted = true
+                case "withdraw":
+                        granted = false
+                default:
+                        fmt.Println("Error: consent action must be grant or withdraw")
+                        return
+                }
+
+                if err := db.SetCustomerConsent(auditContext(auth.GetCurrentUser()), id, channel, granted); err != nil {
+                        fmt.Printf("Error updating consent: %v\n", err)
+                        return
+                }
+
+                if granted {
+                        fmt.Printf("Marketing %s consent granted for customer ID %d\n", channel, id)
+                } else {
+                        fmt.Printf("Marketing %s consent withdrawn for customer ID %d\n", channel, id)
+                }
+        },
+}
+
+// customerExportDataCmd exports all data held about a customer
+var customerExportDataCmd = &cobra.Command{
+        Use:   "export-data [id]",
+        Short: "Export all data held about a customer",
+        Long: `Export a complete JSON bundle of everything held about a customer: profile,
+sales, loyalty points history, reward redemptions and sensitive data entries.`,
+        Args: cobra.ExactArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("customer:export"); err != nil {
+                        fmt.Println("Error: You don't have permission to export customer data")
+                        return
+                }
+
+                id, err := strconv.Atoi(args[0])
+                if err != nil {
+                        fmt.Println("Error: ID must be a number")
+                        return
+                }
+
+                session := auth.GetCurrentUser()
+                export, err := db.ExportCustomerData(id, session.Username)
+                if err != nil {
+                        fmt.Printf("Error exporting customer data: %v\n", err)
+                        return
+                }
+
+                if customerExportOutput == "" {
+                        data, err := db.CustomerDataExportJSON(export)
+                        if err != nil {
+                                fmt.Printf("Error: %v\n", err)
+                                return
+                        }
+                        fmt.Println(data)
+                        return
+                }
+
+                if err := db.WriteCustomerDataExport(export, customerExportOutput); err != nil {
+                        fmt.Printf("Error writing export: %v\n", err)
+                        return
+                }
+
+                fmt.Printf("Customer data exported to %s (%d sales, %d sensitive fields)\n",
+                        customerExportOutput, len(export.Sales), len(export.SensitiveData))
+        },
+}
+
+// customerAnonymizeCmd scrubs a customer's personal data
+var customerAnonymizeCmd = &cobra.Command{
+        Use:   "anonymize [id]",
+        Short: "Erase a customer's personal data",
+        Long: `Irreversibly remove a customer's name, contact details, birthday, notes and
+sensitive data. Sales and loyalty history are kept for accounting, but are no
+longer linked to any identifying information.`,
+        Args: cobra.ExactArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("customer:delete"); err != nil {
+                        fmt.Println("Error: You don't have permission to anonymize customers")
+                        return
+                }
+
+                id, err := strconv.Atoi(args[0])
+                if err != nil {
+                        fmt.Println("Error: ID must be a number")
+                        return
+                }
+
+                // Confirm anonymization
+                fmt.Printf("Are you sure you want to anonymize customer ID %d? This cannot be undone. (y/N): ", id)
+                var confirm string
+                fmt.Scanln(&confirm)
+                if strings.ToLower(confirm) != "y" {
+                        fmt.Println("Anonymization cancelled")
+                        return
+                }
+
+                session := auth.GetCurrentUser()
+                if err := db.AnonymizeCustomer(id, session.Username); err != nil {
+                        fmt.Printf("Error anonymizing customer: %v\n", err)
+                        return
+                }
+
+                fmt.Printf("Customer ID %d anonymized successfully\n", id)
+        },
+}
+
+// formatConsent describes a consent flag and when it was last changed
+func formatConsent(granted bool, changedAt time.Time) string {
+        if changedAt.IsZero() {
+                return "not recorded"
+        }
+        if granted {
+                return fmt.Sprintf("granted (%s)", changedAt.Format("2006-01-02 15:04:05"))
+        }
+        return fmt.Sprintf("withdrawn (%s)", changedAt.Format("2006-01-02 15:04:05"))
+}
+
+func init() {
+        customerCmd.AddCommand(customerConsentCmd)
+        customerCmd.AddCommand(customerExportDataCmd)
+        customerCmd.AddCommand(customerAnonymizeCmd)
+
+        customerExportDataCmd.Flags().StringVarP(&customerExportOutput, "output", "o", "", "Write the export to a file instead of stdout")
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+        "fmt"
+        "os"
+        "strings"
+        "time"
+
+        "github.com/olekukonko/tablewriter"
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/models"
+)
+
+var (
+        // Customer segment command flags
+        segmentDescription string
+        segmentRules       models.SegmentRules
+)
+
+// customerSegmentCmd represents the customer segment command
+var customerSegmentCmd = &cobra.Command{
+        Use:   "segment",
+        Short: "Customer segmentation and RFM analytics",
+        Long: `Group customers into named segments using recency, frequency and monetary (RFM)
+scores computed from their purchase history, and export segment members for marketing.`,
+}
+
+// customerSegmentListCmd lists all segments with their member counts
+var customerSegmentListCmd = &cobra.Command{
+        Use:   "list",
+        Short: "List customer segments",
+        Long:  `List all customer segments with the number of customers currently matching each one.`,
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("customer:read"); err != nil {
+                        fmt.Println("Error: You don't have permission to view customers")
+                        return
+                }
+
+                segments, err := db.GetCustomerSegments()
+                if err != nil {
+                        fmt.Printf("Error: %v\n", err)
+                        return
+                }
+
+                if len(segments) == 0 {
+                        fmt.Println("No customer segments defined")
+                        return
+                }
+
+                now := time.Now()
+                customers, err := db.CalculateCustomerRFM(now)
+                if err != nil {
+                        fmt.Printf("Error: %v\n", err)
+                        return
+                }
+
+                table := tablewriter.NewWriter(os.Stdout)
+                table.SetHeader([]string{"NAME", "DESCRIPTION", "MEMBERS"})
+                table.SetBorder(false)
+
+                for _, segment := range segments {
+                        members := 0
+                        for _, c := range customers {
+                                if segment.Rules.Matches(c, now) {
+                                        members++
+                                }
+                        }
+
+                        table.Append([]string{
+                                segment.Name,
+                                segment.Description,
+                                fmt.Sprintf("%d", members),
+                        })
+                }
+
+                table.Render()
+        },
+}
+
+// customerSegmentShowCmd shows a segment's rules and members
+var customerSegmentShowCmd = &cobra.Command{
+        Use:   "show [name]",
+        Short: "Show a segment and its members",
+        Long:  `Display the rules of a customer segment and the customers that currently match it.`,
+        Args:  cobra.ExactArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("customer:read"); err != nil {
+                        fmt.Println("Error: You don't have permission to view customers")
+                        return
+                }
+
+                segment, err := db.GetCustomerSegment(args[0])
+                if err != nil {
+                        fmt.Printf("Error: %v\n", err)
+                        return
+                }
+
+                members, err := db.GetSegmentMembers(segment.Name)
+                if err != nil {
+                        fmt.Printf("Error: %v\n", err)
+                        return
+                }
+
+                fmt.Printf("\nSegment: %s\n", segment.Name)
+                if segment.Description != "" {
+                        fmt.Printf("Description: %s\n", segment.Description)
+                }
+                fmt.Println("Rules:")
+                for _, rule := range describeSegmentRules(segment.Rules) {
+                        fmt.Printf("  - %s\n", rule)
+                }
+
+                if len(members) == 0 {
+                        fmt.Println("\nNo customers currently match this segment")
+                        return
+                }
+
+                fmt.Printf("\nMembers (%d):\n", len(members))
+                table := tablewriter.NewWriter(os.Stdout)
+                table.SetHeader([]string{"ID", "NAME", "LAST PURCHASE", "ORDERS", "SPENT", "RFM", "BIRTHDAY"})
+                table.SetBorder(false)
+
+                for _, m := range members {
+                        lastPurchase := "Never"
+                        if !m.LastPurchase.IsZero() {
+                                lastPurchase = fmt.Sprintf("%s (%dd ago)", m.LastPurchase.Format("2006-01-02"), m.RecencyDays)
+                        }
+
+                        table.Append([]string{
+                                fmt.Sprintf("%d", m.CustomerID),
+                                m.Name,
+                                lastPurchase,
+                                fmt.Sprintf("%d", m.Frequency),
+                                fmt.Sprintf("$%.2f", m.Monetary),
+                                m.Score(),
+                                m.Birthday,
+                        })
+                }
+
+                table.Render()
+        },
+}
+
+// customerSegmentExportCmd exports segment members to CSV
+var customerSegmentExportCmd = &cobra.Command{
+        Use:   "export [name] [file.csv]",
+        Short: "Export segment members to CSV",
+        Long:  `Export the customers matching a segment, with contact details, consent flags and RFM scores, to a CSV file.`,
+        Args:  cobra.ExactArgs(2),
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("customer:export"); err != nil {
+                        fmt.Println("Error: You don't have permission to export customer data")
+                        return
+                }
+
+                session := auth.GetCurrentUser()
+                count, err := db.ExportSegmentMembersCSV(args[0], args[1], session.Username)
+                if err != nil {
+                        fmt.Printf("Error exporting segment: %v\n", err)
+                        return
+                }
+
+                fmt.Printf("Exported %d customers in segment '%s' to %s\n", count, args[0], args[1])
+        },
+}
+
+// customerSegmentCreateCmd creates or updates a segment
+var customerSegmentCreateCmd = &cobra.Command{
+        Use:   "create [name]",
+        Short: "Create or update a segment",
+        Long: `Create a customer segment, or replace the rules of an existing one. Scores range
+from 1 (worst) to 5 (best). For example, to target big spenders who have not
+been in for two months:
+
+  pos customer segment create win-back --min-monetary 4 --min-days 60`,
+        Args: cobra.ExactArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("customer:update"); err != nil {
+                        fmt.Println("Error: You don't have permission to manage customer segments")
+                        return
+                }
+
+                segment := models.CustomerSegment{
+                        Name:        strings.ToLower(args[0]),
+                        Description: segmentDescription,
+                        Rules:       segmentRules,
+                }
+
+                session := auth.GetCurrentUser()
+                if err := db.SaveCustomerSegment(segment, session.Username); err != nil {
+                        fmt.Printf("Error saving segment: %v\n", err)
+                        return
+                }
+
+                fmt.Printf("Segment '%s' saved successfully\n", segment.Name)
+        },
+}
+
+// customerSegmentDeleteCmd deletes a segment
+var customerSegmentDeleteCmd = &cobra.Command{
+        Use:   "delete [name]",
+        Short: "Delete a segment",
+        Long:  `Delete a customer segment definition. Customers themselves are not affected.`,
+        Args:  cobra.ExactArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("customer:update"); err != nil {
+                        fmt.Println("Error: You don't have permission to manage customer segments")
+                        return
+                }
+
+                session := auth.GetCurrentUser()
+                if err := db.DeleteCustomerSegment(args[0], session.Username); err != nil {
+                        fmt.Printf("Error deleting segment: %v\n", err)
+                        return
+                }
+
+                fmt.Printf("Segment '%s' deleted\n", args[0])
+        },
+}
+
+// describeSegmentRules returns a human readable description of each active rule
+func describeSegmentRules(r models.SegmentRules) []string {
+        var rules []string
+
+        scoreRule := func(name string, min, max int) {
+                switch {
+                case min > 0 && max > 0:
+                        rules = append(rules, fmt.Sprintf("%s score between %d and %d", name, min, max))
+                case min > 0:
+                        rules = append(rules, fmt.Sprintf("%s score at least %d", name, min))
+                case max > 0:
+                        rules = append(rules, fmt.Sprintf("%s score at most %d", name, max))
+                }
+        }
+
+        scoreRule("Recency", r.MinRecencyScore, r.MaxRecencyScore)
+        scoreRule("Frequency", r.MinFrequencyScore, r.MaxFrequencyScore)
+        scoreRule("Monetary", r.MinMonetaryScore, r.MaxMonetaryScore)
+
+        if r.MinDaysSincePurchase > 0 {
+                rules = append(rules, fmt.Sprintf("No purchase in the last %d days", r.MinDaysSincePurchase))
+        }
+        if r.MaxDaysSincePurchase > 0 {
+                rules = append(rules, fmt.Sprintf("Purchased within the last %d days", r.MaxDaysSincePurchase))
+        }
+        if r.MinOrders > 0 {
+                rules = append(rules, fmt.Sprintf("At least %d orders", r.MinOrders))
+        }
+        if r.MinSpend > 0 {
+                rules = append(rules, fmt.Sprintf("Spent at least $%.2f", r.MinSpend))
+        }
+        if r.BirthdayThisMonth {
+                rules = append(rules, "Birthday this month")
+        }
+        if r.BirthdayWithinDays > 0 {
+                rules = append(rules, fmt.Sprintf("Birthday within the next %d days", r.BirthdayWithinDays))
+        }
+
+        if len(rules) == 0 {
+                rules = append(rules, "All customers")
+        }
+        return rules
+}
+
+func init() {
+        customerCmd.AddCommand(customerSegmentCmd)
+        customerSegmentCmd.AddCommand(customerSegmentListCmd)
+        customerSegmentCmd.AddCommand(customerSegmentShowCmd)
+        customerSegmentCmd.AddCommand(customerSegmentExportCmd)
+        customerSegmentCmd.AddCommand(customerSegmentCreateCmd)
+        customerSegmentCmd.AddCommand(customerSegmentDeleteCmd)
+
+        // Add flags for create command
+        flags := customerSegmentCreateCmd.Flags()
+        flags.StringVar(&segmentDescription, "description", "", "Segment description")
+        flags.IntVar(&segmentRules.MinRecencyScore, "min-recency", 0, "Minimum recency score (1-5)")
+        flags.IntVar(&segmentRules.MaxRecencyScore, "max-recency", 0, "Maximum recency score (1-5)")
+        flags.IntVar(&segmentRules.MinFrequencyScore, "min-frequency", 0, "Minimum frequency score (1-5)")
+        flags.IntVar(&segmentRules.MaxFrequencyScore, "max-frequency", 0, "Maximum frequency score (1-5)")
+        flags.IntVar(&segmentRules.MinMonetaryScore, "min-monetary", 0, "Minimum monetary score (1-5)")
+        flags.IntVar(&segmentRules.MaxMonetaryScore, "max-monetary", 0, "Maximum monetary score (1-5)")
+        flags.IntVar(&segmentRules.MinDaysSincePurchase, "min-days", 0, "Minimum days since last purchase")
+        flags.IntVar(&segmentRules.MaxDaysSincePurchase, "max-days", 0, "Maximum days since last purchase")
+        flags.IntVar(&segmentRules.MinOrders, "min-orders", 0, "Minimum number of orders")
+        flags.Float64Var(&segmentRules.MinSpend, "min-spend", 0, "Minimum total spend")
+        flags.BoolVar(&segmentRules.BirthdayThisMonth, "birthday-this-month", false, "Only customers with a birthday this month")
+        flags.IntVar(&segmentRules.BirthdayWithinDays, "birthday-within", 0, "Only customers with a birthday within this many days")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+        "fmt"
+        "path/filepath"
+
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/db"
+)
+
+var (
+        dbCmd = &cobra.Command{
+                Use:   "db",
+                Short: "Encrypt or decrypt the database",
+                Long: `The database, with its WAL files and backups, can be encrypted at rest with SQLCipher.
+The key is read, base64 encoded, from POS_DB_KEY, or derived with scrypt from the
+passphrase in POS_DB_PASSPHRASE. New databases are encrypted when either is set.
+
+Encryption needs a build linked against SQLCipher:
+
+  CGO_CFLAGS="-DSQLITE_HAS_CODEC -I/usr/include/sqlcipher" CGO_LDFLAGS="-lsqlcipher" \
+    go build -tags libsqlite3 ./cmd/pos
+
+Keep the key safe: an encrypted database cannot be opened without it.`,
+        }
+
+        dbEncryptCmd = &cobra.Command{
+                Use:   "encrypt",
+                Short: "Encrypt the database with POS_DB_KEY or POS_DB_PASSPHRASE",
+                Long: `Encrypt the database in place. It is copied to an encrypted file, which replaces the
+database and its WAL files. Backups taken before are not encrypted by this command.`,
+                Args: cobra.NoArgs,
+                RunE: runDBEncrypt,
+        }
+
+        dbDecryptCmd = &cobra.Command{
+                Use:   "decrypt",
+                Short: "Decrypt the database",
+                Long: `Decrypt the database in place. It is copied to a file that is not encrypted, which
+replaces the database and its WAL files. Unset POS_DB_KEY and POS_DB_PASSPHRASE afterwards,
+or the next new database will be encrypted again.`,
+                Args: cobra.NoArgs,
+                RunE: runDBDecrypt,
+        }
+)
+
+// runDBEncrypt handles the db encrypt command
+func runDBEncrypt(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("key:manage"); err != nil {
+                return err
+        }
+        session := auth.GetCurrentUser()
+
+        fmt.Println("Encrypting the database...")
+        if err := db.EncryptDatabase(auditContext(session)); err != nil {
+                return err
+        }
+        fmt.Printf("Encrypted %s, it cannot be opened without its key\n", db.GetDatabasePath())
+
+        // Backups taken before still hold the business history in the clear
+        settings, err := db.GetSettings()
+        if err != nil {
+                return nil
+        }
+        backups, _ := filepath.Glob(filepath.Join(settings.Backup.BackupPath, "*.db"))
+        plaintext := 0
+        for _, backup := range backups {
+                if encrypted, err := db.IsDatabaseFileEncrypted(backup); err == nil && !encrypted {
+                        plaintext++
+                }
+        }
+        if plaintext > 0 {
+                fmt.Printf("Warning: %d backups in %s are not encrypted, delete them once newer backups are taken\n", plaintext, settings.Backup.BackupPath)
+        }
+        return nil
+}
+
+// runDBDecrypt handles the db decrypt command
+func runDBDecrypt(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("key:manage"); err != nil {
+                return err
+        }
+        session := auth.GetCurrentUser()
+
+        fmt.Println("Decrypting the database...")
+        if err := db.DecryptDatabase(auditContext(session)); err != nil {
+                return err
+        }
+        fmt.Printf("Decrypted %s\n", db.GetDatabasePath())
+        return nil
+}
+
+func init() {
+        rootCmd.AddCommand(dbCmd)
+        dbCmd.AddCommand(dbEncryptCmd)
+        dbCmd.AddCommand(dbDecryptCmd)
+}
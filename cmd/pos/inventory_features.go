@@ -228,7 +228,7 @@ func runAddCategory(cmd *cobra.Command, args []string) error {
 		ParentID:    categoryParentID,
 	}
 
-	id, err := db.AddCategory(category)
+	id, err := db.AddCategory(auditContext(auth.GetCurrentUser()), category)
 	if err != nil {
 		return fmt.Errorf("failed to add category: %v", err)
 	}
@@ -303,7 +303,7 @@ func runAddSupplier(cmd *cobra.Command, args []string) error {
 		IsActive: true,
 	}
 
-	id, err := db.AddSupplier(supplier)
+	id, err := db.AddSupplier(auditContext(auth.GetCurrentUser()), supplier)
 	if err != nil {
 		return fmt.Errorf("failed to add supplier: %v", err)
 	}
@@ -377,7 +377,7 @@ func runAddLocation(cmd *cobra.Command, args []string) error {
 		IsActive:    true,
 	}
 
-	id, err := db.AddLocation(location)
+	id, err := db.AddLocation(auditContext(auth.GetCurrentUser()), location)
 	if err != nil {
 		return fmt.Errorf("failed to add location: %v", err)
 	}
@@ -479,7 +479,7 @@ func runAddBatch(cmd *cobra.Command, args []string) error {
 		batch.ManufactureDate = manufactureDate
 	}
 
-	id, err := db.AddProductBatch(batch)
+	id, err := db.AddProductBatch(auditContext(auth.GetCurrentUser()), batch)
 	if err != nil {
 		return fmt.Errorf("failed to add product batch: %v", err)
 	}
@@ -0,0 +1,197 @@
+package main
+
+import (
+        "fmt"
+        "os"
+        "sort"
+        "strconv"
+
+        "github.com/olekukonko/tablewriter"
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/security"
+)
+
+var (
+        keysCmd = &cobra.Command{
+                Use:   "keys",
+                Short: "Manage the keys sensitive data is encrypted with",
+                Long: `Sensitive data, such as two-factor secrets, and the email addresses, phone numbers,
+addresses, birthdays and emergency contacts of customers and staff are encrypted with a
+data key. Data keys are stored in the database, each wrapped by the master key, and every
+encrypted value records the ID of its data key.
+
+The master key is read, base64 encoded, from POS_ENCRYPTION_KEY or from the file named
+by POS_ENCRYPTION_KEY_FILE. Generate one with:
+
+  openssl rand -base64 32
+
+Without a master key nothing is encrypted. Keep it safe: data encrypted under it cannot
+be read without it.`,
+        }
+
+        keysStatusCmd = &cobra.Command{
+                Use:   "status",
+                Short: "Check the master key and the data keys",
+                Long: `Show the master key and the data keys, with the number of sensitive data rows and
+personal data values encrypted with each. Fails when no master key is configured, when a
+data key cannot be unwrapped with the master key, or when rows are encrypted with an
+unknown key.`,
+                Args: cobra.NoArgs,
+                RunE: runKeysStatus,
+        }
+
+        keysRotateCmd = &cobra.Command{
+                Use:   "rotate",
+                Short: "Create a new data key and re-encrypt all sensitive data with it",
+                Long: `Create a new data key and re-encrypt every sensitive data row, and the personal data of
+customers and staff, with it in batches. The previous keys are retired but kept, as
+archives and backups may still need them.
+
+If a rotation is interrupted, run it again with --resume to finish re-encrypting the
+remaining rows with the active key instead of creating another one.
+
+Processes already running, such as 'pos agent', pick up the new key within 30 seconds,
+and the rotation only completes once they have. Run 'pos keys rotate --resume' after
+that to re-encrypt rows they wrote with the previous key in the meantime.`,
+                Args: cobra.NoArgs,
+                RunE: runKeysRotate,
+        }
+)
+
+// runKeysStatus handles the keys status command
+func runKeysStatus(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("key:manage"); err != nil {
+                return err
+        }
+
+        if err := security.InitEncryption(); err != nil {
+                return err
+        }
+        if security.IsEphemeralKey() {
+                fmt.Println("Master key: not configured")
+                return security.ErrEphemeralKey
+        }
+        fmt.Printf("Master key: %s (from %s)\n", security.MasterKeyID(), security.MasterKeySource())
+
+        keys, err := db.GetDataKeys()
+        if err != nil {
+                return err
+        }
+        counts, err := db.CountSensitiveDataByKey()
+        if err != nil {
+                return err
+        }
+        piiCounts, err := db.CountPIIByKey()
+        if err != nil {
+                return err
+        }
+
+        problems := 0
+        if len(keys) == 0 {
+                fmt.Println("\nNo data keys yet, one is created when sensitive data is first stored")
+        } else {
+                fmt.Println()
+                table := tablewriter.NewWriter(os.Stdout)
+                table.SetHeader([]string{"ID", "Status", "Master Key", "Created", "Retired", "Sensitive Rows", "PII Values", "Health"})
+                table.SetBorder(false)
+                for _, key := range keys {
+                        status, retired := "active", ""
+                        if !key.Active() {
+                                status, retired = "retired", key.RetiredAt.Format("2006-01-02 15:04")
+                        }
+                        health := "ok"
+                        if err := security.UnwrapDataKey(key); err != nil {
+                                health = err.Error()
+                                problems++
+                        }
+                        table.Append([]string{
+                                key.ID,
+                                status,
+                                key.MasterKeyID,
+                                key.CreatedAt.Format("2006-01-02 15:04"),
+                                retired,
+                                strconv.Itoa(counts[key.ID]),
+                                strconv.Itoa(piiCounts[key.ID]),
+                                health,
+                        })
+                        delete(counts, key.ID)
+                        delete(piiCounts, key.ID)
+                }
+                table.Render()
+        }
+
+        // Rows encrypted with the master key by earlier versions can still be read
+        if legacy := counts[""]; legacy > 0 {
+                fmt.Printf("\nWarning: %d sensitive data rows are encrypted with the master key directly, run 'pos keys rotate' to move them to a data key\n", legacy)
+                delete(counts, "")
+        }
+
+        // Personal data is only stored in plaintext while no master key is configured, and is
+        // encrypted by the next rotation with one
+        if plaintext := piiCounts[""]; plaintext > 0 {
+                fmt.Printf("\nWarning: %d personal data values are stored in plaintext, run 'pos keys rotate' to encrypt them\n", plaintext)
+                delete(piiCounts, "")
+        }
+
+        unknown := make([]string, 0, len(counts)+len(piiCounts))
+        for id := range counts {
+                unknown = append(unknown, id)
+        }
+        for id := range piiCounts {
+                if _, ok := counts[id]; !ok {
+                        unknown = append(unknown, id)
+                }
+        }
+        sort.Strings(unknown)
+        for _, id := range unknown {
+                fmt.Printf("\nError: %d rows are encrypted with unknown key %s\n", counts[id]+piiCounts[id], id)
+                problems++
+        }
+
+        if problems > 0 {
+                return fmt.Errorf("encryption keys are unhealthy, %d problems found", problems)
+        }
+        fmt.Println("\nEncryption keys are healthy")
+        return nil
+}
+
+// runKeysRotate handles the keys rotate command
+func runKeysRotate(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("key:manage"); err != nil {
+                return err
+        }
+        session := auth.GetCurrentUser()
+
+        batch, _ := cmd.Flags().GetInt("batch")
+        resume, _ := cmd.Flags().GetBool("resume")
+
+        if err := security.InitEncryption(); err != nil {
+                return err
+        }
+
+        rotation, err := db.RotateSensitiveData(auditContext(session), batch, !resume)
+        if rotation.Rotated > 0 || err == nil {
+                fmt.Printf("Re-encrypted %d rows with key %s in %d batches\n", rotation.Rotated, rotation.KeyID, rotation.Batches)
+        }
+        if err == nil && !resume {
+                fmt.Println("Running processes pick up the new key within 30 seconds, then run 'pos keys rotate --resume' to finish")
+        }
+        if err != nil {
+                if rotation.KeyID != "" {
+                        fmt.Println("Run 'pos keys rotate --resume' to finish the rotation")
+                }
+                return err
+        }
+        return nil
+}
+
+func init() {
+        rootCmd.AddCommand(keysCmd)
+        keysCmd.AddCommand(keysStatusCmd)
+        keysCmd.AddCommand(keysRotateCmd)
+
+        keysRotateCmd.Flags().Int("batch", db.DefaultKeyRotationBatch, "Number of rows re-encrypted per transaction")
+        keysRotateCmd.Flags().Bool("resume", false, "Finish an interrupted rotation with the active key instead of creating a new one")
+}
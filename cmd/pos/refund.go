@@ -0,0 +1,62 @@
+package main
+
+import (
+        "fmt"
+        "strconv"
+
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/handlers"
+        "termpos/internal/models"
+)
+
+var (
+        // Refund command flags
+        refundReason   string
+        refundApproval string
+)
+
+// refundCmd refunds a sale
+var refundCmd = &cobra.Command{
+        Use:   "refund [sale_id]",
+        Short: "Refund a sale",
+        Long: `Refund a sale, returning its items to stock and reversing any loyalty points.
+Users without the sale:refund permission need a supervisor's approval, either by
+entering the supervisor's credentials when asked or with a token from 'pos approve refund'.`,
+        Args: cobra.ExactArgs(1),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Anyone who can sell may start a refund; approval is checked below
+                if err := auth.RequirePermission("sale:create"); err != nil {
+                        return err
+                }
+
+                saleID, err := strconv.Atoi(args[0])
+                if err != nil {
+                        return fmt.Errorf("invalid sale ID: %w", err)
+                }
+
+                approvalToken, err := requireApproval(
+                        []models.RestrictedAction{handlers.RefundRestrictedAction(saleID)},
+                        refundApproval,
+                        refundReason,
+                )
+                if err != nil {
+                        return err
+                }
+
+                session := auth.GetCurrentUser()
+                if err := handlers.RefundSale(auditContext(session), saleID, approvalToken, refundReason); err != nil {
+                        return err
+                }
+
+                fmt.Printf("Sale %d refunded successfully\n", saleID)
+                return nil
+        },
+}
+
+func init() {
+        rootCmd.AddCommand(refundCmd)
+
+        refundCmd.Flags().StringVar(&refundReason, "reason", "", "Reason for the refund")
+        refundCmd.Flags().StringVar(&refundApproval, "approval", "", "Supervisor approval token")
+}
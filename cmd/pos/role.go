@@ -0,0 +1,257 @@
+package main
+
+import (
+        "fmt"
+        "os"
+
+        "github.com/olekukonko/tablewriter"
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/models"
+)
+
+var (
+        // Role command flags
+        roleDescription string
+        roleCopyFrom    string
+)
+
+// roleCmd represents the role command
+var roleCmd = &cobra.Command{
+        Use:   "role",
+        Short: "Manage roles and permissions",
+        Long: `Manage the roles that can be assigned to staff and the permissions each role grants.
+Besides the built-in admin, manager and cashier roles, custom roles such as
+"shift-lead" can be created and assigned with 'pos staff set-role'.`,
+}
+
+// roleListCmd lists all roles
+var roleListCmd = &cobra.Command{
+        Use:   "list",
+        Short: "List roles",
+        Long:  `List all roles with their descriptions and number of permissions.`,
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("role:read"); err != nil {
+                        fmt.Println("Error: You don't have permission to view roles")
+                        return
+                }
+
+                roles, err := db.GetRoles()
+                if err != nil {
+                        fmt.Printf("Error: %v\n", err)
+                        return
+                }
+
+                table := tablewriter.NewWriter(os.Stdout)
+                table.SetHeader([]string{"ROLE", "TYPE", "PERMISSIONS", "DESCRIPTION"})
+                table.SetBorder(false)
+
+                for _, role := range roles {
+                        roleType := "custom"
+                        if role.System {
+                                roleType = "built-in"
+                        }
+
+                        table.Append([]string{
+                                string(role.Name),
+                                roleType,
+                                fmt.Sprintf("%d", len(role.Permissions)),
+                                role.Description,
+                        })
+                }
+
+                table.Render()
+        },
+}
+
+// roleShowCmd shows the permissions granted by a role
+var roleShowCmd = &cobra.Command{
+        Use:   "show [role]",
+        Short: "Show a role's permissions",
+        Long:  `Display every registered permission and whether the role grants it.`,
+        Args:  cobra.ExactArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("role:read"); err != nil {
+                        fmt.Println("Error: You don't have permission to view roles")
+                        return
+                }
+
+                role, err := db.GetRole(models.NormalizeRoleName(args[0]))
+                if err != nil {
+                        fmt.Printf("Error: %v\n", err)
+                        return
+                }
+
+                fmt.Printf("\nRole: %s\n", role.Name)
+                if role.Description != "" {
+                        fmt.Printf("Description: %s\n", role.Description)
+                }
+                fmt.Println()
+
+                table := tablewriter.NewWriter(os.Stdout)
+                table.SetHeader([]string{"PERMISSION", "GRANTED", "DESCRIPTION"})
+                table.SetBorder(false)
+
+                for _, p := range models.PermissionRegistry {
+                        granted := ""
+                        if role.HasPermission(p.Name) {
+                                granted = "yes"
+                        }
+                        table.Append([]string{p.Name, granted, p.Description})
+                }
+
+                table.Render()
+        },
+}
+
+// roleCreateCmd creates a custom role
+var roleCreateCmd = &cobra.Command{
+        Use:   "create [name]",
+        Short: "Create a custom role",
+        Long: `Create a custom role. Names are lowercased with spaces replaced by dashes.
+Use --copy-from to start from the permissions of an existing role, for example:
+
+  pos role create "shift lead" --copy-from cashier
+  pos role grant shift-lead report:generate`,
+        Args: cobra.ExactArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("role:manage"); err != nil {
+                        fmt.Println("Error: You don't have permission to manage roles")
+                        return
+                }
+
+                session := auth.GetCurrentUser()
+                role, err := db.CreateRole(
+                        models.NormalizeRoleName(args[0]),
+                        roleDescription,
+                        models.NormalizeRoleName(roleCopyFrom),
+                        session.Username,
+                )
+                if err != nil {
+                        fmt.Printf("Error creating role: %v\n", err)
+                        return
+                }
+
+                fmt.Printf("Role '%s' created with %d permission(s)\n", role.Name, len(role.Permissions))
+        },
+}
+
+// roleDeleteCmd deletes a custom role
+var roleDeleteCmd = &cobra.Command{
+        Use:   "delete [name]",
+        Short: "Delete a custom role",
+        Long:  `Delete a custom role. Built-in roles and roles still assigned to staff cannot be deleted.`,
+        Args:  cobra.ExactArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("role:manage"); err != nil {
+                        fmt.Println("Error: You don't have permission to manage roles")
+                        return
+                }
+
+                name := models.NormalizeRoleName(args[0])
+                session := auth.GetCurrentUser()
+                if err := db.DeleteRole(name, session.Username); err != nil {
+                        fmt.Printf("Error deleting role: %v\n", err)
+                        return
+                }
+
+                fmt.Printf("Role '%s' deleted\n", name)
+        },
+}
+
+// roleGrantCmd grants permissions to a role
+var roleGrantCmd = &cobra.Command{
+        Use:   "grant [role] [permission...]",
+        Short: "Grant permissions to a role",
+        Long:  `Grant one or more permissions to a role. Run 'pos role permissions' to list them.`,
+        Args:  cobra.MinimumNArgs(2),
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("role:manage"); err != nil {
+                        fmt.Println("Error: You don't have permission to manage roles")
+                        return
+                }
+
+                name := models.NormalizeRoleName(args[0])
+                session := auth.GetCurrentUser()
+                for _, permission := range args[1:] {
+                        if err := db.GrantPermission(name, permission, session.Username); err != nil {
+                                fmt.Printf("Error granting %s: %v\n", permission, err)
+                                continue
+                        }
+                        fmt.Printf("Granted %s to role '%s'\n", permission, name)
+                }
+        },
+}
+
+// roleRevokeCmd revokes permissions from a role
+var roleRevokeCmd = &cobra.Command{
+        Use:   "revoke [role] [permission...]",
+        Short: "Revoke permissions from a role",
+        Long:  `Revoke one or more permissions from a role.`,
+        Args:  cobra.MinimumNArgs(2),
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("role:manage"); err != nil {
+                        fmt.Println("Error: You don't have permission to manage roles")
+                        return
+                }
+
+                name := models.NormalizeRoleName(args[0])
+                session := auth.GetCurrentUser()
+                for _, permission := range args[1:] {
+                        if err := db.RevokePermission(name, permission, session.Username); err != nil {
+                                fmt.Printf("Error revoking %s: %v\n", permission, err)
+                                continue
+                        }
+                        fmt.Printf("Revoked %s from role '%s'\n", permission, name)
+                }
+        },
+}
+
+// rolePermissionsCmd lists all registered permissions
+var rolePermissionsCmd = &cobra.Command{
+        Use:   "permissions",
+        Short: "List all permissions",
+        Long:  `List every permission that can be granted to a role.`,
+        Run: func(cmd *cobra.Command, args []string) {
+                // Check permissions
+                if err := auth.RequirePermission("role:read"); err != nil {
+                        fmt.Println("Error: You don't have permission to view roles")
+                        return
+                }
+
+                table := tablewriter.NewWriter(os.Stdout)
+                table.SetHeader([]string{"PERMISSION", "DESCRIPTION"})
+                table.SetBorder(false)
+
+                for _, p := range models.PermissionRegistry {
+                        table.Append([]string{p.Name, p.Description})
+                }
+
+                table.Render()
+                fmt.Printf("\nThe admin role always has all %d permissions.\n", len(models.PermissionRegistry))
+                fmt.Println("Grant them to other roles with: pos role grant [role] [permission...]")
+        },
+}
+
+func init() {
+        rootCmd.AddCommand(roleCmd)
+
+        roleCmd.AddCommand(roleListCmd)
+        roleCmd.AddCommand(roleShowCmd)
+        roleCmd.AddCommand(roleCreateCmd)
+        roleCmd.AddCommand(roleDeleteCmd)
+        roleCmd.AddCommand(roleGrantCmd)
+        roleCmd.AddCommand(roleRevokeCmd)
+        roleCmd.AddCommand(rolePermissionsCmd)
+
+        // Add flags for create command
+        roleCreateCmd.Flags().StringVar(&roleDescription, "description", "", "Role description")
+        roleCreateCmd.Flags().StringVar(&roleCopyFrom, "copy-from", "", "Copy permissions from an existing role")
+}
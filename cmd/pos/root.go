@@ -48,12 +48,20 @@ a classic command-line interface for managing your business operations.`,
                         if err := db.Initialize(dbPath); err != nil {
                                 return fmt.Errorf("failed to initialize database: %w", err)
                         }
+
+                        // Load role permissions from the database
+                        auth.SetRoleLoader(db.GetRole)
                         
                         // Try to load session if it exists
                         if err := auth.LoadSession(); err != nil {
                                 fmt.Printf("Warning: Failed to load session: %v\n", err)
                                 // Non-fatal error, continue without a session
                         }
+
+                        // Lock idle sessions and keep locked sessions from running commands
+                        if err := enforceSessionLock(cmd); err != nil {
+                                return err
+                        }
                         
                         return nil
                 },
@@ -72,6 +80,8 @@ func init() {
 
         // Initialize the CLI commands
         initClassicCommands()
+        initUserCommands()
+        initStaffCommands()
 }
 
 // ensureDirectoriesExist makes sure required directories are available
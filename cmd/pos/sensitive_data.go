@@ -54,28 +54,12 @@ var sensitiveStoreCmd = &cobra.Command{
                 }
 
                 // Store the sensitive data
-                err = db.StoreSensitiveData(resourceType, resourceID, fieldName, value)
+                err = db.StoreSensitiveData(auditContext(session), resourceType, resourceID, fieldName, value)
                 if err != nil {
                         fmt.Printf("Error storing sensitive data: %v\n", err)
                         return
                 }
 
-                // Log the action
-                if session != nil {
-                        description := fmt.Sprintf("Stored sensitive data for %s %d, field: %s", resourceType, resourceID, fieldName)
-                        db.AddAuditLog(
-                                session.Username,
-                                db.ActionCreate,
-                                "sensitive_data",
-                                fmt.Sprintf("%s/%d/%s", resourceType, resourceID, fieldName),
-                                description,
-                                "",
-                                "<encrypted>",
-                                "",
-                                "",
-                        )
-                }
-
                 fmt.Printf("Sensitive data stored successfully for %s %d, field: %s\n", resourceType, resourceID, fieldName)
         },
 }
@@ -161,55 +145,23 @@ var sensitiveDeleteCmd = &cobra.Command{
                 // If field name is provided, delete specific field
                 if len(args) > 2 {
                         fieldName := args[2]
-                        err = db.DeleteSensitiveData(resourceType, resourceID, fieldName)
+                        err = db.DeleteSensitiveData(auditContext(session), resourceType, resourceID, fieldName)
                         if err != nil {
                                 fmt.Printf("Error deleting sensitive data: %v\n", err)
                                 return
                         }
 
-                        // Log the deletion
-                        if session != nil {
-                                description := fmt.Sprintf("Deleted sensitive data for %s %d, field: %s", resourceType, resourceID, fieldName)
-                                db.AddAuditLog(
-                                        session.Username,
-                                        db.ActionDelete,
-                                        "sensitive_data",
-                                        fmt.Sprintf("%s/%d/%s", resourceType, resourceID, fieldName),
-                                        description,
-                                        "",
-                                        "",
-                                        "",
-                                        "",
-                                )
-                        }
-
                         fmt.Printf("Sensitive data deleted for %s %d, field: %s\n", resourceType, resourceID, fieldName)
                         return
                 }
 
                 // Delete all sensitive data for this resource
-                err = db.DeleteAllSensitiveDataForResource(resourceType, resourceID)
+                err = db.DeleteAllSensitiveDataForResource(auditContext(session), resourceType, resourceID)
                 if err != nil {
                         fmt.Printf("Error deleting all sensitive data: %v\n", err)
                         return
                 }
 
-                // Log the deletion
-                if session != nil {
-                        description := fmt.Sprintf("Deleted all sensitive data for %s %d", resourceType, resourceID)
-                        db.AddAuditLog(
-                                session.Username,
-                                db.ActionDelete,
-                                "sensitive_data",
-                                fmt.Sprintf("%s/%d", resourceType, resourceID),
-                                description,
-                                "",
-                                "",
-                                "",
-                                "",
-                        )
-                }
-
                 fmt.Printf("All sensitive data deleted for %s %d\n", resourceType, resourceID)
         },
 }
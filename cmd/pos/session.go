@@ -0,0 +1,405 @@
+package main
+
+import (
+        "errors"
+        "fmt"
+        "strings"
+        "time"
+
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/handlers"
+        "termpos/internal/models"
+)
+
+var (
+        switchCmd = &cobra.Command{
+                Use:   "switch [username] [pin]",
+                Short: "Switch to another user",
+                Long: `Switch the terminal to another user with their PIN, without logging out first.
+Users who have not set a PIN are asked for their password instead. This also
+takes over a locked session.`,
+                Args: cobra.MaximumNArgs(2),
+                RunE: runSwitch,
+        }
+
+        lockCmd = &cobra.Command{
+                Use:   "lock",
+                Short: "Lock the current session",
+                Long:  "Lock the terminal until you unlock it or another user switches in",
+                Args:  cobra.NoArgs,
+                RunE:  runLock,
+        }
+
+        passwdCmd = &cobra.Command{
+                Use:   "passwd",
+                Short: "Change your password",
+                Long: `Change your own password. The new password must meet the password policy and
+must not match one of your recent passwords.`,
+                Args: cobra.NoArgs,
+                RunE: func(cmd *cobra.Command, args []string) error {
+                        return changeOwnPassword("")
+                },
+        }
+
+        unlockCmd = &cobra.Command{
+                Use:   "unlock [pin]",
+                Short: "Unlock the current session",
+                Long:  "Unlock a locked session with your PIN, or your password if you have not set a PIN",
+                Args:  cobra.MaximumNArgs(1),
+                RunE:  runUnlock,
+        }
+)
+
+// sessionCommands can be run while the session is locked or waiting for a password change
+// or two-factor enrollment
+var sessionCommands = map[string]bool{
+        "login":   true,
+        "logout":  true,
+        "switch":  true,
+        "lock":    true,
+        "unlock":  true,
+        "passwd":  true,
+        "version": true,
+        "help":    true,
+}
+
+// securitySettings returns the configured security settings, or the defaults if they cannot be loaded
+func securitySettings() models.SecuritySettings {
+        settings, err := db.GetSettings()
+        if err != nil {
+                return models.SecuritySettings{}
+        }
+        return settings.Security
+}
+
+// enforceSessionLock locks an idle session and stops commands from running while the
+// session is locked, the user must change their password or must enroll in two-factor
+// authentication. Otherwise it records activity on the session.
+func enforceSessionLock(cmd *cobra.Command) error {
+        session := auth.GetCurrentUser()
+        if session == nil {
+                return nil
+        }
+
+        timeout := securitySettings().IdleLock()
+        locked, err := auth.LockIfIdle(timeout)
+        if err != nil {
+                fmt.Printf("Warning: Failed to lock idle session: %v\n", err)
+        }
+        if locked {
+                fmt.Printf("Session locked after %s of inactivity\n", timeout)
+        }
+
+        if session.Locked || session.PasswordChangeRequired || session.TwoFactorSetupRequired {
+                if cmd.Parent() == cmd.Root() && sessionCommands[cmd.Name()] {
+                        return nil
+                }
+                if session.Locked {
+                        return auth.ErrSessionLocked
+                }
+                if session.PasswordChangeRequired {
+                        return auth.ErrPasswordChangeRequired
+                }
+                if strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ") == twoFactorSetupCommand {
+                        return nil
+                }
+                return auth.ErrTwoFactorSetupRequired
+        }
+
+        if err := auth.Touch(); err != nil {
+                fmt.Printf("Warning: Failed to update session: %v\n", err)
+        }
+        return nil
+}
+
+// authenticate logs a user in with their password or PIN, and a TOTP or recovery code
+// when they have two-factor authentication enabled. Failed attempts are counted and
+// logged, and the account is locked once the configured limit is reached, for longer
+// with each further failure. The session is marked as needing a password change on
+// first login, after an admin reset and when the password has expired, and as needing
+// two-factor enrollment when the user's role requires it.
+func authenticate(username, secret string, usePIN bool, otp, ipAddress string) (*auth.Session, error) {
+        user, err := db.GetUserByUsername(username)
+        if err != nil {
+                LogLoginAction(username, false, ipAddress)
+                return nil, auth.ErrInvalidCredentials
+        }
+
+        security, err := db.GetUserSecurity(user.ID)
+        if err != nil {
+                return nil, err
+        }
+        if security.IsLocked(time.Now()) {
+                LogLoginAction(username, false, ipAddress)
+                return nil, fmt.Errorf("%w until %s", auth.ErrAccountLocked, security.LockedUntil.Format("15:04:05"))
+        }
+
+        policy := securitySettings()
+
+        if usePIN {
+                _, err = auth.CheckPIN(username, secret, db.GetUserByUsername, db.GetUserSecurity)
+        } else {
+                _, err = auth.CheckCredentials(username, secret, db.GetUserByUsername)
+        }
+
+        usedRecoveryCode := false
+        if err == nil && security.TwoFactorEnabled {
+                if otp == "" {
+                        // Not a failure, the caller asks for the code and tries again
+                        return nil, auth.ErrTwoFactorRequired
+                }
+                usedRecoveryCode, err = handlers.VerifyTwoFactor(user.ID, otp)
+        }
+
+        if err != nil {
+                LogLoginAction(username, false, ipAddress)
+                if !errors.Is(err, auth.ErrInvalidCredentials) && !errors.Is(err, auth.ErrInvalidTwoFactorCode) {
+                        return nil, err
+                }
+
+                security, recordErr := db.RecordFailedLogin(user.ID, policy)
+                if recordErr != nil {
+                        fmt.Printf("Warning: Failed to record failed login: %v\n", recordErr)
+                        return nil, err
+                }
+
+                if security.IsLocked(time.Now()) {
+                        db.AddAuditLog(username, db.ActionAccess, "auth", username,
+                                fmt.Sprintf("Account locked after %d failed login attempts", security.FailedAttempts),
+                                "", "", ipAddress, fmt.Sprintf("locked_until=%s", security.LockedUntil.Format(time.RFC3339)))
+                        return nil, fmt.Errorf("%w until %s", auth.ErrAccountLocked, security.LockedUntil.Format("15:04:05"))
+                }
+                return nil, err
+        }
+
+        session, err := auth.StartSession(user, db.UpdateLastLogin)
+        if err != nil {
+                return nil, err
+        }
+
+        if security.FailedAttempts > 0 {
+                if err := db.ResetFailedLogins(user.ID); err != nil {
+                        fmt.Printf("Warning: Failed to reset failed logins: %v\n", err)
+                }
+        }
+        LogLoginAction(username, true, ipAddress)
+
+        if usedRecoveryCode {
+                remaining, _ := db.CountUnusedRecoveryCodes(user.ID)
+                db.AddAuditLog(username, db.ActionAccess, "auth", username,
+                        fmt.Sprintf("Logged in with a recovery code, %d remaining", remaining),
+                        "", "", ipAddress, "")
+        }
+
+        firstLogin := user.LastLoginAt.IsZero()
+        expired := security.PasswordExpired(policy.PasswordMaxAge(), user.CreatedAt, time.Now())
+        if security.MustChangePassword || firstLogin || expired {
+                // Keep requiring the change until it is made, even across logins
+                if !security.MustChangePassword {
+                        if err := db.SetPasswordChangeRequired(user.ID, true); err != nil {
+                                fmt.Printf("Warning: Failed to require password change: %v\n", err)
+                        }
+                }
+                session.PasswordChangeRequired = true
+        }
+
+        if policy.RequiresTwoFactor(user.Role) && !security.TwoFactorEnabled {
+                session.TwoFactorSetupRequired = true
+        }
+
+        if session.PasswordChangeRequired || session.TwoFactorSetupRequired {
+                if err := auth.SaveSession(); err != nil {
+                        fmt.Printf("Warning: Failed to save session: %v\n", err)
+                }
+        }
+
+        return session, nil
+}
+
+// authenticateInteractive logs a user in like authenticate, asking for their two-factor
+// authentication code when one is required
+func authenticateInteractive(username, secret string, usePIN bool) (*auth.Session, error) {
+        session, err := authenticate(username, secret, usePIN, "", "")
+        if !errors.Is(err, auth.ErrTwoFactorRequired) {
+                return session, err
+        }
+
+        fmt.Print("Authentication code (or recovery code): ")
+        otp, err := stdinReader.ReadString('\n')
+        if err != nil {
+                return nil, fmt.Errorf("failed to read authentication code: %w", err)
+        }
+
+        return authenticate(username, secret, usePIN, strings.TrimSpace(otp), "")
+}
+
+// changeOwnPassword changes the logged in user's password. If current is empty the user
+// is asked for their current password.
+func changeOwnPassword(current string) error {
+        session := auth.GetCurrentUser()
+        if session == nil {
+                return fmt.Errorf("you must be logged in to change your password")
+        }
+
+        user, err := db.GetUserByID(session.UserID)
+        if err != nil {
+                return fmt.Errorf("failed to retrieve user: %w", err)
+        }
+
+        if current == "" {
+                fmt.Print("Current password: ")
+                current, err = stdinReader.ReadString('\n')
+                if err != nil {
+                        return fmt.Errorf("failed to read password: %w", err)
+                }
+                current = strings.TrimSpace(current)
+        }
+        if !auth.CheckPasswordHash(current, user.PasswordHash) {
+                return fmt.Errorf("current password is incorrect")
+        }
+
+        password, err := getPassword("New password: ", "Confirm new password: ")
+        if err != nil {
+                return err
+        }
+
+        if err := setUserPassword(user, password, false); err != nil {
+                return err
+        }
+
+        session.PasswordChangeRequired = false
+        if err := auth.SaveSession(); err != nil {
+                fmt.Printf("Warning: Failed to save session: %v\n", err)
+        }
+
+        LogUserAction(session, db.ActionUserMod, user.ID, fmt.Sprintf("User %s changed their password", user.Username), nil, nil)
+        fmt.Println("Your password has been changed")
+        return nil
+}
+
+// hasPIN reports whether a user logs in to the terminal with a PIN rather than a password
+func hasPIN(username string) bool {
+        user, err := db.GetUserByUsername(username)
+        if err != nil {
+                return false
+        }
+
+        security, err := db.GetUserSecurity(user.ID)
+        if err != nil {
+                return false
+        }
+
+        return security.HasPIN()
+}
+
+// promptCredential asks for a PIN or password
+func promptCredential(usePIN bool) (string, error) {
+        prompt := "Password: "
+        if usePIN {
+                prompt = "PIN: "
+        }
+
+        fmt.Print(prompt)
+        secret, err := stdinReader.ReadString('\n')
+        if err != nil {
+                return "", fmt.Errorf("failed to read credentials: %w", err)
+        }
+
+        return strings.TrimSpace(secret), nil
+}
+
+// runSwitch handles the switch command
+func runSwitch(cmd *cobra.Command, args []string) error {
+        var username string
+        if len(args) > 0 {
+                username = args[0]
+        } else {
+                username = readInput(stdinReader, "Username: ", "")
+        }
+        if username == "" {
+                return fmt.Errorf("username is required")
+        }
+
+        usePIN := hasPIN(username)
+
+        var secret string
+        if len(args) > 1 {
+                secret = args[1]
+        } else {
+                var err error
+                secret, err = promptCredential(usePIN)
+                if err != nil {
+                        return err
+                }
+        }
+
+        previous := auth.GetCurrentUser()
+        session, err := authenticateInteractive(username, secret, usePIN)
+        if err != nil {
+                return fmt.Errorf("switch failed: %w", err)
+        }
+
+        if previous != nil && previous.Username != session.Username {
+                fmt.Printf("Switched from %s to %s (Role: %s)\n", previous.Username, session.Username, session.Role)
+        } else {
+                fmt.Printf("Logged in as %s (Role: %s)\n", session.Username, session.Role)
+        }
+        return nil
+}
+
+// runLock handles the lock command
+func runLock(cmd *cobra.Command, args []string) error {
+        session := auth.GetCurrentUser()
+        if session == nil {
+                return fmt.Errorf("you are not logged in")
+        }
+
+        if err := auth.Lock(); err != nil {
+                return fmt.Errorf("failed to lock session: %w", err)
+        }
+
+        LogSystemAction(session, db.ActionAccess, "auth", session.Username, "Session locked")
+        fmt.Println("Session locked. Run 'pos unlock' to continue or 'pos switch' to change user.")
+        return nil
+}
+
+// runUnlock handles the unlock command
+func runUnlock(cmd *cobra.Command, args []string) error {
+        session := auth.GetCurrentUser()
+        if session == nil {
+                return fmt.Errorf("you are not logged in")
+        }
+        if !session.Locked {
+                fmt.Println("Session is not locked")
+                return nil
+        }
+
+        usePIN := hasPIN(session.Username)
+
+        var secret string
+        if len(args) > 0 {
+                secret = args[0]
+        } else {
+                var err error
+                secret, err = promptCredential(usePIN)
+                if err != nil {
+                        return err
+                }
+        }
+
+        if _, err := authenticateInteractive(session.Username, secret, usePIN); err != nil {
+                return fmt.Errorf("unlock failed: %w", err)
+        }
+
+        fmt.Printf("Session unlocked for %s\n", session.Username)
+        return nil
+}
+
+func init() {
+        rootCmd.AddCommand(switchCmd)
+        rootCmd.AddCommand(lockCmd)
+        rootCmd.AddCommand(unlockCmd)
+        rootCmd.AddCommand(passwdCmd)
+}
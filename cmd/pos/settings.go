@@ -83,7 +83,7 @@ var settingsUpdateCmd = &cobra.Command{
                 }
 
                 // Save updated settings to DB
-                err = db.SaveSettings(updated, session.Username)
+                err = db.SaveSettings(auditContext(session), updated)
                 if err != nil {
                         fmt.Printf("Error saving settings: %v\n", err)
                         return
@@ -176,7 +176,7 @@ var settingsImportCmd = &cobra.Command{
                 }
 
                 // Save to DB
-                err = db.SaveSettings(settings, session.Username)
+                err = db.SaveSettings(auditContext(session), settings)
                 if err != nil {
                         fmt.Printf("Error saving settings: %v\n", err)
                         return
@@ -372,9 +372,66 @@ func displaySettings(settings models.Settings) {
         systemTable.Append([]string{"Date Format", settings.System.DateFormat})
         systemTable.Append([]string{"Time Format", settings.System.TimeFormat})
         systemTable.Append([]string{"Default Operating Mode", settings.System.DefaultOperatingMode})
+        systemTable.Append([]string{"Terminal ID", settings.System.Terminal()})
+        systemTable.Append([]string{"Idempotency Key Retention", settings.System.IdempotencyRetention().String()})
         systemTable.Render()
         fmt.Println()
 
+        // Print security settings
+        fmt.Println("=== Security Settings ===")
+        securityTable := tablewriter.NewWriter(os.Stdout)
+        securityTable.SetHeader([]string{"Setting", "Value"})
+        securityTable.SetBorder(false)
+        securityTable.SetColumnSeparator(" | ")
+        securityTable.Append([]string{"Max Discount Without Approval (%)", fmt.Sprintf("%.1f", settings.Security.DiscountLimit())})
+        securityTable.Append([]string{"Approval Timeout", settings.Security.ApprovalTimeout().String()})
+        idleLock := "Disabled"
+        if settings.Security.IdleLock() > 0 {
+                idleLock = settings.Security.IdleLock().String()
+        }
+        securityTable.Append([]string{"Idle Session Lock", idleLock})
+        securityTable.Append([]string{"Failed Logins Before Lockout", fmt.Sprintf("%d", settings.Security.FailedLoginLimit())})
+        securityTable.Append([]string{"Lockout Duration", settings.Security.LockoutDuration().String() + " (doubles on each further failure)"})
+        securityTable.Append([]string{"API Access Token Lifetime", settings.Security.AccessTokenTTL().String()})
+        securityTable.Append([]string{"API Refresh Token Lifetime", settings.Security.RefreshTokenTTL().String()})
+        securityTable.Append([]string{"Password Min Length", fmt.Sprintf("%d", settings.Security.MinPasswordLength())})
+        securityTable.Append([]string{"Password Character Classes", fmt.Sprintf("%d of 4", settings.Security.MinPasswordClasses())})
+        securityTable.Append([]string{"Password History", fmt.Sprintf("%d", settings.Security.PasswordHistoryLimit())})
+        passwordMaxAge := "Never expires"
+        if settings.Security.PasswordMaxAge() > 0 {
+                passwordMaxAge = fmt.Sprintf("%d days", settings.Security.PasswordMaxAgeDays)
+        }
+        securityTable.Append([]string{"Password Max Age", passwordMaxAge})
+        securityTable.Append([]string{"Breached Passwords File", settings.Security.BreachListPath()})
+        securityTable.Append([]string{"Stale Account After", fmt.Sprintf("%d days", int(settings.Security.StaleAfter().Hours()/24))})
+        twoFactorRoles := settings.Security.RequireTwoFactorRoles
+        if twoFactorRoles == "" {
+                twoFactorRoles = "None"
+        }
+        securityTable.Append([]string{"Two-Factor Required For", twoFactorRoles})
+        securityTable.Render()
+        fmt.Println()
+
+        // Print labour settings
+        fmt.Println("=== Labour Settings ===")
+        labourTable := tablewriter.NewWriter(os.Stdout)
+        labourTable.SetHeader([]string{"Setting", "Value"})
+        labourTable.SetBorder(false)
+        labourTable.SetColumnSeparator(" | ")
+        dailyOvertime := "Disabled"
+        if settings.Labour.DailyOvertime() > 0 {
+                dailyOvertime = fmt.Sprintf("%.2f hours", settings.Labour.DailyOvertime().Hours())
+        }
+        weeklyOvertime := "Disabled"
+        if settings.Labour.WeeklyOvertime() > 0 {
+                weeklyOvertime = fmt.Sprintf("%.2f hours", settings.Labour.WeeklyOvertime().Hours())
+        }
+        labourTable.Append([]string{"Daily Overtime After", dailyOvertime})
+        labourTable.Append([]string{"Weekly Overtime After", weeklyOvertime})
+        labourTable.Append([]string{"Week Starts On", settings.Labour.WeekStart().String()})
+        labourTable.Render()
+        fmt.Println()
+
         // Print last updated info
         fmt.Printf("Last Updated: %s", settings.LastUpdated)
         if settings.LastUpdatedBy != "" {
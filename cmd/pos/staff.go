@@ -99,8 +99,8 @@ var staffAddCmd = &cobra.Command{
                 
                 // Validate role
                 role := models.Role(roleStr)
-                if role != models.RoleAdmin && role != models.RoleManager && role != models.RoleCashier {
-                        fmt.Printf("Error: Invalid role: %s (must be admin, manager, or cashier)\n", roleStr)
+                if _, err := db.GetRole(role); err != nil {
+                        fmt.Printf("Error: Invalid role: %s (run 'pos role list' to see available roles)\n", roleStr)
                         return
                 }
                 
@@ -115,6 +115,10 @@ var staffAddCmd = &cobra.Command{
                         hash = usePasswordHash
                 } else if usePassword != "" {
                         // Use provided password and hash it
+                        if err := auth.ValidatePassword(usePassword, securitySettings()); err != nil {
+                                fmt.Printf("Error: %v\n", err)
+                                return
+                        }
                         var err error
                         hash, err = auth.HashPassword(usePassword)
                         if err != nil {
@@ -128,6 +132,10 @@ var staffAddCmd = &cobra.Command{
                                 fmt.Printf("Error: %v\n", err)
                                 return
                         }
+                        if err := auth.ValidatePassword(password, securitySettings()); err != nil {
+                                fmt.Printf("Error: %v\n", err)
+                                return
+                        }
                         
                         // Hash password
                         hash, err = auth.HashPassword(password)
@@ -154,7 +162,7 @@ var staffAddCmd = &cobra.Command{
                         HireDate:     time.Now(),
                 }
                 
-                id, err := db.CreateUser(user)
+                id, err := db.CreateUser(auditContext(auth.GetCurrentUser()), user)
                 if err != nil {
                         if err == db.ErrUserExists {
                                 fmt.Printf("Error: User '%s' already exists\n", username)
@@ -320,7 +328,7 @@ var staffUpdateCmd = &cobra.Command{
                 }
                 
                 // Save the updated user
-                if err := db.UpdateUser(user); err != nil {
+                if err := db.UpdateUser(auditContext(auth.GetCurrentUser()), user); err != nil {
                         fmt.Printf("Error updating staff member: %v\n", err)
                         return
                 }
@@ -345,9 +353,7 @@ var staffFindCmd = &cobra.Command{
                 searchTerm := args[0]
                 
                 // Try to find by role first (if the search term exactly matches a role)
-                if searchTerm == string(models.RoleAdmin) || 
-                   searchTerm == string(models.RoleManager) || 
-                   searchTerm == string(models.RoleCashier) {
+                if _, err := db.GetRole(models.Role(searchTerm)); err == nil {
                         
                         users, err := db.FindUsersByRole(models.Role(searchTerm))
                         if err != nil {
@@ -398,7 +404,7 @@ var staffFindCmd = &cobra.Command{
 var staffSetRoleCmd = &cobra.Command{
         Use:   "set-role [username or id] [role]",
         Short: "Set staff role",
-        Long:  `Update a staff member's role (admin, manager, cashier).`,
+        Long:  `Update a staff member's role (admin, manager, cashier or a custom role).`,
         Args:  cobra.ExactArgs(2),
         Run: func(cmd *cobra.Command, args []string) {
                 // Check permissions
@@ -412,8 +418,8 @@ var staffSetRoleCmd = &cobra.Command{
                 
                 // Validate role
                 role := models.Role(roleStr)
-                if role != models.RoleAdmin && role != models.RoleManager && role != models.RoleCashier {
-                        fmt.Printf("Error: Invalid role: %s (must be admin, manager, or cashier)\n", roleStr)
+                if _, err := db.GetRole(role); err != nil {
+                        fmt.Printf("Error: Invalid role: %s (run 'pos role list' to see available roles)\n", roleStr)
                         return
                 }
                 
@@ -449,7 +455,7 @@ var staffSetRoleCmd = &cobra.Command{
                 // Update role
                 oldRole := user.Role
                 user.Role = role
-                if err := db.UpdateUser(user); err != nil {
+                if err := db.UpdateUser(auditContext(session), user); err != nil {
                         fmt.Printf("Error updating staff role: %v\n", err)
                         return
                 }
@@ -482,16 +488,23 @@ func initStaffCommands() {
                         password := args[1]
                         
                         // Initialize JWT
-                        auth.InitJWT()
+                        if err := auth.InitJWT(); err != nil {
+                                return err
+                        }
                         
                         // Attempt login
-                        session, err := auth.Login(username, password, db.GetUserByUsername, db.UpdateLastLogin)
+                        session, err := authenticateInteractive(username, password, false)
                         if err != nil {
                                 return fmt.Errorf("authentication failed: %v", err)
                         }
                         
-                        // Generate JWT token
-                        token, err := auth.GenerateJWT(session.UserID, session.Username, string(session.Role))
+                        // Generate JWT token, after any revocation of the user's tokens
+                        userSecurity, err := db.GetUserSecurity(session.UserID)
+                        if err != nil {
+                                return fmt.Errorf("failed to generate token: %v", err)
+                        }
+                        token, claims, err := auth.GenerateJWTAt(session.UserID, session.Username, string(session.Role),
+                                userSecurity.TokenIssueTime(time.Now()), securitySettings().AccessTokenTTL())
                         if err != nil {
                                 return fmt.Errorf("failed to generate token: %v", err)
                         }
@@ -501,6 +514,7 @@ func initStaffCommands() {
                         fmt.Println("User:", session.Username)
                         fmt.Println("Role:", session.Role)
                         fmt.Println("JWT Token:", token)
+                        fmt.Println("Expires:", claims.ExpiresAt.Time.Format("2006-01-02 15:04:05"))
                         
                         return nil
                 },
@@ -0,0 +1,229 @@
+package main
+
+import (
+        "fmt"
+        "os"
+        "strconv"
+
+        "github.com/olekukonko/tablewriter"
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/models"
+)
+
+var (
+        commissionCmd = &cobra.Command{
+                Use:   "commission",
+                Short: "Manage staff commission rules",
+                Long: `Commission is paid as a percentage of each sale after discounts and before tax.
+A rule applies to a role, a product category, or both. When several rules match a sale
+the most specific one is used: role and category, then category, then role.`,
+        }
+
+        commissionListCmd = &cobra.Command{
+                Use:   "list",
+                Short: "List commission rules",
+                Args:  cobra.NoArgs,
+                RunE:  runCommissionList,
+        }
+
+        commissionSetCmd = &cobra.Command{
+                Use:   "set",
+                Short: "Set the commission rate for a role or product category",
+                Long: `Set the commission rate for a role, a product category, or both, for example:
+
+  pos commission set --role cashier --rate 1.5
+  pos commission set --category 3 --rate 4
+  pos commission set --role manager --category 3 --rate 5`,
+                Args: cobra.NoArgs,
+                RunE: runCommissionSet,
+        }
+
+        commissionDeleteCmd = &cobra.Command{
+                Use:   "delete [rule_id]",
+                Short: "Delete a commission rule",
+                Args:  cobra.ExactArgs(1),
+                RunE:  runCommissionDelete,
+        }
+)
+
+// formatCommissionScope describes what a commission rule applies to
+func formatCommissionScope(rule models.CommissionRule) (string, string) {
+        role := "Any"
+        if rule.Role != "" {
+                role = string(rule.Role)
+        }
+        category := "Any"
+        if rule.CategoryID != 0 {
+                category = fmt.Sprintf("%s (%d)", rule.CategoryName, rule.CategoryID)
+        }
+        return role, category
+}
+
+// runCommissionList handles the commission list command
+func runCommissionList(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("report:generate"); err != nil {
+                return err
+        }
+
+        rules, err := db.ListCommissionRules()
+        if err != nil {
+                return err
+        }
+        if len(rules) == 0 {
+                fmt.Println("No commission rules configured")
+                return nil
+        }
+
+        table := tablewriter.NewWriter(os.Stdout)
+        table.SetHeader([]string{"ID", "Role", "Category", "Rate", "Updated By", "Updated"})
+        table.SetBorder(false)
+        for _, r := range rules {
+                role, category := formatCommissionScope(r)
+                table.Append([]string{
+                        strconv.Itoa(r.ID),
+                        role,
+                        category,
+                        fmt.Sprintf("%.2f%%", r.Rate),
+                        r.UpdatedBy,
+                        r.UpdatedAt.Format("2006-01-02 15:04"),
+                })
+        }
+        table.Render()
+        return nil
+}
+
+// runCommissionSet handles the commission set command
+func runCommissionSet(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("setting:update"); err != nil {
+                return err
+        }
+        session := auth.GetCurrentUser()
+
+        roleName, _ := cmd.Flags().GetString("role")
+        categoryID, _ := cmd.Flags().GetInt("category")
+        if !cmd.Flags().Changed("rate") {
+                return fmt.Errorf("--rate is required")
+        }
+        rate, _ := cmd.Flags().GetFloat64("rate")
+
+        rule := models.CommissionRule{CategoryID: categoryID, Rate: rate}
+        if roleName != "" {
+                rule.Role = models.NormalizeRoleName(roleName)
+        }
+
+        rule, err := db.SetCommissionRule(auditContext(session), rule)
+        if err != nil {
+                return err
+        }
+
+        role, category := formatCommissionScope(rule)
+        fmt.Printf("Commission rule %d: %.2f%% for role %s, category %s\n", rule.ID, rule.Rate, role, category)
+        return nil
+}
+
+// runCommissionDelete handles the commission delete command
+func runCommissionDelete(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("setting:update"); err != nil {
+                return err
+        }
+        session := auth.GetCurrentUser()
+
+        id, err := strconv.Atoi(args[0])
+        if err != nil {
+                return fmt.Errorf("invalid rule ID: %w", err)
+        }
+
+        if err := db.DeleteCommissionRule(auditContext(session), id); err != nil {
+                return err
+        }
+
+        fmt.Printf("Commission rule %d deleted\n", id)
+        return nil
+}
+
+// staffDisplayName names a staff member in reports
+func staffDisplayName(p models.StaffPerformance) string {
+        if p.UserID == 0 {
+                return "(unattributed)"
+        }
+        if p.Username == "" {
+                return fmt.Sprintf("(deleted user %d)", p.UserID)
+        }
+        return p.Username
+}
+
+// generateStaffReport shows the sales, refunds, discounts and commission of each cashier
+func generateStaffReport(cmd *cobra.Command) error {
+        startDate, _ := cmd.Flags().GetString("start-date")
+        endDate, _ := cmd.Flags().GetString("end-date")
+
+        results, err := db.GetStaffPerformance(startDate, endDate)
+        if err != nil {
+                return fmt.Errorf("failed to get staff report: %w", err)
+        }
+
+        if startDate != "" || endDate != "" {
+                fmt.Printf("Staff Performance for period %s to %s:\n", startDate, endDate)
+        } else {
+                fmt.Println("Staff Performance (all time):")
+        }
+        if len(results) == 0 {
+                fmt.Println("No sales found")
+                return nil
+        }
+
+        table := tablewriter.NewWriter(cmd.OutOrStdout())
+        table.SetHeader([]string{"Staff", "Role", "Sales", "Revenue", "Avg Basket", "Items/Sale", "Refund Rate", "Discounted", "Discounts", "Commission"})
+        table.SetBorder(false)
+
+        var total models.StaffPerformance
+        for _, p := range results {
+                table.Append([]string{
+                        staffDisplayName(p),
+                        string(p.Role),
+                        fmt.Sprintf("%d", p.Transactions),
+                        fmt.Sprintf("$%.2f", p.Revenue),
+                        fmt.Sprintf("$%.2f", p.AverageBasket()),
+                        fmt.Sprintf("%.2f", p.ItemsPerTransaction()),
+                        fmt.Sprintf("%.1f%%", p.RefundRate()),
+                        fmt.Sprintf("%.1f%%", p.DiscountRate()),
+                        fmt.Sprintf("$%.2f", p.DiscountTotal),
+                        fmt.Sprintf("$%.2f", p.Commission),
+                })
+                total.Transactions += p.Transactions
+                total.Revenue += p.Revenue
+                total.Items += p.Items
+                total.Refunds += p.Refunds
+                total.DiscountedSales += p.DiscountedSales
+                total.DiscountTotal += p.DiscountTotal
+                total.Commission += p.Commission
+        }
+        table.SetFooter([]string{
+                "Total", "-",
+                fmt.Sprintf("%d", total.Transactions),
+                fmt.Sprintf("$%.2f", total.Revenue),
+                fmt.Sprintf("$%.2f", total.AverageBasket()),
+                fmt.Sprintf("%.2f", total.ItemsPerTransaction()),
+                fmt.Sprintf("%.1f%%", total.RefundRate()),
+                fmt.Sprintf("%.1f%%", total.DiscountRate()),
+                fmt.Sprintf("$%.2f", total.DiscountTotal),
+                fmt.Sprintf("$%.2f", total.Commission),
+        })
+        table.Render()
+
+        fmt.Println("\nRevenue, basket size and items exclude refunded sales. Commission uses the current rules and roles.")
+        return nil
+}
+
+func init() {
+        rootCmd.AddCommand(commissionCmd)
+        commissionCmd.AddCommand(commissionListCmd)
+        commissionCmd.AddCommand(commissionSetCmd)
+        commissionCmd.AddCommand(commissionDeleteCmd)
+
+        commissionSetCmd.Flags().String("role", "", "Role the rule applies to, any role if empty")
+        commissionSetCmd.Flags().Int("category", 0, "Product category ID the rule applies to, any category if zero")
+        commissionSetCmd.Flags().Float64("rate", 0, "Commission as a percentage of the sale before tax")
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+        "errors"
+        "fmt"
+        "strings"
+
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/handlers"
+        "termpos/internal/qrcode"
+)
+
+var (
+        userTwoFactorCmd = &cobra.Command{
+                Use:   "2fa",
+                Short: "Manage two-factor authentication",
+                Long: `Manage TOTP two-factor authentication. Once enrolled, logging in asks for a code
+from an authenticator app, or one of the single-use recovery codes.`,
+        }
+
+        userTwoFactorEnrollCmd = &cobra.Command{
+                Use:   "enroll",
+                Short: "Enroll in two-factor authentication",
+                Long: `Generate a TOTP secret, show it as a QR code to scan with an authenticator app
+and confirm it with a code from the app. Recovery codes are shown once at the end.`,
+                Args: cobra.NoArgs,
+                RunE: runUserTwoFactorEnroll,
+        }
+
+        userTwoFactorDisableCmd = &cobra.Command{
+                Use:   "disable [username]",
+                Short: "Disable two-factor authentication",
+                Long: `Disable your own two-factor authentication with a current code, or another
+user's with the user:manage permission, for example when they have lost their device.`,
+                Args: cobra.MaximumNArgs(1),
+                RunE: runUserTwoFactorDisable,
+        }
+
+        userTwoFactorRecoveryCmd = &cobra.Command{
+                Use:   "recovery-codes",
+                Short: "Generate new recovery codes",
+                Long:  "Replace your recovery codes with new ones. The old codes stop working.",
+                Args:  cobra.NoArgs,
+                RunE:  runUserTwoFactorRecoveryCodes,
+        }
+
+        userTwoFactorStatusCmd = &cobra.Command{
+                Use:   "status [username]",
+                Short: "Show two-factor authentication status",
+                Args:  cobra.MaximumNArgs(1),
+                RunE:  runUserTwoFactorStatus,
+        }
+)
+
+// twoFactorSetupCommand can be run while the session is waiting for two-factor enrollment
+const twoFactorSetupCommand = "user 2fa enroll"
+
+// enrollTwoFactor walks the logged in user through two-factor enrollment
+func enrollTwoFactor(invert bool) error {
+        session := auth.GetCurrentUser()
+        if session == nil {
+                return fmt.Errorf("you must be logged in to enroll in two-factor authentication")
+        }
+
+        user, err := db.GetUserByID(session.UserID)
+        if err != nil {
+                return fmt.Errorf("failed to retrieve user: %w", err)
+        }
+
+        secret, uri, err := handlers.BeginTwoFactorEnrollment(user)
+        if err != nil {
+                return err
+        }
+
+        fmt.Println("Scan this QR code with your authenticator app:")
+        fmt.Println()
+        if code, err := qrcode.Encode(uri); err == nil {
+                if invert {
+                        fmt.Print(code.Inverted())
+                } else {
+                        fmt.Print(code.String())
+                }
+                fmt.Println()
+        }
+        fmt.Printf("Or enter this key manually: %s\n", secret)
+        fmt.Printf("URI: %s\n\n", uri)
+
+        var recoveryCodes []string
+        for attempt := 1; ; attempt++ {
+                code := readInput(stdinReader, "Enter the code shown in the app: ", "")
+                recoveryCodes, err = handlers.ConfirmTwoFactorEnrollment(user.ID, code)
+                if err == nil {
+                        break
+                }
+                if !errors.Is(err, auth.ErrInvalidTwoFactorCode) || attempt == 3 {
+                        return fmt.Errorf("enrollment failed: %w", err)
+                }
+                fmt.Println("That code is not valid, check the time on this terminal and your device and try again.")
+        }
+
+        session.TwoFactorSetupRequired = false
+        if err := auth.SaveSession(); err != nil {
+                fmt.Printf("Warning: Failed to save session: %v\n", err)
+        }
+
+        LogUserAction(session, db.ActionUserMod, user.ID, fmt.Sprintf("User %s enabled two-factor authentication", user.Username), nil, nil)
+
+        fmt.Println("Two-factor authentication is now enabled.")
+        printRecoveryCodes(recoveryCodes)
+        return nil
+}
+
+// printRecoveryCodes shows newly generated recovery codes
+func printRecoveryCodes(codes []string) {
+        fmt.Println()
+        fmt.Println("Recovery codes (each can be used once if you lose your device):")
+        for _, code := range codes {
+                fmt.Printf("  %s\n", code)
+        }
+        fmt.Println()
+        fmt.Println("Store these somewhere safe, they will not be shown again.")
+}
+
+// confirmOwnTwoFactor asks the logged in user for a current code before a sensitive change
+func confirmOwnTwoFactor(userID int) error {
+        code := readInput(stdinReader, "Authentication code (or recovery code): ", "")
+        _, err := handlers.VerifyTwoFactor(userID, strings.TrimSpace(code))
+        return err
+}
+
+// runUserTwoFactorEnroll handles the user 2fa enroll command
+func runUserTwoFactorEnroll(cmd *cobra.Command, args []string) error {
+        invert, _ := cmd.Flags().GetBool("invert")
+        return enrollTwoFactor(invert)
+}
+
+// runUserTwoFactorDisable handles the user 2fa disable command
+func runUserTwoFactorDisable(cmd *cobra.Command, args []string) error {
+        session := auth.GetCurrentUser()
+        if session == nil {
+                return fmt.Errorf("you must be logged in to change two-factor authentication")
+        }
+
+        username := session.Username
+        if len(args) > 0 {
+                username = args[0]
+        }
+
+        user, err := db.GetUserByUsername(username)
+        if err != nil {
+                if err == db.ErrUserNotFound {
+                        return fmt.Errorf("user '%s' not found", username)
+                }
+                return fmt.Errorf("failed to retrieve user: %w", err)
+        }
+
+        security, err := db.GetUserSecurity(user.ID)
+        if err != nil {
+                return err
+        }
+        if !security.TwoFactorEnabled {
+                return handlers.ErrTwoFactorNotEnabled
+        }
+
+        if user.ID == session.UserID {
+                if err := confirmOwnTwoFactor(user.ID); err != nil {
+                        return err
+                }
+        } else if err := auth.RequirePermission("user:manage"); err != nil {
+                return err
+        }
+
+        if err := db.DisableTwoFactor(user.ID); err != nil {
+                return err
+        }
+
+        LogUserAction(session, db.ActionUserMod, user.ID, fmt.Sprintf("Disabled two-factor authentication for user %s", username), nil, nil)
+        fmt.Printf("Two-factor authentication for user '%s' has been disabled\n", username)
+
+        if securitySettings().RequiresTwoFactor(user.Role) {
+                fmt.Printf("Role %s requires two-factor authentication, %s must enroll again at their next login\n", user.Role, username)
+        }
+        return nil
+}
+
+// runUserTwoFactorRecoveryCodes handles the user 2fa recovery-codes command
+func runUserTwoFactorRecoveryCodes(cmd *cobra.Command, args []string) error {
+        session := auth.GetCurrentUser()
+        if session == nil {
+                return fmt.Errorf("you must be logged in to generate recovery codes")
+        }
+
+        security, err := db.GetUserSecurity(session.UserID)
+        if err != nil {
+                return err
+        }
+        if !security.TwoFactorEnabled {
+                return handlers.ErrTwoFactorNotEnabled
+        }
+
+        if err := confirmOwnTwoFactor(session.UserID); err != nil {
+                return err
+        }
+
+        codes, err := handlers.RegenerateRecoveryCodes(session.UserID)
+        if err != nil {
+                return err
+        }
+
+        LogUserAction(session, db.ActionUserMod, session.UserID, fmt.Sprintf("User %s generated new recovery codes", session.Username), nil, nil)
+        printRecoveryCodes(codes)
+        return nil
+}
+
+// runUserTwoFactorStatus handles the user 2fa status command
+func runUserTwoFactorStatus(cmd *cobra.Command, args []string) error {
+        session := auth.GetCurrentUser()
+        if session == nil {
+                return fmt.Errorf("you must be logged in to view two-factor authentication status")
+        }
+
+        username := session.Username
+        if len(args) > 0 && args[0] != session.Username {
+                if err := auth.RequirePermission("user:manage"); err != nil {
+                        return err
+                }
+                username = args[0]
+        }
+
+        user, err := db.GetUserByUsername(username)
+        if err != nil {
+                if err == db.ErrUserNotFound {
+                        return fmt.Errorf("user '%s' not found", username)
+                }
+                return fmt.Errorf("failed to retrieve user: %w", err)
+        }
+
+        security, err := db.GetUserSecurity(user.ID)
+        if err != nil {
+                return err
+        }
+
+        fmt.Printf("User:      %s (%s)\n", user.Username, user.Role)
+        if security.TwoFactorEnabled {
+                remaining, err := db.CountUnusedRecoveryCodes(user.ID)
+                if err != nil {
+                        return err
+                }
+                fmt.Println("Status:    enabled")
+                fmt.Printf("Recovery:  %d unused codes\n", remaining)
+        } else {
+                fmt.Println("Status:    not enrolled")
+        }
+        if securitySettings().RequiresTwoFactor(user.Role) {
+                fmt.Printf("Required:  yes, for role %s\n", user.Role)
+        } else {
+                fmt.Println("Required:  no")
+        }
+        return nil
+}
+
+func init() {
+        userCmd.AddCommand(userTwoFactorCmd)
+        userTwoFactorCmd.AddCommand(userTwoFactorEnrollCmd)
+        userTwoFactorCmd.AddCommand(userTwoFactorDisableCmd)
+        userTwoFactorCmd.AddCommand(userTwoFactorRecoveryCmd)
+        userTwoFactorCmd.AddCommand(userTwoFactorStatusCmd)
+
+        userTwoFactorEnrollCmd.Flags().Bool("invert", false, "Draw the QR code for a terminal with a light background")
+}
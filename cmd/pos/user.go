@@ -5,7 +5,9 @@ import (
         "fmt"
         "os"
         "strings"
+        "time"
 
+        "github.com/olekukonko/tablewriter"
         "github.com/spf13/cobra"
         "termpos/internal/auth"
         "termpos/internal/db"
@@ -13,10 +15,13 @@ import (
 )
 
 var (
+        // Login command flags
+        loginWithPIN bool
+
         loginCmd = &cobra.Command{
                 Use:   "login [username] [password]",
                 Short: "Log in to the system",
-                Long:  "Authenticate with username and password to access the system",
+                Long:  "Authenticate with username and password, or with your PIN using --pin, to access the system",
                 RunE:  runLogin,
                 Args:  cobra.MaximumNArgs(2),
         }
@@ -47,7 +52,7 @@ var (
         userAddCmd = &cobra.Command{
                 Use:   "add [username] [role]",
                 Short: "Add a new user",
-                Long:  "Create a new user with the specified username and role (admin, manager, cashier)",
+                Long:  "Create a new user with the specified username and role (admin, manager, cashier or a custom role)",
                 Args:  cobra.ExactArgs(2),
                 RunE:  runUserAdd,
         }
@@ -83,6 +88,33 @@ var (
                 Args:  cobra.ExactArgs(1),
                 RunE:  runUserResetPassword,
         }
+
+        userSetPINCmd = &cobra.Command{
+                Use:   "set-pin [username]",
+                Short: "Set a quick login PIN",
+                Long: `Set a short numeric PIN for quick login and user switching. Without a username
+the PIN is set for your own account. Use --clear to remove the PIN.`,
+                Args: cobra.MaximumNArgs(1),
+                RunE: runUserSetPIN,
+        }
+
+        userSecurityReportCmd = &cobra.Command{
+                Use:   "security-report",
+                Short: "Report stale and locked accounts",
+                Long: `List accounts that need attention: locked out accounts, active accounts with no
+login within the stale account period, and accounts whose password must be changed
+or has expired. Use --all to list every account.`,
+                Args: cobra.NoArgs,
+                RunE: runUserSecurityReport,
+        }
+
+        userUnlockCmd = &cobra.Command{
+                Use:   "unlock [username]",
+                Short: "Unlock a locked out user account",
+                Long:  "Clear the failed login count and lockout of a user account",
+                Args:  cobra.ExactArgs(1),
+                RunE:  runUserUnlock,
+        }
 )
 
 // initUserCommands adds the user-related commands to the root command
@@ -99,12 +131,19 @@ func initUserCommands() {
         userCmd.AddCommand(userActivateCmd)
         userCmd.AddCommand(userDeactivateCmd)
         userCmd.AddCommand(userResetPasswordCmd)
+        userCmd.AddCommand(userSetPINCmd)
+        userCmd.AddCommand(userUnlockCmd)
+        userCmd.AddCommand(userSecurityReportCmd)
+
+        loginCmd.Flags().BoolVar(&loginWithPIN, "pin", false, "Log in with your PIN instead of your password")
+        userSetPINCmd.Flags().Bool("clear", false, "Remove the PIN")
+        userSecurityReportCmd.Flags().Bool("all", false, "List all accounts, not only those that need attention")
 }
 
 // runLogin handles the login command
 func runLogin(cmd *cobra.Command, args []string) error {
         // Check if already logged in
-        if auth.IsAuthenticated() {
+        if auth.IsAuthenticated() && !auth.GetCurrentUser().Locked {
                 session := auth.GetCurrentUser()
                 fmt.Printf("Already logged in as %s (Role: %s)\n", session.Username, session.Role)
                 return nil
@@ -116,7 +155,7 @@ func runLogin(cmd *cobra.Command, args []string) error {
                 username = args[0]
                 password = args[1]
         } else {
-                reader := bufio.NewReader(os.Stdin)
+                reader := stdinReader
 
                 // Get username
                 fmt.Print("Username: ")
@@ -128,7 +167,11 @@ func runLogin(cmd *cobra.Command, args []string) error {
                 username = strings.TrimSpace(username)
 
                 // Get password
-                fmt.Print("Password: ")
+                if loginWithPIN {
+                        fmt.Print("PIN: ")
+                } else {
+                        fmt.Print("Password: ")
+                }
                 password, err = reader.ReadString('\n')
                 if err != nil {
                         return fmt.Errorf("failed to read password: %w", err)
@@ -137,9 +180,12 @@ func runLogin(cmd *cobra.Command, args []string) error {
         }
 
         // Authenticate
-        session, err := auth.Login(username, password, db.GetUserByUsername, db.UpdateLastLogin)
+        session, err := authenticateInteractive(username, password, loginWithPIN)
         if err != nil {
                 if err == auth.ErrInvalidCredentials {
+                        if loginWithPIN {
+                                return fmt.Errorf("invalid username or PIN")
+                        }
                         return fmt.Errorf("invalid username or password")
                 }
                 if err == auth.ErrUserInactive {
@@ -149,6 +195,22 @@ func runLogin(cmd *cobra.Command, args []string) error {
         }
 
         fmt.Printf("Successfully logged in as %s (Role: %s)\n", session.Username, session.Role)
+
+        if session.PasswordChangeRequired {
+                fmt.Println("You must change your password before continuing.")
+                current := password
+                if loginWithPIN {
+                        current = ""
+                }
+                if err := changeOwnPassword(current); err != nil {
+                        return err
+                }
+        }
+
+        if session.TwoFactorSetupRequired {
+                fmt.Println("Your role requires two-factor authentication.")
+                return enrollTwoFactor(false)
+        }
         return nil
 }
 
@@ -195,8 +257,8 @@ func runUserAdd(cmd *cobra.Command, args []string) error {
 
         // Validate role
         role := models.Role(roleStr)
-        if role != models.RoleAdmin && role != models.RoleManager && role != models.RoleCashier {
-                return fmt.Errorf("invalid role: %s (must be admin, manager, or cashier)", roleStr)
+        if _, err := db.GetRole(role); err != nil {
+                return fmt.Errorf("invalid role: %s (run 'pos role list' to see available roles)", roleStr)
         }
 
         // Get and confirm password
@@ -205,6 +267,11 @@ func runUserAdd(cmd *cobra.Command, args []string) error {
                 return err
         }
 
+        // Check the password policy
+        if err := auth.ValidatePassword(password, securitySettings()); err != nil {
+                return err
+        }
+
         // Hash password
         hash, err := auth.HashPassword(password)
         if err != nil {
@@ -219,7 +286,7 @@ func runUserAdd(cmd *cobra.Command, args []string) error {
                 Active:       true,
         }
 
-        id, err := db.CreateUser(user)
+        id, err := db.CreateUser(auditContext(auth.GetCurrentUser()), user)
         if err != nil {
                 if err == db.ErrUserExists {
                         return fmt.Errorf("user '%s' already exists", username)
@@ -243,8 +310,8 @@ func runUserUpdate(cmd *cobra.Command, args []string) error {
 
         // Validate role
         role := models.Role(roleStr)
-        if role != models.RoleAdmin && role != models.RoleManager && role != models.RoleCashier {
-                return fmt.Errorf("invalid role: %s (must be admin, manager, or cashier)", roleStr)
+        if _, err := db.GetRole(role); err != nil {
+                return fmt.Errorf("invalid role: %s (run 'pos role list' to see available roles)", roleStr)
         }
 
         // Get user
@@ -258,7 +325,7 @@ func runUserUpdate(cmd *cobra.Command, args []string) error {
 
         // Update role
         user.Role = role
-        if err := db.UpdateUser(user); err != nil {
+        if err := db.UpdateUser(auditContext(auth.GetCurrentUser()), user); err != nil {
                 return fmt.Errorf("failed to update user: %w", err)
         }
 
@@ -286,7 +353,7 @@ func runUserActivate(cmd *cobra.Command, args []string) error {
 
         // Update active status
         user.Active = true
-        if err := db.UpdateUser(user); err != nil {
+        if err := db.UpdateUser(auditContext(auth.GetCurrentUser()), user); err != nil {
                 return fmt.Errorf("failed to activate user: %w", err)
         }
 
@@ -320,11 +387,16 @@ func runUserDeactivate(cmd *cobra.Command, args []string) error {
 
         // Update active status
         user.Active = false
-        if err := db.UpdateUser(user); err != nil {
+        if err := db.UpdateUser(auditContext(session), user); err != nil {
                 return fmt.Errorf("failed to deactivate user: %w", err)
         }
 
-        fmt.Printf("User '%s' has been deactivated\n", username)
+        // Tokens already issued to the user stop working straight away
+        if err := db.RevokeUserTokens(user.ID); err != nil {
+                return fmt.Errorf("user deactivated but their API tokens could not be revoked: %w", err)
+        }
+
+        fmt.Printf("User '%s' has been deactivated and their API tokens revoked\n", username)
         return nil
 }
 
@@ -352,24 +424,214 @@ func runUserResetPassword(cmd *cobra.Command, args []string) error {
                 return err
         }
 
-        // Hash password
-        hash, err := auth.HashPassword(password)
+        // Store the password and have the user choose their own at next login
+        if err := setUserPassword(user, password, true); err != nil {
+                return err
+        }
+
+        LogUserAction(auth.GetCurrentUser(), db.ActionUserMod, user.ID, fmt.Sprintf("Reset password for user %s", username), nil, nil)
+        fmt.Printf("Password for user '%s' has been reset. They must change it at their next login.\n", username)
+        return nil
+}
+
+// runUserSetPIN handles the user set-pin command
+func runUserSetPIN(cmd *cobra.Command, args []string) error {
+        session := auth.GetCurrentUser()
+        if session == nil {
+                return fmt.Errorf("you must be logged in to set a PIN")
+        }
+
+        username := session.Username
+        if len(args) > 0 && args[0] != session.Username {
+                // Setting another user's PIN requires user management permission
+                if err := auth.RequirePermission("user:manage"); err != nil {
+                        return err
+                }
+                username = args[0]
+        }
+
+        // Get user
+        user, err := db.GetUserByUsername(username)
         if err != nil {
-                return fmt.Errorf("failed to hash password: %w", err)
+                if err == db.ErrUserNotFound {
+                        return fmt.Errorf("user '%s' not found", username)
+                }
+                return fmt.Errorf("failed to retrieve user: %w", err)
         }
 
-        // Update password
-        if err := db.UpdateUserPassword(user.ID, hash); err != nil {
-                return fmt.Errorf("failed to update password: %w", err)
+        if clear, _ := cmd.Flags().GetBool("clear"); clear {
+                if err := db.SetUserPIN(user.ID, ""); err != nil {
+                        return err
+                }
+                LogUserAction(session, db.ActionUserMod, user.ID, fmt.Sprintf("Removed PIN for user %s", username), nil, nil)
+                fmt.Printf("PIN for user '%s' has been removed\n", username)
+                return nil
+        }
+
+        reader := stdinReader
+        pin := readInput(reader, fmt.Sprintf("Enter new PIN (%d-%d digits): ", auth.MinPINLength, auth.MaxPINLength), "")
+        confirm := readInput(reader, "Confirm new PIN: ", "")
+        if pin != confirm {
+                return fmt.Errorf("PINs do not match")
+        }
+
+        hash, err := auth.HashPIN(pin)
+        if err != nil {
+                return err
+        }
+
+        if err := db.SetUserPIN(user.ID, hash); err != nil {
+                return err
+        }
+
+        LogUserAction(session, db.ActionUserMod, user.ID, fmt.Sprintf("Set PIN for user %s", username), nil, nil)
+        fmt.Printf("PIN for user '%s' has been set\n", username)
+        return nil
+}
+
+// runUserUnlock handles the user unlock command
+func runUserUnlock(cmd *cobra.Command, args []string) error {
+        // Check permissions
+        if err := auth.RequirePermission("user:manage"); err != nil {
+                return err
+        }
+
+        username := args[0]
+
+        // Get user
+        user, err := db.GetUserByUsername(username)
+        if err != nil {
+                if err == db.ErrUserNotFound {
+                        return fmt.Errorf("user '%s' not found", username)
+                }
+                return fmt.Errorf("failed to retrieve user: %w", err)
+        }
+
+        if err := db.ResetFailedLogins(user.ID); err != nil {
+                return err
+        }
+
+        LogUserAction(auth.GetCurrentUser(), db.ActionUserMod, user.ID, fmt.Sprintf("Unlocked user %s", username), nil, nil)
+        fmt.Printf("User '%s' has been unlocked\n", username)
+        return nil
+}
+
+// runUserSecurityReport handles the user security-report command
+func runUserSecurityReport(cmd *cobra.Command, args []string) error {
+        // Check permissions
+        if err := auth.RequirePermission("user:manage"); err != nil {
+                return err
+        }
+
+        users, err := db.GetAllUsers()
+        if err != nil {
+                return fmt.Errorf("failed to retrieve users: %w", err)
+        }
+
+        records, err := db.GetAllUserSecurity()
+        if err != nil {
+                return err
+        }
+
+        showAll, _ := cmd.Flags().GetBool("all")
+        policy := securitySettings()
+        now := time.Now()
+
+        table := tablewriter.NewWriter(os.Stdout)
+        table.SetHeader([]string{"Username", "Role", "Last Login", "Password Changed", "2FA", "Failed", "Issues"})
+        table.SetBorder(false)
+
+        flagged := 0
+        for _, user := range users {
+                security, ok := records[user.ID]
+                if !ok {
+                        security = models.UserSecurity{UserID: user.ID}
+                }
+
+                issues := accountSecurityIssues(user, security, policy, now)
+                if len(issues) > 0 {
+                        flagged++
+                } else if !showAll {
+                        continue
+                }
+
+                lastLogin := "Never"
+                if !user.LastLoginAt.IsZero() {
+                        lastLogin = user.LastLoginAt.Format("2006-01-02 15:04")
+                }
+                passwordChanged := "Never"
+                if !security.PasswordChangedAt.IsZero() {
+                        passwordChanged = security.PasswordChangedAt.Format("2006-01-02")
+                }
+                twoFactor := "No"
+                if security.TwoFactorEnabled {
+                        twoFactor = "Yes"
+                }
+
+                table.Append([]string{
+                        user.Username,
+                        string(user.Role),
+                        lastLogin,
+                        passwordChanged,
+                        twoFactor,
+                        fmt.Sprintf("%d", security.FailedAttempts),
+                        strings.Join(issues, ", "),
+                })
+        }
+
+        if flagged == 0 && !showAll {
+                fmt.Println("No accounts need attention")
+                return nil
         }
 
-        fmt.Printf("Password for user '%s' has been reset\n", username)
+        table.Render()
+        fmt.Printf("\n%d of %d accounts need attention\n", flagged, len(users))
         return nil
 }
 
+// accountSecurityIssues lists the security problems of an account for the security report
+func accountSecurityIssues(user models.User, security models.UserSecurity, policy models.SecuritySettings, now time.Time) []string {
+        if !user.Active {
+                return nil
+        }
+
+        var issues []string
+        if security.IsLocked(now) {
+                issues = append(issues, fmt.Sprintf("locked until %s", security.LockedUntil.Format("2006-01-02 15:04")))
+        }
+
+        lastSeen := user.LastLoginAt
+        if lastSeen.IsZero() {
+                lastSeen = user.CreatedAt
+        }
+        if now.Sub(lastSeen) > policy.StaleAfter() {
+                if user.LastLoginAt.IsZero() {
+                        issues = append(issues, "stale (never logged in)")
+                } else {
+                        issues = append(issues, fmt.Sprintf("stale (%d days since login)", int(now.Sub(lastSeen).Hours()/24)))
+                }
+        }
+
+        if security.PasswordExpired(policy.PasswordMaxAge(), user.CreatedAt, now) {
+                issues = append(issues, "password expired")
+        } else if security.MustChangePassword {
+                issues = append(issues, "must change password")
+        }
+
+        if policy.RequiresTwoFactor(user.Role) && !security.TwoFactorEnabled {
+                issues = append(issues, "2FA not enrolled")
+        }
+
+        return issues
+}
+
+// stdinReader is shared by prompts that may follow each other in one command, so that
+// input buffered by one prompt is not lost to the next
+var stdinReader = bufio.NewReader(os.Stdin)
+
 // getPassword prompts for a password and confirms it
 func getPassword(prompt, confirmPrompt string) (string, error) {
-        reader := bufio.NewReader(os.Stdin)
+        reader := stdinReader
 
         // Prompt for password
         fmt.Print(prompt)
@@ -392,10 +654,37 @@ func getPassword(prompt, confirmPrompt string) (string, error) {
                 return "", fmt.Errorf("passwords do not match")
         }
 
-        // Validate password length
-        if len(password) < 6 {
-                return "", fmt.Errorf("password must be at least 6 characters")
+        if password == "" {
+                return "", fmt.Errorf("password cannot be empty")
         }
 
         return password, nil
+}
+
+// setUserPassword checks a new password against the password policy and the user's
+// recent passwords, then stores it. mustChange makes the user change it at their next login.
+func setUserPassword(user models.User, password string, mustChange bool) error {
+        policy := securitySettings()
+        if err := auth.ValidatePassword(password, policy); err != nil {
+                return err
+        }
+
+        history, err := db.GetPasswordHistory(user.ID, policy.PasswordHistoryLimit())
+        if err != nil {
+                return err
+        }
+        if err := auth.CheckPasswordReuse(password, append([]string{user.PasswordHash}, history...)); err != nil {
+                return err
+        }
+
+        hash, err := auth.HashPassword(password)
+        if err != nil {
+                return fmt.Errorf("failed to hash password: %w", err)
+        }
+
+        if err := db.ChangeUserPassword(user.ID, hash, mustChange, policy.PasswordHistoryLimit()); err != nil {
+                return fmt.Errorf("failed to update password: %w", err)
+        }
+
+        return nil
 }
\ No newline at end of file
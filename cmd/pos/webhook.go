@@ -0,0 +1,302 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "os"
+        "os/signal"
+        "strconv"
+        "strings"
+
+        "github.com/olekukonko/tablewriter"
+        "github.com/spf13/cobra"
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/models"
+        "termpos/internal/webhook"
+)
+
+// webhookSecretPrefix starts every webhook signing secret
+const webhookSecretPrefix = "whsec_"
+
+var (
+        webhookCmd = &cobra.Command{
+                Use:   "webhook",
+                Short: "Manage webhooks that notify other systems of changes",
+                Long: `Webhooks send sales, refunds, low stock alerts, customer changes and shifts to other
+systems, such as an e-commerce or accounting system, so they do not have to poll the
+agent API.
+
+Events are queued in the same transaction as the change they report and sent by the
+agent server, or by "pos webhook dispatch". Each delivery is a JSON POST with these
+headers:
+
+  X-POS-Event      the event, e.g. sale.created
+  X-POS-Delivery   the delivery ID
+  X-POS-Timestamp  when it was sent, in Unix seconds
+  X-POS-Signature  sha256=<hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the secret>
+
+A delivery that fails is retried with exponential backoff for about a day. Deliveries
+rejected with a 4xx status, or still failing after every retry, become dead letters
+that can be replayed with "pos webhook replay".
+
+Events: ` + strings.Join(models.WebhookEvents, ", "),
+        }
+
+        webhookAddCmd = &cobra.Command{
+                Use:   "add [url]",
+                Short: "Add a webhook",
+                Long: `Add a webhook, for example:
+
+  pos webhook add https://shop.example.com/hooks/pos --events sale.created,stock.low
+
+The signing secret is only shown once.`,
+                Args: cobra.ExactArgs(1),
+                RunE: runWebhookAdd,
+        }
+
+        webhookListCmd = &cobra.Command{
+                Use:   "list",
+                Short: "List webhooks",
+                Args:  cobra.NoArgs,
+                RunE:  runWebhookList,
+        }
+
+        webhookRemoveCmd = &cobra.Command{
+                Use:   "remove [webhook_id]",
+                Short: "Remove a webhook and its queued deliveries",
+                Args:  cobra.ExactArgs(1),
+                RunE:  runWebhookRemove,
+        }
+
+        webhookDeliveriesCmd = &cobra.Command{
+                Use:   "deliveries",
+                Short: "List recent webhook deliveries",
+                Long: `List recent webhook deliveries, newest first. Use --dead to list the dead letters,
+the deliveries that were given up on.`,
+                Args: cobra.NoArgs,
+                RunE: runWebhookDeliveries,
+        }
+
+        webhookReplayCmd = &cobra.Command{
+                Use:   "replay [delivery_id]",
+                Short: "Send a dead or delivered delivery again",
+                Args:  cobra.ExactArgs(1),
+                RunE:  runWebhookReplay,
+        }
+
+        webhookDispatchCmd = &cobra.Command{
+                Use:   "dispatch",
+                Short: "Send queued webhook deliveries",
+                Long: `Send the webhook deliveries that are due. The agent server does this in the
+background; use this command on a terminal that does not run it. With --watch, keep
+sending deliveries as they are queued until interrupted.`,
+                Args: cobra.NoArgs,
+                RunE: runWebhookDispatch,
+        }
+)
+
+// runWebhookAdd handles the webhook add command
+func runWebhookAdd(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("webhook:manage"); err != nil {
+                return err
+        }
+        session := auth.GetCurrentUser()
+
+        eventList, _ := cmd.Flags().GetString("events")
+        events, err := models.ParseWebhookEvents(eventList)
+        if err != nil {
+                return err
+        }
+
+        secret, err := auth.GenerateToken(webhookSecretPrefix)
+        if err != nil {
+                return err
+        }
+
+        hook, err := db.CreateWebhook(models.Webhook{
+                URL:       strings.TrimSpace(args[0]),
+                Secret:    secret,
+                Events:    events,
+                CreatedBy: session.Username,
+        })
+        if err != nil {
+                return err
+        }
+
+        LogWebhookAction(session, db.ActionCreate, hook.ID, fmt.Sprintf("Added webhook %s for %s", hook.URL, strings.Join(hook.Events, ",")), nil, hook)
+
+        fmt.Printf("Webhook %d added for %s\n", hook.ID, hook.URL)
+        fmt.Printf("Events: %s\n", strings.Join(hook.Events, ", "))
+        fmt.Printf("\nSigning secret:\n\n  %s\n\n", secret)
+        fmt.Println("Store the secret now, it cannot be shown again.")
+        return nil
+}
+
+// runWebhookList handles the webhook list command
+func runWebhookList(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("webhook:manage"); err != nil {
+                return err
+        }
+
+        hooks, err := db.ListWebhooks()
+        if err != nil {
+                return err
+        }
+        if len(hooks) == 0 {
+                fmt.Println("No webhooks found")
+                return nil
+        }
+
+        table := tablewriter.NewWriter(os.Stdout)
+        table.SetHeader([]string{"ID", "URL", "Events", "Created By", "Created"})
+        table.SetBorder(false)
+        for _, h := range hooks {
+                table.Append([]string{
+                        strconv.Itoa(h.ID),
+                        h.URL,
+                        strings.Join(h.Events, ", "),
+                        h.CreatedBy,
+                        h.CreatedAt.Format("2006-01-02 15:04"),
+                })
+        }
+        table.Render()
+        return nil
+}
+
+// runWebhookRemove handles the webhook remove command
+func runWebhookRemove(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("webhook:manage"); err != nil {
+                return err
+        }
+        session := auth.GetCurrentUser()
+
+        id, err := strconv.Atoi(args[0])
+        if err != nil {
+                return fmt.Errorf("invalid webhook ID: %w", err)
+        }
+
+        hook, err := db.GetWebhook(id)
+        if err != nil {
+                return err
+        }
+        if err := db.DeleteWebhook(id); err != nil {
+                return err
+        }
+
+        LogWebhookAction(session, db.ActionDelete, hook.ID, fmt.Sprintf("Removed webhook %s", hook.URL), hook, nil)
+        fmt.Printf("Webhook %d (%s) removed\n", hook.ID, hook.URL)
+        return nil
+}
+
+// runWebhookDeliveries handles the webhook deliveries command
+func runWebhookDeliveries(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("webhook:manage"); err != nil {
+                return err
+        }
+
+        status := ""
+        if dead, _ := cmd.Flags().GetBool("dead"); dead {
+                status = models.DeliveryDead
+        }
+        limit, _ := cmd.Flags().GetInt("limit")
+
+        deliveries, err := db.ListWebhookDeliveries(status, limit)
+        if err != nil {
+                return err
+        }
+        if len(deliveries) == 0 {
+                fmt.Println("No webhook deliveries found")
+                return nil
+        }
+
+        table := tablewriter.NewWriter(os.Stdout)
+        table.SetHeader([]string{"ID", "Webhook", "Event", "Status", "Attempts", "Last Error", "Created", "Next Attempt"})
+        table.SetBorder(false)
+        for _, d := range deliveries {
+                next := ""
+                if d.Status == models.DeliveryPending {
+                        next = d.NextAttemptAt.Format("2006-01-02 15:04:05")
+                }
+                lastError := d.LastError
+                if len(lastError) > 60 {
+                        lastError = lastError[:57] + "..."
+                }
+                table.Append([]string{
+                        strconv.Itoa(d.ID),
+                        fmt.Sprintf("%d %s", d.WebhookID, d.URL),
+                        d.Event,
+                        d.Status,
+                        strconv.Itoa(d.Attempts),
+                        lastError,
+                        d.CreatedAt.Format("2006-01-02 15:04:05"),
+                        next,
+                })
+        }
+        table.Render()
+        return nil
+}
+
+// runWebhookReplay handles the webhook replay command
+func runWebhookReplay(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("webhook:manage"); err != nil {
+                return err
+        }
+        session := auth.GetCurrentUser()
+
+        id, err := strconv.Atoi(args[0])
+        if err != nil {
+                return fmt.Errorf("invalid delivery ID: %w", err)
+        }
+
+        delivery, err := db.GetWebhookDelivery(id)
+        if err != nil {
+                return err
+        }
+        if err := db.ReplayWebhookDelivery(id); err != nil {
+                return err
+        }
+
+        LogWebhookAction(session, db.ActionUpdate, delivery.WebhookID, fmt.Sprintf("Replayed %s delivery %d", delivery.Event, delivery.ID), nil, nil)
+        fmt.Printf("Delivery %d (%s to %s) queued to be sent again\n", delivery.ID, delivery.Event, delivery.URL)
+        return nil
+}
+
+// runWebhookDispatch handles the webhook dispatch command
+func runWebhookDispatch(cmd *cobra.Command, args []string) error {
+        if err := auth.RequirePermission("webhook:manage"); err != nil {
+                return err
+        }
+
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+        defer stop()
+
+        dispatcher := webhook.NewDispatcher()
+        if watch, _ := cmd.Flags().GetBool("watch"); watch {
+                fmt.Println("Sending webhook deliveries, press Ctrl+C to stop")
+                dispatcher.Run(ctx)
+                return nil
+        }
+
+        delivered, err := dispatcher.DispatchDue(ctx)
+        if err != nil {
+                return err
+        }
+        fmt.Printf("%d webhook deliveries sent\n", delivered)
+        return nil
+}
+
+func init() {
+        rootCmd.AddCommand(webhookCmd)
+        webhookCmd.AddCommand(webhookAddCmd)
+        webhookCmd.AddCommand(webhookListCmd)
+        webhookCmd.AddCommand(webhookRemoveCmd)
+        webhookCmd.AddCommand(webhookDeliveriesCmd)
+        webhookCmd.AddCommand(webhookReplayCmd)
+        webhookCmd.AddCommand(webhookDispatchCmd)
+
+        webhookAddCmd.Flags().String("events", "", "Comma-separated events to send, e.g. sale.created,refund.created")
+        webhookDeliveriesCmd.Flags().Bool("dead", false, "Only list dead letters")
+        webhookDeliveriesCmd.Flags().Int("limit", 50, "Maximum number of deliveries to list")
+        webhookDispatchCmd.Flags().Bool("watch", false, "Keep sending deliveries until interrupted")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+        "context"
         "fmt"
         "os"
         "path/filepath"
@@ -211,15 +212,15 @@ func configureBackupWorkflow(interval int, path string, enabled bool, keepCount
         settings.Backup.BackupPath = path
         settings.Backup.KeepBackupCount = keepCount
 
-        // Get current user (for audit trails)
-        session := auth.GetCurrentUser()
-        username := "system"
-        if session != nil {
-                username = session.Username
+        // Audit the change as made by a workflow, for the current user
+        actor := db.Actor{Username: "system", Source: db.SourceWorkflow}
+        if session := auth.GetCurrentUser(); session != nil {
+                actor.Username = session.Username
         }
+        ctx := db.WithActor(context.Background(), actor)
 
         // Save updated settings
-        if err := db.SaveSettings(settings, username); err != nil {
+        if err := db.SaveSettings(ctx, settings); err != nil {
                 return fmt.Errorf("failed to save backup settings: %w", err)
         }
 
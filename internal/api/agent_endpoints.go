@@ -0,0 +1,255 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// endpoint documents an unversioned endpoint of the agent server. These predate the
+// versioned API, return bare JSON and report errors as plain text.
+type endpoint struct {
+	Method     string
+	Path       string
+	Permission string
+	Public     bool // The endpoint does not need authentication
+	Idempotent bool // The endpoint accepts an Idempotency-Key header
+	Stream     bool // The response is a stream of server-sent events of type Response
+	Summary    string
+	Request    interface{}
+	Response   interface{}
+	Status     int
+	Query      []parameter
+}
+
+// Bodies of the agent endpoints, declared here so their schemas can be generated
+
+type loginRequest struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	PIN         string `json:"pin"`
+	NewPassword string `json:"new_password"`
+	OTP         string `json:"otp"`
+}
+
+type tokenResponse struct {
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	User         struct {
+		ID       int         `json:"id"`
+		Username string      `json:"username"`
+		Role     models.Role `json:"role"`
+	} `json:"user"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type logoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+	All          bool   `json:"all"`
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+type idResponse struct {
+	ID int `json:"id"`
+}
+
+type stockRequest struct {
+	Stock int `json:"stock"`
+}
+
+type refundRequest struct {
+	Reason string `json:"reason"`
+}
+
+type refundResponse struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+}
+
+type approvalRequest struct {
+	Supervisor string                    `json:"supervisor"`
+	Password   string                    `json:"password"`
+	Reason     string                    `json:"reason"`
+	Actions    []models.RestrictedAction `json:"actions"`
+}
+
+type approvalResponse struct {
+	Token      string    `json:"token"`
+	ApprovedBy string    `json:"approved_by"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type inventoryReport struct {
+	Items []struct {
+		ID    int     `json:"id"`
+		Name  string  `json:"name"`
+		Price float64 `json:"price"`
+		Stock int     `json:"stock"`
+		Value float64 `json:"value"`
+	} `json:"items"`
+	TotalValue float64 `json:"totalValue"`
+}
+
+type productRevenueReport struct {
+	Items        []models.RevenueReport `json:"items"`
+	TotalRevenue float64                `json:"totalRevenue"`
+}
+
+type summaryReport struct {
+	TotalRevenue        float64 `json:"totalRevenue"`
+	TotalItemsSold      int     `json:"totalItemsSold"`
+	TotalTransactions   int     `json:"totalTransactions"`
+	AvgTransactionValue float64 `json:"avgTransactionValue"`
+}
+
+type topProductsReport struct {
+	Items []db.TopSellingProduct `json:"items"`
+	Limit int                    `json:"limit"`
+}
+
+type dailyReport struct {
+	Date         string         `json:"date"`
+	Items        []db.DailySale `json:"items"`
+	TotalUnits   int            `json:"totalUnits"`
+	TotalRevenue float64        `json:"totalRevenue"`
+}
+
+type staffReport struct {
+	StartDate string `json:"startDate"`
+	EndDate   string `json:"endDate"`
+	Items     []struct {
+		UserID              int     `json:"userId"`
+		Username            string  `json:"username"`
+		Role                string  `json:"role"`
+		Transactions        int     `json:"transactions"`
+		Revenue             float64 `json:"revenue"`
+		Items               int     `json:"items"`
+		AverageBasket       float64 `json:"averageBasket"`
+		ItemsPerTransaction float64 `json:"itemsPerTransaction"`
+		Refunds             int     `json:"refunds"`
+		RefundRate          float64 `json:"refundRate"`
+		DiscountedSales     int     `json:"discountedSales"`
+		DiscountRate        float64 `json:"discountRate"`
+		DiscountTotal       float64 `json:"discountTotal"`
+		Commission          float64 `json:"commission"`
+	} `json:"items"`
+	TotalRevenue      float64 `json:"totalRevenue"`
+	TotalTransactions int     `json:"totalTransactions"`
+	TotalCommission   float64 `json:"totalCommission"`
+}
+
+// agentEndpoints lists the unversioned endpoints registered by the agent command
+var agentEndpoints = []endpoint{
+	{Method: http.MethodGet, Path: "/health", Public: true, Summary: "Check the server is running", Response: statusResponse{}},
+	{Method: http.MethodGet, Path: "/openapi.json", Public: true, Summary: "Get this OpenAPI document", Response: map[string]interface{}{}},
+
+	{Method: http.MethodPost, Path: "/auth/login", Public: true, Summary: "Log in and get an access and refresh token", Request: loginRequest{}, Response: tokenResponse{}},
+	{Method: http.MethodPost, Path: "/auth/refresh", Public: true, Summary: "Exchange a refresh token for new tokens", Request: refreshRequest{}, Response: tokenResponse{}},
+	{Method: http.MethodPost, Path: "/auth/logout", Summary: "Revoke the access token and, optionally, refresh tokens", Request: logoutRequest{}, Response: statusResponse{}},
+
+	{Method: http.MethodGet, Path: "/products", Permission: "product:read", Summary: "List all products", Response: []models.Product{}},
+	{Method: http.MethodPost, Path: "/products", Permission: "product:create", Summary: "Add a product", Request: models.Product{}, Response: idResponse{}, Status: http.StatusCreated, Idempotent: true},
+	{Method: http.MethodGet, Path: "/products/{id}", Permission: "product:read", Summary: "Get a product", Response: models.Product{}},
+	{Method: http.MethodPut, Path: "/products/{id}", Permission: "product:update", Summary: "Set the stock of a product", Request: stockRequest{}, Response: statusResponse{}, Idempotent: true},
+
+	{Method: http.MethodGet, Path: "/sales", Permission: "sale:read", Summary: "List all sales", Response: []models.Sale{}},
+	{Method: http.MethodPost, Path: "/sales", Permission: "sale:create", Summary: "Record a sale. Restricted discounts and price overrides need an X-Approval-Token header.", Request: models.Sale{}, Response: idResponse{}, Status: http.StatusCreated, Idempotent: true},
+	{Method: http.MethodPost, Path: "/sales/{id}/refund", Permission: "sale:create", Summary: "Refund a sale. Users without sale:refund need an X-Approval-Token header.", Request: refundRequest{}, Response: refundResponse{}, Idempotent: true},
+	{Method: http.MethodPost, Path: "/approvals", Permission: "sale:create", Summary: "Get a supervisor approval token for restricted actions", Request: approvalRequest{}, Response: approvalResponse{}, Status: http.StatusCreated, Idempotent: true},
+
+	{Method: http.MethodGet, Path: "/events", Permission: models.PermissionEventStream, Stream: true, Response: models.Event{},
+		Summary: "Stream live events as server-sent events. Each event's id is its ID, its event is its type, and its data the JSON event. Only the events the user's permissions allow are sent; a comment is sent every 15 seconds as a heartbeat.",
+		Query: []parameter{
+			{"types", "string", "Comma-separated event types to receive: " + strings.Join(models.EventTypes, ", ")},
+			{"last_event_id", "integer", "Resume after this event, like the Last-Event-ID header"},
+		}},
+
+	{Method: http.MethodGet, Path: "/reports/sales", Permission: "report:generate", Summary: "Sales report", Response: []models.Sale{}},
+	{Method: http.MethodGet, Path: "/reports/inventory", Permission: "report:generate", Summary: "Inventory value report", Response: inventoryReport{}},
+	{Method: http.MethodGet, Path: "/reports/revenue", Permission: "report:generate", Summary: "Revenue by product", Response: productRevenueReport{}},
+	{Method: http.MethodGet, Path: "/reports/summary", Permission: "report:generate", Summary: "Sales summary", Response: summaryReport{}},
+	{Method: http.MethodGet, Path: "/reports/top", Permission: "report:generate", Summary: "Top selling products", Response: topProductsReport{},
+		Query: []parameter{{"limit", "integer", "Number of products, 5 by default"}}},
+	{Method: http.MethodGet, Path: "/reports/daily", Permission: "report:generate", Summary: "Today's sales by product", Response: dailyReport{}},
+	{Method: http.MethodGet, Path: "/reports/staff", Permission: "report:generate", Summary: "Sales and commission per cashier", Response: staffReport{},
+		Query: []parameter{
+			{"start_date", "string", "First day of the period (YYYY-MM-DD)"},
+			{"end_date", "string", "Last day of the period (YYYY-MM-DD)"},
+		}},
+}
+
+// agentOperation describes an unversioned endpoint
+func (g *schemaGenerator) agentOperation(e endpoint) object {
+	op := object{
+		"operationId": operationID(e.Method, e.Path),
+		"summary":     e.Summary,
+		"tags":        []string{"agent"},
+	}
+
+	status := e.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := jsonResponse("Success", g.schema(reflect.TypeOf(e.Response)))
+	if e.Stream {
+		success = object{"description": "A stream of events", "content": object{"text/event-stream": object{"schema": g.schema(reflect.TypeOf(e.Response))}}}
+	}
+	responses := object{
+		strconv.Itoa(status):                         success,
+		strconv.Itoa(http.StatusBadRequest):          textResponse(http.StatusText(http.StatusBadRequest)),
+		strconv.Itoa(http.StatusUnauthorized):        textResponse(http.StatusText(http.StatusUnauthorized)),
+		strconv.Itoa(http.StatusInternalServerError): textResponse(http.StatusText(http.StatusInternalServerError)),
+	}
+
+	switch {
+	case e.Public:
+		op["security"] = []object{}
+	case e.Permission == "":
+		op["security"] = []object{{"bearerAuth": []string{}}}
+	default:
+		op["security"] = []object{{"bearerAuth": []string{}}, {"apiKeyAuth": []string{}}}
+		op["description"] = "Requires the " + e.Permission + " permission."
+		op["x-permission"] = e.Permission
+		responses[strconv.Itoa(http.StatusForbidden)] = textResponse(http.StatusText(http.StatusForbidden))
+	}
+	op["responses"] = responses
+
+	if e.Request != nil {
+		op["requestBody"] = object{"required": true, "content": object{"application/json": object{"schema": g.schema(reflect.TypeOf(e.Request))}}}
+	}
+
+	var params []object
+	if pathHasID(e.Path) {
+		params = append(params, object{"name": "id", "in": "path", "required": true, "schema": object{"type": "integer"}})
+	}
+	for _, p := range e.Query {
+		params = append(params, queryParameter(p.name, object{"type": p.typ}, p.description))
+	}
+	if e.Idempotent {
+		params = append(params, idempotencyKeyParameter())
+		responses[strconv.Itoa(http.StatusConflict)] = textResponse(http.StatusText(http.StatusConflict))
+		responses[strconv.Itoa(http.StatusUnprocessableEntity)] = textResponse(http.StatusText(http.StatusUnprocessableEntity))
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+	return op
+}
+
+func textResponse(description string) object {
+	return object{"description": description, "content": object{"text/plain": object{"schema": object{"type": "string"}}}}
+}
@@ -0,0 +1,162 @@
+// Package api implements version 1 of the agent server's REST API, served under /api/v1.
+//
+// Every response is JSON. Single records are wrapped in {"data": ...}, lists add a
+// "pagination" object with the cursor of the next page, and errors use the envelope
+// {"error": {"code": ..., "message": ..., "fields": ...}}.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// Prefix is the path the API is served under
+const Prefix = "/api/v1"
+
+// Error codes returned in the error envelope
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeValidation       = "validation_failed"
+	CodeInternal         = "internal_error"
+)
+
+// Error is an error returned to the client with its status code. Fields holds the
+// problem with each invalid field of a validation error.
+type Error struct {
+	Status  int               `json:"-"`
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// codeForStatus returns the error code used for a status code
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusUnprocessableEntity:
+		return CodeValidation
+	default:
+		return CodeInternal
+	}
+}
+
+// newError creates an error with the code for its status
+func newError(status int, format string, args ...interface{}) *Error {
+	return &Error{Status: status, Code: codeForStatus(status), Message: fmt.Sprintf(format, args...)}
+}
+
+// badRequest is returned for malformed requests, such as invalid JSON or query parameters
+func badRequest(format string, args ...interface{}) *Error {
+	return newError(http.StatusBadRequest, format, args...)
+}
+
+// notFound is returned when the requested record does not exist
+func notFound(format string, args ...interface{}) *Error {
+	return newError(http.StatusNotFound, format, args...)
+}
+
+// conflict is returned when a request conflicts with the current state of a record
+func conflict(format string, args ...interface{}) *Error {
+	return newError(http.StatusConflict, format, args...)
+}
+
+// invalidField is returned when a well-formed request has an invalid value
+func invalidField(field, format string, args ...interface{}) *Error {
+	return validationError(map[string]string{field: fmt.Sprintf(format, args...)})
+}
+
+// toError maps an error from the database layer to the error returned to the client.
+// Unexpected errors are not shown to the client.
+func toError(err error) *Error {
+	var apiErr *Error
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, models.ErrProductNotFound), errors.Is(err, db.ErrCategoryNotFound),
+		errors.Is(err, db.ErrSupplierNotFound), errors.Is(err, db.ErrLocationNotFound),
+		errors.Is(err, db.ErrBatchNotFound), errors.Is(err, db.ErrUserNotFound),
+		errors.Is(err, db.ErrCustomerNotFound), errors.Is(err, db.ErrAuditLogNotFound),
+		errors.Is(err, db.ErrSaleNotFound):
+		return notFound("%s", err.Error())
+	case errors.Is(err, db.ErrInUse), errors.Is(err, db.ErrUserExists):
+		return conflict("%s", err.Error())
+	case db.IsUniqueViolation(err):
+		return conflict("a record with the same unique value already exists")
+	case errors.Is(err, db.ErrInvalidReference):
+		return newError(http.StatusUnprocessableEntity, "%s", err.Error())
+	case errors.Is(err, models.ErrEmptyName):
+		return invalidField("name", "cannot be empty")
+	case errors.Is(err, models.ErrInvalidPrice):
+		return invalidField("price", "must be greater than zero")
+	case errors.Is(err, models.ErrInvalidStock):
+		return invalidField("stock", "cannot be negative")
+	default:
+		fmt.Fprintf(os.Stderr, "api: %v\n", err)
+		return newError(http.StatusInternalServerError, "internal server error")
+	}
+}
+
+// WriteJSON writes v as a JSON response
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// WriteError writes an error envelope with the code for status. It is used by the
+// authentication middleware for requests to the API.
+func WriteError(w http.ResponseWriter, status int, message string) {
+	writeError(w, newError(status, "%s", message))
+}
+
+// writeError writes the error envelope of err
+func writeError(w http.ResponseWriter, err error) {
+	apiErr := toError(err)
+	WriteJSON(w, apiErr.Status, map[string]interface{}{"error": apiErr})
+}
+
+// writeData writes a single record
+func writeData(w http.ResponseWriter, status int, data interface{}) {
+	WriteJSON(w, status, map[string]interface{}{"data": data})
+}
+
+// writeCreated writes a record created by a POST, with its location
+func writeCreated(w http.ResponseWriter, path string, id interface{}, data interface{}) {
+	w.Header().Set("Location", fmt.Sprintf("%s%s/%v", Prefix, path, id))
+	writeData(w, http.StatusCreated, data)
+}
+
+// currentUser returns the user the request was authenticated as
+func currentUser(r *http.Request) *models.User {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil {
+		return &models.User{Username: "unknown"}
+	}
+	return user
+}
@@ -0,0 +1,377 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// setupTestServer creates an in-memory database and an API server whose requests are
+// made as the default admin user
+func setupTestServer(t *testing.T) *Server {
+	if err := db.Initialize(":memory:"); err != nil {
+		t.Fatalf("Failed to initialize test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	admin := &models.User{ID: 1, Username: "admin", Role: models.RoleAdmin, Active: true}
+	return NewServer(func(next http.HandlerFunc, permission string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "user", admin)
+			ctx = db.WithActor(ctx, db.Actor{Username: admin.Username, Source: db.SourceAPI, IPAddress: r.RemoteAddr})
+			next(w, r.WithContext(ctx))
+		}
+	})
+}
+
+// response is a decoded API response
+type response struct {
+	Status     int
+	Header     http.Header
+	Data       json.RawMessage `json:"data"`
+	Pagination pagination      `json:"pagination"`
+	Error      *Error          `json:"error"`
+}
+
+// do sends a request to the server and decodes its response
+func do(t *testing.T, s *Server, method, path string, body interface{}) response {
+	t.Helper()
+	return send(t, s, newRequest(t, method, path, body))
+}
+
+// newRequest builds a request to the server with a JSON body
+func newRequest(t *testing.T, method, path string, body interface{}) *http.Request {
+	t.Helper()
+
+	var reader bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Failed to encode request body: %v", err)
+		}
+		reader = *bytes.NewReader(data)
+	}
+	return httptest.NewRequest(method, Prefix+path, &reader)
+}
+
+// send sends a request to the server and decodes its response
+func send(t *testing.T, s *Server, req *http.Request) response {
+	t.Helper()
+
+	method, path := req.Method, req.URL.Path
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	resp := response{Status: rec.Code, Header: rec.Header()}
+	if rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s %s returned invalid JSON %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return resp
+}
+
+// expectStatus fails the test if a response does not have the expected status
+func expectStatus(t *testing.T, resp response, status int) {
+	t.Helper()
+	if resp.Status != status {
+		t.Fatalf("Expected status %d, got %d (error: %+v)", status, resp.Status, resp.Error)
+	}
+}
+
+func TestRoutePermissionsRegistered(t *testing.T) {
+	for _, route := range routes() {
+		if !models.IsRegisteredPermission(route.Permission) {
+			t.Errorf("%s %s uses unregistered permission %q", route.Method, route.Path, route.Permission)
+		}
+	}
+}
+
+func TestRouting(t *testing.T) {
+	s := setupTestServer(t)
+
+	resp := do(t, s, http.MethodGet, "/nothing-here", nil)
+	expectStatus(t, resp, http.StatusNotFound)
+	if resp.Error == nil || resp.Error.Code != CodeNotFound {
+		t.Errorf("Expected a not_found error envelope, got %+v", resp.Error)
+	}
+
+	resp = do(t, s, http.MethodPut, "/products", nil)
+	expectStatus(t, resp, http.StatusMethodNotAllowed)
+	if allow := resp.Header.Get("Allow"); allow != "GET, POST" {
+		t.Errorf("Expected Allow: GET, POST, got %q", allow)
+	}
+
+	expectStatus(t, do(t, s, http.MethodGet, "/products/abc", nil), http.StatusNotFound)
+	expectStatus(t, do(t, s, http.MethodGet, "/products/999", nil), http.StatusNotFound)
+	expectStatus(t, do(t, s, http.MethodGet, "/products?limit=0", nil), http.StatusBadRequest)
+	expectStatus(t, do(t, s, http.MethodGet, "/products?sort=colour", nil), http.StatusBadRequest)
+}
+
+func TestProductCreateAndPatch(t *testing.T) {
+	s := setupTestServer(t)
+
+	resp := do(t, s, http.MethodPost, "/products", map[string]interface{}{
+		"name": "Coffee", "price": 3.5, "stock": 10, "sku": "COF-1",
+	})
+	expectStatus(t, resp, http.StatusCreated)
+
+	var created models.ProductWithDetails
+	if err := json.Unmarshal(resp.Data, &created); err != nil {
+		t.Fatalf("Failed to decode product: %v", err)
+	}
+	if location := resp.Header.Get("Location"); location != Prefix+"/products/1" {
+		t.Errorf("Expected Location %s/products/1, got %q", Prefix, location)
+	}
+
+	// A PATCH changes only the fields it contains
+	resp = do(t, s, http.MethodPatch, "/products/1", map[string]interface{}{"price": 4.25})
+	expectStatus(t, resp, http.StatusOK)
+
+	var updated models.ProductWithDetails
+	if err := json.Unmarshal(resp.Data, &updated); err != nil {
+		t.Fatalf("Failed to decode product: %v", err)
+	}
+	if updated.Price != 4.25 || updated.Name != "Coffee" || updated.Stock != 10 || updated.SKU != "COF-1" {
+		t.Errorf("Expected only the price to change, got %+v", updated.Product)
+	}
+
+	tests := []struct {
+		name  string
+		body  map[string]interface{}
+		field string
+	}{
+		{"read-only field", map[string]interface{}{"id": 7}, "id"},
+		{"wrong type", map[string]interface{}{"price": "cheap"}, "price"},
+		{"invalid value", map[string]interface{}{"stock": -1}, "stock"},
+		{"missing category", map[string]interface{}{"category_id": 999}, "category_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := do(t, s, http.MethodPatch, "/products/1", tt.body)
+			expectStatus(t, resp, http.StatusUnprocessableEntity)
+			if _, ok := resp.Error.Fields[tt.field]; !ok {
+				t.Errorf("Expected an error for field %s, got %+v", tt.field, resp.Error)
+			}
+		})
+	}
+}
+
+func TestPagination(t *testing.T) {
+	s := setupTestServer(t)
+
+	for _, name := range []string{"Bakery", "Dairy", "Drinks", "Frozen", "Snacks"} {
+		expectStatus(t, do(t, s, http.MethodPost, "/categories", map[string]string{"name": name}), http.StatusCreated)
+	}
+
+	// Walk the pages, sorted by name descending
+	var names []string
+	query := url.Values{"limit": {"2"}, "sort": {"-name"}}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("Pagination did not end")
+		}
+		resp := do(t, s, http.MethodGet, "/categories?"+query.Encode(), nil)
+		expectStatus(t, resp, http.StatusOK)
+
+		var page []models.Category
+		if err := json.Unmarshal(resp.Data, &page); err != nil {
+			t.Fatalf("Failed to decode categories: %v", err)
+		}
+		for _, c := range page {
+			names = append(names, c.Name)
+		}
+		if !resp.Pagination.HasMore {
+			break
+		}
+		query.Set("cursor", resp.Pagination.NextCursor)
+	}
+
+	expected := []string{"Uncategorized", "Snacks", "Frozen", "Drinks", "Dairy", "Bakery"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, names)
+		}
+	}
+
+	// A cursor cannot be reused with another sort order
+	query.Set("sort", "name")
+	expectStatus(t, do(t, s, http.MethodGet, "/categories?"+query.Encode(), nil), http.StatusBadRequest)
+	expectStatus(t, do(t, s, http.MethodGet, "/categories?cursor=not-a-cursor", nil), http.StatusBadRequest)
+}
+
+// listAll walks the pages of a list and returns the IDs of its records
+func listAll(t *testing.T, s *Server, path string, query url.Values, visit func(page int, ids []int)) []int {
+	t.Helper()
+
+	var ids []int
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("Pagination did not end")
+		}
+		resp := do(t, s, http.MethodGet, path+"?"+query.Encode(), nil)
+		expectStatus(t, resp, http.StatusOK)
+
+		var records []struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(resp.Data, &records); err != nil {
+			t.Fatalf("Failed to decode %s: %v", path, err)
+		}
+		var page []int
+		for _, r := range records {
+			page = append(page, r.ID)
+		}
+		ids = append(ids, page...)
+		if visit != nil {
+			visit(pages, page)
+		}
+		if !resp.Pagination.HasMore {
+			return ids
+		}
+		query.Set("cursor", resp.Pagination.NextCursor)
+	}
+}
+
+func TestListQueries(t *testing.T) {
+	s := setupTestServer(t)
+
+	prices := []float64{5, 3, 5, 1, 4, 2}
+	for i, price := range prices {
+		expectStatus(t, do(t, s, http.MethodPost, "/products", map[string]interface{}{
+			"name": fmt.Sprintf("Product %d", i+1), "price": price, "stock": i, "low_stock_alert": 2,
+			"sku": fmt.Sprintf("SKU_%d", i+1),
+		}), http.StatusCreated)
+	}
+
+	// Sorted by price descending, records of the same price by ID
+	ids := listAll(t, s, "/products", url.Values{"limit": {"2"}, "sort": {"-price"}}, nil)
+	if fmt.Sprint(ids) != "[3 1 5 2 6 4]" {
+		t.Errorf("Expected products [3 1 5 2 6 4] by price descending, got %v", ids)
+	}
+
+	// Pages continue from the last record read, so deleting a record already read does
+	// not shift the records after it
+	ids = listAll(t, s, "/products", url.Values{"limit": {"2"}, "sort": {"price"}}, func(page int, ids []int) {
+		if page == 0 {
+			expectStatus(t, do(t, s, http.MethodDelete, fmt.Sprintf("/products/%d", ids[0]), nil), http.StatusNoContent)
+		}
+	})
+	if fmt.Sprint(ids) != "[4 6 2 5 1 3]" {
+		t.Errorf("Expected products [4 6 2 5 1 3] by price, got %v", ids)
+	}
+
+	// Filters are applied before paging, and search text is matched literally
+	ids = listAll(t, s, "/products", url.Values{"limit": {"1"}, "low_stock": {"true"}, "sort": {"id"}}, nil)
+	if fmt.Sprint(ids) != "[1 2 3]" {
+		t.Errorf("Expected low stock products [1 2 3], got %v", ids)
+	}
+	ids = listAll(t, s, "/products", url.Values{"q": {"sku_5"}}, nil)
+	if fmt.Sprint(ids) != "[5]" {
+		t.Errorf("Expected product 5 for SKU_5, got %v", ids)
+	}
+	if ids = listAll(t, s, "/products", url.Values{"q": {"%"}}, nil); len(ids) != 0 {
+		t.Errorf("Expected no products containing %%, got %v", ids)
+	}
+
+	// Sales are filtered by refund and sorted by date
+	now := time.Now()
+	for i, refunded := range []bool{false, true, false} {
+		var refundedAt interface{}
+		if refunded {
+			refundedAt = now
+		}
+		_, err := db.DB.Exec(
+			`INSERT INTO sales (product_id, quantity, price_per_unit, subtotal, total, sale_date, refunded_at)
+			 VALUES (1, 1, 5, 5, 5, ?, ?)`,
+			now.Add(time.Duration(-i)*time.Hour), refundedAt,
+		)
+		if err != nil {
+			t.Fatalf("Failed to insert sale: %v", err)
+		}
+	}
+	ids = listAll(t, s, "/sales", url.Values{"limit": {"1"}, "refunded": {"false"}}, nil)
+	if fmt.Sprint(ids) != "[1 3]" {
+		t.Errorf("Expected unrefunded sales [1 3], newest first, got %v", ids)
+	}
+	expectStatus(t, do(t, s, http.MethodGet, "/sales/2", nil), http.StatusOK)
+	expectStatus(t, do(t, s, http.MethodGet, "/sales/99", nil), http.StatusNotFound)
+}
+
+func TestConflicts(t *testing.T) {
+	s := setupTestServer(t)
+
+	expectStatus(t, do(t, s, http.MethodPost, "/categories", map[string]string{"name": "Drinks"}), http.StatusCreated)
+	resp := do(t, s, http.MethodPost, "/categories", map[string]string{"name": "Drinks"})
+	expectStatus(t, resp, http.StatusConflict)
+	if resp.Error.Code != CodeConflict {
+		t.Errorf("Expected code %s, got %s", CodeConflict, resp.Error.Code)
+	}
+
+	// A category used by a product cannot be deleted
+	expectStatus(t, do(t, s, http.MethodPost, "/products", map[string]interface{}{
+		"name": "Cola", "price": 1.5, "category_id": 2,
+	}), http.StatusCreated)
+	expectStatus(t, do(t, s, http.MethodDelete, "/categories/2", nil), http.StatusConflict)
+
+	expectStatus(t, do(t, s, http.MethodDelete, "/products/1", nil), http.StatusNoContent)
+	expectStatus(t, do(t, s, http.MethodDelete, "/categories/2", nil), http.StatusNoContent)
+	expectStatus(t, do(t, s, http.MethodGet, "/categories/2", nil), http.StatusNotFound)
+
+	// Users cannot delete their own account
+	expectStatus(t, do(t, s, http.MethodDelete, "/staff/1", nil), http.StatusConflict)
+}
+
+func TestAuditLogPages(t *testing.T) {
+	s := setupTestServer(t)
+
+	for _, name := range []string{"North", "South", "East"} {
+		expectStatus(t, do(t, s, http.MethodPost, "/suppliers", map[string]string{"name": name}), http.StatusCreated)
+	}
+
+	var logs []db.AuditLog
+	query := url.Values{"limit": {"2"}, "resource_type": {"supplier"}}
+	for {
+		resp := do(t, s, http.MethodGet, "/audit-logs?"+query.Encode(), nil)
+		expectStatus(t, resp, http.StatusOK)
+
+		var page []db.AuditLog
+		if err := json.Unmarshal(resp.Data, &page); err != nil {
+			t.Fatalf("Failed to decode audit logs: %v", err)
+		}
+		logs = append(logs, page...)
+		if !resp.Pagination.HasMore {
+			break
+		}
+		query.Set("cursor", resp.Pagination.NextCursor)
+	}
+
+	if len(logs) != 3 {
+		t.Fatalf("Expected 3 supplier audit log entries, got %d", len(logs))
+	}
+	for _, log := range logs {
+		if log.Username != "admin" || log.Source != db.SourceAPI || log.NewValue == "" {
+			t.Errorf("Expected supplier created by admin through the API with its new value, got %+v", log)
+		}
+	}
+	for i := 1; i < len(logs); i++ {
+		if logs[i].ID >= logs[i-1].ID {
+			t.Errorf("Expected audit logs newest first, got IDs %d then %d", logs[i-1].ID, logs[i].ID)
+		}
+	}
+
+	resp := do(t, s, http.MethodGet, "/audit-logs/"+url.PathEscape("99999"), nil)
+	expectStatus(t, resp, http.StatusNotFound)
+}
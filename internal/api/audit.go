@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"termpos/internal/db"
+)
+
+// auditTimeFormat is the format audit log timestamps are compared in
+const auditTimeFormat = "2006-01-02 15:04:05.999999999"
+
+// listAuditLogs lists audit log entries, newest first. The log is paged by entry ID
+// rather than by offset, so new entries do not shift the pages a client is reading.
+func listAuditLogs(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "-id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	from, to, err := queryDateRange(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var before int64
+	if p.Cursor != "" {
+		c, err := decodeCursor(p.Cursor)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		before = c.After
+	}
+
+	var startDate, endDate string
+	if !from.IsZero() {
+		startDate = from.Format(auditTimeFormat)
+	}
+	if !to.IsZero() {
+		endDate = to.Format(auditTimeFormat)
+	}
+
+	query := r.URL.Query()
+	logs, err := db.GetAuditLogsBefore(query.Get("username"), db.AuditAction(query.Get("action")),
+		query.Get("resource_type"), startDate, endDate, before, p.Limit+1)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page := pagination{Limit: p.Limit, HasMore: len(logs) > p.Limit}
+	if page.HasMore {
+		logs = logs[:p.Limit]
+		page.NextCursor = cursor{Sort: p.Sort, After: logs[len(logs)-1].ID}.encode()
+	}
+	if logs == nil {
+		logs = []db.AuditLog{}
+	}
+	writeList(w, logs, page)
+}
+
+func getAuditLog(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeError(w, notFound("audit log entry %q not found", r.PathValue("id")))
+		return
+	}
+
+	log, err := db.GetAuditLog(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, log)
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxBodySize limits the size of request bodies
+const maxBodySize = 1 << 20
+
+// decodeBody applies the JSON object in a request body to v. Fields that are not in the
+// body keep their value in v, so a PATCH is decoded onto the current record and a POST
+// onto its defaults. Only the fields listed in writable may be set.
+func decodeBody(r *http.Request, v interface{}, writable ...string) error {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return badRequest("failed to read request body")
+	}
+	if len(data) > maxBodySize {
+		return newError(http.StatusRequestEntityTooLarge, "request body is larger than %d bytes", maxBodySize)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return badRequest("request body must be a JSON object")
+	}
+
+	invalid := make(map[string]string)
+	for name := range fields {
+		if !slices.Contains(writable, name) {
+			invalid[name] = "is not a writable field"
+		}
+	}
+	if len(invalid) > 0 {
+		return validationError(invalid)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return invalidField(typeErr.Field, "must be a %s", jsonType(typeErr.Type.Kind().String()))
+		}
+		var timeErr *time.ParseError
+		if errors.As(err, &timeErr) {
+			return invalidField("body", "dates must be in RFC 3339 format, such as 2024-05-01T00:00:00Z")
+		}
+		return badRequest("invalid request body: %v", err)
+	}
+	return nil
+}
+
+// jsonType names the JSON type of a Go kind in error messages
+func jsonType(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "bool":
+		return "boolean"
+	case kind == "struct", kind == "map":
+		return "object"
+	default:
+		return kind
+	}
+}
+
+// validationError is returned when one or more fields of a request are invalid
+func validationError(fields map[string]string) *Error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	problems := make([]string, len(names))
+	for i, name := range names {
+		problems[i] = name + " " + fields[name]
+	}
+	return &Error{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CodeValidation,
+		Message: strings.Join(problems, "; "),
+		Fields:  fields,
+	}
+}
+
+// validator collects the problems with the fields of a record
+type validator map[string]string
+
+// check records problem for field unless ok
+func (v validator) check(ok bool, field, problem string) {
+	if !ok {
+		if _, exists := v[field]; !exists {
+			v[field] = problem
+		}
+	}
+}
+
+// err returns a validation error if any field is invalid
+func (v validator) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return validationError(v)
+}
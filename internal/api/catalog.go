@@ -0,0 +1,705 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// Fields of each record that can be set by a POST or PATCH
+var (
+	productFields  = []string{"name", "price", "stock", "category_id", "low_stock_alert", "default_supplier_id", "sku", "description"}
+	categoryFields = []string{"name", "description", "parent_id"}
+	supplierFields = []string{"name", "contact", "email", "phone", "address", "notes", "is_active"}
+	locationFields = []string{"name", "address", "description", "is_active"}
+
+	// The product, location and supplier of a batch are fixed once it is received
+	batchFields       = []string{"quantity", "batch_number", "expiry_date", "manufacture_date", "cost_price", "receipt_date"}
+	batchCreateFields = append([]string{"product_id", "location_id", "supplier_id"}, batchFields...)
+)
+
+//
+// Products
+//
+
+// productSorts are the fields a list of products can be sorted by
+var productSorts = []string{"id", "name", "price", "stock", "updated_at"}
+
+// validateProduct checks a product's fields and that its category and supplier exist
+func validateProduct(p models.Product) error {
+	v := validator{}
+	v.check(p.Name != "", "name", "cannot be empty")
+	v.check(p.Price > 0, "price", "must be greater than zero")
+	v.check(p.Stock >= 0, "stock", "cannot be negative")
+	v.check(p.LowStockAlert >= 0, "low_stock_alert", "cannot be negative")
+	if _, err := db.GetCategoryByID(p.CategoryID); err != nil {
+		v.check(false, "category_id", "does not exist")
+	}
+	if _, err := db.GetSupplierByID(p.DefaultSupplierID); err != nil {
+		v.check(false, "default_supplier_id", "does not exist")
+	}
+	return v.err()
+}
+
+func listProducts(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "name", productSorts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	filter := db.ProductFilter{Search: r.URL.Query().Get("q")}
+	if filter.CategoryID, err = queryInt(r, "category_id"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if filter.SupplierID, err = queryInt(r, "supplier_id"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if filter.LowStock, err = queryBool(r, "low_stock"); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, pagination, err := listPage(p, func(p models.ProductWithDetails) int { return p.ID },
+		func(q db.ListQuery) ([]models.ProductWithDetails, error) { return db.ListProducts(filter, q) })
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeList(w, page, pagination)
+}
+
+func getProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "product")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	product, err := db.GetProductWithDetails(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, product)
+}
+
+func createProduct(w http.ResponseWriter, r *http.Request) {
+	product := models.Product{CategoryID: 1, DefaultSupplierID: 1}
+	if err := decodeBody(r, &product, productFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateProduct(product); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id, err := db.AddProduct(r.Context(), product)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	created, err := db.GetProductWithDetails(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, "/products", id, created)
+}
+
+func updateProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "product")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	old, err := db.GetProductByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	product := old
+	if err := decodeBody(r, &product, productFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateProduct(product); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.UpdateProduct(r.Context(), product); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	updated, err := db.GetProductWithDetails(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, updated)
+}
+
+func deleteProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "product")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := db.GetProductByID(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.DeleteProduct(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Categories
+//
+
+// categorySorts are the fields a list of categories can be sorted by
+var categorySorts = []string{"id", "name"}
+
+// validateCategory checks a category's fields and that its parent exists
+func validateCategory(c models.Category) error {
+	v := validator{}
+	v.check(c.Name != "", "name", "cannot be empty")
+	if c.ParentID != 0 {
+		v.check(c.ParentID != c.ID, "parent_id", "cannot be the category itself")
+		if _, err := db.GetCategoryByID(c.ParentID); err != nil {
+			v.check(false, "parent_id", "does not exist")
+		}
+	}
+	return v.err()
+}
+
+func listCategories(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "name", categorySorts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	parentID, err := queryInt(r, "parent_id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	search := r.URL.Query().Get("q")
+
+	page, pagination, err := listPage(p, func(c models.Category) int { return c.ID },
+		func(q db.ListQuery) ([]models.Category, error) { return db.ListCategories(parentID, search, q) })
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeList(w, page, pagination)
+}
+
+func getCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "category")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	category, err := db.GetCategoryByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, category)
+}
+
+func createCategory(w http.ResponseWriter, r *http.Request) {
+	var category models.Category
+	if err := decodeBody(r, &category, categoryFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateCategory(category); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id, err := db.AddCategory(r.Context(), category)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	created, err := db.GetCategoryByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, "/categories", id, created)
+}
+
+func updateCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "category")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	old, err := db.GetCategoryByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	category := old
+	if err := decodeBody(r, &category, categoryFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateCategory(category); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.UpdateCategory(r.Context(), category); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	updated, err := db.GetCategoryByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, updated)
+}
+
+func deleteCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "category")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := db.GetCategoryByID(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.DeleteCategory(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Suppliers
+//
+
+// supplierSorts are the fields a list of suppliers can be sorted by
+var supplierSorts = []string{"id", "name"}
+
+func listSuppliers(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "name", supplierSorts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	active, err := queryBool(r, "active")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	search := r.URL.Query().Get("q")
+
+	page, pagination, err := listPage(p, func(s models.Supplier) int { return s.ID },
+		func(q db.ListQuery) ([]models.Supplier, error) { return db.ListSuppliers(active, search, q) })
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeList(w, page, pagination)
+}
+
+func getSupplier(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "supplier")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	supplier, err := db.GetSupplierByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, supplier)
+}
+
+func createSupplier(w http.ResponseWriter, r *http.Request) {
+	supplier := models.Supplier{IsActive: true}
+	if err := decodeBody(r, &supplier, supplierFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if supplier.Name == "" {
+		writeError(w, invalidField("name", "cannot be empty"))
+		return
+	}
+
+	id, err := db.AddSupplier(r.Context(), supplier)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	created, err := db.GetSupplierByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, "/suppliers", id, created)
+}
+
+func updateSupplier(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "supplier")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	old, err := db.GetSupplierByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	supplier := old
+	if err := decodeBody(r, &supplier, supplierFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if supplier.Name == "" {
+		writeError(w, invalidField("name", "cannot be empty"))
+		return
+	}
+	if err := db.UpdateSupplier(r.Context(), supplier); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	updated, err := db.GetSupplierByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, updated)
+}
+
+func deleteSupplier(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "supplier")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := db.GetSupplierByID(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.DeleteSupplier(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Locations
+//
+
+// locationSorts are the fields a list of locations can be sorted by
+var locationSorts = []string{"id", "name"}
+
+func listLocations(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "name", locationSorts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	active, err := queryBool(r, "active")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	search := r.URL.Query().Get("q")
+
+	page, pagination, err := listPage(p, func(l models.Location) int { return l.ID },
+		func(q db.ListQuery) ([]models.Location, error) { return db.ListLocations(active, search, q) })
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeList(w, page, pagination)
+}
+
+func getLocation(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "location")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	location, err := db.GetLocationByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, location)
+}
+
+func createLocation(w http.ResponseWriter, r *http.Request) {
+	location := models.Location{IsActive: true}
+	if err := decodeBody(r, &location, locationFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if location.Name == "" {
+		writeError(w, invalidField("name", "cannot be empty"))
+		return
+	}
+
+	id, err := db.AddLocation(r.Context(), location)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	created, err := db.GetLocationByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, "/locations", id, created)
+}
+
+func updateLocation(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "location")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	old, err := db.GetLocationByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	location := old
+	if err := decodeBody(r, &location, locationFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if location.Name == "" {
+		writeError(w, invalidField("name", "cannot be empty"))
+		return
+	}
+	if err := db.UpdateLocation(r.Context(), location); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	updated, err := db.GetLocationByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, updated)
+}
+
+func deleteLocation(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "location")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := db.GetLocationByID(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.DeleteLocation(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Batches
+//
+
+// batchSorts are the fields a list of batches can be sorted by
+var batchSorts = []string{"expiry_date", "id", "quantity", "receipt_date"}
+
+// validateBatch checks a batch's fields and, for a new batch, that its product, location
+// and supplier exist
+func validateBatch(b models.ProductBatch, isNew bool) error {
+	v := validator{}
+	v.check(b.Quantity > 0, "quantity", "must be greater than zero")
+	v.check(b.CostPrice >= 0, "cost_price", "cannot be negative")
+	if !b.ExpiryDate.IsZero() && !b.ManufactureDate.IsZero() {
+		v.check(b.ExpiryDate.After(b.ManufactureDate), "expiry_date", "must be after the manufacture date")
+	}
+	if isNew {
+		if _, err := db.GetProductByID(b.ProductID); err != nil {
+			v.check(false, "product_id", "does not exist")
+		}
+		if _, err := db.GetLocationByID(b.LocationID); err != nil {
+			v.check(false, "location_id", "does not exist")
+		}
+		if _, err := db.GetSupplierByID(b.SupplierID); err != nil {
+			v.check(false, "supplier_id", "does not exist")
+		}
+	}
+	return v.err()
+}
+
+func listBatches(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "expiry_date", batchSorts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var filter db.BatchFilter
+	if filter.ProductID, err = queryInt(r, "product_id"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if filter.LocationID, err = queryInt(r, "location_id"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if filter.SupplierID, err = queryInt(r, "supplier_id"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if filter.Expired, err = queryBool(r, "expired"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if filter.ExpiringWithinDays, err = queryInt(r, "expiring_within_days"); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, pagination, err := listPage(p, func(b models.ProductBatch) int { return b.ID },
+		func(q db.ListQuery) ([]models.ProductBatch, error) { return db.ListBatches(filter, q) })
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeList(w, page, pagination)
+}
+
+func getBatch(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "batch")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	batch, err := db.GetBatchByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, batch)
+}
+
+func createBatch(w http.ResponseWriter, r *http.Request) {
+	batch := models.ProductBatch{ReceiptDate: time.Now()}
+	if err := decodeBody(r, &batch, batchCreateFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateBatch(batch, true); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id, err := db.AddProductBatch(r.Context(), batch)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	created, err := db.GetBatchByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, "/batches", id, created)
+}
+
+func updateBatch(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "batch")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	old, err := db.GetBatchByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	batch := old
+	if err := decodeBody(r, &batch, batchFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateBatch(batch, false); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.UpdateBatch(r.Context(), batch); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	updated, err := db.GetBatchByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, updated)
+}
+
+func deleteBatch(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "batch")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := db.GetBatchByID(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.DeleteBatch(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
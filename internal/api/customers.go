@@ -0,0 +1,135 @@
+package api
+
+import (
+	"net/http"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// customerFields are the fields of a customer that can be set by a POST or PATCH.
+// Loyalty points and purchase totals are only changed by sales.
+var customerFields = []string{"name", "email", "phone", "address", "notes", "birthday", "preferred_products"}
+
+// customerSorts are the fields a list of customers can be sorted by
+var customerSorts = []string{"id", "loyalty_points", "name"}
+
+func listCustomers(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "name", customerSorts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	search, tier := r.URL.Query().Get("q"), r.URL.Query().Get("tier")
+
+	page, pagination, err := listPage(p, func(c models.CustomerSummary) int { return c.ID },
+		func(q db.ListQuery) ([]models.CustomerSummary, error) { return db.ListCustomerPage(search, tier, q) })
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeList(w, page, pagination)
+}
+
+func getCustomer(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "customer")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	customer, err := db.GetCustomer(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, customer)
+}
+
+func createCustomer(w http.ResponseWriter, r *http.Request) {
+	var customer models.Customer
+	if err := decodeBody(r, &customer, customerFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if customer.Name == "" {
+		writeError(w, invalidField("name", "cannot be empty"))
+		return
+	}
+
+	id, err := db.AddCustomer(r.Context(), customer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	created, err := db.GetCustomer(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, "/customers", id, created)
+}
+
+func updateCustomer(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "customer")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	old, err := db.GetCustomer(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if old.IsAnonymized() {
+		writeError(w, conflict("customer %d has been anonymized and cannot be changed", id))
+		return
+	}
+	customer := old
+	if err := decodeBody(r, &customer, customerFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if customer.Name == "" {
+		writeError(w, invalidField("name", "cannot be empty"))
+		return
+	}
+	if err := db.UpdateCustomer(r.Context(), customer); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	updated, err := db.GetCustomer(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, updated)
+}
+
+// deleteCustomer deletes a customer with no purchase history. Customers with history
+// are anonymized with "pos customer anonymize" instead, which keeps their sales.
+func deleteCustomer(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "customer")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := db.GetCustomer(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.CheckCustomerUnused(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.DeleteCustomer(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"termpos/internal/db"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header carrying the client's idempotency key
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// ReplayedHeader is set on responses replayed for a retried request
+	ReplayedHeader = "Idempotent-Replayed"
+
+	// maxIdempotencyKeyLength limits the length of idempotency keys
+	maxIdempotencyKeyLength = 255
+)
+
+// Idempotent makes a mutating handler safe to retry. A request with an Idempotency-Key
+// header is processed once: retries with the same key get the stored response instead,
+// for as long as the idempotency retention setting. Reusing a key for a different request
+// is refused. Only successful responses are stored, so a request that failed can be
+// retried with the same key, as can one left in progress by a crash once its lease of a
+// few minutes has run out. The handler must run after authentication, since keys are
+// scoped to the user.
+func Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength || strings.IndexFunc(key, func(c rune) bool { return c < ' ' || c > '~' }) >= 0 {
+			writeAgentError(w, r, badRequest("%s must be 1 to %d printable ASCII characters", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			writeAgentError(w, r, badRequest("failed to read request body"))
+			return
+		}
+		if len(body) > maxBodySize {
+			writeAgentError(w, r, newError(http.StatusRequestEntityTooLarge, "request body is larger than %d bytes", maxBodySize))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		settings, err := db.GetSettings()
+		if err != nil {
+			writeAgentError(w, r, err)
+			return
+		}
+
+		scope := currentUser(r).Username
+		earlier, started, err := db.BeginIdempotentRequest(db.IdempotentRequest{
+			Scope:       scope,
+			Key:         key,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			RequestHash: db.IdempotencyHash(r.Method, r.URL.Path, body),
+		}, settings.System.IdempotencyRetention())
+		switch {
+		case errors.Is(err, db.ErrIdempotencyKeyReused):
+			writeAgentError(w, r, newError(http.StatusUnprocessableEntity, "%s %q was already used for a different request", IdempotencyKeyHeader, key))
+			return
+		case errors.Is(err, db.ErrIdempotencyInProgress):
+			writeAgentError(w, r, conflict("a request with %s %q is still being processed, retry later", IdempotencyKeyHeader, key))
+			return
+		case err != nil:
+			writeAgentError(w, r, err)
+			return
+		case !started:
+			replay(w, earlier)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		if rec.status >= http.StatusBadRequest {
+			err = db.ReleaseIdempotentRequest(scope, key)
+		} else {
+			err = db.CompleteIdempotentRequest(scope, key, rec.status, w.Header().Get("Content-Type"), w.Header().Get("Location"), rec.body.Bytes())
+		}
+		if err != nil {
+			// The response has been sent, so the failure can only be logged
+			fmt.Fprintf(os.Stderr, "api: %v\n", err)
+		}
+	}
+}
+
+// replay writes the stored response of an earlier request
+func replay(w http.ResponseWriter, earlier db.IdempotentRequest) {
+	if earlier.ContentType != "" {
+		w.Header().Set("Content-Type", earlier.ContentType)
+	}
+	if earlier.Location != "" {
+		w.Header().Set("Location", earlier.Location)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(earlier.Status)
+	w.Write(earlier.Response)
+}
+
+// writeAgentError writes an error in the format of the endpoint: the error envelope for
+// the API and plain text for the unversioned agent endpoints
+func writeAgentError(w http.ResponseWriter, r *http.Request, err error) {
+	if strings.HasPrefix(r.URL.Path, Prefix+"/") {
+		writeError(w, err)
+		return
+	}
+	apiErr := toError(err)
+	http.Error(w, apiErr.Message, apiErr.Status)
+}
+
+// responseRecorder keeps a copy of the response written by a handler
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
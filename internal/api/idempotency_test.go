@@ -0,0 +1,106 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"termpos/internal/db"
+)
+
+// postWithKey sends a POST request with an Idempotency-Key header
+func postWithKey(t *testing.T, s *Server, path, key string, body interface{}) response {
+	t.Helper()
+	req := newRequest(t, http.MethodPost, path, body)
+	req.Header.Set(IdempotencyKeyHeader, key)
+	return send(t, s, req)
+}
+
+func TestIdempotentRetry(t *testing.T) {
+	s := setupTestServer(t)
+
+	body := map[string]string{"name": "Drinks"}
+	first := postWithKey(t, s, "/categories", "create-drinks", body)
+	expectStatus(t, first, http.StatusCreated)
+	if first.Header.Get(ReplayedHeader) != "" {
+		t.Errorf("Expected the first response not to be replayed")
+	}
+
+	// A retry gets the stored response instead of a duplicate name conflict
+	retry := postWithKey(t, s, "/categories", "create-drinks", body)
+	expectStatus(t, retry, http.StatusCreated)
+	if retry.Header.Get(ReplayedHeader) != "true" {
+		t.Errorf("Expected the retry to be replayed")
+	}
+	if !bytes.Equal(retry.Data, first.Data) || retry.Header.Get("Location") != first.Header.Get("Location") {
+		t.Errorf("Expected the replayed response to match, got %s and %s", first.Data, retry.Data)
+	}
+
+	categories, err := db.GetAllCategories()
+	if err != nil {
+		t.Fatalf("Failed to get categories: %v", err)
+	}
+	if len(categories) != 2 {
+		t.Errorf("Expected one category to be created, got %d categories", len(categories))
+	}
+
+	// The key cannot be reused for another request
+	resp := postWithKey(t, s, "/categories", "create-drinks", map[string]string{"name": "Snacks"})
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+	resp = postWithKey(t, s, "/suppliers", "create-drinks", body)
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+}
+
+func TestIdempotentFailureReleasesKey(t *testing.T) {
+	s := setupTestServer(t)
+
+	// A failed request is not stored, so it can be retried with the same key once fixed
+	resp := postWithKey(t, s, "/products", "new-product", map[string]interface{}{"name": "Tea", "price": -1})
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+
+	expectStatus(t, postWithKey(t, s, "/products", "new-product", map[string]interface{}{"name": "Tea", "price": 2}), http.StatusCreated)
+
+	resp = postWithKey(t, s, "/products", "\x01bad", map[string]interface{}{"name": "Tea", "price": 2})
+	expectStatus(t, resp, http.StatusBadRequest)
+}
+
+func TestIdempotentAbandonedKey(t *testing.T) {
+	s := setupTestServer(t)
+
+	// A request that was claimed but never completed, as when the server crashed
+	body := map[string]string{"name": "Drinks"}
+	data, _ := json.Marshal(body)
+	_, started, err := db.BeginIdempotentRequest(db.IdempotentRequest{
+		Scope:       "admin",
+		Key:         "create-drinks",
+		Method:      http.MethodPost,
+		Path:        Prefix + "/categories",
+		RequestHash: db.IdempotencyHash(http.MethodPost, Prefix+"/categories", data),
+	}, time.Hour)
+	if err != nil || !started {
+		t.Fatalf("Expected the key to be claimed, got %v", err)
+	}
+
+	// A retry while it may still be running is refused
+	expectStatus(t, postWithKey(t, s, "/categories", "create-drinks", body), http.StatusConflict)
+
+	// Once its lease has run out, a retry takes the key over and is processed
+	if _, err := db.DB.Exec("UPDATE idempotency_keys SET created_at = ?", time.Now().Add(-10*time.Minute)); err != nil {
+		t.Fatalf("Failed to age the idempotency key: %v", err)
+	}
+	resp := postWithKey(t, s, "/categories", "create-drinks", map[string]string{"name": "Snacks"})
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+	resp = postWithKey(t, s, "/categories", "create-drinks", body)
+	expectStatus(t, resp, http.StatusCreated)
+	if resp.Header.Get(ReplayedHeader) != "" {
+		t.Errorf("Expected the retry to be processed rather than replayed")
+	}
+
+	retry := postWithKey(t, s, "/categories", "create-drinks", body)
+	expectStatus(t, retry, http.StatusCreated)
+	if retry.Header.Get(ReplayedHeader) != "true" {
+		t.Errorf("Expected the next retry to be replayed")
+	}
+}
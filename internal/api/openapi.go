@@ -0,0 +1,440 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification the document follows
+const OpenAPIVersion = "3.0.3"
+
+// object is a JSON object in the OpenAPI document
+type object = map[string]interface{}
+
+// resource describes the records served under the first segment of a route's path.
+// Request schemas are made of the record's writable fields, so they follow the field
+// lists the handlers check bodies against.
+type resource struct {
+	record   interface{}
+	body     interface{} // The type of a create request, if it differs from record
+	create   []string
+	update   []string
+	required []string // Fields a create request must set
+	sorts    []string
+	filters  []parameter
+
+	singleton bool // The path is the record itself rather than a list
+}
+
+// parameter is a query parameter of an operation
+type parameter struct {
+	name        string
+	typ         string
+	description string
+}
+
+var resources = map[string]resource{
+	"products": {
+		record: models.ProductWithDetails{}, create: productFields, update: productFields,
+		required: []string{"name", "price"}, sorts: productSorts,
+		filters: []parameter{
+			{"category_id", "integer", "Only products in this category"},
+			{"supplier_id", "integer", "Only products from this default supplier"},
+			{"low_stock", "boolean", "Only products that are, or are not, low on stock"},
+			{"q", "string", "Search the name, SKU and description"},
+		},
+	},
+	"categories": {
+		record: models.Category{}, create: categoryFields, update: categoryFields,
+		required: []string{"name"}, sorts: categorySorts,
+		filters: []parameter{
+			{"parent_id", "integer", "Only subcategories of this category, or 0 for top-level categories"},
+			{"q", "string", "Search the name and description"},
+		},
+	},
+	"suppliers": {
+		record: models.Supplier{}, create: supplierFields, update: supplierFields,
+		required: []string{"name"}, sorts: supplierSorts,
+		filters: []parameter{
+			{"active", "boolean", "Only active, or inactive, suppliers"},
+			{"q", "string", "Search the name, contact, email and phone"},
+		},
+	},
+	"locations": {
+		record: models.Location{}, create: locationFields, update: locationFields,
+		required: []string{"name"}, sorts: locationSorts,
+		filters: []parameter{
+			{"active", "boolean", "Only active, or inactive, locations"},
+			{"q", "string", "Search the name, address and description"},
+		},
+	},
+	"batches": {
+		record: models.ProductBatch{}, create: batchCreateFields, update: batchFields,
+		required: []string{"product_id", "location_id", "supplier_id", "quantity"}, sorts: batchSorts,
+		filters: []parameter{
+			{"product_id", "integer", "Only batches of this product"},
+			{"location_id", "integer", "Only batches at this location"},
+			{"supplier_id", "integer", "Only batches from this supplier"},
+			{"expired", "boolean", "Only expired, or unexpired, batches"},
+			{"expiring_within_days", "integer", "Only batches expiring within this many days"},
+		},
+	},
+	"customers": {
+		record: models.Customer{}, create: customerFields, update: customerFields,
+		required: []string{"name"}, sorts: customerSorts,
+		filters: []parameter{
+			{"tier", "string", "Only customers in this loyalty tier"},
+			{"q", "string", "Search the name, phone and email"},
+		},
+	},
+	"staff": {
+		record: models.User{}, body: newStaff{}, create: staffCreateFields, update: staffFields,
+		required: []string{"username", "password"}, sorts: staffSorts,
+		filters: []parameter{
+			{"active", "boolean", "Only active, or inactive, accounts"},
+			{"role", "string", "Only accounts with this role"},
+			{"department", "string", "Only accounts in this department"},
+			{"q", "string", "Search the username, full name and email"},
+		},
+	},
+	"sales": {
+		record: models.Sale{}, sorts: saleSorts,
+		filters: []parameter{
+			{"user_id", "integer", "Only sales made by this cashier"},
+			{"product_id", "integer", "Only sales of this product"},
+			{"customer_id", "integer", "Only sales to this customer"},
+			{"refunded", "boolean", "Only refunded, or unrefunded, sales"},
+			{"payment_method", "string", "Only sales paid this way"},
+			{"from", "string", "Only sales on or after this date (YYYY-MM-DD or RFC 3339)"},
+			{"to", "string", "Only sales on or before this date (YYYY-MM-DD or RFC 3339)"},
+		},
+	},
+	"settings": {
+		record: models.Settings{}, update: settingsSections, singleton: true,
+	},
+	"audit-logs": {
+		record: db.AuditLog{},
+		filters: []parameter{
+			{"username", "string", "Only entries for this user"},
+			{"action", "string", "Only entries with this action"},
+			{"resource_type", "string", "Only entries for this type of resource"},
+			{"from", "string", "Only entries on or after this date (YYYY-MM-DD or RFC 3339)"},
+			{"to", "string", "Only entries on or before this date (YYYY-MM-DD or RFC 3339)"},
+		},
+	},
+}
+
+// OpenAPI returns the OpenAPI document describing the agent server: the operations of
+// the API and the unversioned endpoints registered by the agent command
+func (s *Server) OpenAPI() map[string]interface{} {
+	g := &schemaGenerator{schemas: object{}, types: map[string]reflect.Type{}}
+	g.schemas["Error"] = g.object(reflect.TypeOf(Error{}))
+	g.schemas["Pagination"] = g.object(reflect.TypeOf(pagination{}))
+
+	paths := object{}
+	addOperation := func(path, method string, op object) {
+		item, ok := paths[path].(object)
+		if !ok {
+			item = object{}
+			paths[path] = item
+		}
+		item[strings.ToLower(method)] = op
+	}
+
+	for _, route := range s.routes {
+		addOperation(Prefix+route.Path, route.Method, g.apiOperation(route))
+	}
+	for _, e := range agentEndpoints {
+		addOperation(e.Path, e.Method, g.agentOperation(e))
+	}
+
+	return object{
+		"openapi": OpenAPIVersion,
+		"info": object{
+			"title":       "TermPOS agent API",
+			"version":     "1.0.0",
+			"description": "Remote access to a TermPOS store. Requests are authenticated with an access token from /auth/login or an API key created with \"pos apikey create\".",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": g.schemas,
+			"securitySchemes": object{
+				"bearerAuth": object{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKeyAuth": object{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+// ServeOpenAPI serves the OpenAPI document
+func (s *Server) ServeOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, newError(http.StatusMethodNotAllowed, "method %s is not allowed on %s", r.Method, r.URL.Path))
+		return
+	}
+	WriteJSON(w, http.StatusOK, s.OpenAPI())
+}
+
+// apiOperation describes an operation of the versioned API
+func (g *schemaGenerator) apiOperation(route Route) object {
+	name, _, _ := strings.Cut(strings.TrimPrefix(route.Path, "/"), "/")
+	res := resources[name]
+	hasID := pathHasID(route.Path)
+
+	op := object{
+		"operationId":  operationID(route.Method, Prefix+route.Path),
+		"summary":      route.Summary,
+		"description":  "Requires the " + route.Permission + " permission.",
+		"tags":         []string{name},
+		"security":     []object{{"bearerAuth": []string{}}, {"apiKeyAuth": []string{}}},
+		"x-permission": route.Permission,
+	}
+
+	var params []object
+	if hasID {
+		params = append(params, object{"name": "id", "in": "path", "required": true, "schema": object{"type": "integer"}})
+	}
+	if route.mutates() {
+		params = append(params, idempotencyKeyParameter())
+	}
+
+	errors := []int{http.StatusUnauthorized, http.StatusForbidden}
+	var record object
+	if res.record != nil {
+		record = g.schema(reflect.TypeOf(res.record))
+	}
+
+	responses := object{}
+	switch {
+	case route.Method == http.MethodGet && res.singleton:
+		responses["200"] = jsonResponse("The record", envelope(record))
+	case route.Method == http.MethodGet && !hasID:
+		params = append(params, g.listParameters(res)...)
+		responses["200"] = jsonResponse("A page of records", object{
+			"type": "object",
+			"properties": object{
+				"data":       object{"type": "array", "items": record},
+				"pagination": object{"$ref": "#/components/schemas/Pagination"},
+			},
+		})
+		errors = append(errors, http.StatusBadRequest)
+	case route.Method == http.MethodGet:
+		responses["200"] = jsonResponse("The record", envelope(record))
+	case route.Method == http.MethodPost:
+		body := res.body
+		if body == nil {
+			body = res.record
+		}
+		op["requestBody"] = g.requestBody(reflect.TypeOf(body), res.create, res.required)
+		responses["201"] = jsonResponse("The created record", envelope(record))
+		errors = append(errors, http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity)
+	case route.Method == http.MethodPatch:
+		op["requestBody"] = g.requestBody(reflect.TypeOf(res.record), res.update, nil)
+		responses["200"] = jsonResponse("The updated record", envelope(record))
+		errors = append(errors, http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity)
+	case route.Method == http.MethodDelete:
+		responses["204"] = object{"description": "The record was deleted"}
+		errors = append(errors, http.StatusConflict)
+	}
+	if hasID {
+		errors = append(errors, http.StatusNotFound)
+	}
+	for _, status := range errors {
+		responses[strconv.Itoa(status)] = jsonResponse(http.StatusText(status), object{
+			"type":       "object",
+			"properties": object{"error": object{"$ref": "#/components/schemas/Error"}},
+		})
+	}
+	op["responses"] = responses
+
+	if params != nil {
+		op["parameters"] = params
+	}
+	return op
+}
+
+// listParameters describes the pagination, sorting and filter parameters of a list
+func (g *schemaGenerator) listParameters(res resource) []object {
+	params := []object{
+		queryParameter("limit", object{"type": "integer", "minimum": 1, "maximum": MaxLimit, "default": DefaultLimit}, "Number of records per page"),
+		queryParameter("cursor", object{"type": "string"}, "The next_cursor of the previous page"),
+	}
+	if len(res.sorts) > 0 {
+		var values []string
+		for _, field := range res.sorts {
+			values = append(values, field, "-"+field)
+		}
+		params = append(params, queryParameter("sort", object{"type": "string", "enum": values}, "Field to sort by, prefixed with - for descending order"))
+	}
+	for _, p := range res.filters {
+		params = append(params, queryParameter(p.name, object{"type": p.typ}, p.description))
+	}
+	return params
+}
+
+// requestBody describes a JSON request body made of the writable fields of a type
+func (g *schemaGenerator) requestBody(t reflect.Type, writable, required []string) object {
+	full := g.object(t)
+	properties := full["properties"].(object)
+
+	body := object{}
+	for _, field := range writable {
+		if schema, ok := properties[field]; ok {
+			body[field] = schema
+		}
+	}
+
+	schema := object{"type": "object", "properties": body, "additionalProperties": false}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return object{"required": true, "content": object{"application/json": object{"schema": schema}}}
+}
+
+// idempotencyKeyParameter describes the Idempotency-Key header of mutating operations
+func idempotencyKeyParameter() object {
+	return object{
+		"name":        IdempotencyKeyHeader,
+		"in":          "header",
+		"schema":      object{"type": "string", "maxLength": maxIdempotencyKeyLength},
+		"description": "Makes the request safe to retry: a retry with the same key replays the stored response with an " + ReplayedHeader + " header, and reusing the key for a different request is refused with 422",
+	}
+}
+
+func envelope(record object) object {
+	return object{"type": "object", "properties": object{"data": record}}
+}
+
+func jsonResponse(description string, schema object) object {
+	return object{"description": description, "content": object{"application/json": object{"schema": schema}}}
+}
+
+func queryParameter(name string, schema object, description string) object {
+	return object{"name": name, "in": "query", "schema": schema, "description": description}
+}
+
+// pathHasID reports whether a path has an {id} parameter
+func pathHasID(path string) bool {
+	return strings.Contains(path, "{id}")
+}
+
+// operationID names an operation after its method and path, e.g. GET /api/v1/products/{id}
+// is getApiV1ProductsById
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '-' }) {
+		if strings.HasPrefix(part, "{") {
+			part = "by-" + strings.Trim(part, "{}")
+		}
+		for _, word := range strings.Split(part, "-") {
+			if word != "" {
+				b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+			}
+		}
+	}
+	return b.String()
+}
+
+// schemaGenerator derives JSON schemas from Go types and their json tags. Named struct
+// types become shared component schemas.
+type schemaGenerator struct {
+	schemas object
+	types   map[string]reflect.Type
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns the schema of a type, referencing a component for named structs
+func (g *schemaGenerator) schema(t reflect.Type) object {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return object{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return object{} // Any JSON value
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		name := g.componentName(t)
+		if _, ok := g.schemas[name]; !ok {
+			g.schemas[name] = object{} // Placeholder for recursive types
+			g.schemas[name] = g.object(t)
+		}
+		return object{"$ref": "#/components/schemas/" + name}
+	case t.Kind() == reflect.Struct:
+		return g.object(t)
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return object{"type": "string", "format": "byte"}
+	case t.Kind() == reflect.Slice, t.Kind() == reflect.Array:
+		return object{"type": "array", "items": g.schema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return object{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case t.Kind() == reflect.Bool:
+		return object{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return object{"type": "integer"}
+	case t.Kind() == reflect.Float32, t.Kind() == reflect.Float64:
+		return object{"type": "number"}
+	case t.Kind() == reflect.String:
+		return object{"type": "string"}
+	default:
+		return object{}
+	}
+}
+
+// object returns the schema of a struct's JSON fields. Embedded structs without a json
+// tag are flattened into it, as encoding/json does.
+func (g *schemaGenerator) object(t reflect.Type) object {
+	properties := object{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for embeddedName, schema := range g.object(field.Type)["properties"].(object) {
+				if _, ok := properties[embeddedName]; !ok {
+					properties[embeddedName] = schema
+				}
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type)
+	}
+	return object{"type": "object", "properties": properties}
+}
+
+// componentName names the component schema of a named type, qualifying it with its
+// package if another package has a type of the same name
+func (g *schemaGenerator) componentName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+
+	qualified := string(name)
+	if existing, ok := g.types[qualified]; ok && existing != t {
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		qualified = strings.ToUpper(pkg[:1]) + pkg[1:] + qualified
+	}
+	g.types[qualified] = t
+	return qualified
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// agentSources are the files of the agent command that register routes
+var agentSources = []string{"../../cmd/pos/agent.go"}
+
+// openAPIDocument returns the OpenAPI document as decoded JSON
+func openAPIDocument(t *testing.T) map[string]interface{} {
+	t.Helper()
+
+	s := NewServer(func(next http.HandlerFunc, permission string) http.HandlerFunc { return next })
+	rec := httptest.NewRecorder()
+	s.ServeOpenAPI(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("OpenAPI document is not valid JSON: %v", err)
+	}
+	return doc
+}
+
+// registeredPatterns returns the patterns passed to http.HandleFunc and http.Handle
+// in the agent command
+func registeredPatterns(t *testing.T) []string {
+	t.Helper()
+
+	var patterns []string
+	fset := token.NewFileSet()
+	for _, path := range agentSources {
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", path, err)
+		}
+
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || (sel.Sel.Name != "HandleFunc" && sel.Sel.Name != "Handle") {
+				return true
+			}
+			if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				pattern, err := strconv.Unquote(lit.Value)
+				if err != nil {
+					t.Fatalf("Invalid route pattern %s", lit.Value)
+				}
+				patterns = append(patterns, pattern)
+			}
+			return true
+		})
+	}
+	return patterns
+}
+
+// TestOpenAPICoversRoutes checks that every route registered by the agent command and
+// every operation of the API is in the OpenAPI document
+func TestOpenAPICoversRoutes(t *testing.T) {
+	doc := openAPIDocument(t)
+	paths := doc["paths"].(map[string]interface{})
+
+	patterns := registeredPatterns(t)
+	if len(patterns) == 0 {
+		t.Fatal("Expected to find routes registered in the agent command")
+	}
+	for _, pattern := range patterns {
+		// A pattern ending in / also matches the paths below it
+		found := false
+		for path := range paths {
+			if path == pattern || (strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Route %s is registered by the agent command but missing from the OpenAPI document", pattern)
+		}
+	}
+
+	for _, route := range routes() {
+		item, ok := paths[Prefix+route.Path].(map[string]interface{})
+		if !ok {
+			t.Errorf("Path %s%s is missing from the OpenAPI document", Prefix, route.Path)
+			continue
+		}
+		op, ok := item[strings.ToLower(route.Method)].(map[string]interface{})
+		if !ok {
+			t.Errorf("Operation %s %s%s is missing from the OpenAPI document", route.Method, Prefix, route.Path)
+			continue
+		}
+		if op["x-permission"] != route.Permission {
+			t.Errorf("Expected %s %s to require %s, got %v", route.Method, route.Path, route.Permission, op["x-permission"])
+		}
+	}
+}
+
+// TestOpenAPISchemas checks that the document's schemas follow the models' json tags and
+// that every reference resolves
+func TestOpenAPISchemas(t *testing.T) {
+	doc := openAPIDocument(t)
+	components := doc["components"].(map[string]interface{})
+	schemas := components["schemas"].(map[string]interface{})
+
+	product, ok := schemas["ProductWithDetails"].(map[string]interface{})
+	if !ok {
+		t.Fatal("Expected a ProductWithDetails schema")
+	}
+	properties := product["properties"].(map[string]interface{})
+	for field, typ := range map[string]string{"price": "number", "stock": "integer", "name": "string", "is_low_stock": "boolean"} {
+		schema, ok := properties[field].(map[string]interface{})
+		if !ok || schema["type"] != typ {
+			t.Errorf("Expected ProductWithDetails.%s to be a %s, got %v", field, typ, properties[field])
+		}
+	}
+
+	user := schemas["User"].(map[string]interface{})["properties"].(map[string]interface{})
+	if _, ok := user["PasswordHash"]; ok {
+		t.Error("Fields tagged json:\"-\" must not be in schemas")
+	}
+
+	// Request bodies only contain writable fields
+	paths := doc["paths"].(map[string]interface{})
+	patch := paths[Prefix+"/batches/{id}"].(map[string]interface{})["patch"].(map[string]interface{})
+	body := patch["requestBody"].(map[string]interface{})["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+	if _, ok := body["properties"].(map[string]interface{})["product_id"]; ok {
+		t.Error("Expected product_id not to be writable in PATCH /batches/{id}")
+	}
+
+	var checkRefs func(v interface{})
+	checkRefs = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				if _, ok := schemas[strings.TrimPrefix(ref, "#/components/schemas/")]; !ok {
+					t.Errorf("Reference %s does not resolve", ref)
+				}
+			}
+			for _, child := range v {
+				checkRefs(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				checkRefs(child)
+			}
+		}
+	}
+	checkRefs(doc)
+
+	// Operation IDs must be unique
+	seen := make(map[string]bool)
+	for path, item := range paths {
+		for method, op := range item.(map[string]interface{}) {
+			id := op.(map[string]interface{})["operationId"].(string)
+			if seen[id] {
+				t.Errorf("Duplicate operationId %s at %s %s", id, method, path)
+			}
+			seen[id] = true
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"termpos/internal/db"
+)
+
+const (
+	// DefaultLimit is the page size when a request does not give a limit
+	DefaultLimit = 50
+
+	// MaxLimit is the largest page size a request can ask for
+	MaxLimit = 200
+)
+
+// listParams are the pagination and sorting parameters of a list request
+type listParams struct {
+	Limit  int
+	Cursor string
+	Sort   string // Field name, prefixed with "-" for descending order
+}
+
+// pagination describes where a page is in a list
+type pagination struct {
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// cursor marks the end of a page. After is the ID of the last record on the page and
+// Offset its position, used if that record has since been deleted.
+type cursor struct {
+	Sort   string `json:"s,omitempty"`
+	After  int64  `json:"a"`
+	Offset int    `json:"o,omitempty"`
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || c.After < 0 || c.Offset < 0 {
+		return cursor{}, badRequest("invalid cursor")
+	}
+	return c, nil
+}
+
+// parseListParams reads limit, cursor and sort from the query string. sort must name
+// one of sortFields, optionally prefixed with "-".
+func parseListParams(r *http.Request, defaultSort string, sortFields ...string) (listParams, error) {
+	query := r.URL.Query()
+	p := listParams{Limit: DefaultLimit, Cursor: query.Get("cursor"), Sort: defaultSort}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MaxLimit {
+			return listParams{}, badRequest("limit must be a number from 1 to %d", MaxLimit)
+		}
+		p.Limit = limit
+	}
+
+	if value := query.Get("sort"); value != "" {
+		if !slices.Contains(sortFields, strings.TrimPrefix(value, "-")) {
+			return listParams{}, badRequest("cannot sort by %q, sort by one of: %s", value, strings.Join(sortFields, ", "))
+		}
+		p.Sort = value
+	}
+
+	return p, nil
+}
+
+// listPage reads the page of records the parameters ask for with list, which is given
+// the database query of the page. One more record than the page holds is read to find
+// whether there are more.
+func listPage[T any](p listParams, id func(T) int, list func(db.ListQuery) ([]T, error)) ([]T, pagination, error) {
+	q := db.ListQuery{
+		Sort:       strings.TrimPrefix(p.Sort, "-"),
+		Descending: strings.HasPrefix(p.Sort, "-"),
+		Limit:      p.Limit + 1,
+	}
+	if p.Cursor != "" {
+		c, err := decodeCursor(p.Cursor)
+		if err != nil {
+			return nil, pagination{}, err
+		}
+		if c.Sort != p.Sort {
+			return nil, pagination{}, badRequest("the cursor was issued for sort %q, not %q", c.Sort, p.Sort)
+		}
+		q.After, q.Offset = int(c.After), c.Offset
+	}
+
+	records, err := list(q)
+	if err != nil {
+		return nil, pagination{}, err
+	}
+
+	page := pagination{Limit: p.Limit, HasMore: len(records) > p.Limit}
+	if page.HasMore {
+		records = records[:p.Limit]
+		page.NextCursor = cursor{Sort: p.Sort, After: int64(id(records[len(records)-1])), Offset: q.Offset + len(records)}.encode()
+	}
+	if records == nil {
+		records = []T{}
+	}
+	return records, page, nil
+}
+
+// writeList writes a page of records
+func writeList(w http.ResponseWriter, records interface{}, page pagination) {
+	WriteJSON(w, http.StatusOK, map[string]interface{}{"data": records, "pagination": page})
+}
+
+// queryInt reads an optional integer filter from the query string, nil if not given
+func queryInt(r *http.Request, name string) (*int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, badRequest("%s must be a number", name)
+	}
+	return &n, nil
+}
+
+// queryBool reads an optional true/false filter from the query string, nil if not given
+func queryBool(r *http.Request, name string) (*bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, badRequest("%s must be true or false", name)
+	}
+	return &b, nil
+}
+
+// queryDate reads an optional YYYY-MM-DD or RFC 3339 date filter from the query string
+func queryDate(r *http.Request, name string) (time.Time, bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false, badRequest("%s must be a date such as 2024-05-01", name)
+	}
+	return t, true, nil
+}
+
+// queryDateRange reads the optional from and to filters. A to date without a time
+// includes the whole day.
+func queryDateRange(r *http.Request) (from, to time.Time, err error) {
+	if from, _, err = queryDate(r, "from"); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if to, _, err = queryDate(r, "to"); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !to.IsZero() && len(r.URL.Query().Get("to")) == len("2006-01-02") {
+		to = to.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return time.Time{}, time.Time{}, badRequest("to must not be before from")
+	}
+	return from, to, nil
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Authorizer authenticates a request and checks it has a permission before calling next.
+// The agent server's authentication middleware is used, which puts the user in the
+// request context.
+type Authorizer func(next http.HandlerFunc, permission string) http.HandlerFunc
+
+// Route is an operation of the API
+type Route struct {
+	Method     string
+	Path       string // Relative to Prefix, with {name} for path parameters
+	Permission string
+	Summary    string
+
+	handler http.HandlerFunc
+}
+
+// mutates reports whether the route changes data
+func (r Route) mutates() bool {
+	return r.Method != http.MethodGet && r.Method != http.MethodHead
+}
+
+// Server serves the API
+type Server struct {
+	routes []Route
+}
+
+// NewServer creates the API server. Every route is authorized with its permission, and
+// routes that change data accept an Idempotency-Key.
+func NewServer(authorize Authorizer) *Server {
+	s := &Server{routes: routes()}
+	for i, route := range s.routes {
+		handler := route.handler
+		if route.mutates() {
+			handler = Idempotent(handler)
+		}
+		s.routes[i].handler = authorize(handler, route.Permission)
+	}
+	return s
+}
+
+// Routes returns the operations of the API
+func (s *Server) Routes() []Route {
+	return s.routes
+}
+
+// ServeHTTP dispatches a request to the route matching its method and path
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, Prefix), "/")
+
+	var allowed []string
+	for _, route := range s.routes {
+		params, ok := matchPath(route.Path, path)
+		if !ok {
+			continue
+		}
+		if route.Method != r.Method {
+			allowed = append(allowed, route.Method)
+			continue
+		}
+
+		for name, value := range params {
+			r.SetPathValue(name, value)
+		}
+		route.handler(w, r)
+		return
+	}
+
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, newError(http.StatusMethodNotAllowed, "method %s is not allowed on %s", r.Method, r.URL.Path))
+		return
+	}
+	writeError(w, notFound("no such endpoint: %s", r.URL.Path))
+}
+
+// matchPath matches a path against a route pattern and returns its path parameters
+func matchPath(pattern, path string) (map[string]string, bool) {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			if pathParts[i] == "" {
+				return nil, false
+			}
+			params[part[1:len(part)-1]] = pathParts[i]
+		} else if part != pathParts[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// pathID returns the {id} path parameter. An ID that is not a positive number cannot
+// exist, so it is reported as not found.
+func pathID(r *http.Request, what string) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		return 0, notFound("%s %q not found", what, r.PathValue("id"))
+	}
+	return id, nil
+}
+
+// routes lists every operation of the API
+func routes() []Route {
+	return []Route{
+		{http.MethodGet, "/products", "product:read", "List products", listProducts},
+		{http.MethodPost, "/products", "product:create", "Create a product", createProduct},
+		{http.MethodGet, "/products/{id}", "product:read", "Get a product", getProduct},
+		{http.MethodPatch, "/products/{id}", "product:update", "Update a product", updateProduct},
+		{http.MethodDelete, "/products/{id}", "product:delete", "Delete a product", deleteProduct},
+
+		{http.MethodGet, "/categories", "product:read", "List categories", listCategories},
+		{http.MethodPost, "/categories", "product:manage", "Create a category", createCategory},
+		{http.MethodGet, "/categories/{id}", "product:read", "Get a category", getCategory},
+		{http.MethodPatch, "/categories/{id}", "product:manage", "Update a category", updateCategory},
+		{http.MethodDelete, "/categories/{id}", "product:manage", "Delete a category", deleteCategory},
+
+		{http.MethodGet, "/suppliers", "product:read", "List suppliers", listSuppliers},
+		{http.MethodPost, "/suppliers", "product:manage", "Create a supplier", createSupplier},
+		{http.MethodGet, "/suppliers/{id}", "product:read", "Get a supplier", getSupplier},
+		{http.MethodPatch, "/suppliers/{id}", "product:manage", "Update a supplier", updateSupplier},
+		{http.MethodDelete, "/suppliers/{id}", "product:manage", "Delete a supplier", deleteSupplier},
+
+		{http.MethodGet, "/locations", "product:read", "List locations", listLocations},
+		{http.MethodPost, "/locations", "product:manage", "Create a location", createLocation},
+		{http.MethodGet, "/locations/{id}", "product:read", "Get a location", getLocation},
+		{http.MethodPatch, "/locations/{id}", "product:manage", "Update a location", updateLocation},
+		{http.MethodDelete, "/locations/{id}", "product:manage", "Delete a location", deleteLocation},
+
+		{http.MethodGet, "/batches", "inventory:view", "List product batches", listBatches},
+		{http.MethodPost, "/batches", "product:manage", "Receive a product batch", createBatch},
+		{http.MethodGet, "/batches/{id}", "inventory:view", "Get a product batch", getBatch},
+		{http.MethodPatch, "/batches/{id}", "product:manage", "Update a product batch", updateBatch},
+		{http.MethodDelete, "/batches/{id}", "product:manage", "Delete a product batch", deleteBatch},
+
+		{http.MethodGet, "/customers", "customer:read", "List customers", listCustomers},
+		{http.MethodPost, "/customers", "customer:create", "Create a customer", createCustomer},
+		{http.MethodGet, "/customers/{id}", "customer:read", "Get a customer", getCustomer},
+		{http.MethodPatch, "/customers/{id}", "customer:update", "Update a customer", updateCustomer},
+		{http.MethodDelete, "/customers/{id}", "customer:delete", "Delete a customer", deleteCustomer},
+
+		{http.MethodGet, "/staff", "user:read", "List staff", listStaff},
+		{http.MethodPost, "/staff", "user:manage", "Create a staff account", createStaff},
+		{http.MethodGet, "/staff/{id}", "user:read", "Get a staff account", getStaff},
+		{http.MethodPatch, "/staff/{id}", "user:manage", "Update a staff account", updateStaff},
+		{http.MethodDelete, "/staff/{id}", "user:manage", "Delete a staff account", deleteStaff},
+
+		{http.MethodGet, "/sales", "sale:read", "List sales", listSales},
+		{http.MethodGet, "/sales/{id}", "sale:read", "Get a sale", getSale},
+
+		{http.MethodGet, "/settings", "setting:read", "Get the settings", getSettings},
+		{http.MethodPatch, "/settings", "setting:update", "Update the settings", updateSettings},
+
+		{http.MethodGet, "/audit-logs", "audit:view", "List audit log entries", listAuditLogs},
+		{http.MethodGet, "/audit-logs/{id}", "audit:view", "Get an audit log entry", getAuditLog},
+	}
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// saleSorts are the fields a list of sales can be sorted by
+var saleSorts = []string{"id", "sale_date", "total"}
+
+func listSales(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "-sale_date", saleSorts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	filter := db.SaleFilter{PaymentMethod: r.URL.Query().Get("payment_method")}
+	if filter.UserID, err = queryInt(r, "user_id"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if filter.ProductID, err = queryInt(r, "product_id"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if filter.CustomerID, err = queryInt(r, "customer_id"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if filter.Refunded, err = queryBool(r, "refunded"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if filter.From, filter.To, err = queryDateRange(r); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, pagination, err := listPage(p, func(s models.Sale) int { return s.ID },
+		func(q db.ListQuery) ([]models.Sale, error) { return db.ListSales(filter, q) })
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeList(w, page, pagination)
+}
+
+func getSale(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "sale")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sale, err := db.GetSale(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, sale)
+}
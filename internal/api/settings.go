@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// settingsSections are the sections of the settings a PATCH can set. Fields left out of
+// a section keep their value.
+var settingsSections = []string{"store", "tax", "product", "payment", "receipt", "backup", "system", "security", "labour"}
+
+func getSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := db.GetSettings()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, settings)
+}
+
+func updateSettings(w http.ResponseWriter, r *http.Request) {
+	old, err := db.GetSettings()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Decode onto a copy, so maps and slices in the old settings are not changed
+	var settings models.Settings
+	data, err := json.Marshal(old)
+	if err == nil {
+		err = json.Unmarshal(data, &settings)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := decodeBody(r, &settings, settingsSections...); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := settings.Validate(); err != nil {
+		writeError(w, invalidField("body", "%s", err.Error()))
+		return
+	}
+
+	if err := db.SaveSettings(r.Context(), settings); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	updated, err := db.GetSettings()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, updated)
+}
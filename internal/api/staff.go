@@ -0,0 +1,199 @@
+package api
+
+import (
+	"net/http"
+
+	"termpos/internal/auth"
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// staffFields are the fields of a staff account that can be set by a PATCH. Usernames
+// are fixed and passwords are changed by their owner or reset from the terminal.
+var staffFields = []string{
+	"role", "active", "full_name", "email", "phone", "address", "hire_date",
+	"position", "department", "notes", "emergency_contact",
+}
+
+// staffCreateFields are the fields that can be set when a staff account is created
+var staffCreateFields = append([]string{"username", "password"}, staffFields...)
+
+// newStaff is the body of a request to create a staff account
+type newStaff struct {
+	models.User
+	Password string `json:"password"`
+}
+
+// staffSorts are the fields a list of staff accounts can be sorted by
+var staffSorts = []string{"full_name", "hire_date", "id", "last_login", "username"}
+
+// validateRole checks that a role exists
+func validateRole(v validator, role models.Role) {
+	if _, err := db.GetRole(role); err != nil {
+		v.check(false, "role", "is not a role")
+	}
+}
+
+func listStaff(w http.ResponseWriter, r *http.Request) {
+	p, err := parseListParams(r, "username", staffSorts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	filter := db.UserFilter{
+		Role:       models.Role(r.URL.Query().Get("role")),
+		Department: r.URL.Query().Get("department"),
+		Search:     r.URL.Query().Get("q"),
+	}
+	if filter.Active, err = queryBool(r, "active"); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, pagination, err := listPage(p, func(u models.User) int { return u.ID },
+		func(q db.ListQuery) ([]models.User, error) { return db.ListUsers(filter, q) })
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeList(w, page, pagination)
+}
+
+func getStaff(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "staff account")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	user, err := db.GetUserByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, user)
+}
+
+func createStaff(w http.ResponseWriter, r *http.Request) {
+	body := newStaff{User: models.User{Role: models.RoleCashier, Active: true}}
+	if err := decodeBody(r, &body, staffCreateFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	settings, err := db.GetSettings()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	v := validator{}
+	v.check(body.Username != "", "username", "cannot be empty")
+	if err := auth.ValidatePassword(body.Password, settings.Security); err != nil {
+		v.check(false, "password", err.Error())
+	}
+	validateRole(v, body.Role)
+	if err := v.err(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	user := body.User
+	user.PasswordHash, err = auth.HashPassword(body.Password)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id, err := db.CreateUser(r.Context(), user)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	created, err := db.GetUserByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, "/staff", id, created)
+}
+
+func updateStaff(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "staff account")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	old, err := db.GetUserByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	user := old
+	if err := decodeBody(r, &user, staffFields...); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	v := validator{}
+	validateRole(v, user.Role)
+	if err := v.err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if id == currentUser(r).ID && (!user.Active || user.Role != old.Role) {
+		writeError(w, conflict("you cannot deactivate your own account or change your own role"))
+		return
+	}
+
+	if err := db.UpdateUser(r.Context(), user); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// A deactivated user must not keep using the tokens they already hold
+	if old.Active && !user.Active {
+		if err := db.RevokeUserTokens(id); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	updated, err := db.GetUserByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, updated)
+}
+
+// deleteStaff deletes a staff account with no sales or time clock history. Accounts
+// with history are deactivated instead, so reports still show who did the work.
+func deleteStaff(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "staff account")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := db.GetUserByID(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if id == currentUser(r).ID {
+		writeError(w, conflict("you cannot delete your own account"))
+		return
+	}
+	if err := db.CheckUserUnused(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.DeleteUser(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,6 +1,7 @@
 package assistant
 
 import (
+        stdcontext "context"
         "fmt"
         "regexp"
         "strconv"
@@ -10,6 +11,7 @@ import (
         "github.com/sahilm/fuzzy"
         "termpos/internal/auth"
         "termpos/internal/db"
+        "termpos/internal/handlers"
         "termpos/internal/models"
 )
 
@@ -441,7 +443,7 @@ func handleAddProduct(entities map[string]Entity) (string, error) {
                 Stock: productQuantity,
         }
         
-        id, err := db.AddProduct(product)
+        id, err := db.AddProduct(auditContext(), product)
         if err != nil {
                 return "", err
         }
@@ -451,8 +453,8 @@ func handleAddProduct(entities map[string]Entity) (string, error) {
 
 // handleSellProduct processes the sell product intent
 func handleSellProduct(entities map[string]Entity) (string, error) {
-        // Check permissions - anyone with sales:create can sell products
-        if err := auth.RequirePermission("sales:create"); err != nil {
+        // Check permissions - anyone with sale:create can sell products
+        if err := auth.RequirePermission("sale:create"); err != nil {
                 return "", fmt.Errorf("you don't have permission to record sales: %w", err)
         }
         
@@ -509,8 +511,9 @@ func handleSellProduct(entities map[string]Entity) (string, error) {
                 ProductID: productID,
                 Quantity:  quantity,
         }
+        attributeSale(&sale)
         
-        id, err := db.RecordSale(sale)
+        id, err := handlers.RecordSale(auditContext(), sale)
         if err != nil {
                 return "", err
         }
@@ -524,6 +527,26 @@ func handleSellProduct(entities map[string]Entity) (string, error) {
         return fmt.Sprintf("Sold %d of %s for $%.2f (Sale ID: %d)", quantity, product.Name, product.Price*float64(quantity), id), nil
 }
 
+// auditContext returns a context whose changes are audited as made by the logged in
+// user through the assistant. The package's conversation state is also named context,
+// hence the import name.
+func auditContext() stdcontext.Context {
+        actor := db.Actor{Source: db.SourceAssistant}
+        if session := auth.GetCurrentUser(); session != nil {
+                actor.Username = session.Username
+        }
+        return db.WithActor(stdcontext.Background(), actor)
+}
+
+// attributeSale records the logged in user and this terminal on a sale
+func attributeSale(sale *models.Sale) {
+        userID := 0
+        if session := auth.GetCurrentUser(); session != nil {
+                userID = session.UserID
+        }
+        handlers.AttributeSale(sale, userID)
+}
+
 // handleGetInventory processes the get inventory intent
 func handleGetInventory() (string, error) {
         // Check permissions - anyone with inventory:view can view inventory
@@ -609,7 +632,7 @@ func handleUpdateStock(entities map[string]Entity) (string, error) {
                 return "", fmt.Errorf("stock cannot be negative")
         }
         
-        if err := db.UpdateProductStock(productID, stock); err != nil {
+        if err := db.UpdateProductStock(auditContext(), productID, stock); err != nil {
                 return "", err
         }
         
@@ -61,7 +61,7 @@ func handleAddCommand(input string) (string, error) {
                                 Stock: stock,
                         }
                         
-                        id, err := handlers.AddProduct(product)
+                        id, err := handlers.AddProduct(auditContext(), product)
                         if err != nil {
                                 return "", err
                         }
@@ -95,7 +95,7 @@ func handleAddCommand(input string) (string, error) {
                 Stock: quantity,
         }
 
-        id, err := handlers.AddProduct(product)
+        id, err := handlers.AddProduct(auditContext(), product)
         if err != nil {
                 return "", err
         }
@@ -129,8 +129,9 @@ func handleSellCommand(input string) (string, error) {
                         ProductID: productID,
                         Quantity:  quantity,
                 }
+                attributeSale(&sale)
 
-                id, err := handlers.RecordSale(sale)
+                id, err := handlers.RecordSale(auditContext(), sale)
                 if err != nil {
                         return "", err
                 }
@@ -199,8 +200,9 @@ func handleSellCommand(input string) (string, error) {
                 ProductID: matchedProduct.ID,
                 Quantity:  quantity,
         }
+        attributeSale(&sale)
 
-        id, err := handlers.RecordSale(sale)
+        id, err := handlers.RecordSale(auditContext(), sale)
         if err != nil {
                 return "", err
         }
@@ -249,7 +251,7 @@ func handleUpdateStockCommand(input string) (string, error) {
                         return "", fmt.Errorf("invalid stock quantity: %s", idMatches[4])
                 }
 
-                if err := handlers.UpdateProductStock(productID, stock); err != nil {
+                if err := handlers.UpdateProductStock(auditContext(), productID, stock); err != nil {
                         return "", err
                 }
 
@@ -290,7 +292,7 @@ func handleUpdateStockCommand(input string) (string, error) {
                         return "", fmt.Errorf("no product found matching '%s'", productName)
                 }
 
-                if err := handlers.UpdateProductStock(matchedProduct.ID, stock); err != nil {
+                if err := handlers.UpdateProductStock(auditContext(), matchedProduct.ID, stock); err != nil {
                         return "", err
                 }
 
@@ -0,0 +1,66 @@
+package auth
+
+import (
+        "errors"
+        "fmt"
+        "strings"
+
+        "termpos/internal/models"
+)
+
+// ErrApprovalRequired is returned when an action needs supervisor approval
+var ErrApprovalRequired = errors.New("supervisor approval required")
+
+// ApprovalRequiredError lists the restricted actions that need supervisor approval
+type ApprovalRequiredError struct {
+        Actions []models.RestrictedAction
+}
+
+func (e *ApprovalRequiredError) Error() string {
+        descriptions := make([]string, len(e.Actions))
+        for i, a := range e.Actions {
+                descriptions[i] = a.Description
+        }
+        return fmt.Sprintf("%v: %s", ErrApprovalRequired, strings.Join(descriptions, ", "))
+}
+
+// Is makes errors.Is(err, ErrApprovalRequired) match
+func (e *ApprovalRequiredError) Is(target error) bool {
+        return target == ErrApprovalRequired
+}
+
+// PendingApprovals returns the actions the user is not permitted to perform without approval
+func PendingApprovals(user *models.User, actions []models.RestrictedAction) []models.RestrictedAction {
+        var pending []models.RestrictedAction
+        for _, a := range actions {
+                if !HasPermission(user, a.Permission) {
+                        pending = append(pending, a)
+                }
+        }
+        return pending
+}
+
+// VerifySupervisor checks a supervisor's credentials and that they hold every
+// permission needed to approve the given actions
+func VerifySupervisor(username, password string, actions []models.RestrictedAction, getUser func(string) (models.User, error)) (models.User, error) {
+        user, err := getUser(username)
+        if err != nil {
+                return models.User{}, ErrInvalidCredentials
+        }
+
+        if !user.Active {
+                return models.User{}, ErrUserInactive
+        }
+
+        if !CheckPasswordHash(password, user.PasswordHash) {
+                return models.User{}, ErrInvalidCredentials
+        }
+
+        for _, a := range actions {
+                if !HasPermission(&user, a.Permission) {
+                        return models.User{}, fmt.Errorf("%w: %s cannot approve %s", ErrInsufficientPerms, username, a.Description)
+                }
+        }
+
+        return user, nil
+}
@@ -13,30 +13,45 @@ import (
 )
 
 var (
-        ErrInvalidCredentials = errors.New("invalid username or password")
-        ErrUserInactive       = errors.New("user account is inactive")
-        ErrInsufficientPerms  = errors.New("insufficient permissions for this operation")
+        ErrInvalidCredentials     = errors.New("invalid username or password")
+        ErrUserInactive           = errors.New("user account is inactive")
+        ErrInsufficientPerms      = errors.New("insufficient permissions for this operation")
+        ErrAccountLocked          = errors.New("account is temporarily locked after too many failed login attempts")
+        ErrSessionLocked          = errors.New("session is locked, run 'pos unlock' or 'pos switch' to continue")
+        ErrPasswordChangeRequired = errors.New("password change required, run 'pos passwd' to continue")
 )
 
 // Permission constants for workflow-related operations
 const (
         PermissionConfigureWorkflows = "setting:workflow:configure"
-        PermissionRunBackups         = "setting:backup:run"
+        PermissionRunBackups         = "setting:backup"
         PermissionGenerateReports    = "report:generate"
 )
 
 // Session represents an authenticated user session
 type Session struct {
-        UserID       int
-        Username     string
-        Role         models.Role
-        CreatedAt    time.Time
-        LastActivity time.Time
+        UserID                 int
+        Username               string
+        Role                   models.Role
+        CreatedAt              time.Time
+        LastActivity           time.Time
+        Locked                 bool
+        PasswordChangeRequired bool // Set on first login, after an admin reset and when the password has expired
+        TwoFactorSetupRequired bool // Set when the user's role requires two-factor authentication and they have not enrolled
 }
 
 // CurrentSession stores the active user session
 var CurrentSession *Session
 
+// roleLoader loads a role and its permissions from storage
+var roleLoader func(models.Role) (models.RoleDefinition, error)
+
+// SetRoleLoader sets the function used to load roles and their permissions.
+// Until it is set, only the default grants of the built-in roles are used.
+func SetRoleLoader(loader func(models.Role) (models.RoleDefinition, error)) {
+        roleLoader = loader
+}
+
 // sessionFilePath returns the path to the session file
 func sessionFilePath() string {
         homeDir, _ := os.UserHomeDir()
@@ -102,22 +117,37 @@ func CheckPasswordHash(password, hash string) bool {
 
 // Login authenticates a user and creates a session
 func Login(username, password string, getUser func(string) (models.User, error), updateLastLogin func(int) error) (*Session, error) {
+        user, err := CheckCredentials(username, password, getUser)
+        if err != nil {
+                return nil, err
+        }
+
+        return StartSession(user, updateLastLogin)
+}
+
+// CheckCredentials verifies a user's password without starting a session
+func CheckCredentials(username, password string, getUser func(string) (models.User, error)) (models.User, error) {
         // Get user by username
         user, err := getUser(username)
         if err != nil {
-                return nil, ErrInvalidCredentials
+                return models.User{}, ErrInvalidCredentials
         }
 
         // Check if user is active
         if !user.Active {
-                return nil, ErrUserInactive
+                return models.User{}, ErrUserInactive
         }
 
         // Verify password
         if !CheckPasswordHash(password, user.PasswordHash) {
-                return nil, ErrInvalidCredentials
+                return models.User{}, ErrInvalidCredentials
         }
 
+        return user, nil
+}
+
+// StartSession records the login of an authenticated user and makes their session current
+func StartSession(user models.User, updateLastLogin func(int) error) (*Session, error) {
         // Update last login time
         if err := updateLastLogin(user.ID); err != nil {
                 return nil, err
@@ -172,6 +202,18 @@ func RequirePermission(permission string) error {
                 return errors.New("authentication required")
         }
 
+        if CurrentSession.Locked {
+                return ErrSessionLocked
+        }
+
+        if CurrentSession.PasswordChangeRequired {
+                return ErrPasswordChangeRequired
+        }
+
+        if CurrentSession.TwoFactorSetupRequired {
+                return ErrTwoFactorSetupRequired
+        }
+
         user := models.User{
                 ID:       CurrentSession.UserID,
                 Username: CurrentSession.Username,
@@ -191,40 +233,24 @@ func HasPermission(user *models.User, permission string) bool {
                 return false
         }
 
-        // For simplicity, role-based checking
+        // API keys only have the permissions they were scoped to
+        if user.Scopes != nil {
+                return user.HasScope(permission)
+        }
+
         // Admin has all permissions
-        if user.Role == "admin" {
+        if user.Role == models.RoleAdmin {
                 return true
         }
 
-        // Manager permissions
-        if user.Role == "manager" {
-                switch permission {
-                case "setting:read", "setting:backup", "setting:export",
-                        "product:read", "product:create", "product:update",
-                        "sale:read", "sale:create", "user:read", "role:read",
-                        "inventory:view",
-                        // API specific permissions
-                        "product:manage",
-                        "sales:create",
-                        // New workflow permissions
-                        PermissionConfigureWorkflows, PermissionRunBackups, 
-                        PermissionGenerateReports:
-                        return true
-                default:
-                        return false
-                }
+        if roleLoader == nil {
+                return user.HasPermission(permission)
         }
 
-        // Cashier permissions
-        if user.Role == "cashier" {
-                switch permission {
-                case "product:read", "sale:create", "sale:read", "inventory:view":
-                        return true
-                default:
-                        return false
-                }
+        role, err := roleLoader(user.Role)
+        if err != nil {
+                return false
         }
 
-        return false
-}
\ No newline at end of file
+        return role.HasPermission(permission)
+}
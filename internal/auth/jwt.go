@@ -1,97 +1,202 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 var (
-	// Default secret key for JWT tokens - this should be overridden in production
-	jwtSecretKey = []byte("termpos-default-secret-key-change-in-production")
+	ErrDefaultJWTSecret = errors.New("TERMPOS_JWT_SECRET or TERMPOS_JWT_KEYS must be set, tokens are never signed with the default secret")
+	ErrWeakJWTSecret    = fmt.Errorf("JWT secrets must be at least %d bytes long", MinJWTSecretLength)
+	ErrUnknownJWTKey    = errors.New("token was signed with an unknown or retired key")
+	ErrJWTKeysNotLoaded = errors.New("JWT keys are not loaded, call InitJWT first")
+)
+
+// MinJWTSecretLength is the shortest secret accepted for signing tokens
+const MinJWTSecretLength = 32
+
+// jwtIssuer is the issuer of every token signed by the agent
+const jwtIssuer = "termpos"
+
+// defaultJWTSecret is the secret earlier versions used when none was configured. It is
+// public, so it is refused as a signing key.
+const defaultJWTSecret = "termpos-default-secret-key-change-in-production"
+
+var (
+	// jwtKeys holds the secrets tokens are verified with, by key ID
+	jwtKeys map[string][]byte
+
+	// jwtSigningKeyID is the key new tokens are signed with
+	jwtSigningKeyID string
 )
 
 // JWT claim structure
 type Claims struct {
-	UserID   int        `json:"user_id"`
-	Username string     `json:"username"`
-	Role     string     `json:"role"`
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
 	jwt.RegisteredClaims
 }
 
-// Initialize JWT configuration
-func InitJWT() {
-	// Check if a custom secret is provided via environment variable
-	if secretKey := os.Getenv("TERMPOS_JWT_SECRET"); secretKey != "" {
-		jwtSecretKey = []byte(secretKey)
-		fmt.Println("Using JWT secret from environment variable")
-	} else {
-		fmt.Println("Warning: Using default JWT secret key. Please set TERMPOS_JWT_SECRET environment variable.")
+// JWTKeyID derives the key ID of a secret that is configured without one
+func JWTKeyID(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:4])
+}
+
+// ParseJWTKeys parses a comma-separated list of signing keys. Each entry is "kid:secret",
+// or a bare secret whose key ID is derived with JWTKeyID. The first key signs new tokens,
+// the others only verify tokens signed before a rotation.
+func ParseJWTKeys(list string) (map[string][]byte, string, error) {
+	keys := make(map[string][]byte)
+	signingKeyID := ""
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kid, secret := "", entry
+		if i := strings.Index(entry, ":"); i > 0 {
+			kid, secret = entry[:i], entry[i+1:]
+		}
+		if secret == defaultJWTSecret {
+			return nil, "", ErrDefaultJWTSecret
+		}
+		if len(secret) < MinJWTSecretLength {
+			return nil, "", ErrWeakJWTSecret
+		}
+		if kid == "" {
+			kid = JWTKeyID([]byte(secret))
+		}
+		if _, exists := keys[kid]; exists {
+			return nil, "", fmt.Errorf("duplicate JWT key ID %q", kid)
+		}
+
+		keys[kid] = []byte(secret)
+		if signingKeyID == "" {
+			signingKeyID = kid
+		}
 	}
+
+	if len(keys) == 0 {
+		return nil, "", ErrDefaultJWTSecret
+	}
+	return keys, signingKeyID, nil
 }
 
-// GenerateJWT creates a new JWT token for a user
-func GenerateJWT(userID int, username string, role string) (string, error) {
-	// Token expiration time (24 hours)
-	expirationTime := time.Now().Add(24 * time.Hour)
+// InitJWT loads the signing keys from TERMPOS_JWT_KEYS, or the single key in
+// TERMPOS_JWT_SECRET. TERMPOS_JWT_KID selects the signing key when several are loaded.
+// It fails rather than fall back to a built-in secret.
+//
+// To rotate keys, put the new key first in TERMPOS_JWT_KEYS and keep the old one after
+// it until the tokens it signed have expired.
+func InitJWT() error {
+	list := os.Getenv("TERMPOS_JWT_KEYS")
+	if list == "" {
+		list = os.Getenv("TERMPOS_JWT_SECRET")
+	}
 
-	// Create claims with user data
+	keys, signingKeyID, err := ParseJWTKeys(list)
+	if err != nil {
+		return err
+	}
+
+	if kid := os.Getenv("TERMPOS_JWT_KID"); kid != "" {
+		if _, ok := keys[kid]; !ok {
+			return fmt.Errorf("TERMPOS_JWT_KID %q is not one of the configured keys", kid)
+		}
+		signingKeyID = kid
+	}
+
+	jwtKeys, jwtSigningKeyID = keys, signingKeyID
+	return nil
+}
+
+// JWTKeyIDs returns the ID of the signing key and the number of keys tokens are verified with
+func JWTKeyIDs() (string, int) {
+	return jwtSigningKeyID, len(jwtKeys)
+}
+
+// GenerateJWT creates a signed access token for a user that expires after ttl. Each token
+// has a unique ID so it can be revoked on its own.
+func GenerateJWT(userID int, username string, role string, ttl time.Duration) (string, *Claims, error) {
+	return GenerateJWTAt(userID, username, role, time.Now(), ttl)
+}
+
+// GenerateJWTAt creates a signed access token for a user issued at issuedAt, which may be
+// up to a second from now to issue it after the user's tokens were revoked
+func GenerateJWTAt(userID int, username string, role string, issuedAt time.Time, ttl time.Duration) (string, *Claims, error) {
+	secret, ok := jwtKeys[jwtSigningKeyID]
+	if !ok {
+		return "", nil, ErrJWTKeysNotLoaded
+	}
+
+	jti, err := GenerateToken("")
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
 	claims := &Claims{
 		UserID:   userID,
 		Username: username,
 		Role:     role,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    "termpos",
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    jwtIssuer,
 			Subject:   username,
 		},
 	}
 
-	// Create token with claims
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = jwtSigningKeyID
 
-	// Sign the token with our secret key
-	tokenString, err := token.SignedString(jwtSecretKey)
+	tokenString, err := token.SignedString(secret)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	return tokenString, nil
+	return tokenString, claims, nil
 }
 
-// ValidateJWT validates a JWT token and returns the claims
+// ValidateJWT checks a token's signature against the key named by its kid header, and its
+// issuer and expiry, and returns the claims. It does not check for revocation.
 func ValidateJWT(tokenString string) (*Claims, error) {
-	// Parse the token
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&Claims{},
 		func(token *jwt.Token) (interface{}, error) {
-			// Validate the signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			kid, _ := token.Header["kid"].(string)
+			secret, ok := jwtKeys[kid]
+			if !ok {
+				return nil, ErrUnknownJWTKey
 			}
-			return jwtSecretKey, nil
+			return secret, nil
 		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(jwtIssuer),
+		jwt.WithExpirationRequired(),
 	)
-
 	if err != nil {
 		return nil, err
 	}
 
-	// Check if the token is valid
-	if !token.Valid {
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	// Extract the claims
 	claims, ok := token.Claims.(*Claims)
-	if !ok {
+	if !ok || !token.Valid || claims.ID == "" {
 		return nil, fmt.Errorf("invalid token claims")
 	}
 
 	return claims, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInitJWTRefusesDefaultSecret(t *testing.T) {
+	t.Setenv("TERMPOS_JWT_KEYS", "")
+	t.Setenv("TERMPOS_JWT_SECRET", "")
+	if err := InitJWT(); !errors.Is(err, ErrDefaultJWTSecret) {
+		t.Errorf("Expected ErrDefaultJWTSecret without a secret, got %v", err)
+	}
+
+	t.Setenv("TERMPOS_JWT_SECRET", defaultJWTSecret)
+	if err := InitJWT(); !errors.Is(err, ErrDefaultJWTSecret) {
+		t.Errorf("Expected ErrDefaultJWTSecret for the built-in secret, got %v", err)
+	}
+
+	t.Setenv("TERMPOS_JWT_SECRET", "too-short")
+	if err := InitJWT(); !errors.Is(err, ErrWeakJWTSecret) {
+		t.Errorf("Expected ErrWeakJWTSecret, got %v", err)
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	oldSecret := strings.Repeat("a", MinJWTSecretLength)
+	newSecret := strings.Repeat("b", MinJWTSecretLength)
+
+	t.Setenv("TERMPOS_JWT_SECRET", oldSecret)
+	if err := InitJWT(); err != nil {
+		t.Fatalf("InitJWT failed: %v", err)
+	}
+	oldToken, claims, err := GenerateJWT(1, "admin", "admin", time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateJWT failed: %v", err)
+	}
+	if claims.ID == "" {
+		t.Error("Expected the token to have an ID")
+	}
+
+	// The new key signs, the old one still verifies tokens it signed
+	t.Setenv("TERMPOS_JWT_KEYS", "2024-06:"+newSecret+","+oldSecret)
+	if err := InitJWT(); err != nil {
+		t.Fatalf("InitJWT failed: %v", err)
+	}
+	if kid, count := JWTKeyIDs(); kid != "2024-06" || count != 2 {
+		t.Errorf("Expected signing key 2024-06 of 2, got %s of %d", kid, count)
+	}
+	if _, err := ValidateJWT(oldToken); err != nil {
+		t.Errorf("Expected a token signed with the old key to validate, got %v", err)
+	}
+	newToken, _, err := GenerateJWT(1, "admin", "admin", time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateJWT failed: %v", err)
+	}
+
+	// Once the old key is retired its tokens are rejected
+	t.Setenv("TERMPOS_JWT_KEYS", "2024-06:"+newSecret)
+	if err := InitJWT(); err != nil {
+		t.Fatalf("InitJWT failed: %v", err)
+	}
+	if _, err := ValidateJWT(oldToken); !errors.Is(err, ErrUnknownJWTKey) {
+		t.Errorf("Expected ErrUnknownJWTKey for a retired key, got %v", err)
+	}
+	if _, err := ValidateJWT(newToken); err != nil {
+		t.Errorf("Expected the new token to validate, got %v", err)
+	}
+
+	expired, _, err := GenerateJWT(1, "admin", "admin", -time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateJWT failed: %v", err)
+	}
+	if _, err := ValidateJWT(expired); err == nil {
+		t.Error("Expected an expired token to be rejected")
+	}
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+        "bufio"
+        "crypto/sha1"
+        "encoding/hex"
+        "errors"
+        "fmt"
+        "os"
+        "strings"
+        "unicode"
+
+        "termpos/internal/models"
+)
+
+var (
+        ErrPasswordBreached = errors.New("password appears in a list of breached passwords")
+        ErrPasswordReused   = errors.New("password was used recently, choose a different one")
+)
+
+// ValidatePassword checks a new password against the password policy:
+// its length, the character classes it uses and the local breached password list
+func ValidatePassword(password string, policy models.SecuritySettings) error {
+        if len([]rune(password)) < policy.MinPasswordLength() {
+                return fmt.Errorf("password must be at least %d characters", policy.MinPasswordLength())
+        }
+
+        if classes := passwordClasses(password); classes < policy.MinPasswordClasses() {
+                return fmt.Errorf("password must contain at least %d of: lowercase letters, uppercase letters, digits and symbols", policy.MinPasswordClasses())
+        }
+
+        breached, err := IsBreachedPassword(password, policy.BreachListPath())
+        if err != nil {
+                return err
+        }
+        if breached {
+                return ErrPasswordBreached
+        }
+
+        return nil
+}
+
+// passwordClasses counts the character classes used in a password
+func passwordClasses(password string) int {
+        var lower, upper, digit, symbol bool
+        for _, c := range password {
+                switch {
+                case unicode.IsLower(c):
+                        lower = true
+                case unicode.IsUpper(c):
+                        upper = true
+                case unicode.IsDigit(c):
+                        digit = true
+                default:
+                        symbol = true
+                }
+        }
+
+        count := 0
+        for _, present := range []bool{lower, upper, digit, symbol} {
+                if present {
+                        count++
+                }
+        }
+        return count
+}
+
+// IsBreachedPassword checks a password against a local breached password list. Each line
+// is either a plain password or an uppercase or lowercase SHA-1 hash, optionally followed
+// by ":count" as in downloaded breach corpora. A missing file is treated as an empty list.
+func IsBreachedPassword(password, path string) (bool, error) {
+        file, err := os.Open(path)
+        if os.IsNotExist(err) {
+                return false, nil
+        }
+        if err != nil {
+                return false, fmt.Errorf("failed to open breached password list: %w", err)
+        }
+        defer file.Close()
+
+        sum := sha1.Sum([]byte(password))
+        hash := hex.EncodeToString(sum[:])
+
+        scanner := bufio.NewScanner(file)
+        for scanner.Scan() {
+                line := strings.TrimSpace(scanner.Text())
+                if line == "" {
+                        continue
+                }
+                if line == password {
+                        return true, nil
+                }
+
+                entry := line
+                if i := strings.IndexByte(entry, ':'); i == 40 {
+                        entry = entry[:i]
+                }
+                if len(entry) == 40 && strings.EqualFold(entry, hash) {
+                        return true, nil
+                }
+        }
+        if err := scanner.Err(); err != nil {
+                return false, fmt.Errorf("failed to read breached password list: %w", err)
+        }
+
+        return false, nil
+}
+
+// CheckPasswordReuse returns ErrPasswordReused if the password matches any of the given hashes
+func CheckPasswordReuse(password string, hashes []string) error {
+        for _, hash := range hashes {
+                if CheckPasswordHash(password, hash) {
+                        return ErrPasswordReused
+                }
+        }
+        return nil
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+        "errors"
+        "fmt"
+        "time"
+
+        "termpos/internal/models"
+)
+
+// PIN length limits for quick login
+const (
+        MinPINLength = 4
+        MaxPINLength = 8
+)
+
+// ErrInvalidPIN is returned when a PIN does not have the required format
+var ErrInvalidPIN = fmt.Errorf("PIN must be %d to %d digits", MinPINLength, MaxPINLength)
+
+// ErrNoPIN is returned when a user without a PIN tries to log in with one
+var ErrNoPIN = errors.New("no PIN has been set for this user")
+
+// ValidatePIN checks that a PIN is a short numeric code
+func ValidatePIN(pin string) error {
+        if len(pin) < MinPINLength || len(pin) > MaxPINLength {
+                return ErrInvalidPIN
+        }
+        for _, c := range pin {
+                if c < '0' || c > '9' {
+                        return ErrInvalidPIN
+                }
+        }
+        return nil
+}
+
+// HashPIN validates a PIN and hashes it with bcrypt like a password
+func HashPIN(pin string) (string, error) {
+        if err := ValidatePIN(pin); err != nil {
+                return "", err
+        }
+        return HashPassword(pin)
+}
+
+// CheckPIN verifies a user's quick login PIN without starting a session
+func CheckPIN(username, pin string, getUser func(string) (models.User, error), getSecurity func(int) (models.UserSecurity, error)) (models.User, error) {
+        user, err := getUser(username)
+        if err != nil {
+                return models.User{}, ErrInvalidCredentials
+        }
+
+        if !user.Active {
+                return models.User{}, ErrUserInactive
+        }
+
+        security, err := getSecurity(user.ID)
+        if err != nil {
+                return models.User{}, err
+        }
+        if !security.HasPIN() {
+                return models.User{}, ErrNoPIN
+        }
+
+        if !CheckPasswordHash(pin, security.PINHash) {
+                return models.User{}, ErrInvalidCredentials
+        }
+
+        return user, nil
+}
+
+// LockIfIdle locks the current session if it has been idle for longer than timeout.
+// A zero timeout disables idle locking. It reports whether the session was locked.
+func LockIfIdle(timeout time.Duration) (bool, error) {
+        if CurrentSession == nil || CurrentSession.Locked || timeout <= 0 {
+                return false, nil
+        }
+
+        if time.Since(CurrentSession.LastActivity) < timeout {
+                return false, nil
+        }
+
+        return true, Lock()
+}
+
+// Lock locks the current session until the user unlocks it or another user switches in
+func Lock() error {
+        if CurrentSession == nil {
+                return errors.New("authentication required")
+        }
+
+        CurrentSession.Locked = true
+        return SaveSession()
+}
+
+// Touch records activity on the current session
+func Touch() error {
+        if CurrentSession == nil || CurrentSession.Locked {
+                return nil
+        }
+
+        CurrentSession.LastActivity = time.Now()
+        return SaveSession()
+}
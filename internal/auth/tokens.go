@@ -0,0 +1,24 @@
+package auth
+
+import (
+        "crypto/rand"
+        "crypto/sha256"
+        "encoding/hex"
+        "fmt"
+)
+
+// GenerateToken creates a random opaque token with the given prefix, e.g. "apv_3f9c..."
+func GenerateToken(prefix string) (string, error) {
+        b := make([]byte, 24)
+        if _, err := rand.Read(b); err != nil {
+                return "", fmt.Errorf("failed to generate token: %w", err)
+        }
+        return prefix + hex.EncodeToString(b), nil
+}
+
+// HashToken returns the SHA-256 hash of a token for storage.
+// Tokens are random, so a fast unsalted hash is sufficient.
+func HashToken(token string) string {
+        sum := sha256.Sum256([]byte(token))
+        return hex.EncodeToString(sum[:])
+}
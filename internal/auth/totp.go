@@ -0,0 +1,137 @@
+package auth
+
+import (
+        "crypto/hmac"
+        "crypto/rand"
+        "crypto/sha1"
+        "encoding/base32"
+        "encoding/binary"
+        "errors"
+        "fmt"
+        "net/url"
+        "strings"
+        "time"
+)
+
+// TOTP parameters (RFC 6238 defaults understood by all authenticator apps)
+const (
+        TOTPDigits = 6
+        TOTPPeriod = 30
+
+        // TOTPSkew is the number of time steps either side of now that are accepted
+        TOTPSkew = 1
+
+        // RecoveryCodeCount is the number of recovery codes issued at enrollment
+        RecoveryCodeCount = 10
+)
+
+var (
+        ErrTwoFactorRequired      = errors.New("two-factor authentication code required")
+        ErrTwoFactorSetupRequired = errors.New("two-factor authentication is required for your role, run 'pos user 2fa enroll' to continue")
+        ErrInvalidTwoFactorCode   = errors.New("invalid two-factor authentication code")
+)
+
+// totpEncoding is base32 without padding, as used in otpauth URIs
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret creates a random 160-bit TOTP secret, base32 encoded
+func GenerateTOTPSecret() (string, error) {
+        b := make([]byte, 20)
+        if _, err := rand.Read(b); err != nil {
+                return "", fmt.Errorf("failed to generate secret: %w", err)
+        }
+        return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURI returns the otpauth URI used to enroll a secret in an authenticator app
+func TOTPURI(issuer, account, secret string) string {
+        label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+        params := url.Values{}
+        params.Set("secret", secret)
+        params.Set("issuer", issuer)
+        return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// TOTPCode returns the code for a secret at the given time
+func TOTPCode(secret string, t time.Time) (string, error) {
+        return totpCodeAt(secret, t.Unix()/TOTPPeriod)
+}
+
+// totpCodeAt computes the HOTP value (RFC 4226) for a time step
+func totpCodeAt(secret string, step int64) (string, error) {
+        key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+        if err != nil {
+                return "", fmt.Errorf("invalid TOTP secret: %w", err)
+        }
+
+        var msg [8]byte
+        binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+        mac := hmac.New(sha1.New, key)
+        mac.Write(msg[:])
+        sum := mac.Sum(nil)
+
+        // Dynamic truncation
+        offset := sum[len(sum)-1] & 0x0f
+        value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+        mod := uint32(1)
+        for i := 0; i < TOTPDigits; i++ {
+                mod *= 10
+        }
+        return fmt.Sprintf("%0*d", TOTPDigits, value%mod), nil
+}
+
+// MatchTOTP checks a code against a secret, allowing TOTPSkew steps of clock drift.
+// It returns the matching time step so callers can refuse to accept it twice.
+func MatchTOTP(secret, code string, t time.Time) (int64, bool) {
+        if !IsTOTPCode(code) {
+                return 0, false
+        }
+
+        now := t.Unix() / TOTPPeriod
+        for step := now - TOTPSkew; step <= now+TOTPSkew; step++ {
+                expected, err := totpCodeAt(secret, step)
+                if err != nil {
+                        return 0, false
+                }
+                if hmac.Equal([]byte(expected), []byte(code)) {
+                        return step, true
+                }
+        }
+        return 0, false
+}
+
+// IsTOTPCode reports whether a code looks like a TOTP code rather than a recovery code
+func IsTOTPCode(code string) bool {
+        if len(code) != TOTPDigits {
+                return false
+        }
+        for _, c := range code {
+                if c < '0' || c > '9' {
+                        return false
+                }
+        }
+        return true
+}
+
+// GenerateRecoveryCodes creates single-use recovery codes formatted as "xxxxx-xxxxx"
+func GenerateRecoveryCodes(n int) ([]string, error) {
+        codes := make([]string, n)
+        for i := range codes {
+                b := make([]byte, 6)
+                if _, err := rand.Read(b); err != nil {
+                        return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+                }
+                code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+                codes[i] = code[:5] + "-" + code[5:]
+        }
+        return codes, nil
+}
+
+// HashRecoveryCode normalizes a recovery code as typed by the user and hashes it for storage
+func HashRecoveryCode(code string) string {
+        code = strings.ToLower(strings.TrimSpace(code))
+        code = strings.NewReplacer("-", "", " ", "").Replace(code)
+        return HashToken(code)
+}
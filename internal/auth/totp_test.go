@@ -0,0 +1,86 @@
+package auth
+
+import (
+        "strings"
+        "testing"
+        "time"
+)
+
+func TestTOTPCode(t *testing.T) {
+        // RFC 6238 appendix B test vectors for SHA-1, truncated to six digits
+        secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+        tests := map[int64]string{
+                59:         "287082",
+                1111111109: "081804",
+                1234567890: "005924",
+                2000000000: "279037",
+        }
+
+        for unix, want := range tests {
+                got, err := TOTPCode(secret, time.Unix(unix, 0))
+                if err != nil {
+                        t.Fatalf("TOTPCode failed: %v", err)
+                }
+                if got != want {
+                        t.Errorf("TOTPCode at %d = %s, want %s", unix, got, want)
+                }
+        }
+}
+
+func TestMatchTOTP(t *testing.T) {
+        secret, err := GenerateTOTPSecret()
+        if err != nil {
+                t.Fatalf("GenerateTOTPSecret failed: %v", err)
+        }
+
+        now := time.Now()
+        code, err := TOTPCode(secret, now.Add(-TOTPPeriod*time.Second))
+        if err != nil {
+                t.Fatalf("TOTPCode failed: %v", err)
+        }
+
+        // The previous step is accepted to allow for clock drift
+        step, ok := MatchTOTP(secret, code, now)
+        if !ok || step != now.Unix()/TOTPPeriod-1 {
+                t.Errorf("Expected the previous step to match, got step %d ok %v", step, ok)
+        }
+
+        // Codes from further away are not
+        old, _ := TOTPCode(secret, now.Add(-3*TOTPPeriod*time.Second))
+        if old != code {
+                if _, ok := MatchTOTP(secret, old, now); ok {
+                        t.Error("Expected an old code not to match")
+                }
+        }
+
+        if _, ok := MatchTOTP(secret, "abcdef", now); ok {
+                t.Error("Expected a non-numeric code not to match")
+        }
+}
+
+func TestRecoveryCodes(t *testing.T) {
+        codes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+        if err != nil {
+                t.Fatalf("GenerateRecoveryCodes failed: %v", err)
+        }
+        if len(codes) != RecoveryCodeCount {
+                t.Fatalf("Expected %d codes, got %d", RecoveryCodeCount, len(codes))
+        }
+
+        seen := make(map[string]bool)
+        for _, code := range codes {
+                if len(code) != 11 || code[5] != '-' {
+                        t.Errorf("Unexpected recovery code format: %q", code)
+                }
+                if seen[code] {
+                        t.Errorf("Duplicate recovery code: %q", code)
+                }
+                seen[code] = true
+        }
+
+        // Codes are matched regardless of case and separators
+        typed := " " + strings.ToUpper(codes[0][:5]+codes[0][6:]) + " "
+        if HashRecoveryCode(typed) != HashRecoveryCode(codes[0]) {
+                t.Error("Expected recovery code hashing to ignore spaces and dashes")
+        }
+}
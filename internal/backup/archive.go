@@ -0,0 +1,606 @@
+// Package backup writes and reads backup archives: a snapshot of the database with a
+// manifest describing it, optionally compressed with gzip and encrypted in chunks with
+// AES-GCM, so backups of any size are streamed rather than held in memory. Changes made
+// between backups are archived in the same format for point-in-time recovery.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"termpos/internal/db"
+	"termpos/internal/security"
+)
+
+// Extension is the file extension of backup archives
+const Extension = ".backup"
+
+// formatVersion is the version of the archive format
+const formatVersion = 1
+
+// magic starts every backup archive
+var magic = []byte("TPBK")
+
+// Names of the archive entries
+const (
+	manifestName = "manifest.json"
+	databaseName = "pos.db"
+)
+
+// Compression methods of the archive header. Only gzip is written for now: zstd would
+// need a third-party library, so its value is reserved and archives using it are refused
+// until it is supported.
+const (
+	compressionNone byte = 0
+	compressionGzip byte = 1
+	compressionZstd byte = 2
+)
+
+// maxManifestSize limits the manifest read from an archive
+const maxManifestSize = 1 << 20
+
+var (
+	ErrNotArchive             = errors.New("file is not a backup archive")
+	ErrPasswordRequired       = errors.New("backup is encrypted with a password, which must be given")
+	ErrChecksumMismatch       = errors.New("backup does not match the checksum of its manifest")
+	ErrManifestMismatch       = errors.New("backup does not match its manifest")
+	ErrUnsupportedFormat      = errors.New("backup was written by a newer version")
+	ErrUnsupportedCompression = errors.New("backup is compressed with a method this version cannot read")
+)
+
+// Encryption is how a backup archive is encrypted
+type Encryption byte
+
+const (
+	EncryptionNone      Encryption = 0
+	EncryptionPassword  Encryption = 1
+	EncryptionMasterKey Encryption = 2
+)
+
+// String returns the name of the encryption
+func (e Encryption) String() string {
+	switch e {
+	case EncryptionPassword:
+		return "password"
+	case EncryptionMasterKey:
+		return "master key"
+	default:
+		return "none"
+	}
+}
+
+// Options are how a backup archive is written
+type Options struct {
+	// Compress compresses the archive with gzip
+	Compress bool
+	// Encrypt encrypts the archive, with a key derived from Password when one is given
+	// and otherwise with a key wrapped by the master key
+	Encrypt  bool
+	Password string
+}
+
+// Manifest describes the database in a backup archive
+type Manifest struct {
+	FormatVersion int              `json:"format_version"`
+	AppVersion    string           `json:"app_version"`
+	SchemaVersion int              `json:"schema_version"`
+	CreatedAt     time.Time        `json:"created_at"`
+	CreatedBy     string           `json:"created_by"`
+	Size          int64            `json:"size"`
+	SHA256        string           `json:"sha256"`
+	Tables        map[string]int64 `json:"tables"`
+}
+
+// Header is the part of a backup archive that is readable without its key
+type Header struct {
+	Version    byte
+	Compressed bool
+	Encryption Encryption
+}
+
+// Create writes a backup archive of the open database to path. The schema version, row
+// counts, size and checksum of the manifest are filled in from a snapshot of the database;
+// the app version and creation user are taken from manifest.
+func Create(path string, manifest Manifest, opts Options) (Manifest, error) {
+	snapshot, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*.db")
+	if err != nil {
+		return manifest, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	snapshot.Close()
+	defer os.Remove(snapshot.Name())
+
+	if err := db.SnapshotDatabase(snapshot.Name()); err != nil {
+		return manifest, err
+	}
+	info, err := db.InspectDatabaseFile(snapshot.Name())
+	if err != nil {
+		return manifest, err
+	}
+	size, sum, err := hashFile(snapshot.Name())
+	if err != nil {
+		return manifest, err
+	}
+
+	manifest.FormatVersion = formatVersion
+	manifest.SchemaVersion = info.SchemaVersion
+	manifest.Tables = info.Tables
+	manifest.Size = size
+	manifest.SHA256 = sum
+	if manifest.CreatedAt.IsZero() {
+		manifest.CreatedAt = time.Now().UTC()
+	}
+
+	err = createFile(path, func(w io.Writer) error {
+		return write(w, snapshot.Name(), manifest, opts)
+	})
+	return manifest, err
+}
+
+// createFile writes a file through a temporary file, so an interrupted write never looks
+// complete
+func createFile(path string, write func(w io.Writer) error) error {
+	temp := path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// hashFile returns the size and SHA-256 checksum of a file
+func hashFile(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// nopWriteCloser adds a Close that does nothing to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// entry is a file written to an archive
+type entry struct {
+	name string
+	size int64
+	data io.Reader
+}
+
+// write writes the archive of a database file
+func write(w io.Writer, databasePath string, manifest Manifest, opts Options) error {
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	database, err := os.Open(databasePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", databasePath, err)
+	}
+	defer database.Close()
+
+	return writeEntries(w, opts, manifest.CreatedAt, []entry{
+		{manifestName, int64(len(manifestJSON)), bytes.NewReader(manifestJSON)},
+		{databaseName, manifest.Size, database},
+	})
+}
+
+// writeEntries writes an archive of files, compressed and encrypted as opts asks
+func writeEntries(w io.Writer, opts Options, modTime time.Time, entries []entry) error {
+	header, aead, prefix, err := newHeader(opts)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	var out io.WriteCloser = nopWriteCloser{w}
+	if aead != nil {
+		out = newChunkWriter(w, aead, prefix, header)
+	}
+	var body io.Writer = out
+	var gz *gzip.Writer
+	if opts.Compress {
+		gz = gzip.NewWriter(out)
+		body = gz
+	}
+
+	archive := tar.NewWriter(body)
+	for _, entry := range entries {
+		err := archive.WriteHeader(&tar.Header{Name: entry.name, Mode: 0600, Size: entry.size, ModTime: modTime})
+		if err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+		if _, err := io.Copy(archive, entry.data); err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("failed to compress backup: %w", err)
+		}
+	}
+	return out.Close()
+}
+
+// newHeader returns the header of a new archive, with the cipher and nonce prefix its
+// chunks are encrypted with when it is encrypted
+func newHeader(opts Options) ([]byte, cipher.AEAD, []byte, error) {
+	compression := compressionNone
+	if opts.Compress {
+		compression = compressionGzip
+	}
+	encryption := EncryptionNone
+	if opts.Encrypt {
+		encryption = EncryptionMasterKey
+		if opts.Password != "" {
+			encryption = EncryptionPassword
+		}
+	}
+	header := append(append([]byte{}, magic...), formatVersion, compression, byte(encryption))
+	if encryption == EncryptionNone {
+		return header, nil, nil, nil
+	}
+
+	var key []byte
+	if encryption == EncryptionPassword {
+		salt, err := randomBytes(security.SaltSize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if key, err = security.DeriveKey(opts.Password, salt); err != nil {
+			return nil, nil, nil, err
+		}
+		header = append(header, salt...)
+	} else {
+		// A random key, wrapped by the master key and kept with the backup, so the backup
+		// can be restored when the database and its data keys are lost
+		var err error
+		if key, err = randomBytes(32); err != nil {
+			return nil, nil, nil, err
+		}
+		wrapped, err := security.EncryptEnvelope(key)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to wrap backup key: %w", err)
+		}
+		header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+		header = append(header, wrapped...)
+	}
+
+	prefix, err := randomBytes(noncePrefixSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return append(header, prefix...), aead, prefix, nil
+}
+
+// readHeader reads the header of an archive, returning the raw header and, when the
+// archive is encrypted, the cipher and nonce prefix of its chunks
+func readHeader(r io.Reader, password string) (Header, []byte, cipher.AEAD, []byte, error) {
+	header, raw, err := readFixedHeader(r)
+	if err != nil {
+		return header, nil, nil, nil, err
+	}
+
+	// read appends the next n bytes of the header to raw
+	read := func(n int) ([]byte, error) {
+		field := make([]byte, n)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return nil, ErrCorrupt
+		}
+		raw = append(raw, field...)
+		return field, nil
+	}
+
+	var key []byte
+	switch header.Encryption {
+	case EncryptionNone:
+		return header, raw, nil, nil, nil
+	case EncryptionPassword:
+		salt, err := read(security.SaltSize)
+		if err != nil {
+			return header, nil, nil, nil, err
+		}
+		if password == "" {
+			return header, nil, nil, nil, ErrPasswordRequired
+		}
+		if key, err = security.DeriveKey(password, salt); err != nil {
+			return header, nil, nil, nil, err
+		}
+	case EncryptionMasterKey:
+		length, err := read(2)
+		if err != nil {
+			return header, nil, nil, nil, err
+		}
+		wrapped, err := read(int(binary.BigEndian.Uint16(length)))
+		if err != nil {
+			return header, nil, nil, nil, err
+		}
+		if key, err = security.DecryptEnvelope(wrapped); err != nil {
+			return header, nil, nil, nil, fmt.Errorf("failed to unwrap backup key: %w", err)
+		}
+	default:
+		return header, nil, nil, nil, ErrUnsupportedFormat
+	}
+
+	prefix, err := read(noncePrefixSize)
+	if err != nil {
+		return header, nil, nil, nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return header, nil, nil, nil, err
+	}
+	return header, raw, aead, prefix, nil
+}
+
+// readFixedHeader reads the part of the header every archive starts with
+func readFixedHeader(r io.Reader) (Header, []byte, error) {
+	raw := make([]byte, len(magic)+3)
+	if _, err := io.ReadFull(r, raw); err != nil || !bytes.Equal(raw[:len(magic)], magic) {
+		return Header{}, nil, ErrNotArchive
+	}
+	compression := raw[len(magic)+1]
+	header := Header{Version: raw[len(magic)], Compressed: compression != compressionNone, Encryption: Encryption(raw[len(magic)+2])}
+	if header.Version > formatVersion {
+		return header, nil, ErrUnsupportedFormat
+	}
+	if compression != compressionNone && compression != compressionGzip {
+		return header, nil, ErrUnsupportedCompression
+	}
+	return header, raw, nil
+}
+
+// ReadHeader reads the header of a backup archive, which needs no key
+func ReadHeader(path string) (Header, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Header{}, fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer file.Close()
+
+	header, _, err := readFixedHeader(file)
+	return header, err
+}
+
+// IsArchive reports whether a file is a backup archive
+func IsArchive(path string) bool {
+	_, err := ReadHeader(path)
+	return err == nil
+}
+
+// archiveReader reads the files of an archive, decrypting and decompressing them
+type archiveReader struct {
+	*tar.Reader
+	file  *os.File
+	body  io.Reader
+	plain io.Reader
+	gz    *gzip.Reader
+}
+
+// openArchive opens an archive for reading. Password is needed for archives encrypted
+// with a password.
+func openArchive(path, password string) (*archiveReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+
+	header, raw, aead, prefix, err := readHeader(file, password)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r := &archiveReader{file: file, body: file}
+	if aead != nil {
+		r.body = newChunkReader(file, aead, prefix, raw)
+	}
+	r.plain = r.body
+	if header.Compressed {
+		if r.gz, err = gzip.NewReader(r.body); err != nil {
+			file.Close()
+			return nil, corrupt(err)
+		}
+		r.plain = r.gz
+	}
+	r.Reader = tar.NewReader(r.plain)
+	return r, nil
+}
+
+// next moves to the next file of the archive, which must be name
+func (r *archiveReader) next(name string) error {
+	entry, err := r.Next()
+	if err != nil || entry.Name != name {
+		return corrupt(err)
+	}
+	return nil
+}
+
+// readJSON reads the next file of the archive, which must be name, as JSON
+func (r *archiveReader) readJSON(name string, v any) error {
+	if err := r.next(name); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(io.LimitReader(r, maxManifestSize)).Decode(v); err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, corrupt(err))
+	}
+	return nil
+}
+
+// finish checks that the archive has no more files and reads it to the end, so the last
+// chunk and the gzip checksum are checked
+func (r *archiveReader) finish() error {
+	if _, err := r.Next(); err != io.EOF {
+		return corrupt(err)
+	}
+	if _, err := io.Copy(io.Discard, r.plain); err != nil {
+		return corrupt(err)
+	}
+	if _, err := io.Copy(io.Discard, r.body); err != nil {
+		return corrupt(err)
+	}
+	return nil
+}
+
+// Close closes the archive file
+func (r *archiveReader) Close() error {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	return r.file.Close()
+}
+
+// Extract writes the database in a backup archive to dst, checking it against the checksum
+// of the manifest, and returns the manifest. Password is needed for archives encrypted with
+// a password.
+func Extract(path, password string, dst io.Writer) (Manifest, error) {
+	var manifest Manifest
+	archive, err := openArchive(path, password)
+	if err != nil {
+		return manifest, err
+	}
+	defer archive.Close()
+
+	if err := archive.readJSON(manifestName, &manifest); err != nil {
+		return manifest, err
+	}
+	if err := archive.next(databaseName); err != nil {
+		return manifest, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hash), archive)
+	if err != nil {
+		return manifest, corrupt(err)
+	}
+	if err := archive.finish(); err != nil {
+		return manifest, err
+	}
+
+	if size != manifest.Size || hex.EncodeToString(hash.Sum(nil)) != manifest.SHA256 {
+		return manifest, ErrChecksumMismatch
+	}
+	return manifest, nil
+}
+
+// corrupt returns ErrCorrupt for errors reading an archive, keeping errors that are
+// already specific
+func corrupt(err error) error {
+	if errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	if err == nil {
+		return ErrCorrupt
+	}
+	return fmt.Errorf("%w: %v", ErrCorrupt, err)
+}
+
+// Verify extracts the database in a backup archive to a temporary file, checks it against
+// the checksum, schema version and row counts of the manifest, and runs an integrity check
+// on it
+func Verify(path, password string) (Manifest, error) {
+	temp, err := os.CreateTemp("", "termpos-verify-*.db")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+
+	manifest, err := Extract(path, password, temp)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return manifest, err
+	}
+
+	info, err := db.InspectDatabaseFile(temp.Name())
+	if err != nil {
+		return manifest, err
+	}
+	if info.SchemaVersion != manifest.SchemaVersion {
+		return manifest, fmt.Errorf("%w: schema version is %d, expected %d", ErrManifestMismatch, info.SchemaVersion, manifest.SchemaVersion)
+	}
+	tables := make([]string, 0, len(manifest.Tables))
+	for table := range manifest.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		if count, ok := info.Tables[table]; !ok || count != manifest.Tables[table] {
+			return manifest, fmt.Errorf("%w: %s has %d rows, expected %d", ErrManifestMismatch, table, count, manifest.Tables[table])
+		}
+	}
+	if len(info.Tables) != len(manifest.Tables) {
+		return manifest, fmt.Errorf("%w: %d tables, expected %d", ErrManifestMismatch, len(info.Tables), len(manifest.Tables))
+	}
+	return manifest, nil
+}
+
+// randomBytes returns n random bytes
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return b, nil
+}
+
+// newAEAD returns an AES-GCM cipher with a key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher block: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return aead, nil
+}
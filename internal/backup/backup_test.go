@@ -0,0 +1,271 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+	"termpos/internal/security"
+)
+
+// setupDatabase opens a database file with a customer, and configures a master key
+func setupDatabase(t *testing.T) {
+	t.Cleanup(func() { security.InitEncryption() })
+	t.Setenv("POS_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32)))
+	t.Setenv("POS_ENCRYPTION_KEY_FILE", "")
+	t.Setenv("POS_DB_KEY", "")
+	t.Setenv("POS_DB_PASSPHRASE", "")
+	if err := security.InitEncryption(); err != nil {
+		t.Fatalf("InitEncryption failed: %v", err)
+	}
+
+	if err := db.Initialize(filepath.Join(t.TempDir(), "pos.db")); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.AddCustomer(context.Background(), models.Customer{Name: "Jane Doe", Email: "jane@example.com"}); err != nil {
+		t.Fatalf("AddCustomer failed: %v", err)
+	}
+}
+
+func TestChunkStream(t *testing.T) {
+	aead, err := newAEAD(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("newAEAD failed: %v", err)
+	}
+	prefix, header := []byte("1234567"), []byte("header")
+
+	seal := func(plaintext []byte) []byte {
+		var sealed bytes.Buffer
+		w := newChunkWriter(&sealed, aead, prefix, header)
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		return sealed.Bytes()
+	}
+	open := func(sealed, header []byte) ([]byte, error) {
+		return io.ReadAll(newChunkReader(bytes.NewReader(sealed), aead, prefix, header))
+	}
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		got, err := open(seal(plaintext), header)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("Expected %d bytes to round trip, got %d (%v)", size, len(got), err)
+		}
+	}
+
+	// Changed, cut short or extended streams fail, as do changed headers
+	sealed := seal(make([]byte, 2*chunkSize+10))
+	chunk := chunkSize + aead.Overhead()
+	tampered := append([]byte{}, sealed...)
+	tampered[10] ^= 1
+	cases := map[string][]byte{
+		"tampered":  tampered,
+		"truncated": sealed[:2*chunk],
+		"empty":     nil,
+		"extended":  append(append([]byte{}, sealed...), sealed[:chunk]...),
+	}
+	for name, data := range cases {
+		if _, err := open(data, header); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Expected a %s stream to fail with ErrCorrupt, got %v", name, err)
+		}
+	}
+	if _, err := open(sealed, []byte("other")); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected a changed header to fail with ErrCorrupt, got %v", err)
+	}
+}
+
+func TestCreateAndVerify(t *testing.T) {
+	setupDatabase(t)
+	dir := t.TempDir()
+
+	for _, opts := range []Options{
+		{},
+		{Compress: true},
+		{Compress: true, Encrypt: true, Password: "hunter2"},
+		{Encrypt: true},
+	} {
+		path := filepath.Join(dir, "pos_backup"+Extension)
+		os.Remove(path)
+
+		created, err := Create(path, Manifest{AppVersion: "1.2.3", CreatedBy: "admin"}, opts)
+		if err != nil {
+			t.Fatalf("Create with %+v failed: %v", opts, err)
+		}
+		if created.SchemaVersion == 0 || created.Tables["customers"] != 1 || len(created.SHA256) != 64 {
+			t.Errorf("Expected the manifest to describe the database, got %+v", created)
+		}
+
+		header, err := ReadHeader(path)
+		if err != nil || header.Compressed != opts.Compress || (header.Encryption != EncryptionNone) != opts.Encrypt {
+			t.Errorf("Expected the header to match %+v, got %+v (%v)", opts, header, err)
+		}
+		if opts.Encrypt {
+			data, _ := os.ReadFile(path)
+			if bytes.Contains(data, []byte("Jane Doe")) || bytes.Contains(data, []byte(manifestName)) {
+				t.Errorf("Expected an encrypted backup not to contain plaintext")
+			}
+		}
+
+		manifest, err := Verify(path, opts.Password)
+		if err != nil {
+			t.Fatalf("Verify with %+v failed: %v", opts, err)
+		}
+		if manifest.SHA256 != created.SHA256 || manifest.AppVersion != "1.2.3" || manifest.CreatedBy != "admin" {
+			t.Errorf("Expected the manifest to be read back, got %+v", manifest)
+		}
+	}
+
+	// Password protected backups need the right password
+	path := filepath.Join(dir, "password"+Extension)
+	if _, err := Create(path, Manifest{}, Options{Encrypt: true, Password: "hunter2"}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := Verify(path, ""); !errors.Is(err, ErrPasswordRequired) {
+		t.Errorf("Expected ErrPasswordRequired, got %v", err)
+	}
+	if _, err := Verify(path, "wrong"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected a wrong password to fail with ErrCorrupt, got %v", err)
+	}
+
+	// A damaged backup fails verification
+	data, _ := os.ReadFile(path)
+	data[len(data)/2] ^= 1
+	damaged := filepath.Join(dir, "damaged"+Extension)
+	os.WriteFile(damaged, data, 0600)
+	if _, err := Verify(damaged, "hunter2"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected a damaged backup to fail with ErrCorrupt, got %v", err)
+	}
+
+	if IsArchive(filepath.Join(dir, "missing")) || !IsArchive(path) {
+		t.Error("Expected IsArchive to recognize backup archives only")
+	}
+
+	// zstd is reserved in the header but not supported yet
+	zstd := filepath.Join(dir, "zstd"+Extension)
+	if err := os.WriteFile(zstd, append(append([]byte{}, magic...), formatVersion, compressionZstd, byte(EncryptionNone)), 0600); err != nil {
+		t.Fatalf("Failed to write backup: %v", err)
+	}
+	if _, err := ReadHeader(zstd); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("Expected ErrUnsupportedCompression, got %v", err)
+	}
+}
+
+func TestVerifyDetectsManifestMismatch(t *testing.T) {
+	setupDatabase(t)
+	dir := t.TempDir()
+
+	// A backup whose manifest disagrees with its database, such as one written by a
+	// faulty version, fails verification although its checksum matches
+	snapshot := filepath.Join(dir, "snapshot.db")
+	if err := db.SnapshotDatabase(snapshot); err != nil {
+		t.Fatalf("SnapshotDatabase failed: %v", err)
+	}
+	size, sum, err := hashFile(snapshot)
+	if err != nil {
+		t.Fatalf("hashFile failed: %v", err)
+	}
+	manifest := Manifest{FormatVersion: formatVersion, SchemaVersion: 1, Size: size, SHA256: sum, Tables: map[string]int64{"customers": 5}}
+
+	path := filepath.Join(dir, "mismatch"+Extension)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	if err := write(file, snapshot, manifest, Options{Compress: true}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	file.Close()
+
+	if _, err := Verify(path, ""); !errors.Is(err, ErrManifestMismatch) {
+		t.Errorf("Expected ErrManifestMismatch, got %v", err)
+	}
+}
+
+func TestArchiveChangesAndRestoreTo(t *testing.T) {
+	setupDatabase(t)
+	dir := t.TempDir()
+	opts := Options{Compress: true, Encrypt: true}
+
+	base, err := ArchiveChanges(dir, Segment{CreatedBy: "admin"}, opts, false)
+	if err != nil {
+		t.Fatalf("ArchiveChanges failed: %v", err)
+	}
+	if base.Sequence != 0 || base.Parent != "" || base.Pages != base.PageCount {
+		t.Errorf("Expected a base segment with every page, got %+v", base)
+	}
+	if _, err := ArchiveChanges(dir, Segment{}, opts, false); !errors.Is(err, ErrNoChanges) {
+		t.Errorf("Expected ErrNoChanges, got %v", err)
+	}
+
+	if _, err := db.AddCustomer(context.Background(), models.Customer{Name: "John Roe", Email: "john@example.com"}); err != nil {
+		t.Fatalf("AddCustomer failed: %v", err)
+	}
+	first, err := ArchiveChanges(dir, Segment{}, opts, false)
+	if err != nil {
+		t.Fatalf("ArchiveChanges failed: %v", err)
+	}
+	if first.Sequence != 1 || first.Parent != base.SHA256 || first.Pages >= first.PageCount || first.Chain != base.Chain {
+		t.Errorf("Expected a segment with the changed pages, got %+v", first)
+	}
+
+	// A missing page index is rebuilt from the chain
+	chain := filepath.Join(dir, base.Chain)
+	os.Remove(filepath.Join(chain, indexFile))
+	if _, err := db.AddCustomer(context.Background(), models.Customer{Name: "Max Moe", Email: "max@example.com"}); err != nil {
+		t.Fatalf("AddCustomer failed: %v", err)
+	}
+	second, err := ArchiveChanges(dir, Segment{}, opts, false)
+	if err != nil {
+		t.Fatalf("ArchiveChanges failed: %v", err)
+	}
+	if second.Sequence != 2 || second.Parent != first.SHA256 {
+		t.Errorf("Expected the segment to follow the chain, got %+v", second)
+	}
+
+	// Restoring to a time replays the segments created by then
+	restore := func(until time.Time) (int64, error) {
+		path := filepath.Join(t.TempDir(), "restored.db")
+		if _, err := RestoreTo(dir, until, path, ""); err != nil {
+			return 0, err
+		}
+		info, err := db.InspectDatabaseFile(path)
+		return info.Tables["customers"], err
+	}
+	for until, want := range map[time.Time]int64{first.CreatedAt: 2, time.Now(): 3, base.CreatedAt: 1} {
+		if count, err := restore(until); err != nil || count != want {
+			t.Errorf("Expected %d customers at %s, got %d (%v)", want, until, count, err)
+		}
+	}
+	if _, err := restore(base.CreatedAt.Add(-time.Hour)); !errors.Is(err, ErrNoRecoveryPoint) {
+		t.Errorf("Expected ErrNoRecoveryPoint, got %v", err)
+	}
+
+	// A damaged or missing segment breaks the chain
+	path := segmentPath(chain, 1)
+	data, _ := os.ReadFile(path)
+	damaged := append([]byte{}, data...)
+	damaged[len(damaged)/2] ^= 1
+	os.WriteFile(path, damaged, 0600)
+	if _, err := restore(time.Now()); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected a damaged segment to fail with ErrCorrupt, got %v", err)
+	}
+	os.Remove(path)
+	if _, err := restore(time.Now()); !errors.Is(err, ErrBrokenChain) {
+		t.Errorf("Expected a missing segment to fail with ErrBrokenChain, got %v", err)
+	}
+}
@@ -0,0 +1,453 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"termpos/internal/db"
+)
+
+// Archived changes are kept in chains, each in its own directory named after the time it
+// was started. The first segment of a chain holds every page of the database, and each
+// following segment the pages that changed since the one before it, like the frames of a
+// WAL checkpoint. A segment records the checksum of the database it applies to and of the
+// database it results in, so a chain is verified as it is replayed.
+
+// SegmentExtension is the file extension of archived changes
+const SegmentExtension = ".segment"
+
+// chainLayout is the time layout of chain directory names
+const chainLayout = "20060102T150405Z"
+
+// Names of the segment and index entries
+const (
+	segmentName = "segment.json"
+	pagesName   = "pages"
+	indexName   = "index.json"
+	indexFile   = "pages.index"
+)
+
+var (
+	ErrNoChanges       = errors.New("database has not changed since the last archive")
+	ErrNoRecoveryPoint = errors.New("no archived changes reach back to that time")
+	ErrBrokenChain     = errors.New("archived changes do not form an unbroken checksum chain")
+)
+
+// Segment describes archived changes to the database
+type Segment struct {
+	FormatVersion int       `json:"format_version"`
+	Chain         string    `json:"chain"`
+	Sequence      int       `json:"sequence"`
+	AppVersion    string    `json:"app_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	CreatedBy     string    `json:"created_by"`
+	PageSize      int       `json:"page_size"`
+	// PageCount is the number of pages in the database after the segment is applied
+	PageCount int `json:"page_count"`
+	// Pages is the number of pages in the segment
+	Pages int `json:"pages"`
+	// Parent is the SHA-256 checksum of the database the segment applies to, empty for
+	// the first segment of a chain
+	Parent string `json:"parent"`
+	// SHA256 is the checksum of the database after the segment is applied
+	SHA256 string `json:"sha256"`
+}
+
+// pageIndex holds the checksum of every page of the database as of the last segment of a
+// chain, so the next segment is found without replaying the chain
+type pageIndex struct {
+	Sequence int      `json:"sequence"`
+	SHA256   string   `json:"sha256"`
+	PageSize int      `json:"page_size"`
+	Pages    [][]byte `json:"pages"`
+}
+
+// ArchiveChanges archives the pages of the open database that changed since the last
+// segment in dir, starting a new chain when there is none or newChain is set. The app
+// version and creation user of the segment are taken from segment. It returns ErrNoChanges
+// when nothing changed.
+func ArchiveChanges(dir string, segment Segment, opts Options, newChain bool) (Segment, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return segment, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	snapshot, err := os.CreateTemp(dir, ".copy-*.db")
+	if err != nil {
+		return segment, fmt.Errorf("failed to create database copy: %w", err)
+	}
+	snapshot.Close()
+	defer os.Remove(snapshot.Name())
+
+	segment.CreatedAt = time.Now().UTC()
+	pageSize, err := db.CopyDatabase(snapshot.Name())
+	if err != nil {
+		return segment, err
+	}
+	pages, sum, err := hashPages(snapshot.Name(), pageSize)
+	if err != nil {
+		return segment, err
+	}
+
+	chain, index, err := latestChain(dir, opts.Password)
+	if err != nil {
+		return segment, err
+	}
+	if chain == "" || newChain || index.PageSize != pageSize {
+		chain = filepath.Join(dir, segment.CreatedAt.Format(chainLayout))
+		if err := os.Mkdir(chain, 0700); err != nil {
+			return segment, fmt.Errorf("failed to start chain: %w", err)
+		}
+		index = pageIndex{Sequence: -1}
+	}
+
+	var changed []int
+	for i, page := range pages {
+		if i >= len(index.Pages) || !bytes.Equal(page, index.Pages[i]) {
+			changed = append(changed, i+1)
+		}
+	}
+	if len(changed) == 0 && len(pages) == len(index.Pages) {
+		return segment, ErrNoChanges
+	}
+
+	segment.FormatVersion = formatVersion
+	segment.Chain = filepath.Base(chain)
+	segment.Sequence = index.Sequence + 1
+	segment.PageSize = pageSize
+	segment.PageCount = len(pages)
+	segment.Pages = len(changed)
+	segment.Parent = index.SHA256
+	segment.SHA256 = sum
+
+	err = createFile(segmentPath(chain, segment.Sequence), func(w io.Writer) error {
+		return writeSegment(w, snapshot.Name(), segment, changed, opts)
+	})
+	if err != nil {
+		return segment, err
+	}
+
+	// The index is only a cache of the chain, rebuilt when it is behind
+	index = pageIndex{Sequence: segment.Sequence, SHA256: sum, PageSize: pageSize, Pages: pages}
+	if err := writeIndex(chain, index, opts); err != nil {
+		return segment, err
+	}
+	return segment, nil
+}
+
+// segmentPath returns the path of a segment of a chain
+func segmentPath(chain string, sequence int) string {
+	return filepath.Join(chain, fmt.Sprintf("%06d%s", sequence, SegmentExtension))
+}
+
+// hashPages returns the checksum of each page of a database file, and of the whole file
+func hashPages(path string, pageSize int) ([][]byte, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var pages [][]byte
+	hash := sha256.New()
+	page := make([]byte, pageSize)
+	for {
+		if _, err := io.ReadFull(file, page); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		sum := sha256.Sum256(page)
+		pages = append(pages, sum[:])
+		hash.Write(page)
+	}
+	return pages, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeSegment writes a segment with the changed pages of a database file. Each page is
+// written as its number followed by its contents.
+func writeSegment(w io.Writer, databasePath string, segment Segment, changed []int, opts Options) error {
+	segmentJSON, err := json.MarshalIndent(segment, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode segment: %w", err)
+	}
+	database, err := os.Open(databasePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", databasePath, err)
+	}
+	defer database.Close()
+
+	pages := make([]io.Reader, 0, 2*len(changed))
+	for _, page := range changed {
+		number := binary.BigEndian.AppendUint32(nil, uint32(page))
+		offset := int64(page-1) * int64(segment.PageSize)
+		pages = append(pages, bytes.NewReader(number), io.NewSectionReader(database, offset, int64(segment.PageSize)))
+	}
+
+	return writeEntries(w, opts, segment.CreatedAt, []entry{
+		{segmentName, int64(len(segmentJSON)), bytes.NewReader(segmentJSON)},
+		{pagesName, int64(len(changed)) * int64(4+segment.PageSize), io.MultiReader(pages...)},
+	})
+}
+
+// writeIndex writes the page index of a chain
+func writeIndex(chain string, index pageIndex, opts Options) error {
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to encode page index: %w", err)
+	}
+	opts.Compress = true
+	return createFile(filepath.Join(chain, indexFile), func(w io.Writer) error {
+		return writeEntries(w, opts, time.Now().UTC(), []entry{
+			{indexName, int64(len(indexJSON)), bytes.NewReader(indexJSON)},
+		})
+	})
+}
+
+// readIndex reads the page index of a chain
+func readIndex(chain, password string) (pageIndex, error) {
+	index := pageIndex{Sequence: -1}
+	archive, err := openArchive(filepath.Join(chain, indexFile), password)
+	if err != nil {
+		return index, err
+	}
+	defer archive.Close()
+
+	if err := archive.next(indexName); err != nil {
+		return index, err
+	}
+	if err := json.NewDecoder(archive).Decode(&index); err != nil {
+		return index, fmt.Errorf("failed to read page index: %w", corrupt(err))
+	}
+	return index, archive.finish()
+}
+
+// listChains returns the chain directories in dir, oldest first
+func listChains(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list archive directory: %w", err)
+	}
+	var chains []string
+	for _, entry := range entries {
+		if _, err := time.Parse(chainLayout, entry.Name()); err == nil && entry.IsDir() {
+			chains = append(chains, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(chains)
+	return chains, nil
+}
+
+// listSegments returns the segments of a chain in order
+func listSegments(chain string) ([]string, error) {
+	segments, err := filepath.Glob(filepath.Join(chain, "*"+SegmentExtension))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list segments: %w", err)
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// latestChain returns the latest chain in dir with its page index, rebuilding the index
+// by replaying the chain when it is missing or behind. It returns an empty chain when
+// there is none.
+func latestChain(dir, password string) (string, pageIndex, error) {
+	chains, err := listChains(dir)
+	if err != nil || len(chains) == 0 {
+		return "", pageIndex{}, err
+	}
+	chain := chains[len(chains)-1]
+	segments, err := listSegments(chain)
+	if err != nil {
+		return "", pageIndex{}, err
+	}
+	if len(segments) == 0 {
+		return "", pageIndex{}, nil
+	}
+
+	index, err := readIndex(chain, password)
+	if err == nil && index.Sequence == len(segments)-1 {
+		return chain, index, nil
+	}
+
+	replayed, err := os.CreateTemp(dir, ".replay-*.db")
+	if err != nil {
+		return "", pageIndex{}, fmt.Errorf("failed to rebuild page index: %w", err)
+	}
+	defer os.Remove(replayed.Name())
+	last, err := replay(chain, time.Time{}, replayed, password)
+	if closeErr := replayed.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", pageIndex{}, err
+	}
+	pages, sum, err := hashPages(replayed.Name(), last.PageSize)
+	if err != nil {
+		return "", pageIndex{}, err
+	}
+	return chain, pageIndex{Sequence: last.Sequence, SHA256: sum, PageSize: last.PageSize, Pages: pages}, nil
+}
+
+// replay applies the segments of a chain created up to a time, or all of them when until
+// is zero, to an empty file, and returns the last segment applied. Each segment must apply
+// to the database the one before it resulted in, and result in the database it records.
+func replay(chain string, until time.Time, out *os.File, password string) (Segment, error) {
+	segments, err := listSegments(chain)
+	if err != nil {
+		return Segment{}, err
+	}
+
+	last := Segment{Sequence: -1}
+	for i, path := range segments {
+		if path != segmentPath(chain, i) {
+			return last, fmt.Errorf("%w: segment %d of %s is missing", ErrBrokenChain, i, filepath.Base(chain))
+		}
+		segment, applied, err := applySegment(path, until, last.SHA256, out, password)
+		if err != nil {
+			return last, fmt.Errorf("segment %d of %s: %w", i, filepath.Base(chain), err)
+		}
+		if !applied {
+			break
+		}
+		last = segment
+	}
+	if last.Sequence < 0 {
+		return last, ErrNoRecoveryPoint
+	}
+	return last, nil
+}
+
+// applySegment writes the pages of a segment to a database file when it was created up to
+// a time, checking it against the checksum chain
+func applySegment(path string, until time.Time, parent string, out *os.File, password string) (Segment, bool, error) {
+	var segment Segment
+	archive, err := openArchive(path, password)
+	if err != nil {
+		return segment, false, err
+	}
+	defer archive.Close()
+
+	if err := archive.readJSON(segmentName, &segment); err != nil {
+		return segment, false, err
+	}
+	if segment.FormatVersion > formatVersion {
+		return segment, false, ErrUnsupportedFormat
+	}
+	if !until.IsZero() && segment.CreatedAt.After(until) {
+		return segment, false, nil
+	}
+	if segment.Parent != parent || segment.PageSize <= 0 {
+		return segment, false, fmt.Errorf("%w: it does not apply to the database before it", ErrBrokenChain)
+	}
+
+	if err := archive.next(pagesName); err != nil {
+		return segment, false, err
+	}
+	page := make([]byte, 4+segment.PageSize)
+	for i := 0; i < segment.Pages; i++ {
+		if _, err := io.ReadFull(archive, page); err != nil {
+			return segment, false, corrupt(err)
+		}
+		number := binary.BigEndian.Uint32(page)
+		if number == 0 || int(number) > segment.PageCount {
+			return segment, false, ErrCorrupt
+		}
+		if _, err := out.WriteAt(page[4:], int64(number-1)*int64(segment.PageSize)); err != nil {
+			return segment, false, fmt.Errorf("failed to write database: %w", err)
+		}
+	}
+	if err := archive.finish(); err != nil {
+		return segment, false, err
+	}
+	if err := out.Truncate(int64(segment.PageCount) * int64(segment.PageSize)); err != nil {
+		return segment, false, fmt.Errorf("failed to write database: %w", err)
+	}
+
+	if _, sum, err := hashFile(out.Name()); err != nil {
+		return segment, false, err
+	} else if sum != segment.SHA256 {
+		return segment, false, fmt.Errorf("%w: the database does not match its checksum", ErrBrokenChain)
+	}
+	return segment, true, nil
+}
+
+// RestoreTo rebuilds the database as it was at a time into a new file, from the latest
+// chain in dir started by then, and returns the last segment applied. The rebuilt database
+// is checked against the checksum chain and with an integrity check.
+func RestoreTo(dir string, until time.Time, path, password string) (Segment, error) {
+	if _, err := os.Stat(path); err == nil {
+		return Segment{}, fmt.Errorf("%s already exists", path)
+	}
+	chains, err := listChains(dir)
+	if err != nil {
+		return Segment{}, err
+	}
+
+	temp := path + ".tmp"
+	for i := len(chains) - 1; i >= 0; i-- {
+		started, _ := time.Parse(chainLayout, filepath.Base(chains[i]))
+		if started.After(until) {
+			continue
+		}
+
+		out, err := os.OpenFile(temp, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+		if err != nil {
+			return Segment{}, fmt.Errorf("failed to create %s: %w", path, err)
+		}
+		last, err := replay(chains[i], until, out, password)
+		if err == nil {
+			err = out.Sync()
+		}
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if errors.Is(err, ErrNoRecoveryPoint) {
+			// The chain was started a moment after the time
+			os.Remove(temp)
+			continue
+		}
+		if err == nil {
+			err = os.Rename(temp, path)
+		}
+		if err != nil {
+			os.Remove(temp)
+			return last, err
+		}
+
+		if _, err := db.InspectDatabaseFile(path); err != nil {
+			os.Remove(path)
+			return last, err
+		}
+		return last, nil
+	}
+	return Segment{}, ErrNoRecoveryPoint
+}
+
+// PruneChains removes all but the latest keep chains in dir, and returns how many it
+// removed. Nothing is removed when keep is not positive.
+func PruneChains(dir string, keep int) (int, error) {
+	if keep <= 0 {
+		return 0, nil
+	}
+	chains, err := listChains(dir)
+	if err != nil || len(chains) <= keep {
+		return 0, err
+	}
+	removed := 0
+	for _, chain := range chains[:len(chains)-keep] {
+		if err := os.RemoveAll(chain); err != nil {
+			return removed, fmt.Errorf("failed to remove chain: %w", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
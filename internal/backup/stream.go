@@ -0,0 +1,135 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// chunkSize is the number of plaintext bytes encrypted together
+const chunkSize = 64 * 1024
+
+// noncePrefixSize is the size of the random part of the chunk nonces. The rest of each
+// nonce is the chunk number and whether it is the last chunk, so chunks cannot be
+// reordered, dropped or appended.
+const noncePrefixSize = 7
+
+var ErrCorrupt = errors.New("backup is corrupt, or the password or key is wrong")
+
+// chunkNonce returns the nonce of a chunk
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// chunkWriter encrypts a stream in chunks with AES-GCM, so it never has to be held in
+// memory. The header of the archive is authenticated with every chunk.
+type chunkWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	header  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newChunkWriter(w io.Writer, aead cipher.AEAD, prefix, header []byte) *chunkWriter {
+	return &chunkWriter{w: w, aead: aead, prefix: prefix, header: header, buf: make([]byte, 0, chunkSize)}
+}
+
+// Write buffers data, encrypting every full chunk once more data follows it
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(c.buf) == chunkSize {
+			if err := c.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(c.buf[len(c.buf):chunkSize], p)
+		c.buf = c.buf[:len(c.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close encrypts the last chunk, which may be empty
+func (c *chunkWriter) Close() error {
+	return c.flush(true)
+}
+
+func (c *chunkWriter) flush(last bool) error {
+	sealed := c.aead.Seal(nil, chunkNonce(c.prefix, c.counter, last), c.buf, c.header)
+	if _, err := c.w.Write(sealed); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	c.counter++
+	c.buf = c.buf[:0]
+	return nil
+}
+
+// chunkReader decrypts a stream written by chunkWriter, failing when it was changed or
+// cut short
+type chunkReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	header  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func newChunkReader(r io.Reader, aead cipher.AEAD, prefix, header []byte) *chunkReader {
+	return &chunkReader{r: bufio.NewReaderSize(r, chunkSize+aead.Overhead()+1), aead: aead, prefix: prefix, header: header}
+}
+
+// Read returns decrypted data, one chunk at a time
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk. A chunk is the last one when nothing follows it.
+func (c *chunkReader) next() error {
+	sealed := make([]byte, chunkSize+c.aead.Overhead())
+	n, err := io.ReadFull(c.r, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return ErrCorrupt
+		}
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := c.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+
+	plaintext, err := c.aead.Open(sealed[:0], chunkNonce(c.prefix, c.counter, last), sealed[:n], c.header)
+	if err != nil {
+		return ErrCorrupt
+	}
+	c.counter++
+	c.buf, c.done = plaintext, last
+	return nil
+}
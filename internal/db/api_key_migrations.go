@@ -0,0 +1,23 @@
+package db
+
+// createAPIKeysTable creates the table of API keys used by machine clients of the agent API
+func createAPIKeysTable() error {
+	query := `
+	CREATE TABLE api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP,
+		last_used_at TIMESTAMP,
+		last_used_ip TEXT,
+		revoked_at TIMESTAMP
+	);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
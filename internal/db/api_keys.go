@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"termpos/internal/models"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrAPIKeyInvalid  = errors.New("API key is invalid, expired or revoked")
+	ErrAPIKeyExists   = errors.New("an API key with this name already exists")
+)
+
+// apiKeyColumns are the columns read by scanAPIKey
+const apiKeyColumns = `id, name, prefix, scopes, created_by, created_at, expires_at, last_used_at, last_used_ip, revoked_at`
+
+// CreateAPIKey stores a new API key. Only the hash of the key is stored, so the key
+// itself can only be shown when it is created.
+func CreateAPIKey(key models.APIKey, keyHash string) (models.APIKey, error) {
+	if len(key.Scopes) == 0 {
+		return models.APIKey{}, models.ErrNoAPIKeyScopes
+	}
+
+	key.CreatedAt = time.Now()
+	var expiresAt interface{}
+	if !key.ExpiresAt.IsZero() {
+		expiresAt = key.ExpiresAt
+	}
+
+	result, err := DB.Exec(
+		`INSERT INTO api_keys (name, prefix, key_hash, scopes, created_by, created_at, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		key.Name, key.Prefix, keyHash, strings.Join(key.Scopes, ","), key.CreatedBy, key.CreatedAt, expiresAt,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: api_keys.name") {
+			return models.APIKey{}, ErrAPIKeyExists
+		}
+		return models.APIKey{}, fmt.Errorf("failed to create API key: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return models.APIKey{}, fmt.Errorf("failed to get API key ID: %w", err)
+	}
+	key.ID = int(id)
+
+	return key, nil
+}
+
+// GetAPIKey retrieves an API key by ID
+func GetAPIKey(id int) (models.APIKey, error) {
+	key, err := scanAPIKey(DB.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return models.APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return models.APIKey{}, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns all API keys, including revoked and expired ones
+func ListAPIKeys() ([]models.APIKey, error) {
+	rows, err := DB.Query("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY name ASC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []models.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// UseAPIKey looks up a key by its hash and records that it was used from ipAddress. It
+// returns ErrAPIKeyInvalid for an unknown, expired or revoked key.
+func UseAPIKey(keyHash, ipAddress string) (models.APIKey, error) {
+	key, err := scanAPIKey(DB.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", keyHash))
+	if err == sql.ErrNoRows {
+		return models.APIKey{}, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return models.APIKey{}, fmt.Errorf("failed to look up API key: %w", err)
+	}
+
+	now := time.Now()
+	if !key.Valid(now) {
+		return models.APIKey{}, ErrAPIKeyInvalid
+	}
+
+	_, err = DB.Exec("UPDATE api_keys SET last_used_at = ?, last_used_ip = ? WHERE id = ?", now, ipAddress, key.ID)
+	if err != nil {
+		return models.APIKey{}, fmt.Errorf("failed to record API key use: %w", err)
+	}
+	key.LastUsedAt, key.LastUsedIP = now, ipAddress
+
+	return key, nil
+}
+
+// RevokeAPIKey revokes an API key so it can no longer be used
+func RevokeAPIKey(id int) error {
+	result, err := DB.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if count == 0 {
+		if _, err := GetAPIKey(id); err != nil {
+			return err
+		}
+		return fmt.Errorf("API key %d is already revoked", id)
+	}
+
+	return nil
+}
+
+// scanAPIKey scans an API key from a row
+func scanAPIKey(scanner interface{ Scan(...interface{}) error }) (models.APIKey, error) {
+	var key models.APIKey
+	var scopes string
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	var lastUsedIP sql.NullString
+
+	err := scanner.Scan(
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		&scopes,
+		&key.CreatedBy,
+		&key.CreatedAt,
+		&expiresAt,
+		&lastUsedAt,
+		&lastUsedIP,
+		&revokedAt,
+	)
+	if err != nil {
+		return models.APIKey{}, err
+	}
+
+	key.Scopes = strings.Split(scopes, ",")
+	if expiresAt.Valid {
+		key.ExpiresAt = expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = revokedAt.Time
+	}
+	key.LastUsedIP = lastUsedIP.String
+
+	return key, nil
+}
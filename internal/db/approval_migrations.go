@@ -0,0 +1,50 @@
+package db
+
+import "strings"
+
+// alterSalesTableForApprovals adds supervisor approval and refund columns to the sales table
+func alterSalesTableForApprovals() error {
+	queries := []string{
+		"ALTER TABLE sales ADD COLUMN approved_by TEXT;",
+		"ALTER TABLE sales ADD COLUMN refunded_at TIMESTAMP;",
+		"ALTER TABLE sales ADD COLUMN refunded_by TEXT;",
+		"ALTER TABLE sales ADD COLUMN refund_reason TEXT;",
+		"ALTER TABLE audit_logs ADD COLUMN approved_by TEXT;",
+	}
+
+	for _, query := range queries {
+		// Execute the query and ignore "duplicate column" errors
+		_, err := DB.Exec(query)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "duplicate column name:") {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createApprovalsTable creates the approvals table for single-use supervisor approvals
+func createApprovalsTable() error {
+	query := `
+	CREATE TABLE approvals (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		action TEXT NOT NULL,
+		resource TEXT NOT NULL,
+		requested_by TEXT NOT NULL,
+		approved_by TEXT NOT NULL,
+		reason TEXT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP
+	);
+
+	CREATE INDEX idx_approvals_requested_by ON approvals(requested_by);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"termpos/internal/models"
+)
+
+// ErrApprovalInvalid is returned when an approval token is unknown, expired, already used
+// or was issued for a different action or user
+var ErrApprovalInvalid = errors.New("approval token is invalid, expired or already used")
+
+// CreateApproval stores an approval given by the actor of the context. Only the hash of
+// the token is stored.
+func CreateApproval(ctx context.Context, tokenHash string, approval models.Approval) (models.Approval, error) {
+	approval.ApprovedBy = ActorFromContext(ctx).Username
+	approval.CreatedAt = time.Now()
+	err := Transaction(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`INSERT INTO approvals (token_hash, action, resource, requested_by, approved_by, reason, created_at, expires_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			tokenHash, approval.Action, approval.Resource, approval.RequestedBy, approval.ApprovedBy,
+			approval.Reason, approval.CreatedAt, approval.ExpiresAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create approval: %w", err)
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get approval ID: %w", err)
+		}
+		approval.ID = int(id)
+
+		description := fmt.Sprintf("%s approved %s for %s", approval.ApprovedBy, approval.Action, approval.RequestedBy)
+		return AuditApprovedTx(ctx, tx, approval.ApprovedBy, ActionApproval, "approvals", approval.ID, description, nil, approval)
+	})
+	if err != nil {
+		return models.Approval{}, err
+	}
+
+	return approval, nil
+}
+
+// ConsumeApprovalTx marks an approval as used by the actor of the context, within the
+// transaction of the action it approves so it is only used up if that action commits. The
+// token must have been issued to the actor for exactly this action and resource, and not
+// be expired or used.
+func ConsumeApprovalTx(ctx context.Context, tx *sql.Tx, tokenHash, action, resource string) (models.Approval, error) {
+	old, err := getApprovalByTokenHash(tx, tokenHash)
+	if err != nil {
+		return models.Approval{}, err
+	}
+
+	now := time.Now()
+	result, err := tx.Exec(
+		`UPDATE approvals SET used_at = ?
+		 WHERE id = ? AND action = ? AND resource = ? AND requested_by = ?
+		   AND used_at IS NULL AND expires_at > ?`,
+		now, old.ID, action, resource, ActorFromContext(ctx).Username, now,
+	)
+	if err != nil {
+		return models.Approval{}, fmt.Errorf("failed to use approval: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return models.Approval{}, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if count == 0 {
+		return models.Approval{}, ErrApprovalInvalid
+	}
+
+	approval := old
+	approval.UsedAt = now
+	description := fmt.Sprintf("%s used approval from %s for %s", approval.RequestedBy, approval.ApprovedBy, approval.Action)
+	if err := AuditApprovedTx(ctx, tx, approval.ApprovedBy, ActionApproval, "approvals", approval.ID, description, old, approval); err != nil {
+		return models.Approval{}, err
+	}
+
+	return approval, nil
+}
+
+// getApprovalByTokenHash retrieves an approval by the hash of its token within a transaction
+func getApprovalByTokenHash(tx *sql.Tx, tokenHash string) (models.Approval, error) {
+	var approval models.Approval
+	var reason sql.NullString
+	var usedAt sql.NullTime
+
+	err := tx.QueryRow(
+		`SELECT id, action, resource, requested_by, approved_by, reason, created_at, expires_at, used_at
+		 FROM approvals WHERE token_hash = ?`,
+		tokenHash,
+	).Scan(
+		&approval.ID,
+		&approval.Action,
+		&approval.Resource,
+		&approval.RequestedBy,
+		&approval.ApprovedBy,
+		&reason,
+		&approval.CreatedAt,
+		&approval.ExpiresAt,
+		&usedAt,
+	)
+	if err == sql.ErrNoRows {
+		return models.Approval{}, ErrApprovalInvalid
+	}
+	if err != nil {
+		return models.Approval{}, fmt.Errorf("failed to get approval: %w", err)
+	}
+
+	approval.Reason = reason.String
+	if usedAt.Valid {
+		approval.UsedAt = usedAt.Time
+	}
+
+	return approval, nil
+}
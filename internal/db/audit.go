@@ -1,11 +1,20 @@
 package db
 
 import (
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// ErrAuditLogNotFound is returned when an audit log entry does not exist
+var ErrAuditLogNotFound = errors.New("audit log entry not found")
+
 // AuditAction represents the type of action performed in an audit log
 type AuditAction string
 
@@ -28,8 +37,20 @@ const (
 	ActionSale       AuditAction = "sale"
 	ActionRefund     AuditAction = "refund"
 	ActionInventory  AuditAction = "inventory"
+	ActionApproval   AuditAction = "approval"
+	ActionKeyRotate  AuditAction = "key_rotate"
+	ActionEncrypt    AuditAction = "encrypt"
+	ActionDecrypt    AuditAction = "decrypt"
 )
 
+// AuditActions are the actions recorded in the audit log
+var AuditActions = []AuditAction{
+	ActionCreate, ActionUpdate, ActionDelete, ActionLogin, ActionLogout, ActionExport,
+	ActionImport, ActionBackup, ActionRestore, ActionSettingsMod, ActionPermissionMod,
+	ActionUserMod, ActionAccess, ActionExecute, ActionSale, ActionRefund, ActionInventory,
+	ActionApproval, ActionKeyRotate, ActionEncrypt, ActionDecrypt,
+}
+
 // AuditLog represents an entry in the audit log
 type AuditLog struct {
 	ID            int64       `json:"id"`
@@ -43,37 +64,50 @@ type AuditLog struct {
 	NewValue      string      `json:"new_value,omitempty"`
 	IPAddress     string      `json:"ip_address,omitempty"`
 	AdditionalInfo string     `json:"additional_info,omitempty"`
+	ApprovedBy    string      `json:"approved_by,omitempty"`
+	Source        AuditSource `json:"source,omitempty"`
+	PrevHash      string      `json:"prev_hash"`
+	Hash          string      `json:"hash"`
 }
 
 // AddAuditLog adds a new audit log entry
 func AddAuditLog(username string, action AuditAction, resourceType, resourceID, description, previousValue, newValue, ipAddress, additionalInfo string) error {
-	// Get database connection
-	db, err := GetDB()
-	if err != nil {
+	return addChainedAuditLog(AuditLog{
+		Username:       username,
+		Action:         action,
+		ResourceType:   resourceType,
+		ResourceID:     resourceID,
+		Description:    description,
+		PreviousValue:  previousValue,
+		NewValue:       newValue,
+		IPAddress:      ipAddress,
+		AdditionalInfo: additionalInfo,
+	})
+}
+
+// AddApprovedAuditLog adds an audit log entry for an action a supervisor approved on behalf of username
+func AddApprovedAuditLog(username, approvedBy string, action AuditAction, resourceType, resourceID, description, ipAddress, additionalInfo string) error {
+	return addChainedAuditLog(AuditLog{
+		Username:       username,
+		Action:         action,
+		ResourceType:   resourceType,
+		ResourceID:     resourceID,
+		Description:    description,
+		IPAddress:      ipAddress,
+		AdditionalInfo: additionalInfo,
+		ApprovedBy:     approvedBy,
+	})
+}
+
+// addChainedAuditLog inserts an audit log entry and links it to the end of the hash chain
+func addChainedAuditLog(log AuditLog) error {
+	if _, err := GetDB(); err != nil {
 		return fmt.Errorf("failed to get database connection: %w", err)
 	}
 
-	// Insert audit log
-	query := `
-		INSERT INTO audit_logs (
-			username, action, resource_type, resource_id, description, 
-			previous_value, new_value, ip_address, additional_info
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
-
-	_, err = db.Exec(
-		query,
-		username,
-		string(action),
-		resourceType,
-		resourceID,
-		description,
-		previousValue,
-		newValue,
-		ipAddress,
-		additionalInfo,
-	)
-
+	err := Transaction(func(tx *sql.Tx) error {
+		return insertAuditLogTx(tx, log)
+	})
 	if err != nil {
 		return fmt.Errorf("failed to add audit log: %w", err)
 	}
@@ -81,16 +115,52 @@ func AddAuditLog(username string, action AuditAction, resourceType, resourceID,
 	return nil
 }
 
-// GetAuditLogs retrieves audit logs with optional filtering
-func GetAuditLogs(username string, action AuditAction, resourceType, startDate, endDate string, limit, offset int) ([]AuditLog, error) {
-	// Get database connection
-	db, err := GetDB()
+// insertAuditLogTx inserts an audit log entry in a transaction and links it to the end of
+// the hash chain
+func insertAuditLogTx(tx *sql.Tx, log AuditLog) error {
+	log.Timestamp = time.Now().UTC().Truncate(time.Second)
+
+	// The insert takes the write lock, so the entry before it cannot change until commit
+	result, err := tx.Exec(`
+		INSERT INTO audit_logs (
+			timestamp, username, action, resource_type, resource_id, description,
+			previous_value, new_value, ip_address, additional_info, approved_by, source
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))
+	`,
+		log.Timestamp.Format(auditTimestampFormat),
+		log.Username,
+		string(log.Action),
+		log.ResourceType,
+		log.ResourceID,
+		log.Description,
+		log.PreviousValue,
+		log.NewValue,
+		log.IPAddress,
+		log.AdditionalInfo,
+		log.ApprovedBy,
+		string(log.Source),
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get database connection: %w", err)
+		return err
+	}
+	if log.ID, err = result.LastInsertId(); err != nil {
+		return err
 	}
 
-	// Build query with filters
-	query := "SELECT id, timestamp, username, action, resource_type, resource_id, description, previous_value, new_value, ip_address, additional_info FROM audit_logs WHERE 1=1"
+	if log.PrevHash, err = auditHashBefore(tx, log.ID); err != nil {
+		return err
+	}
+	log.Hash = log.ComputeHash()
+	_, err = tx.Exec("UPDATE audit_logs SET prev_hash = ?, hash = ? WHERE id = ?", log.PrevHash, log.Hash, log.ID)
+	return err
+}
+
+// auditLogColumns are the columns read by scanAuditLogs
+const auditLogColumns = "id, timestamp, username, action, resource_type, resource_id, description, previous_value, new_value, ip_address, additional_info, COALESCE(approved_by, ''), COALESCE(source, ''), COALESCE(prev_hash, ''), COALESCE(hash, '')"
+
+// auditLogFilter builds the WHERE clause shared by the audit log queries
+func auditLogFilter(username string, action AuditAction, resourceType, startDate, endDate string) (string, []interface{}) {
+	query := " WHERE 1=1"
 	params := []interface{}{}
 
 	if username != "" {
@@ -122,6 +192,21 @@ func GetAuditLogs(username string, action AuditAction, resourceType, startDate,
 		params = append(params, endDate)
 	}
 
+	return query, params
+}
+
+// GetAuditLogs retrieves audit logs with optional filtering
+func GetAuditLogs(username string, action AuditAction, resourceType, startDate, endDate string, limit, offset int) ([]AuditLog, error) {
+	// Get database connection
+	db, err := GetDB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %w", err)
+	}
+
+	// Build query with filters
+	where, params := auditLogFilter(username, action, resourceType, startDate, endDate)
+	query := "SELECT " + auditLogColumns + " FROM audit_logs" + where
+
 	// Add order by and pagination
 	query += " ORDER BY timestamp DESC"
 
@@ -142,75 +227,103 @@ func GetAuditLogs(username string, action AuditAction, resourceType, startDate,
 	}
 	defer rows.Close()
 
-	// Process results
-	var logs []AuditLog
-	for rows.Next() {
-		var log AuditLog
-		var timestamp string
-
-		err := rows.Scan(
-			&log.ID,
-			&timestamp,
-			&log.Username,
-			&log.Action,
-			&log.ResourceType,
-			&log.ResourceID,
-			&log.Description,
-			&log.PreviousValue,
-			&log.NewValue,
-			&log.IPAddress,
-			&log.AdditionalInfo,
-		)
+	return scanAuditLogs(rows)
+}
 
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan audit log: %w", err)
-		}
+// GetAuditLogsBefore retrieves up to limit audit logs with an ID below beforeID, newest
+// first, with the same filters as GetAuditLogs. A beforeID of zero starts at the newest
+// entry. Paging by ID stays stable while new entries are written.
+func GetAuditLogsBefore(username string, action AuditAction, resourceType, startDate, endDate string, beforeID int64, limit int) ([]AuditLog, error) {
+	where, params := auditLogFilter(username, action, resourceType, startDate, endDate)
+	if beforeID > 0 {
+		where += " AND id < ?"
+		params = append(params, beforeID)
+	}
+	params = append(params, limit)
 
-		// Parse timestamp
-		log.Timestamp, err = time.Parse("2006-01-02 15:04:05", timestamp)
+	rows, err := DB.Query("SELECT "+auditLogColumns+" FROM audit_logs"+where+" ORDER BY id DESC LIMIT ?", params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit logs: %w", err)
+	}
+	defer rows.Close()
+
+	return scanAuditLogs(rows)
+}
+
+// GetAuditLog retrieves a single audit log entry
+func GetAuditLog(id int64) (AuditLog, error) {
+	rows, err := DB.Query("SELECT "+auditLogColumns+" FROM audit_logs WHERE id = ?", id)
+	if err != nil {
+		return AuditLog{}, fmt.Errorf("failed to query audit logs: %w", err)
+	}
+	defer rows.Close()
+
+	logs, err := scanAuditLogs(rows)
+	if err != nil {
+		return AuditLog{}, err
+	}
+	if len(logs) == 0 {
+		return AuditLog{}, ErrAuditLogNotFound
+	}
+	return logs[0], nil
+}
+
+// scanAuditLogs reads audit log entries from rows
+func scanAuditLogs(rows *sql.Rows) ([]AuditLog, error) {
+	var logs []AuditLog
+	for rows.Next() {
+		log, err := scanAuditLog(rows)
 		if err != nil {
-			// Try alternative format
-			log.Timestamp, err = time.Parse(time.RFC3339, timestamp)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse timestamp: %w", err)
-			}
+			return nil, err
 		}
-
 		logs = append(logs, log)
 	}
 
-	if err = rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error during rows iteration: %w", err)
 	}
 
 	return logs, nil
 }
 
-// PurgeOldAuditLogs removes audit logs older than the specified number of days
-func PurgeOldAuditLogs(days int) (int64, error) {
-	// Get database connection
-	db, err := GetDB()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get database connection: %w", err)
-	}
-
-	// Calculate cutoff date
-	cutoffDate := time.Now().AddDate(0, 0, -days)
-	cutoffStr := cutoffDate.Format("2006-01-02")
+// scanAuditLog reads the audit log entry of the current row
+func scanAuditLog(rows *sql.Rows) (AuditLog, error) {
+	var log AuditLog
+	var timestamp string
+
+	err := rows.Scan(
+		&log.ID,
+		&timestamp,
+		&log.Username,
+		&log.Action,
+		&log.ResourceType,
+		&log.ResourceID,
+		&log.Description,
+		&log.PreviousValue,
+		&log.NewValue,
+		&log.IPAddress,
+		&log.AdditionalInfo,
+		&log.ApprovedBy,
+		&log.Source,
+		&log.PrevHash,
+		&log.Hash,
+	)
 
-	// Delete old logs
-	result, err := db.Exec("DELETE FROM audit_logs WHERE timestamp < ?", cutoffStr)
 	if err != nil {
-		return 0, fmt.Errorf("failed to purge old audit logs: %w", err)
+		return AuditLog{}, fmt.Errorf("failed to scan audit log: %w", err)
 	}
 
-	// Get number of deleted rows
-	count, err := result.RowsAffected()
+	// Parse timestamp
+	log.Timestamp, err = time.Parse("2006-01-02 15:04:05", timestamp)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+		// Try alternative format
+		log.Timestamp, err = time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			return AuditLog{}, fmt.Errorf("failed to parse timestamp: %w", err)
+		}
 	}
 
-	return count, nil
+	return log, nil
 }
 
 // AuditLogStatistics returns statistics about audit logs
@@ -287,16 +400,115 @@ func AuditLogStatistics() (map[string]interface{}, error) {
 	return stats, nil
 }
 
-// ExportAuditLogs exports audit logs to a JSON file
-func ExportAuditLogs(filepath string, startDate string, endDate string) error {
-	// Get logs for the specified date range
-	logs, err := GetAuditLogs("", "", "", startDate, endDate, 0, 0)
+// Audit log export formats
+const (
+	AuditExportJSON  = "json"  // A JSON array
+	AuditExportJSONL = "jsonl" // One JSON object per line
+	AuditExportCSV   = "csv"   // CSV with a header row
+)
+
+// AuditExportFormats are the formats audit logs can be exported in
+var AuditExportFormats = []string{AuditExportJSON, AuditExportJSONL, AuditExportCSV}
+
+// auditCSVHeader is the header row of CSV exports
+var auditCSVHeader = []string{
+	"id", "timestamp", "username", "action", "resource_type", "resource_id", "description",
+	"previous_value", "new_value", "ip_address", "additional_info", "approved_by", "source", "prev_hash", "hash",
+}
+
+// ExportAuditLogs writes the audit logs matching the filters of GetAuditLogs to w in the
+// given format, oldest first, and returns how many were written. Entries are written as
+// they are read, so exports of any size use little memory.
+func ExportAuditLogs(w io.Writer, format string, username string, action AuditAction, resourceType, startDate, endDate string) (int, error) {
+	var write func(AuditLog) error
+	var finish func() error
+
+	switch format {
+	case AuditExportJSON, AuditExportJSONL:
+		encoder := json.NewEncoder(w)
+		written := 0
+		write = func(log AuditLog) error {
+			if format == AuditExportJSON {
+				separator := ",\n"
+				if written == 0 {
+					separator = "[\n"
+				}
+				if _, err := io.WriteString(w, separator); err != nil {
+					return err
+				}
+			}
+			written++
+			return encoder.Encode(log)
+		}
+		finish = func() error {
+			if format != AuditExportJSON {
+				return nil
+			}
+			end := "]\n"
+			if written == 0 {
+				end = "[]\n"
+			}
+			_, err := io.WriteString(w, end)
+			return err
+		}
+	case AuditExportCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(auditCSVHeader); err != nil {
+			return 0, err
+		}
+		write = func(log AuditLog) error {
+			return writer.Write([]string{
+				strconv.FormatInt(log.ID, 10),
+				log.Timestamp.UTC().Format(time.RFC3339),
+				log.Username,
+				string(log.Action),
+				log.ResourceType,
+				log.ResourceID,
+				log.Description,
+				log.PreviousValue,
+				log.NewValue,
+				log.IPAddress,
+				log.AdditionalInfo,
+				log.ApprovedBy,
+				string(log.Source),
+				log.PrevHash,
+				log.Hash,
+			})
+		}
+		finish = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format %q, expected one of %s", format, strings.Join(AuditExportFormats, ", "))
+	}
+
+	where, params := auditLogFilter(username, action, resourceType, startDate, endDate)
+	rows, err := DB.Query("SELECT "+auditLogColumns+" FROM audit_logs"+where+" ORDER BY id", params...)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve audit logs: %w", err)
+		return 0, fmt.Errorf("failed to query audit logs: %w", err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		log, err := scanAuditLog(rows)
+		if err != nil {
+			return count, err
+		}
+		if err := write(log); err != nil {
+			return count, fmt.Errorf("failed to write audit log: %w", err)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, fmt.Errorf("error during rows iteration: %w", err)
 	}
 
-	// Export to JSON file
-	return writeJSONToFile(logs, filepath)
+	if err := finish(); err != nil {
+		return count, fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return count, nil
 }
 
 // AuditDiff creates a structured diff for audit logs
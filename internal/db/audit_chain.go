@@ -0,0 +1,645 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"termpos/internal/security"
+)
+
+// auditTimestampFormat is how audit log timestamps are stored and hashed
+const auditTimestampFormat = "2006-01-02 15:04:05"
+
+// AuditGenesisHash is the previous hash of the first entry of the audit chain
+var AuditGenesisHash = strings.Repeat("0", 64)
+
+var (
+	ErrNoAuditLogsToArchive       = errors.New("no audit logs to archive")
+	ErrInvalidCheckpointSignature = errors.New("audit checkpoint signature is invalid")
+)
+
+// Kinds of problems found when verifying the audit chain
+const (
+	AuditProblemModified   = "modified"   // An entry does not match its hash
+	AuditProblemGap        = "gap"        // Entries were removed or inserted before an entry
+	AuditProblemTruncated  = "truncated"  // Entries were removed from the end of the log
+	AuditProblemArchive    = "archive"    // An archive segment is missing or was changed
+	AuditProblemCheckpoint = "checkpoint" // The log no longer matches a checkpoint
+)
+
+// ComputeHash returns the hash of the entry's content and the hash of the entry before it.
+// Each entry's hash covers the previous one, so changing or removing an entry breaks the
+// chain from that entry on.
+func (l AuditLog) ComputeHash() string {
+	fields := []interface{}{
+		l.ID,
+		l.Timestamp.UTC().Format(auditTimestampFormat),
+		l.Username,
+		string(l.Action),
+		l.ResourceType,
+		l.ResourceID,
+		l.Description,
+		l.PreviousValue,
+		l.NewValue,
+		l.IPAddress,
+		l.AdditionalInfo,
+		l.ApprovedBy,
+		l.PrevHash,
+	}
+	// Entries written before the source was recorded have none, and hash as they did
+	if l.Source != "" {
+		fields = append(fields, string(l.Source))
+	}
+
+	content, _ := json.Marshal(fields)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditArchive records a range of audit log entries that were archived to a segment file.
+// The entries are purged from the database as their retention expires, and the chain of
+// later entries continues from the head of the range.
+type AuditArchive struct {
+	ID         int64     `json:"id"`
+	FirstID    int64     `json:"first_id"`
+	LastID     int64     `json:"last_id"`
+	Entries    int       `json:"entries"`
+	AnchorHash string    `json:"anchor_hash"` // Previous hash of the first archived entry
+	HeadHash   string    `json:"head_hash"`   // Hash of the last archived entry
+	File       string    `json:"file"`
+	SHA256     string    `json:"sha256"`
+	ArchivedBy string    `json:"archived_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// AuditProblem is a break in the audit chain
+type AuditProblem struct {
+	ID     int64  `json:"id"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+// AuditVerification is the result of verifying the audit chain
+type AuditVerification struct {
+	Entries  int            `json:"entries"`  // Entries checked in the database
+	Archived int            `json:"archived"` // Entries checked in archive files
+	HeadID   int64          `json:"head_id"`
+	HeadHash string         `json:"head_hash"`
+	Problems []AuditProblem `json:"problems"`
+}
+
+// OK reports whether the chain is intact
+func (v AuditVerification) OK() bool {
+	return len(v.Problems) == 0
+}
+
+// AuditCheckpoint is a signed record of the head of the audit chain. Checkpoints are kept
+// outside the database, so rewriting the whole chain is detected too.
+type AuditCheckpoint struct {
+	LastID    int64     `json:"last_id"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+	KeyID     string    `json:"key_id"`
+	Signature string    `json:"signature"`
+}
+
+// auditHashBefore returns the hash the entry with the given ID follows: that of the entry
+// before it, whether it is still in the database or was archived and purged, or the
+// genesis hash
+func auditHashBefore(tx *sql.Tx, id int64) (string, error) {
+	var hash string
+	err := tx.QueryRow(`
+		SELECT hash FROM (
+			SELECT id, COALESCE(hash, '') AS hash FROM audit_logs WHERE id < ?
+			UNION ALL SELECT last_id, head_hash FROM audit_archives WHERE last_id < ?
+		) ORDER BY id DESC LIMIT 1
+	`, id, id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return AuditGenesisHash, nil
+	}
+	return hash, err
+}
+
+// auditChainHead returns the ID and hash of the last entry of the chain
+func auditChainHead(tx *sql.Tx) (int64, string, error) {
+	var head sql.NullInt64
+	if err := tx.QueryRow("SELECT MAX(id) FROM audit_logs").Scan(&head); err != nil {
+		return 0, "", err
+	}
+	if head.Valid {
+		hash, err := auditHashBefore(tx, head.Int64+1)
+		return head.Int64, hash, err
+	}
+
+	// Every entry was archived, or none was ever written
+	id, hash := int64(0), AuditGenesisHash
+	err := tx.QueryRow("SELECT last_id, head_hash FROM audit_archives ORDER BY last_id DESC LIMIT 1").Scan(&id, &hash)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, "", err
+	}
+	return id, hash, nil
+}
+
+// ListAuditArchives returns the archived ranges of the audit log, oldest first
+func ListAuditArchives() ([]AuditArchive, error) {
+	rows, err := DB.Query(`
+		SELECT id, first_id, last_id, entries, anchor_hash, head_hash, file, sha256, archived_by, created_at
+		FROM audit_archives ORDER BY last_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit archives: %w", err)
+	}
+	defer rows.Close()
+
+	var archives []AuditArchive
+	for rows.Next() {
+		var a AuditArchive
+		err := rows.Scan(&a.ID, &a.FirstID, &a.LastID, &a.Entries, &a.AnchorHash, &a.HeadHash, &a.File, &a.SHA256, &a.ArchivedBy, &a.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan audit archive: %w", err)
+		}
+		archives = append(archives, a)
+	}
+	return archives, rows.Err()
+}
+
+// DefaultAuditSegmentEntries is the most entries written to one archive segment
+const DefaultAuditSegmentEntries = 10000
+
+// AuditArchiveOptions control how audit logs are archived
+type AuditArchiveOptions struct {
+	Dir            string // Directory the segment files are written to
+	Encrypt        bool   // Encrypt segments with the encryption key
+	SegmentEntries int    // Most entries per segment, DefaultAuditSegmentEntries if zero
+}
+
+// ArchiveAuditLogs writes the audit log entries older than before that were not archived
+// yet to gzip-compressed JSON lines segment files, optionally encrypted, and records each
+// segment. Entries are archived in the order of the chain, so each segment continues from
+// the head of the one before it. Archived entries stay in the database until
+// ApplyAuditRetention purges them.
+func ArchiveAuditLogs(before time.Time, opts AuditArchiveOptions, archivedBy string) ([]AuditArchive, error) {
+	if _, err := GetDB(); err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %w", err)
+	}
+	if opts.Encrypt {
+		// Load the data key now, segments are encrypted while the database is in use
+		if _, err := security.ActiveKeyID(); err != nil {
+			return nil, fmt.Errorf("failed to encrypt archives: %w", err)
+		}
+	}
+	if opts.SegmentEntries <= 0 {
+		opts.SegmentEntries = DefaultAuditSegmentEntries
+	}
+
+	var archives []AuditArchive
+	for {
+		archive, err := archiveAuditSegment(before, opts, archivedBy)
+		if errors.Is(err, ErrNoAuditLogsToArchive) {
+			break
+		}
+		if err != nil {
+			return archives, fmt.Errorf("failed to archive audit logs: %w", err)
+		}
+		archives = append(archives, archive)
+	}
+	if len(archives) == 0 {
+		return nil, ErrNoAuditLogsToArchive
+	}
+
+	first, last := archives[0], archives[len(archives)-1]
+	AddAuditLog(archivedBy, ActionExport, "audit_logs", fmt.Sprintf("%d-%d", first.FirstID, last.LastID),
+		fmt.Sprintf("Archived audit log entries %d to %d in %d segments to %s", first.FirstID, last.LastID, len(archives), opts.Dir),
+		"", "", "", fmt.Sprintf("head_hash=%s", last.HeadHash))
+
+	return archives, nil
+}
+
+// archiveAuditSegment archives the next segment of entries older than before
+func archiveAuditSegment(before time.Time, opts AuditArchiveOptions, archivedBy string) (AuditArchive, error) {
+	var archive AuditArchive
+	err := Transaction(func(tx *sql.Tx) error {
+		if archive.File != "" {
+			// A retry writes the file again
+			os.Remove(archive.File)
+			archive = AuditArchive{}
+		}
+
+		var archived int64
+		anchor := AuditGenesisHash
+		err := tx.QueryRow("SELECT last_id, head_hash FROM audit_archives ORDER BY last_id DESC LIMIT 1").Scan(&archived, &anchor)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		var last sql.NullInt64
+		err = tx.QueryRow("SELECT MAX(id) FROM audit_logs WHERE id > ? AND timestamp < ?", archived, before.UTC().Format(auditTimestampFormat)).Scan(&last)
+		if err != nil {
+			return err
+		}
+		if !last.Valid {
+			return ErrNoAuditLogsToArchive
+		}
+
+		rows, err := tx.Query("SELECT "+auditLogColumns+" FROM audit_logs WHERE id > ? AND id <= ? ORDER BY id LIMIT ?", archived, last.Int64, opts.SegmentEntries)
+		if err != nil {
+			return err
+		}
+		logs, err := scanAuditLogs(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		// Never archive a broken chain: the archive would make the break look legitimate
+		for _, log := range logs {
+			if log.PrevHash != anchor || log.ComputeHash() != log.Hash {
+				return fmt.Errorf("the audit chain is broken at entry %d, run \"pos audit verify\"", log.ID)
+			}
+			anchor = log.Hash
+		}
+
+		first, head := logs[0], logs[len(logs)-1]
+		name := fmt.Sprintf("audit-%08d-%08d.jsonl.gz", first.ID, head.ID)
+		if opts.Encrypt {
+			name += ".enc"
+		}
+		path := filepath.Join(opts.Dir, name)
+		sum, err := writeAuditArchive(path, logs, opts.Encrypt)
+		if err != nil {
+			return err
+		}
+
+		archive = AuditArchive{
+			FirstID:    first.ID,
+			LastID:     head.ID,
+			Entries:    len(logs),
+			AnchorHash: first.PrevHash,
+			HeadHash:   head.Hash,
+			File:       path,
+			SHA256:     sum,
+			ArchivedBy: archivedBy,
+			CreatedAt:  time.Now().UTC(),
+		}
+		result, err := tx.Exec(`
+			INSERT INTO audit_archives (first_id, last_id, entries, anchor_hash, head_hash, file, sha256, archived_by, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, archive.FirstID, archive.LastID, archive.Entries, archive.AnchorHash, archive.HeadHash, archive.File, archive.SHA256, archive.ArchivedBy, archive.CreatedAt)
+		if err != nil {
+			return err
+		}
+		archive.ID, err = result.LastInsertId()
+		return err
+	})
+	if err != nil && archive.File != "" {
+		// The segment was not recorded, so the file of this attempt is not needed
+		os.Remove(archive.File)
+	}
+	return archive, err
+}
+
+// writeAuditArchive writes audit log entries to a new segment file, one JSON object per
+// line, gzip-compressed and optionally encrypted, and returns the SHA-256 of the file
+func writeAuditArchive(path string, logs []AuditLog, encrypt bool) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(zw)
+	for _, log := range logs {
+		if err := encoder.Encode(log); err != nil {
+			return "", fmt.Errorf("failed to encode archive: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("failed to compress archive: %w", err)
+	}
+
+	data := buf.Bytes()
+	if encrypt {
+		var err error
+		if data, err = security.EncryptBytes(data); err != nil {
+			return "", fmt.Errorf("failed to encrypt archive: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to write archive file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to write archive file: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readAuditArchive reads the entries of a segment file and returns them with the SHA-256
+// of the file. Encrypted segments end in .enc and compressed ones in .gz before that;
+// uncompressed files of earlier versions are read as they are.
+func readAuditArchive(path string) ([]AuditLog, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(data)
+
+	name := path
+	if strings.HasSuffix(name, ".enc") {
+		name = strings.TrimSuffix(name, ".enc")
+		if data, err = security.DecryptBytes(data); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var r io.Reader = bytes.NewReader(data)
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, "", err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	decoder := json.NewDecoder(r)
+	var logs []AuditLog
+	for {
+		var log AuditLog
+		if err := decoder.Decode(&log); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		logs = append(logs, log)
+	}
+
+	return logs, hex.EncodeToString(sum[:]), nil
+}
+
+// auditChainChecker follows the chain entry by entry, recording the problems it finds
+type auditChainChecker struct {
+	result   *AuditVerification
+	prevID   int64
+	prevHash string
+	wanted   map[int64]bool   // Entries checkpoints refer to
+	hashes   map[int64]string // Stored hashes of the wanted entries
+}
+
+// check checks that an entry matches its hash and follows the entry before it
+func (c *auditChainChecker) check(log AuditLog) {
+	if log.ComputeHash() != log.Hash {
+		c.problem(log.ID, AuditProblemModified, fmt.Sprintf("entry %d does not match its hash", log.ID))
+	}
+	if log.PrevHash != c.prevHash {
+		if c.prevID == 0 {
+			c.problem(log.ID, AuditProblemGap, fmt.Sprintf("entry %d does not follow the start of the chain", log.ID))
+		} else {
+			c.problem(log.ID, AuditProblemGap, fmt.Sprintf("entry %d does not follow entry %d", log.ID, c.prevID))
+		}
+	}
+
+	c.prevID, c.prevHash = log.ID, log.Hash
+	if c.wanted[log.ID] {
+		c.hashes[log.ID] = log.Hash
+	}
+}
+
+// forEachAuditLog calls fn with the entries with an ID after after, up to upTo, in order.
+// The entries are read in pages, so large logs are not loaded at once.
+func forEachAuditLog(after, upTo int64, fn func(AuditLog)) error {
+	const pageSize = 1000
+	for {
+		rows, err := DB.Query("SELECT "+auditLogColumns+" FROM audit_logs WHERE id > ? AND id <= ? ORDER BY id LIMIT ?", after, upTo, pageSize)
+		if err != nil {
+			return fmt.Errorf("failed to query audit logs: %w", err)
+		}
+		logs, err := scanAuditLogs(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, log := range logs {
+			fn(log)
+		}
+		if len(logs) < pageSize {
+			return nil
+		}
+		after = logs[len(logs)-1].ID
+	}
+}
+
+// problem records a problem with an entry
+func (c *auditChainChecker) problem(id int64, kind, detail string) {
+	c.result.Problems = append(c.result.Problems, AuditProblem{ID: id, Kind: kind, Detail: detail})
+}
+
+// VerifyAuditChain verifies the audit chain from its start: the archive segments, the
+// entries in the database, including archived entries that were not purged yet, and that
+// the chain still contains the entries of the given checkpoints. Archive files are read from the paths they were written to, or
+// from archiveDir if it is set. The signatures of the checkpoints are not checked.
+func VerifyAuditChain(archiveDir string, checkpoints []AuditCheckpoint) (AuditVerification, error) {
+	if _, err := GetDB(); err != nil {
+		return AuditVerification{}, fmt.Errorf("failed to get database connection: %w", err)
+	}
+
+	var result AuditVerification
+	c := &auditChainChecker{
+		result:   &result,
+		prevHash: AuditGenesisHash,
+		wanted:   make(map[int64]bool),
+		hashes:   make(map[int64]string),
+	}
+	for _, cp := range checkpoints {
+		c.wanted[cp.LastID] = true
+	}
+
+	archives, err := ListAuditArchives()
+	if err != nil {
+		return AuditVerification{}, err
+	}
+	for _, a := range archives {
+		if a.AnchorHash != c.prevHash {
+			c.problem(a.FirstID, AuditProblemGap, fmt.Sprintf("archive of entries %d to %d does not follow entry %d", a.FirstID, a.LastID, c.prevID))
+		}
+
+		path := a.File
+		if archiveDir != "" {
+			path = filepath.Join(archiveDir, filepath.Base(a.File))
+		}
+		logs, sum, err := readAuditArchive(path)
+		var copies map[int64]string
+		switch {
+		case err != nil:
+			c.problem(a.FirstID, AuditProblemArchive, fmt.Sprintf("archive of entries %d to %d cannot be read: %v", a.FirstID, a.LastID, err))
+		case sum != a.SHA256 || len(logs) != a.Entries:
+			c.problem(a.FirstID, AuditProblemArchive, fmt.Sprintf("archive %s was changed since entries %d to %d were archived", path, a.FirstID, a.LastID))
+		default:
+			c.prevHash = a.AnchorHash
+			copies = make(map[int64]string, len(logs))
+			for _, log := range logs {
+				c.check(log)
+				copies[log.ID] = log.Hash
+			}
+			result.Archived += len(logs)
+		}
+
+		// Entries kept in the database after they were archived must match their copies
+		err = forEachAuditLog(a.FirstID-1, a.LastID, func(log AuditLog) {
+			result.Entries++
+			if log.ComputeHash() != log.Hash {
+				c.problem(log.ID, AuditProblemModified, fmt.Sprintf("entry %d does not match its hash", log.ID))
+			} else if hash, ok := copies[log.ID]; copies != nil && (!ok || hash != log.Hash) {
+				c.problem(log.ID, AuditProblemModified, fmt.Sprintf("entry %d does not match its archived copy", log.ID))
+			}
+		})
+		if err != nil {
+			return AuditVerification{}, err
+		}
+
+		// The database record of the archive is what later entries follow
+		c.prevID, c.prevHash = a.LastID, a.HeadHash
+		if c.wanted[a.LastID] {
+			c.hashes[a.LastID] = a.HeadHash
+		}
+	}
+
+	err = forEachAuditLog(c.prevID, math.MaxInt64, func(log AuditLog) {
+		result.Entries++
+		c.check(log)
+	})
+	if err != nil {
+		return AuditVerification{}, err
+	}
+
+	// AUTOINCREMENT never reuses IDs, so the sequence shows entries removed from the end
+	var seq int64
+	err = DB.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = 'audit_logs'").Scan(&seq)
+	if err != nil && err != sql.ErrNoRows {
+		return AuditVerification{}, fmt.Errorf("failed to read audit log sequence: %w", err)
+	}
+	if seq > c.prevID {
+		c.problem(c.prevID+1, AuditProblemTruncated, fmt.Sprintf("entries %d to %d were removed from the end of the log", c.prevID+1, seq))
+	}
+
+	for _, cp := range checkpoints {
+		hash, ok := c.hashes[cp.LastID]
+		switch {
+		case !ok && cp.LastID > 0:
+			c.problem(cp.LastID, AuditProblemCheckpoint, fmt.Sprintf("entry %d of the checkpoint of %s is missing", cp.LastID, cp.CreatedAt.Format(time.RFC3339)))
+		case ok && hash != cp.Hash:
+			c.problem(cp.LastID, AuditProblemCheckpoint, fmt.Sprintf("entry %d does not match the checkpoint of %s", cp.LastID, cp.CreatedAt.Format(time.RFC3339)))
+		}
+	}
+
+	result.HeadID, result.HeadHash = c.prevID, c.prevHash
+	return result, nil
+}
+
+// auditKeyID identifies the key a checkpoint was signed with, without revealing it
+func auditKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// signature returns the HMAC-SHA256 of the checkpoint's content
+func (c AuditCheckpoint) signature(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d.%s.%s.%s", c.LastID, c.Hash, c.CreatedAt.UTC().Format(time.RFC3339), c.KeyID)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks that the checkpoint was signed with key
+func (c AuditCheckpoint) VerifySignature(key []byte) error {
+	if c.KeyID != auditKeyID(key) || !hmac.Equal([]byte(c.Signature), []byte(c.signature(key))) {
+		return ErrInvalidCheckpointSignature
+	}
+	return nil
+}
+
+// NewAuditCheckpoint returns a checkpoint of the current head of the audit chain, signed
+// with key
+func NewAuditCheckpoint(key []byte) (AuditCheckpoint, error) {
+	if _, err := GetDB(); err != nil {
+		return AuditCheckpoint{}, fmt.Errorf("failed to get database connection: %w", err)
+	}
+
+	var cp AuditCheckpoint
+	err := Transaction(func(tx *sql.Tx) error {
+		var err error
+		cp.LastID, cp.Hash, err = auditChainHead(tx)
+		return err
+	})
+	if err != nil {
+		return AuditCheckpoint{}, fmt.Errorf("failed to read audit chain head: %w", err)
+	}
+
+	cp.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	cp.KeyID = auditKeyID(key)
+	cp.Signature = cp.signature(key)
+	return cp, nil
+}
+
+// AppendAuditCheckpoint appends a checkpoint to a JSON lines file
+func AppendAuditCheckpoint(path string, cp AuditCheckpoint) error {
+	line, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open checkpoint file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return file.Sync()
+}
+
+// ReadAuditCheckpoints reads the checkpoints of a JSON lines file
+func ReadAuditCheckpoints(path string) ([]AuditCheckpoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint file: %w", err)
+	}
+	defer file.Close()
+
+	var checkpoints []AuditCheckpoint
+	decoder := json.NewDecoder(file)
+	for {
+		var cp AuditCheckpoint
+		if err := decoder.Decode(&cp); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read checkpoint file: %w", err)
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+	return checkpoints, nil
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// chainAuditLogs adds the hash chain to the audit log, chaining the entries already
+// written in the order they were written, and creates the table recording the archived
+// ranges of the chain
+func chainAuditLogs() error {
+	queries := []string{
+		"ALTER TABLE audit_logs ADD COLUMN prev_hash TEXT;",
+		"ALTER TABLE audit_logs ADD COLUMN hash TEXT;",
+	}
+	for _, query := range queries {
+		// Execute the query and ignore "duplicate column" errors
+		if _, err := DB.Exec(query); err != nil && !strings.HasPrefix(err.Error(), "duplicate column name:") {
+			return err
+		}
+	}
+
+	_, err := DB.Exec(`
+	CREATE TABLE audit_archives (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		first_id INTEGER NOT NULL,
+		last_id INTEGER NOT NULL UNIQUE,
+		entries INTEGER NOT NULL,
+		anchor_hash TEXT NOT NULL,
+		head_hash TEXT NOT NULL,
+		file TEXT NOT NULL,
+		sha256 TEXT NOT NULL,
+		archived_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// The source column is added by a later migration, and entries written before it
+	// have none
+	columns := strings.Replace(auditLogColumns, "COALESCE(source, '')", "''", 1)
+	rows, err := DB.Query("SELECT " + columns + " FROM audit_logs ORDER BY id")
+	if err != nil {
+		return err
+	}
+	logs, err := scanAuditLogs(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		prevHash := AuditGenesisHash
+		for _, log := range logs {
+			log.PrevHash = prevHash
+			log.Hash = log.ComputeHash()
+			if _, err := tx.Exec("UPDATE audit_logs SET prev_hash = ?, hash = ? WHERE id = ?", log.PrevHash, log.Hash, log.ID); err != nil {
+				return err
+			}
+			prevHash = log.Hash
+		}
+		return nil
+	})
+}
+
+// createAuditRetentionTables creates the tables of the retention policies of the audit
+// log and of the positions of audit log forwarders
+func createAuditRetentionTables() error {
+	query := `
+	CREATE TABLE audit_retention (
+		action TEXT PRIMARY KEY,
+		days INTEGER NOT NULL,
+		updated_by TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE audit_forwarders (
+		name TEXT PRIMARY KEY,
+		last_id INTEGER NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
+
+// alterAuditLogsForSource records where each audited change was made from
+func alterAuditLogsForSource() error {
+	_, err := DB.Exec("ALTER TABLE audit_logs ADD COLUMN source TEXT;")
+	if err != nil && strings.HasPrefix(err.Error(), "duplicate column name:") {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// AuditSource is where an audited change was made from
+type AuditSource string
+
+// Sources of audited changes
+const (
+	SourceCLI       AuditSource = "cli"
+	SourceAPI       AuditSource = "api"
+	SourceAssistant AuditSource = "assistant"
+	SourceWorkflow  AuditSource = "workflow"
+	SourceSystem    AuditSource = "system"
+)
+
+// Actor is who made a change, and from where. Functions that change business data take
+// it from their context and record the change in the audit log, in the transaction
+// making it, so no change is committed without its audit log entry.
+type Actor struct {
+	Username  string
+	Source    AuditSource
+	IPAddress string
+}
+
+// actorKey is the context key of the actor
+type actorKey struct{}
+
+// WithActor returns a context carrying the actor making changes
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor of a context. Changes made without one, such as by
+// migrations and background jobs, are attributed to the system.
+func ActorFromContext(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorKey{}).(Actor)
+	if actor.Username == "" {
+		actor.Username = "system"
+	}
+	if actor.Source == "" {
+		actor.Source = SourceSystem
+	}
+	return actor
+}
+
+// AuditTx records a change made by the actor of the context in the audit log, in the
+// transaction making it. The previous and new values are recorded as JSON with AuditDiff.
+func AuditTx(ctx context.Context, tx *sql.Tx, action AuditAction, resourceType string, resourceID interface{}, description string, oldValue, newValue interface{}) error {
+	return AuditApprovedTx(ctx, tx, "", action, resourceType, resourceID, description, oldValue, newValue)
+}
+
+// AuditApprovedTx is AuditTx for a change a supervisor approved
+func AuditApprovedTx(ctx context.Context, tx *sql.Tx, approvedBy string, action AuditAction, resourceType string, resourceID interface{}, description string, oldValue, newValue interface{}) error {
+	prevJSON, newJSON, err := AuditDiff(oldValue, newValue)
+	if err != nil {
+		return err
+	}
+
+	actor := ActorFromContext(ctx)
+	err = insertAuditLogTx(tx, AuditLog{
+		Username:      actor.Username,
+		Action:        action,
+		ResourceType:  resourceType,
+		ResourceID:    fmt.Sprintf("%v", resourceID),
+		Description:   description,
+		PreviousValue: prevJSON,
+		NewValue:      newJSON,
+		IPAddress:     actor.IPAddress,
+		ApprovedBy:    approvedBy,
+		Source:        actor.Source,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add audit log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AuditLogsAfter returns up to limit audit log entries with an ID after afterID, oldest
+// first
+func AuditLogsAfter(afterID int64, limit int) ([]AuditLog, error) {
+	rows, err := DB.Query("SELECT "+auditLogColumns+" FROM audit_logs WHERE id > ? ORDER BY id LIMIT ?", afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit logs: %w", err)
+	}
+	defer rows.Close()
+
+	return scanAuditLogs(rows)
+}
+
+// AuditForwarderPosition returns the ID of the last entry a forwarder sent, and whether
+// the forwarder has run before
+func AuditForwarderPosition(name string) (int64, bool, error) {
+	var id int64
+	err := DB.QueryRow("SELECT last_id FROM audit_forwarders WHERE name = ?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read audit forwarder position: %w", err)
+	}
+	return id, true, nil
+}
+
+// SetAuditForwarderPosition records the ID of the last entry a forwarder sent
+func SetAuditForwarderPosition(name string, id int64) error {
+	_, err := DB.Exec(`
+		INSERT INTO audit_forwarders (name, last_id, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET last_id = excluded.last_id, updated_at = excluded.updated_at
+	`, name, id, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record audit forwarder position: %w", err)
+	}
+	return nil
+}
+
+// LatestAuditLogID returns the ID of the newest audit log entry, or zero if there is none
+func LatestAuditLogID() (int64, error) {
+	var id int64
+	if err := DB.QueryRow("SELECT COALESCE(MAX(id), 0) FROM audit_logs").Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to read latest audit log ID: %w", err)
+	}
+	return id, nil
+}
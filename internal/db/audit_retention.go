@@ -0,0 +1,183 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AuditRetentionDefault is the action of the retention policy for actions without one
+const AuditRetentionDefault AuditAction = "default"
+
+// ErrAuditRetentionNotFound is returned when an action has no retention policy
+var ErrAuditRetentionNotFound = errors.New("audit retention policy not found")
+
+// AuditRetention is how long the audit log entries of an action are kept in the database
+type AuditRetention struct {
+	Action    AuditAction `json:"action"`
+	Days      int         `json:"days"`
+	UpdatedBy string      `json:"updated_by"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// IsAuditAction reports whether action is recorded in the audit log
+func IsAuditAction(action AuditAction) bool {
+	for _, a := range AuditActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAuditRetention sets how many days the entries of an action, or of every action
+// without a policy if action is AuditRetentionDefault, are kept
+func SetAuditRetention(action AuditAction, days int, updatedBy string) error {
+	if action != AuditRetentionDefault && !IsAuditAction(action) {
+		return fmt.Errorf("unknown audit action %q", action)
+	}
+	if days <= 0 {
+		return errors.New("retention must be at least one day")
+	}
+
+	_, err := DB.Exec(`
+		INSERT INTO audit_retention (action, days, updated_by, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(action) DO UPDATE SET days = excluded.days, updated_by = excluded.updated_by, updated_at = excluded.updated_at
+	`, string(action), days, updatedBy, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to set audit retention: %w", err)
+	}
+
+	AddAuditLog(updatedBy, ActionSettingsMod, "audit_retention", string(action),
+		fmt.Sprintf("Set audit log retention of %s to %d days", action, days), "", "", "", "")
+	return nil
+}
+
+// RemoveAuditRetention removes the retention policy of an action, so its entries follow
+// the default policy
+func RemoveAuditRetention(action AuditAction, removedBy string) error {
+	result, err := DB.Exec("DELETE FROM audit_retention WHERE action = ?", string(action))
+	if err != nil {
+		return fmt.Errorf("failed to remove audit retention: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrAuditRetentionNotFound
+	}
+
+	AddAuditLog(removedBy, ActionSettingsMod, "audit_retention", string(action),
+		fmt.Sprintf("Removed the audit log retention policy of %s", action), "", "", "", "")
+	return nil
+}
+
+// ListAuditRetention returns the retention policies, by action
+func ListAuditRetention() ([]AuditRetention, error) {
+	rows, err := DB.Query("SELECT action, days, updated_by, updated_at FROM audit_retention ORDER BY action")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit retention: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []AuditRetention
+	for rows.Next() {
+		var p AuditRetention
+		if err := rows.Scan(&p.Action, &p.Days, &p.UpdatedBy, &p.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan audit retention: %w", err)
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+// ApplyAuditRetention purges the audit log entries whose retention expired as of asOf.
+// defaultDays, if positive, overrides the default policy. Only archived entries are
+// purged, so the chain can still be verified from the archive segments.
+func ApplyAuditRetention(asOf time.Time, defaultDays int, purgedBy string) (int64, error) {
+	policies, err := ListAuditRetention()
+	if err != nil {
+		return 0, err
+	}
+
+	var purged int64
+	err = Transaction(func(tx *sql.Tx) error {
+		purged = 0
+
+		var archived int64
+		if err := tx.QueryRow("SELECT COALESCE(MAX(last_id), 0) FROM audit_archives").Scan(&archived); err != nil {
+			return err
+		}
+
+		var actions []interface{}
+		placeholders := ""
+		for _, p := range policies {
+			if p.Action == AuditRetentionDefault {
+				if defaultDays <= 0 {
+					defaultDays = p.Days
+				}
+				continue
+			}
+
+			cutoff := asOf.AddDate(0, 0, -p.Days).UTC().Format(auditTimestampFormat)
+			result, err := tx.Exec("DELETE FROM audit_logs WHERE id <= ? AND action = ? AND timestamp < ?", archived, string(p.Action), cutoff)
+			if err != nil {
+				return err
+			}
+			n, _ := result.RowsAffected()
+			purged += n
+
+			actions = append(actions, string(p.Action))
+			if placeholders != "" {
+				placeholders += ", "
+			}
+			placeholders += "?"
+		}
+
+		if defaultDays <= 0 {
+			return nil
+		}
+		query := "DELETE FROM audit_logs WHERE id <= ? AND timestamp < ?"
+		if placeholders != "" {
+			query += " AND action NOT IN (" + placeholders + ")"
+		}
+		cutoff := asOf.AddDate(0, 0, -defaultDays).UTC().Format(auditTimestampFormat)
+		result, err := tx.Exec(query, append([]interface{}{archived, cutoff}, actions...)...)
+		if err != nil {
+			return err
+		}
+		n, _ := result.RowsAffected()
+		purged += n
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge audit logs: %w", err)
+	}
+
+	if purged > 0 {
+		AddAuditLog(purgedBy, ActionDelete, "audit_logs", "",
+			fmt.Sprintf("Purged %d archived audit log entries past their retention", purged), "", "", "", "")
+	}
+	return purged, nil
+}
+
+// ShortestAuditRetention returns the shortest retention in days of the policies and
+// defaultDays, if positive, or zero if there is none
+func ShortestAuditRetention(defaultDays int) (int, error) {
+	policies, err := ListAuditRetention()
+	if err != nil {
+		return 0, err
+	}
+
+	shortest := defaultDays
+	for _, p := range policies {
+		if p.Action == AuditRetentionDefault && defaultDays > 0 {
+			continue
+		}
+		if shortest <= 0 || p.Days < shortest {
+			shortest = p.Days
+		}
+	}
+	if shortest < 0 {
+		shortest = 0
+	}
+	return shortest, nil
+}
@@ -0,0 +1,442 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"termpos/internal/models"
+)
+
+var (
+	ErrCategoryNotFound = errors.New("category not found")
+	ErrSupplierNotFound = errors.New("supplier not found")
+	ErrLocationNotFound = errors.New("location not found")
+	ErrBatchNotFound    = errors.New("batch not found")
+)
+
+//
+// Products
+//
+
+// UpdateProduct updates all fields of a product
+func UpdateProduct(ctx context.Context, product models.Product) error {
+	if err := product.Validate(); err != nil {
+		return err
+	}
+	old, err := GetProductByID(product.ID)
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		if err := checkExists(tx, "categories", product.CategoryID, "category"); err != nil {
+			return err
+		}
+		if err := checkExists(tx, "suppliers", product.DefaultSupplierID, "supplier"); err != nil {
+			return err
+		}
+
+		var previousStock int
+		err := tx.QueryRow("SELECT stock FROM products WHERE id = ?", product.ID).Scan(&previousStock)
+		if err == sql.ErrNoRows {
+			return models.ErrProductNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		err = execUpdate(tx, models.ErrProductNotFound,
+			`UPDATE products
+			 SET name = ?, price = ?, stock = ?, category_id = ?, low_stock_alert = ?,
+			     default_supplier_id = ?, sku = ?, description = ?, updated_at = ?
+			 WHERE id = ?`,
+			product.Name, product.Price, product.Stock, product.CategoryID, product.LowStockAlert,
+			product.DefaultSupplierID, product.SKU, product.Description, time.Now(), product.ID,
+		)
+		if err != nil {
+			return err
+		}
+		if err := AuditTx(ctx, tx, ActionUpdate, "product", product.ID, "Updated product "+product.Name, old, product); err != nil {
+			return err
+		}
+		return PublishLowStockTx(tx, product.ID, previousStock)
+	})
+}
+
+// DeleteProduct deletes a product that has never been sold or received in a batch
+func DeleteProduct(ctx context.Context, id int) error {
+	old, err := GetProductByID(id)
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		err := checkUnused(tx, id,
+			reference{"sales", "product_id", "sales"},
+			reference{"product_batches", "product_id", "batches"},
+		)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM product_locations WHERE product_id = ?", id); err != nil {
+			return err
+		}
+		result, err := tx.Exec("DELETE FROM products WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		if count, _ := result.RowsAffected(); count == 0 {
+			return models.ErrProductNotFound
+		}
+		return AuditTx(ctx, tx, ActionDelete, "product", id, "Deleted product "+old.Name, old, nil)
+	})
+}
+
+//
+// Categories
+//
+
+// UpdateCategory updates a category's name, description and parent
+func UpdateCategory(ctx context.Context, category models.Category) error {
+	if category.Name == "" {
+		return fmt.Errorf("category name is required")
+	}
+	if category.ParentID == category.ID && category.ID != 0 {
+		return fmt.Errorf("a category cannot be its own parent")
+	}
+	old, err := GetCategoryByID(category.ID)
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		if category.ParentID > 0 {
+			if err := checkExists(tx, "categories", category.ParentID, "parent category"); err != nil {
+				return err
+			}
+		}
+
+		err := execUpdate(tx, ErrCategoryNotFound,
+			"UPDATE categories SET name = ?, description = ?, parent_id = ?, updated_at = ? WHERE id = ?",
+			category.Name, category.Description, category.ParentID, time.Now(), category.ID,
+		)
+		if err != nil {
+			return err
+		}
+		return AuditTx(ctx, tx, ActionUpdate, "category", category.ID, "Updated category "+category.Name, old, category)
+	})
+}
+
+// DeleteCategory deletes a category that no product, subcategory or commission rule uses.
+// The default category cannot be deleted.
+func DeleteCategory(ctx context.Context, id int) error {
+	if id == 1 {
+		return fmt.Errorf("%w: the default category cannot be deleted", ErrInUse)
+	}
+
+	old, err := GetCategoryByID(id)
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		err := checkUnused(tx, id,
+			reference{"products", "category_id", "products"},
+			reference{"categories", "parent_id", "subcategories"},
+			reference{"commission_rules", "category_id", "commission rules"},
+		)
+		if err != nil {
+			return err
+		}
+
+		err = execUpdate(tx, ErrCategoryNotFound, "DELETE FROM categories WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		return AuditTx(ctx, tx, ActionDelete, "category", id, "Deleted category "+old.Name, old, nil)
+	})
+}
+
+//
+// Suppliers
+//
+
+// UpdateSupplier updates all fields of a supplier
+func UpdateSupplier(ctx context.Context, supplier models.Supplier) error {
+	if supplier.Name == "" {
+		return fmt.Errorf("supplier name is required")
+	}
+	old, err := GetSupplierByID(supplier.ID)
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		err := execUpdate(tx, ErrSupplierNotFound,
+			`UPDATE suppliers
+			 SET name = ?, contact = ?, email = ?, phone = ?, address = ?, notes = ?, is_active = ?, updated_at = ?
+			 WHERE id = ?`,
+			supplier.Name, supplier.Contact, supplier.Email, supplier.Phone, supplier.Address,
+			supplier.Notes, supplier.IsActive, time.Now(), supplier.ID,
+		)
+		if err != nil {
+			return err
+		}
+		return AuditTx(ctx, tx, ActionUpdate, "supplier", supplier.ID, "Updated supplier "+supplier.Name, old, supplier)
+	})
+}
+
+// DeleteSupplier deletes a supplier that no product or batch refers to. The default
+// supplier cannot be deleted.
+func DeleteSupplier(ctx context.Context, id int) error {
+	if id == 1 {
+		return fmt.Errorf("%w: the default supplier cannot be deleted", ErrInUse)
+	}
+
+	old, err := GetSupplierByID(id)
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		err := checkUnused(tx, id,
+			reference{"products", "default_supplier_id", "products"},
+			reference{"product_batches", "supplier_id", "batches"},
+		)
+		if err != nil {
+			return err
+		}
+
+		err = execUpdate(tx, ErrSupplierNotFound, "DELETE FROM suppliers WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		return AuditTx(ctx, tx, ActionDelete, "supplier", id, "Deleted supplier "+old.Name, old, nil)
+	})
+}
+
+//
+// Locations
+//
+
+// UpdateLocation updates all fields of a location
+func UpdateLocation(ctx context.Context, location models.Location) error {
+	if location.Name == "" {
+		return fmt.Errorf("location name is required")
+	}
+	old, err := GetLocationByID(location.ID)
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		err := execUpdate(tx, ErrLocationNotFound,
+			"UPDATE locations SET name = ?, address = ?, description = ?, is_active = ?, updated_at = ? WHERE id = ?",
+			location.Name, location.Address, location.Description, location.IsActive, time.Now(), location.ID,
+		)
+		if err != nil {
+			return err
+		}
+		return AuditTx(ctx, tx, ActionUpdate, "location", location.ID, "Updated location "+location.Name, old, location)
+	})
+}
+
+// DeleteLocation deletes a location that holds no batches
+func DeleteLocation(ctx context.Context, id int) error {
+	old, err := GetLocationByID(id)
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		err := checkUnused(tx, id, reference{"product_batches", "location_id", "batches"})
+		if err != nil {
+			return err
+		}
+
+		var stock int
+		err = tx.QueryRow("SELECT COALESCE(SUM(quantity), 0) FROM product_locations WHERE location_id = ?", id).Scan(&stock)
+		if err != nil {
+			return err
+		}
+		if stock > 0 {
+			return fmt.Errorf("%w: %d items are stocked at this location", ErrInUse, stock)
+		}
+
+		if _, err := tx.Exec("DELETE FROM product_locations WHERE location_id = ?", id); err != nil {
+			return err
+		}
+		err = execUpdate(tx, ErrLocationNotFound, "DELETE FROM locations WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		return AuditTx(ctx, tx, ActionDelete, "location", id, "Deleted location "+old.Name, old, nil)
+	})
+}
+
+//
+// Batches
+//
+
+// batchColumns are the columns read by scanBatch
+const batchColumns = `id, product_id, location_id, supplier_id, quantity, batch_number,
+	expiry_date, manufacture_date, cost_price, receipt_date, created_at, updated_at`
+
+// GetAllBatches retrieves the batches of every product, soonest expiry first
+func GetAllBatches() ([]models.ProductBatch, error) {
+	rows, err := DB.Query("SELECT " + batchColumns + " FROM product_batches ORDER BY expiry_date, created_at")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query product batches: %w", err)
+	}
+	defer rows.Close()
+
+	var batches []models.ProductBatch
+	for rows.Next() {
+		batch, err := scanBatch(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan product batch: %w", err)
+		}
+		batches = append(batches, batch)
+	}
+
+	return batches, rows.Err()
+}
+
+// GetBatchByID retrieves a product batch by its ID
+func GetBatchByID(id int) (models.ProductBatch, error) {
+	batch, err := scanBatch(DB.QueryRow("SELECT "+batchColumns+" FROM product_batches WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return models.ProductBatch{}, ErrBatchNotFound
+	}
+	if err != nil {
+		return models.ProductBatch{}, fmt.Errorf("failed to get product batch: %w", err)
+	}
+	return batch, nil
+}
+
+// UpdateBatch updates a batch. A change of quantity is applied to the product's stock
+// and its stock at the batch's location. The product, location and supplier of a batch
+// cannot be changed.
+func UpdateBatch(ctx context.Context, batch models.ProductBatch) error {
+	if batch.Quantity <= 0 {
+		return fmt.Errorf("quantity must be greater than zero")
+	}
+	old, err := GetBatchByID(batch.ID)
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		var productID, locationID, quantity int
+		err := tx.QueryRow(
+			"SELECT product_id, location_id, quantity FROM product_batches WHERE id = ?", batch.ID,
+		).Scan(&productID, &locationID, &quantity)
+		if err == sql.ErrNoRows {
+			return ErrBatchNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err := adjustBatchStock(tx, productID, locationID, batch.Quantity-quantity, now); err != nil {
+			return err
+		}
+
+		err = execUpdate(tx, ErrBatchNotFound,
+			`UPDATE product_batches
+			 SET quantity = ?, batch_number = ?, expiry_date = ?, manufacture_date = ?, cost_price = ?,
+			     receipt_date = ?, updated_at = ?
+			 WHERE id = ?`,
+			batch.Quantity, batch.BatchNumber, batch.ExpiryDate, batch.ManufactureDate, batch.CostPrice,
+			batch.ReceiptDate, now, batch.ID,
+		)
+		if err != nil {
+			return err
+		}
+
+		// The product, location and supplier are kept
+		batch.ProductID, batch.LocationID, batch.SupplierID = old.ProductID, old.LocationID, old.SupplierID
+		return AuditTx(ctx, tx, ActionInventory, "batch", batch.ID, "Updated batch "+batch.BatchNumber, old, batch)
+	})
+}
+
+// DeleteBatch deletes a batch and removes its quantity from stock, for example when it
+// was received in error
+func DeleteBatch(ctx context.Context, id int) error {
+	old, err := GetBatchByID(id)
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		var productID, locationID, quantity int
+		err := tx.QueryRow(
+			"SELECT product_id, location_id, quantity FROM product_batches WHERE id = ?", id,
+		).Scan(&productID, &locationID, &quantity)
+		if err == sql.ErrNoRows {
+			return ErrBatchNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := adjustBatchStock(tx, productID, locationID, -quantity, time.Now()); err != nil {
+			return err
+		}
+		err = execUpdate(tx, ErrBatchNotFound, "DELETE FROM product_batches WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		return AuditTx(ctx, tx, ActionInventory, "batch", id, "Deleted batch "+old.BatchNumber, old, nil)
+	})
+}
+
+// adjustBatchStock changes a product's stock and its stock at a location by delta. Stock
+// that has already been sold cannot be removed.
+func adjustBatchStock(tx *sql.Tx, productID, locationID, delta int, now time.Time) error {
+	if delta == 0 {
+		return nil
+	}
+
+	var stock int
+	if err := tx.QueryRow("SELECT stock FROM products WHERE id = ?", productID).Scan(&stock); err != nil {
+		return err
+	}
+	if stock+delta < 0 {
+		return fmt.Errorf("%w: only %d of the product are in stock", ErrInUse, stock)
+	}
+
+	if _, err := tx.Exec("UPDATE products SET stock = stock + ?, updated_at = ? WHERE id = ?", delta, now, productID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
+		"UPDATE product_locations SET quantity = MAX(quantity + ?, 0), updated_at = ? WHERE product_id = ? AND location_id = ?",
+		delta, now, productID, locationID,
+	)
+	return err
+}
+
+// scanBatch scans a product batch from a row
+func scanBatch(scanner interface{ Scan(...interface{}) error }) (models.ProductBatch, error) {
+	var batch models.ProductBatch
+	err := scanner.Scan(
+		&batch.ID,
+		&batch.ProductID,
+		&batch.LocationID,
+		&batch.SupplierID,
+		&batch.Quantity,
+		&batch.BatchNumber,
+		&batch.ExpiryDate,
+		&batch.ManufactureDate,
+		&batch.CostPrice,
+		&batch.ReceiptDate,
+		&batch.CreatedAt,
+		&batch.UpdatedAt,
+	)
+	return batch, err
+}
@@ -0,0 +1,268 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"termpos/internal/security"
+)
+
+var (
+	ErrDatabaseEncrypted    = errors.New("the database is encrypted, set POS_DB_KEY or POS_DB_PASSPHRASE to open it")
+	ErrDatabaseNotEncrypted = errors.New("the database is not encrypted")
+	ErrWrongDatabaseKey     = errors.New("the database key is wrong, or the file is not a database")
+	ErrCipherUnavailable    = errors.New("this build cannot encrypt databases, build it against SQLCipher with -tags libsqlite3")
+)
+
+// sqliteHeader starts every database file that is not encrypted. SQLCipher starts
+// encrypted files with the salt of their key instead.
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// databaseKey is the SQLCipher key of the open database, as a raw key literal, or "" when
+// it is not encrypted
+var databaseKey string
+
+// rawKey returns the SQLCipher literal of a key and the salt the database keeps it with
+func rawKey(key, salt []byte) string {
+	return fmt.Sprintf("x'%s%s'", hex.EncodeToString(key), hex.EncodeToString(salt))
+}
+
+// keyedDSN returns the URI a database file is opened with its key by. The key must be set
+// before anything is read, so SQLCipher reads it from the URI as each connection is opened.
+func keyedDSN(path, key string) string {
+	return fileURI(path) + "?key=" + url.QueryEscape(key)
+}
+
+// fileURI returns the URI of a database file, to which parameters can be added
+func fileURI(path string) string {
+	return "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+}
+
+// databaseSalt reads the salt of a database file. It returns nil for a database that is
+// not encrypted, or that does not exist yet.
+func databaseSalt(path string) ([]byte, error) {
+	if path == ":memory:" || strings.HasPrefix(path, "file:") {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer file.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(file, header); err != nil {
+		// An empty file is a database that has not been written yet
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read database header: %w", err)
+	}
+	if bytes.Equal(header, sqliteHeader) {
+		return nil, nil
+	}
+	return header[:security.SaltSize], nil
+}
+
+// isNewDatabaseFile reports whether a database file has not been written yet
+func isNewDatabaseFile(path string) bool {
+	if path == ":memory:" || strings.HasPrefix(path, "file:") {
+		return false
+	}
+	info, err := os.Stat(path)
+	return os.IsNotExist(err) || (err == nil && info.Size() == 0)
+}
+
+// IsDatabaseFileEncrypted reports whether a database file, such as a backup, is encrypted
+func IsDatabaseFileEncrypted(path string) (bool, error) {
+	salt, err := databaseSalt(path)
+	return salt != nil, err
+}
+
+// IsDatabaseEncrypted reports whether the open database is encrypted
+func IsDatabaseEncrypted() bool {
+	return databaseKey != ""
+}
+
+// openDatabase opens a database file, with its key when it is encrypted. New databases
+// are encrypted when a database key is configured. It returns the key of the database, or
+// "" when it is not encrypted.
+func openDatabase(path string) (*sql.DB, string, error) {
+	salt, err := databaseSalt(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if salt == nil {
+		if !security.DatabaseKeyConfigured() || !isNewDatabaseFile(path) {
+			db, err := sql.Open("sqlite3", path)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to open database: %w", err)
+			}
+			return db, "", nil
+		}
+
+		salt = make([]byte, security.SaltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, "", fmt.Errorf("failed to generate salt: %w", err)
+		}
+	} else if !security.DatabaseKeyConfigured() {
+		return nil, "", ErrDatabaseEncrypted
+	}
+
+	key, err := security.DatabaseKey(salt)
+	if err != nil {
+		return nil, "", err
+	}
+	literal := rawKey(key, salt)
+	db, err := sql.Open("sqlite3", keyedDSN(path, literal))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open database: %w", err)
+	}
+	return db, literal, nil
+}
+
+// checkCipher fails when the SQLite library is not SQLCipher
+func checkCipher() error {
+	probe, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer probe.Close()
+
+	var version string
+	if err := probe.QueryRow("PRAGMA cipher_version").Scan(&version); err != nil || version == "" {
+		return ErrCipherUnavailable
+	}
+	return nil
+}
+
+// checkDatabaseKey fails when an encrypted database cannot be read with its key
+func checkDatabaseKey(db *sql.DB) error {
+	if err := checkCipher(); err != nil {
+		return err
+	}
+
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables); err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrNotADB {
+			return ErrWrongDatabaseKey
+		}
+		return fmt.Errorf("failed to read database: %w", err)
+	}
+	return nil
+}
+
+// exportDatabase copies the open database to a new file encrypted with key, or not
+// encrypted when key is ""
+func exportDatabase(path, key string) error {
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to export database: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS export KEY ?", path, key); err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	_, err = conn.ExecContext(ctx, "SELECT sqlcipher_export('export')")
+	if _, detachErr := conn.ExecContext(ctx, "DETACH DATABASE export"); err == nil && detachErr != nil {
+		err = detachErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to export database: %w", err)
+	}
+	return nil
+}
+
+// EncryptDatabase encrypts the open database in place with the configured database key,
+// replacing the database file and its WAL files with an encrypted copy
+func EncryptDatabase(ctx context.Context) error {
+	if IsDatabaseEncrypted() {
+		return fmt.Errorf("the database is already encrypted")
+	}
+	if err := checkCipher(); err != nil {
+		return err
+	}
+
+	salt := make([]byte, security.SaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key, err := security.DatabaseKey(salt)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceDatabase(rawKey(key, salt)); err != nil {
+		return err
+	}
+	return Transaction(func(tx *sql.Tx) error {
+		return AuditTx(ctx, tx, ActionEncrypt, "database", "", "Encrypted the database", nil, nil)
+	})
+}
+
+// DecryptDatabase decrypts the open database in place, replacing the database file and
+// its WAL files with a copy that is not encrypted
+func DecryptDatabase(ctx context.Context) error {
+	if !IsDatabaseEncrypted() {
+		return ErrDatabaseNotEncrypted
+	}
+
+	if err := replaceDatabase(""); err != nil {
+		return err
+	}
+	return Transaction(func(tx *sql.Tx) error {
+		return AuditTx(ctx, tx, ActionDecrypt, "database", "", "Decrypted the database", nil, nil)
+	})
+}
+
+// replaceDatabase exports the open database to a copy encrypted with key, replaces the
+// database file with it and opens it again
+func replaceDatabase(key string) error {
+	path := GetDatabasePath()
+	temp := path + ".tmp"
+	os.Remove(temp)
+
+	if err := exportDatabase(temp, key); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	// The WAL files belong to the old file, and must not be applied to the new one
+	if _, err := DB.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("failed to checkpoint database: %w", err)
+	}
+	if err := CloseDB(); err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("failed to close database: %w", err)
+	}
+	if err := os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		if initErr := Initialize(path); initErr != nil {
+			fmt.Printf("Warning: Failed to reopen database: %v\n", initErr)
+		}
+		return fmt.Errorf("failed to replace database: %w", err)
+	}
+	os.Remove(path + "-wal")
+	os.Remove(path + "-shm")
+
+	return Initialize(path)
+}
@@ -1,22 +1,27 @@
 package db
 
 import (
+        "context"
         "database/sql"
+        "errors"
         "fmt"
         "time"
 
         "termpos/internal/models"
 )
 
+// ErrCustomerNotFound is returned when a customer does not exist
+var ErrCustomerNotFound = errors.New("customer not found")
+
 // AddCustomer adds a new customer to the database
-func AddCustomer(customer models.Customer) (int, error) {
+func AddCustomer(ctx context.Context, customer models.Customer) (int, error) {
         var id int64
         now := time.Now()
         
-        // Format birthday as string (empty if not provided)
-        birthday := sql.NullString{
-                String: customer.Birthday,
-                Valid:  customer.Birthday != "",
+        // Encrypt the personal data before the transaction, the first data key may have to be stored
+        pii, err := sealPIIFields(customer.Email, customer.Phone, customer.Address, customer.Birthday)
+        if err != nil {
+                return 0, fmt.Errorf("failed to add customer: %w", err)
         }
 
         // If join date not specified, use current time
@@ -29,45 +34,44 @@ func AddCustomer(customer models.Customer) (int, error) {
                 INSERT INTO customers (
                         name, email, phone, address, join_date, notes, 
                         loyalty_points, loyalty_tier, birthday, preferred_products,
-                        created_at, updated_at
+                        email_bidx, phone_bidx, created_at, updated_at
                 )
-                VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+                VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
                 RETURNING id
         `
 
-        err := DB.QueryRow(
-                query,
-                customer.Name,
-                customer.Email,
-                customer.Phone,
-                customer.Address,
-                joinDate,
-                customer.Notes,
-                customer.LoyaltyPoints,
-                customer.LoyaltyTier,
-                birthday,
-                customer.PreferredProducts,
-                now,
-                now,
-        ).Scan(&id)
+        err = Transaction(func(tx *sql.Tx) error {
+                err := tx.QueryRow(
+                        query,
+                        customer.Name,
+                        pii.email,
+                        pii.phone,
+                        pii.address,
+                        joinDate,
+                        customer.Notes,
+                        customer.LoyaltyPoints,
+                        customer.LoyaltyTier,
+                        pii.other,
+                        customer.PreferredProducts,
+                        pii.emailIndex,
+                        pii.phoneIndex,
+                        now,
+                        now,
+                ).Scan(&id)
+                if err != nil {
+                        return err
+                }
+
+                customer.ID = int(id)
+                customer.JoinDate = joinDate
+                customer.CreatedAt, customer.UpdatedAt = now, now
+                return AuditTx(ctx, tx, ActionCreate, "customer", id, "Created customer "+customer.Name, nil, redactCustomerPII(customer))
+        })
 
         if err != nil {
                 return 0, fmt.Errorf("failed to add customer: %w", err)
         }
 
-        // Add audit log
-        AddAuditLog(
-                "system", 
-                ActionCreate, 
-                "customers", 
-                fmt.Sprintf("%d", id), 
-                fmt.Sprintf("Created new customer: %s", customer.Name),
-                "", 
-                "", 
-                "",
-                "",
-        )
-
         return int(id), nil
 }
 
@@ -77,12 +81,14 @@ func GetCustomer(id int) (models.Customer, error) {
         var email, phone, address, notes, preferredProducts sql.NullString
         var birthday sql.NullString
         var lastPurchaseDate sql.NullTime
+        var emailConsentAt, smsConsentAt, anonymizedAt sql.NullTime
 
         query := `
                 SELECT 
                         id, name, email, phone, address, join_date, last_purchase_date,
                         total_purchases, notes, loyalty_points, loyalty_tier, birthday, 
-                        preferred_products, created_at, updated_at
+                        preferred_products, created_at, updated_at,
+                        email_consent, email_consent_at, sms_consent, sms_consent_at, anonymized_at
                 FROM customers
                 WHERE id = ?
         `
@@ -103,11 +109,16 @@ func GetCustomer(id int) (models.Customer, error) {
                 &preferredProducts,
                 &customer.CreatedAt,
                 &customer.UpdatedAt,
+                &customer.EmailConsent,
+                &emailConsentAt,
+                &customer.SMSConsent,
+                &smsConsentAt,
+                &anonymizedAt,
         )
 
         if err != nil {
                 if err == sql.ErrNoRows {
-                        return models.Customer{}, fmt.Errorf("customer not found")
+                        return models.Customer{}, ErrCustomerNotFound
                 }
                 return models.Customer{}, fmt.Errorf("failed to get customer: %w", err)
         }
@@ -134,30 +145,45 @@ func GetCustomer(id int) (models.Customer, error) {
         if lastPurchaseDate.Valid {
                 customer.LastPurchaseDate = lastPurchaseDate.Time
         }
+        if emailConsentAt.Valid {
+                customer.EmailConsentAt = emailConsentAt.Time
+        }
+        if smsConsentAt.Valid {
+                customer.SMSConsentAt = smsConsentAt.Time
+        }
+        if anonymizedAt.Valid {
+                customer.AnonymizedAt = anonymizedAt.Time
+        }
+
+        if err := openCustomerPII(&customer); err != nil {
+                return models.Customer{}, err
+        }
 
         return customer, nil
 }
 
-// GetCustomerByPhone retrieves a customer by phone number
+// GetCustomerByPhone retrieves a customer by phone number, by its blind index once
+// phone numbers are encrypted
 func GetCustomerByPhone(phone string) (models.Customer, error) {
         var id int
-        err := DB.QueryRow("SELECT id FROM customers WHERE phone = ?", phone).Scan(&id)
+        err := DB.QueryRow("SELECT id FROM customers WHERE phone_bidx = ? OR phone = ?", piiIndex("phone", phone), phone).Scan(&id)
         if err != nil {
                 if err == sql.ErrNoRows {
-                        return models.Customer{}, fmt.Errorf("customer not found")
+                        return models.Customer{}, ErrCustomerNotFound
                 }
                 return models.Customer{}, fmt.Errorf("failed to find customer by phone: %w", err)
         }
         return GetCustomer(id)
 }
 
-// GetCustomerByEmail retrieves a customer by email
+// GetCustomerByEmail retrieves a customer by email, by its blind index once email
+// addresses are encrypted
 func GetCustomerByEmail(email string) (models.Customer, error) {
         var id int
-        err := DB.QueryRow("SELECT id FROM customers WHERE email = ?", email).Scan(&id)
+        err := DB.QueryRow("SELECT id FROM customers WHERE email_bidx = ? OR email = ?", piiIndex("email", email), email).Scan(&id)
         if err != nil {
                 if err == sql.ErrNoRows {
-                        return models.Customer{}, fmt.Errorf("customer not found")
+                        return models.Customer{}, ErrCustomerNotFound
                 }
                 return models.Customer{}, fmt.Errorf("failed to find customer by email: %w", err)
         }
@@ -165,13 +191,17 @@ func GetCustomerByEmail(email string) (models.Customer, error) {
 }
 
 // UpdateCustomer updates customer information
-func UpdateCustomer(customer models.Customer) error {
+func UpdateCustomer(ctx context.Context, customer models.Customer) error {
+        old, err := GetCustomer(customer.ID)
+        if err != nil {
+                return err
+        }
         now := time.Now()
         
-        // Format birthday as string (empty if not provided)
-        birthday := sql.NullString{
-                String: customer.Birthday,
-                Valid:  customer.Birthday != "",
+        // Encrypt the personal data before the transaction, the first data key may have to be stored
+        pii, err := sealPIIFields(customer.Email, customer.Phone, customer.Address, customer.Birthday)
+        if err != nil {
+                return fmt.Errorf("failed to update customer: %w", err)
         }
 
         query := `
@@ -185,79 +215,70 @@ func UpdateCustomer(customer models.Customer) error {
                         loyalty_tier = ?,
                         birthday = ?,
                         preferred_products = ?,
+                        email_bidx = ?,
+                        phone_bidx = ?,
                         updated_at = ?
                 WHERE id = ?
         `
 
-        _, err := DB.Exec(
-                query,
-                customer.Name,
-                customer.Email,
-                customer.Phone,
-                customer.Address,
-                customer.Notes,
-                customer.LoyaltyPoints,
-                customer.LoyaltyTier,
-                birthday,
-                customer.PreferredProducts,
-                now,
-                customer.ID,
-        )
+        err = Transaction(func(tx *sql.Tx) error {
+                _, err := tx.Exec(
+                        query,
+                        customer.Name,
+                        pii.email,
+                        pii.phone,
+                        pii.address,
+                        customer.Notes,
+                        customer.LoyaltyPoints,
+                        customer.LoyaltyTier,
+                        pii.other,
+                        customer.PreferredProducts,
+                        pii.emailIndex,
+                        pii.phoneIndex,
+                        now,
+                        customer.ID,
+                )
+                if err != nil {
+                        return err
+                }
+
+                customer.UpdatedAt = now
+                err = AuditTx(ctx, tx, ActionUpdate, "customer", customer.ID, "Updated customer "+customer.Name, redactCustomerPII(old), redactCustomerPII(customer))
+                if err != nil {
+                        return err
+                }
+                return PublishEventTx(tx, models.EventCustomerUpdated, redactCustomerPII(customer))
+        })
 
         if err != nil {
                 return fmt.Errorf("failed to update customer: %w", err)
         }
 
-        // Add audit log
-        AddAuditLog(
-                "system", 
-                ActionUpdate, 
-                "customers", 
-                fmt.Sprintf("%d", customer.ID), 
-                fmt.Sprintf("Updated customer: %s", customer.Name),
-                "", 
-                "", 
-                "",
-                "",
-        )
-
         return nil
 }
 
 // DeleteCustomer deletes a customer
-func DeleteCustomer(id int) error {
-        // Get customer name for audit log
-        var name string
-        err := DB.QueryRow("SELECT name FROM customers WHERE id = ?", id).Scan(&name)
+func DeleteCustomer(ctx context.Context, id int) error {
+        old, err := GetCustomer(id)
         if err != nil {
                 return fmt.Errorf("failed to find customer: %w", err)
         }
 
-        _, err = DB.Exec("DELETE FROM customers WHERE id = ?", id)
+        err = Transaction(func(tx *sql.Tx) error {
+                if _, err := tx.Exec("DELETE FROM customers WHERE id = ?", id); err != nil {
+                        return err
+                }
+                return AuditTx(ctx, tx, ActionDelete, "customer", id, "Deleted customer "+old.Name, redactCustomerPII(old), nil)
+        })
         if err != nil {
                 return fmt.Errorf("failed to delete customer: %w", err)
         }
 
-        // Add audit log
-        AddAuditLog(
-                "system", 
-                ActionDelete, 
-                "customers", 
-                fmt.Sprintf("%d", id), 
-                fmt.Sprintf("Deleted customer: %s", name),
-                "", 
-                "", 
-                "",
-                "",
-        )
-
         return nil
 }
 
 // ListCustomers lists all customers with optional filtering
 func ListCustomers(filter string, limit, offset int) ([]models.CustomerSummary, error) {
-        var customers []models.CustomerSummary
-        
         // Base query
         query := `
                 SELECT 
@@ -268,9 +289,9 @@ func ListCustomers(filter string, limit, offset int) ([]models.CustomerSummary,
         // Apply filters if provided
         params := []interface{}{}
         if filter != "" {
-                query += " WHERE name LIKE ? OR phone LIKE ? OR email LIKE ?"
-                filterParam := "%" + filter + "%"
-                params = append(params, filterParam, filterParam, filterParam)
+                condition, filterParams := customerMatch(filter)
+                query += " WHERE " + condition
+                params = append(params, filterParams...)
         }
         
         // Apply ordering
@@ -293,6 +314,13 @@ func ListCustomers(filter string, limit, offset int) ([]models.CustomerSummary,
         }
         defer rows.Close()
         
+        return scanCustomerSummaries(rows)
+}
+
+// scanCustomerSummaries reads customer summaries from rows, decrypting their personal data
+func scanCustomerSummaries(rows *sql.Rows) ([]models.CustomerSummary, error) {
+        var customers []models.CustomerSummary
+
         for rows.Next() {
                 var customer models.CustomerSummary
                 var email, phone sql.NullString
@@ -320,45 +348,40 @@ func ListCustomers(filter string, limit, offset int) ([]models.CustomerSummary,
                 customers = append(customers, customer)
         }
         
+        if err := openCustomerSummaries(customers); err != nil {
+                return nil, err
+        }
+        
         return customers, nil
 }
 
 // LinkSaleToCustomer associates a sale with a customer and updates loyalty points
-func LinkSaleToCustomer(saleID, customerID, pointsEarned, pointsUsed int, rewardID int) error {
-        // Use the centralized retry logic
-        return WithRetry(func() error {
-                return linkSaleToCustomerWithTransaction(saleID, customerID, pointsEarned, pointsUsed, rewardID)
+func LinkSaleToCustomer(ctx context.Context, saleID, customerID, pointsEarned, pointsUsed int, rewardID int) error {
+        return Transaction(func(tx *sql.Tx) error {
+                return LinkSaleToCustomerTx(ctx, tx, saleID, customerID, pointsEarned, pointsUsed, rewardID)
         })
 }
 
-// linkSaleToCustomerWithTransaction performs the actual database operations within a transaction
-func linkSaleToCustomerWithTransaction(saleID, customerID, pointsEarned, pointsUsed int, rewardID int) error {
-        // Begin transaction
-        tx, err := DB.Begin()
-        if err != nil {
-                return fmt.Errorf("failed to start transaction: %w", err)
-        }
-        
+// LinkSaleToCustomerTx associates a sale with a customer and updates loyalty points
+// inside an existing transaction, so it commits or rolls back together with the sale
+func LinkSaleToCustomerTx(ctx context.Context, tx *sql.Tx, saleID, customerID, pointsEarned, pointsUsed int, rewardID int) error {
         // Record the customer sale link
-        _, err = tx.Exec(
+        _, err := tx.Exec(
                 "INSERT INTO customer_sales (sale_id, customer_id, points_earned, points_used, reward_id, created_at) VALUES (?, ?, ?, ?, ?, ?)",
                 saleID, customerID, pointsEarned, pointsUsed, rewardID, time.Now(),
         )
         if err != nil {
-                tx.Rollback()
                 return fmt.Errorf("failed to link sale to customer: %w", err)
         }
         
         // Get current customer points
-        var currentPoints int
-        err = tx.QueryRow("SELECT loyalty_points FROM customers WHERE id = ?", customerID).Scan(&currentPoints)
+        old, err := getLoyaltyBalance(tx, customerID)
         if err != nil {
-                tx.Rollback()
-                return fmt.Errorf("failed to get customer points: %w", err)
+                return err
         }
         
         // Update customer points (add earned, subtract used)
-        newPoints := currentPoints + pointsEarned - pointsUsed
+        newPoints := old.LoyaltyPoints + pointsEarned - pointsUsed
         if newPoints < 0 {
                 newPoints = 0 // Prevent negative points
         }
@@ -367,7 +390,6 @@ func linkSaleToCustomerWithTransaction(saleID, customerID, pointsEarned, pointsU
         var saleAmount float64
         err = tx.QueryRow("SELECT total FROM sales WHERE id = ?", saleID).Scan(&saleAmount)
         if err != nil {
-                tx.Rollback()
                 return fmt.Errorf("failed to get sale amount: %w", err)
         }
         
@@ -386,17 +408,90 @@ func linkSaleToCustomerWithTransaction(saleID, customerID, pointsEarned, pointsU
                 customerID,
         )
         if err != nil {
-                tx.Rollback()
                 return fmt.Errorf("failed to update customer points: %w", err)
         }
         
-        // Commit transaction
-        err = tx.Commit()
+        balance, err := getLoyaltyBalance(tx, customerID)
+        if err != nil {
+                return err
+        }
+        description := fmt.Sprintf("Linked sale %d to customer %d: %d points earned, %d points used", saleID, customerID, pointsEarned, pointsUsed)
+        return AuditTx(ctx, tx, ActionUpdate, "customer", customerID, description, old, balance)
+}
+
+// loyaltyBalance is a customer's loyalty standing, recorded in the audit log when it changes
+type loyaltyBalance struct {
+        LoyaltyPoints  int     `json:"loyalty_points"`
+        LoyaltyTier    string  `json:"loyalty_tier"`
+        TotalPurchases float64 `json:"total_purchases"`
+}
+
+// getLoyaltyBalance reads a customer's loyalty standing within a transaction
+func getLoyaltyBalance(tx *sql.Tx, customerID int) (loyaltyBalance, error) {
+        var balance loyaltyBalance
+        err := tx.QueryRow(
+                "SELECT loyalty_points, COALESCE(loyalty_tier, ''), COALESCE(total_purchases, 0) FROM customers WHERE id = ?",
+                customerID,
+        ).Scan(&balance.LoyaltyPoints, &balance.LoyaltyTier, &balance.TotalPurchases)
+        if err != nil {
+                return loyaltyBalance{}, fmt.Errorf("failed to get customer points: %w", err)
+        }
+        return balance, nil
+}
+
+// ReverseCustomerSaleTx reverses the loyalty points and purchase total a sale added to its
+// customer, for use when the sale is refunded. Sales without a customer are ignored.
+func ReverseCustomerSaleTx(ctx context.Context, tx *sql.Tx, saleID int) error {
+        var customerID, pointsEarned, pointsUsed int
+        err := tx.QueryRow(
+                "SELECT customer_id, points_earned, points_used FROM customer_sales WHERE sale_id = ?",
+                saleID,
+        ).Scan(&customerID, &pointsEarned, &pointsUsed)
+        if err == sql.ErrNoRows {
+                return nil
+        }
+        if err != nil {
+                return fmt.Errorf("failed to get customer sale: %w", err)
+        }
+        
+        old, err := getLoyaltyBalance(tx, customerID)
         if err != nil {
-                return fmt.Errorf("failed to commit transaction: %w", err)
+                return err
         }
         
-        return nil
+        // Take back earned points and return the points spent on the sale
+        newPoints := old.LoyaltyPoints - pointsEarned + pointsUsed
+        if newPoints < 0 {
+                newPoints = 0
+        }
+        
+        var saleAmount float64
+        err = tx.QueryRow("SELECT total FROM sales WHERE id = ?", saleID).Scan(&saleAmount)
+        if err != nil {
+                return fmt.Errorf("failed to get sale amount: %w", err)
+        }
+        
+        _, err = tx.Exec(
+                `UPDATE customers SET 
+                        loyalty_points = ?, 
+                        loyalty_tier = ?,
+                        total_purchases = MAX(total_purchases - ?, 0)
+                 WHERE id = ?`,
+                newPoints,
+                models.GetLoyaltyTierName(newPoints),
+                saleAmount,
+                customerID,
+        )
+        if err != nil {
+                return fmt.Errorf("failed to update customer points: %w", err)
+        }
+        
+        balance, err := getLoyaltyBalance(tx, customerID)
+        if err != nil {
+                return err
+        }
+        description := fmt.Sprintf("Reversed sale %d for customer %d: %d points taken back, %d points returned", saleID, customerID, pointsEarned, pointsUsed)
+        return AuditTx(ctx, tx, ActionUpdate, "customer", customerID, description, old, balance)
 }
 
 // GetLoyaltyRewards retrieves all available loyalty rewards
@@ -467,31 +562,91 @@ func GetLoyaltyReward(id int) (models.LoyaltyReward, error) {
 }
 
 // RedeemLoyaltyReward uses customer points to redeem a reward
-func RedeemLoyaltyReward(customerID, rewardID int) (models.LoyaltyReward, error) {
+func RedeemLoyaltyReward(ctx context.Context, customerID, rewardID int) (models.LoyaltyReward, error) {
         var reward models.LoyaltyReward
         
-        // Use the centralized retry logic
-        err := WithRetry(func() error {
-                var err error
-                reward, err = redeemLoyaltyRewardWithTransaction(customerID, rewardID)
-                return err
+        err := Transaction(func(tx *sql.Tx) error {
+                // Get reward details
+                reward = models.LoyaltyReward{}
+                err := tx.QueryRow(
+                        "SELECT id, name, description, points_cost, discount_value, is_percentage, valid_days, active FROM loyalty_rewards WHERE id = ?",
+                        rewardID,
+                ).Scan(
+                        &reward.ID,
+                        &reward.Name,
+                        &reward.Description,
+                        &reward.PointsCost,
+                        &reward.DiscountValue,
+                        &reward.IsPercentage,
+                        &reward.ValidDays,
+                        &reward.Active,
+                )
+                if err != nil {
+                        return fmt.Errorf("failed to get reward: %w", err)
+                }
+                
+                // Verify reward is active
+                if !reward.Active {
+                        return fmt.Errorf("this reward is no longer active")
+                }
+                
+                // Check if customer has enough points
+                old, err := getLoyaltyBalance(tx, customerID)
+                if err != nil {
+                        return err
+                }
+                if old.LoyaltyPoints < reward.PointsCost {
+                        return fmt.Errorf("insufficient loyalty points")
+                }
+                
+                // Deduct points from customer
+                now := time.Now()
+                _, err = tx.Exec(
+                        "UPDATE customers SET loyalty_points = ?, updated_at = ? WHERE id = ?",
+                        old.LoyaltyPoints-reward.PointsCost, now, customerID,
+                )
+                if err != nil {
+                        return fmt.Errorf("failed to update customer points: %w", err)
+                }
+                
+                // Record redemption in redemption history table
+                _, err = tx.Exec(
+                        "INSERT INTO loyalty_redemptions (customer_id, reward_id, points_used, redeemed_at, expiry_date) VALUES (?, ?, ?, ?, ?)",
+                        customerID, rewardID, reward.PointsCost, now, now.AddDate(0, 0, reward.ValidDays),
+                )
+                if err != nil {
+                        return fmt.Errorf("failed to record redemption: %w", err)
+                }
+                
+                balance, err := getLoyaltyBalance(tx, customerID)
+                if err != nil {
+                        return err
+                }
+                description := fmt.Sprintf("Redeemed reward %q (%d) for customer %d: %d points used", reward.Name, reward.ID, customerID, reward.PointsCost)
+                return AuditTx(ctx, tx, ActionUpdate, "customer", customerID, description, old, balance)
         })
+        if err != nil {
+                return models.LoyaltyReward{}, err
+        }
         
-        return reward, err
+        return reward, nil
 }
 
-// redeemLoyaltyRewardWithTransaction performs the actual reward redemption within a transaction
-func redeemLoyaltyRewardWithTransaction(customerID, rewardID int) (models.LoyaltyReward, error) {
-        var reward models.LoyaltyReward
-        
-        // Begin transaction
-        tx, err := DB.Begin()
-        if err != nil {
-                return models.LoyaltyReward{}, fmt.Errorf("failed to start transaction: %w", err)
-        }
+// RewardRedemption describes a loyalty reward being applied to a sale
+type RewardRedemption struct {
+        Reward     models.LoyaltyReward
+        VoucherID  int // Unused loyalty_redemptions row being consumed, 0 when redeeming points now
+        PointsCost int // Points to deduct with this sale (0 when a voucher was already paid for)
+}
+
+// PrepareRewardRedemption checks, inside the sale transaction, that a customer can redeem a
+// reward. A previously redeemed voucher that is still within its ValidDays is used first;
+// otherwise the customer must have enough points to redeem the reward now.
+func PrepareRewardRedemption(tx *sql.Tx, customerID, rewardID int) (RewardRedemption, error) {
+        var redemption RewardRedemption
+        reward := &redemption.Reward
         
-        // Get reward details
-        err = tx.QueryRow(
+        err := tx.QueryRow(
                 "SELECT id, name, description, points_cost, discount_value, is_percentage, valid_days, active FROM loyalty_rewards WHERE id = ?",
                 rewardID,
         ).Scan(
@@ -504,60 +659,91 @@ func redeemLoyaltyRewardWithTransaction(customerID, rewardID int) (models.Loyalt
                 &reward.ValidDays,
                 &reward.Active,
         )
-        
         if err != nil {
-                tx.Rollback()
-                return models.LoyaltyReward{}, fmt.Errorf("failed to get reward: %w", err)
+                if err == sql.ErrNoRows {
+                        return RewardRedemption{}, fmt.Errorf("reward not found")
+                }
+                return RewardRedemption{}, fmt.Errorf("failed to get reward: %w", err)
+        }
+        
+        now := time.Now()
+        
+        // Use the oldest outstanding voucher that has not expired
+        err = tx.QueryRow(
+                `SELECT id FROM loyalty_redemptions 
+                 WHERE customer_id = ? AND reward_id = ? AND used = 0 AND expiry_date >= ?
+                 ORDER BY expiry_date ASC LIMIT 1`,
+                customerID, rewardID, now,
+        ).Scan(&redemption.VoucherID)
+        if err == nil {
+                return redemption, nil
+        }
+        if err != sql.ErrNoRows {
+                return RewardRedemption{}, fmt.Errorf("failed to check redeemed vouchers: %w", err)
         }
         
-        // Verify reward is active
+        // Otherwise redeem the reward with points as part of this sale
         if !reward.Active {
-                tx.Rollback()
-                return models.LoyaltyReward{}, fmt.Errorf("this reward is no longer active")
+                return RewardRedemption{}, fmt.Errorf("this reward is no longer active")
         }
         
-        // Get customer points
         var currentPoints int
         err = tx.QueryRow("SELECT loyalty_points FROM customers WHERE id = ?", customerID).Scan(&currentPoints)
         if err != nil {
-                tx.Rollback()
-                return models.LoyaltyReward{}, fmt.Errorf("failed to get customer points: %w", err)
+                return RewardRedemption{}, fmt.Errorf("failed to get customer points: %w", err)
         }
         
-        // Check if customer has enough points
         if currentPoints < reward.PointsCost {
-                tx.Rollback()
-                return models.LoyaltyReward{}, fmt.Errorf("insufficient loyalty points")
+                // Explain when an expired voucher is the reason the reward can't be used
+                var expiredAt sql.NullString
+                tx.QueryRow(
+                        "SELECT MAX(expiry_date) FROM loyalty_redemptions WHERE customer_id = ? AND reward_id = ? AND used = 0",
+                        customerID, rewardID,
+                ).Scan(&expiredAt)
+                if expiredAt.Valid {
+                        if expiry, err := parseDBTime(expiredAt.String); err == nil {
+                                return RewardRedemption{}, fmt.Errorf("reward voucher expired on %s and customer has insufficient loyalty points (%d of %d)",
+                                        expiry.Format("2006-01-02"), currentPoints, reward.PointsCost)
+                        }
+                }
+                return RewardRedemption{}, fmt.Errorf("insufficient loyalty points (%d of %d)", currentPoints, reward.PointsCost)
         }
         
-        // Deduct points from customer
-        newPoints := currentPoints - reward.PointsCost
-        _, err = tx.Exec(
-                "UPDATE customers SET loyalty_points = ?, updated_at = ? WHERE id = ?",
-                newPoints, time.Now(), customerID,
-        )
-        if err != nil {
-                tx.Rollback()
-                return models.LoyaltyReward{}, fmt.Errorf("failed to update customer points: %w", err)
-        }
+        redemption.PointsCost = reward.PointsCost
+        return redemption, nil
+}
+
+// CompleteRewardRedemption records a prepared redemption against a sale inside the sale
+// transaction. The points themselves are deducted by LinkSaleToCustomerTx via points_used.
+func CompleteRewardRedemption(tx *sql.Tx, redemption RewardRedemption, customerID, saleID int) error {
+        now := time.Now()
         
-        // Record redemption in redemption history table
-        _, err = tx.Exec(
-                "INSERT INTO loyalty_redemptions (customer_id, reward_id, points_used, redeemed_at, expiry_date) VALUES (?, ?, ?, ?, ?)",
-                customerID, rewardID, reward.PointsCost, time.Now(), time.Now().AddDate(0, 0, reward.ValidDays),
-        )
-        if err != nil {
-                tx.Rollback()
-                return models.LoyaltyReward{}, fmt.Errorf("failed to record redemption: %w", err)
+        if redemption.VoucherID > 0 {
+                result, err := tx.Exec(
+                        "UPDATE loyalty_redemptions SET used = 1, used_at = ?, used_sale_id = ? WHERE id = ? AND used = 0",
+                        now, saleID, redemption.VoucherID,
+                )
+                if err != nil {
+                        return fmt.Errorf("failed to mark reward voucher as used: %w", err)
+                }
+                if count, _ := result.RowsAffected(); count != 1 {
+                        return fmt.Errorf("reward voucher %d has already been used", redemption.VoucherID)
+                }
+                return nil
         }
         
-        // Commit transaction
-        err = tx.Commit()
+        _, err := tx.Exec(
+                `INSERT INTO loyalty_redemptions 
+                        (customer_id, reward_id, points_used, redeemed_at, expiry_date, used, used_at, used_sale_id) 
+                 VALUES (?, ?, ?, ?, ?, 1, ?, ?)`,
+                customerID, redemption.Reward.ID, redemption.PointsCost, now,
+                now.AddDate(0, 0, redemption.Reward.ValidDays), now, saleID,
+        )
         if err != nil {
-                return models.LoyaltyReward{}, fmt.Errorf("failed to commit transaction: %w", err)
+                return fmt.Errorf("failed to record redemption: %w", err)
         }
         
-        return reward, nil
+        return nil
 }
 
 // GetCustomerPurchaseHistory gets a customer's purchase history
@@ -642,13 +828,12 @@ func SearchCustomers(query string, limit int) ([]models.CustomerSummary, error)
                 return nil, fmt.Errorf("search query cannot be empty")
         }
         
-        searchTerm := "%" + query + "%"
-        
+        condition, params := customerMatch(query)
         sqlQuery := `
                 SELECT 
                         id, name, phone, email, loyalty_points, loyalty_tier
                 FROM customers
-                WHERE name LIKE ? OR phone LIKE ? OR email LIKE ?
+                WHERE ` + condition + `
                 ORDER BY name ASC
         `
         
@@ -656,7 +841,7 @@ func SearchCustomers(query string, limit int) ([]models.CustomerSummary, error)
                 sqlQuery += fmt.Sprintf(" LIMIT %d", limit)
         }
         
-        rows, err := DB.Query(sqlQuery, searchTerm, searchTerm, searchTerm)
+        rows, err := DB.Query(sqlQuery, params...)
         if err != nil {
                 return nil, fmt.Errorf("failed to search customers: %w", err)
         }
@@ -690,6 +875,10 @@ func SearchCustomers(query string, limit int) ([]models.CustomerSummary, error)
                 customers = append(customers, customer)
         }
         
+        if err := openCustomerSummaries(customers); err != nil {
+                return nil, err
+        }
+        
         return customers, nil
 }
 
@@ -1,6 +1,7 @@
 package db
 
 import (
+        "context"
         "database/sql"
         "fmt"
         "io"
@@ -8,6 +9,7 @@ import (
         "path/filepath"
         "sort"
         "termpos/internal/models"
+        "termpos/internal/security"
         "time"
 
         _ "github.com/mattn/go-sqlite3"
@@ -15,6 +17,9 @@ import (
 
 var (
         DB *sql.DB
+
+        // databasePath is the path of the open database file
+        databasePath = "./pos.db"
 )
 
 // Initialize sets up the database connection and runs migrations
@@ -27,10 +32,18 @@ func Initialize(dbPath string) error {
                 }
         }
 
-        // Connect to the database
-        db, err := sql.Open("sqlite3", dbPath)
+        // Connect to the database, with its key when it is encrypted
+        db, key, err := openDatabase(dbPath)
         if err != nil {
-                return fmt.Errorf("failed to open database: %w", err)
+                return err
+        }
+
+        // Fail clearly rather than on the first query when the key is wrong
+        if key != "" {
+                if err := checkDatabaseKey(db); err != nil {
+                        db.Close()
+                        return err
+                }
         }
 
         // Test the connection
@@ -52,6 +65,10 @@ func Initialize(dbPath string) error {
 
         // Set the global DB variable
         DB = db
+        databaseKey, databasePath = key, dbPath
+
+        // Keep the data keys sensitive data is encrypted with in this database
+        security.SetKeyStore(keyStore{})
 
         // Run migrations
         if err := RunMigrations(); err != nil {
@@ -128,8 +145,8 @@ func BackupDatabase(backupDir string) error {
         settings, err := GetSettings()
         if err == nil { // Only update if we can get settings
                 settings.Backup.LastBackupTime = time.Now().Format(time.RFC3339)
-                // Use admin as the updater since this is a system operation
-                if err := SaveSettings(settings, "system"); err != nil {
+                // Record the system as the updater since this is a system operation
+                if err := SaveSettings(context.Background(), settings); err != nil {
                         fmt.Printf("Warning: Could not update backup timestamp: %v\n", err)
                         // Non-fatal, continue anyway
                 }
@@ -150,11 +167,16 @@ func CleanupBackups(backupDir string, keepCount int) error {
                 backupDir = "./backups"
         }
 
-        // List backup files
+        // List backup files, both plain database copies and backup archives
         files, err := filepath.Glob(filepath.Join(backupDir, "pos_backup_*.db"))
         if err != nil {
                 return fmt.Errorf("failed to list backup files: %w", err)
         }
+        archives, err := filepath.Glob(filepath.Join(backupDir, "pos_backup_*.backup"))
+        if err != nil {
+                return fmt.Errorf("failed to list backup files: %w", err)
+        }
+        files = append(files, archives...)
 
         // If we have fewer files than we want to keep, return
         if len(files) <= keepCount {
@@ -199,13 +221,11 @@ func CleanupBackups(backupDir string, keepCount int) error {
 
 // GetDatabasePath returns the current database file path
 func GetDatabasePath() string {
-        // Return the path to the database file 
-        // For now, we use a hardcoded default
-        return "./pos.db"
+        return databasePath
 }
 
 // UpdateProductStock updates the stock of a product
-func UpdateProductStock(id int, quantity int) error {
+func UpdateProductStock(ctx context.Context, id int, quantity int) error {
         if quantity < 0 {
                 return models.ErrInvalidStock
         }
@@ -218,8 +238,8 @@ func UpdateProductStock(id int, quantity int) error {
 
         err := Transaction(func(tx *sql.Tx) error {
                 // Check if the product exists
-                var exists bool
-                err := tx.QueryRow("SELECT 1 FROM products WHERE id = ?", id).Scan(&exists)
+                var previousStock int
+                err := tx.QueryRow("SELECT stock FROM products WHERE id = ?", id).Scan(&previousStock)
                 if err != nil {
                         if err == sql.ErrNoRows {
                                 return models.ErrProductNotFound
@@ -228,8 +248,15 @@ func UpdateProductStock(id int, quantity int) error {
                 }
 
                 // Update the stock
-                _, err = tx.Exec(query, quantity, time.Now(), id)
-                return err
+                if _, err := tx.Exec(query, quantity, time.Now(), id); err != nil {
+                        return err
+                }
+                err = AuditTx(ctx, tx, ActionInventory, "product", id, fmt.Sprintf("Set stock from %d to %d", previousStock, quantity),
+                        map[string]int{"stock": previousStock}, map[string]int{"stock": quantity})
+                if err != nil {
+                        return err
+                }
+                return PublishLowStockTx(tx, id, previousStock)
         })
 
         if err != nil {
@@ -369,11 +396,9 @@ func GetAllProducts() ([]models.Product, error) {
         return products, nil
 }
 
-// GetAllProductsWithDetails retrieves all products with category and supplier details
-func GetAllProductsWithDetails() ([]models.ProductWithDetails, error) {
-        var products []models.ProductWithDetails
-
-        query := `
+// productDetailsQuery selects products with their category and supplier details, read
+// by scanProductsWithDetails
+const productDetailsQuery = `
                 SELECT p.id, p.name, p.price, p.stock, p.category_id, p.low_stock_alert, 
                        p.default_supplier_id, p.sku, p.description, p.created_at, p.updated_at,
                        c.name AS category_name, s.name AS supplier_name,
@@ -387,8 +412,11 @@ func GetAllProductsWithDetails() ([]models.ProductWithDetails, error) {
                 FROM products p
                 LEFT JOIN categories c ON p.category_id = c.id
                 LEFT JOIN suppliers s ON p.default_supplier_id = s.id
-                ORDER BY p.name
-        `
+`
+
+// GetAllProductsWithDetails retrieves all products with category and supplier details
+func GetAllProductsWithDetails() ([]models.ProductWithDetails, error) {
+        query := productDetailsQuery + " ORDER BY p.name"
 
         rows, err := DB.Query(query)
         if err != nil {
@@ -396,6 +424,13 @@ func GetAllProductsWithDetails() ([]models.ProductWithDetails, error) {
         }
         defer rows.Close()
 
+        return scanProductsWithDetails(rows)
+}
+
+// scanProductsWithDetails reads products with their details from rows
+func scanProductsWithDetails(rows *sql.Rows) ([]models.ProductWithDetails, error) {
+        var products []models.ProductWithDetails
+
         for rows.Next() {
                 var product models.ProductWithDetails
                 err := rows.Scan(
@@ -431,7 +466,7 @@ func GetAllProductsWithDetails() ([]models.ProductWithDetails, error) {
 }
 
 // AddProduct adds a new product to the database
-func AddProduct(product models.Product) (int, error) {
+func AddProduct(ctx context.Context, product models.Product) (int, error) {
         // Validate the product
         if err := product.Validate(); err != nil {
                 return 0, err
@@ -475,7 +510,13 @@ func AddProduct(product models.Product) (int, error) {
                 }
 
                 id, err = result.LastInsertId()
-                return err
+                if err != nil {
+                        return err
+                }
+
+                product.ID = int(id)
+                product.CreatedAt, product.UpdatedAt = now, now
+                return AuditTx(ctx, tx, ActionCreate, "product", id, "Created product "+product.Name, nil, product)
         })
 
         if err != nil {
@@ -486,7 +527,7 @@ func AddProduct(product models.Product) (int, error) {
 }
 
 // RecordSale records a new sale
-func RecordSale(sale models.Sale) (int, error) {
+func RecordSale(ctx context.Context, sale models.Sale) (int, error) {
         // Validate the sale
         if err := sale.Validate(); err != nil {
                 return 0, err
@@ -535,7 +576,12 @@ func RecordSale(sale models.Sale) (int, error) {
                         "UPDATE products SET stock = stock - ?, updated_at = ? WHERE id = ?",
                         sale.Quantity, time.Now(), sale.ProductID,
                 )
-                return err
+                if err != nil {
+                        return err
+                }
+
+                sale.ID, sale.PricePerUnit, sale.Total = int(id), product.Price, total
+                return AuditTx(ctx, tx, ActionSale, "sale", id, fmt.Sprintf("Sold %d x %s", sale.Quantity, product.Name), nil, sale)
         })
 
         if err != nil {
@@ -587,10 +633,8 @@ func executeTransaction(fn func(*sql.Tx) error) error {
 
 // GetAllCategories retrieves all product categories
 func GetAllCategories() ([]models.Category, error) {
-        var categories []models.Category
-
         query := `
-                SELECT id, name, description, parent_id, created_at, updated_at
+                SELECT id, name, COALESCE(description, ''), COALESCE(parent_id, 0), created_at, updated_at
                 FROM categories
                 ORDER BY name
         `
@@ -601,6 +645,13 @@ func GetAllCategories() ([]models.Category, error) {
         }
         defer rows.Close()
 
+        return scanCategories(rows)
+}
+
+// scanCategories reads categories from rows
+func scanCategories(rows *sql.Rows) ([]models.Category, error) {
+        var categories []models.Category
+
         for rows.Next() {
                 var category models.Category
                 err := rows.Scan(
@@ -629,7 +680,7 @@ func GetCategoryByID(id int) (models.Category, error) {
         var category models.Category
 
         query := `
-                SELECT id, name, description, parent_id, created_at, updated_at
+                SELECT id, name, COALESCE(description, ''), COALESCE(parent_id, 0), created_at, updated_at
                 FROM categories
                 WHERE id = ?
         `
@@ -645,7 +696,7 @@ func GetCategoryByID(id int) (models.Category, error) {
 
         if err != nil {
                 if err == sql.ErrNoRows {
-                        return category, fmt.Errorf("category not found")
+                        return category, ErrCategoryNotFound
                 }
                 return category, fmt.Errorf("failed to get category: %w", err)
         }
@@ -654,7 +705,7 @@ func GetCategoryByID(id int) (models.Category, error) {
 }
 
 // AddCategory adds a new product category
-func AddCategory(category models.Category) (int, error) {
+func AddCategory(ctx context.Context, category models.Category) (int, error) {
         if category.Name == "" {
                 return 0, fmt.Errorf("category name is required")
         }
@@ -692,7 +743,13 @@ func AddCategory(category models.Category) (int, error) {
                 }
 
                 id, err = result.LastInsertId()
-                return err
+                if err != nil {
+                        return err
+                }
+
+                category.ID = int(id)
+                category.CreatedAt, category.UpdatedAt = now, now
+                return AuditTx(ctx, tx, ActionCreate, "category", id, "Created category "+category.Name, nil, category)
         })
 
         if err != nil {
@@ -708,10 +765,9 @@ func AddCategory(category models.Category) (int, error) {
 
 // GetAllSuppliers retrieves all suppliers
 func GetAllSuppliers() ([]models.Supplier, error) {
-        var suppliers []models.Supplier
-
         query := `
-                SELECT id, name, contact, email, phone, address, notes, is_active, created_at, updated_at
+                SELECT id, name, COALESCE(contact, ''), COALESCE(email, ''), COALESCE(phone, ''), COALESCE(address, ''),
+                       COALESCE(notes, ''), is_active, created_at, updated_at
                 FROM suppliers
                 ORDER BY name
         `
@@ -722,6 +778,13 @@ func GetAllSuppliers() ([]models.Supplier, error) {
         }
         defer rows.Close()
 
+        return scanSuppliers(rows)
+}
+
+// scanSuppliers reads suppliers from rows
+func scanSuppliers(rows *sql.Rows) ([]models.Supplier, error) {
+        var suppliers []models.Supplier
+
         for rows.Next() {
                 var supplier models.Supplier
                 err := rows.Scan(
@@ -754,7 +817,8 @@ func GetSupplierByID(id int) (models.Supplier, error) {
         var supplier models.Supplier
 
         query := `
-                SELECT id, name, contact, email, phone, address, notes, is_active, created_at, updated_at
+                SELECT id, name, COALESCE(contact, ''), COALESCE(email, ''), COALESCE(phone, ''), COALESCE(address, ''),
+                       COALESCE(notes, ''), is_active, created_at, updated_at
                 FROM suppliers
                 WHERE id = ?
         `
@@ -774,7 +838,7 @@ func GetSupplierByID(id int) (models.Supplier, error) {
 
         if err != nil {
                 if err == sql.ErrNoRows {
-                        return supplier, fmt.Errorf("supplier not found")
+                        return supplier, ErrSupplierNotFound
                 }
                 return supplier, fmt.Errorf("failed to get supplier: %w", err)
         }
@@ -783,7 +847,7 @@ func GetSupplierByID(id int) (models.Supplier, error) {
 }
 
 // AddSupplier adds a new supplier
-func AddSupplier(supplier models.Supplier) (int, error) {
+func AddSupplier(ctx context.Context, supplier models.Supplier) (int, error) {
         if supplier.Name == "" {
                 return 0, fmt.Errorf("supplier name is required")
         }
@@ -813,7 +877,13 @@ func AddSupplier(supplier models.Supplier) (int, error) {
                 }
 
                 id, err = result.LastInsertId()
-                return err
+                if err != nil {
+                        return err
+                }
+
+                supplier.ID = int(id)
+                supplier.CreatedAt, supplier.UpdatedAt = now, now
+                return AuditTx(ctx, tx, ActionCreate, "supplier", id, "Created supplier "+supplier.Name, nil, supplier)
         })
 
         if err != nil {
@@ -829,10 +899,8 @@ func AddSupplier(supplier models.Supplier) (int, error) {
 
 // GetAllLocations retrieves all locations
 func GetAllLocations() ([]models.Location, error) {
-        var locations []models.Location
-
         query := `
-                SELECT id, name, address, description, is_active, created_at, updated_at
+                SELECT id, name, COALESCE(address, ''), COALESCE(description, ''), is_active, created_at, updated_at
                 FROM locations
                 ORDER BY name
         `
@@ -843,6 +911,13 @@ func GetAllLocations() ([]models.Location, error) {
         }
         defer rows.Close()
 
+        return scanLocations(rows)
+}
+
+// scanLocations reads locations from rows
+func scanLocations(rows *sql.Rows) ([]models.Location, error) {
+        var locations []models.Location
+
         for rows.Next() {
                 var location models.Location
                 err := rows.Scan(
@@ -872,7 +947,7 @@ func GetLocationByID(id int) (models.Location, error) {
         var location models.Location
 
         query := `
-                SELECT id, name, address, description, is_active, created_at, updated_at
+                SELECT id, name, COALESCE(address, ''), COALESCE(description, ''), is_active, created_at, updated_at
                 FROM locations
                 WHERE id = ?
         `
@@ -889,7 +964,7 @@ func GetLocationByID(id int) (models.Location, error) {
 
         if err != nil {
                 if err == sql.ErrNoRows {
-                        return location, fmt.Errorf("location not found")
+                        return location, ErrLocationNotFound
                 }
                 return location, fmt.Errorf("failed to get location: %w", err)
         }
@@ -898,7 +973,7 @@ func GetLocationByID(id int) (models.Location, error) {
 }
 
 // AddLocation adds a new location
-func AddLocation(location models.Location) (int, error) {
+func AddLocation(ctx context.Context, location models.Location) (int, error) {
         if location.Name == "" {
                 return 0, fmt.Errorf("location name is required")
         }
@@ -925,7 +1000,13 @@ func AddLocation(location models.Location) (int, error) {
                 }
 
                 id, err = result.LastInsertId()
-                return err
+                if err != nil {
+                        return err
+                }
+
+                location.ID = int(id)
+                location.CreatedAt, location.UpdatedAt = now, now
+                return AuditTx(ctx, tx, ActionCreate, "location", id, "Created location "+location.Name, nil, location)
         })
 
         if err != nil {
@@ -988,7 +1069,7 @@ func GetProductBatches(productID int) ([]models.ProductBatch, error) {
 }
 
 // AddProductBatch adds a new batch for a product
-func AddProductBatch(batch models.ProductBatch) (int, error) {
+func AddProductBatch(ctx context.Context, batch models.ProductBatch) (int, error) {
         // Validate required fields
         if batch.ProductID <= 0 {
                 return 0, fmt.Errorf("product ID is required")
@@ -1082,8 +1163,13 @@ func AddProductBatch(batch models.ProductBatch) (int, error) {
                         ON CONFLICT(product_id, location_id) 
                         DO UPDATE SET quantity = quantity + ?, updated_at = ?
                 `, batch.ProductID, batch.LocationID, batch.Quantity, now, now, batch.Quantity, now)
+                if err != nil {
+                        return err
+                }
 
-                return err
+                batch.ID = int(id)
+                batch.CreatedAt, batch.UpdatedAt = now, now
+                return AuditTx(ctx, tx, ActionInventory, "batch", id, "Received batch "+batch.BatchNumber, nil, batch)
         })
 
         if err != nil {
@@ -1,13 +1,25 @@
 package db
 
 import (
+        "bytes"
+        "context"
+        "crypto/aes"
+        "crypto/cipher"
         "database/sql"
+        "encoding/base64"
+        "encoding/csv"
+        "encoding/json"
+        "errors"
         "os"
+        "path/filepath"
+        "strings"
         "testing"
         "time"
 
         _ "github.com/mattn/go-sqlite3"
+        "termpos/internal/auth"
         "termpos/internal/models"
+        "termpos/internal/security"
 )
 
 // setupTestDB creates an in-memory SQLite database for testing
@@ -27,6 +39,18 @@ func setupTestDB(t *testing.T) func() {
         }
 }
 
+// setTestEncryptionKey configures a master key for the test, so sensitive data can be
+// encrypted
+func setTestEncryptionKey(t *testing.T) {
+        // Registered first so it runs after the environment is restored
+        t.Cleanup(func() { security.InitEncryption() })
+        t.Setenv("POS_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+        t.Setenv("POS_ENCRYPTION_KEY_FILE", "")
+        if err := security.InitEncryption(); err != nil {
+                t.Fatalf("InitEncryption failed: %v", err)
+        }
+}
+
 // setupTestData populates the test database with sample data
 func setupTestData(t *testing.T) {
         // Add test products
@@ -489,4 +513,1652 @@ func TestReporting(t *testing.T) {
                         }
                 }
         })
-}
\ No newline at end of file
+}
+// TestCustomerPrivacy tests consent tracking, data export and anonymization
+func TestCustomerPrivacy(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+        setupTestData(t)
+
+        customerID, err := AddCustomer(context.Background(), models.Customer{
+                Name:     "Jane Doe",
+                Email:    "jane@example.com",
+                Phone:    "555-0100",
+                Address:  "1 Main St",
+                Birthday: "1990-04-01",
+        })
+        if err != nil {
+                t.Fatalf("AddCustomer failed: %v", err)
+        }
+
+        // Record a sale linked to the customer
+        var saleID int
+        err = DB.QueryRow(
+                `INSERT INTO sales (product_id, quantity, price_per_unit, subtotal, total, customer_id, customer_name, customer_email)
+                 VALUES (1, 2, 3.50, 7.00, 7.00, ?, 'Jane Doe', 'jane@example.com') RETURNING id`,
+                customerID,
+        ).Scan(&saleID)
+        if err != nil {
+                t.Fatalf("Failed to insert sale: %v", err)
+        }
+        ctx := WithActor(context.Background(), Actor{Username: "tester", Source: SourceCLI})
+        if err := LinkSaleToCustomer(ctx, saleID, customerID, 7, 0, 0); err != nil {
+                t.Fatalf("LinkSaleToCustomer failed: %v", err)
+        }
+        logs, err := GetAuditLogsBefore("tester", ActionUpdate, "customer", "", "", 0, 10)
+        if err != nil || len(logs) != 1 || !strings.Contains(logs[0].PreviousValue, `"loyalty_points":0`) || !strings.Contains(logs[0].NewValue, `"loyalty_points":7`) {
+                t.Errorf("Expected the points earned audited, got %+v (%v)", logs, err)
+        }
+
+        t.Run("Consent", func(t *testing.T) {
+                if err := SetCustomerConsent(ctx, customerID, ConsentEmail, true); err != nil {
+                        t.Fatalf("SetCustomerConsent failed: %v", err)
+                }
+                logs, err := GetAuditLogsBefore("tester", ActionUpdate, "customer", "", "", 0, 1)
+                if err != nil || len(logs) != 1 || logs[0].PreviousValue != `{"channel":"email","granted":false}` || logs[0].NewValue != `{"channel":"email","granted":true}` {
+                        t.Errorf("Expected the consent change audited, got %+v (%v)", logs, err)
+                }
+                if err := SetCustomerConsent(ctx, customerID, "fax", true); err == nil {
+                        t.Errorf("Expected error for unknown consent channel")
+                }
+
+                customer, err := GetCustomer(customerID)
+                if err != nil {
+                        t.Fatalf("GetCustomer failed: %v", err)
+                }
+                if !customer.EmailConsent || customer.EmailConsentAt.IsZero() {
+                        t.Errorf("Expected email consent to be granted with a timestamp")
+                }
+                if customer.SMSConsent {
+                        t.Errorf("Expected SMS consent to default to false")
+                }
+        })
+
+        t.Run("ExportData", func(t *testing.T) {
+                export, err := ExportCustomerData(customerID, "tester")
+                if err != nil {
+                        t.Fatalf("ExportCustomerData failed: %v", err)
+                }
+                if export.Profile.Email != "jane@example.com" {
+                        t.Errorf("Expected profile email in export, got %q", export.Profile.Email)
+                }
+                if len(export.Sales) != 1 || export.Sales[0].ID != saleID {
+                        t.Errorf("Expected 1 sale in export, got %d", len(export.Sales))
+                }
+                if len(export.PointsHistory) != 1 || export.PointsHistory[0].PointsEarned != 7 {
+                        t.Errorf("Expected points history entry with 7 points, got %+v", export.PointsHistory)
+                }
+        })
+
+        t.Run("Anonymize", func(t *testing.T) {
+                if err := AnonymizeCustomer(customerID, "tester"); err != nil {
+                        t.Fatalf("AnonymizeCustomer failed: %v", err)
+                }
+
+                customer, err := GetCustomer(customerID)
+                if err != nil {
+                        t.Fatalf("GetCustomer failed: %v", err)
+                }
+                if !customer.IsAnonymized() {
+                        t.Errorf("Expected customer to be marked anonymized")
+                }
+                if customer.Email != "" || customer.Phone != "" || customer.Address != "" || customer.Birthday != "" {
+                        t.Errorf("Expected PII to be scrubbed, got %+v", customer)
+                }
+                if customer.Name == "Jane Doe" || customer.EmailConsent {
+                        t.Errorf("Expected name and consent to be reset")
+                }
+
+                // Sales rows are kept without contact details
+                var count int
+                var email sql.NullString
+                err = DB.QueryRow("SELECT COUNT(*), MAX(customer_email) FROM sales WHERE id = ?", saleID).Scan(&count, &email)
+                if err != nil {
+                        t.Fatalf("Failed to query sale: %v", err)
+                }
+                if count != 1 || email.Valid {
+                        t.Errorf("Expected sale to be kept with email removed, got count=%d email=%v", count, email)
+                }
+
+                if err := AnonymizeCustomer(customerID, "tester"); err == nil {
+                        t.Errorf("Expected error when anonymizing twice")
+                }
+        })
+}
+
+// TestCustomerSegments tests RFM scoring and segment membership
+func TestCustomerSegments(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+        setupTestData(t)
+
+        now := time.Now()
+        addCustomerWithSales := func(name, birthday string, daysAgo []int, total float64) int {
+                id, err := AddCustomer(context.Background(), models.Customer{Name: name, Birthday: birthday})
+                if err != nil {
+                        t.Fatalf("AddCustomer failed: %v", err)
+                }
+                for _, days := range daysAgo {
+                        _, err := DB.Exec(
+                                `INSERT INTO sales (product_id, quantity, price_per_unit, subtotal, total, sale_date, customer_id)
+                                 VALUES (1, 1, ?, ?, ?, ?, ?)`,
+                                total, total, total, now.AddDate(0, 0, -days), id,
+                        )
+                        if err != nil {
+                                t.Fatalf("Failed to insert sale: %v", err)
+                        }
+                }
+                return id
+        }
+
+        champion := addCustomerWithSales("Champion", "", []int{1, 3, 5, 7, 9}, 100)
+        lapsed := addCustomerWithSales("Lapsed", "", []int{200, 250}, 10)
+        addCustomerWithSales("Occasional A", "", []int{30}, 20)
+        addCustomerWithSales("Occasional B", "", []int{40}, 20)
+        addCustomerWithSales("Occasional C", "", []int{50}, 20)
+        birthday := addCustomerWithSales("Birthday", time.Date(1992, now.Month(), now.Day(), 0, 0, 0, 0, time.Local).Format("2006-01-02"), nil, 0)
+
+        customers, err := CalculateCustomerRFM(now)
+        if err != nil {
+                t.Fatalf("CalculateCustomerRFM failed: %v", err)
+        }
+        if len(customers) != 6 {
+                t.Fatalf("Expected 6 customers, got %d", len(customers))
+        }
+
+        byID := make(map[int]models.CustomerRFM)
+        for _, c := range customers {
+                byID[c.CustomerID] = c
+        }
+        if c := byID[champion]; c.Frequency != 5 || c.RecencyScore != 5 || c.FrequencyScore != 5 || c.MonetaryScore != 5 {
+                t.Errorf("Expected champion to score 555, got %+v", c)
+        }
+        if c := byID[lapsed]; c.RecencyDays < 199 || c.RecencyScore != 1 {
+                t.Errorf("Expected lapsed customer to have lowest recency, got %+v", c)
+        }
+        if c := byID[birthday]; c.HasPurchases() || c.Score() != "000" {
+                t.Errorf("Expected customer without purchases to score 000, got %+v", c)
+        }
+
+        tests := []struct {
+                segment  string
+                expected []int
+        }{
+                {"champions", []int{champion}},
+                {"lapsed", []int{lapsed}},
+                {"birthday-this-month", []int{birthday}},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.segment, func(t *testing.T) {
+                        members, err := GetSegmentMembers(tc.segment)
+                        if err != nil {
+                                t.Fatalf("GetSegmentMembers failed: %v", err)
+                        }
+                        if len(members) != len(tc.expected) {
+                                t.Fatalf("Expected %d members, got %d: %+v", len(tc.expected), len(members), members)
+                        }
+                        for i, id := range tc.expected {
+                                if members[i].CustomerID != id {
+                                        t.Errorf("Expected member %d, got %d", id, members[i].CustomerID)
+                                }
+                        }
+                })
+        }
+
+        t.Run("CustomSegment", func(t *testing.T) {
+                segment := models.CustomerSegment{
+                        Name:  "big-spenders",
+                        Rules: models.SegmentRules{MinSpend: 100},
+                }
+                if err := SaveCustomerSegment(segment, "tester"); err != nil {
+                        t.Fatalf("SaveCustomerSegment failed: %v", err)
+                }
+
+                members, err := GetSegmentMembers("big-spenders")
+                if err != nil {
+                        t.Fatalf("GetSegmentMembers failed: %v", err)
+                }
+                if len(members) != 1 || members[0].CustomerID != champion {
+                        t.Errorf("Expected only the champion in big-spenders, got %+v", members)
+                }
+
+                invalid := models.CustomerSegment{Name: "bad", Rules: models.SegmentRules{MinRecencyScore: 6}}
+                if err := SaveCustomerSegment(invalid, "tester"); err == nil {
+                        t.Errorf("Expected validation error for out of range score")
+                }
+        })
+}
+
+func TestRolesAndPermissions(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        // Built-in roles are seeded with the default grants
+        cashier, err := GetRole(models.RoleCashier)
+        if err != nil {
+                t.Fatalf("GetRole failed: %v", err)
+        }
+        if !cashier.System || !cashier.HasPermission("sale:read") || cashier.HasPermission("user:manage") {
+                t.Errorf("Unexpected cashier role: %+v", cashier)
+        }
+
+        admin, err := GetRole(models.RoleAdmin)
+        if err != nil {
+                t.Fatalf("GetRole failed: %v", err)
+        }
+        if len(admin.Permissions) != len(models.PermissionRegistry) {
+                t.Errorf("Expected admin to have %d permissions, got %d", len(models.PermissionRegistry), len(admin.Permissions))
+        }
+
+        // Create a custom role based on cashier and extend it
+        shiftLead := models.NormalizeRoleName("Shift Lead")
+        if shiftLead != "shift-lead" {
+                t.Fatalf("Expected normalized name shift-lead, got %s", shiftLead)
+        }
+        role, err := CreateRole(shiftLead, "Runs the floor", models.RoleCashier, "admin")
+        if err != nil {
+                t.Fatalf("CreateRole failed: %v", err)
+        }
+        if role.System || len(role.Permissions) != len(cashier.Permissions) {
+                t.Errorf("Expected custom role with cashier permissions, got %+v", role)
+        }
+        if _, err := CreateRole(shiftLead, "", "", "admin"); err == nil {
+                t.Error("Expected error creating a duplicate role")
+        }
+
+        if err := GrantPermission(shiftLead, "report:generate", "admin"); err != nil {
+                t.Fatalf("GrantPermission failed: %v", err)
+        }
+        if err := GrantPermission(shiftLead, "sales:create", "admin"); err == nil {
+                t.Error("Expected error granting an unregistered permission")
+        }
+        if err := GrantPermission(models.RoleAdmin, "report:generate", "admin"); err == nil {
+                t.Error("Expected error changing admin permissions")
+        }
+        if err := RevokePermission(shiftLead, "customer:create", "admin"); err != nil {
+                t.Fatalf("RevokePermission failed: %v", err)
+        }
+        if err := RevokePermission(shiftLead, "customer:create", "admin"); err == nil {
+                t.Error("Expected error revoking a permission the role does not have")
+        }
+
+        role, err = GetRole(shiftLead)
+        if err != nil {
+                t.Fatalf("GetRole failed: %v", err)
+        }
+        if !role.HasPermission("report:generate") || role.HasPermission("customer:create") {
+                t.Errorf("Unexpected shift-lead permissions: %v", role.Permissions)
+        }
+
+        var audits int
+        DB.QueryRow("SELECT COUNT(*) FROM audit_logs WHERE resource_type = 'roles' AND action = ?", ActionPermissionMod).Scan(&audits)
+        if audits != 2 {
+                t.Errorf("Expected 2 permission change audit entries, got %d", audits)
+        }
+
+        // Users can be assigned the custom role
+        _, err = CreateUser(context.Background(), models.User{Username: "lead", PasswordHash: "hash", Role: shiftLead, Active: true})
+        if err != nil {
+                t.Fatalf("CreateUser with custom role failed: %v", err)
+        }
+        if err := DeleteRole(shiftLead, "admin"); err == nil {
+                t.Error("Expected error deleting a role assigned to a user")
+        }
+        if err := DeleteRole(models.RoleManager, "admin"); err != ErrSystemRole {
+                t.Errorf("Expected ErrSystemRole deleting a built-in role, got %v", err)
+        }
+}
+
+func TestSupervisorApprovals(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        manager := WithActor(context.Background(), Actor{Username: "manager1", Source: SourceCLI})
+        consume := func(username, tokenHash, resource string) (approval models.Approval, err error) {
+                ctx := WithActor(context.Background(), Actor{Username: username, Source: SourceAPI, IPAddress: "127.0.0.1"})
+                err = Transaction(func(tx *sql.Tx) error {
+                        approval, err = ConsumeApprovalTx(ctx, tx, tokenHash, models.PermissionRefund, resource)
+                        return err
+                })
+                return approval, err
+        }
+
+        approval, err := CreateApproval(manager, "hash-1", models.Approval{
+                Action:      models.PermissionRefund,
+                Resource:    "sale:42",
+                RequestedBy: "cashier1",
+                Reason:      "damaged item",
+                ExpiresAt:   time.Now().Add(5 * time.Minute),
+        })
+        if err != nil {
+                t.Fatalf("CreateApproval failed: %v", err)
+        }
+
+        // The approval is bound to the action, resource and requester
+        if _, err := consume("cashier1", "hash-1", "sale:43"); err != ErrApprovalInvalid {
+                t.Errorf("Expected ErrApprovalInvalid for a different resource, got %v", err)
+        }
+        if _, err := consume("cashier2", "hash-1", "sale:42"); err != ErrApprovalInvalid {
+                t.Errorf("Expected ErrApprovalInvalid for a different requester, got %v", err)
+        }
+
+        used, err := consume("cashier1", "hash-1", "sale:42")
+        if err != nil {
+                t.Fatalf("ConsumeApproval failed: %v", err)
+        }
+        if used.ID != approval.ID || used.ApprovedBy != "manager1" || used.UsedAt.IsZero() {
+                t.Errorf("Unexpected approval: %+v", used)
+        }
+
+        // Approvals are single use
+        if _, err := consume("cashier1", "hash-1", "sale:42"); err != ErrApprovalInvalid {
+                t.Errorf("Expected ErrApprovalInvalid reusing an approval, got %v", err)
+        }
+
+        // Expired approvals cannot be used
+        _, err = CreateApproval(manager, "hash-2", models.Approval{
+                Action:      models.PermissionRefund,
+                Resource:    "sale:42",
+                RequestedBy: "cashier1",
+                ExpiresAt:   time.Now().Add(-time.Minute),
+        })
+        if err != nil {
+                t.Fatalf("CreateApproval failed: %v", err)
+        }
+        if _, err := consume("cashier1", "hash-2", "sale:42"); err != ErrApprovalInvalid {
+                t.Errorf("Expected ErrApprovalInvalid for an expired approval, got %v", err)
+        }
+
+        // Approvals are given by the supervisor and used by the requester, and the approver
+        // is recorded on both
+        for username, want := range map[string]int{"manager1": 2, "cashier1": 1} {
+                logs, err := GetAuditLogs(username, ActionApproval, "approvals", "", "", 0, 0)
+                if err != nil {
+                        t.Fatalf("GetAuditLogs failed: %v", err)
+                }
+                if len(logs) != want {
+                        t.Fatalf("Expected %d approval audit entries by %s, got %d", want, username, len(logs))
+                }
+                for _, log := range logs {
+                        if log.ApprovedBy != "manager1" || !strings.Contains(log.NewValue, `"cashier1"`) {
+                                t.Errorf("Expected approval of cashier1 by manager1, got %+v", log)
+                        }
+                }
+        }
+}
+
+func TestPINAndLockout(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        // The default admin user is created by the migrations
+        admin, err := GetUserByUsername("admin")
+        if err != nil {
+                t.Fatalf("GetUserByUsername failed: %v", err)
+        }
+
+        security, err := GetUserSecurity(admin.ID)
+        if err != nil {
+                t.Fatalf("GetUserSecurity failed: %v", err)
+        }
+        if security.HasPIN() || security.FailedAttempts != 0 {
+                t.Errorf("Expected an empty security record, got %+v", security)
+        }
+
+        if err := SetUserPIN(admin.ID, "pin-hash"); err != nil {
+                t.Fatalf("SetUserPIN failed: %v", err)
+        }
+
+        // The account locks once the limit is reached
+        policy := models.SecuritySettings{MaxFailedLogins: 3, LockoutMinutes: 15}
+        for i := 1; i <= 3; i++ {
+                security, err = RecordFailedLogin(admin.ID, policy)
+                if err != nil {
+                        t.Fatalf("RecordFailedLogin failed: %v", err)
+                }
+                if security.FailedAttempts != i {
+                        t.Errorf("Expected %d failed attempts, got %d", i, security.FailedAttempts)
+                }
+                if locked := security.IsLocked(time.Now()); locked != (i == 3) {
+                        t.Errorf("After %d failures expected locked=%v, got %v", i, i == 3, locked)
+                }
+        }
+        if security.PINHash != "pin-hash" {
+                t.Errorf("Expected failed logins to keep the PIN, got %q", security.PINHash)
+        }
+
+        // Each further failure doubles the lockout
+        security, err = RecordFailedLogin(admin.ID, policy)
+        if err != nil {
+                t.Fatalf("RecordFailedLogin failed: %v", err)
+        }
+        if remaining := time.Until(security.LockedUntil); remaining < 29*time.Minute || remaining > 30*time.Minute {
+                t.Errorf("Expected a 30 minute lockout after 4 failures, got %v", remaining)
+        }
+
+        if err := ResetFailedLogins(admin.ID); err != nil {
+                t.Fatalf("ResetFailedLogins failed: %v", err)
+        }
+        security, err = GetUserSecurity(admin.ID)
+        if err != nil {
+                t.Fatalf("GetUserSecurity failed: %v", err)
+        }
+        if security.FailedAttempts != 0 || security.IsLocked(time.Now()) {
+                t.Errorf("Expected the lockout to be cleared, got %+v", security)
+        }
+
+        // An empty hash removes the PIN
+        if err := SetUserPIN(admin.ID, ""); err != nil {
+                t.Fatalf("SetUserPIN failed: %v", err)
+        }
+        if security, _ = GetUserSecurity(admin.ID); security.HasPIN() {
+                t.Error("Expected the PIN to be removed")
+        }
+}
+
+func TestPasswordHistory(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        admin, err := GetUserByUsername("admin")
+        if err != nil {
+                t.Fatalf("GetUserByUsername failed: %v", err)
+        }
+        originalHash := admin.PasswordHash
+
+        // An admin reset forces a change at next login and clears any lockout
+        if _, err := RecordFailedLogin(admin.ID, models.SecuritySettings{MaxFailedLogins: 1}); err != nil {
+                t.Fatalf("RecordFailedLogin failed: %v", err)
+        }
+        if err := ChangeUserPassword(admin.ID, "hash-1", true, 2); err != nil {
+                t.Fatalf("ChangeUserPassword failed: %v", err)
+        }
+
+        security, err := GetUserSecurity(admin.ID)
+        if err != nil {
+                t.Fatalf("GetUserSecurity failed: %v", err)
+        }
+        if !security.MustChangePassword || security.PasswordChangedAt.IsZero() {
+                t.Errorf("Expected a required password change, got %+v", security)
+        }
+        if security.FailedAttempts != 0 || security.IsLocked(time.Now()) {
+                t.Errorf("Expected the lockout to be cleared, got %+v", security)
+        }
+
+        if err := ChangeUserPassword(admin.ID, "hash-2", false, 2); err != nil {
+                t.Fatalf("ChangeUserPassword failed: %v", err)
+        }
+        if err := ChangeUserPassword(admin.ID, "hash-3", false, 2); err != nil {
+                t.Fatalf("ChangeUserPassword failed: %v", err)
+        }
+
+        user, err := GetUserByID(admin.ID)
+        if err != nil {
+                t.Fatalf("GetUserByID failed: %v", err)
+        }
+        if user.PasswordHash != "hash-3" {
+                t.Errorf("Expected the new password hash, got %q", user.PasswordHash)
+        }
+
+        // Only the most recent previous passwords are kept
+        history, err := GetPasswordHistory(admin.ID, 10)
+        if err != nil {
+                t.Fatalf("GetPasswordHistory failed: %v", err)
+        }
+        if len(history) != 2 || history[0] != "hash-2" || history[1] != "hash-1" {
+                t.Errorf("Expected history [hash-2 hash-1], got %v", history)
+        }
+        for _, hash := range history {
+                if hash == originalHash {
+                        t.Error("Expected the oldest password to be pruned from the history")
+                }
+        }
+
+        if security, _ = GetUserSecurity(admin.ID); security.MustChangePassword {
+                t.Error("Expected the password change requirement to be cleared")
+        }
+}
+
+func TestTwoFactor(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+        setTestEncryptionKey(t)
+
+        admin, err := GetUserByUsername("admin")
+        if err != nil {
+                t.Fatalf("GetUserByUsername failed: %v", err)
+        }
+
+        // The secret is stored encrypted and 2FA stays off until enrollment is confirmed
+        if err := SaveTOTPSecret(admin.ID, "JBSWY3DPEHPK3PXP"); err != nil {
+                t.Fatalf("SaveTOTPSecret failed: %v", err)
+        }
+        secret, err := GetTOTPSecret(admin.ID)
+        if err != nil || secret != "JBSWY3DPEHPK3PXP" {
+                t.Fatalf("Expected the stored secret, got %q (%v)", secret, err)
+        }
+        var stored string
+        if err := DB.QueryRow("SELECT encrypted_value FROM sensitive_data WHERE resource_id = ?", admin.ID).Scan(&stored); err != nil {
+                t.Fatalf("Failed to read sensitive data: %v", err)
+        }
+        if stored == secret {
+                t.Error("Expected the secret to be encrypted at rest")
+        }
+
+        security, err := GetUserSecurity(admin.ID)
+        if err != nil {
+                t.Fatalf("GetUserSecurity failed: %v", err)
+        }
+        if security.TwoFactorEnabled {
+                t.Error("Expected two-factor authentication to be off before confirmation")
+        }
+
+        if err := EnableTwoFactor(admin.ID, []string{"hash-a", "hash-b"}); err != nil {
+                t.Fatalf("EnableTwoFactor failed: %v", err)
+        }
+        if security, _ = GetUserSecurity(admin.ID); !security.TwoFactorEnabled {
+                t.Error("Expected two-factor authentication to be enabled")
+        }
+
+        // A time step is accepted once, and earlier steps are refused after a later one
+        for _, tc := range []struct {
+                step int64
+                want bool
+        }{{100, true}, {100, false}, {99, false}, {101, true}} {
+                ok, err := UseTOTPStep(admin.ID, tc.step)
+                if err != nil {
+                        t.Fatalf("UseTOTPStep failed: %v", err)
+                }
+                if ok != tc.want {
+                        t.Errorf("UseTOTPStep(%d) = %v, want %v", tc.step, ok, tc.want)
+                }
+        }
+
+        // Recovery codes are single use
+        if ok, _ := UseRecoveryCode(admin.ID, "hash-a"); !ok {
+                t.Error("Expected the recovery code to be accepted")
+        }
+        if ok, _ := UseRecoveryCode(admin.ID, "hash-a"); ok {
+                t.Error("Expected a used recovery code to be refused")
+        }
+        if count, _ := CountUnusedRecoveryCodes(admin.ID); count != 1 {
+                t.Errorf("Expected 1 unused recovery code, got %d", count)
+        }
+
+        if err := ReplaceRecoveryCodes(admin.ID, []string{"hash-c", "hash-d", "hash-e"}); err != nil {
+                t.Fatalf("ReplaceRecoveryCodes failed: %v", err)
+        }
+        if ok, _ := UseRecoveryCode(admin.ID, "hash-b"); ok {
+                t.Error("Expected replaced recovery codes to be refused")
+        }
+        if count, _ := CountUnusedRecoveryCodes(admin.ID); count != 3 {
+                t.Errorf("Expected 3 unused recovery codes, got %d", count)
+        }
+
+        if err := DisableTwoFactor(admin.ID); err != nil {
+                t.Fatalf("DisableTwoFactor failed: %v", err)
+        }
+        if security, _ = GetUserSecurity(admin.ID); security.TwoFactorEnabled {
+                t.Error("Expected two-factor authentication to be disabled")
+        }
+        if _, err := GetTOTPSecret(admin.ID); err == nil {
+                t.Error("Expected the secret to be deleted")
+        }
+        if count, _ := CountUnusedRecoveryCodes(admin.ID); count != 0 {
+                t.Errorf("Expected recovery codes to be deleted, got %d", count)
+        }
+}
+
+func TestTimeClock(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        admin, err := GetUserByUsername("admin")
+        if err != nil {
+                t.Fatalf("GetUserByUsername failed: %v", err)
+        }
+
+        start := time.Now().Add(-4 * time.Hour).Truncate(time.Second)
+        if _, err := ClockIn(admin.ID, start, ""); err != nil {
+                t.Fatalf("ClockIn failed: %v", err)
+        }
+        if _, err := ClockIn(admin.ID, start.Add(time.Minute), ""); err != ErrAlreadyClockedIn {
+                t.Errorf("Expected ErrAlreadyClockedIn, got %v", err)
+        }
+
+        if _, err := StartBreak(admin.ID, start.Add(2*time.Hour)); err != nil {
+                t.Fatalf("StartBreak failed: %v", err)
+        }
+        if _, err := StartBreak(admin.ID, start.Add(2*time.Hour)); err != ErrAlreadyOnBreak {
+                t.Errorf("Expected ErrAlreadyOnBreak, got %v", err)
+        }
+        if _, err := EndBreak(admin.ID, start.Add(150*time.Minute)); err != nil {
+                t.Fatalf("EndBreak failed: %v", err)
+        }
+
+        // Sales made by the user count towards their labour hours, unattributed sales do not
+        for _, userID := range []interface{}{admin.ID, admin.ID, nil} {
+                _, err := DB.Exec(
+                        "INSERT INTO sales (product_id, quantity, price_per_unit, subtotal, total, sale_date, user_id) VALUES (1, 1, 10, 10, 10, ?, ?)",
+                        start.Add(time.Hour), userID,
+                )
+                if err != nil {
+                        t.Fatalf("Failed to insert sale: %v", err)
+                }
+        }
+
+        entry, err := ClockOut(admin.ID, start.Add(4*time.Hour))
+        if err != nil {
+                t.Fatalf("ClockOut failed: %v", err)
+        }
+        if worked := entry.Worked(time.Now()); worked != 3*time.Hour+30*time.Minute {
+                t.Errorf("Expected 3h30m worked, got %s", worked)
+        }
+        if _, err := ClockOut(admin.ID, time.Now()); err != ErrNotClockedIn {
+                t.Errorf("Expected ErrNotClockedIn, got %v", err)
+        }
+
+        // Manager corrections cannot create overlapping shifts
+        ctx := WithActor(context.Background(), Actor{Username: "manager", Source: SourceCLI})
+        overlapping := models.TimeEntry{UserID: admin.ID, ClockIn: start.Add(-time.Hour), ClockOut: start.Add(time.Hour)}
+        if _, err := AddTimeEntry(ctx, overlapping); err != ErrShiftOverlap {
+                t.Errorf("Expected ErrShiftOverlap, got %v", err)
+        }
+        earlier := models.TimeEntry{UserID: admin.ID, ClockIn: start.Add(-3 * time.Hour), ClockOut: start.Add(-time.Hour)}
+        earlier, err = AddTimeEntry(ctx, earlier)
+        if err != nil {
+                t.Fatalf("AddTimeEntry failed: %v", err)
+        }
+
+        // The break must still fit in the corrected shift
+        entry.ClockOut = start.Add(2 * time.Hour)
+        if _, err := UpdateTimeEntry(ctx, entry); err == nil {
+                t.Error("Expected an error when the shift no longer covers its break")
+        }
+        entry.ClockOut = start.Add(5 * time.Hour)
+        updated, err := UpdateTimeEntry(ctx, entry)
+        if err != nil {
+                t.Fatalf("UpdateTimeEntry failed: %v", err)
+        }
+        if updated.EditedBy != "manager" {
+                t.Errorf("Expected the edit to be attributed to manager, got %q", updated.EditedBy)
+        }
+
+        entries, err := ListTimeEntries(admin.ID, start.Add(-24*time.Hour), start.Add(24*time.Hour))
+        if err != nil || len(entries) != 2 {
+                t.Fatalf("Expected 2 time entries, got %d (%v)", len(entries), err)
+        }
+
+        results, err := GetLabourSales(start.Add(-24*time.Hour), start.Add(24*time.Hour), time.Now())
+        if err != nil {
+                t.Fatalf("GetLabourSales failed: %v", err)
+        }
+        if len(results) != 1 || results[0].Transactions != 2 || results[0].Revenue != 20 {
+                t.Fatalf("Expected 2 sales worth 20 attributed to admin, got %+v", results)
+        }
+        if results[0].Worked != 6*time.Hour+30*time.Minute {
+                t.Errorf("Expected 6h30m worked, got %s", results[0].Worked)
+        }
+
+        if err := DeleteTimeEntry(ctx, earlier.ID); err != nil {
+                t.Fatalf("DeleteTimeEntry failed: %v", err)
+        }
+        if _, err := GetTimeEntry(earlier.ID); err != ErrTimeEntryNotFound {
+                t.Errorf("Expected ErrTimeEntryNotFound, got %v", err)
+        }
+
+        // Corrections are audited as made by the manager
+        logs, err := GetAuditLogs("manager", "", "time_entry", "", "", 0, 0)
+        if err != nil || len(logs) != 3 {
+                t.Fatalf("Expected 3 time entry audit logs, got %d (%v)", len(logs), err)
+        }
+}
+
+func TestStaffPerformance(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        admin, err := GetUserByUsername("admin")
+        if err != nil {
+                t.Fatalf("GetUserByUsername failed: %v", err)
+        }
+
+        productID, err := AddProduct(context.Background(), models.Product{Name: "Widget", Price: 10, Stock: 100, CategoryID: 1})
+        if err != nil {
+                t.Fatalf("AddProduct failed: %v", err)
+        }
+
+        // Two sales by admin, one with a discount, and a refunded one
+        sales := []struct {
+                quantity int
+                discount float64
+                refunded bool
+        }{
+                {2, 0, false},
+                {4, 5, false},
+                {1, 0, true},
+        }
+        for _, s := range sales {
+                var refundedAt interface{}
+                if s.refunded {
+                        refundedAt = time.Now()
+                }
+                subtotal := 10 * float64(s.quantity)
+                _, err := DB.Exec(
+                        `INSERT INTO sales (product_id, quantity, price_per_unit, discount_amount, subtotal, total, sale_date, user_id, terminal_id, refunded_at)
+                         VALUES (?, ?, 10, ?, ?, ?, ?, ?, 'till-1', ?)`,
+                        productID, s.quantity, s.discount, subtotal, subtotal-s.discount, time.Now(), admin.ID, refundedAt,
+                )
+                if err != nil {
+                        t.Fatalf("Failed to insert sale: %v", err)
+                }
+        }
+
+        // A role rule and a more specific category rule for the same role
+        ctx := WithActor(context.Background(), Actor{Username: "admin", Source: SourceCLI})
+        if _, err := SetCommissionRule(ctx, models.CommissionRule{Role: models.RoleAdmin, Rate: 1}); err != nil {
+                t.Fatalf("SetCommissionRule failed: %v", err)
+        }
+        rule, err := SetCommissionRule(ctx, models.CommissionRule{Role: models.RoleAdmin, CategoryID: 1, Rate: 10})
+        if err != nil {
+                t.Fatalf("SetCommissionRule failed: %v", err)
+        }
+        if _, err := SetCommissionRule(ctx, models.CommissionRule{Role: "nonexistent", Rate: 1}); err == nil {
+                t.Error("Expected an error for a commission rule on an unknown role")
+        }
+
+        // Setting the same role and category again updates the rule
+        updated, err := SetCommissionRule(ctx, models.CommissionRule{Role: models.RoleAdmin, CategoryID: 1, Rate: 5})
+        if err != nil || updated.ID != rule.ID {
+                t.Fatalf("Expected rule %d to be updated, got %d (%v)", rule.ID, updated.ID, err)
+        }
+
+        results, err := GetStaffPerformance("", "")
+        if err != nil {
+                t.Fatalf("GetStaffPerformance failed: %v", err)
+        }
+        if len(results) != 1 {
+                t.Fatalf("Expected results for 1 user, got %d", len(results))
+        }
+
+        p := results[0]
+        if p.UserID != admin.ID || p.Transactions != 3 || p.Refunds != 1 || p.Items != 6 {
+                t.Errorf("Unexpected counts: %+v", p)
+        }
+        if p.Revenue != 55 || p.AverageBasket() != 27.5 || p.DiscountedSales != 1 {
+                t.Errorf("Expected revenue 55, average basket 27.50 and 1 discounted sale, got %+v", p)
+        }
+        // 5% of the 55 sold after discounts, the refunded sale earns nothing
+        if p.Commission < 2.749 || p.Commission > 2.751 {
+                t.Errorf("Expected commission 2.75, got %.4f", p.Commission)
+        }
+
+        if err := DeleteCommissionRule(ctx, rule.ID); err != nil {
+                t.Fatalf("DeleteCommissionRule failed: %v", err)
+        }
+        if err := DeleteCommissionRule(ctx, rule.ID); err != ErrCommissionRuleNotFound {
+                t.Errorf("Expected ErrCommissionRuleNotFound, got %v", err)
+        }
+
+        // Two rules created, one updated and one deleted
+        logs, err := GetAuditLogs("admin", "", "commission_rule", "", "", 0, 0)
+        if err != nil || len(logs) != 4 {
+                t.Fatalf("Expected 4 commission rule audit logs, got %d (%v)", len(logs), err)
+        }
+}
+
+func TestAPITokens(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        admin, err := GetUserByUsername("admin")
+        if err != nil {
+                t.Fatalf("GetUserByUsername failed: %v", err)
+        }
+        expiresAt := time.Now().Add(time.Hour)
+
+        if err := CreateRefreshToken(admin.ID, "hash-1", "family-1", "127.0.0.1", expiresAt); err != nil {
+                t.Fatalf("CreateRefreshToken failed: %v", err)
+        }
+
+        // Rotating issues a new token in the same family
+        userID, err := RotateRefreshToken("hash-1", "hash-2", "127.0.0.1", expiresAt)
+        if err != nil {
+                t.Fatalf("RotateRefreshToken failed: %v", err)
+        }
+        if userID != admin.ID {
+                t.Errorf("Expected user %d, got %d", admin.ID, userID)
+        }
+
+        // Using the old token again revokes the whole family
+        if _, err := RotateRefreshToken("hash-1", "hash-3", "127.0.0.1", expiresAt); !errors.Is(err, ErrRefreshTokenReused) {
+                t.Errorf("Expected ErrRefreshTokenReused, got %v", err)
+        }
+        if _, err := RotateRefreshToken("hash-2", "hash-4", "127.0.0.1", expiresAt); !errors.Is(err, ErrRefreshTokenInvalid) {
+                t.Errorf("Expected the rotated token to be revoked, got %v", err)
+        }
+        if _, err := RotateRefreshToken("unknown", "hash-5", "127.0.0.1", expiresAt); !errors.Is(err, ErrRefreshTokenInvalid) {
+                t.Errorf("Expected ErrRefreshTokenInvalid for an unknown token, got %v", err)
+        }
+
+        // Logging out revokes the refresh token's family
+        if err := CreateRefreshToken(admin.ID, "hash-6", "family-2", "127.0.0.1", expiresAt); err != nil {
+                t.Fatalf("CreateRefreshToken failed: %v", err)
+        }
+        if err := RevokeRefreshToken(admin.ID, "hash-6"); err != nil {
+                t.Fatalf("RevokeRefreshToken failed: %v", err)
+        }
+        if _, err := RotateRefreshToken("hash-6", "hash-7", "127.0.0.1", expiresAt); !errors.Is(err, ErrRefreshTokenInvalid) {
+                t.Errorf("Expected a logged out token to be rejected, got %v", err)
+        }
+
+        // Access tokens are denylisted by ID
+        if err := RevokeAccessToken("jti-1", admin.ID, expiresAt); err != nil {
+                t.Fatalf("RevokeAccessToken failed: %v", err)
+        }
+        if revoked, err := IsAccessTokenRevoked("jti-1"); err != nil || !revoked {
+                t.Errorf("Expected jti-1 to be revoked, got %v, %v", revoked, err)
+        }
+        if revoked, err := IsAccessTokenRevoked("jti-2"); err != nil || revoked {
+                t.Errorf("Expected jti-2 not to be revoked, got %v, %v", revoked, err)
+        }
+
+        // Revoking all of a user's tokens covers those issued before now
+        issuedAt := time.Now().Add(-time.Minute)
+        if err := CreateRefreshToken(admin.ID, "hash-8", "family-3", "127.0.0.1", expiresAt); err != nil {
+                t.Fatalf("CreateRefreshToken failed: %v", err)
+        }
+        if err := RevokeUserTokens(admin.ID); err != nil {
+                t.Fatalf("RevokeUserTokens failed: %v", err)
+        }
+        security, err := GetUserSecurity(admin.ID)
+        if err != nil {
+                t.Fatalf("GetUserSecurity failed: %v", err)
+        }
+        if !security.TokenRevoked(issuedAt) {
+                t.Error("Expected tokens issued before revocation to be revoked")
+        }
+        if security.TokenRevoked(time.Now().Add(time.Minute)) {
+                t.Error("Expected tokens issued after revocation to be valid")
+        }
+        if _, err := RotateRefreshToken("hash-8", "hash-9", "127.0.0.1", expiresAt); !errors.Is(err, ErrRefreshTokenInvalid) {
+                t.Errorf("Expected refresh tokens to be revoked, got %v", err)
+        }
+}
+
+func TestLoginAfterRevokingTokens(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        t.Setenv("TERMPOS_JWT_SECRET", strings.Repeat("s", auth.MinJWTSecretLength))
+        t.Setenv("TERMPOS_JWT_KEYS", "")
+        if err := auth.InitJWT(); err != nil {
+                t.Fatalf("InitJWT failed: %v", err)
+        }
+        admin, err := GetUserByUsername("admin")
+        if err != nil {
+                t.Fatalf("GetUserByUsername failed: %v", err)
+        }
+
+        // A token issued in the same second as the revocation is revoked, although its
+        // issue time is truncated to before the revocation
+        oldToken, _, err := auth.GenerateJWT(admin.ID, admin.Username, string(admin.Role), time.Minute)
+        if err != nil {
+                t.Fatalf("GenerateJWT failed: %v", err)
+        }
+        if err := RevokeUserTokens(admin.ID); err != nil {
+                t.Fatalf("RevokeUserTokens failed: %v", err)
+        }
+        security, err := GetUserSecurity(admin.ID)
+        if err != nil {
+                t.Fatalf("GetUserSecurity failed: %v", err)
+        }
+        claims, err := auth.ValidateJWT(oldToken)
+        if err != nil {
+                t.Fatalf("ValidateJWT failed: %v", err)
+        }
+        if !security.TokenRevoked(claims.IssuedAt.Time) {
+                t.Error("Expected the token issued before revocation to be revoked")
+        }
+
+        // Logging in immediately afterwards issues a token that is not
+        issuedAt := security.TokenIssueTime(time.Now())
+        newToken, _, err := auth.GenerateJWTAt(admin.ID, admin.Username, string(admin.Role), issuedAt, time.Minute)
+        if err != nil {
+                t.Fatalf("GenerateJWTAt failed: %v", err)
+        }
+        claims, err = auth.ValidateJWT(newToken)
+        if err != nil {
+                t.Fatalf("Expected the new token to validate, got %v", err)
+        }
+        if security.TokenRevoked(claims.IssuedAt.Time) {
+                t.Error("Expected the token issued right after revocation to be valid")
+        }
+}
+
+func TestAPIKeys(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        key, err := CreateAPIKey(models.APIKey{
+                Name:      "webshop",
+                Prefix:    "tpk_1234abcd",
+                Scopes:    []string{"product:read", "sale:create"},
+                CreatedBy: "admin",
+                ExpiresAt: time.Now().Add(time.Hour),
+        }, "key-hash")
+        if err != nil {
+                t.Fatalf("CreateAPIKey failed: %v", err)
+        }
+        if _, err := CreateAPIKey(models.APIKey{Name: "webshop", Scopes: []string{"product:read"}}, "other-hash"); !errors.Is(err, ErrAPIKeyExists) {
+                t.Errorf("Expected ErrAPIKeyExists for a duplicate name, got %v", err)
+        }
+
+        used, err := UseAPIKey("key-hash", "10.0.0.5")
+        if err != nil {
+                t.Fatalf("UseAPIKey failed: %v", err)
+        }
+        if used.ID != key.ID || len(used.Scopes) != 2 || used.Scopes[1] != "sale:create" {
+                t.Errorf("Expected key %d with its scopes, got %+v", key.ID, used)
+        }
+
+        stored, err := GetAPIKey(key.ID)
+        if err != nil {
+                t.Fatalf("GetAPIKey failed: %v", err)
+        }
+        if stored.LastUsedAt.IsZero() || stored.LastUsedIP != "10.0.0.5" {
+                t.Errorf("Expected the last use to be recorded, got %v from %q", stored.LastUsedAt, stored.LastUsedIP)
+        }
+
+        if _, err := UseAPIKey("unknown-hash", ""); !errors.Is(err, ErrAPIKeyInvalid) {
+                t.Errorf("Expected ErrAPIKeyInvalid for an unknown key, got %v", err)
+        }
+
+        // Expired and revoked keys are refused
+        if _, err := CreateAPIKey(models.APIKey{Name: "old", Scopes: []string{"product:read"}, CreatedBy: "admin", ExpiresAt: time.Now().Add(-time.Minute)}, "old-hash"); err != nil {
+                t.Fatalf("CreateAPIKey failed: %v", err)
+        }
+        if _, err := UseAPIKey("old-hash", ""); !errors.Is(err, ErrAPIKeyInvalid) {
+                t.Errorf("Expected ErrAPIKeyInvalid for an expired key, got %v", err)
+        }
+
+        if err := RevokeAPIKey(key.ID); err != nil {
+                t.Fatalf("RevokeAPIKey failed: %v", err)
+        }
+        if _, err := UseAPIKey("key-hash", ""); !errors.Is(err, ErrAPIKeyInvalid) {
+                t.Errorf("Expected ErrAPIKeyInvalid for a revoked key, got %v", err)
+        }
+        if err := RevokeAPIKey(key.ID); err == nil {
+                t.Error("Expected revoking a revoked key to fail")
+        }
+        if err := RevokeAPIKey(999); !errors.Is(err, ErrAPIKeyNotFound) {
+                t.Errorf("Expected ErrAPIKeyNotFound, got %v", err)
+        }
+
+        keys, err := ListAPIKeys()
+        if err != nil {
+                t.Fatalf("ListAPIKeys failed: %v", err)
+        }
+        if len(keys) != 2 || keys[1].Status(time.Now()) != "revoked" {
+                t.Errorf("Expected 2 keys with webshop revoked, got %+v", keys)
+        }
+}
+
+// auditProblemKinds returns the kinds of the problems found verifying the audit chain
+func auditProblemKinds(t *testing.T, checkpoints []AuditCheckpoint) []string {
+        t.Helper()
+        result, err := VerifyAuditChain("", checkpoints)
+        if err != nil {
+                t.Fatalf("VerifyAuditChain failed: %v", err)
+        }
+
+        var kinds []string
+        for _, p := range result.Problems {
+                kinds = append(kinds, p.Kind)
+        }
+        return kinds
+}
+
+func TestAuditChain(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        for i := 1; i <= 3; i++ {
+                if err := LogUserAction("admin", ActionUpdate, "products", "1", "Changed price"); err != nil {
+                        t.Fatalf("AddAuditLog failed: %v", err)
+                }
+        }
+        if err := AddApprovedAuditLog("cashier", "manager", ActionRefund, "sales", "7", "Refunded sale", "", ""); err != nil {
+                t.Fatalf("AddApprovedAuditLog failed: %v", err)
+        }
+
+        logs, err := GetAuditLogs("", "", "", "", "", 0, 0)
+        if err != nil {
+                t.Fatalf("GetAuditLogs failed: %v", err)
+        }
+        if len(logs) != 4 || logs[0].PrevHash != logs[1].Hash || logs[3].PrevHash != AuditGenesisHash {
+                t.Fatalf("Expected 4 chained entries, got %+v", logs)
+        }
+        if kinds := auditProblemKinds(t, nil); len(kinds) != 0 {
+                t.Fatalf("Expected an intact chain, got %v", kinds)
+        }
+
+        // A checkpoint only verifies with the key it was signed with
+        key := []byte("0123456789abcdef0123456789abcdef")
+        checkpoint, err := NewAuditCheckpoint(key)
+        if err != nil {
+                t.Fatalf("NewAuditCheckpoint failed: %v", err)
+        }
+        if checkpoint.LastID != 4 || checkpoint.Hash != logs[0].Hash {
+                t.Errorf("Expected a checkpoint of entry 4, got %+v", checkpoint)
+        }
+        if err := checkpoint.VerifySignature(key); err != nil {
+                t.Errorf("Expected the checkpoint signature to verify, got %v", err)
+        }
+        if err := checkpoint.VerifySignature([]byte("another key of at least 32 bytes")); !errors.Is(err, ErrInvalidCheckpointSignature) {
+                t.Errorf("Expected ErrInvalidCheckpointSignature for another key, got %v", err)
+        }
+
+        // Edited entries do not match their hash, and restoring them mends the chain
+        DB.Exec("UPDATE audit_logs SET description = 'Nothing happened' WHERE id = 2")
+        if kinds := auditProblemKinds(t, nil); len(kinds) != 1 || kinds[0] != AuditProblemModified {
+                t.Errorf("Expected the edited entry to be found, got %v", kinds)
+        }
+        DB.Exec("UPDATE audit_logs SET description = 'Changed price' WHERE id = 2")
+
+        // Archived entries stay in the database until their retention expires, and must
+        // match their archived copies until then
+        dir := t.TempDir()
+        archives, err := ArchiveAuditLogs(time.Now().Add(time.Hour), AuditArchiveOptions{Dir: dir, SegmentEntries: 3}, "admin")
+        if err != nil {
+                t.Fatalf("ArchiveAuditLogs failed: %v", err)
+        }
+        if len(archives) != 2 || archives[0].LastID != 3 || archives[1].LastID != 4 || archives[1].HeadHash != checkpoint.Hash {
+                t.Fatalf("Expected entries 1 to 4 to be archived in 2 segments, got %+v", archives)
+        }
+        archive := archives[0]
+        if _, err := ArchiveAuditLogs(time.Now().Add(-time.Hour), AuditArchiveOptions{Dir: dir}, "admin"); !errors.Is(err, ErrNoAuditLogsToArchive) {
+                t.Errorf("Expected ErrNoAuditLogsToArchive, got %v", err)
+        }
+
+        DB.Exec("UPDATE audit_logs SET hash = ? WHERE id = 3", logs[0].Hash)
+        if kinds := auditProblemKinds(t, nil); len(kinds) != 1 || kinds[0] != AuditProblemModified {
+                t.Errorf("Expected the entry that differs from its archived copy to be found, got %v", kinds)
+        }
+        DB.Exec("UPDATE audit_logs SET hash = ? WHERE id = 3", logs[1].Hash)
+
+        if err := SetAuditRetention(ActionRefund, 30, "admin"); err != nil {
+                t.Fatalf("SetAuditRetention failed: %v", err)
+        }
+        if err := SetAuditRetention(AuditRetentionDefault, 1, "admin"); err != nil {
+                t.Fatalf("SetAuditRetention failed: %v", err)
+        }
+        if err := SetAuditRetention("sneeze", 1, "admin"); err == nil {
+                t.Error("Expected a retention policy for an unknown action to be refused")
+        }
+
+        // In two days, the updates are past the default retention but the refund is kept,
+        // and so are the entries that were not archived
+        purged, err := ApplyAuditRetention(time.Now().Add(48*time.Hour), 0, "admin")
+        if err != nil {
+                t.Fatalf("ApplyAuditRetention failed: %v", err)
+        }
+        if purged != 3 {
+                t.Errorf("Expected 3 entries to be purged, got %d", purged)
+        }
+        if _, err := GetAuditLog(4); err != nil {
+                t.Errorf("Expected the refund to be kept, got %v", err)
+        }
+
+        LogUserAction("admin", ActionUpdate, "products", "1", "Changed stock")
+        result, err := VerifyAuditChain("", []AuditCheckpoint{checkpoint})
+        if err != nil {
+                t.Fatalf("VerifyAuditChain failed: %v", err)
+        }
+        if !result.OK() || result.Archived != 4 || result.HeadID != 9 {
+                t.Errorf("Expected 4 archived entries and the chain up to entry 9 to verify, got %+v", result)
+        }
+
+        // Deleting entries breaks the chain, in the middle or at the end
+        DB.Exec("DELETE FROM audit_logs WHERE id = 8")
+        if kinds := auditProblemKinds(t, nil); len(kinds) != 1 || kinds[0] != AuditProblemGap {
+                t.Errorf("Expected the deleted entry to be found, got %v", kinds)
+        }
+        DB.Exec("DELETE FROM audit_logs WHERE id = 9")
+        if kinds := auditProblemKinds(t, nil); len(kinds) != 1 || kinds[0] != AuditProblemTruncated {
+                t.Errorf("Expected the truncated log to be found, got %v", kinds)
+        }
+
+        // A changed archive file is found, and so is a checkpoint of an entry that is gone
+        file, err := os.OpenFile(archive.File, os.O_APPEND|os.O_WRONLY, 0600)
+        if err != nil {
+                t.Fatalf("Failed to open archive file: %v", err)
+        }
+        file.WriteString("\n")
+        file.Close()
+
+        gone := checkpoint
+        gone.LastID = 8
+        kinds := auditProblemKinds(t, []AuditCheckpoint{checkpoint, gone})
+        expected := []string{AuditProblemArchive, AuditProblemTruncated, AuditProblemCheckpoint}
+        if len(kinds) != len(expected) {
+                t.Fatalf("Expected problems %v, got %v", expected, kinds)
+        }
+        for i := range expected {
+                if kinds[i] != expected[i] {
+                        t.Errorf("Expected problems %v, got %v", expected, kinds)
+                        break
+                }
+        }
+}
+
+func TestExportAuditLogs(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+        setTestEncryptionKey(t)
+
+        LogUserAction("admin", ActionLogin, "auth", "admin", "Logged in")
+        LogUserAction("admin", ActionUpdate, "products", "1", "Changed \"price\", again")
+        LogUserAction("cashier", ActionUpdate, "products", "2", "Changed stock")
+
+        var out bytes.Buffer
+        count, err := ExportAuditLogs(&out, AuditExportJSON, "", ActionUpdate, "", "", "")
+        if err != nil {
+                t.Fatalf("ExportAuditLogs failed: %v", err)
+        }
+        var logs []AuditLog
+        if err := json.Unmarshal(out.Bytes(), &logs); err != nil {
+                t.Fatalf("Expected a JSON array, got %v:\n%s", err, out.String())
+        }
+        if count != 2 || len(logs) != 2 || logs[0].ID != 2 || logs[1].Username != "cashier" {
+                t.Errorf("Expected the 2 updates oldest first, got %d: %+v", count, logs)
+        }
+
+        out.Reset()
+        if count, err := ExportAuditLogs(&out, AuditExportJSON, "nobody", "", "", "", ""); err != nil || count != 0 || out.String() != "[]\n" {
+                t.Errorf("Expected an empty array, got %d %q (%v)", count, out.String(), err)
+        }
+
+        out.Reset()
+        if _, err := ExportAuditLogs(&out, AuditExportJSONL, "admin", "", "", "", ""); err != nil {
+                t.Fatalf("ExportAuditLogs failed: %v", err)
+        }
+        if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], `{"id":1,`) {
+                t.Errorf("Expected 2 JSON lines, got %q", out.String())
+        }
+
+        out.Reset()
+        if _, err := ExportAuditLogs(&out, AuditExportCSV, "", "", "products", "", ""); err != nil {
+                t.Fatalf("ExportAuditLogs failed: %v", err)
+        }
+        records, err := csv.NewReader(&out).ReadAll()
+        if err != nil {
+                t.Fatalf("Expected valid CSV, got %v", err)
+        }
+        if len(records) != 3 || records[0][0] != "id" || records[1][6] != `Changed "price", again` {
+                t.Errorf("Expected a header and 2 rows, got %q", records)
+        }
+
+        if _, err := ExportAuditLogs(&out, "xml", "", "", "", "", ""); err == nil {
+                t.Error("Expected an unknown format to be refused")
+        }
+
+        // Segments can be encrypted, and are read back the same
+        all, _ := GetAuditLogs("", "", "", "", "", 0, 0)
+        path := filepath.Join(t.TempDir(), "segment.jsonl.gz.enc")
+        sum, err := writeAuditArchive(path, all, true)
+        if err != nil {
+                t.Fatalf("writeAuditArchive failed: %v", err)
+        }
+        read, readSum, err := readAuditArchive(path)
+        if err != nil {
+                t.Fatalf("readAuditArchive failed: %v", err)
+        }
+        if readSum != sum || len(read) != 3 || read[2].Hash != all[2].Hash {
+                t.Errorf("Expected the segment to read back the same, got %+v", read)
+        }
+        if data, _ := os.ReadFile(path); bytes.Contains(data, []byte("cashier")) {
+                t.Error("Expected the segment to be encrypted")
+        }
+}
+
+func TestAuditedMutations(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        ctx := WithActor(context.Background(), Actor{Username: "manager", Source: SourceCLI, IPAddress: "10.0.0.5"})
+
+        id, err := AddSupplier(ctx, models.Supplier{Name: "Dairy Co", IsActive: true})
+        if err != nil {
+                t.Fatalf("AddSupplier failed: %v", err)
+        }
+        supplier, err := GetSupplierByID(id)
+        if err != nil {
+                t.Fatalf("GetSupplierByID failed: %v", err)
+        }
+        supplier.Phone = "555-0100"
+        if err := UpdateSupplier(ctx, supplier); err != nil {
+                t.Fatalf("UpdateSupplier failed: %v", err)
+        }
+        if err := DeleteSupplier(context.Background(), id); err != nil {
+                t.Fatalf("DeleteSupplier failed: %v", err)
+        }
+
+        // A change that fails is not audited
+        if err := DeleteSupplier(ctx, id); !errors.Is(err, ErrSupplierNotFound) {
+                t.Fatalf("Expected ErrSupplierNotFound, got %v", err)
+        }
+
+        logs, err := GetAuditLogsBefore("", "", "supplier", "", "", 0, 10)
+        if err != nil {
+                t.Fatalf("GetAuditLogsBefore failed: %v", err)
+        }
+        if len(logs) != 3 {
+                t.Fatalf("Expected 3 supplier audit log entries, got %d", len(logs))
+        }
+
+        deleted, updated, created := logs[0], logs[1], logs[2]
+        if created.Action != ActionCreate || created.Username != "manager" || created.Source != SourceCLI ||
+                created.IPAddress != "10.0.0.5" || created.PreviousValue != "" || !strings.Contains(created.NewValue, "Dairy Co") {
+                t.Errorf("Unexpected create entry: %+v", created)
+        }
+        if updated.Action != ActionUpdate || strings.Contains(updated.PreviousValue, "555-0100") || !strings.Contains(updated.NewValue, "555-0100") {
+                t.Errorf("Expected the update to record the previous and new phone, got %+v", updated)
+        }
+
+        // Changes made without an actor are attributed to the system
+        if deleted.Action != ActionDelete || deleted.Username != "system" || deleted.Source != SourceSystem || deleted.NewValue != "" {
+                t.Errorf("Unexpected delete entry: %+v", deleted)
+        }
+
+        if kinds := auditProblemKinds(t, nil); len(kinds) != 0 {
+                t.Fatalf("Expected an intact chain, got %v", kinds)
+        }
+}
+
+// TestKeyRotation tests re-encrypting sensitive data with a new data key
+func TestKeyRotation(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+        setTestEncryptionKey(t)
+
+        ctx := WithActor(context.Background(), Actor{Username: "admin", Source: SourceCLI})
+        values := map[string]string{"alpha": "1", "beta": "2", "gamma": "3"}
+        for field, value := range values {
+                if err := StoreSensitiveData(ctx, "user", 1, field, value); err != nil {
+                        t.Fatalf("StoreSensitiveData failed: %v", err)
+                }
+        }
+        if err := StoreSensitiveData(ctx, "user", 1, "alpha", "one"); err != nil {
+                t.Fatalf("StoreSensitiveData failed: %v", err)
+        }
+        if err := DeleteSensitiveData(ctx, "user", 1, "alpha"); err != nil {
+                t.Fatalf("DeleteSensitiveData failed: %v", err)
+        }
+        if err := StoreSensitiveData(ctx, "user", 1, "alpha", "1"); err != nil {
+                t.Fatalf("StoreSensitiveData failed: %v", err)
+        }
+        for action, want := range map[AuditAction]int{ActionCreate: 4, ActionUpdate: 1, ActionDelete: 1} {
+                logs, err := GetAuditLogsBefore("admin", action, "sensitive_data", "", "", 0, 10)
+                if err != nil || len(logs) != want {
+                        t.Fatalf("Expected %d %s audit logs for sensitive data, got %d (%v)", want, action, len(logs), err)
+                }
+                for _, log := range logs {
+                        if strings.Contains(log.PreviousValue+log.NewValue, "one") || !strings.Contains(log.PreviousValue+log.NewValue, redactedPII) {
+                                t.Errorf("Expected the value redacted in the audit log, got %+v", log)
+                        }
+                }
+        }
+        firstKey, err := security.ActiveKeyID()
+        if err != nil {
+                t.Fatalf("ActiveKeyID failed: %v", err)
+        }
+
+        // A row encrypted with the master key directly, as earlier versions did
+        block, _ := aes.NewCipher(bytes.Repeat([]byte{7}, 32))
+        gcm, _ := cipher.NewGCM(block)
+        nonce := make([]byte, gcm.NonceSize())
+        legacy := base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte("4"), nil))
+        if _, err := DB.Exec("INSERT INTO sensitive_data (resource_type, resource_id, field_name, encrypted_value, created_at, updated_at) VALUES ('user', 1, 'delta', ?, '', '')", legacy); err != nil {
+                t.Fatalf("Failed to insert legacy row: %v", err)
+        }
+        values["delta"] = "4"
+
+        counts, err := CountSensitiveDataByKey()
+        if err != nil || counts[firstKey] != 3 || counts[""] != 1 {
+                t.Fatalf("Expected 3 rows on %s and 1 legacy row, got %v (%v)", firstKey, counts, err)
+        }
+
+        rotation, err := RotateSensitiveData(ctx, 3, true)
+        if err != nil {
+                t.Fatalf("RotateSensitiveData failed: %v", err)
+        }
+        if rotation.KeyID == firstKey || rotation.Rotated != 4 || rotation.Batches != 2 {
+                t.Errorf("Expected 4 rows rotated to a new key in 2 batches, got %+v", rotation)
+        }
+        if counts, _ := CountSensitiveDataByKey(); len(counts) != 1 || counts[rotation.KeyID] != 4 {
+                t.Errorf("Expected every row on %s, got %v", rotation.KeyID, counts)
+        }
+        for field, want := range values {
+                if got, err := GetSensitiveData("user", 1, field); err != nil || got != want {
+                        t.Errorf("Expected %s to decrypt to %q, got %q (%v)", field, want, got, err)
+                }
+        }
+
+        keys, err := GetDataKeys()
+        if err != nil || len(keys) != 2 {
+                t.Fatalf("Expected 2 data keys, got %d (%v)", len(keys), err)
+        }
+        if keys[0].ID != firstKey || keys[0].Active() || keys[1].ID != rotation.KeyID || !keys[1].Active() {
+                t.Errorf("Expected %s retired and %s active, got %+v", firstKey, rotation.KeyID, keys)
+        }
+
+        // Resuming keeps the active key and has nothing left to do
+        if resumed, err := RotateSensitiveData(ctx, 0, false); err != nil || resumed.KeyID != rotation.KeyID || resumed.Rotated != 0 {
+                t.Errorf("Expected nothing to resume on %s, got %+v (%v)", rotation.KeyID, resumed, err)
+        }
+
+        logs, err := GetAuditLogsBefore("", ActionKeyRotate, "", "", "", 0, 10)
+        if err != nil || len(logs) != 2 || logs[1].Username != "admin" || logs[1].ResourceID != rotation.KeyID {
+                t.Errorf("Expected both rotations audited, got %+v (%v)", logs, err)
+        }
+
+        // The data keys cannot be unwrapped with another master key
+        t.Setenv("POS_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32)))
+        if err := security.InitEncryption(); err != nil {
+                t.Fatalf("InitEncryption failed: %v", err)
+        }
+        if _, err := GetSensitiveData("user", 1, "alpha"); err == nil {
+                t.Error("Expected decryption with another master key to fail")
+        }
+
+        // Nothing is encrypted without a master key
+        t.Setenv("POS_ENCRYPTION_KEY", "")
+        if err := security.InitEncryption(); err != nil {
+                t.Fatalf("InitEncryption failed: %v", err)
+        }
+        if err := StoreSensitiveData(ctx, "user", 1, "epsilon", "5"); !errors.Is(err, security.ErrEphemeralKey) {
+                t.Errorf("Expected ErrEphemeralKey, got %v", err)
+        }
+}
+
+func TestPIIEncryption(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+
+        // Personal data written without a master key is stored in plaintext
+        ctx := context.Background()
+        customerID, err := AddCustomer(ctx, models.Customer{
+                Name:     "Jane Doe",
+                Email:    "jane@example.com",
+                Phone:    "555-0100",
+                Address:  "1 Main St",
+                Birthday: "1990-04-01",
+        })
+        if err != nil {
+                t.Fatalf("AddCustomer failed: %v", err)
+        }
+        userID, err := CreateUser(ctx, models.User{Username: "casey", PasswordHash: "hash", Role: models.RoleCashier, Email: "casey@example.com", Active: true})
+        if err != nil {
+                t.Fatalf("CreateUser failed: %v", err)
+        }
+        var saleID int
+        err = DB.QueryRow(
+                `INSERT INTO sales (product_id, quantity, price_per_unit, subtotal, total, customer_email, customer_phone)
+                 VALUES (1, 1, 3.50, 3.50, 3.50, 'walkin@example.com', '555-0199') RETURNING id`,
+        ).Scan(&saleID)
+        if err != nil {
+                t.Fatalf("Failed to insert sale: %v", err)
+        }
+
+        // and encrypted in place once one is configured
+        setTestEncryptionKey(t)
+        if encrypted, err := EncryptPII(); err != nil || encrypted != 3 {
+                t.Fatalf("Expected the customer, the user and the sale encrypted, got %d (%v)", encrypted, err)
+        }
+        var saleEmail string
+        DB.QueryRow("SELECT customer_email FROM sales WHERE id = ?", saleID).Scan(&saleEmail)
+        if security.CiphertextKeyID(saleEmail) == "" {
+                t.Errorf("Expected the email address given with the sale to be encrypted, got %q", saleEmail)
+        }
+        if sale, err := GetSale(saleID); err != nil || sale.CustomerEmail != "walkin@example.com" || sale.CustomerPhone != "555-0199" {
+                t.Errorf("Expected to decrypt the sale, got %+v (%v)", sale, err)
+        }
+        var email, phone, birthday string
+        var emailIndex sql.NullString
+        DB.QueryRow("SELECT email, phone, birthday, email_bidx FROM customers WHERE id = ?", customerID).Scan(&email, &phone, &birthday, &emailIndex)
+        for _, value := range []string{email, phone, birthday} {
+                if security.CiphertextKeyID(value) == "" {
+                        t.Errorf("Expected the stored value to be encrypted, got %q", value)
+                }
+        }
+        if !emailIndex.Valid {
+                t.Error("Expected the email address to be indexed")
+        }
+        if counts, err := CountPIIByKey(); err != nil || counts[""] != 0 {
+                t.Errorf("Expected no plaintext personal data, got %v (%v)", counts, err)
+        }
+
+        // Encrypted values are found by their blind index
+        customer, err := GetCustomerByEmail(" JANE@example.com")
+        if err != nil || customer.ID != customerID || customer.Email != "jane@example.com" || customer.Birthday != "1990-04-01" {
+                t.Errorf("Expected to find the customer by email, got %+v (%v)", customer, err)
+        }
+        if customer, err := GetCustomerByPhone("555-0100"); err != nil || customer.ID != customerID {
+                t.Errorf("Expected to find the customer by phone, got %+v (%v)", customer, err)
+        }
+        if found, err := SearchCustomers("jane@example.com", 10); err != nil || len(found) != 1 || found[0].Phone != "555-0100" {
+                t.Errorf("Expected to search the customer by email, got %+v (%v)", found, err)
+        }
+        if found, err := ListCustomers("555-0100", 10, 0); err != nil || len(found) != 1 || found[0].Email != "jane@example.com" {
+                t.Errorf("Expected to list the customer by phone, got %+v (%v)", found, err)
+        }
+        // Short queries match names only, not part of the ciphertext of other customers
+        if _, err := AddCustomer(ctx, models.Customer{Name: "Bob Roe", Email: "bob@example.com", Phone: "555-0111"}); err != nil {
+                t.Fatalf("AddCustomer failed: %v", err)
+        }
+        for _, query := range []string{"1", "v1", "5", "e"} {
+                found, err := SearchCustomers(query, 10)
+                if err != nil {
+                        t.Fatalf("SearchCustomers failed: %v", err)
+                }
+                listed, err := ListCustomers(query, 10, 0)
+                if err != nil {
+                        t.Fatalf("ListCustomers failed: %v", err)
+                }
+                for _, customer := range append(found, listed...) {
+                        if !strings.Contains(strings.ToLower(customer.Name), query) {
+                                t.Errorf("Expected %q not to match %s", query, customer.Name)
+                        }
+                }
+        }
+
+        if user, err := GetUserByEmail("casey@example.com"); err != nil || user.ID != userID || user.Email != "casey@example.com" {
+                t.Errorf("Expected to find the user by email, got %+v (%v)", user, err)
+        }
+
+        // Email addresses stay unique although they are encrypted
+        if _, err := AddCustomer(ctx, models.Customer{Name: "Jane Again", Email: "Jane@Example.com"}); !IsUniqueViolation(err) {
+                t.Errorf("Expected a unique violation, got %v", err)
+        }
+
+        // Rotating the data key re-encrypts personal data too, and encrypts personal data
+        // written in plaintext
+        if _, err := DB.Exec("UPDATE customers SET address = '1 Main St' WHERE id = ?", customerID); err != nil {
+                t.Fatalf("Failed to store a plaintext address: %v", err)
+        }
+        rotation, err := RotateSensitiveData(WithActor(ctx, Actor{Username: "admin", Source: SourceCLI}), 0, true)
+        if err != nil {
+                t.Fatalf("RotateSensitiveData failed: %v", err)
+        }
+        if counts, _ := CountPIIByKey(); len(counts) != 1 || counts[rotation.KeyID] == 0 {
+                t.Errorf("Expected all personal data on %s, got %v", rotation.KeyID, counts)
+        }
+        if customer, err := GetCustomer(customerID); err != nil || customer.Address != "1 Main St" {
+                t.Errorf("Expected to decrypt the customer after rotation, got %+v (%v)", customer, err)
+        }
+}
+
+func TestPIINotCopiedOutsideColumns(t *testing.T) {
+        cleanup := setupTestDB(t)
+        defer cleanup()
+        setTestEncryptionKey(t)
+
+        if _, err := CreateWebhook(models.Webhook{URL: "https://example.com/hook", Events: []string{models.EventCustomerUpdated}}); err != nil {
+                t.Fatalf("CreateWebhook failed: %v", err)
+        }
+
+        ctx := WithActor(context.Background(), Actor{Username: "admin", Source: SourceCLI})
+        customerID, err := AddCustomer(ctx, models.Customer{Name: "Jane Doe", Email: "jane@example.com", Phone: "555-0100", Address: "1 Main St", Birthday: "1990-04-01"})
+        if err != nil {
+                t.Fatalf("AddCustomer failed: %v", err)
+        }
+        customer, err := GetCustomer(customerID)
+        if err != nil {
+                t.Fatalf("GetCustomer failed: %v", err)
+        }
+        customer.Email, customer.Phone, customer.Address = "jane.doe@example.com", "555-0199", "2 High St"
+        if err := UpdateCustomer(ctx, customer); err != nil {
+                t.Fatalf("UpdateCustomer failed: %v", err)
+        }
+        if err := DeleteCustomer(ctx, customerID); err != nil {
+                t.Fatalf("DeleteCustomer failed: %v", err)
+        }
+
+        userID, err := CreateUser(ctx, models.User{Username: "casey", PasswordHash: "hash", Role: models.RoleCashier, Email: "casey@example.com", Phone: "555-0200", Address: "3 Low St", EmergencyContact: "Sam 555-0300", Active: true})
+        if err != nil {
+                t.Fatalf("CreateUser failed: %v", err)
+        }
+        user, err := GetUserByID(userID)
+        if err != nil {
+                t.Fatalf("GetUserByID failed: %v", err)
+        }
+        user.Email, user.Phone = "casey.new@example.com", "555-0299"
+        if err := UpdateUser(ctx, user); err != nil {
+                t.Fatalf("UpdateUser failed: %v", err)
+        }
+        if err := DeleteUser(ctx, userID); err != nil {
+                t.Fatalf("DeleteUser failed: %v", err)
+        }
+
+        // Personal data is only kept, encrypted, in its columns
+        plaintext := []string{
+                "jane@example.com", "555-0100", "1 Main St", "1990-04-01", "jane.doe@example.com", "555-0199", "2 High St",
+                "casey@example.com", "555-0200", "3 Low St", "Sam 555-0300", "casey.new@example.com", "555-0299",
+        }
+        copies := map[string]string{
+                "audit_logs":         "SELECT COALESCE(previous_value, '') || COALESCE(new_value, '') || COALESCE(description, '') FROM audit_logs",
+                "events":             "SELECT data FROM events",
+                "webhook_deliveries": "SELECT payload FROM webhook_deliveries",
+        }
+        for table, query := range copies {
+                rows, err := DB.Query(query)
+                if err != nil {
+                        t.Fatalf("Failed to read %s: %v", table, err)
+                }
+                found := 0
+                for rows.Next() {
+                        var value string
+                        if err := rows.Scan(&value); err != nil {
+                                t.Fatalf("Failed to read %s: %v", table, err)
+                        }
+                        found++
+                        for _, pii := range plaintext {
+                                if strings.Contains(value, pii) {
+                                        t.Errorf("Expected no personal data in %s, found %q", table, pii)
+                                }
+                        }
+                }
+                rows.Close()
+                if found == 0 {
+                        t.Errorf("Expected rows in %s", table)
+                }
+        }
+}
+
+func TestDatabaseEncryption(t *testing.T) {
+        dir := t.TempDir()
+        path := filepath.Join(dir, "pos.db")
+        t.Setenv("POS_DB_KEY", "")
+        t.Setenv("POS_DB_PASSPHRASE", "")
+
+        // A database that is not encrypted opens without a key, and with one
+        if err := Initialize(path); err != nil {
+                t.Fatalf("Initialize failed: %v", err)
+        }
+        if _, err := AddCustomer(context.Background(), models.Customer{Name: "Jane Doe"}); err != nil {
+                t.Fatalf("AddCustomer failed: %v", err)
+        }
+        if IsDatabaseEncrypted() || GetDatabasePath() != path {
+                t.Errorf("Expected %s not to be encrypted", GetDatabasePath())
+        }
+        Close()
+        t.Setenv("POS_DB_PASSPHRASE", "correct horse battery staple")
+        if err := Initialize(path); err != nil {
+                t.Fatalf("Initialize with a passphrase failed: %v", err)
+        }
+        defer Close()
+        if IsDatabaseEncrypted() {
+                t.Error("Expected an existing database not to be encrypted by a passphrase alone")
+        }
+
+        ctx := WithActor(context.Background(), Actor{Username: "admin", Source: SourceCLI})
+        if err := checkCipher(); err != nil {
+                // Without SQLCipher nothing can be encrypted, and encrypted files fail clearly
+                if err := EncryptDatabase(ctx); !errors.Is(err, ErrCipherUnavailable) {
+                        t.Errorf("Expected ErrCipherUnavailable, got %v", err)
+                }
+                if err := Initialize(filepath.Join(dir, "new.db")); !errors.Is(err, ErrCipherUnavailable) {
+                        t.Errorf("Expected a new database to need SQLCipher, got %v", err)
+                }
+
+                encrypted := filepath.Join(dir, "encrypted.db")
+                if err := os.WriteFile(encrypted, bytes.Repeat([]byte{0xa5}, 4096), 0600); err != nil {
+                        t.Fatalf("Failed to write encrypted file: %v", err)
+                }
+                if ok, err := IsDatabaseFileEncrypted(encrypted); err != nil || !ok {
+                        t.Errorf("Expected %s to look encrypted, got %v (%v)", encrypted, ok, err)
+                }
+                if err := Initialize(encrypted); !errors.Is(err, ErrCipherUnavailable) {
+                        t.Errorf("Expected ErrCipherUnavailable, got %v", err)
+                }
+                t.Setenv("POS_DB_PASSPHRASE", "")
+                if err := Initialize(encrypted); !errors.Is(err, ErrDatabaseEncrypted) {
+                        t.Errorf("Expected ErrDatabaseEncrypted, got %v", err)
+                }
+                return
+        }
+
+        // With SQLCipher the database is encrypted in place
+        if err := EncryptDatabase(ctx); err != nil {
+                t.Fatalf("EncryptDatabase failed: %v", err)
+        }
+        if ok, err := IsDatabaseFileEncrypted(path); err != nil || !ok || !IsDatabaseEncrypted() {
+                t.Fatalf("Expected %s to be encrypted, got %v (%v)", path, ok, err)
+        }
+        Close()
+
+        t.Setenv("POS_DB_PASSPHRASE", "wrong")
+        if err := Initialize(path); !errors.Is(err, ErrWrongDatabaseKey) {
+                t.Errorf("Expected ErrWrongDatabaseKey, got %v", err)
+        }
+        t.Setenv("POS_DB_PASSPHRASE", "")
+        if err := Initialize(path); !errors.Is(err, ErrDatabaseEncrypted) {
+                t.Errorf("Expected ErrDatabaseEncrypted, got %v", err)
+        }
+        t.Setenv("POS_DB_PASSPHRASE", "correct horse battery staple")
+        if err := Initialize(path); err != nil {
+                t.Fatalf("Initialize with the passphrase failed: %v", err)
+        }
+        if customers, err := ListCustomers("Jane", 10, 0); err != nil || len(customers) != 1 {
+                t.Errorf("Expected the customer to survive encryption, got %+v (%v)", customers, err)
+        }
+
+        if err := DecryptDatabase(ctx); err != nil {
+                t.Fatalf("DecryptDatabase failed: %v", err)
+        }
+        if ok, _ := IsDatabaseFileEncrypted(path); ok || IsDatabaseEncrypted() {
+                t.Error("Expected the database to be decrypted")
+        }
+}
@@ -0,0 +1,41 @@
+package db
+
+import "termpos/internal/models"
+
+// createEventsTable creates the log of events published for live subscribers
+func createEventsTable() error {
+	query := `
+	CREATE TABLE events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		data TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX idx_events_created_at ON events(created_at);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
+
+// grantEventStreamPermission lets the built-in roles of existing databases subscribe to
+// the live event feed
+func grantEventStreamPermission() error {
+	if err := syncPermissionRegistry(); err != nil {
+		return err
+	}
+
+	for _, role := range []models.Role{models.RoleManager, models.RoleCashier} {
+		_, err := DB.Exec(
+			`INSERT OR IGNORE INTO role_permissions (role_id, permission)
+			 SELECT id, ? FROM roles WHERE name = ?`,
+			models.PermissionEventStream, role,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"termpos/internal/models"
+)
+
+// PublishEventTx publishes an event in the transaction making the change it reports: it
+// is added to the event log streamed to live subscribers and queued for the webhooks
+// subscribed to it. Either way it is only seen if the change is committed.
+func PublishEventTx(tx *sql.Tx, eventType string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", eventType, err)
+	}
+
+	_, err = tx.Exec("INSERT INTO events (type, data, created_at) VALUES (?, ?, ?)", eventType, string(encoded), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to publish %s event: %w", eventType, err)
+	}
+
+	return EnqueueWebhookEventTx(tx, eventType, data)
+}
+
+// EventsAfter returns up to limit events published after the event with the given ID,
+// oldest first
+func EventsAfter(id int64, limit int) ([]models.Event, error) {
+	rows, err := DB.Query("SELECT id, type, data, created_at FROM events WHERE id > ? ORDER BY id ASC LIMIT ?", id, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []models.Event
+	for rows.Next() {
+		var e models.Event
+		var data string
+		if err := rows.Scan(&e.ID, &e.Type, &data, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan event: %w", err)
+		}
+		e.Data = json.RawMessage(data)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// LatestEventID returns the ID of the last event published, or zero if there is none
+func LatestEventID() (int64, error) {
+	var id sql.NullInt64
+	if err := DB.QueryRow("SELECT MAX(id) FROM events").Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to get the latest event: %w", err)
+	}
+	return id.Int64, nil
+}
+
+// PurgeEvents deletes events published before a time, which subscribers can no longer
+// resume from
+func PurgeEvents(before time.Time) (int64, error) {
+	result, err := DB.Exec("DELETE FROM events WHERE created_at < ?", before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge events: %w", err)
+	}
+	return result.RowsAffected()
+}
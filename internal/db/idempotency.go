@@ -0,0 +1,172 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrIdempotencyKeyReused   = errors.New("idempotency key was already used for a different request")
+	ErrIdempotencyInProgress  = errors.New("a request with this idempotency key is still being processed")
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+)
+
+// idempotencyLease is how long a request keeps its key while in progress. A request that
+// has not completed by then is taken to have been abandoned, by a process that crashed or
+// a client that gave up, and a retry of it takes over its key. Requests are expected to
+// finish well within it.
+const idempotencyLease = 5 * time.Minute
+
+// IdempotentRequest is a request made with an idempotency key, or a sale made with a
+// client reference. Keys are unique within a scope, the user who made the request.
+// Status is zero until the request has completed.
+type IdempotentRequest struct {
+	Scope       string
+	Key         string
+	Method      string
+	Path        string
+	RequestHash string
+	Status      int
+	ContentType string
+	Location    string
+	Response    []byte
+	CreatedAt   time.Time
+	CompletedAt time.Time
+}
+
+// Completed reports whether the request has a stored response
+func (r IdempotentRequest) Completed() bool {
+	return r.Status != 0
+}
+
+// IdempotencyHash fingerprints a request, so a key reused for another request is detected
+func IdempotencyHash(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// BeginIdempotentRequest claims the key of a request. If the key is new, or the same
+// request was abandoned in progress for longer than the lease, it returns true, and the
+// caller must complete or release it once the request is done. Otherwise it returns the
+// earlier request, so its response can be replayed, with ErrIdempotencyKeyReused if the
+// earlier request was different or ErrIdempotencyInProgress if it has not completed. Keys
+// older than retention are forgotten.
+func BeginIdempotentRequest(req IdempotentRequest, retention time.Duration) (IdempotentRequest, bool, error) {
+	var earlier IdempotentRequest
+	started := false
+
+	err := Transaction(func(tx *sql.Tx) error {
+		now := time.Now()
+		if _, err := tx.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", now.Add(-retention)); err != nil {
+			return fmt.Errorf("failed to purge idempotency keys: %w", err)
+		}
+
+		var err error
+		earlier, err = scanIdempotentRequest(tx.QueryRow(
+			`SELECT scope, key, method, path, request_hash, status, content_type, location, response, created_at, completed_at
+			 FROM idempotency_keys WHERE scope = ? AND key = ?`,
+			req.Scope, req.Key,
+		))
+		if err == nil {
+			if earlier.Completed() || earlier.RequestHash != req.RequestHash || now.Sub(earlier.CreatedAt) < idempotencyLease {
+				return nil
+			}
+
+			// Take over the key of the abandoned request, unless another retry has
+			result, err := tx.Exec(
+				`UPDATE idempotency_keys SET created_at = ?
+				 WHERE scope = ? AND key = ? AND completed_at IS NULL AND created_at < ?`,
+				now, req.Scope, req.Key, now.Add(-idempotencyLease),
+			)
+			if err != nil {
+				return fmt.Errorf("failed to take over idempotency key: %w", err)
+			}
+			if n, err := result.RowsAffected(); err == nil && n > 0 {
+				req.CreatedAt = now
+				started = true
+			}
+			return nil
+		}
+		if err != sql.ErrNoRows {
+			return fmt.Errorf("failed to get idempotency key: %w", err)
+		}
+
+		req.CreatedAt = now
+		_, err = tx.Exec(
+			`INSERT INTO idempotency_keys (scope, key, method, path, request_hash, created_at)
+			 VALUES (?, ?, ?, ?, ?, ?)`,
+			req.Scope, req.Key, req.Method, req.Path, req.RequestHash, req.CreatedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to store idempotency key: %w", err)
+		}
+		started = true
+		return nil
+	})
+	if err != nil {
+		return IdempotentRequest{}, false, err
+	}
+
+	switch {
+	case started:
+		return req, true, nil
+	case earlier.RequestHash != req.RequestHash || earlier.Method != req.Method || earlier.Path != req.Path:
+		return earlier, false, ErrIdempotencyKeyReused
+	case !earlier.Completed():
+		return earlier, false, ErrIdempotencyInProgress
+	default:
+		return earlier, false, nil
+	}
+}
+
+// CompleteIdempotentRequest stores the response to a request, to be replayed if it is retried
+func CompleteIdempotentRequest(scope, key string, status int, contentType, location string, response []byte) error {
+	result, err := DB.Exec(
+		`UPDATE idempotency_keys SET status = ?, content_type = ?, location = ?, response = ?, completed_at = ?
+		 WHERE scope = ? AND key = ?`,
+		status, contentType, location, response, time.Now(), scope, key,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store idempotent response: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrIdempotencyKeyNotFound
+	}
+	return nil
+}
+
+// ReleaseIdempotentRequest forgets a request that failed before it made any change, so
+// that it can be retried with the same key
+func ReleaseIdempotentRequest(scope, key string) error {
+	_, err := DB.Exec("DELETE FROM idempotency_keys WHERE scope = ? AND key = ? AND completed_at IS NULL", scope, key)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// scanIdempotentRequest reads a row of the idempotency_keys table
+func scanIdempotentRequest(row *sql.Row) (IdempotentRequest, error) {
+	var req IdempotentRequest
+	var status sql.NullInt64
+	var contentType, location sql.NullString
+	var completedAt sql.NullTime
+
+	err := row.Scan(&req.Scope, &req.Key, &req.Method, &req.Path, &req.RequestHash,
+		&status, &contentType, &location, &req.Response, &req.CreatedAt, &completedAt)
+	if err != nil {
+		return IdempotentRequest{}, err
+	}
+
+	req.Status = int(status.Int64)
+	req.ContentType = contentType.String
+	req.Location = location.String
+	req.CompletedAt = completedAt.Time
+	return req, nil
+}
@@ -0,0 +1,27 @@
+package db
+
+// createIdempotencyKeysTable creates the table of requests made with an idempotency key or
+// client reference, with the response to replay if they are retried
+func createIdempotencyKeysTable() error {
+	query := `
+	CREATE TABLE idempotency_keys (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		method TEXT NOT NULL,
+		path TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status INTEGER,
+		content_type TEXT,
+		location TEXT,
+		response BLOB,
+		created_at TIMESTAMP NOT NULL,
+		completed_at TIMESTAMP,
+		PRIMARY KEY (scope, key)
+	);
+
+	CREATE INDEX idx_idempotency_keys_created_at ON idempotency_keys (created_at);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
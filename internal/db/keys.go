@@ -0,0 +1,205 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"termpos/internal/security"
+)
+
+// DefaultKeyRotationBatch is the number of sensitive data rows re-encrypted per
+// transaction when the encryption key is rotated
+const DefaultKeyRotationBatch = 100
+
+// keyStore stores the data keys of the security package in the encryption_keys table
+type keyStore struct{}
+
+// DataKeys returns all data keys, oldest first
+func (keyStore) DataKeys() ([]security.DataKey, error) {
+	rows, err := DB.Query("SELECT id, wrapped_key, master_key_id, created_at, retired_at FROM encryption_keys ORDER BY created_at ASC, rowid ASC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []security.DataKey
+	for rows.Next() {
+		var key security.DataKey
+		var retiredAt sql.NullTime
+		if err := rows.Scan(&key.ID, &key.WrappedKey, &key.MasterKeyID, &key.CreatedAt, &retiredAt); err != nil {
+			return nil, fmt.Errorf("failed to scan encryption key: %w", err)
+		}
+		if retiredAt.Valid {
+			key.RetiredAt = &retiredAt.Time
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// AddDataKey stores a new data key and retires the active one
+func (keyStore) AddDataKey(key security.DataKey) error {
+	return Transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE encryption_keys SET retired_at = ? WHERE retired_at IS NULL", key.CreatedAt); err != nil {
+			return fmt.Errorf("failed to retire encryption key: %w", err)
+		}
+		_, err := tx.Exec(
+			"INSERT INTO encryption_keys (id, wrapped_key, master_key_id, created_at) VALUES (?, ?, ?, ?)",
+			key.ID, key.WrappedKey, key.MasterKeyID, key.CreatedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to store encryption key: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetDataKeys returns the data keys sensitive data has been encrypted with, oldest first
+func GetDataKeys() ([]security.DataKey, error) {
+	return keyStore{}.DataKeys()
+}
+
+// CountSensitiveDataByKey returns the number of sensitive data rows encrypted with each
+// data key. Rows encrypted with the master key by earlier versions are counted under "".
+func CountSensitiveDataByKey() (map[string]int, error) {
+	rows, err := DB.Query("SELECT encrypted_value FROM sensitive_data")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sensitive data: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var encrypted string
+		if err := rows.Scan(&encrypted); err != nil {
+			return nil, fmt.Errorf("failed to scan sensitive data row: %w", err)
+		}
+		counts[security.CiphertextKeyID(encrypted)]++
+	}
+	return counts, rows.Err()
+}
+
+// KeyRotation is the result of re-encrypting the sensitive data
+type KeyRotation struct {
+	KeyID   string
+	Rotated int
+	Batches int
+}
+
+// RotateSensitiveData re-encrypts every sensitive data row, and the personal data of
+// customers, users and sales, not yet encrypted with the active data key, batchSize rows
+// per transaction. Personal data stored in plaintext is encrypted too.
+//
+// With newKey a new data key is created and the data is re-encrypted with it. Without
+// newKey the active key is kept, which resumes a rotation that was interrupted. Rows that
+// cannot be decrypted stop the rotation, leaving the rows before them rotated.
+func RotateSensitiveData(ctx context.Context, batchSize int, newKey bool) (KeyRotation, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultKeyRotationBatch
+	}
+
+	var rotation KeyRotation
+	var err error
+	if newKey {
+		rotation.KeyID, err = security.RotateDataKey()
+	} else {
+		rotation.KeyID, err = security.ActiveKeyID()
+	}
+	if err != nil {
+		return rotation, err
+	}
+
+	type row struct {
+		id        int64
+		encrypted string
+		rotated   string
+	}
+
+	var lastID int64
+	for {
+		// Read the batch before re-encrypting it, as data keys may have to be loaded
+		rows, err := DB.Query("SELECT id, encrypted_value FROM sensitive_data WHERE id > ? ORDER BY id ASC LIMIT ?", lastID, batchSize)
+		if err != nil {
+			return rotation, fmt.Errorf("failed to get sensitive data: %w", err)
+		}
+		var batch []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.encrypted); err != nil {
+				rows.Close()
+				return rotation, fmt.Errorf("failed to scan sensitive data row: %w", err)
+			}
+			batch = append(batch, r)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return rotation, fmt.Errorf("failed to get sensitive data: %w", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		lastID = batch[len(batch)-1].id
+
+		var stale []row
+		for _, r := range batch {
+			if security.CiphertextKeyID(r.encrypted) == rotation.KeyID {
+				continue
+			}
+			value, err := security.Decrypt(r.encrypted)
+			if err != nil {
+				return rotation, fmt.Errorf("failed to decrypt sensitive data %d: %w", r.id, err)
+			}
+			encrypted, err := security.Encrypt(value)
+			if err != nil {
+				return rotation, fmt.Errorf("failed to encrypt sensitive data %d: %w", r.id, err)
+			}
+			r.rotated = encrypted
+			stale = append(stale, r)
+		}
+		if len(stale) == 0 {
+			continue
+		}
+
+		err = Transaction(func(tx *sql.Tx) error {
+			for _, r := range stale {
+				// A row changed since it was read is already encrypted with the active key
+				_, err := tx.Exec("UPDATE sensitive_data SET encrypted_value = ? WHERE id = ? AND encrypted_value = ?", r.rotated, r.id, r.encrypted)
+				if err != nil {
+					return fmt.Errorf("failed to update sensitive data %d: %w", r.id, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return rotation, err
+		}
+		rotation.Rotated += len(stale)
+		rotation.Batches++
+	}
+
+	// Personal data is encrypted with the same data keys, including personal data still
+	// stored in plaintext, written while no master key was configured
+	encrypted, err := EncryptPII()
+	rotation.Rotated += encrypted
+	if err != nil {
+		return rotation, err
+	}
+	rotated, batches, err := rotatePII(rotation.KeyID, batchSize)
+	rotation.Rotated += rotated
+	rotation.Batches += batches
+	if err != nil {
+		return rotation, err
+	}
+
+	err = Transaction(func(tx *sql.Tx) error {
+		description := fmt.Sprintf("Re-encrypted %d rows with key %s", rotation.Rotated, rotation.KeyID)
+		return AuditTx(ctx, tx, ActionKeyRotate, "encryption_keys", rotation.KeyID, description, nil, map[string]interface{}{
+			"key_id":  rotation.KeyID,
+			"rotated": rotation.Rotated,
+			"new_key": newKey,
+		})
+	})
+	return rotation, err
+}
@@ -0,0 +1,383 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"termpos/internal/models"
+)
+
+// ErrUnknownSort is returned for a list sorted by a field it cannot be sorted by
+var ErrUnknownSort = errors.New("list cannot be sorted by that field")
+
+// ListQuery asks for a page of a list, sorted by one field with records of the same value
+// ordered by ID. The page continues after the record with ID After, or when that record
+// has since been deleted, after the first Offset records. An After of zero starts at the
+// first record.
+type ListQuery struct {
+	Sort       string
+	Descending bool
+	After      int
+	Offset     int
+	Limit      int
+}
+
+// listConditions are the WHERE conditions of a list and their parameters
+type listConditions struct {
+	where  []string
+	params []interface{}
+}
+
+// add adds a condition records of the list must meet
+func (c *listConditions) add(condition string, params ...interface{}) {
+	c.where = append(c.where, "("+condition+")")
+	c.params = append(c.params, params...)
+}
+
+// containing returns the LIKE pattern matching values that contain text, used with
+// ESCAPE '\'
+func containing(text string) string {
+	text = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(text)
+	return "%" + text + "%"
+}
+
+// pageQuery completes the query of a list with its conditions and the cursor, order and
+// limit of q. The query selects from table as alias, and sortColumns maps the fields the
+// list can be sorted by to expressions of columns of that table, which must not be NULL.
+// Paging continues from the sort value of the last record read rather than by offset, so
+// records added or deleted before it do not shift the pages.
+func pageQuery(query, table, alias string, sortColumns map[string]string, c listConditions, q ListQuery) (string, []interface{}, error) {
+	column, ok := sortColumns[q.Sort]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %q", ErrUnknownSort, q.Sort)
+	}
+	compare, direction := ">", "ASC"
+	if q.Descending {
+		compare, direction = "<", "DESC"
+	}
+	id := alias + ".id"
+
+	offset := 0
+	if q.After > 0 {
+		var exists bool
+		if err := DB.QueryRow("SELECT EXISTS (SELECT 1 FROM "+table+" WHERE id = ?)", q.After).Scan(&exists); err != nil {
+			return "", nil, fmt.Errorf("failed to read the last record of the page: %w", err)
+		}
+		if exists {
+			c.add(fmt.Sprintf("(%s, %s) %s (SELECT %s, %s FROM %s %s WHERE %s = ?)",
+				column, id, compare, column, id, table, alias, id), q.After)
+		} else {
+			offset = q.Offset
+		}
+	}
+
+	if len(c.where) > 0 {
+		query += " WHERE " + strings.Join(c.where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, %s %s LIMIT ? OFFSET ?", column, direction, id, direction)
+	return query, append(c.params, q.Limit, offset), nil
+}
+
+//
+// Products
+//
+
+// ProductFilter selects the products of a list. Nil fields do not filter.
+type ProductFilter struct {
+	CategoryID *int
+	SupplierID *int
+	LowStock   *bool
+	Search     string // Part of the name, SKU or description
+}
+
+var productSortColumns = map[string]string{
+	"id":         "p.id",
+	"name":       "p.name",
+	"price":      "p.price",
+	"stock":      "p.stock",
+	"updated_at": "p.updated_at",
+}
+
+// ListProducts retrieves a page of the products with their details
+func ListProducts(filter ProductFilter, q ListQuery) ([]models.ProductWithDetails, error) {
+	var c listConditions
+	if filter.CategoryID != nil {
+		c.add("p.category_id = ?", *filter.CategoryID)
+	}
+	if filter.SupplierID != nil {
+		c.add("p.default_supplier_id = ?", *filter.SupplierID)
+	}
+	if filter.LowStock != nil {
+		c.add("(p.low_stock_alert > 0 AND p.stock <= p.low_stock_alert) = ?", *filter.LowStock)
+	}
+	if filter.Search != "" {
+		term := containing(filter.Search)
+		c.add(`p.name LIKE ? ESCAPE '\' OR p.sku LIKE ? ESCAPE '\' OR p.description LIKE ? ESCAPE '\'`, term, term, term)
+	}
+
+	query, params, err := pageQuery(productDetailsQuery, "products", "p", productSortColumns, c, q)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query products with details: %w", err)
+	}
+	defer rows.Close()
+
+	return scanProductsWithDetails(rows)
+}
+
+//
+// Categories, suppliers and locations
+//
+
+var nameSortColumns = map[string]string{
+	"id":   "t.id",
+	"name": "t.name",
+}
+
+// ListCategories retrieves a page of the categories. A non-nil parentID lists the
+// subcategories of a category, zero listing top-level categories. search matches part
+// of their name or description.
+func ListCategories(parentID *int, search string, q ListQuery) ([]models.Category, error) {
+	var c listConditions
+	if parentID != nil {
+		c.add("COALESCE(t.parent_id, 0) = ?", *parentID)
+	}
+	if search != "" {
+		term := containing(search)
+		c.add(`t.name LIKE ? ESCAPE '\' OR t.description LIKE ? ESCAPE '\'`, term, term)
+	}
+
+	query, params, err := pageQuery(
+		`SELECT t.id, t.name, COALESCE(t.description, ''), COALESCE(t.parent_id, 0), t.created_at, t.updated_at
+		 FROM categories t`,
+		"categories", "t", nameSortColumns, c, q,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query categories: %w", err)
+	}
+	defer rows.Close()
+
+	return scanCategories(rows)
+}
+
+// ListSuppliers retrieves a page of the suppliers. search matches part of their name,
+// contact, email address or phone number.
+func ListSuppliers(active *bool, search string, q ListQuery) ([]models.Supplier, error) {
+	var c listConditions
+	if active != nil {
+		c.add("t.is_active = ?", *active)
+	}
+	if search != "" {
+		term := containing(search)
+		c.add(`t.name LIKE ? ESCAPE '\' OR t.contact LIKE ? ESCAPE '\' OR t.email LIKE ? ESCAPE '\' OR t.phone LIKE ? ESCAPE '\'`,
+			term, term, term, term)
+	}
+
+	query, params, err := pageQuery(
+		`SELECT t.id, t.name, COALESCE(t.contact, ''), COALESCE(t.email, ''), COALESCE(t.phone, ''), COALESCE(t.address, ''),
+		        COALESCE(t.notes, ''), t.is_active, t.created_at, t.updated_at
+		 FROM suppliers t`,
+		"suppliers", "t", nameSortColumns, c, q,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query suppliers: %w", err)
+	}
+	defer rows.Close()
+
+	return scanSuppliers(rows)
+}
+
+// ListLocations retrieves a page of the locations. search matches part of their name,
+// address or description.
+func ListLocations(active *bool, search string, q ListQuery) ([]models.Location, error) {
+	var c listConditions
+	if active != nil {
+		c.add("t.is_active = ?", *active)
+	}
+	if search != "" {
+		term := containing(search)
+		c.add(`t.name LIKE ? ESCAPE '\' OR t.address LIKE ? ESCAPE '\' OR t.description LIKE ? ESCAPE '\'`, term, term, term)
+	}
+
+	query, params, err := pageQuery(
+		`SELECT t.id, t.name, COALESCE(t.address, ''), COALESCE(t.description, ''), t.is_active, t.created_at, t.updated_at
+		 FROM locations t`,
+		"locations", "t", nameSortColumns, c, q,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query locations: %w", err)
+	}
+	defer rows.Close()
+
+	return scanLocations(rows)
+}
+
+//
+// Batches
+//
+
+// BatchFilter selects the batches of a list. Nil fields do not filter.
+type BatchFilter struct {
+	ProductID          *int
+	LocationID         *int
+	SupplierID         *int
+	Expired            *bool
+	ExpiringWithinDays *int // Batches not yet expired that expire within this many days
+}
+
+var batchSortColumns = map[string]string{
+	"id":           "b.id",
+	"quantity":     "b.quantity",
+	"expiry_date":  "b.expiry_date",
+	"receipt_date": "b.receipt_date",
+}
+
+// ListBatches retrieves a page of the batches of every product. Batches without an
+// expiry date are stored with the zero time, so never expire.
+func ListBatches(filter BatchFilter, q ListQuery) ([]models.ProductBatch, error) {
+	now := time.Now()
+
+	var c listConditions
+	if filter.ProductID != nil {
+		c.add("b.product_id = ?", *filter.ProductID)
+	}
+	if filter.LocationID != nil {
+		c.add("b.location_id = ?", *filter.LocationID)
+	}
+	if filter.SupplierID != nil {
+		c.add("b.supplier_id = ?", *filter.SupplierID)
+	}
+	if filter.Expired != nil {
+		c.add("(b.expiry_date > ? AND b.expiry_date < ?) = ?", time.Time{}, now, *filter.Expired)
+	}
+	if filter.ExpiringWithinDays != nil {
+		c.add("b.expiry_date >= ? AND b.expiry_date < ?", now, now.AddDate(0, 0, *filter.ExpiringWithinDays))
+	}
+
+	query, params, err := pageQuery("SELECT "+batchColumns+" FROM product_batches b", "product_batches", "b", batchSortColumns, c, q)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query product batches: %w", err)
+	}
+	defer rows.Close()
+
+	var batches []models.ProductBatch
+	for rows.Next() {
+		batch, err := scanBatch(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan product batch: %w", err)
+		}
+		batches = append(batches, batch)
+	}
+
+	return batches, rows.Err()
+}
+
+//
+// Staff and customers
+//
+
+// UserFilter selects the users of a list. Nil and empty fields do not filter.
+type UserFilter struct {
+	Active     *bool
+	Role       models.Role
+	Department string
+	Search     string // Part of the username or full name, or the whole email address
+}
+
+var userSortColumns = map[string]string{
+	"id":         "u.id",
+	"username":   "u.username",
+	"full_name":  "COALESCE(u.full_name, '')",
+	"hire_date":  "COALESCE(u.hire_date, '')",
+	"last_login": "COALESCE(u.last_login_at, '')",
+}
+
+// ListUsers retrieves a page of the users
+func ListUsers(filter UserFilter, q ListQuery) ([]models.User, error) {
+	var c listConditions
+	if filter.Active != nil {
+		c.add("u.active = ?", *filter.Active)
+	}
+	if filter.Role != "" {
+		c.add("u.role = ?", filter.Role)
+	}
+	if filter.Department != "" {
+		c.add("u.department = ?", filter.Department)
+	}
+	if filter.Search != "" {
+		condition, params := userMatch(filter.Search)
+		c.add(condition, params...)
+	}
+
+	query, params, err := pageQuery(
+		`SELECT u.id, u.username, u.password_hash, u.role, u.created_at, u.last_login_at, u.active,
+		        u.full_name, u.email, u.phone, u.address, u.hire_date, u.position, u.department, u.notes, u.emergency_contact
+		 FROM users u`,
+		"users", "u", userSortColumns, c, q,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	return scanUsers(rows)
+}
+
+var customerSortColumns = map[string]string{
+	"id":             "c.id",
+	"name":           "c.name",
+	"loyalty_points": "c.loyalty_points",
+}
+
+// ListCustomerPage retrieves a page of the customers. search matches them as
+// ListCustomers does, and a non-empty tier lists the customers of a loyalty tier.
+func ListCustomerPage(search, tier string, q ListQuery) ([]models.CustomerSummary, error) {
+	var c listConditions
+	if search != "" {
+		condition, params := customerMatch(search)
+		c.add(condition, params...)
+	}
+	if tier != "" {
+		c.add("c.loyalty_tier = ? COLLATE NOCASE", tier)
+	}
+
+	query, params, err := pageQuery(
+		"SELECT c.id, c.name, c.phone, c.email, c.loyalty_points, c.loyalty_tier FROM customers c",
+		"customers", "c", customerSortColumns, c, q,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list customers: %w", err)
+	}
+	defer rows.Close()
+
+	return scanCustomerSummaries(rows)
+}
@@ -38,6 +38,33 @@ func RunMigrations() error {
                 {18, "create_loyalty_redemptions_table", createLoyaltyRedemptionsTable},
                 {19, "alter_sales_table_for_customers", alterSalesTableForCustomers},
                 {20, "alter_users_table_for_staff", alterUsersTableForStaff},
+                {21, "alter_customers_table_for_privacy", alterCustomersTableForPrivacy},
+                {22, "create_customer_segments_table", createCustomerSegmentsTable},
+                {23, "create_roles_tables", createRolesTables},
+                {24, "rebuild_users_table_for_custom_roles", rebuildUsersTableForCustomRoles},
+                {25, "alter_sales_table_for_approvals", alterSalesTableForApprovals},
+                {26, "create_approvals_table", createApprovalsTable},
+                {27, "create_user_security_table", createUserSecurityTable},
+                {28, "alter_user_security_for_password_policy", alterUserSecurityForPasswordPolicy},
+                {29, "create_password_history_table", createPasswordHistoryTable},
+                {30, "alter_user_security_for_two_factor", alterUserSecurityForTwoFactor},
+                {31, "create_recovery_codes_table", createRecoveryCodesTable},
+                {32, "create_time_entries_table", createTimeEntriesTable},
+                {33, "grant_time_clock_permissions", grantTimeClockPermissions},
+                {34, "alter_sales_table_for_staff_attribution", alterSalesTableForStaffAttribution},
+                {35, "create_commission_rules_table", createCommissionRulesTable},
+                {36, "create_api_tokens_tables", createAPITokensTables},
+                {37, "create_api_keys_table", createAPIKeysTable},
+                {38, "create_idempotency_keys_table", createIdempotencyKeysTable},
+                {39, "create_webhook_tables", createWebhookTables},
+                {40, "create_events_table", createEventsTable},
+                {41, "grant_event_stream_permission", grantEventStreamPermission},
+                {42, "chain_audit_logs", chainAuditLogs},
+                {43, "create_audit_retention_tables", createAuditRetentionTables},
+                {44, "alter_audit_logs_for_source", alterAuditLogsForSource},
+                {45, "create_encryption_keys_table", createEncryptionKeysTable},
+                {46, "add_pii_blind_indexes", addPIIBlindIndexes},
+                {47, "encrypt_sale_pii", encryptSalePII},
         }
 
         for _, m := range migrations {
@@ -59,6 +86,11 @@ func RunMigrations() error {
                 }
         }
 
+        // Register permissions added since the roles tables were created
+        if err := syncPermissionRegistry(); err != nil {
+                return fmt.Errorf("failed to sync permission registry: %w", err)
+        }
+
         return nil
 }
 
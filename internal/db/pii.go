@@ -0,0 +1,469 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"termpos/internal/models"
+	"termpos/internal/security"
+)
+
+// piiColumns are the columns of personal data encrypted at rest, by table. Values written
+// while no master key is configured are stored in plaintext, and encrypted by
+// EncryptPII once one is.
+var piiColumns = map[string][]string{
+	"customers": {"email", "phone", "address", "birthday"},
+	"users":     {"email", "phone", "address", "emergency_contact"},
+	"sales":     {"customer_email", "customer_phone"},
+}
+
+// piiTables lists the tables of piiColumns in a fixed order
+var piiTables = []string{"customers", "users", "sales"}
+
+// piiIndexedTables lists the tables of piiColumns whose email addresses and phone numbers
+// have blind indexes. Sales are not looked up by the customer details given with them.
+var piiIndexedTables = []string{"customers", "users"}
+
+// piiIndexed reports whether a table of piiColumns has blind indexes
+func piiIndexed(table string) bool {
+	for _, indexed := range piiIndexedTables {
+		if table == indexed {
+			return true
+		}
+	}
+	return false
+}
+
+// sealPII encrypts a personal data value, leaving it in plaintext when no master key is
+// configured. Values must be sealed before a transaction is started, as the first data key
+// may have to be stored.
+func sealPII(value string) (string, error) {
+	if value == "" || security.IsEphemeralKey() {
+		return value, nil
+	}
+	encrypted, err := security.Encrypt(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt personal data: %w", err)
+	}
+	return encrypted, nil
+}
+
+// openPII decrypts a personal data value stored by sealPII
+func openPII(value string) (string, error) {
+	if security.CiphertextKeyID(value) == "" {
+		return value, nil
+	}
+	decrypted, err := security.Decrypt(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt personal data: %w", err)
+	}
+	return decrypted, nil
+}
+
+// piiIndex returns the blind index an email address or phone number is looked up by,
+// ignoring surrounding spaces and the case of email addresses. It is NULL for an empty
+// value or when no master key is configured.
+func piiIndex(column, value string) sql.NullString {
+	value = strings.TrimSpace(value)
+	if column == "email" {
+		value = strings.ToLower(value)
+	}
+	index := security.BlindIndex(value)
+	return sql.NullString{String: index, Valid: index != ""}
+}
+
+// customerMatch returns the condition and parameters matching customers by part of their
+// name, or by their email address or phone number. Once a master key is configured these
+// are encrypted and only match in full, by their blind index, as part of a ciphertext
+// would match unrelated customers.
+func customerMatch(query string) (string, []interface{}) {
+	term := "%" + query + "%"
+	if security.IsEphemeralKey() {
+		return "name LIKE ? OR phone LIKE ? OR email LIKE ?", []interface{}{term, term, term}
+	}
+	return "name LIKE ? OR email_bidx = ? OR phone_bidx = ?", []interface{}{term, piiIndex("email", query), piiIndex("phone", query)}
+}
+
+// userMatch returns the condition and parameters matching users by part of their username
+// or full name, or by their email address, which like a customer's only matches in full
+// once a master key is configured
+func userMatch(query string) (string, []interface{}) {
+	term := "%" + query + "%"
+	if security.IsEphemeralKey() {
+		return "username LIKE ? OR full_name LIKE ? OR email LIKE ?", []interface{}{term, term, term}
+	}
+	return "username LIKE ? OR full_name LIKE ? OR email_bidx = ?", []interface{}{term, term, piiIndex("email", query)}
+}
+
+// sealedPII is the personal data of a customer or user ready to be stored: the email
+// address, phone number, address and, for customers the birthday or for users the
+// emergency contact, with the blind indexes of the email address and phone number
+type sealedPII struct {
+	email, phone, address, other sql.NullString
+	emailIndex, phoneIndex       sql.NullString
+}
+
+// sealPIIFields encrypts the personal data of a customer or user. Missing values are
+// stored as NULL so the UNIQUE constraints allow many customers without them.
+func sealPIIFields(email, phone, address, other string) (sealedPII, error) {
+	sealed := sealedPII{emailIndex: piiIndex("email", email), phoneIndex: piiIndex("phone", phone)}
+	fields := []struct {
+		value string
+		dest  *sql.NullString
+	}{{email, &sealed.email}, {phone, &sealed.phone}, {address, &sealed.address}, {other, &sealed.other}}
+	for _, field := range fields {
+		value, err := sealPII(field.value)
+		if err != nil {
+			return sealedPII{}, err
+		}
+		*field.dest = sql.NullString{String: value, Valid: value != ""}
+	}
+	return sealed, nil
+}
+
+// SealSaleContact encrypts the email address and phone number given with a sale, to store
+// in its customer_email and customer_phone columns. Like other personal data it must be
+// sealed before the transaction recording the sale is started.
+func SealSaleContact(email, phone string) (sql.NullString, sql.NullString, error) {
+	sealed, err := sealPIIFields(email, phone, "", "")
+	return sealed.email, sealed.phone, err
+}
+
+// OpenSaleContact decrypts the email address and phone number of a sale read from its
+// customer_email and customer_phone columns
+func OpenSaleContact(sale *models.Sale) error {
+	for _, field := range []*string{&sale.CustomerEmail, &sale.CustomerPhone} {
+		value, err := openPII(*field)
+		if err != nil {
+			return fmt.Errorf("sale %d: %w", sale.ID, err)
+		}
+		*field = value
+	}
+	return nil
+}
+
+// openCustomerPII decrypts the personal data of a customer
+func openCustomerPII(customer *models.Customer) error {
+	for _, field := range []*string{&customer.Email, &customer.Phone, &customer.Address, &customer.Birthday} {
+		value, err := openPII(*field)
+		if err != nil {
+			return fmt.Errorf("customer %d: %w", customer.ID, err)
+		}
+		*field = value
+	}
+	return nil
+}
+
+// openCustomerSummaries decrypts the email addresses and phone numbers of customers
+func openCustomerSummaries(customers []models.CustomerSummary) error {
+	for i := range customers {
+		for _, field := range []*string{&customers[i].Email, &customers[i].Phone} {
+			value, err := openPII(*field)
+			if err != nil {
+				return fmt.Errorf("customer %d: %w", customers[i].ID, err)
+			}
+			*field = value
+		}
+	}
+	return nil
+}
+
+// openUserPII decrypts the personal data of a user
+func openUserPII(user *models.User) error {
+	for _, field := range []*string{&user.Email, &user.Phone, &user.Address, &user.EmergencyContact} {
+		value, err := openPII(*field)
+		if err != nil {
+			return fmt.Errorf("user %d: %w", user.ID, err)
+		}
+		*field = value
+	}
+	return nil
+}
+
+// redactedPII replaces personal data in the copies of customers, users and sales written
+// outside their encrypted columns: the audit log, which cannot be scrubbed, events and
+// webhooks
+const redactedPII = "[redacted]"
+
+// redactPII masks the values that are set
+func redactPII(fields ...*string) {
+	for _, field := range fields {
+		if *field != "" {
+			*field = redactedPII
+		}
+	}
+}
+
+// redactCustomerPII returns a customer with its personal data masked
+func redactCustomerPII(customer models.Customer) models.Customer {
+	redactPII(&customer.Email, &customer.Phone, &customer.Address, &customer.Birthday)
+	return customer
+}
+
+// redactUserPII returns a user with their personal data masked
+func redactUserPII(user models.User) models.User {
+	redactPII(&user.Email, &user.Phone, &user.Address, &user.EmergencyContact)
+	return user
+}
+
+// RedactSalePII returns a sale with the customer details given with it masked
+func RedactSalePII(sale models.Sale) models.Sale {
+	redactPII(&sale.CustomerEmail, &sale.CustomerPhone)
+	return sale
+}
+
+// EncryptPII encrypts the personal data still stored in plaintext, written before field
+// encryption or while no master key was configured, and fills in its blind indexes. It
+// returns the number of rows encrypted, and does nothing when no master key is configured.
+// It runs with the migration adding field encryption and with key rotation, not on every
+// start; rows another process changed since they were read are left for the next run.
+func EncryptPII() (int, error) {
+	if security.IsEphemeralKey() {
+		return 0, nil
+	}
+
+	encrypted := 0
+	for _, table := range piiTables {
+		columns := piiColumns[table]
+
+		// Read the rows before encrypting them, as the data keys may have to be stored
+		selects := make([]string, len(columns))
+		for i, column := range columns {
+			selects[i] = "COALESCE(" + column + ", '')"
+		}
+		rows, err := DB.Query(fmt.Sprintf("SELECT id, %s FROM %s", strings.Join(selects, ", "), table))
+		if err != nil {
+			return encrypted, fmt.Errorf("failed to read %s: %w", table, err)
+		}
+		type row struct {
+			id     int
+			values []string
+		}
+		var plaintext []row
+		for rows.Next() {
+			r := row{values: make([]string, len(columns))}
+			dest := []interface{}{&r.id}
+			for i := range r.values {
+				dest = append(dest, &r.values[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return encrypted, fmt.Errorf("failed to scan %s: %w", table, err)
+			}
+			for _, value := range r.values {
+				if value != "" && security.CiphertextKeyID(value) == "" {
+					plaintext = append(plaintext, r)
+					break
+				}
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return encrypted, fmt.Errorf("failed to read %s: %w", table, err)
+		}
+		if len(plaintext) == 0 {
+			continue
+		}
+
+		assignments := make([]string, 0, len(columns)+2)
+		guards := make([]string, len(columns))
+		for i, column := range columns {
+			assignments = append(assignments, column+" = ?")
+			guards[i] = "COALESCE(" + column + ", '') = ?"
+		}
+		indexed := piiIndexed(table)
+		if indexed {
+			assignments = append(assignments, "email_bidx = ?", "phone_bidx = ?")
+		}
+		// A row changed since it was read was written by another process, and is left as it is
+		query := fmt.Sprintf("UPDATE %s SET %s WHERE id = ? AND %s", table, strings.Join(assignments, ", "), strings.Join(guards, " AND "))
+
+		// Encrypt the values first, then write them in one transaction
+		args := make([][]interface{}, 0, len(plaintext))
+		for _, r := range plaintext {
+			var emailIndex, phoneIndex sql.NullString
+			rowArgs := make([]interface{}, 0, len(columns)+3)
+			for i, column := range columns {
+				// Values already encrypted are kept, but are decrypted to be indexed
+				sealed := r.values[i]
+				value, err := openPII(sealed)
+				if err != nil {
+					return encrypted, fmt.Errorf("%s %d: %w", table, r.id, err)
+				}
+				if sealed == value {
+					if sealed, err = sealPII(value); err != nil {
+						return encrypted, err
+					}
+				}
+				switch column {
+				case "email":
+					emailIndex = piiIndex(column, value)
+				case "phone":
+					phoneIndex = piiIndex(column, value)
+				}
+				rowArgs = append(rowArgs, sql.NullString{String: sealed, Valid: sealed != ""})
+			}
+			if indexed {
+				rowArgs = append(rowArgs, emailIndex, phoneIndex)
+			}
+			rowArgs = append(rowArgs, r.id)
+			for _, value := range r.values {
+				rowArgs = append(rowArgs, value)
+			}
+			args = append(args, rowArgs)
+		}
+
+		updated := 0
+		err = Transaction(func(tx *sql.Tx) error {
+			for i, rowArgs := range args {
+				result, err := tx.Exec(query, rowArgs...)
+				if err != nil {
+					if IsUniqueViolation(err) {
+						return fmt.Errorf("%s %d has the same email address or phone number as another: %w", table, plaintext[i].id, err)
+					}
+					return fmt.Errorf("failed to encrypt %s %d: %w", table, plaintext[i].id, err)
+				}
+				if affected, _ := result.RowsAffected(); affected > 0 {
+					updated++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return encrypted, err
+		}
+		encrypted += updated
+	}
+
+	return encrypted, nil
+}
+
+// CountPIIByKey returns the number of encrypted personal data values encrypted with each
+// data key. Values stored in plaintext are counted under "".
+func CountPIIByKey() (map[string]int, error) {
+	counts := make(map[string]int)
+	for _, table := range piiTables {
+		for _, column := range piiColumns[table] {
+			rows, err := DB.Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s IS NOT NULL AND %s != ''", column, table, column, column))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", table, err)
+			}
+			for rows.Next() {
+				var value string
+				if err := rows.Scan(&value); err != nil {
+					rows.Close()
+					return nil, fmt.Errorf("failed to scan %s: %w", table, err)
+				}
+				counts[security.CiphertextKeyID(value)]++
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", table, err)
+			}
+		}
+	}
+	return counts, nil
+}
+
+// rotatePII re-encrypts the personal data encrypted with a data key other than keyID,
+// batchSize rows per transaction, returning the number of rows and batches re-encrypted
+func rotatePII(keyID string, batchSize int) (int, int, error) {
+	rotated, batches := 0, 0
+	for _, table := range piiTables {
+		columns := piiColumns[table]
+		selects := make([]string, len(columns))
+		assignments := make([]string, len(columns))
+		guards := make([]string, len(columns))
+		for i, column := range columns {
+			selects[i] = "COALESCE(" + column + ", '')"
+			assignments[i] = column + " = ?"
+			guards[i] = "COALESCE(" + column + ", '') = ?"
+		}
+		// A row changed since it was read is already encrypted with the active key
+		update := fmt.Sprintf("UPDATE %s SET %s WHERE id = ? AND %s", table, strings.Join(assignments, ", "), strings.Join(guards, " AND "))
+
+		lastID := 0
+		for {
+			rows, err := DB.Query(fmt.Sprintf("SELECT id, %s FROM %s WHERE id > ? ORDER BY id ASC LIMIT ?", strings.Join(selects, ", "), table), lastID, batchSize)
+			if err != nil {
+				return rotated, batches, fmt.Errorf("failed to read %s: %w", table, err)
+			}
+			type row struct {
+				id     int
+				values []string
+			}
+			var batch []row
+			for rows.Next() {
+				r := row{values: make([]string, len(columns))}
+				dest := []interface{}{&r.id}
+				for i := range r.values {
+					dest = append(dest, &r.values[i])
+				}
+				if err := rows.Scan(dest...); err != nil {
+					rows.Close()
+					return rotated, batches, fmt.Errorf("failed to scan %s: %w", table, err)
+				}
+				batch = append(batch, r)
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return rotated, batches, fmt.Errorf("failed to read %s: %w", table, err)
+			}
+			if len(batch) == 0 {
+				break
+			}
+			lastID = batch[len(batch)-1].id
+
+			var args [][]interface{}
+			for _, r := range batch {
+				stale := false
+				sealed := make([]interface{}, len(columns))
+				for i, value := range r.values {
+					sealed[i] = sql.NullString{String: value, Valid: value != ""}
+					if id := security.CiphertextKeyID(value); id == "" || id == keyID {
+						continue
+					}
+					plaintext, err := openPII(value)
+					if err != nil {
+						return rotated, batches, fmt.Errorf("%s %d: %w", table, r.id, err)
+					}
+					encrypted, err := sealPII(plaintext)
+					if err != nil {
+						return rotated, batches, err
+					}
+					sealed[i], stale = encrypted, true
+				}
+				if !stale {
+					continue
+				}
+				rowArgs := append(sealed, r.id)
+				for _, value := range r.values {
+					rowArgs = append(rowArgs, value)
+				}
+				args = append(args, rowArgs)
+			}
+			if len(args) == 0 {
+				continue
+			}
+
+			err = Transaction(func(tx *sql.Tx) error {
+				for _, rowArgs := range args {
+					if _, err := tx.Exec(update, rowArgs...); err != nil {
+						return fmt.Errorf("failed to update %s: %w", table, err)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return rotated, batches, err
+			}
+			rotated += len(args)
+			batches++
+		}
+	}
+	return rotated, batches, nil
+}
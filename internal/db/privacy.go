@@ -0,0 +1,398 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"termpos/internal/models"
+	"termpos/internal/security"
+)
+
+// Marketing consent channels
+const (
+	ConsentEmail = "email"
+	ConsentSMS   = "sms"
+)
+
+// customerSensitiveResourceTypes lists the sensitive_data resource types that refer to customers
+var customerSensitiveResourceTypes = []string{"customer", "customers"}
+
+// customerConsent is a customer's marketing consent for a channel, recorded in the audit
+// log when it changes
+type customerConsent struct {
+	Channel string `json:"channel"`
+	Granted bool   `json:"granted"`
+}
+
+// SetCustomerConsent records a customer's marketing consent for a channel
+func SetCustomerConsent(ctx context.Context, customerID int, channel string, granted bool) error {
+	var column string
+	switch channel {
+	case ConsentEmail:
+		column = "email_consent"
+	case ConsentSMS:
+		column = "sms_consent"
+	default:
+		return fmt.Errorf("unknown consent channel: %s (must be %s or %s)", channel, ConsentEmail, ConsentSMS)
+	}
+
+	customer, err := GetCustomer(customerID)
+	if err != nil {
+		return err
+	}
+	if customer.IsAnonymized() {
+		return fmt.Errorf("customer %d has been anonymized", customerID)
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		old := customerConsent{Channel: channel}
+		if err := tx.QueryRow("SELECT COALESCE("+column+", 0) FROM customers WHERE id = ?", customerID).Scan(&old.Granted); err != nil {
+			return fmt.Errorf("failed to get consent: %w", err)
+		}
+
+		now := time.Now()
+		query := fmt.Sprintf("UPDATE customers SET %s = ?, %s_at = ?, updated_at = ? WHERE id = ?", column, column)
+		if _, err := tx.Exec(query, granted, now, now, customerID); err != nil {
+			return fmt.Errorf("failed to update consent: %w", err)
+		}
+
+		state := "withdrawn"
+		if granted {
+			state = "granted"
+		}
+		description := fmt.Sprintf("Marketing %s consent %s", channel, state)
+		return AuditTx(ctx, tx, ActionUpdate, "customer", customerID, description, old, customerConsent{Channel: channel, Granted: granted})
+	})
+}
+
+// ExportCustomerData gathers everything held about a customer into a single bundle
+func ExportCustomerData(customerID int, username string) (models.CustomerDataExport, error) {
+	customer, err := GetCustomer(customerID)
+	if err != nil {
+		return models.CustomerDataExport{}, err
+	}
+
+	export := models.CustomerDataExport{
+		GeneratedAt:   time.Now(),
+		GeneratedBy:   username,
+		Profile:       customer,
+		Sales:         []models.Sale{},
+		PointsHistory: []models.CustomerSale{},
+		Redemptions:   []models.CustomerRedemption{},
+		SensitiveData: []models.CustomerSensitiveField{},
+	}
+
+	if export.Sales, err = getCustomerSales(customerID); err != nil {
+		return models.CustomerDataExport{}, err
+	}
+	if export.PointsHistory, err = getCustomerPointsHistory(customerID); err != nil {
+		return models.CustomerDataExport{}, err
+	}
+	if export.Redemptions, err = getCustomerRedemptions(customerID); err != nil {
+		return models.CustomerDataExport{}, err
+	}
+	if export.SensitiveData, err = getCustomerSensitiveData(customerID); err != nil {
+		return models.CustomerDataExport{}, err
+	}
+
+	AddAuditLog(
+		username,
+		ActionExport,
+		"customers",
+		fmt.Sprintf("%d", customerID),
+		"Exported customer personal data",
+		"",
+		"",
+		"",
+		fmt.Sprintf("sales=%d,points_entries=%d,redemptions=%d,sensitive_fields=%d",
+			len(export.Sales), len(export.PointsHistory), len(export.Redemptions), len(export.SensitiveData)),
+	)
+
+	return export, nil
+}
+
+// WriteCustomerDataExport writes a customer data export bundle to a JSON file
+func WriteCustomerDataExport(export models.CustomerDataExport, filepath string) error {
+	return writeJSONToFile(export, filepath)
+}
+
+// CustomerDataExportJSON renders a customer data export bundle as indented JSON
+func CustomerDataExportJSON(export models.CustomerDataExport) (string, error) {
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal customer export: %w", err)
+	}
+	return string(data), nil
+}
+
+// AnonymizeCustomer irreversibly scrubs a customer's personal data while keeping
+// their sales and loyalty history for accounting purposes
+func AnonymizeCustomer(customerID int, username string) error {
+	customer, err := GetCustomer(customerID)
+	if err != nil {
+		return err
+	}
+	if customer.IsAnonymized() {
+		return fmt.Errorf("customer %d has already been anonymized", customerID)
+	}
+
+	placeholder := fmt.Sprintf("Anonymized Customer #%d", customerID)
+	now := time.Now()
+	var salesScrubbed, sensitiveRemoved int64
+
+	err = Transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE customers SET
+				name = ?,
+				email = NULL,
+				phone = NULL,
+				address = NULL,
+				birthday = NULL,
+				email_bidx = NULL,
+				phone_bidx = NULL,
+				notes = NULL,
+				preferred_products = NULL,
+				email_consent = 0,
+				email_consent_at = ?,
+				sms_consent = 0,
+				sms_consent_at = ?,
+				anonymized_at = ?,
+				updated_at = ?
+			WHERE id = ?`,
+			placeholder, now, now, now, now, customerID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to anonymize customer: %w", err)
+		}
+
+		// Keep the sales rows but drop the contact details copied onto them
+		result, err := tx.Exec(`
+			UPDATE sales SET
+				customer_name = ?,
+				customer_email = NULL,
+				customer_phone = NULL
+			WHERE customer_id = ?
+			   OR id IN (SELECT sale_id FROM customer_sales WHERE customer_id = ?)`,
+			placeholder, customerID, customerID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to scrub customer sales: %w", err)
+		}
+		salesScrubbed, _ = result.RowsAffected()
+
+		for _, resourceType := range customerSensitiveResourceTypes {
+			result, err := tx.Exec(
+				"DELETE FROM sensitive_data WHERE resource_type = ? AND resource_id = ?",
+				resourceType, customerID,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to delete customer sensitive data: %w", err)
+			}
+			removed, _ := result.RowsAffected()
+			sensitiveRemoved += removed
+		}
+
+		// Tell integrations to erase their copy of the customer's personal data too
+		return PublishEventTx(tx, models.EventCustomerUpdated, models.Customer{
+			ID:            customerID,
+			Name:          placeholder,
+			JoinDate:      customer.JoinDate,
+			LoyaltyPoints: customer.LoyaltyPoints,
+			LoyaltyTier:   customer.LoyaltyTier,
+			CreatedAt:     customer.CreatedAt,
+			UpdatedAt:     now,
+			AnonymizedAt:  now,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	AddAuditLog(
+		username,
+		ActionDelete,
+		"customers",
+		fmt.Sprintf("%d", customerID),
+		"Anonymized customer personal data",
+		"",
+		"",
+		"",
+		fmt.Sprintf("anonymized=true,sales_scrubbed=%d,sensitive_fields_removed=%d", salesScrubbed, sensitiveRemoved),
+	)
+
+	return nil
+}
+
+// getCustomerSales returns every sale linked to a customer
+func getCustomerSales(customerID int) ([]models.Sale, error) {
+	sales := []models.Sale{}
+
+	query := `
+		SELECT
+			s.id, s.product_id, COALESCE(p.name, ''), s.quantity, s.price_per_unit,
+			COALESCE(s.discount_amount, 0), COALESCE(s.discount_code, ''),
+			COALESCE(s.tax_rate, 0), COALESCE(s.tax_amount, 0),
+			COALESCE(s.subtotal, 0), s.total,
+			COALESCE(s.payment_method, ''), COALESCE(s.payment_reference, ''),
+			s.sale_date, COALESCE(s.receipt_number, ''),
+			COALESCE(s.customer_email, ''), COALESCE(s.customer_phone, ''), COALESCE(s.notes, ''),
+			COALESCE(s.customer_id, 0), COALESCE(s.customer_name, ''),
+			COALESCE(s.loyalty_discount, 0), COALESCE(s.points_earned, 0), COALESCE(s.points_used, 0),
+			COALESCE(s.loyalty_tier, ''), COALESCE(s.reward_id, 0), COALESCE(s.reward_name, '')
+		FROM sales s
+		LEFT JOIN products p ON s.product_id = p.id
+		WHERE s.customer_id = ?
+		   OR s.id IN (SELECT sale_id FROM customer_sales WHERE customer_id = ?)
+		ORDER BY s.sale_date ASC
+	`
+
+	rows, err := DB.Query(query, customerID, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get customer sales: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sale models.Sale
+		err := rows.Scan(
+			&sale.ID, &sale.ProductID, &sale.ProductName, &sale.Quantity, &sale.PricePerUnit,
+			&sale.DiscountAmount, &sale.DiscountCode,
+			&sale.TaxRate, &sale.TaxAmount,
+			&sale.Subtotal, &sale.Total,
+			&sale.PaymentMethod, &sale.PaymentReference,
+			&sale.SaleDate, &sale.ReceiptNumber,
+			&sale.CustomerEmail, &sale.CustomerPhone, &sale.Notes,
+			&sale.CustomerID, &sale.CustomerName,
+			&sale.LoyaltyDiscount, &sale.PointsEarned, &sale.PointsUsed,
+			&sale.LoyaltyTier, &sale.RewardID, &sale.RewardName,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan customer sale: %w", err)
+		}
+		sales = append(sales, sale)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get customer sales: %w", err)
+	}
+	rows.Close()
+
+	for i := range sales {
+		if err := OpenSaleContact(&sales[i]); err != nil {
+			return nil, err
+		}
+	}
+	return sales, nil
+}
+
+// getCustomerPointsHistory returns the loyalty points ledger for a customer
+func getCustomerPointsHistory(customerID int) ([]models.CustomerSale, error) {
+	history := []models.CustomerSale{}
+
+	rows, err := DB.Query(`
+		SELECT sale_id, customer_id, points_earned, points_used, COALESCE(reward_id, 0), created_at
+		FROM customer_sales
+		WHERE customer_id = ?
+		ORDER BY created_at ASC`,
+		customerID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get points history: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry models.CustomerSale
+		err := rows.Scan(
+			&entry.SaleID,
+			&entry.CustomerID,
+			&entry.PointsEarned,
+			&entry.PointsUsed,
+			&entry.RewardID,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan points history row: %w", err)
+		}
+		history = append(history, entry)
+	}
+
+	return history, rows.Err()
+}
+
+// getCustomerRedemptions returns the loyalty rewards a customer has redeemed
+func getCustomerRedemptions(customerID int) ([]models.CustomerRedemption, error) {
+	redemptions := []models.CustomerRedemption{}
+
+	rows, err := DB.Query(`
+		SELECT lr.id, lr.reward_id, COALESCE(r.name, ''), lr.points_used,
+		       lr.redeemed_at, lr.expiry_date, lr.used, COALESCE(lr.used_sale_id, 0)
+		FROM loyalty_redemptions lr
+		LEFT JOIN loyalty_rewards r ON lr.reward_id = r.id
+		WHERE lr.customer_id = ?
+		ORDER BY lr.redeemed_at ASC`,
+		customerID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get redemptions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var redemption models.CustomerRedemption
+		err := rows.Scan(
+			&redemption.ID,
+			&redemption.RewardID,
+			&redemption.RewardName,
+			&redemption.PointsUsed,
+			&redemption.RedeemedAt,
+			&redemption.ExpiryDate,
+			&redemption.Used,
+			&redemption.UsedSaleID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan redemption row: %w", err)
+		}
+		redemptions = append(redemptions, redemption)
+	}
+
+	return redemptions, rows.Err()
+}
+
+// getCustomerSensitiveData returns the decrypted sensitive_data entries held for a customer
+func getCustomerSensitiveData(customerID int) ([]models.CustomerSensitiveField, error) {
+	fields := []models.CustomerSensitiveField{}
+
+	for _, resourceType := range customerSensitiveResourceTypes {
+		rows, err := DB.Query(
+			"SELECT field_name, encrypted_value FROM sensitive_data WHERE resource_type = ? AND resource_id = ? ORDER BY field_name",
+			resourceType, customerID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get customer sensitive data: %w", err)
+		}
+
+		for rows.Next() {
+			var field models.CustomerSensitiveField
+			if err := rows.Scan(&field.FieldName, &field.Value); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan sensitive data row: %w", err)
+			}
+			fields = append(fields, field)
+		}
+		rows.Close()
+	}
+
+	// Decrypt once the rows are closed, as data keys may have to be loaded
+	for i, field := range fields {
+		value, err := security.Decrypt(field.Value)
+		if err != nil {
+			value = "<unable to decrypt with current key>"
+		}
+		fields[i].Value = value
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,29 @@
+package db
+
+import "strings"
+
+// alterCustomersTableForPrivacy adds marketing consent and anonymization columns to the customers table
+func alterCustomersTableForPrivacy() error {
+	// SQLite doesn't support adding multiple columns in a single ALTER TABLE statement
+	// so we need to execute multiple statements
+	queries := []string{
+		"ALTER TABLE customers ADD COLUMN email_consent BOOLEAN NOT NULL DEFAULT 0;",
+		"ALTER TABLE customers ADD COLUMN email_consent_at TIMESTAMP;",
+		"ALTER TABLE customers ADD COLUMN sms_consent BOOLEAN NOT NULL DEFAULT 0;",
+		"ALTER TABLE customers ADD COLUMN sms_consent_at TIMESTAMP;",
+		"ALTER TABLE customers ADD COLUMN anonymized_at TIMESTAMP;",
+	}
+
+	for _, query := range queries {
+		// Execute the query and ignore "duplicate column" errors
+		_, err := DB.Exec(query)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "duplicate column name:") {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
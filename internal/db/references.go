@@ -0,0 +1,95 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	// ErrInUse is returned when a record cannot be deleted because other records refer to it
+	ErrInUse = errors.New("record is still in use")
+
+	// ErrInvalidReference is returned when a record refers to another that does not exist
+	ErrInvalidReference = errors.New("referenced record does not exist")
+)
+
+// IsUniqueViolation reports whether an error was caused by a UNIQUE constraint, for
+// example a second category with the same name
+func IsUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// reference is a table and column that refers to another record
+type reference struct {
+	table  string
+	column string
+	what   string
+}
+
+// checkUnused returns ErrInUse if any of the references point to id
+func checkUnused(tx *sql.Tx, id int, refs ...reference) error {
+	for _, ref := range refs {
+		var count int
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s = ?", ref.table, ref.column)
+		if err := tx.QueryRow(query, id).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("%w: used by %d %s", ErrInUse, count, ref.what)
+		}
+	}
+	return nil
+}
+
+// checkExists returns ErrInvalidReference if there is no row with id in table
+func checkExists(tx *sql.Tx, table string, id int, what string) error {
+	var exists bool
+	err := tx.QueryRow(fmt.Sprintf("SELECT 1 FROM %s WHERE id = ?", table), id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s %d", ErrInvalidReference, what, id)
+	}
+	return err
+}
+
+// execUpdate runs an UPDATE and returns notFound if it did not match a row
+func execUpdate(tx *sql.Tx, notFound error, query string, args ...interface{}) error {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// CheckCustomerUnused returns ErrInUse if a customer has purchases or redeemed rewards.
+// Such customers are anonymized rather than deleted.
+func CheckCustomerUnused(id int) error {
+	return Transaction(func(tx *sql.Tx) error {
+		return checkUnused(tx, id,
+			reference{"customer_sales", "customer_id", "sales"},
+			reference{"loyalty_redemptions", "customer_id", "reward redemptions"},
+		)
+	})
+}
+
+// CheckUserUnused returns ErrInUse if a user has recorded sales or time clock entries.
+// Such users are deactivated rather than deleted.
+func CheckUserUnused(id int) error {
+	return Transaction(func(tx *sql.Tx) error {
+		return checkUnused(tx, id,
+			reference{"sales", "user_id", "sales"},
+			reference{"time_entries", "user_id", "time entries"},
+		)
+	})
+}
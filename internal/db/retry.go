@@ -60,6 +60,19 @@ func WithCustomRetry(config RetryConfig, operation func() error) error {
         return err // Should never reach here
 }
 
+// Delay returns how long to wait after the given failed attempt, counting from 1, before
+// trying again
+func (config RetryConfig) Delay(attempt int) time.Duration {
+        delay := config.InitialDelay
+        for i := 1; i < attempt && delay < config.MaxDelay; i++ {
+                delay = time.Duration(float64(delay) * config.BackoffFactor)
+        }
+        if delay > config.MaxDelay {
+                delay = config.MaxDelay
+        }
+        return delay
+}
+
 // isDBLockedError checks if an error is a database locked error
 func isDBLockedError(err error) bool {
         if err == nil {
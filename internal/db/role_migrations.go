@@ -0,0 +1,125 @@
+package db
+
+import "termpos/internal/models"
+
+// defaultRoles are the built-in roles created with the roles table
+var defaultRoles = []models.RoleDefinition{
+	{Name: models.RoleAdmin, Description: "Full access to all features"},
+	{Name: models.RoleManager, Description: "Store management, reporting and backups"},
+	{Name: models.RoleCashier, Description: "Point of sale operations"},
+}
+
+// createRolesTables creates the permissions, roles and role_permissions tables
+// and seeds them from the permission registry and the built-in roles
+func createRolesTables() error {
+	query := `
+	CREATE TABLE permissions (
+		name TEXT PRIMARY KEY,
+		description TEXT
+	);
+
+	CREATE TABLE roles (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		description TEXT,
+		system BOOLEAN NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE role_permissions (
+		role_id INTEGER NOT NULL,
+		permission TEXT NOT NULL,
+		PRIMARY KEY (role_id, permission),
+		FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE,
+		FOREIGN KEY (permission) REFERENCES permissions(name)
+	);
+	`
+
+	if _, err := DB.Exec(query); err != nil {
+		return err
+	}
+
+	if err := syncPermissionRegistry(); err != nil {
+		return err
+	}
+
+	for _, role := range defaultRoles {
+		result, err := DB.Exec(
+			"INSERT INTO roles (name, description, system) VALUES (?, ?, 1)",
+			role.Name, role.Description,
+		)
+		if err != nil {
+			return err
+		}
+
+		roleID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		for _, permission := range models.DefaultRolePermissions[role.Name] {
+			_, err := DB.Exec("INSERT INTO role_permissions (role_id, permission) VALUES (?, ?)", roleID, permission)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rebuildUsersTableForCustomRoles recreates the users table without the CHECK
+// constraint that limited roles to admin, manager and cashier
+func rebuildUsersTableForCustomRoles() error {
+	// SQLite cannot drop a CHECK constraint, so the table is rebuilt in a
+	// single statement batch to keep it on one connection
+	query := `
+	CREATE TABLE users_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_login_at TIMESTAMP,
+		active BOOLEAN NOT NULL DEFAULT 1,
+		full_name TEXT,
+		email TEXT,
+		phone TEXT,
+		address TEXT,
+		hire_date TIMESTAMP,
+		position TEXT,
+		department TEXT,
+		notes TEXT,
+		emergency_contact TEXT
+	);
+
+	INSERT INTO users_new (
+		id, username, password_hash, role, created_at, last_login_at, active,
+		full_name, email, phone, address, hire_date, position, department, notes, emergency_contact
+	)
+	SELECT
+		id, username, password_hash, role, created_at, last_login_at, active,
+		full_name, email, phone, address, hire_date, position, department, notes, emergency_contact
+	FROM users;
+
+	DROP TABLE users;
+	ALTER TABLE users_new RENAME TO users;
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
+
+// syncPermissionRegistry makes sure every registered permission exists in the permissions table
+func syncPermissionRegistry() error {
+	for _, p := range models.PermissionRegistry {
+		_, err := DB.Exec(
+			"INSERT INTO permissions (name, description) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET description = excluded.description",
+			p.Name, p.Description,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"termpos/internal/models"
+)
+
+var (
+	ErrRoleNotFound      = errors.New("role not found")
+	ErrRoleExists        = errors.New("role already exists")
+	ErrSystemRole        = errors.New("built-in roles cannot be deleted")
+	ErrUnknownPermission = errors.New("unknown permission")
+)
+
+// GetRoles retrieves all roles with their permissions
+func GetRoles() ([]models.RoleDefinition, error) {
+	rows, err := DB.Query("SELECT id, name, COALESCE(description, ''), system, created_at FROM roles ORDER BY system DESC, name ASC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get roles: %w", err)
+	}
+
+	var roles []models.RoleDefinition
+	for rows.Next() {
+		var role models.RoleDefinition
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.System, &role.CreatedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan role: %w", err)
+		}
+		roles = append(roles, role)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating roles: %w", err)
+	}
+
+	for i := range roles {
+		roles[i].Permissions, err = getRolePermissions(roles[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return roles, nil
+}
+
+// GetRole retrieves a role and its permissions by name
+func GetRole(name models.Role) (models.RoleDefinition, error) {
+	var role models.RoleDefinition
+	err := DB.QueryRow(
+		"SELECT id, name, COALESCE(description, ''), system, created_at FROM roles WHERE name = ?",
+		name,
+	).Scan(&role.ID, &role.Name, &role.Description, &role.System, &role.CreatedAt)
+	if err == sql.ErrNoRows {
+		return models.RoleDefinition{}, fmt.Errorf("%w: %s", ErrRoleNotFound, name)
+	}
+	if err != nil {
+		return models.RoleDefinition{}, fmt.Errorf("failed to get role: %w", err)
+	}
+
+	role.Permissions, err = getRolePermissions(role)
+	if err != nil {
+		return models.RoleDefinition{}, err
+	}
+
+	return role, nil
+}
+
+// getRolePermissions returns the permissions granted to a role.
+// The admin role is granted every registered permission.
+func getRolePermissions(role models.RoleDefinition) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	if role.Name == models.RoleAdmin {
+		rows, err = DB.Query("SELECT name FROM permissions ORDER BY name ASC")
+	} else {
+		rows, err = DB.Query("SELECT permission FROM role_permissions WHERE role_id = ? ORDER BY permission ASC", role.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get permissions for role %s: %w", role.Name, err)
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, fmt.Errorf("failed to scan permission: %w", err)
+		}
+		permissions = append(permissions, permission)
+	}
+
+	return permissions, rows.Err()
+}
+
+// CreateRole creates a custom role, optionally copying the permissions of an existing role
+func CreateRole(name models.Role, description string, copyFrom models.Role, username string) (models.RoleDefinition, error) {
+	if strings.TrimSpace(string(name)) == "" {
+		return models.RoleDefinition{}, models.ErrEmptyName
+	}
+
+	if _, err := GetRole(name); err == nil {
+		return models.RoleDefinition{}, fmt.Errorf("%w: %s", ErrRoleExists, name)
+	}
+
+	var permissions []string
+	if copyFrom != "" {
+		source, err := GetRole(copyFrom)
+		if err != nil {
+			return models.RoleDefinition{}, err
+		}
+		permissions = source.Permissions
+	}
+
+	err := Transaction(func(tx *sql.Tx) error {
+		result, err := tx.Exec("INSERT INTO roles (name, description, system) VALUES (?, ?, 0)", name, description)
+		if err != nil {
+			return fmt.Errorf("failed to create role: %w", err)
+		}
+
+		roleID, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get role ID: %w", err)
+		}
+
+		for _, permission := range permissions {
+			if _, err := tx.Exec("INSERT INTO role_permissions (role_id, permission) VALUES (?, ?)", roleID, permission); err != nil {
+				return fmt.Errorf("failed to grant permission %s: %w", permission, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return models.RoleDefinition{}, err
+	}
+
+	info := ""
+	if copyFrom != "" {
+		info = fmt.Sprintf("copied_from=%s", copyFrom)
+	}
+	AddAuditLog(
+		username,
+		ActionCreate,
+		"roles",
+		string(name),
+		fmt.Sprintf("Created role: %s", name),
+		"",
+		strings.Join(permissions, ","),
+		"",
+		info,
+	)
+
+	return GetRole(name)
+}
+
+// DeleteRole deletes a custom role that is not assigned to any user
+func DeleteRole(name models.Role, username string) error {
+	role, err := GetRole(name)
+	if err != nil {
+		return err
+	}
+	if role.System {
+		return ErrSystemRole
+	}
+
+	var users int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM users WHERE role = ?", name).Scan(&users); err != nil {
+		return fmt.Errorf("failed to count users with role: %w", err)
+	}
+	if users > 0 {
+		return fmt.Errorf("role %s is assigned to %d user(s)", name, users)
+	}
+
+	err = Transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM role_permissions WHERE role_id = ?", role.ID); err != nil {
+			return fmt.Errorf("failed to delete role permissions: %w", err)
+		}
+		if _, err := tx.Exec("DELETE FROM roles WHERE id = ?", role.ID); err != nil {
+			return fmt.Errorf("failed to delete role: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	AddAuditLog(
+		username,
+		ActionDelete,
+		"roles",
+		string(name),
+		fmt.Sprintf("Deleted role: %s", name),
+		strings.Join(role.Permissions, ","),
+		"",
+		"",
+		"",
+	)
+
+	return nil
+}
+
+// GrantPermission grants a registered permission to a role
+func GrantPermission(name models.Role, permission string, username string) error {
+	role, err := roleForPermissionChange(name, permission)
+	if err != nil {
+		return err
+	}
+
+	if role.HasPermission(permission) {
+		return nil
+	}
+
+	if _, err := DB.Exec("INSERT INTO role_permissions (role_id, permission) VALUES (?, ?)", role.ID, permission); err != nil {
+		return fmt.Errorf("failed to grant permission: %w", err)
+	}
+
+	AddAuditLog(
+		username,
+		ActionPermissionMod,
+		"roles",
+		string(name),
+		fmt.Sprintf("Granted %s to role %s", permission, name),
+		"",
+		permission,
+		"",
+		"",
+	)
+
+	return nil
+}
+
+// RevokePermission revokes a permission from a role
+func RevokePermission(name models.Role, permission string, username string) error {
+	role, err := roleForPermissionChange(name, permission)
+	if err != nil {
+		return err
+	}
+
+	result, err := DB.Exec("DELETE FROM role_permissions WHERE role_id = ? AND permission = ?", role.ID, permission)
+	if err != nil {
+		return fmt.Errorf("failed to revoke permission: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if count == 0 {
+		return fmt.Errorf("role %s does not have permission %s", name, permission)
+	}
+
+	AddAuditLog(
+		username,
+		ActionPermissionMod,
+		"roles",
+		string(name),
+		fmt.Sprintf("Revoked %s from role %s", permission, name),
+		permission,
+		"",
+		"",
+		"",
+	)
+
+	return nil
+}
+
+// roleForPermissionChange validates a grant or revoke and returns the role being changed
+func roleForPermissionChange(name models.Role, permission string) (models.RoleDefinition, error) {
+	if !models.IsRegisteredPermission(permission) {
+		return models.RoleDefinition{}, fmt.Errorf("%w: %s", ErrUnknownPermission, permission)
+	}
+
+	if name == models.RoleAdmin {
+		return models.RoleDefinition{}, fmt.Errorf("the admin role always has every permission")
+	}
+
+	return GetRole(name)
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"termpos/internal/models"
+)
+
+// ErrSaleNotFound is returned when a sale does not exist
+var ErrSaleNotFound = errors.New("sale not found")
+
+// saleQuery selects sales with their product and cashier, read by scanSale
+const saleQuery = `
+	SELECT s.id, s.product_id, COALESCE(p.name, ''), s.quantity, s.price_per_unit,
+	       COALESCE(s.discount_amount, 0), COALESCE(s.discount_code, ''),
+	       COALESCE(s.tax_rate, 0), COALESCE(s.tax_amount, 0),
+	       COALESCE(s.subtotal, 0), s.total,
+	       COALESCE(s.payment_method, ''), COALESCE(s.payment_reference, ''),
+	       s.sale_date, COALESCE(s.receipt_number, ''),
+	       COALESCE(s.customer_email, ''), COALESCE(s.customer_phone, ''), COALESCE(s.notes, ''),
+	       COALESCE(s.customer_id, 0), COALESCE(s.customer_name, ''),
+	       COALESCE(s.approved_by, ''), s.refunded_at, COALESCE(s.refunded_by, ''), COALESCE(s.refund_reason, ''),
+	       COALESCE(s.user_id, 0), COALESCE(u.username, ''), COALESCE(s.terminal_id, '')
+	FROM sales s
+	LEFT JOIN products p ON s.product_id = p.id
+	LEFT JOIN users u ON s.user_id = u.id`
+
+// SaleFilter selects the sales of a list. Nil, empty and zero fields do not filter.
+type SaleFilter struct {
+	UserID        *int
+	ProductID     *int
+	CustomerID    *int
+	Refunded      *bool
+	PaymentMethod string
+	From, To      time.Time // Sales made from From up to and including To
+}
+
+var saleSortColumns = map[string]string{
+	"id":        "s.id",
+	"total":     "s.total",
+	"sale_date": "s.sale_date",
+}
+
+// ListSales retrieves a page of the sales
+func ListSales(filter SaleFilter, q ListQuery) ([]models.Sale, error) {
+	var c listConditions
+	if filter.UserID != nil {
+		c.add("COALESCE(s.user_id, 0) = ?", *filter.UserID)
+	}
+	if filter.ProductID != nil {
+		c.add("s.product_id = ?", *filter.ProductID)
+	}
+	if filter.CustomerID != nil {
+		c.add("COALESCE(s.customer_id, 0) = ?", *filter.CustomerID)
+	}
+	if filter.Refunded != nil {
+		c.add("(s.refunded_at IS NOT NULL) = ?", *filter.Refunded)
+	}
+	if filter.PaymentMethod != "" {
+		c.add("s.payment_method = ?", filter.PaymentMethod)
+	}
+	if !filter.From.IsZero() {
+		c.add("s.sale_date >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		c.add("s.sale_date <= ?", filter.To)
+	}
+
+	query, params, err := pageQuery(saleQuery, "sales", "s", saleSortColumns, c, q)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sales: %w", err)
+	}
+	defer rows.Close()
+
+	var sales []models.Sale
+	for rows.Next() {
+		sale, err := scanSale(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sale: %w", err)
+		}
+		sales = append(sales, sale)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query sales: %w", err)
+	}
+	rows.Close()
+
+	// Decrypted once the rows are read, as the data keys may have to be loaded
+	for i := range sales {
+		if err := OpenSaleContact(&sales[i]); err != nil {
+			return nil, err
+		}
+	}
+	return sales, nil
+}
+
+// GetSale retrieves a sale by its ID
+func GetSale(id int) (models.Sale, error) {
+	sale, err := scanSale(DB.QueryRow(saleQuery+" WHERE s.id = ?", id))
+	if err == sql.ErrNoRows {
+		return models.Sale{}, ErrSaleNotFound
+	}
+	if err != nil {
+		return models.Sale{}, fmt.Errorf("failed to get sale: %w", err)
+	}
+	if err := OpenSaleContact(&sale); err != nil {
+		return models.Sale{}, err
+	}
+	return sale, nil
+}
+
+// scanSale reads the sale of a row selected by saleQuery
+func scanSale(scanner interface{ Scan(...interface{}) error }) (models.Sale, error) {
+	var sale models.Sale
+	var refundedAt sql.NullTime
+	err := scanner.Scan(
+		&sale.ID, &sale.ProductID, &sale.ProductName, &sale.Quantity, &sale.PricePerUnit,
+		&sale.DiscountAmount, &sale.DiscountCode,
+		&sale.TaxRate, &sale.TaxAmount,
+		&sale.Subtotal, &sale.Total,
+		&sale.PaymentMethod, &sale.PaymentReference,
+		&sale.SaleDate, &sale.ReceiptNumber,
+		&sale.CustomerEmail, &sale.CustomerPhone, &sale.Notes,
+		&sale.CustomerID, &sale.CustomerName,
+		&sale.ApprovedBy, &refundedAt, &sale.RefundedBy, &sale.RefundReason,
+		&sale.UserID, &sale.Username, &sale.TerminalID,
+	)
+	sale.RefundedAt = refundedAt.Time
+	return sale, err
+}
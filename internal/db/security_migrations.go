@@ -0,0 +1,153 @@
+package db
+
+import "strings"
+
+// createUserSecurityTable creates the table holding quick login PINs and failed login state
+func createUserSecurityTable() error {
+	query := `
+	CREATE TABLE user_security (
+		user_id INTEGER PRIMARY KEY,
+		pin_hash TEXT,
+		failed_attempts INTEGER NOT NULL DEFAULT 0,
+		last_failed_at TIMESTAMP,
+		locked_until TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
+
+// alterUserSecurityForPasswordPolicy adds forced password change columns to the user_security table
+func alterUserSecurityForPasswordPolicy() error {
+	queries := []string{
+		"ALTER TABLE user_security ADD COLUMN must_change_password BOOLEAN NOT NULL DEFAULT 0;",
+		"ALTER TABLE user_security ADD COLUMN password_changed_at TIMESTAMP;",
+	}
+
+	for _, query := range queries {
+		// Execute the query and ignore "duplicate column" errors
+		_, err := DB.Exec(query)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "duplicate column name:") {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createPasswordHistoryTable creates the table of previous password hashes used to prevent reuse
+func createPasswordHistoryTable() error {
+	query := `
+	CREATE TABLE password_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX idx_password_history_user_id ON password_history(user_id);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
+
+// alterUserSecurityForTwoFactor adds two-factor authentication columns to the user_security table.
+// The TOTP secret itself is kept encrypted in sensitive_data.
+func alterUserSecurityForTwoFactor() error {
+	queries := []string{
+		"ALTER TABLE user_security ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT 0;",
+		"ALTER TABLE user_security ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;",
+	}
+
+	for _, query := range queries {
+		// Execute the query and ignore "duplicate column" errors
+		_, err := DB.Exec(query)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "duplicate column name:") {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createRecoveryCodesTable creates the table of hashed single-use two-factor recovery codes
+func createRecoveryCodesTable() error {
+	query := `
+	CREATE TABLE user_recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX idx_user_recovery_codes_user_id ON user_recovery_codes(user_id);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
+
+// createEncryptionKeysTable creates the table of the data keys sensitive data is encrypted
+// with, each wrapped by the master key
+func createEncryptionKeysTable() error {
+	query := `
+	CREATE TABLE encryption_keys (
+		id TEXT PRIMARY KEY,
+		wrapped_key BLOB NOT NULL,
+		master_key_id TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		retired_at TIMESTAMP
+	);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
+
+// addPIIBlindIndexes adds the blind index columns email addresses and phone numbers are
+// looked up by once they are encrypted, and encrypts the personal data already stored
+// when a master key is configured
+func addPIIBlindIndexes() error {
+	for _, table := range piiIndexedTables {
+		for _, column := range []string{"email_bidx", "phone_bidx"} {
+			// Execute the query and ignore "duplicate column" errors
+			_, err := DB.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " TEXT;")
+			if err != nil && !strings.HasPrefix(err.Error(), "duplicate column name:") {
+				return err
+			}
+		}
+	}
+
+	// Customers stay unique by email address and phone number once these are encrypted
+	_, err := DB.Exec(`
+	CREATE UNIQUE INDEX idx_customers_email_bidx ON customers(email_bidx);
+	CREATE UNIQUE INDEX idx_customers_phone_bidx ON customers(phone_bidx);
+	CREATE INDEX idx_users_email_bidx ON users(email_bidx);
+	CREATE INDEX idx_users_phone_bidx ON users(phone_bidx);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = EncryptPII()
+	return err
+}
+
+// encryptSalePII encrypts the customer email addresses and phone numbers given with sales
+// before they were encrypted at rest, when a master key is configured
+func encryptSalePII() error {
+	_, err := EncryptPII()
+	return err
+}
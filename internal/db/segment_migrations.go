@@ -0,0 +1,66 @@
+package db
+
+import (
+	"encoding/json"
+
+	"termpos/internal/models"
+)
+
+// defaultCustomerSegments are the segments created with the customer_segments table
+var defaultCustomerSegments = []models.CustomerSegment{
+	{
+		Name:        "champions",
+		Description: "Bought recently, buy often and spend the most",
+		Rules:       models.SegmentRules{MinRecencyScore: 4, MinFrequencyScore: 4, MinMonetaryScore: 4},
+	},
+	{
+		Name:        "at-risk",
+		Description: "Used to buy often but have not purchased for a while",
+		Rules:       models.SegmentRules{MaxRecencyScore: 2, MinFrequencyScore: 3},
+	},
+	{
+		Name:        "lapsed",
+		Description: "No purchase in the last 180 days",
+		Rules:       models.SegmentRules{MinDaysSincePurchase: 180},
+	},
+	{
+		Name:        "birthday-this-month",
+		Description: "Customers with a birthday this month",
+		Rules:       models.SegmentRules{BirthdayThisMonth: true},
+	},
+}
+
+// createCustomerSegmentsTable creates the customer_segments table and default segments
+func createCustomerSegmentsTable() error {
+	query := `
+	CREATE TABLE customer_segments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		description TEXT,
+		rules_json TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+
+	if _, err := DB.Exec(query); err != nil {
+		return err
+	}
+
+	for _, segment := range defaultCustomerSegments {
+		rules, err := json.Marshal(segment.Rules)
+		if err != nil {
+			return err
+		}
+
+		_, err = DB.Exec(
+			"INSERT INTO customer_segments (name, description, rules_json) VALUES (?, ?, ?)",
+			segment.Name, segment.Description, string(rules),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,362 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"termpos/internal/models"
+)
+
+// CalculateCustomerRFM computes recency, frequency and monetary metrics for every
+// active customer and assigns 1-5 quintile scores relative to other purchasing customers.
+// Customers without purchases are included with zero scores.
+func CalculateCustomerRFM(now time.Time) ([]models.CustomerRFM, error) {
+	query := `
+		SELECT
+			c.id, c.name, COALESCE(c.email, ''), COALESCE(c.phone, ''), COALESCE(c.birthday, ''),
+			c.email_consent, c.sms_consent,
+			COUNT(s.id), COALESCE(SUM(s.total), 0), MAX(s.sale_date)
+		FROM customers c
+		LEFT JOIN sales s ON s.customer_id = c.id
+			OR s.id IN (SELECT cs.sale_id FROM customer_sales cs WHERE cs.customer_id = c.id)
+		WHERE c.anonymized_at IS NULL
+		GROUP BY c.id
+		ORDER BY c.name ASC
+	`
+
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate customer RFM: %w", err)
+	}
+	defer rows.Close()
+
+	var customers []models.CustomerRFM
+	for rows.Next() {
+		var c models.CustomerRFM
+		var lastPurchase sql.NullString
+
+		err := rows.Scan(
+			&c.CustomerID,
+			&c.Name,
+			&c.Email,
+			&c.Phone,
+			&c.Birthday,
+			&c.EmailConsent,
+			&c.SMSConsent,
+			&c.Frequency,
+			&c.Monetary,
+			&lastPurchase,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan customer RFM row: %w", err)
+		}
+
+		if lastPurchase.Valid {
+			c.LastPurchase, err = parseDBTime(lastPurchase.String)
+			if err != nil {
+				return nil, err
+			}
+			c.RecencyDays = int(now.Sub(c.LastPurchase).Hours() / 24)
+			if c.RecencyDays < 0 {
+				c.RecencyDays = 0
+			}
+		}
+
+		customers = append(customers, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating customer RFM rows: %w", err)
+	}
+
+	for i := range customers {
+		for _, field := range []*string{&customers[i].Email, &customers[i].Phone, &customers[i].Birthday} {
+			if *field, err = openPII(*field); err != nil {
+				return nil, fmt.Errorf("customer %d: %w", customers[i].CustomerID, err)
+			}
+		}
+	}
+
+	scoreRFM(customers)
+	return customers, nil
+}
+
+// scoreRFM assigns quintile scores to customers that have purchases.
+// Equal values always receive the same score.
+func scoreRFM(customers []models.CustomerRFM) {
+	var recency, frequency, monetary []float64
+	for _, c := range customers {
+		if !c.HasPurchases() {
+			continue
+		}
+		// Fewer days since the last purchase is better, so negate recency
+		recency = append(recency, -float64(c.RecencyDays))
+		frequency = append(frequency, float64(c.Frequency))
+		monetary = append(monetary, c.Monetary)
+	}
+
+	sort.Float64s(recency)
+	sort.Float64s(frequency)
+	sort.Float64s(monetary)
+
+	for i := range customers {
+		if !customers[i].HasPurchases() {
+			continue
+		}
+		customers[i].RecencyScore = quintile(recency, -float64(customers[i].RecencyDays))
+		customers[i].FrequencyScore = quintile(frequency, float64(customers[i].Frequency))
+		customers[i].MonetaryScore = quintile(monetary, customers[i].Monetary)
+	}
+}
+
+// quintile returns a 1-5 score for value based on how many sorted values are below it
+func quintile(sorted []float64, value float64) int {
+	below := sort.SearchFloat64s(sorted, value)
+	return 1 + below*5/len(sorted)
+}
+
+// GetCustomerSegments retrieves all customer segments
+func GetCustomerSegments() ([]models.CustomerSegment, error) {
+	rows, err := DB.Query("SELECT id, name, COALESCE(description, ''), rules_json, created_at, updated_at FROM customer_segments ORDER BY name ASC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get customer segments: %w", err)
+	}
+	defer rows.Close()
+
+	var segments []models.CustomerSegment
+	for rows.Next() {
+		segment, err := scanCustomerSegment(rows)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+
+	return segments, rows.Err()
+}
+
+// GetCustomerSegment retrieves a customer segment by name
+func GetCustomerSegment(name string) (models.CustomerSegment, error) {
+	row := DB.QueryRow("SELECT id, name, COALESCE(description, ''), rules_json, created_at, updated_at FROM customer_segments WHERE name = ?", name)
+	segment, err := scanCustomerSegment(row)
+	if err == sql.ErrNoRows {
+		return models.CustomerSegment{}, fmt.Errorf("segment not found: %s", name)
+	}
+	return segment, err
+}
+
+// scanCustomerSegment scans a customer_segments row
+func scanCustomerSegment(scanner interface{ Scan(...interface{}) error }) (models.CustomerSegment, error) {
+	var segment models.CustomerSegment
+	var rulesJSON string
+
+	err := scanner.Scan(
+		&segment.ID,
+		&segment.Name,
+		&segment.Description,
+		&rulesJSON,
+		&segment.CreatedAt,
+		&segment.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.CustomerSegment{}, err
+		}
+		return models.CustomerSegment{}, fmt.Errorf("failed to scan customer segment: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(rulesJSON), &segment.Rules); err != nil {
+		return models.CustomerSegment{}, fmt.Errorf("failed to parse rules for segment %s: %w", segment.Name, err)
+	}
+
+	return segment, nil
+}
+
+// SaveCustomerSegment creates a segment or replaces the rules of an existing one
+func SaveCustomerSegment(segment models.CustomerSegment, username string) error {
+	if err := segment.Validate(); err != nil {
+		return err
+	}
+
+	rules, err := json.Marshal(segment.Rules)
+	if err != nil {
+		return fmt.Errorf("failed to marshal segment rules: %w", err)
+	}
+
+	previous, err := GetCustomerSegment(segment.Name)
+	exists := err == nil
+
+	now := time.Now()
+	if exists {
+		_, err = DB.Exec(
+			"UPDATE customer_segments SET description = ?, rules_json = ?, updated_at = ? WHERE name = ?",
+			segment.Description, string(rules), now, segment.Name,
+		)
+	} else {
+		_, err = DB.Exec(
+			"INSERT INTO customer_segments (name, description, rules_json, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+			segment.Name, segment.Description, string(rules), now, now,
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save customer segment: %w", err)
+	}
+
+	if exists {
+		previousRules, _ := json.Marshal(previous.Rules)
+		AddAuditLog(
+			username,
+			ActionUpdate,
+			"customer_segments",
+			segment.Name,
+			fmt.Sprintf("Updated customer segment: %s", segment.Name),
+			string(previousRules),
+			string(rules),
+			"",
+			"",
+		)
+	} else {
+		AddAuditLog(
+			username,
+			ActionCreate,
+			"customer_segments",
+			segment.Name,
+			fmt.Sprintf("Created customer segment: %s", segment.Name),
+			"",
+			string(rules),
+			"",
+			"",
+		)
+	}
+
+	return nil
+}
+
+// DeleteCustomerSegment deletes a customer segment by name
+func DeleteCustomerSegment(name string, username string) error {
+	result, err := DB.Exec("DELETE FROM customer_segments WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete customer segment: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if count == 0 {
+		return fmt.Errorf("segment not found: %s", name)
+	}
+
+	AddAuditLog(
+		username,
+		ActionDelete,
+		"customer_segments",
+		name,
+		fmt.Sprintf("Deleted customer segment: %s", name),
+		"",
+		"",
+		"",
+		"",
+	)
+
+	return nil
+}
+
+// GetSegmentMembers returns the customers that currently match a segment's rules
+func GetSegmentMembers(name string) ([]models.CustomerRFM, error) {
+	segment, err := GetCustomerSegment(name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	customers, err := CalculateCustomerRFM(now)
+	if err != nil {
+		return nil, err
+	}
+
+	members := []models.CustomerRFM{}
+	for _, c := range customers {
+		if segment.Rules.Matches(c, now) {
+			members = append(members, c)
+		}
+	}
+
+	return members, nil
+}
+
+// ExportSegmentMembersCSV writes the members of a segment to a CSV file for marketing use
+func ExportSegmentMembersCSV(name, filePath, username string) (int, error) {
+	members, err := GetSegmentMembers(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if dir := filepath.Dir(filePath); dir != "." && dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return 0, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create export file: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{
+		"customer_id", "name", "email", "phone", "birthday", "email_consent", "sms_consent",
+		"last_purchase", "recency_days", "frequency", "monetary",
+		"recency_score", "frequency_score", "monetary_score", "rfm_score",
+	})
+
+	for _, m := range members {
+		lastPurchase := ""
+		if !m.LastPurchase.IsZero() {
+			lastPurchase = m.LastPurchase.Format("2006-01-02")
+		}
+
+		writer.Write([]string{
+			fmt.Sprintf("%d", m.CustomerID),
+			m.Name,
+			m.Email,
+			m.Phone,
+			m.Birthday,
+			fmt.Sprintf("%t", m.EmailConsent),
+			fmt.Sprintf("%t", m.SMSConsent),
+			lastPurchase,
+			fmt.Sprintf("%d", m.RecencyDays),
+			fmt.Sprintf("%d", m.Frequency),
+			fmt.Sprintf("%.2f", m.Monetary),
+			fmt.Sprintf("%d", m.RecencyScore),
+			fmt.Sprintf("%d", m.FrequencyScore),
+			fmt.Sprintf("%d", m.MonetaryScore),
+			m.Score(),
+		})
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return 0, fmt.Errorf("failed to write segment export: %w", err)
+	}
+
+	AddAuditLog(
+		username,
+		ActionExport,
+		"customer_segments",
+		name,
+		fmt.Sprintf("Exported %d members of customer segment %s", len(members), name),
+		"",
+		"",
+		"",
+		fmt.Sprintf("path=%s", filePath),
+	)
+
+	return len(members), nil
+}
@@ -1,7 +1,9 @@
 package db
 
 import (
+        "context"
         "database/sql"
+        "errors"
         "fmt"
         "regexp"
         "strings"
@@ -21,49 +23,74 @@ type SensitiveDataEntry struct {
         UpdatedAt    string
 }
 
-// StoreSensitiveData encrypts and stores sensitive data for a resource
-func StoreSensitiveData(resourceType string, resourceID int64, fieldName string, value string) error {
-        db, err := GetDB()
-        if err != nil {
-                return fmt.Errorf("failed to get database connection: %w", err)
-        }
-
-        // Check if field already exists
-        var count int
-        err = db.QueryRow(
-                "SELECT COUNT(*) FROM sensitive_data WHERE resource_type = ? AND resource_id = ? AND field_name = ?",
-                resourceType, resourceID, fieldName,
-        ).Scan(&count)
-        if err != nil {
-                return fmt.Errorf("failed to check for existing sensitive data: %w", err)
-        }
-
-        // Encrypt the value
+// StoreSensitiveData encrypts and stores sensitive data for a resource, recording the change
+// in the audit log. The value itself is never written to the log.
+func StoreSensitiveData(ctx context.Context, resourceType string, resourceID int64, fieldName string, value string) error {
+        // Encrypt the value before the transaction, as loading the data keys needs the database
         encrypted, err := security.Encrypt(value)
         if err != nil {
                 return fmt.Errorf("failed to encrypt sensitive data: %w", err)
         }
 
-        // Update or insert
-        if count > 0 {
-                _, err = db.Exec(
-                        "UPDATE sensitive_data SET value = ?, updated_at = ? WHERE resource_type = ? AND resource_id = ? AND field_name = ?",
-                        encrypted, time.Now().Format(time.RFC3339), resourceType, resourceID, fieldName,
-                )
-                if err != nil {
-                        return fmt.Errorf("failed to update sensitive data: %w", err)
+        return Transaction(func(tx *sql.Tx) error {
+                old, err := getSensitiveDataEntry(tx, resourceType, resourceID, fieldName)
+                if err != nil && err != errSensitiveDataNotFound {
+                        return err
                 }
-        } else {
-                _, err = db.Exec(
-                        "INSERT INTO sensitive_data (resource_type, resource_id, field_name, value, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
-                        resourceType, resourceID, fieldName, encrypted, time.Now().Format(time.RFC3339), time.Now().Format(time.RFC3339),
-                )
+
+                entry, err := storeSensitiveDataTx(tx, resourceType, resourceID, fieldName, encrypted)
                 if err != nil {
-                        return fmt.Errorf("failed to store sensitive data: %w", err)
+                        return err
+                }
+
+                resource := sensitiveDataResource(resourceType, resourceID, fieldName)
+                if old.ID == 0 {
+                        return AuditTx(ctx, tx, ActionCreate, "sensitive_data", resource, "Stored sensitive data "+resource, nil, entry)
                 }
+                return AuditTx(ctx, tx, ActionUpdate, "sensitive_data", resource, "Updated sensitive data "+resource, old, entry)
+        })
+}
+
+// storeSensitiveDataTx stores an encrypted value of sensitive data for a resource within
+// a transaction, returning the stored entry with its value redacted
+func storeSensitiveDataTx(tx *sql.Tx, resourceType string, resourceID int64, fieldName string, encrypted string) (SensitiveDataEntry, error) {
+        now := time.Now().Format(time.RFC3339)
+        _, err := tx.Exec(
+                `INSERT INTO sensitive_data (resource_type, resource_id, field_name, encrypted_value, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+                 ON CONFLICT (resource_type, resource_id, field_name) DO UPDATE
+                 SET encrypted_value = excluded.encrypted_value, updated_at = excluded.updated_at`,
+                resourceType, resourceID, fieldName, encrypted, now, now,
+        )
+        if err != nil {
+                return SensitiveDataEntry{}, fmt.Errorf("failed to store sensitive data: %w", err)
         }
 
-        return nil
+        return getSensitiveDataEntry(tx, resourceType, resourceID, fieldName)
+}
+
+// errSensitiveDataNotFound is returned when a resource has no sensitive data in a field
+var errSensitiveDataNotFound = errors.New("sensitive data not found")
+
+// getSensitiveDataEntry reads a sensitive data entry within a transaction. Its value is
+// redacted, so the entry can be recorded in the audit log.
+func getSensitiveDataEntry(tx *sql.Tx, resourceType string, resourceID int64, fieldName string) (SensitiveDataEntry, error) {
+        entry := SensitiveDataEntry{ResourceType: resourceType, ResourceID: resourceID, FieldName: fieldName, Value: redactedPII}
+        err := tx.QueryRow(
+                "SELECT id, created_at, updated_at FROM sensitive_data WHERE resource_type = ? AND resource_id = ? AND field_name = ?",
+                resourceType, resourceID, fieldName,
+        ).Scan(&entry.ID, &entry.CreatedAt, &entry.UpdatedAt)
+        if err == sql.ErrNoRows {
+                return SensitiveDataEntry{}, errSensitiveDataNotFound
+        }
+        if err != nil {
+                return SensitiveDataEntry{}, fmt.Errorf("failed to check for existing sensitive data: %w", err)
+        }
+        return entry, nil
+}
+
+// sensitiveDataResource identifies a sensitive data field in the audit log
+func sensitiveDataResource(resourceType string, resourceID int64, fieldName string) string {
+        return fmt.Sprintf("%s/%d/%s", resourceType, resourceID, fieldName)
 }
 
 // GetSensitiveData retrieves and decrypts sensitive data for a resource
@@ -75,7 +102,7 @@ func GetSensitiveData(resourceType string, resourceID int64, fieldName string) (
 
         var encrypted string
         err = db.QueryRow(
-                "SELECT value FROM sensitive_data WHERE resource_type = ? AND resource_id = ? AND field_name = ?",
+                "SELECT encrypted_value FROM sensitive_data WHERE resource_type = ? AND resource_id = ? AND field_name = ?",
                 resourceType, resourceID, fieldName,
         ).Scan(&encrypted)
         if err != nil {
@@ -94,49 +121,70 @@ func GetSensitiveData(resourceType string, resourceID int64, fieldName string) (
         return decrypted, nil
 }
 
-// DeleteSensitiveData deletes sensitive data for a resource
-func DeleteSensitiveData(resourceType string, resourceID int64, fieldName string) error {
-        db, err := GetDB()
-        if err != nil {
-                return fmt.Errorf("failed to get database connection: %w", err)
-        }
-
-        result, err := db.Exec(
-                "DELETE FROM sensitive_data WHERE resource_type = ? AND resource_id = ? AND field_name = ?",
-                resourceType, resourceID, fieldName,
-        )
-        if err != nil {
-                return fmt.Errorf("failed to delete sensitive data: %w", err)
-        }
-
-        rows, err := result.RowsAffected()
-        if err != nil {
-                return fmt.Errorf("failed to get rows affected: %w", err)
-        }
+// DeleteSensitiveData deletes sensitive data for a resource, recording the deletion in
+// the audit log
+func DeleteSensitiveData(ctx context.Context, resourceType string, resourceID int64, fieldName string) error {
+        return Transaction(func(tx *sql.Tx) error {
+                old, err := getSensitiveDataEntry(tx, resourceType, resourceID, fieldName)
+                if err != nil {
+                        return err
+                }
 
-        if rows == 0 {
-                return fmt.Errorf("sensitive data not found")
-        }
+                _, err = tx.Exec("DELETE FROM sensitive_data WHERE id = ?", old.ID)
+                if err != nil {
+                        return fmt.Errorf("failed to delete sensitive data: %w", err)
+                }
 
-        return nil
+                resource := sensitiveDataResource(resourceType, resourceID, fieldName)
+                return AuditTx(ctx, tx, ActionDelete, "sensitive_data", resource, "Deleted sensitive data "+resource, old, nil)
+        })
 }
 
-// DeleteAllSensitiveDataForResource deletes all sensitive data for a resource
-func DeleteAllSensitiveDataForResource(resourceType string, resourceID int64) error {
-        db, err := GetDB()
-        if err != nil {
-                return fmt.Errorf("failed to get database connection: %w", err)
-        }
+// DeleteAllSensitiveDataForResource deletes all sensitive data for a resource, recording
+// the deletion in the audit log
+func DeleteAllSensitiveDataForResource(ctx context.Context, resourceType string, resourceID int64) error {
+        return Transaction(func(tx *sql.Tx) error {
+                rows, err := tx.Query(
+                        "SELECT field_name FROM sensitive_data WHERE resource_type = ? AND resource_id = ? ORDER BY field_name",
+                        resourceType, resourceID,
+                )
+                if err != nil {
+                        return fmt.Errorf("failed to retrieve sensitive data fields: %w", err)
+                }
+                var fields []string
+                for rows.Next() {
+                        var field string
+                        if err := rows.Scan(&field); err != nil {
+                                rows.Close()
+                                return fmt.Errorf("failed to scan field name: %w", err)
+                        }
+                        fields = append(fields, field)
+                }
+                rows.Close()
+                if err := rows.Err(); err != nil {
+                        return fmt.Errorf("error iterating sensitive data fields: %w", err)
+                }
 
-        _, err = db.Exec(
-                "DELETE FROM sensitive_data WHERE resource_type = ? AND resource_id = ?",
-                resourceType, resourceID,
-        )
-        if err != nil {
-                return fmt.Errorf("failed to delete sensitive data: %w", err)
-        }
+                var old []SensitiveDataEntry
+                for _, field := range fields {
+                        entry, err := getSensitiveDataEntry(tx, resourceType, resourceID, field)
+                        if err != nil {
+                                return err
+                        }
+                        old = append(old, entry)
+                }
+
+                _, err = tx.Exec(
+                        "DELETE FROM sensitive_data WHERE resource_type = ? AND resource_id = ?",
+                        resourceType, resourceID,
+                )
+                if err != nil {
+                        return fmt.Errorf("failed to delete sensitive data: %w", err)
+                }
 
-        return nil
+                resource := fmt.Sprintf("%s/%d", resourceType, resourceID)
+                return AuditTx(ctx, tx, ActionDelete, "sensitive_data", resource, "Deleted all sensitive data for "+resource, old, nil)
+        })
 }
 
 // GetSensitiveDataFields gets all field names for sensitive data for a resource
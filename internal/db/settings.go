@@ -1,6 +1,7 @@
 package db
 
 import (
+        "context"
         "database/sql"
         "encoding/json"
         "fmt"
@@ -45,12 +46,16 @@ func GetSettings() (models.Settings, error) {
         return settings, nil
 }
 
-// SaveSettings saves settings to the database
-func SaveSettings(settings models.Settings, username string) error {
+// SaveSettings saves settings to the database as changed by the actor of the context
+func SaveSettings(ctx context.Context, settings models.Settings) error {
         // First validate the settings
         if err := settings.Validate(); err != nil {
                 return err
         }
+        old, err := GetSettings()
+        if err != nil {
+                return err
+        }
 
         // Convert settings to JSON
         settingsJSON, err := json.Marshal(settings)
@@ -60,6 +65,7 @@ func SaveSettings(settings models.Settings, username string) error {
 
         // Update last updated time
         now := time.Now().Format(time.RFC3339)
+        username := ActorFromContext(ctx).Username
 
         // Use insert or update logic
         query := `
@@ -68,8 +74,13 @@ func SaveSettings(settings models.Settings, username string) error {
                 RETURNING id
         `
         
-        var id int
-        err = DB.QueryRow(query, string(settingsJSON), now, username).Scan(&id)
+        err = Transaction(func(tx *sql.Tx) error {
+                var id int
+                if err := tx.QueryRow(query, string(settingsJSON), now, username).Scan(&id); err != nil {
+                        return err
+                }
+                return AuditTx(ctx, tx, ActionSettingsMod, "settings", "global", "Updated settings", old, settings)
+        })
         if err != nil {
                 return fmt.Errorf("failed to save settings: %w", err)
         }
@@ -194,10 +205,8 @@ func BackupDatabaseViaVacuum(backupPath string) error {
         }
 
         // Use SQLite's backup mechanism
-        backup := fmt.Sprintf("VACUUM INTO '%s'", backupPath)
-        _, err := DB.Exec(backup)
-        if err != nil {
-                return fmt.Errorf("failed to create database backup: %w", err)
+        if err := SnapshotDatabase(backupPath); err != nil {
+                return err
         }
 
         // Update last backup time in settings
@@ -207,7 +216,7 @@ func BackupDatabaseViaVacuum(backupPath string) error {
         }
         settings.Backup.LastBackupTime = time.Now().Format(time.RFC3339)
         
-        return SaveSettings(settings, "system")
+        return SaveSettings(context.Background(), settings)
 }
 
 // ensureBackupDir ensures that the backup directory exists
@@ -250,7 +259,7 @@ func ExportSettings(filePath string) error {
 }
 
 // ImportSettings imports settings from a JSON file
-func ImportSettings(jsonData string, username string) error {
+func ImportSettings(ctx context.Context, jsonData string) error {
         settings, err := models.ImportFromJSON(jsonData)
         if err != nil {
                 return fmt.Errorf("failed to parse settings JSON: %w", err)
@@ -262,5 +271,5 @@ func ImportSettings(jsonData string, username string) error {
         }
 
         // Save to database
-        return SaveSettings(settings, username)
+        return SaveSettings(ctx, settings)
 }
\ No newline at end of file
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"termpos/internal/security"
+)
+
+// DatabaseFileInfo describes a database file, such as a backup
+type DatabaseFileInfo struct {
+	SchemaVersion int
+	Tables        map[string]int64
+}
+
+// SnapshotDatabase writes a consistent copy of the open database to a new file. The copy
+// of an encrypted database is encrypted with its key.
+func SnapshotDatabase(path string) error {
+	if IsDatabaseEncrypted() {
+		if err := exportDatabase(path, databaseKey); err != nil {
+			return fmt.Errorf("failed to create database snapshot: %w", err)
+		}
+		return nil
+	}
+	if _, err := DB.Exec("VACUUM INTO ?", path); err != nil {
+		return fmt.Errorf("failed to create database snapshot: %w", err)
+	}
+	return nil
+}
+
+// CopyDatabase copies the open database page for page to a new file with SQLite's online
+// backup API and returns its page size. Unlike a snapshot, which rebuilds the database,
+// pages that did not change are identical in each copy, so copies can be compared page by
+// page. The copy of an encrypted database is encrypted with its key.
+func CopyDatabase(path string) (int, error) {
+	ctx := context.Background()
+
+	var pageSize int
+	if err := DB.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, fmt.Errorf("failed to read page size: %w", err)
+	}
+
+	dsn := fileURI(path)
+	if IsDatabaseEncrypted() {
+		dsn = keyedDSN(path, databaseKey)
+	}
+	dest, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer dest.Close()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer destConn.Close()
+	srcConn, err := DB.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy database: %w", err)
+	}
+	defer srcConn.Close()
+
+	err = destConn.Raw(func(destDriver any) error {
+		return srcConn.Raw(func(srcDriver any) error {
+			backup, err := destDriver.(*sqlite3.SQLiteConn).Backup("main", srcDriver.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy database: %w", err)
+	}
+	return pageSize, nil
+}
+
+// InspectDatabaseFile opens a database file read-only, checks its integrity and returns
+// its schema version and the number of rows in each table. Encrypted files are opened with
+// the configured database key.
+func InspectDatabaseFile(path string) (DatabaseFileInfo, error) {
+	info := DatabaseFileInfo{Tables: make(map[string]int64)}
+
+	salt, err := databaseSalt(path)
+	if err != nil {
+		return info, err
+	}
+	dsn := fileURI(path) + "?mode=ro"
+	if salt != nil {
+		key, err := security.DatabaseKey(salt)
+		if err != nil {
+			return info, err
+		}
+		dsn = keyedDSN(path, rawKey(key, salt)) + "&mode=ro"
+	}
+
+	file, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return info, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+	if salt != nil {
+		if err := checkDatabaseKey(file); err != nil {
+			return info, err
+		}
+	}
+
+	rows, err := file.Query("PRAGMA integrity_check")
+	if err != nil {
+		return info, fmt.Errorf("failed to check integrity of %s: %w", path, err)
+	}
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			rows.Close()
+			return info, fmt.Errorf("failed to check integrity of %s: %w", path, err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return info, fmt.Errorf("failed to check integrity of %s: %w", path, err)
+	}
+	if len(problems) > 0 {
+		return info, fmt.Errorf("integrity check of %s failed: %s", path, strings.Join(problems, "; "))
+	}
+
+	rows, err = file.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return info, fmt.Errorf("failed to list tables of %s: %w", path, err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return info, fmt.Errorf("failed to list tables of %s: %w", path, err)
+		}
+		tables = append(tables, table)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return info, fmt.Errorf("failed to list tables of %s: %w", path, err)
+	}
+
+	for _, table := range tables {
+		var count int64
+		query := fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, strings.ReplaceAll(table, `"`, `""`))
+		if err := file.QueryRow(query).Scan(&count); err != nil {
+			return info, fmt.Errorf("failed to count rows of %s: %w", table, err)
+		}
+		info.Tables[table] = count
+		if table == "schema_migrations" {
+			if err := file.QueryRow("SELECT COALESCE(MAX(id), 0) FROM schema_migrations").Scan(&info.SchemaVersion); err != nil {
+				return info, fmt.Errorf("failed to read schema version: %w", err)
+			}
+		}
+	}
+
+	return info, nil
+}
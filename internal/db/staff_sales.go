@@ -0,0 +1,253 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"termpos/internal/models"
+)
+
+var ErrCommissionRuleNotFound = errors.New("commission rule not found")
+
+// saleDateFilter returns the WHERE conditions and parameters limiting sales to a date
+// range. Either bound may be empty.
+func saleDateFilter(startDate, endDate string) (string, []interface{}) {
+	var conditions []string
+	var params []interface{}
+	if startDate != "" {
+		conditions = append(conditions, "date(s.sale_date) >= ?")
+		params = append(params, startDate)
+	}
+	if endDate != "" {
+		conditions = append(conditions, "date(s.sale_date) <= ?")
+		params = append(params, endDate)
+	}
+	if len(conditions) == 0 {
+		return "1 = 1", nil
+	}
+	return strings.Join(conditions, " AND "), params
+}
+
+// GetStaffPerformance returns the sales made by each staff member between two dates,
+// with the commission earned under the current commission rules. Sales recorded
+// before sales were attributed to users are grouped under user ID zero.
+func GetStaffPerformance(startDate, endDate string) ([]models.StaffPerformance, error) {
+	filter, params := saleDateFilter(startDate, endDate)
+
+	rows, err := DB.Query(
+		`SELECT COALESCE(s.user_id, 0), COALESCE(u.username, ''), COALESCE(u.role, ''),
+		        COUNT(*),
+		        COALESCE(SUM(CASE WHEN s.refunded_at IS NULL THEN s.total ELSE 0 END), 0),
+		        COALESCE(SUM(CASE WHEN s.refunded_at IS NULL THEN s.quantity ELSE 0 END), 0),
+		        COUNT(s.refunded_at),
+		        COUNT(CASE WHEN s.discount_amount > 0 THEN 1 END),
+		        COALESCE(SUM(s.discount_amount), 0)
+		 FROM sales s
+		 LEFT JOIN users u ON s.user_id = u.id
+		 WHERE `+filter+`
+		 GROUP BY COALESCE(s.user_id, 0)`,
+		params...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query staff performance: %w", err)
+	}
+	defer rows.Close()
+
+	var results []models.StaffPerformance
+	index := make(map[int]int)
+	for rows.Next() {
+		var p models.StaffPerformance
+		if err := rows.Scan(
+			&p.UserID, &p.Username, &p.Role,
+			&p.Transactions, &p.Revenue, &p.Items, &p.Refunds,
+			&p.DiscountedSales, &p.DiscountTotal,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan staff performance: %w", err)
+		}
+		index[p.UserID] = len(results)
+		results = append(results, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating staff performance: %w", err)
+	}
+
+	if err := addCommission(results, index, filter, params); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Revenue > results[j].Revenue })
+	return results, nil
+}
+
+// addCommission applies the commission rules to the net sales of each staff member by
+// product category. Commission is paid on the sale after discounts and before tax.
+func addCommission(results []models.StaffPerformance, index map[int]int, filter string, params []interface{}) error {
+	rules, err := ListCommissionRules()
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	rows, err := DB.Query(
+		`SELECT s.user_id, COALESCE(p.category_id, 0),
+		        COALESCE(SUM(COALESCE(s.subtotal, s.total) - COALESCE(s.discount_amount, 0)), 0)
+		 FROM sales s
+		 LEFT JOIN products p ON s.product_id = p.id
+		 WHERE s.user_id IS NOT NULL AND s.refunded_at IS NULL AND `+filter+`
+		 GROUP BY s.user_id, p.category_id`,
+		params...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query commissionable sales: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID, categoryID int
+		var net float64
+		if err := rows.Scan(&userID, &categoryID, &net); err != nil {
+			return fmt.Errorf("failed to scan commissionable sales: %w", err)
+		}
+		i, ok := index[userID]
+		if !ok {
+			continue
+		}
+		if rule, ok := models.MatchCommissionRule(rules, results[i].Role, categoryID); ok {
+			results[i].Commission += net * rule.Rate / 100
+		}
+	}
+
+	return rows.Err()
+}
+
+// ListCommissionRules returns all commission rules
+func ListCommissionRules() ([]models.CommissionRule, error) {
+	rows, err := DB.Query(
+		`SELECT r.id, r.role, r.category_id, COALESCE(c.name, ''), r.rate,
+		        COALESCE(r.updated_by, ''), r.updated_at
+		 FROM commission_rules r
+		 LEFT JOIN categories c ON r.category_id = c.id
+		 ORDER BY r.role, r.category_id`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query commission rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []models.CommissionRule
+	for rows.Next() {
+		var r models.CommissionRule
+		var updatedAt sql.NullTime
+		if err := rows.Scan(&r.ID, &r.Role, &r.CategoryID, &r.CategoryName, &r.Rate, &r.UpdatedBy, &updatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan commission rule: %w", err)
+		}
+		r.UpdatedAt = updatedAt.Time
+		rules = append(rules, r)
+	}
+
+	return rules, rows.Err()
+}
+
+// SetCommissionRule creates the commission rule for a role and category, or changes
+// its rate if one already exists. The rule is recorded as updated by the actor of the
+// context.
+func SetCommissionRule(ctx context.Context, rule models.CommissionRule) (models.CommissionRule, error) {
+	if err := rule.Validate(); err != nil {
+		return models.CommissionRule{}, err
+	}
+
+	if rule.Role != "" {
+		if _, err := GetRole(rule.Role); err != nil {
+			return models.CommissionRule{}, err
+		}
+	}
+	if rule.CategoryID != 0 {
+		if err := DB.QueryRow("SELECT name FROM categories WHERE id = ?", rule.CategoryID).Scan(&rule.CategoryName); err != nil {
+			if err == sql.ErrNoRows {
+				return models.CommissionRule{}, fmt.Errorf("category %d not found", rule.CategoryID)
+			}
+			return models.CommissionRule{}, err
+		}
+	}
+
+	rule.UpdatedBy = ActorFromContext(ctx).Username
+	rule.UpdatedAt = time.Now()
+	err := Transaction(func(tx *sql.Tx) error {
+		old, err := getCommissionRule(tx, "role = ? AND category_id = ?", rule.Role, rule.CategoryID)
+		if err != nil && err != ErrCommissionRuleNotFound {
+			return err
+		}
+
+		err = tx.QueryRow(
+			`INSERT INTO commission_rules (role, category_id, rate, updated_by, updated_at)
+			 VALUES (?, ?, ?, ?, ?)
+			 ON CONFLICT (role, category_id) DO UPDATE
+			 SET rate = excluded.rate, updated_by = excluded.updated_by, updated_at = excluded.updated_at
+			 RETURNING id`,
+			rule.Role, rule.CategoryID, rule.Rate, rule.UpdatedBy, rule.UpdatedAt,
+		).Scan(&rule.ID)
+		if err != nil {
+			return fmt.Errorf("failed to save commission rule: %w", err)
+		}
+
+		role, category := string(rule.Role), "Any"
+		if role == "" {
+			role = "Any"
+		}
+		if rule.CategoryID != 0 {
+			category = fmt.Sprintf("%s (%d)", rule.CategoryName, rule.CategoryID)
+		}
+		description := fmt.Sprintf("Set commission to %.2f%% for role %s and category %s", rule.Rate, role, category)
+		if old == nil {
+			return AuditTx(ctx, tx, ActionCreate, "commission_rule", rule.ID, description, nil, rule)
+		}
+		return AuditTx(ctx, tx, ActionUpdate, "commission_rule", rule.ID, description, old, rule)
+	})
+	if err != nil {
+		return models.CommissionRule{}, err
+	}
+
+	return rule, nil
+}
+
+// DeleteCommissionRule deletes a commission rule
+func DeleteCommissionRule(ctx context.Context, id int) error {
+	return Transaction(func(tx *sql.Tx) error {
+		old, err := getCommissionRule(tx, "id = ?", id)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM commission_rules WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete commission rule: %w", err)
+		}
+		return AuditTx(ctx, tx, ActionDelete, "commission_rule", id,
+			fmt.Sprintf("Deleted commission rule %d", id), old, nil)
+	})
+}
+
+// getCommissionRule reads the commission rule matching a condition in a transaction
+func getCommissionRule(tx *sql.Tx, where string, args ...interface{}) (*models.CommissionRule, error) {
+	var r models.CommissionRule
+	var updatedAt sql.NullTime
+	err := tx.QueryRow(
+		`SELECT id, role, category_id, rate, COALESCE(updated_by, ''), updated_at
+		 FROM commission_rules WHERE `+where,
+		args...,
+	).Scan(&r.ID, &r.Role, &r.CategoryID, &r.Rate, &r.UpdatedBy, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrCommissionRuleNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commission rule: %w", err)
+	}
+	r.UpdatedAt = updatedAt.Time
+	return &r, nil
+}
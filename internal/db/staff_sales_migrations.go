@@ -0,0 +1,43 @@
+package db
+
+import "strings"
+
+// alterSalesTableForStaffAttribution records the user and terminal that made each sale
+func alterSalesTableForStaffAttribution() error {
+	queries := []string{
+		"ALTER TABLE sales ADD COLUMN user_id INTEGER REFERENCES users(id) ON DELETE SET NULL;",
+		"ALTER TABLE sales ADD COLUMN terminal_id TEXT;",
+	}
+
+	for _, query := range queries {
+		// Execute the query and ignore "duplicate column" errors
+		_, err := DB.Exec(query)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "duplicate column name:") {
+				continue
+			}
+			return err
+		}
+	}
+
+	_, err := DB.Exec("CREATE INDEX IF NOT EXISTS idx_sales_user_id ON sales(user_id, sale_date);")
+	return err
+}
+
+// createCommissionRulesTable creates the table of commission rates per role and product category
+func createCommissionRulesTable() error {
+	query := `
+	CREATE TABLE commission_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		role TEXT NOT NULL DEFAULT '',
+		category_id INTEGER NOT NULL DEFAULT 0,
+		rate REAL NOT NULL,
+		updated_by TEXT,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (role, category_id)
+	);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
@@ -0,0 +1,533 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"termpos/internal/models"
+)
+
+var (
+	ErrAlreadyClockedIn  = errors.New("already clocked in")
+	ErrNotClockedIn      = errors.New("not clocked in")
+	ErrAlreadyOnBreak    = errors.New("already on a break")
+	ErrNotOnBreak        = errors.New("not on a break")
+	ErrShiftOverlap      = errors.New("shift overlaps another shift for this user")
+	ErrTimeEntryNotFound = errors.New("time entry not found")
+)
+
+// timeEntryColumns are the columns read by scanTimeEntry
+const timeEntryColumns = `e.id, e.user_id, u.username, e.clock_in, e.clock_out, e.notes, e.edited_by, e.edited_at`
+
+// clockTime normalizes a time clock timestamp to whole seconds in UTC so stored times
+// compare correctly as text
+func clockTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// nullClockTime returns a normalized timestamp, or NULL for a zero time
+func nullClockTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return clockTime(t)
+}
+
+// ClockIn starts a shift for a user
+func ClockIn(userID int, at time.Time, notes string) (models.TimeEntry, error) {
+	entry := models.TimeEntry{UserID: userID, ClockIn: clockTime(at), Notes: notes}
+
+	err := Transaction(func(tx *sql.Tx) error {
+		if _, err := openTimeEntryID(tx, userID); err == nil {
+			return ErrAlreadyClockedIn
+		} else if err != ErrNotClockedIn {
+			return err
+		}
+
+		if err := checkShiftOverlap(tx, entry); err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(
+			"INSERT INTO time_entries (user_id, clock_in, notes) VALUES (?, ?, ?)",
+			userID, entry.ClockIn, notes,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to clock in: %w", err)
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get time entry ID: %w", err)
+		}
+		entry.ID = int(id)
+		return publishShiftEventTx(tx, models.EventShiftStarted, entry)
+	})
+	if err != nil {
+		return models.TimeEntry{}, err
+	}
+
+	return GetTimeEntry(entry.ID)
+}
+
+// ClockOut ends a user's open shift, ending any break in progress
+func ClockOut(userID int, at time.Time) (models.TimeEntry, error) {
+	at = clockTime(at)
+
+	var entryID int
+	err := Transaction(func(tx *sql.Tx) error {
+		var err error
+		entryID, err = openTimeEntryID(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		var clockIn time.Time
+		if err := tx.QueryRow("SELECT clock_in FROM time_entries WHERE id = ?", entryID).Scan(&clockIn); err != nil {
+			return fmt.Errorf("failed to get time entry: %w", err)
+		}
+		if at.Before(clockIn) {
+			return fmt.Errorf("clock out time is before the clock in time %s", clockIn.Local().Format("2006-01-02 15:04"))
+		}
+
+		_, err = tx.Exec("UPDATE time_breaks SET break_end = ? WHERE entry_id = ? AND break_end IS NULL", at, entryID)
+		if err != nil {
+			return fmt.Errorf("failed to end break: %w", err)
+		}
+
+		if _, err := tx.Exec("UPDATE time_entries SET clock_out = ? WHERE id = ?", at, entryID); err != nil {
+			return fmt.Errorf("failed to clock out: %w", err)
+		}
+		return publishShiftEventTx(tx, models.EventShiftEnded, models.TimeEntry{
+			ID: entryID, UserID: userID, ClockIn: clockIn, ClockOut: at,
+		})
+	})
+	if err != nil {
+		return models.TimeEntry{}, err
+	}
+
+	return GetTimeEntry(entryID)
+}
+
+// StartBreak starts a break in a user's open shift
+func StartBreak(userID int, at time.Time) (models.TimeEntry, error) {
+	var entryID int
+	err := Transaction(func(tx *sql.Tx) error {
+		var err error
+		entryID, err = openTimeEntryID(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		var open int
+		err = tx.QueryRow("SELECT COUNT(*) FROM time_breaks WHERE entry_id = ? AND break_end IS NULL", entryID).Scan(&open)
+		if err != nil {
+			return fmt.Errorf("failed to check breaks: %w", err)
+		}
+		if open > 0 {
+			return ErrAlreadyOnBreak
+		}
+
+		_, err = tx.Exec("INSERT INTO time_breaks (entry_id, break_start) VALUES (?, ?)", entryID, clockTime(at))
+		if err != nil {
+			return fmt.Errorf("failed to start break: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return models.TimeEntry{}, err
+	}
+
+	return GetTimeEntry(entryID)
+}
+
+// EndBreak ends the break in progress in a user's open shift
+func EndBreak(userID int, at time.Time) (models.TimeEntry, error) {
+	var entryID int
+	err := Transaction(func(tx *sql.Tx) error {
+		var err error
+		entryID, err = openTimeEntryID(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(
+			"UPDATE time_breaks SET break_end = ? WHERE entry_id = ? AND break_end IS NULL",
+			clockTime(at), entryID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to end break: %w", err)
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rows == 0 {
+			return ErrNotOnBreak
+		}
+		return nil
+	})
+	if err != nil {
+		return models.TimeEntry{}, err
+	}
+
+	return GetTimeEntry(entryID)
+}
+
+// publishShiftEventTx publishes a staff member clocking in or out
+func publishShiftEventTx(tx *sql.Tx, eventType string, entry models.TimeEntry) error {
+	if err := tx.QueryRow("SELECT username FROM users WHERE id = ?", entry.UserID).Scan(&entry.Username); err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+	return PublishEventTx(tx, eventType, entry)
+}
+
+// openTimeEntryID returns the ID of a user's open shift
+func openTimeEntryID(tx *sql.Tx, userID int) (int, error) {
+	var id int
+	err := tx.QueryRow("SELECT id FROM time_entries WHERE user_id = ? AND clock_out IS NULL", userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotClockedIn
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get open shift: %w", err)
+	}
+	return id, nil
+}
+
+// checkShiftOverlap returns ErrShiftOverlap if an entry overlaps another shift of the same
+// user. An entry without a clock out time extends indefinitely.
+func checkShiftOverlap(tx *sql.Tx, entry models.TimeEntry) error {
+	var count int
+	err := tx.QueryRow(
+		`SELECT COUNT(*) FROM time_entries
+		 WHERE user_id = ? AND id != ?
+		   AND (clock_out IS NULL OR clock_out > ?)
+		   AND (? IS NULL OR clock_in < ?)`,
+		entry.UserID, entry.ID, clockTime(entry.ClockIn),
+		nullClockTime(entry.ClockOut), nullClockTime(entry.ClockOut),
+	).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check for overlapping shifts: %w", err)
+	}
+	if count > 0 {
+		return ErrShiftOverlap
+	}
+	return nil
+}
+
+// GetOpenTimeEntry retrieves a user's open shift
+func GetOpenTimeEntry(userID int) (models.TimeEntry, error) {
+	entries, err := queryTimeEntries("WHERE e.user_id = ? AND e.clock_out IS NULL", userID)
+	if err != nil {
+		return models.TimeEntry{}, err
+	}
+	if len(entries) == 0 {
+		return models.TimeEntry{}, ErrNotClockedIn
+	}
+	return entries[0], nil
+}
+
+// GetTimeEntry retrieves a time entry by ID
+func GetTimeEntry(id int) (models.TimeEntry, error) {
+	entries, err := queryTimeEntries("WHERE e.id = ?", id)
+	if err != nil {
+		return models.TimeEntry{}, err
+	}
+	if len(entries) == 0 {
+		return models.TimeEntry{}, ErrTimeEntryNotFound
+	}
+	return entries[0], nil
+}
+
+// ListTimeEntries retrieves the shifts that started from from up to, but not including,
+// to, oldest first. A zero userID lists the shifts of all users.
+func ListTimeEntries(userID int, from, to time.Time) ([]models.TimeEntry, error) {
+	if userID == 0 {
+		return queryTimeEntries("WHERE e.clock_in >= ? AND e.clock_in < ?", clockTime(from), clockTime(to))
+	}
+	return queryTimeEntries(
+		"WHERE e.user_id = ? AND e.clock_in >= ? AND e.clock_in < ?",
+		userID, clockTime(from), clockTime(to),
+	)
+}
+
+// ListOpenTimeEntries retrieves the shifts of everyone who is clocked in
+func ListOpenTimeEntries() ([]models.TimeEntry, error) {
+	return queryTimeEntries("WHERE e.clock_out IS NULL")
+}
+
+// queryTimeEntries retrieves time entries and their breaks matching a WHERE clause
+func queryTimeEntries(where string, args ...interface{}) ([]models.TimeEntry, error) {
+	rows, err := DB.Query(
+		`SELECT `+timeEntryColumns+` FROM time_entries e
+		 JOIN users u ON u.id = e.user_id `+where+`
+		 ORDER BY e.clock_in ASC, e.id ASC`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get time entries: %w", err)
+	}
+
+	var entries []models.TimeEntry
+	for rows.Next() {
+		entry, err := scanTimeEntry(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan time entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		breaks, err := getShiftBreaks(entries[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Breaks = breaks
+	}
+
+	return entries, nil
+}
+
+// scanTimeEntry scans a time entry from a row
+func scanTimeEntry(scanner interface{ Scan(...interface{}) error }) (models.TimeEntry, error) {
+	var entry models.TimeEntry
+	var clockOut, editedAt sql.NullTime
+	var notes, editedBy sql.NullString
+
+	err := scanner.Scan(
+		&entry.ID,
+		&entry.UserID,
+		&entry.Username,
+		&entry.ClockIn,
+		&clockOut,
+		&notes,
+		&editedBy,
+		&editedAt,
+	)
+	if err != nil {
+		return models.TimeEntry{}, err
+	}
+
+	entry.ClockIn = entry.ClockIn.Local()
+	if clockOut.Valid {
+		entry.ClockOut = clockOut.Time.Local()
+	}
+	if editedAt.Valid {
+		entry.EditedAt = editedAt.Time.Local()
+	}
+	entry.Notes = notes.String
+	entry.EditedBy = editedBy.String
+
+	return entry, nil
+}
+
+// getShiftBreaks retrieves the breaks of a shift, oldest first
+func getShiftBreaks(entryID int) ([]models.ShiftBreak, error) {
+	rows, err := DB.Query(
+		"SELECT id, break_start, break_end FROM time_breaks WHERE entry_id = ? ORDER BY break_start ASC",
+		entryID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get breaks: %w", err)
+	}
+	defer rows.Close()
+
+	var breaks []models.ShiftBreak
+	for rows.Next() {
+		var b models.ShiftBreak
+		var end sql.NullTime
+		if err := rows.Scan(&b.ID, &b.Start, &end); err != nil {
+			return nil, fmt.Errorf("failed to scan break: %w", err)
+		}
+		b.Start = b.Start.Local()
+		if end.Valid {
+			b.End = end.Time.Local()
+		}
+		breaks = append(breaks, b)
+	}
+
+	return breaks, rows.Err()
+}
+
+// validateTimeEntry checks that a shift ends after it starts and contains its breaks
+func validateTimeEntry(entry models.TimeEntry) error {
+	if entry.ClockIn.IsZero() {
+		return fmt.Errorf("clock in time is required")
+	}
+	if !entry.IsOpen() && !entry.ClockOut.After(entry.ClockIn) {
+		return fmt.Errorf("clock out time must be after the clock in time")
+	}
+
+	for _, b := range entry.Breaks {
+		if b.Start.Before(entry.ClockIn) || (!entry.IsOpen() && (b.End.IsZero() || b.End.After(entry.ClockOut))) {
+			return fmt.Errorf("break starting %s falls outside the shift", b.Start.Format("2006-01-02 15:04"))
+		}
+	}
+
+	return nil
+}
+
+// AddTimeEntry records a completed shift on behalf of a user, such as one they forgot to
+// clock in for. The entry is recorded as edited by the actor of the context.
+func AddTimeEntry(ctx context.Context, entry models.TimeEntry) (models.TimeEntry, error) {
+	if entry.IsOpen() {
+		return models.TimeEntry{}, fmt.Errorf("clock out time is required")
+	}
+	entry.ID = 0
+	entry.Breaks = nil
+	if err := validateTimeEntry(entry); err != nil {
+		return models.TimeEntry{}, err
+	}
+
+	err := Transaction(func(tx *sql.Tx) error {
+		if err := checkShiftOverlap(tx, entry); err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(
+			`INSERT INTO time_entries (user_id, clock_in, clock_out, notes, edited_by, edited_at)
+			 VALUES (?, ?, ?, ?, ?, ?)`,
+			entry.UserID, clockTime(entry.ClockIn), clockTime(entry.ClockOut), entry.Notes, ActorFromContext(ctx).Username, clockTime(time.Now()),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to add time entry: %w", err)
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get time entry ID: %w", err)
+		}
+		entry.ID = int(id)
+		return AuditTx(ctx, tx, ActionCreate, "time_entry", entry.ID,
+			fmt.Sprintf("Added shift %d for user %d", entry.ID, entry.UserID), nil, entry)
+	})
+	if err != nil {
+		return models.TimeEntry{}, err
+	}
+
+	return GetTimeEntry(entry.ID)
+}
+
+// UpdateTimeEntry corrects the times and notes of a shift. Breaks are kept and must
+// still fall within the shift. The entry is recorded as edited by the actor of the context.
+func UpdateTimeEntry(ctx context.Context, entry models.TimeEntry) (models.TimeEntry, error) {
+	current, err := GetTimeEntry(entry.ID)
+	if err != nil {
+		return models.TimeEntry{}, err
+	}
+	entry.UserID = current.UserID
+	entry.Breaks = current.Breaks
+
+	if err := validateTimeEntry(entry); err != nil {
+		return models.TimeEntry{}, err
+	}
+
+	err = Transaction(func(tx *sql.Tx) error {
+		if err := checkShiftOverlap(tx, entry); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(
+			`UPDATE time_entries SET clock_in = ?, clock_out = ?, notes = ?, edited_by = ?, edited_at = ?
+			 WHERE id = ?`,
+			clockTime(entry.ClockIn), nullClockTime(entry.ClockOut), entry.Notes, ActorFromContext(ctx).Username, clockTime(time.Now()), entry.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update time entry: %w", err)
+		}
+		return AuditTx(ctx, tx, ActionUpdate, "time_entry", entry.ID,
+			fmt.Sprintf("Corrected shift %d for %s", entry.ID, current.Username), current, entry)
+	})
+	if err != nil {
+		return models.TimeEntry{}, err
+	}
+
+	return GetTimeEntry(entry.ID)
+}
+
+// DeleteTimeEntry deletes a shift and its breaks
+func DeleteTimeEntry(ctx context.Context, id int) error {
+	old, err := GetTimeEntry(id)
+	if err != nil {
+		return err
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM time_breaks WHERE entry_id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete breaks: %w", err)
+		}
+
+		result, err := tx.Exec("DELETE FROM time_entries WHERE id = ?", id)
+		if err != nil {
+			return fmt.Errorf("failed to delete time entry: %w", err)
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rows == 0 {
+			return ErrTimeEntryNotFound
+		}
+		return AuditTx(ctx, tx, ActionDelete, "time_entry", id,
+			fmt.Sprintf("Deleted shift %d for %s", id, old.Username), old, nil)
+	})
+}
+
+// GetLabourSales returns, for each user with shifts starting in the period, the time they
+// worked and the sales they made in the period. Refunded sales are not counted.
+func GetLabourSales(from, to, now time.Time) ([]models.LabourSales, error) {
+	entries, err := ListTimeEntries(0, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []models.LabourSales
+	index := make(map[int]int)
+	for _, e := range entries {
+		i, ok := index[e.UserID]
+		if !ok {
+			i = len(results)
+			index[e.UserID] = i
+			results = append(results, models.LabourSales{UserID: e.UserID, Username: e.Username})
+		}
+		results[i].Worked += e.Worked(now)
+	}
+
+	rows, err := DB.Query(
+		`SELECT user_id, COUNT(*), COALESCE(SUM(total), 0)
+		 FROM sales
+		 WHERE user_id IS NOT NULL AND refunded_at IS NULL
+		   AND julianday(sale_date) >= julianday(?) AND julianday(sale_date) < julianday(?)
+		 GROUP BY user_id`,
+		clockTime(from), clockTime(to),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sales per labour hour: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID, transactions int
+		var revenue float64
+		if err := rows.Scan(&userID, &transactions, &revenue); err != nil {
+			return nil, fmt.Errorf("failed to scan labour sales: %w", err)
+		}
+		if i, ok := index[userID]; ok {
+			results[i].Transactions = transactions
+			results[i].Revenue = revenue
+		}
+	}
+
+	return results, rows.Err()
+}
@@ -0,0 +1,62 @@
+package db
+
+import "termpos/internal/models"
+
+// createTimeEntriesTable creates the tables holding staff shifts and their breaks
+func createTimeEntriesTable() error {
+	query := `
+	CREATE TABLE time_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		clock_in TIMESTAMP NOT NULL,
+		clock_out TIMESTAMP,
+		notes TEXT,
+		edited_by TEXT,
+		edited_at TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX idx_time_entries_user_clock_in ON time_entries(user_id, clock_in);
+
+	CREATE TABLE time_breaks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		entry_id INTEGER NOT NULL,
+		break_start TIMESTAMP NOT NULL,
+		break_end TIMESTAMP,
+		FOREIGN KEY (entry_id) REFERENCES time_entries(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX idx_time_breaks_entry_id ON time_breaks(entry_id);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
+
+// grantTimeClockPermissions grants the time clock permissions to the built-in roles
+// of databases whose roles were created before the time clock existed
+func grantTimeClockPermissions() error {
+	if err := syncPermissionRegistry(); err != nil {
+		return err
+	}
+
+	grants := map[models.Role][]string{
+		models.RoleManager: {models.PermissionTimeClockUse, models.PermissionTimeClockManage},
+		models.RoleCashier: {models.PermissionTimeClockUse},
+	}
+
+	for role, permissions := range grants {
+		for _, permission := range permissions {
+			_, err := DB.Exec(
+				`INSERT OR IGNORE INTO role_permissions (role_id, permission)
+				 SELECT id, ? FROM roles WHERE name = ?`,
+				permission, role,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package db
+
+import "strings"
+
+// createAPITokensTables creates the tables of agent API refresh tokens and revoked access
+// tokens, and records when each user's tokens were last revoked
+func createAPITokensTables() error {
+	query := `
+	CREATE TABLE refresh_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		family_id TEXT NOT NULL,
+		ip_address TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+	CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+
+	CREATE TABLE revoked_tokens (
+		jti TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+
+	if _, err := DB.Exec(query); err != nil {
+		return err
+	}
+
+	_, err := DB.Exec("ALTER TABLE user_security ADD COLUMN tokens_revoked_at TIMESTAMP;")
+	if err != nil && !strings.HasPrefix(err.Error(), "duplicate column name:") {
+		return err
+	}
+	return nil
+}
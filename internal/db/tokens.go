@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, every token from the same login has been revoked")
+)
+
+// CreateRefreshToken stores the hash of a new refresh token. Tokens issued by rotating a
+// refresh token share its family, so they can be revoked together.
+func CreateRefreshToken(userID int, tokenHash, familyID, ipAddress string, expiresAt time.Time) error {
+	if err := purgeExpiredTokens(); err != nil {
+		return err
+	}
+
+	_, err := DB.Exec(
+		`INSERT INTO refresh_tokens (user_id, token_hash, family_id, ip_address, created_at, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, tokenHash, familyID, ipAddress, time.Now(), expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	return nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same family and
+// returns the user it belongs to. Each refresh token can be used once: presenting a used
+// token again means it was copied, so the whole family is revoked and
+// ErrRefreshTokenReused is returned.
+func RotateRefreshToken(tokenHash, newTokenHash, ipAddress string, expiresAt time.Time) (int, error) {
+	var userID int
+	reused := false
+
+	err := Transaction(func(tx *sql.Tx) error {
+		var id int
+		var familyID string
+		var tokenExpiresAt time.Time
+		var usedAt, revokedAt sql.NullTime
+		err := tx.QueryRow(
+			`SELECT id, user_id, family_id, expires_at, used_at, revoked_at
+			 FROM refresh_tokens WHERE token_hash = ?`,
+			tokenHash,
+		).Scan(&id, &userID, &familyID, &tokenExpiresAt, &usedAt, &revokedAt)
+		if err == sql.ErrNoRows {
+			return ErrRefreshTokenInvalid
+		}
+		if err != nil {
+			return fmt.Errorf("failed to look up refresh token: %w", err)
+		}
+
+		now := time.Now()
+		if revokedAt.Valid || now.After(tokenExpiresAt) {
+			return ErrRefreshTokenInvalid
+		}
+
+		if usedAt.Valid {
+			reused = true
+			_, err := tx.Exec(
+				"UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL",
+				now, familyID,
+			)
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = ? WHERE id = ?", now, id); err != nil {
+			return fmt.Errorf("failed to use refresh token: %w", err)
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO refresh_tokens (user_id, token_hash, family_id, ip_address, created_at, expires_at)
+			 VALUES (?, ?, ?, ?, ?, ?)`,
+			userID, newTokenHash, familyID, ipAddress, now, expiresAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to store refresh token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if reused {
+		return userID, ErrRefreshTokenReused
+	}
+
+	return userID, nil
+}
+
+// RevokeRefreshToken revokes a user's refresh token and every token rotated from the same login
+func RevokeRefreshToken(userID int, tokenHash string) error {
+	_, err := DB.Exec(
+		`UPDATE refresh_tokens SET revoked_at = ?
+		 WHERE user_id = ? AND revoked_at IS NULL
+		   AND family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = ?)`,
+		time.Now(), userID, tokenHash,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeAccessToken adds an access token to the denylist until it expires
+func RevokeAccessToken(jti string, userID int, expiresAt time.Time) error {
+	_, err := DB.Exec(
+		"INSERT OR IGNORE INTO revoked_tokens (jti, user_id, expires_at, revoked_at) VALUES (?, ?, ?, ?)",
+		jti, userID, expiresAt, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to revoke access token: %w", err)
+	}
+
+	return nil
+}
+
+// IsAccessTokenRevoked reports whether an access token is on the denylist
+func IsAccessTokenRevoked(jti string) (bool, error) {
+	var count int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?", jti).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check revoked tokens: %w", err)
+	}
+	return count > 0, nil
+}
+
+// RevokeUserTokens revokes all of a user's refresh tokens and every access token issued
+// to them until now, for example when their account is deactivated. Access tokens carry
+// their issue time in whole seconds, so the revocation time is stored in whole seconds too.
+func RevokeUserTokens(userID int) error {
+	return Transaction(func(tx *sql.Tx) error {
+		now := time.Now()
+		_, err := tx.Exec(
+			"UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL",
+			now, userID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO user_security (user_id, tokens_revoked_at) VALUES (?, ?)
+			 ON CONFLICT(user_id) DO UPDATE SET tokens_revoked_at = excluded.tokens_revoked_at`,
+			userID, now.Truncate(time.Second),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to revoke access tokens: %w", err)
+		}
+		return nil
+	})
+}
+
+// purgeExpiredTokens removes refresh tokens and denylist entries that can no longer be used
+func purgeExpiredTokens() error {
+	now := time.Now()
+	if _, err := DB.Exec("DELETE FROM refresh_tokens WHERE expires_at < ?", now); err != nil {
+		return fmt.Errorf("failed to purge expired refresh tokens: %w", err)
+	}
+	if _, err := DB.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", now); err != nil {
+		return fmt.Errorf("failed to purge expired revoked tokens: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"termpos/internal/security"
+)
+
+// totpSecretField is the sensitive_data field holding a user's encrypted TOTP secret
+const totpSecretField = "totp_secret"
+
+// SaveTOTPSecret stores a new TOTP secret for a user, encrypted at rest. Two-factor
+// authentication stays disabled until EnableTwoFactor confirms the enrollment.
+func SaveTOTPSecret(userID int, secret string) error {
+	encrypted, err := security.Encrypt(secret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt sensitive data: %w", err)
+	}
+
+	return Transaction(func(tx *sql.Tx) error {
+		if _, err := storeSensitiveDataTx(tx, "user", int64(userID), totpSecretField, encrypted); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(
+			`INSERT INTO user_security (user_id, totp_enabled, totp_last_step) VALUES (?, 0, 0)
+			 ON CONFLICT(user_id) DO UPDATE SET totp_enabled = 0, totp_last_step = 0`,
+			userID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update two-factor state: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// GetTOTPSecret retrieves and decrypts a user's TOTP secret
+func GetTOTPSecret(userID int) (string, error) {
+	return GetSensitiveData("user", int64(userID), totpSecretField)
+}
+
+// EnableTwoFactor turns on two-factor authentication for a user and replaces their
+// recovery codes with the given hashes
+func EnableTwoFactor(userID int, recoveryCodeHashes []string) error {
+	return Transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`INSERT INTO user_security (user_id, totp_enabled) VALUES (?, 1)
+			 ON CONFLICT(user_id) DO UPDATE SET totp_enabled = 1`,
+			userID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to enable two-factor authentication: %w", err)
+		}
+
+		return replaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+	})
+}
+
+// ReplaceRecoveryCodes discards a user's recovery codes and stores the given hashes
+func ReplaceRecoveryCodes(userID int, recoveryCodeHashes []string) error {
+	return Transaction(func(tx *sql.Tx) error {
+		return replaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+	})
+}
+
+// replaceRecoveryCodes replaces a user's recovery codes within a transaction
+func replaceRecoveryCodes(tx *sql.Tx, userID int, hashes []string) error {
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	now := time.Now()
+	for _, hash := range hashes {
+		_, err := tx.Exec(
+			"INSERT INTO user_recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)",
+			userID, hash, now,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user and deletes their
+// TOTP secret and recovery codes
+func DisableTwoFactor(userID int) error {
+	return Transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			"UPDATE user_security SET totp_enabled = 0, totp_last_step = 0 WHERE user_id = ?",
+			userID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to disable two-factor authentication: %w", err)
+		}
+
+		if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+			return fmt.Errorf("failed to delete recovery codes: %w", err)
+		}
+
+		_, err = tx.Exec(
+			"DELETE FROM sensitive_data WHERE resource_type = 'user' AND resource_id = ? AND field_name = ?",
+			userID, totpSecretField,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to delete TOTP secret: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// UseTOTPStep records the time step of an accepted TOTP code. It returns false if the
+// step, or a later one, was already used, so each code is only accepted once.
+func UseTOTPStep(userID int, step int64) (bool, error) {
+	result, err := DB.Exec(
+		"UPDATE user_security SET totp_last_step = ? WHERE user_id = ? AND totp_last_step < ?",
+		step, userID, step,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to record TOTP use: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// UseRecoveryCode marks an unused recovery code as used. It returns false if the user
+// has no unused code with the given hash.
+func UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	result, err := DB.Exec(
+		`UPDATE user_recovery_codes SET used_at = ?
+		 WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+		time.Now(), userID, codeHash,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return rows > 0, nil
+}
+
+// CountUnusedRecoveryCodes returns the number of recovery codes a user has left
+func CountUnusedRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := DB.QueryRow(
+		"SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = ? AND used_at IS NULL",
+		userID,
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"termpos/internal/models"
+)
+
+// userSecurityColumns are the columns read by scanUserSecurity
+const userSecurityColumns = `user_id, pin_hash, failed_attempts, last_failed_at, locked_until,
+	must_change_password, password_changed_at, totp_enabled, tokens_revoked_at`
+
+// GetUserSecurity retrieves a user's PIN, failed login, password change and two-factor state.
+// Users without a stored record get an empty one.
+func GetUserSecurity(userID int) (models.UserSecurity, error) {
+	security, err := scanUserSecurity(DB.QueryRow(
+		`SELECT `+userSecurityColumns+` FROM user_security WHERE user_id = ?`,
+		userID,
+	))
+	if err == sql.ErrNoRows {
+		return models.UserSecurity{UserID: userID}, nil
+	}
+	if err != nil {
+		return models.UserSecurity{}, fmt.Errorf("failed to get user security: %w", err)
+	}
+
+	return security, nil
+}
+
+// GetAllUserSecurity retrieves the security records of all users, keyed by user ID.
+// Users without a stored record are not included.
+func GetAllUserSecurity() (map[int]models.UserSecurity, error) {
+	rows, err := DB.Query(`SELECT ` + userSecurityColumns + ` FROM user_security`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user security: %w", err)
+	}
+	defer rows.Close()
+
+	records := make(map[int]models.UserSecurity)
+	for rows.Next() {
+		security, err := scanUserSecurity(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user security: %w", err)
+		}
+		records[security.UserID] = security
+	}
+
+	return records, rows.Err()
+}
+
+// scanUserSecurity scans a user security record from a row
+func scanUserSecurity(scanner interface{ Scan(...interface{}) error }) (models.UserSecurity, error) {
+	var security models.UserSecurity
+	var pinHash sql.NullString
+	var lastFailedAt, lockedUntil, passwordChangedAt, tokensRevokedAt sql.NullTime
+
+	err := scanner.Scan(
+		&security.UserID,
+		&pinHash,
+		&security.FailedAttempts,
+		&lastFailedAt,
+		&lockedUntil,
+		&security.MustChangePassword,
+		&passwordChangedAt,
+		&security.TwoFactorEnabled,
+		&tokensRevokedAt,
+	)
+	if err != nil {
+		return models.UserSecurity{}, err
+	}
+
+	security.PINHash = pinHash.String
+	if lastFailedAt.Valid {
+		security.LastFailedAt = lastFailedAt.Time
+	}
+	if lockedUntil.Valid {
+		security.LockedUntil = lockedUntil.Time
+	}
+	if passwordChangedAt.Valid {
+		security.PasswordChangedAt = passwordChangedAt.Time
+	}
+	if tokensRevokedAt.Valid {
+		security.TokensRevokedAt = tokensRevokedAt.Time
+	}
+
+	return security, nil
+}
+
+// SetUserPIN stores the hash of a user's quick login PIN. An empty hash removes the PIN.
+func SetUserPIN(userID int, pinHash string) error {
+	var value interface{}
+	if pinHash != "" {
+		value = pinHash
+	}
+
+	_, err := DB.Exec(
+		`INSERT INTO user_security (user_id, pin_hash) VALUES (?, ?)
+		 ON CONFLICT(user_id) DO UPDATE SET pin_hash = excluded.pin_hash`,
+		userID, value,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set PIN: %w", err)
+	}
+
+	return nil
+}
+
+// RecordFailedLogin counts a failed login for a user and, once the policy's failed login
+// limit is reached, locks the account with an exponentially increasing lockout
+func RecordFailedLogin(userID int, policy models.SecuritySettings) (models.UserSecurity, error) {
+	now := time.Now()
+
+	_, err := DB.Exec(
+		`INSERT INTO user_security (user_id, failed_attempts, last_failed_at) VALUES (?, 1, ?)
+		 ON CONFLICT(user_id) DO UPDATE SET
+		   failed_attempts = user_security.failed_attempts + 1,
+		   last_failed_at = excluded.last_failed_at`,
+		userID, now,
+	)
+	if err != nil {
+		return models.UserSecurity{}, fmt.Errorf("failed to record failed login: %w", err)
+	}
+
+	security, err := GetUserSecurity(userID)
+	if err != nil {
+		return models.UserSecurity{}, err
+	}
+
+	lockout := policy.LockoutFor(security.FailedAttempts)
+	if lockout == 0 {
+		return security, nil
+	}
+
+	security.LockedUntil = now.Add(lockout)
+	_, err = DB.Exec(
+		"UPDATE user_security SET locked_until = ? WHERE user_id = ?",
+		security.LockedUntil, userID,
+	)
+	if err != nil {
+		return models.UserSecurity{}, fmt.Errorf("failed to lock account: %w", err)
+	}
+
+	return security, nil
+}
+
+// ResetFailedLogins clears a user's failed login count and any lockout
+func ResetFailedLogins(userID int) error {
+	_, err := DB.Exec(
+		`UPDATE user_security SET failed_attempts = 0, last_failed_at = NULL, locked_until = NULL
+		 WHERE user_id = ?`,
+		userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to reset failed logins: %w", err)
+	}
+
+	return nil
+}
+
+// SetPasswordChangeRequired sets whether a user must change their password at their next login
+func SetPasswordChangeRequired(userID int, required bool) error {
+	_, err := DB.Exec(
+		`INSERT INTO user_security (user_id, must_change_password) VALUES (?, ?)
+		 ON CONFLICT(user_id) DO UPDATE SET must_change_password = excluded.must_change_password`,
+		userID, required,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update password change requirement: %w", err)
+	}
+
+	return nil
+}
+
+// GetPasswordHistory returns the hashes of a user's previous passwords, newest first
+func GetPasswordHistory(userID, limit int) ([]string, error) {
+	rows, err := DB.Query(
+		`SELECT password_hash FROM password_history WHERE user_id = ?
+		 ORDER BY id DESC LIMIT ?`,
+		userID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get password history: %w", err)
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("failed to scan password history: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
+
+// ChangeUserPassword replaces a user's password, moving the old hash into the password
+// history and keeping at most historyLimit entries. mustChange forces the user to change
+// the password again at their next login, as after an admin reset. The failed login
+// count and any lockout are cleared.
+func ChangeUserPassword(userID int, passwordHash string, mustChange bool, historyLimit int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var oldHash string
+	err = tx.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&oldHash)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	now := time.Now()
+
+	_, err = tx.Exec(
+		"INSERT INTO password_history (user_id, password_hash, created_at) VALUES (?, ?, ?)",
+		userID, oldHash, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record password history: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`DELETE FROM password_history WHERE user_id = ? AND id NOT IN (
+		   SELECT id FROM password_history WHERE user_id = ? ORDER BY id DESC LIMIT ?)`,
+		userID, userID, historyLimit,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to prune password history: %w", err)
+	}
+
+	_, err = tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO user_security (user_id, must_change_password, password_changed_at) VALUES (?, ?, ?)
+		 ON CONFLICT(user_id) DO UPDATE SET
+		   must_change_password = excluded.must_change_password,
+		   password_changed_at = excluded.password_changed_at,
+		   failed_attempts = 0,
+		   last_failed_at = NULL,
+		   locked_until = NULL`,
+		userID, mustChange, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update user security: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+        "context"
         "database/sql"
         "errors"
         "fmt"
@@ -85,6 +86,10 @@ func GetUserByID(id int) (models.User, error) {
                 user.EmergencyContact = emergencyContact.String
         }
 
+        if err := openUserPII(&user); err != nil {
+                return models.User{}, err
+        }
+
         return user, nil
 }
 
@@ -159,6 +164,10 @@ func GetUserByUsername(username string) (models.User, error) {
                 user.EmergencyContact = emergencyContact.String
         }
 
+        if err := openUserPII(&user); err != nil {
+                return models.User{}, err
+        }
+
         return user, nil
 }
 
@@ -176,6 +185,11 @@ func GetAllUsers() ([]models.User, error) {
         }
         defer rows.Close()
 
+        return scanUsers(rows)
+}
+
+// scanUsers reads users from rows, decrypting their personal data
+func scanUsers(rows *sql.Rows) ([]models.User, error) {
         var users []models.User
         for rows.Next() {
                 var user models.User
@@ -241,15 +255,21 @@ func GetAllUsers() ([]models.User, error) {
                 users = append(users, user)
         }
 
-        if err = rows.Err(); err != nil {
+        if err := rows.Err(); err != nil {
                 return nil, err
         }
 
+        for i := range users {
+                if err := openUserPII(&users[i]); err != nil {
+                        return nil, err
+                }
+        }
+
         return users, nil
 }
 
 // CreateUser adds a new user to the database
-func CreateUser(user models.User) (int, error) {
+func CreateUser(ctx context.Context, user models.User) (int, error) {
         // Check if username already exists
         exists, err := userExists(user.Username)
         if err != nil {
@@ -259,39 +279,57 @@ func CreateUser(user models.User) (int, error) {
                 return 0, ErrUserExists
         }
 
+        // Encrypt the personal data before the transaction, the first data key may have to be stored
+        pii, err := sealPIIFields(user.Email, user.Phone, user.Address, user.EmergencyContact)
+        if err != nil {
+                return 0, err
+        }
+
         query := `
         INSERT INTO users (
                 username, password_hash, role, active, 
                 full_name, email, phone, address, hire_date, 
-                position, department, notes, emergency_contact
-        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+                position, department, notes, emergency_contact,
+                email_bidx, phone_bidx
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
         // Set default hire date to now if not specified
         if user.HireDate.IsZero() {
                 user.HireDate = time.Now()
         }
 
-        result, err := DB.Exec(
-                query, 
-                user.Username, 
-                user.PasswordHash, 
-                user.Role, 
-                user.Active,
-                user.FullName,
-                user.Email,
-                user.Phone,
-                user.Address,
-                user.HireDate,
-                user.Position,
-                user.Department,
-                user.Notes,
-                user.EmergencyContact,
-        )
-        if err != nil {
-                return 0, err
-        }
+        var id int64
+        err = Transaction(func(tx *sql.Tx) error {
+                result, err := tx.Exec(
+                        query,
+                        user.Username,
+                        user.PasswordHash,
+                        user.Role,
+                        user.Active,
+                        user.FullName,
+                        pii.email,
+                        pii.phone,
+                        pii.address,
+                        user.HireDate,
+                        user.Position,
+                        user.Department,
+                        user.Notes,
+                        pii.other,
+                        pii.emailIndex,
+                        pii.phoneIndex,
+                )
+                if err != nil {
+                        return err
+                }
+
+                id, err = result.LastInsertId()
+                if err != nil {
+                        return err
+                }
 
-        id, err := result.LastInsertId()
+                user.ID = int(id)
+                return AuditTx(ctx, tx, ActionCreate, "user", id, "Created user "+user.Username, nil, redactUserPII(user))
+        })
         if err != nil {
                 return 0, err
         }
@@ -300,68 +338,89 @@ func CreateUser(user models.User) (int, error) {
 }
 
 // UpdateUser updates user information
-func UpdateUser(user models.User) error {
+func UpdateUser(ctx context.Context, user models.User) error {
+        old, err := GetUserByID(user.ID)
+        if err != nil {
+                return err
+        }
+
+        // Encrypt the personal data before the transaction, the first data key may have to be stored
+        pii, err := sealPIIFields(user.Email, user.Phone, user.Address, user.EmergencyContact)
+        if err != nil {
+                return err
+        }
+
         query := `
         UPDATE users
         SET role = ?, active = ?, 
             full_name = ?, email = ?, phone = ?, address = ?,
             hire_date = ?, position = ?, department = ?, 
-            notes = ?, emergency_contact = ?
+            notes = ?, emergency_contact = ?,
+            email_bidx = ?, phone_bidx = ?
         WHERE id = ?`
 
-        result, err := DB.Exec(
-                query, 
-                user.Role, 
-                user.Active,
-                user.FullName,
-                user.Email,
-                user.Phone,
-                user.Address,
-                user.HireDate,
-                user.Position,
-                user.Department,
-                user.Notes,
-                user.EmergencyContact,
-                user.ID,
-        )
-        if err != nil {
-                return err
-        }
+        return Transaction(func(tx *sql.Tx) error {
+                result, err := tx.Exec(
+                        query,
+                        user.Role,
+                        user.Active,
+                        user.FullName,
+                        pii.email,
+                        pii.phone,
+                        pii.address,
+                        user.HireDate,
+                        user.Position,
+                        user.Department,
+                        user.Notes,
+                        pii.other,
+                        pii.emailIndex,
+                        pii.phoneIndex,
+                        user.ID,
+                )
+                if err != nil {
+                        return err
+                }
 
-        rowsAffected, err := result.RowsAffected()
-        if err != nil {
-                return err
-        }
+                rowsAffected, err := result.RowsAffected()
+                if err != nil {
+                        return err
+                }
 
-        if rowsAffected == 0 {
-                return ErrUserNotFound
-        }
+                if rowsAffected == 0 {
+                        return ErrUserNotFound
+                }
 
-        return nil
+                // The username, password and login times are not changed here
+                user.Username, user.CreatedAt, user.LastLoginAt = old.Username, old.CreatedAt, old.LastLoginAt
+                return AuditTx(ctx, tx, ActionUpdate, "user", user.ID, "Updated user "+user.Username, redactUserPII(old), redactUserPII(user))
+        })
 }
 
-// UpdateUserPassword updates a user's password
-func UpdateUserPassword(userID int, passwordHash string) error {
+// UpdateUserPassword updates a user's password. The audit log records the change, not
+// the password.
+func UpdateUserPassword(ctx context.Context, userID int, passwordHash string) error {
         query := `
         UPDATE users
         SET password_hash = ?
         WHERE id = ?`
 
-        result, err := DB.Exec(query, passwordHash, userID)
-        if err != nil {
-                return err
-        }
+        return Transaction(func(tx *sql.Tx) error {
+                result, err := tx.Exec(query, passwordHash, userID)
+                if err != nil {
+                        return err
+                }
 
-        rowsAffected, err := result.RowsAffected()
-        if err != nil {
-                return err
-        }
+                rowsAffected, err := result.RowsAffected()
+                if err != nil {
+                        return err
+                }
 
-        if rowsAffected == 0 {
-                return ErrUserNotFound
-        }
+                if rowsAffected == 0 {
+                        return ErrUserNotFound
+                }
 
-        return nil
+                return AuditTx(ctx, tx, ActionUserMod, "user", userID, "Changed password", nil, nil)
+        })
 }
 
 // UpdateLastLogin updates a user's last login time
@@ -389,26 +448,33 @@ func UpdateLastLogin(userID int) error {
 }
 
 // DeleteUser removes a user from the system
-func DeleteUser(userID int) error {
+func DeleteUser(ctx context.Context, userID int) error {
+        old, err := GetUserByID(userID)
+        if err != nil {
+                return err
+        }
+
         query := `
         DELETE FROM users
         WHERE id = ?`
 
-        result, err := DB.Exec(query, userID)
-        if err != nil {
-                return err
-        }
+        return Transaction(func(tx *sql.Tx) error {
+                result, err := tx.Exec(query, userID)
+                if err != nil {
+                        return err
+                }
 
-        rowsAffected, err := result.RowsAffected()
-        if err != nil {
-                return err
-        }
+                rowsAffected, err := result.RowsAffected()
+                if err != nil {
+                        return err
+                }
 
-        if rowsAffected == 0 {
-                return ErrUserNotFound
-        }
+                if rowsAffected == 0 {
+                        return ErrUserNotFound
+                }
 
-        return nil
+                return AuditTx(ctx, tx, ActionDelete, "user", userID, "Deleted user "+old.Username, redactUserPII(old), nil)
+        })
 }
 
 // userExists checks if a username is already taken
@@ -510,22 +576,29 @@ func FindUsersByFullName(name string) ([]models.User, error) {
                 return nil, err
         }
 
+        for i := range users {
+                if err := openUserPII(&users[i]); err != nil {
+                        return nil, err
+                }
+        }
+
         return users, nil
 }
 
-// GetUserByEmail retrieves a user by email address
+// GetUserByEmail retrieves a user by email address, by its blind index once email
+// addresses are encrypted
 func GetUserByEmail(email string) (models.User, error) {
         var user models.User
         query := `
         SELECT id, username, password_hash, role, created_at, last_login_at, active,
                full_name, email, phone, address, hire_date, position, department, notes, emergency_contact
         FROM users
-        WHERE email = ?`
+        WHERE email_bidx = ? OR email = ?`
 
         var lastLoginTime, hireDate sql.NullTime
         var fullName, userEmail, phone, address, position, department, notes, emergencyContact sql.NullString
         
-        err := DB.QueryRow(query, email).Scan(
+        err := DB.QueryRow(query, piiIndex("email", email), email).Scan(
                 &user.ID,
                 &user.Username,
                 &user.PasswordHash,
@@ -584,22 +657,27 @@ func GetUserByEmail(email string) (models.User, error) {
                 user.EmergencyContact = emergencyContact.String
         }
 
+        if err := openUserPII(&user); err != nil {
+                return models.User{}, err
+        }
+
         return user, nil
 }
 
-// GetUserByPhone retrieves a user by phone number
+// GetUserByPhone retrieves a user by phone number, by its blind index once phone numbers
+// are encrypted
 func GetUserByPhone(phone string) (models.User, error) {
         var user models.User
         query := `
         SELECT id, username, password_hash, role, created_at, last_login_at, active,
                full_name, email, phone, address, hire_date, position, department, notes, emergency_contact
         FROM users
-        WHERE phone = ?`
+        WHERE phone_bidx = ? OR phone = ?`
 
         var lastLoginTime, hireDate sql.NullTime
         var fullName, email, userPhone, address, position, department, notes, emergencyContact sql.NullString
         
-        err := DB.QueryRow(query, phone).Scan(
+        err := DB.QueryRow(query, piiIndex("phone", phone), phone).Scan(
                 &user.ID,
                 &user.Username,
                 &user.PasswordHash,
@@ -658,6 +736,10 @@ func GetUserByPhone(phone string) (models.User, error) {
                 user.EmergencyContact = emergencyContact.String
         }
 
+        if err := openUserPII(&user); err != nil {
+                return models.User{}, err
+        }
+
         return user, nil
 }
 
@@ -745,6 +827,12 @@ func FindUsersByDepartment(department string) ([]models.User, error) {
                 return nil, err
         }
 
+        for i := range users {
+                if err := openUserPII(&users[i]); err != nil {
+                        return nil, err
+                }
+        }
+
         return users, nil
 }
 
@@ -832,5 +920,11 @@ func FindUsersByRole(role models.Role) ([]models.User, error) {
                 return nil, err
         }
 
+        for i := range users {
+                if err := openUserPII(&users[i]); err != nil {
+                        return nil, err
+                }
+        }
+
         return users, nil
 }
\ No newline at end of file
@@ -6,9 +6,25 @@ import (
         "io"
         "os"
         "path/filepath"
+        "strings"
         "time"
+
+        "github.com/mattn/go-sqlite3"
 )
 
+// parseDBTime parses a timestamp string as stored by the SQLite driver.
+// Aggregates such as MAX(sale_date) lose the column type, so they come back as text.
+func parseDBTime(value string) (time.Time, error) {
+        // Mirror the driver, which strips a trailing UTC designator before parsing
+        value = strings.TrimSuffix(value, "Z")
+        for _, layout := range sqlite3.SQLiteTimestampFormats {
+                if t, err := time.ParseInLocation(layout, value, time.UTC); err == nil {
+                        return t, nil
+                }
+        }
+        return time.Time{}, fmt.Errorf("unrecognised timestamp format: %s", value)
+}
+
 // writeJSONToFile writes a JSON-serializable object to a file
 func writeJSONToFile(data interface{}, filePath string) error {
         // Create the output directory if it doesn't exist
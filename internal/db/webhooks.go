@@ -0,0 +1,341 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"termpos/internal/models"
+)
+
+var (
+	ErrWebhookNotFound         = errors.New("webhook not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrDeliveryPending         = errors.New("webhook delivery is still pending")
+)
+
+// webhookDeliveryColumns are the columns read by scanWebhookDelivery
+const webhookDeliveryColumns = `d.id, d.webhook_id, w.url, d.event, d.payload, d.status, d.attempts,
+	d.next_attempt_at, d.last_error, d.last_status, d.created_at, d.delivered_at`
+
+// querier is a *sql.DB or a *sql.Tx
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// CreateWebhook stores a new webhook
+func CreateWebhook(webhook models.Webhook) (models.Webhook, error) {
+	if err := models.ValidateWebhookURL(webhook.URL); err != nil {
+		return models.Webhook{}, err
+	}
+	if len(webhook.Events) == 0 {
+		return models.Webhook{}, models.ErrNoWebhookEvents
+	}
+
+	webhook.CreatedAt = time.Now()
+	result, err := DB.Exec(
+		"INSERT INTO webhooks (url, secret, events, created_by, created_at) VALUES (?, ?, ?, ?, ?)",
+		webhook.URL, webhook.Secret, strings.Join(webhook.Events, ","), webhook.CreatedBy, webhook.CreatedAt,
+	)
+	if err != nil {
+		return models.Webhook{}, fmt.Errorf("failed to create webhook: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return models.Webhook{}, fmt.Errorf("failed to get webhook ID: %w", err)
+	}
+	webhook.ID = int(id)
+
+	return webhook, nil
+}
+
+// GetWebhook retrieves a webhook by ID
+func GetWebhook(id int) (models.Webhook, error) {
+	webhook, err := scanWebhook(DB.QueryRow("SELECT id, url, secret, events, created_by, created_at FROM webhooks WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return models.Webhook{}, ErrWebhookNotFound
+	}
+	if err != nil {
+		return models.Webhook{}, fmt.Errorf("failed to get webhook: %w", err)
+	}
+	return webhook, nil
+}
+
+// ListWebhooks returns all webhooks
+func ListWebhooks() ([]models.Webhook, error) {
+	return queryWebhooks(DB, "SELECT id, url, secret, events, created_by, created_at FROM webhooks ORDER BY id ASC")
+}
+
+// DeleteWebhook deletes a webhook and its deliveries
+func DeleteWebhook(id int) error {
+	return Transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete webhook deliveries: %w", err)
+		}
+		return execUpdate(tx, ErrWebhookNotFound, "DELETE FROM webhooks WHERE id = ?", id)
+	})
+}
+
+// EnqueueWebhookEventTx adds an event to the outbox of every webhook subscribed to it.
+// It is called by PublishEventTx in the transaction making the change the event reports,
+// so an event is sent if and only if the change is committed.
+func EnqueueWebhookEventTx(tx *sql.Tx, event string, data interface{}) error {
+	webhooks, err := queryWebhooks(tx, "SELECT id, url, secret, events, created_by, created_at FROM webhooks")
+	if err != nil {
+		return err
+	}
+
+	var subscribed []models.Webhook
+	for _, w := range webhooks {
+		if w.Subscribes(event) {
+			subscribed = append(subscribed, w)
+		}
+	}
+	if len(subscribed) == 0 {
+		return nil
+	}
+
+	eventID, err := newEventID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	payload, err := json.Marshal(models.WebhookPayload{ID: eventID, Event: event, CreatedAt: now, Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", event, err)
+	}
+
+	for _, w := range subscribed {
+		_, err := tx.Exec(
+			`INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+			 VALUES (?, ?, ?, ?, ?, ?)`,
+			w.ID, event, string(payload), models.DeliveryPending, now, now,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to queue %s event: %w", event, err)
+		}
+	}
+	return nil
+}
+
+// PublishLowStockTx publishes a stock.low event if a change of stock took a product to or
+// below its low stock alert. previousStock is the stock before the change, so the event
+// is only sent when the product becomes low on stock, not on every sale after that.
+func PublishLowStockTx(tx *sql.Tx, productID, previousStock int) error {
+	var level models.StockLevel
+	var sku sql.NullString
+	err := tx.QueryRow(
+		"SELECT id, name, sku, stock, COALESCE(low_stock_alert, 0) FROM products WHERE id = ?",
+		productID,
+	).Scan(&level.ProductID, &level.Name, &sku, &level.Stock, &level.LowStockAlert)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.ErrProductNotFound
+		}
+		return err
+	}
+	level.SKU = sku.String
+
+	if level.LowStockAlert <= 0 || level.Stock > level.LowStockAlert || previousStock <= level.LowStockAlert {
+		return nil
+	}
+	return PublishEventTx(tx, models.EventStockLow, level)
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries that are due, oldest
+// first. They are leased for the given duration, so another dispatcher does not send
+// them at the same time; a delivery whose dispatcher stops is retried after the lease.
+func ClaimWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+	err := Transaction(func(tx *sql.Tx) error {
+		now := time.Now()
+		var err error
+		deliveries, err = queryWebhookDeliveries(tx,
+			"WHERE d.status = ? AND d.next_attempt_at <= ? ORDER BY d.next_attempt_at ASC, d.id ASC LIMIT ?",
+			models.DeliveryPending, now, limit,
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range deliveries {
+			if _, err := tx.Exec("UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ?", now.Add(lease), d.ID); err != nil {
+				return fmt.Errorf("failed to claim webhook delivery: %w", err)
+			}
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+// MarkWebhookDelivered records that a delivery was accepted by its webhook
+func MarkWebhookDelivered(id, attempts, status int) error {
+	_, err := DB.Exec(
+		"UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status = ?, last_error = NULL, delivered_at = ? WHERE id = ?",
+		models.DeliveryDelivered, attempts, status, time.Now(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark webhook delivery as delivered: %w", err)
+	}
+	return nil
+}
+
+// RetryWebhookDelivery records a failed attempt and schedules the next one
+func RetryWebhookDelivery(id, attempts, status int, lastError string, next time.Time) error {
+	_, err := DB.Exec(
+		"UPDATE webhook_deliveries SET attempts = ?, last_status = ?, last_error = ?, next_attempt_at = ? WHERE id = ?",
+		attempts, nullStatus(status), lastError, next, id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to schedule webhook retry: %w", err)
+	}
+	return nil
+}
+
+// MarkWebhookDead records a failed attempt after which the delivery is given up, moving
+// it to the dead letters
+func MarkWebhookDead(id, attempts, status int, lastError string) error {
+	_, err := DB.Exec(
+		"UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status = ?, last_error = ? WHERE id = ?",
+		models.DeliveryDead, attempts, nullStatus(status), lastError, id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark webhook delivery as dead: %w", err)
+	}
+	return nil
+}
+
+// ReplayWebhookDelivery queues a dead or delivered delivery to be sent again now, with
+// the same payload and a fresh set of retries
+func ReplayWebhookDelivery(id int) error {
+	delivery, err := GetWebhookDelivery(id)
+	if err != nil {
+		return err
+	}
+	if delivery.Status == models.DeliveryPending {
+		return ErrDeliveryPending
+	}
+
+	_, err = DB.Exec(
+		"UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = ?, delivered_at = NULL WHERE id = ?",
+		models.DeliveryPending, time.Now(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to replay webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// GetWebhookDelivery retrieves a delivery by ID
+func GetWebhookDelivery(id int) (models.WebhookDelivery, error) {
+	deliveries, err := queryWebhookDeliveries(DB, "WHERE d.id = ?", id)
+	if err != nil {
+		return models.WebhookDelivery{}, err
+	}
+	if len(deliveries) == 0 {
+		return models.WebhookDelivery{}, ErrWebhookDeliveryNotFound
+	}
+	return deliveries[0], nil
+}
+
+// ListWebhookDeliveries returns the most recent deliveries, newest first. An empty
+// status lists deliveries of every status; models.DeliveryDead lists the dead letters.
+func ListWebhookDeliveries(status string, limit int) ([]models.WebhookDelivery, error) {
+	if status == "" {
+		return queryWebhookDeliveries(DB, "ORDER BY d.id DESC LIMIT ?", limit)
+	}
+	return queryWebhookDeliveries(DB, "WHERE d.status = ? ORDER BY d.id DESC LIMIT ?", status, limit)
+}
+
+// newEventID generates the ID of an event, which is the same in every delivery of it so
+// receivers can discard duplicates
+func newEventID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate event ID: %w", err)
+	}
+	return "evt_" + hex.EncodeToString(b), nil
+}
+
+// nullStatus stores a missing HTTP status, when the webhook could not be reached, as NULL
+func nullStatus(status int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(status), Valid: status != 0}
+}
+
+// queryWebhooks runs a query returning webhooks
+func queryWebhooks(q querier, query string, args ...interface{}) ([]models.Webhook, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []models.Webhook
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// queryWebhookDeliveries returns the deliveries matching a WHERE, ORDER BY and LIMIT clause
+func queryWebhookDeliveries(q querier, clause string, args ...interface{}) ([]models.WebhookDelivery, error) {
+	rows, err := q.Query(
+		"SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id "+clause,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []models.WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// scanWebhook scans a webhook from a row
+func scanWebhook(scanner interface{ Scan(...interface{}) error }) (models.Webhook, error) {
+	var webhook models.Webhook
+	var events string
+	err := scanner.Scan(&webhook.ID, &webhook.URL, &webhook.Secret, &events, &webhook.CreatedBy, &webhook.CreatedAt)
+	if err != nil {
+		return models.Webhook{}, err
+	}
+	webhook.Events = strings.Split(events, ",")
+	return webhook, nil
+}
+
+// scanWebhookDelivery scans a webhook delivery from a row
+func scanWebhookDelivery(scanner interface{ Scan(...interface{}) error }) (models.WebhookDelivery, error) {
+	var d models.WebhookDelivery
+	var lastError sql.NullString
+	var lastStatus sql.NullInt64
+	var deliveredAt sql.NullTime
+
+	err := scanner.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &lastError, &lastStatus, &d.CreatedAt, &deliveredAt)
+	if err != nil {
+		return models.WebhookDelivery{}, err
+	}
+
+	d.LastError = lastError.String
+	d.LastStatus = int(lastStatus.Int64)
+	d.DeliveredAt = deliveredAt.Time
+	return d, nil
+}
@@ -0,0 +1,165 @@
+// Package events streams the events published to the event log to live subscribers of
+// the agent server, such as kitchen displays and dashboards.
+package events
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// subscriberBuffer is how many events a subscriber can fall behind by before it is
+// dropped. A dropped subscriber reconnects and resumes from its last event.
+const subscriberBuffer = 256
+
+// Bus fans the events published to the event log out to subscribers. Events are
+// published by the CLI and the agent server alike, in the transaction making the change,
+// so the bus follows the log rather than being told about events directly: that way it
+// sees changes made by every process, and never an event whose change was rolled back.
+type Bus struct {
+	Interval  time.Duration // How often the event log is checked for new events
+	Heartbeat time.Duration // How often idle streams are sent a keepalive
+	Retention time.Duration // How long events are kept for subscribers to resume from
+
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+	lastID      int64
+}
+
+// NewBus returns a bus with the default settings
+func NewBus() *Bus {
+	return &Bus{
+		Interval:    250 * time.Millisecond,
+		Heartbeat:   15 * time.Second,
+		Retention:   7 * 24 * time.Hour,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription receives the events published after it was made
+type Subscription struct {
+	bus    *Bus
+	events chan models.Event
+	once   sync.Once
+}
+
+// Events returns the channel of events. It is closed when the subscription is closed,
+// or when the subscriber falls too far behind.
+func (s *Subscription) Events() <-chan models.Event {
+	return s.events
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.close()
+}
+
+// close closes the channel, with the bus locked
+func (s *Subscription) close() {
+	s.once.Do(func() {
+		delete(s.bus.subscribers, s)
+		close(s.events)
+	})
+}
+
+// Subscribe returns a subscription to the events published from now on
+func (b *Bus) Subscribe() *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &Subscription{bus: b, events: make(chan models.Event, subscriberBuffer)}
+	b.subscribers[s] = struct{}{}
+	return s
+}
+
+// Start makes the bus follow the event log from its current end
+func (b *Bus) Start() error {
+	id, err := db.LatestEventID()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.lastID = id
+	b.mu.Unlock()
+	return nil
+}
+
+// Run sends new events to subscribers until the context is cancelled, and purges events
+// older than the retention once an hour
+func (b *Bus) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.Interval)
+	defer ticker.Stop()
+	var lastPurge time.Time
+
+	for {
+		if err := b.Poll(); err != nil {
+			fmt.Fprintf(os.Stderr, "events: %v\n", err)
+		}
+
+		if time.Since(lastPurge) > time.Hour {
+			if _, err := db.PurgeEvents(time.Now().Add(-b.Retention)); err != nil {
+				fmt.Fprintf(os.Stderr, "events: %v\n", err)
+			}
+			lastPurge = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			b.closeAll()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll sends the events published since the last poll to subscribers
+func (b *Bus) Poll() error {
+	b.mu.Lock()
+	after := b.lastID
+	b.mu.Unlock()
+
+	for {
+		events, err := db.EventsAfter(after, subscriberBuffer)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		b.mu.Lock()
+		for _, e := range events {
+			for s := range b.subscribers {
+				select {
+				case s.events <- e:
+				default:
+					s.close()
+				}
+			}
+			b.lastID = e.ID
+		}
+		b.mu.Unlock()
+
+		after = events[len(events)-1].ID
+		if len(events) < subscriberBuffer {
+			return nil
+		}
+	}
+}
+
+// closeAll ends every subscription
+func (b *Bus) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		s.close()
+	}
+}
@@ -0,0 +1,173 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"termpos/internal/auth"
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+const (
+	// LastEventIDHeader is sent by clients reconnecting to the stream, with the ID of the
+	// last event they received
+	LastEventIDHeader = "Last-Event-ID"
+
+	// retryMillis tells clients how long to wait before reconnecting
+	retryMillis = 3000
+)
+
+// ServeSSE streams events to the user of the request as server-sent events. The user
+// only receives the events their permissions allow, optionally limited to the
+// comma-separated event types of the types parameter. A client that reconnects with a
+// Last-Event-ID header, or a last_event_id parameter, first receives the events it
+// missed. Comments are sent as heartbeats to keep idle connections open.
+func (b *Bus) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	types, err := parseTypes(r.URL.Query().Get("types"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, t := range types {
+		if !auth.HasPermission(user, models.EventPermission(t)) {
+			http.Error(w, fmt.Sprintf("Unauthorized: %s events need the %s permission", t, models.EventPermission(t)), http.StatusForbidden)
+			return
+		}
+	}
+
+	lastEventID := r.Header.Get(LastEventIDHeader)
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var last int64
+	if lastEventID != "" {
+		if last, err = strconv.ParseInt(lastEventID, 10, 64); err != nil || last < 0 {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before catching up, so no event falls between the two
+	sub := b.Subscribe()
+	defer sub.Close()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", retryMillis)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	allowed := permitted(user, types)
+	send := func(e models.Event) error {
+		if e.ID <= last {
+			return nil
+		}
+		last = e.ID
+		if !allowed[e.Type] {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if lastEventID != "" {
+		for {
+			missed, err := db.EventsAfter(last, subscriberBuffer)
+			if err != nil {
+				return
+			}
+			for _, e := range missed {
+				if err := send(e); err != nil {
+					return
+				}
+			}
+			if len(missed) < subscriberBuffer {
+				break
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(b.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.Events():
+			if !ok {
+				// The subscriber fell behind; the client resumes from its last event
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			// Permissions may have changed since the stream started
+			allowed = permitted(user, types)
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// parseTypes parses a comma-separated list of event types
+func parseTypes(list string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !models.IsEventType(t) {
+			return nil, fmt.Errorf("unknown event type %q, expected one of %s", t, strings.Join(models.EventTypes, ", "))
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// permitted returns the event types a user may receive, of the requested types or of
+// every type if none were requested
+func permitted(user *models.User, types []string) map[string]bool {
+	if len(types) == 0 {
+		types = models.EventTypes
+	}
+
+	allowed := make(map[string]bool)
+	for _, t := range types {
+		allowed[t] = auth.HasPermission(user, models.EventPermission(t))
+	}
+	return allowed
+}
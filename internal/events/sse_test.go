@@ -0,0 +1,232 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// frame is a server-sent event, or a comment if Comment is set
+type frame struct {
+	ID      string
+	Event   string
+	Data    string
+	Comment string
+}
+
+// stream is a connection to the event feed
+type stream struct {
+	resp   *http.Response
+	reader *bufio.Reader
+}
+
+// next reads the next event or comment, skipping the retry field
+func (s *stream) next(t *testing.T) frame {
+	t.Helper()
+
+	var f frame
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read the stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "":
+			if f != (frame{}) {
+				return f
+			}
+		case strings.HasPrefix(line, ":"):
+			f.Comment = strings.TrimSpace(line[1:])
+		case strings.HasPrefix(line, "id: "):
+			f.ID = line[len("id: "):]
+		case strings.HasPrefix(line, "event: "):
+			f.Event = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			f.Data = line[len("data: "):]
+		}
+	}
+}
+
+// nextEvent reads the next event, skipping heartbeats
+func (s *stream) nextEvent(t *testing.T) frame {
+	t.Helper()
+	for {
+		if f := s.next(t); f.Comment == "" {
+			return f
+		}
+	}
+}
+
+// setupBus creates an in-memory database and serves the event feed of a bus to a user
+// who may read sales but not customers
+func setupBus(t *testing.T) (*Bus, *httptest.Server) {
+	if err := db.Initialize(":memory:"); err != nil {
+		t.Fatalf("Failed to initialize test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	bus := NewBus()
+	bus.Heartbeat = 50 * time.Millisecond
+	if err := bus.Start(); err != nil {
+		t.Fatalf("Failed to start bus: %v", err)
+	}
+
+	user := &models.User{Username: "apikey:display", Active: true, Scopes: []string{models.PermissionEventStream, "sale:read"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bus.ServeSSE(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
+	}))
+	t.Cleanup(server.Close)
+	return bus, server
+}
+
+// connect opens the event feed, failing the test if it is not a stream
+func connect(t *testing.T, server *httptest.Server, query, lastEventID string) *stream {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events"+query, nil)
+	if lastEventID != "" {
+		req.Header.Set(LastEventIDHeader, lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return &stream{resp: resp, reader: bufio.NewReader(resp.Body)}
+}
+
+// publish publishes an event as the CLI or the API would
+func publish(t *testing.T, eventType string, data interface{}) {
+	t.Helper()
+	err := db.Transaction(func(tx *sql.Tx) error {
+		return db.PublishEventTx(tx, eventType, data)
+	})
+	if err != nil {
+		t.Fatalf("Failed to publish %s: %v", eventType, err)
+	}
+}
+
+func TestStreamFiltersByPermission(t *testing.T) {
+	bus, server := setupBus(t)
+	s := connect(t, server, "", "")
+
+	publish(t, models.EventCustomerUpdated, models.Customer{ID: 1, Name: "Ada"})
+	publish(t, models.EventSaleCreated, models.Sale{ID: 7, ProductID: 1, Quantity: 2})
+	if err := bus.Poll(); err != nil {
+		t.Fatalf("Failed to poll: %v", err)
+	}
+
+	// The customer event needs customer:read, which the user does not have
+	f := s.nextEvent(t)
+	if f.Event != models.EventSaleCreated || f.ID != "2" {
+		t.Fatalf("Expected sale.created with ID 2, got %+v", f)
+	}
+	if !strings.Contains(f.Data, `"type":"sale.created"`) || !strings.Contains(f.Data, `"id":7`) {
+		t.Errorf("Unexpected event data %s", f.Data)
+	}
+
+	// Idle streams get heartbeats
+	if f := s.next(t); f.Comment != "heartbeat" {
+		t.Errorf("Expected a heartbeat, got %+v", f)
+	}
+}
+
+func TestStreamResumesFromLastEventID(t *testing.T) {
+	bus, server := setupBus(t)
+
+	for i := 1; i <= 3; i++ {
+		publish(t, models.EventSaleCreated, models.Sale{ID: i})
+	}
+	if err := bus.Poll(); err != nil {
+		t.Fatalf("Failed to poll: %v", err)
+	}
+
+	// A client that saw event 1 gets 2 and 3, then live events
+	s := connect(t, server, "", "1")
+	for _, id := range []string{"2", "3"} {
+		if f := s.nextEvent(t); f.ID != id {
+			t.Fatalf("Expected event %s, got %+v", id, f)
+		}
+	}
+
+	publish(t, models.EventRefundCreated, models.Refund{SaleID: 3})
+	if err := bus.Poll(); err != nil {
+		t.Fatalf("Failed to poll: %v", err)
+	}
+	if f := s.nextEvent(t); f.ID != "4" || f.Event != models.EventRefundCreated {
+		t.Fatalf("Expected refund.created with ID 4, got %+v", f)
+	}
+
+	// The query parameter works like the header, for clients that cannot set headers
+	s = connect(t, server, "?types=refund.created&last_event_id=0", "")
+	if f := s.nextEvent(t); f.ID != "4" {
+		t.Fatalf("Expected only the refund, got %+v", f)
+	}
+}
+
+func TestStreamRejectsInvalidRequests(t *testing.T) {
+	_, server := setupBus(t)
+
+	tests := []struct {
+		query  string
+		header string
+		status int
+	}{
+		{"?types=sale.deleted", "", http.StatusBadRequest},
+		{"?types=sale.created,customer.updated", "", http.StatusForbidden},
+		{"", "abc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/events"+tt.query, nil)
+		if tt.header != "" {
+			req.Header.Set(LastEventIDHeader, tt.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("Expected %d for %s (Last-Event-ID %q), got %d", tt.status, tt.query, tt.header, resp.StatusCode)
+		}
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	bus, _ := setupBus(t)
+	sub := bus.Subscribe()
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		publish(t, models.EventSaleCreated, models.Sale{ID: i})
+	}
+	if err := bus.Poll(); err != nil {
+		t.Fatalf("Failed to poll: %v", err)
+	}
+
+	received := 0
+	for range sub.Events() {
+		received++
+	}
+	if received != subscriberBuffer {
+		t.Errorf("Expected the subscription to close after %d events, got %d", subscriberBuffer, received)
+	}
+	if bus.lastID != int64(subscriberBuffer+1) {
+		t.Errorf("Expected the bus to reach event %d, got %d", subscriberBuffer+1, bus.lastID)
+	}
+}
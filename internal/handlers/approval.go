@@ -0,0 +1,121 @@
+package handlers
+
+import (
+        "context"
+        "database/sql"
+        "fmt"
+        "time"
+
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/models"
+)
+
+// approvalTokenPrefix identifies approval tokens
+const approvalTokenPrefix = "apv_"
+
+// SaleRestrictedActions returns the parts of a sale that need more than sale:create,
+// such as a price override or a discount above the configured limit
+func SaleRestrictedActions(sale models.Sale) ([]models.RestrictedAction, error) {
+        product, err := GetProductByID(sale.ProductID)
+        if err != nil {
+                return nil, err
+        }
+
+        settings, err := db.GetSettings()
+        if err != nil {
+                return nil, err
+        }
+
+        var actions []models.RestrictedAction
+
+        unitPrice := product.Price
+        if sale.PriceOverride > 0 && sale.PriceOverride != product.Price {
+                unitPrice = sale.PriceOverride
+                actions = append(actions, models.RestrictedAction{
+                        Permission:  models.PermissionPriceOverride,
+                        Resource:    fmt.Sprintf("product:%d:price:%.2f", product.ID, sale.PriceOverride),
+                        Description: fmt.Sprintf("price override on %s from $%.2f to $%.2f", product.Name, product.Price, sale.PriceOverride),
+                })
+        }
+
+        subtotal := unitPrice * float64(sale.Quantity)
+        if sale.DiscountAmount > 0 && subtotal > 0 {
+                percent := sale.DiscountAmount / subtotal * 100
+                if percent > settings.Security.DiscountLimit() {
+                        actions = append(actions, models.RestrictedAction{
+                                Permission:  models.PermissionDiscountOverride,
+                                Resource:    fmt.Sprintf("product:%d:quantity:%d:discount:%.2f", product.ID, sale.Quantity, sale.DiscountAmount),
+                                Description: fmt.Sprintf("discount of $%.2f (%.0f%%) on %s", sale.DiscountAmount, percent, product.Name),
+                        })
+                }
+        }
+
+        return actions, nil
+}
+
+// RefundRestrictedAction returns the restricted action for refunding a sale
+func RefundRestrictedAction(saleID int) models.RestrictedAction {
+        return models.RestrictedAction{
+                Permission:  models.PermissionRefund,
+                Resource:    fmt.Sprintf("sale:%d", saleID),
+                Description: fmt.Sprintf("refund of sale %d", saleID),
+        }
+}
+
+// RequestApproval verifies a supervisor's credentials and issues a single-use approval
+// token bound to the actions and the actor of the context, who requested it
+func RequestApproval(ctx context.Context, actions []models.RestrictedAction, supervisor, password, reason string) (string, models.Approval, error) {
+        requester := db.ActorFromContext(ctx)
+        if supervisor == requester.Username {
+                return "", models.Approval{}, fmt.Errorf("you cannot approve your own request")
+        }
+
+        if _, err := auth.VerifySupervisor(supervisor, password, actions, db.GetUserByUsername); err != nil {
+                return "", models.Approval{}, err
+        }
+
+        // The approval is given by the supervisor, from where the request was made
+        approver := requester
+        approver.Username = supervisor
+        return IssueApproval(db.WithActor(ctx, approver), actions, requester.Username, reason)
+}
+
+// IssueApproval issues a single-use approval token for requestedBy from the actor of the
+// context, an already verified supervisor. Only the hash of the token is stored.
+func IssueApproval(ctx context.Context, actions []models.RestrictedAction, requestedBy, reason string) (string, models.Approval, error) {
+        if len(actions) == 0 {
+                return "", models.Approval{}, fmt.Errorf("no actions to approve")
+        }
+
+        timeout := models.DefaultApprovalTimeoutMinutes * time.Minute
+        if settings, err := db.GetSettings(); err == nil {
+                timeout = settings.Security.ApprovalTimeout()
+        }
+
+        token, err := auth.GenerateToken(approvalTokenPrefix)
+        if err != nil {
+                return "", models.Approval{}, err
+        }
+
+        action, resource := models.ApprovalScope(actions)
+        approval, err := db.CreateApproval(ctx, auth.HashToken(token), models.Approval{
+                Action:      action,
+                Resource:    resource,
+                RequestedBy: requestedBy,
+                Reason:      reason,
+                ExpiresAt:   time.Now().Add(timeout),
+        })
+        if err != nil {
+                return "", models.Approval{}, err
+        }
+
+        return token, approval, nil
+}
+
+// useApprovalTx uses up an approval token for the given actions on behalf of the actor of
+// the context, within the transaction of the approved action
+func useApprovalTx(ctx context.Context, tx *sql.Tx, token string, actions []models.RestrictedAction) (models.Approval, error) {
+        action, resource := models.ApprovalScope(actions)
+        return db.ConsumeApprovalTx(ctx, tx, auth.HashToken(token), action, resource)
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+        "context"
         "database/sql"
         "time"
 
@@ -9,14 +10,14 @@ import (
 )
 
 // AddProduct adds a new product to the database
-func AddProduct(product models.Product) (int, error) {
+func AddProduct(ctx context.Context, product models.Product) (int, error) {
         // Validate the product
         if err := product.Validate(); err != nil {
                 return 0, err
         }
 
         // Use the enhanced database function that supports advanced inventory fields
-        return db.AddProduct(product)
+        return db.AddProduct(ctx, product)
 }
 
 // GetProductByID retrieves a product by its ID
@@ -44,9 +45,9 @@ func GetAllProductsWithDetails() ([]models.ProductWithDetails, error) {
 }
 
 // UpdateProductStock updates the stock of a product
-func UpdateProductStock(id int, quantity int) error {
+func UpdateProductStock(ctx context.Context, id int, quantity int) error {
         // Use the enhanced database function
-        return db.UpdateProductStock(id, quantity)
+        return db.UpdateProductStock(ctx, id, quantity)
 }
 
 // DecrementProductStock decreases the stock of a product by the specified quantity
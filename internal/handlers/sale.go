@@ -1,6 +1,7 @@
 package handlers
 
 import (
+        "context"
         "database/sql"
         "fmt"
         "strings"
@@ -11,14 +12,75 @@ import (
 )
 
 // RecordSale records a new sale with optional discount, tax, payment, and customer loyalty information
-func RecordSale(sale models.Sale) (int, error) {
+func RecordSale(ctx context.Context, sale models.Sale) (int, error) {
+        return RecordApprovedSale(ctx, sale, "")
+}
+
+// RecordApprovedSale records a sale whose restricted actions a supervisor approved with
+// approvalToken. The approval is used up in the transaction recording the sale, so it can
+// still be used if the sale fails. Without a token the sale is recorded unapproved.
+func RecordApprovedSale(ctx context.Context, sale models.Sale, approvalToken string) (int, error) {
         // Validate the sale
         if err := sale.Validate(); err != nil {
                 return 0, err
         }
 
+        // Only an approval used up with the sale can approve it
+        sale.ApprovedBy = ""
+        var restricted []models.RestrictedAction
+        if approvalToken != "" {
+                var err error
+                restricted, err = SaleRestrictedActions(sale)
+                if err != nil {
+                        return 0, err
+                }
+        }
+
+        // The customer details given with the sale are stored encrypted
+        customerEmail, customerPhone, err := db.SealSaleContact(sale.CustomerEmail, sale.CustomerPhone)
+        if err != nil {
+                return 0, err
+        }
+
+        // Look up customer if ID, phone, or email provided
+        var customer models.Customer
+        var customerFound bool
+        var loyaltyRate float64
+
+        if sale.CustomerID > 0 {
+                // Lookup customer by ID
+                customer, err = db.GetCustomer(sale.CustomerID)
+                if err == nil {
+                        customerFound = true
+                }
+        } else if sale.CustomerPhone != "" {
+                // Lookup customer by phone
+                customer, err = db.GetCustomerByPhone(sale.CustomerPhone)
+                if err == nil {
+                        customerFound = true
+                        sale.CustomerID = customer.ID
+                }
+        } else if sale.CustomerEmail != "" {
+                // Lookup customer by email
+                customer, err = db.GetCustomerByEmail(sale.CustomerEmail)
+                if err == nil {
+                        customerFound = true
+                        sale.CustomerID = customer.ID
+                }
+        }
+
+        if customerFound {
+                sale.CustomerName = customer.Name
+                sale.LoyaltyTier = customer.LoyaltyTier
+
+                // The tier's discount on each dollar, applied once the subtotal is known
+                if rate, err := db.CalculateLoyaltyDiscount(customer.ID, 1); err == nil {
+                        loyaltyRate = rate
+                }
+        }
+
         var id int64
-        err := db.Transaction(func(tx *sql.Tx) error {
+        err = db.Transaction(func(tx *sql.Tx) error {
                 // Get the product
                 var product models.Product
                 err := tx.QueryRow(
@@ -37,53 +99,31 @@ func RecordSale(sale models.Sale) (int, error) {
                         return models.ErrInsufficientStock
                 }
 
+                if approvalToken != "" {
+                        approval, err := useApprovalTx(ctx, tx, approvalToken, restricted)
+                        if err != nil {
+                                return err
+                        }
+                        sale.ApprovedBy = approval.ApprovedBy
+                }
+
                 // Set default payment method if not specified
                 if sale.PaymentMethod == "" {
                         sale.PaymentMethod = "cash"
                 }
                 
-                // Calculate subtotal
-                subtotal := product.Price * float64(sale.Quantity)
-                
-                // Look up customer if ID, phone, or email provided
-                var customer models.Customer
-                var customerFound bool
-                
-                if sale.CustomerID > 0 {
-                        // Lookup customer by ID
-                        customer, err = db.GetCustomer(sale.CustomerID)
-                        if err == nil {
-                                customerFound = true
-                        }
-                } else if sale.CustomerPhone != "" {
-                        // Lookup customer by phone
-                        customer, err = db.GetCustomerByPhone(sale.CustomerPhone)
-                        if err == nil {
-                                customerFound = true
-                                sale.CustomerID = customer.ID
-                        }
-                } else if sale.CustomerEmail != "" {
-                        // Lookup customer by email
-                        customer, err = db.GetCustomerByEmail(sale.CustomerEmail)
-                        if err == nil {
-                                customerFound = true
-                                sale.CustomerID = customer.ID
-                        }
+                // Use the approved price override, if any, as the unit price
+                unitPrice := product.Price
+                if sale.PriceOverride > 0 {
+                        unitPrice = sale.PriceOverride
                 }
                 
-                // If customer found, apply loyalty tier discount or reward
-                if customerFound {
-                        sale.CustomerName = customer.Name
-                        sale.LoyaltyTier = customer.LoyaltyTier
-                        
-                        // Calculate loyalty discount based on tier
-                        if sale.LoyaltyDiscount <= 0 {
-                                // Check for loyalty tier discount
-                                loyaltyDiscount, err := db.CalculateLoyaltyDiscount(customer.ID, subtotal)
-                                if err == nil && loyaltyDiscount > 0 {
-                                        sale.LoyaltyDiscount = loyaltyDiscount
-                                }
-                        }
+                // Calculate subtotal
+                subtotal := unitPrice * float64(sale.Quantity)
+                
+                // If customer found, apply loyalty tier discount
+                if customerFound && sale.LoyaltyDiscount <= 0 && loyaltyRate > 0 {
+                        sale.LoyaltyDiscount = subtotal * loyaltyRate
                 }
                 
                 // Apply discount if specified
@@ -93,6 +133,23 @@ func RecordSale(sale models.Sale) (int, error) {
                         sale.DiscountAmount = subtotal * 0.1
                 }
                 
+                // Validate and apply a loyalty reward being redeemed with this sale
+                var redemption db.RewardRedemption
+                if sale.RewardID > 0 {
+                        if !customerFound {
+                                return fmt.Errorf("a customer is required to redeem a loyalty reward")
+                        }
+                        
+                        redemption, err = db.PrepareRewardRedemption(tx, customer.ID, sale.RewardID)
+                        if err != nil {
+                                return fmt.Errorf("cannot redeem reward: %w", err)
+                        }
+                        
+                        sale.RewardName = redemption.Reward.Name
+                        sale.PointsUsed += redemption.PointsCost
+                        sale.DiscountAmount += redemption.Reward.DiscountFor(subtotal - sale.DiscountAmount)
+                }
+                
                 // Ensure discount doesn't exceed subtotal
                 if sale.DiscountAmount > subtotal {
                         sale.DiscountAmount = subtotal
@@ -113,6 +170,7 @@ func RecordSale(sale models.Sale) (int, error) {
                 
                 // Generate receipt number
                 receiptNum := fmt.Sprintf("RCP-%d-%s", time.Now().Unix(), randomString(4))
+                saleDate := time.Now()
                 
                 // Insert the sale
                 result, err := tx.Exec(
@@ -123,15 +181,21 @@ func RecordSale(sale models.Sale) (int, error) {
                                 subtotal, total, 
                                 payment_method, payment_reference,
                                 receipt_number, customer_email, customer_phone,
-                                notes, sale_date
-                        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-                        sale.ProductID, sale.Quantity, product.Price,
+                                notes, sale_date,
+                                customer_id, customer_name, loyalty_tier,
+                                points_used, reward_id, reward_name, approved_by,
+                                user_id, terminal_id
+                        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+                        sale.ProductID, sale.Quantity, unitPrice,
                         sale.DiscountAmount, sale.DiscountCode,
                         sale.TaxRate, sale.TaxAmount,
                         subtotal, total,
                         sale.PaymentMethod, sale.PaymentReference,
-                        receiptNum, sale.CustomerEmail, sale.CustomerPhone,
-                        sale.Notes, time.Now(),
+                        receiptNum, customerEmail, customerPhone,
+                        sale.Notes, saleDate,
+                        sale.CustomerID, sale.CustomerName, sale.LoyaltyTier,
+                        sale.PointsUsed, sale.RewardID, sale.RewardName, sale.ApprovedBy,
+                        sql.NullInt64{Int64: int64(sale.UserID), Valid: sale.UserID > 0}, sale.TerminalID,
                 )
                 if err != nil {
                         return err
@@ -145,52 +209,60 @@ func RecordSale(sale models.Sale) (int, error) {
 
                 // Link sale to customer if CustomerID is provided
                 if sale.CustomerID > 0 {
-                        // Get customer details to determine tier and multiplier
-                        customer, err := db.GetCustomer(sale.CustomerID)
-                        if err != nil {
+                        if !customerFound {
                                 // If customer not found, continue without loyalty features
-                                fmt.Printf("Warning: Customer ID %d not found: %v\n", sale.CustomerID, err)
+                                fmt.Printf("Warning: Customer ID %d not found\n", sale.CustomerID)
                         } else {
-                                // Set customer tier for calculations
-                                sale.LoyaltyTier = customer.LoyaltyTier
-                                sale.CustomerName = customer.Name
-                                
-                                // Apply loyalty discount if not already manually applied
-                                if sale.LoyaltyDiscount == 0 && sale.DiscountAmount == 0 {
-                                        tierDiscount := models.GetLoyaltyTierDiscount(customer.LoyaltyTier)
-                                        if tierDiscount > 0 {
-                                                sale.LoyaltyDiscount = subtotal * tierDiscount
-                                                // Update total price with loyalty discount
-                                                total -= sale.LoyaltyDiscount
+                                // Mark the reward as redeemed against this sale
+                                if sale.RewardID > 0 {
+                                        if err := db.CompleteRewardRedemption(tx, redemption, customer.ID, int(id)); err != nil {
+                                                return err
                                         }
                                 }
-                        }
-                        
-                        // Calculate points to be earned for this purchase
-                        var pointsEarned int
-                        
-                        // Try to get customer tier for points calculation
-                        if sale.LoyaltyTier != "" {
-                                // Calculate based on tier multiplier
-                                multiplier := models.GetLoyaltyTierMultiplier(sale.LoyaltyTier)
-                                pointsEarned = models.CalculatePointsForPurchase(subtotal-sale.DiscountAmount-sale.LoyaltyDiscount, multiplier)
-                        } else {
-                                // Use default multiplier
-                                pointsEarned = models.CalculatePointsForPurchase(subtotal-sale.DiscountAmount-sale.LoyaltyDiscount, 1.0)
-                        }
-                        
-                        // Link the sale to the customer and update their loyalty points
-                        // This operation has its own transaction and retry logic
-                        linkErr := db.LinkSaleToCustomer(int(id), sale.CustomerID, pointsEarned, sale.PointsUsed, sale.RewardID)
-                        if linkErr != nil {
-                                // Log the error but don't fail the entire sale
-                                fmt.Printf("Warning: Failed to link sale to customer: %v\n", linkErr)
-                                // We continue with the transaction since the sale itself succeeded
+                                
+                                // Calculate points to be earned for this purchase
+                                var pointsEarned int
+                                
+                                // Try to get customer tier for points calculation
+                                if sale.LoyaltyTier != "" {
+                                        // Calculate based on tier multiplier
+                                        multiplier := models.GetLoyaltyTierMultiplier(sale.LoyaltyTier)
+                                        pointsEarned = models.CalculatePointsForPurchase(subtotal-sale.DiscountAmount-sale.LoyaltyDiscount, multiplier)
+                                } else {
+                                        // Use default multiplier
+                                        pointsEarned = models.CalculatePointsForPurchase(subtotal-sale.DiscountAmount-sale.LoyaltyDiscount, 1.0)
+                                }
+                                
+                                // Link the sale to the customer and update their loyalty points in the same
+                                // transaction, so redeemed points are restored if any later step fails
+                                if err := db.LinkSaleToCustomerTx(ctx, tx, int(id), customer.ID, pointsEarned, sale.PointsUsed, sale.RewardID); err != nil {
+                                        return err
+                                }
                         }
                 }
 
                 // Update the product stock
-                return DecrementProductStock(tx, sale.ProductID, sale.Quantity)
+                if err := DecrementProductStock(tx, sale.ProductID, sale.Quantity); err != nil {
+                        return err
+                }
+
+                // Publish the events in the same transaction, so they are only seen
+                // if the sale is recorded
+                sale.ID = int(id)
+                sale.ProductName = product.Name
+                sale.PricePerUnit = unitPrice
+                sale.Subtotal = subtotal
+                sale.Total = total
+                sale.ReceiptNumber = receiptNum
+                sale.SaleDate = saleDate
+                description := fmt.Sprintf("Sold %d of %s on terminal %s", sale.Quantity, product.Name, sale.TerminalID)
+                if err := db.AuditApprovedTx(ctx, tx, sale.ApprovedBy, db.ActionSale, "sale", id, description, nil, db.RedactSalePII(sale)); err != nil {
+                        return err
+                }
+                if err := db.PublishEventTx(tx, models.EventSaleCreated, db.RedactSalePII(sale)); err != nil {
+                        return err
+                }
+                return db.PublishLowStockTx(tx, sale.ProductID, product.Stock)
         })
 
         if err != nil {
@@ -200,6 +272,101 @@ func RecordSale(sale models.Sale) (int, error) {
         return int(id), nil
 }
 
+// TerminalID returns the ID of this terminal, which is recorded on every sale made here
+func TerminalID() string {
+        settings, err := db.GetSettings()
+        if err != nil {
+                return models.SystemSettings{}.Terminal()
+        }
+        return settings.System.Terminal()
+}
+
+// AttributeSale records the user making a sale and, unless the sale already names one,
+// the terminal it is made on
+func AttributeSale(sale *models.Sale, userID int) {
+        sale.UserID = userID
+        if sale.TerminalID == "" {
+                sale.TerminalID = TerminalID()
+        }
+}
+
+// RefundSale refunds a sale made by the actor of the context, returning its stock to
+// inventory and reversing any loyalty points. approvalToken is a supervisor's approval of
+// the refund, if the user needs one, and is used up in the refund's transaction.
+func RefundSale(ctx context.Context, saleID int, approvalToken, reason string) error {
+        username := db.ActorFromContext(ctx).Username
+        err := db.Transaction(func(tx *sql.Tx) error {
+                var productID, quantity int
+                var total float64
+                var refundedAt sql.NullTime
+                err := tx.QueryRow(
+                        "SELECT product_id, quantity, total, refunded_at FROM sales WHERE id = ?",
+                        saleID,
+                ).Scan(&productID, &quantity, &total, &refundedAt)
+                if err != nil {
+                        if err == sql.ErrNoRows {
+                                return fmt.Errorf("sale not found: %d", saleID)
+                        }
+                        return err
+                }
+
+                if refundedAt.Valid {
+                        return fmt.Errorf("sale %d was already refunded on %s", saleID, refundedAt.Time.Format("2006-01-02 15:04"))
+                }
+
+                var approvedBy string
+                if approvalToken != "" {
+                        approval, err := useApprovalTx(ctx, tx, approvalToken, []models.RestrictedAction{RefundRestrictedAction(saleID)})
+                        if err != nil {
+                                return err
+                        }
+                        approvedBy = approval.ApprovedBy
+                }
+
+                now := time.Now()
+                _, err = tx.Exec(
+                        "UPDATE sales SET refunded_at = ?, refunded_by = ?, refund_reason = ? WHERE id = ?",
+                        now, username, reason, saleID,
+                )
+                if err != nil {
+                        return fmt.Errorf("failed to mark sale as refunded: %w", err)
+                }
+
+                // Return the items to stock
+                if _, err := tx.Exec("UPDATE products SET stock = stock + ?, updated_at = ? WHERE id = ?", quantity, now, productID); err != nil {
+                        return fmt.Errorf("failed to restore stock: %w", err)
+                }
+
+                if err := db.ReverseCustomerSaleTx(ctx, tx, saleID); err != nil {
+                        return err
+                }
+
+                refund := models.Refund{
+                        SaleID:     saleID,
+                        ProductID:  productID,
+                        Quantity:   quantity,
+                        Total:      total,
+                        Reason:     reason,
+                        RefundedBy: username,
+                        ApprovedBy: approvedBy,
+                        RefundedAt: now,
+                }
+                description := fmt.Sprintf("Refunded sale %d", saleID)
+                if reason != "" {
+                        description += ": " + reason
+                }
+                if err := db.AuditApprovedTx(ctx, tx, approvedBy, db.ActionRefund, "sales", saleID, description, nil, refund); err != nil {
+                        return err
+                }
+                return db.PublishEventTx(tx, models.EventRefundCreated, refund)
+        })
+        if err != nil {
+                return fmt.Errorf("failed to refund sale: %w", err)
+        }
+
+        return nil
+}
+
 // Generate a random string for receipt numbers
 func randomString(length int) string {
         const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
@@ -272,9 +439,12 @@ func GenerateReceipt(saleID int) (string, error) {
                         s.points_used,
                         s.loyalty_tier,
                         s.reward_id,
-                        s.reward_name
+                        s.reward_name,
+                        COALESCE(u.username, ''),
+                        COALESCE(s.terminal_id, '')
                 FROM sales s
                 JOIN products p ON s.product_id = p.id
+                LEFT JOIN users u ON s.user_id = u.id
                 WHERE s.id = ?
         `
         
@@ -304,6 +474,8 @@ func GenerateReceipt(saleID int) (string, error) {
                 &loyaltyTier,
                 &rewardID,
                 &rewardName,
+                &sale.Username,
+                &sale.TerminalID,
         )
         
         if err != nil {
@@ -329,6 +501,9 @@ func GenerateReceipt(saleID int) (string, error) {
         if custPhone.Valid {
                 sale.CustomerPhone = custPhone.String
         }
+        if err := db.OpenSaleContact(&sale); err != nil {
+                return "", err
+        }
         
         // Transfer loyalty program values
         if customerID.Valid {
@@ -364,6 +539,12 @@ func GenerateReceipt(saleID int) (string, error) {
         sb.WriteString("===========================================\n")
         sb.WriteString(fmt.Sprintf("Receipt Number: %s\n", sale.ReceiptNumber))
         sb.WriteString(fmt.Sprintf("Date: %s\n", sale.SaleDate.Format("2006-01-02 15:04:05")))
+        if sale.Username != "" {
+                sb.WriteString(fmt.Sprintf("Served by: %s\n", sale.Username))
+        }
+        if sale.TerminalID != "" {
+                sb.WriteString(fmt.Sprintf("Terminal: %s\n", sale.TerminalID))
+        }
         sb.WriteString("-------------------------------------------\n")
         
         // Item details
@@ -480,9 +661,13 @@ func GetAllSales() ([]models.Sale, error) {
                         s.customer_email,
                         s.customer_phone,
                         s.notes,
-                        s.sale_date
+                        s.sale_date,
+                        COALESCE(s.user_id, 0),
+                        COALESCE(u.username, ''),
+                        COALESCE(s.terminal_id, '')
                 FROM sales s
                 JOIN products p ON s.product_id = p.id
+                LEFT JOIN users u ON s.user_id = u.id
                 ORDER BY s.sale_date DESC
         `
 
@@ -517,6 +702,9 @@ func GetAllSales() ([]models.Sale, error) {
                         &custPhone,
                         &notes,
                         &sale.SaleDate,
+                        &sale.UserID,
+                        &sale.Username,
+                        &sale.TerminalID,
                 )
                 if err != nil {
                         return nil, fmt.Errorf("failed to scan sale: %w", err)
@@ -548,6 +736,13 @@ func GetAllSales() ([]models.Sale, error) {
         if err := rows.Err(); err != nil {
                 return nil, fmt.Errorf("error iterating sales: %w", err)
         }
+        rows.Close()
+
+        for i := range sales {
+                if err := db.OpenSaleContact(&sales[i]); err != nil {
+                        return nil, err
+                }
+        }
 
         return sales, nil
 }
@@ -0,0 +1,312 @@
+package handlers
+
+import (
+        "bytes"
+        "context"
+        "encoding/base64"
+        "errors"
+        "strings"
+        "testing"
+        "time"
+
+        "termpos/internal/db"
+        "termpos/internal/models"
+        "termpos/internal/security"
+)
+
+// setupTestDB creates an in-memory database for the test
+func setupTestDB(t *testing.T) {
+        if err := db.Initialize(":memory:"); err != nil {
+                t.Fatalf("Failed to initialize test database: %v", err)
+        }
+        t.Cleanup(func() { db.Close() })
+}
+
+// setTestEncryptionKey configures a master key for the test, so personal data is encrypted
+func setTestEncryptionKey(t *testing.T) {
+        // Registered first so it runs after the environment is restored
+        t.Cleanup(func() { security.InitEncryption() })
+        t.Setenv("POS_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+        t.Setenv("POS_ENCRYPTION_KEY_FILE", "")
+        if err := security.InitEncryption(); err != nil {
+                t.Fatalf("InitEncryption failed: %v", err)
+        }
+}
+
+// TestApprovalUsedWithAction tests that an approval is only used up by a sale or refund
+// that is recorded
+func TestApprovalUsedWithAction(t *testing.T) {
+        setupTestDB(t)
+
+        manager := db.WithActor(context.Background(), db.Actor{Username: "manager", Source: db.SourceCLI})
+        cashier := db.WithActor(context.Background(), db.Actor{Username: "cashier", Source: db.SourceCLI})
+        unused := func() int {
+                var count int
+                if err := db.DB.QueryRow("SELECT COUNT(*) FROM approvals WHERE used_at IS NULL").Scan(&count); err != nil {
+                        t.Fatalf("Failed to count approvals: %v", err)
+                }
+                return count
+        }
+
+        productID, err := AddProduct(manager, models.Product{Name: "Coffee", Price: 10, Stock: 2})
+        if err != nil {
+                t.Fatalf("AddProduct failed: %v", err)
+        }
+
+        sale := models.Sale{ProductID: productID, Quantity: 3, PriceOverride: 8, ApprovedBy: "someone"}
+        actions, err := SaleRestrictedActions(sale)
+        if err != nil || len(actions) != 1 {
+                t.Fatalf("Expected a price override to approve, got %+v (%v)", actions, err)
+        }
+        token, _, err := IssueApproval(manager, actions, "cashier", "regular customer")
+        if err != nil {
+                t.Fatalf("IssueApproval failed: %v", err)
+        }
+
+        // A sale that fails keeps the approval for the next attempt
+        if _, err := RecordApprovedSale(cashier, sale, token); !errors.Is(err, models.ErrInsufficientStock) {
+                t.Fatalf("Expected ErrInsufficientStock, got %v", err)
+        }
+        if got := unused(); got != 1 {
+                t.Fatalf("Expected the approval unused after a failed sale, got %d unused", got)
+        }
+
+        sale.Quantity = 2
+        saleID, err := RecordApprovedSale(cashier, sale, token)
+        if err != nil {
+                t.Fatalf("RecordApprovedSale failed: %v", err)
+        }
+        recorded, err := db.GetSale(saleID)
+        if err != nil || recorded.ApprovedBy != "manager" || recorded.PricePerUnit != 8 {
+                t.Errorf("Expected the sale at $8 approved by manager, got %+v (%v)", recorded, err)
+        }
+
+        // A sale without an approval is not approved, whatever it claims
+        sale.PriceOverride, sale.Quantity = 0, 1
+        if _, err := RecordSale(cashier, sale); !errors.Is(err, models.ErrInsufficientStock) {
+                t.Fatalf("Expected ErrInsufficientStock, got %v", err)
+        }
+
+        refund := []models.RestrictedAction{RefundRestrictedAction(saleID)}
+        refundToken, _, err := IssueApproval(manager, refund, "cashier", "")
+        if err != nil {
+                t.Fatalf("IssueApproval failed: %v", err)
+        }
+        if err := RefundSale(cashier, saleID, refundToken, "damaged"); err != nil {
+                t.Fatalf("RefundSale failed: %v", err)
+        }
+
+        // A refund that fails keeps its approval too
+        retryToken, _, err := IssueApproval(manager, refund, "cashier", "")
+        if err != nil {
+                t.Fatalf("IssueApproval failed: %v", err)
+        }
+        if err := RefundSale(cashier, saleID, retryToken, ""); err == nil {
+                t.Fatal("Expected an error refunding a sale twice")
+        }
+        if got := unused(); got != 1 {
+                t.Errorf("Expected the approval unused after a failed refund, got %d unused", got)
+        }
+
+        // The stock is back, but the used approval cannot approve another sale
+        sale.PriceOverride, sale.Quantity = 8, 2
+        if _, err := RecordApprovedSale(cashier, sale, token); !errors.Is(err, db.ErrApprovalInvalid) {
+                t.Errorf("Expected ErrApprovalInvalid reusing an approval, got %v", err)
+        }
+
+        // Only the approvals used by the recorded sale and refund are audited as used
+        logs, err := db.GetAuditLogs("cashier", db.ActionApproval, "approvals", "", "", 0, 0)
+        if err != nil || len(logs) != 2 {
+                t.Errorf("Expected 2 approvals audited as used, got %d (%v)", len(logs), err)
+        }
+}
+
+// TestSaleContactEncrypted tests that the customer details given with a sale are stored
+// encrypted and not copied into the audit log or events
+func TestSaleContactEncrypted(t *testing.T) {
+        setupTestDB(t)
+        setTestEncryptionKey(t)
+
+        ctx := db.WithActor(context.Background(), db.Actor{Username: "cashier", Source: db.SourceCLI})
+        productID, err := AddProduct(ctx, models.Product{Name: "Coffee", Price: 3.50, Stock: 10})
+        if err != nil {
+                t.Fatalf("AddProduct failed: %v", err)
+        }
+
+        saleID, err := RecordSale(ctx, models.Sale{ProductID: productID, Quantity: 1, CustomerEmail: "walkin@example.com", CustomerPhone: "555-0199"})
+        if err != nil {
+                t.Fatalf("RecordSale failed: %v", err)
+        }
+
+        var email, phone string
+        if err := db.DB.QueryRow("SELECT customer_email, customer_phone FROM sales WHERE id = ?", saleID).Scan(&email, &phone); err != nil {
+                t.Fatalf("Failed to read sale: %v", err)
+        }
+        for _, value := range []string{email, phone} {
+                if security.CiphertextKeyID(value) == "" {
+                        t.Errorf("Expected the stored value to be encrypted, got %q", value)
+                }
+        }
+
+        sale, err := db.GetSale(saleID)
+        if err != nil || sale.CustomerEmail != "walkin@example.com" || sale.CustomerPhone != "555-0199" {
+                t.Errorf("Expected to decrypt the sale, got %+v (%v)", sale, err)
+        }
+        receipt, err := GenerateReceipt(saleID)
+        if err != nil || !strings.Contains(receipt, "walkin@example.com") {
+                t.Errorf("Expected the email address on the receipt, got %q (%v)", receipt, err)
+        }
+
+        for table, query := range map[string]string{
+                "audit_logs": "SELECT COALESCE(GROUP_CONCAT(COALESCE(previous_value, '') || COALESCE(new_value, ''), ''), '') FROM audit_logs WHERE resource_type = 'sale'",
+                "events":     "SELECT COALESCE(GROUP_CONCAT(data, ''), '') FROM events",
+        } {
+                var copies string
+                if err := db.DB.QueryRow(query).Scan(&copies); err != nil {
+                        t.Fatalf("Failed to read %s: %v", table, err)
+                }
+                if copies == "" || strings.Contains(copies, "walkin@example.com") || strings.Contains(copies, "555-0199") {
+                        t.Errorf("Expected the customer details redacted in %s, got %q", table, copies)
+                }
+        }
+}
+
+// TestRewardRedemptionAtCheckout tests that a loyalty reward redeemed with a sale is
+// discounted, paid for and linked to the sale together, or not at all
+func TestRewardRedemptionAtCheckout(t *testing.T) {
+        setupTestDB(t)
+
+        ctx := db.WithActor(context.Background(), db.Actor{Username: "cashier", Source: db.SourceCLI})
+        productID, err := AddProduct(ctx, models.Product{Name: "Sandwich", Price: 20, Stock: 10})
+        if err != nil {
+                t.Fatalf("AddProduct failed: %v", err)
+        }
+        customerID, err := db.AddCustomer(ctx, models.Customer{Name: "Loyal Larry", LoyaltyPoints: 250})
+        if err != nil {
+                t.Fatalf("AddCustomer failed: %v", err)
+        }
+
+        checkout := func(rewardID, quantity int) (int, error) {
+                return RecordSale(ctx, models.Sale{ProductID: productID, Quantity: quantity, CustomerID: customerID, RewardID: rewardID})
+        }
+        points := func() int {
+                customer, err := db.GetCustomer(customerID)
+                if err != nil {
+                        t.Fatalf("GetCustomer failed: %v", err)
+                }
+                return customer.LoyaltyPoints
+        }
+        count := func(query string, args ...interface{}) int {
+                var n int
+                if err := db.DB.QueryRow(query, args...).Scan(&n); err != nil {
+                        t.Fatalf("Failed to count: %v", err)
+                }
+                return n
+        }
+        // link returns the points earned and used recorded for a sale
+        link := func(saleID int) (int, int) {
+                var earned, used int
+                err := db.DB.QueryRow(
+                        "SELECT points_earned, points_used FROM customer_sales WHERE sale_id = ? AND customer_id = ?",
+                        saleID, customerID,
+                ).Scan(&earned, &used)
+                if err != nil {
+                        t.Fatalf("Expected sale %d linked to the customer: %v", saleID, err)
+                }
+                return earned, used
+        }
+
+        t.Run("RollbackOnFailedSale", func(t *testing.T) {
+                if _, err := checkout(1, 11); !errors.Is(err, models.ErrInsufficientStock) {
+                        t.Fatalf("Expected ErrInsufficientStock, got %v", err)
+                }
+                if got := points(); got != 250 {
+                        t.Errorf("Expected points to be unchanged after rollback, got %d", got)
+                }
+                if got := count("SELECT COUNT(*) FROM loyalty_redemptions"); got != 0 {
+                        t.Errorf("Expected no redemption after rollback, got %d", got)
+                }
+                if got := count("SELECT COUNT(*) FROM customer_sales"); got != 0 {
+                        t.Errorf("Expected no customer link after rollback, got %d", got)
+                }
+        })
+
+        t.Run("RedeemWithPoints", func(t *testing.T) {
+                saleID, err := checkout(1, 1)
+                if err != nil {
+                        t.Fatalf("RecordSale failed: %v", err)
+                }
+                sale, err := db.GetSale(saleID)
+                if err != nil {
+                        t.Fatalf("GetSale failed: %v", err)
+                }
+                if sale.DiscountAmount != 5 {
+                        t.Errorf("Expected $5 discount, got %.2f", sale.DiscountAmount)
+                }
+                earned, used := link(saleID)
+                if used != 100 {
+                        t.Errorf("Expected 100 points used, got %d", used)
+                }
+                if got := points(); got != 250-100+earned {
+                        t.Errorf("Expected %d points after redemption, got %d", 250-100+earned, got)
+                }
+                if got := count("SELECT COUNT(*) FROM loyalty_redemptions WHERE used_sale_id = ? AND points_used = 100", saleID); got != 1 {
+                        t.Errorf("Expected the redemption recorded against the sale, got %d", got)
+                }
+        })
+
+        t.Run("InsufficientPoints", func(t *testing.T) {
+                before := points()
+                if _, err := checkout(4, 1); err == nil {
+                        t.Errorf("Expected error redeeming a 300 point reward with %d points", before)
+                }
+                if got := points(); got != before {
+                        t.Errorf("Expected points to be unchanged, got %d", got)
+                }
+        })
+
+        t.Run("UseRedeemedVoucher", func(t *testing.T) {
+                if _, err := db.RedeemLoyaltyReward(ctx, customerID, 1); err != nil {
+                        t.Fatalf("RedeemLoyaltyReward failed: %v", err)
+                }
+                before := points()
+                saleID, err := checkout(1, 1)
+                if err != nil {
+                        t.Fatalf("RecordSale failed: %v", err)
+                }
+                earned, used := link(saleID)
+                if used != 0 {
+                        t.Errorf("Expected existing voucher to be used without charging points, got %d", used)
+                }
+                if got := points(); got != before+earned {
+                        t.Errorf("Expected %d points (voucher paid once), got %d", before+earned, got)
+                }
+                if got := count("SELECT COUNT(*) FROM loyalty_redemptions WHERE used = 0"); got != 0 {
+                        t.Errorf("Expected the voucher used, got %d unused", got)
+                }
+        })
+
+        t.Run("ExpiredVoucher", func(t *testing.T) {
+                _, err := db.DB.Exec(
+                        "INSERT INTO loyalty_redemptions (customer_id, reward_id, points_used, redeemed_at, expiry_date) VALUES (?, 3, 150, ?, ?)",
+                        customerID, time.Now().AddDate(0, 0, -30), time.Now().AddDate(0, 0, -16),
+                )
+                if err != nil {
+                        t.Fatalf("Failed to insert expired voucher: %v", err)
+                }
+                if _, err := checkout(3, 1); err == nil {
+                        t.Errorf("Expected expired voucher to be rejected")
+                }
+        })
+
+        t.Run("PercentageDiscount", func(t *testing.T) {
+                reward := models.LoyaltyReward{DiscountValue: 10, IsPercentage: true}
+                if discount := reward.DiscountFor(50); discount != 5 {
+                        t.Errorf("Expected 10%% of 50 to be 5, got %.2f", discount)
+                }
+                reward = models.LoyaltyReward{DiscountValue: 5}
+                if discount := reward.DiscountFor(3); discount != 3 {
+                        t.Errorf("Expected fixed discount to be capped at amount, got %.2f", discount)
+                }
+        })
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+        "errors"
+        "fmt"
+        "time"
+
+        "termpos/internal/auth"
+        "termpos/internal/db"
+        "termpos/internal/models"
+        "termpos/internal/security"
+)
+
+// twoFactorIssuer names the POS in authenticator apps
+const twoFactorIssuer = "TermPOS"
+
+var (
+        ErrTwoFactorAlreadyEnabled = errors.New("two-factor authentication is already enabled, disable it first to enroll again")
+        ErrTwoFactorNotEnabled     = errors.New("two-factor authentication is not enabled")
+        ErrTwoFactorNotEnrolling   = errors.New("no two-factor enrollment in progress, run 'pos user 2fa enroll' first")
+        ErrEphemeralEncryptionKey  = errors.New("POS_ENCRYPTION_KEY or POS_ENCRYPTION_KEY_FILE must be set before enrolling in two-factor authentication, otherwise the secret cannot be read after a restart")
+)
+
+// BeginTwoFactorEnrollment generates and stores a new TOTP secret for a user and returns
+// it with the otpauth URI to load into an authenticator app. Two-factor authentication is
+// not enabled until the user confirms a code with ConfirmTwoFactorEnrollment.
+func BeginTwoFactorEnrollment(user models.User) (string, string, error) {
+        if security.IsEphemeralKey() {
+                return "", "", ErrEphemeralEncryptionKey
+        }
+
+        userSecurity, err := db.GetUserSecurity(user.ID)
+        if err != nil {
+                return "", "", err
+        }
+        if userSecurity.TwoFactorEnabled {
+                return "", "", ErrTwoFactorAlreadyEnabled
+        }
+
+        secret, err := auth.GenerateTOTPSecret()
+        if err != nil {
+                return "", "", err
+        }
+
+        if err := db.SaveTOTPSecret(user.ID, secret); err != nil {
+                return "", "", fmt.Errorf("failed to store TOTP secret: %w", err)
+        }
+
+        issuer := twoFactorIssuer
+        if settings, err := db.GetSettings(); err == nil && settings.Store.Name != "" {
+                issuer = settings.Store.Name
+        }
+
+        return secret, auth.TOTPURI(issuer, user.Username, secret), nil
+}
+
+// ConfirmTwoFactorEnrollment checks a code from the user's authenticator app against
+// their pending secret, enables two-factor authentication and returns new recovery codes.
+// The recovery codes are only stored hashed, so they must be shown to the user now.
+func ConfirmTwoFactorEnrollment(userID int, code string) ([]string, error) {
+        secret, err := db.GetTOTPSecret(userID)
+        if err != nil {
+                return nil, ErrTwoFactorNotEnrolling
+        }
+
+        step, ok := auth.MatchTOTP(secret, code, time.Now())
+        if !ok {
+                return nil, auth.ErrInvalidTwoFactorCode
+        }
+
+        codes, hashes, err := newRecoveryCodes()
+        if err != nil {
+                return nil, err
+        }
+
+        if err := db.EnableTwoFactor(userID, hashes); err != nil {
+                return nil, err
+        }
+
+        // The enrollment code cannot be used again to log in
+        if _, err := db.UseTOTPStep(userID, step); err != nil {
+                return nil, err
+        }
+
+        return codes, nil
+}
+
+// VerifyTwoFactor checks a TOTP code or a recovery code for a user with two-factor
+// authentication enabled. Each TOTP code and recovery code is accepted only once.
+// It reports whether a recovery code was used.
+func VerifyTwoFactor(userID int, code string) (bool, error) {
+        if auth.IsTOTPCode(code) {
+                secret, err := db.GetTOTPSecret(userID)
+                if err != nil {
+                        return false, fmt.Errorf("failed to read TOTP secret: %w", err)
+                }
+
+                step, ok := auth.MatchTOTP(secret, code, time.Now())
+                if !ok {
+                        return false, auth.ErrInvalidTwoFactorCode
+                }
+
+                fresh, err := db.UseTOTPStep(userID, step)
+                if err != nil {
+                        return false, err
+                }
+                if !fresh {
+                        return false, auth.ErrInvalidTwoFactorCode
+                }
+                return false, nil
+        }
+
+        used, err := db.UseRecoveryCode(userID, auth.HashRecoveryCode(code))
+        if err != nil {
+                return false, err
+        }
+        if !used {
+                return false, auth.ErrInvalidTwoFactorCode
+        }
+        return true, nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes and returns the new ones
+func RegenerateRecoveryCodes(userID int) ([]string, error) {
+        userSecurity, err := db.GetUserSecurity(userID)
+        if err != nil {
+                return nil, err
+        }
+        if !userSecurity.TwoFactorEnabled {
+                return nil, ErrTwoFactorNotEnabled
+        }
+
+        codes, hashes, err := newRecoveryCodes()
+        if err != nil {
+                return nil, err
+        }
+
+        if err := db.ReplaceRecoveryCodes(userID, hashes); err != nil {
+                return nil, err
+        }
+
+        return codes, nil
+}
+
+// newRecoveryCodes generates recovery codes and their hashes for storage
+func newRecoveryCodes() ([]string, []string, error) {
+        codes, err := auth.GenerateRecoveryCodes(auth.RecoveryCodeCount)
+        if err != nil {
+                return nil, nil, err
+        }
+
+        hashes := make([]string, len(codes))
+        for i, code := range codes {
+                hashes[i] = auth.HashRecoveryCode(code)
+        }
+
+        return codes, hashes, nil
+}
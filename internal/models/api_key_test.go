@@ -0,0 +1,68 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("products:read, sales:create,product:read,report:generate")
+	if err != nil {
+		t.Fatalf("ParseScopes failed: %v", err)
+	}
+	expected := []string{"product:read", "sale:create", "report:generate"}
+	if !reflect.DeepEqual(scopes, expected) {
+		t.Errorf("Expected %v, got %v", expected, scopes)
+	}
+
+	if _, err := ParseScopes("products:steal"); err == nil {
+		t.Error("Expected an unknown scope to be rejected")
+	}
+	if _, err := ParseScopes(" , "); !errors.Is(err, ErrNoAPIKeyScopes) {
+		t.Errorf("Expected ErrNoAPIKeyScopes, got %v", err)
+	}
+}
+
+func TestParseKeyLifetime(t *testing.T) {
+	tests := map[string]time.Duration{
+		"90d":   90 * 24 * time.Hour,
+		"12h":   12 * time.Hour,
+		"never": 0,
+		"":      0,
+	}
+	for value, expected := range tests {
+		got, err := ParseKeyLifetime(value)
+		if err != nil || got != expected {
+			t.Errorf("ParseKeyLifetime(%q) = %s, %v, expected %s", value, got, err, expected)
+		}
+	}
+
+	for _, value := range []string{"0d", "-5d", "soon", "-1h"} {
+		if _, err := ParseKeyLifetime(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	now := time.Now()
+	key := APIKey{Name: "webshop", Scopes: []string{"product:read"}, ExpiresAt: now.Add(time.Hour)}
+
+	user := key.User()
+	if !user.HasPermission("product:read") || user.HasPermission("product:update") {
+		t.Error("Expected the key to be limited to its scopes")
+	}
+	if user.Username != "apikey:webshop" || user.ID != 0 {
+		t.Errorf("Expected requests to be attributed to apikey:webshop, got %s (%d)", user.Username, user.ID)
+	}
+
+	if !key.Valid(now) || key.Status(now.Add(2*time.Hour)) != "expired" {
+		t.Error("Expected the key to expire after an hour")
+	}
+	key.RevokedAt = now
+	if key.Valid(now) {
+		t.Error("Expected a revoked key to be invalid")
+	}
+}
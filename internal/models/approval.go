@@ -0,0 +1,44 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Permissions for actions that cashiers may only perform with supervisor approval
+const (
+	PermissionRefund           = "sale:refund"
+	PermissionPriceOverride    = "sale:price:override"
+	PermissionDiscountOverride = "sale:discount:override"
+)
+
+// RestrictedAction is a specific action that requires a permission, e.g. refunding sale 42
+type RestrictedAction struct {
+	Permission  string `json:"permission"`
+	Resource    string `json:"resource"`
+	Description string `json:"description"`
+}
+
+// Approval is a single-use supervisor approval bound to one or more restricted actions
+type Approval struct {
+	ID          int       `json:"id"`
+	Action      string    `json:"action"`
+	Resource    string    `json:"resource"`
+	RequestedBy string    `json:"requested_by"`
+	ApprovedBy  string    `json:"approved_by"`
+	Reason      string    `json:"reason,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	UsedAt      time.Time `json:"used_at,omitempty"`
+}
+
+// ApprovalScope returns the action and resource an approval for the given actions is bound to
+func ApprovalScope(actions []RestrictedAction) (string, string) {
+	permissions := make([]string, len(actions))
+	resources := make([]string, len(actions))
+	for i, a := range actions {
+		permissions[i] = a.Permission
+		resources[i] = a.Resource
+	}
+	return strings.Join(permissions, ","), strings.Join(resources, ";")
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrInvalidCommissionRate = errors.New("commission rate must be between 0 and 100 percent")
+
+// CommissionRule pays a percentage of the net sales made by staff with a role, of
+// products in a category, or both. An empty Role or a zero CategoryID matches any.
+type CommissionRule struct {
+	ID           int       `json:"id"`
+	Role         Role      `json:"role,omitempty"`
+	CategoryID   int       `json:"category_id,omitempty"`
+	CategoryName string    `json:"category_name,omitempty"` // For display
+	Rate         float64   `json:"rate"`                    // Percentage of the sale before tax
+	UpdatedBy    string    `json:"updated_by,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Validate checks if the commission rule is valid
+func (r CommissionRule) Validate() error {
+	if r.Rate < 0 || r.Rate > 100 {
+		return ErrInvalidCommissionRate
+	}
+	if r.CategoryID < 0 {
+		return ErrInvalidID
+	}
+	return nil
+}
+
+// specificity ranks how closely a rule matches: a role and category rule beats a
+// category rule, which beats a role rule, which beats a catch-all rule
+func (r CommissionRule) specificity() int {
+	score := 0
+	if r.CategoryID != 0 {
+		score += 2
+	}
+	if r.Role != "" {
+		score++
+	}
+	return score
+}
+
+// MatchCommissionRule returns the most specific rule that applies to a sale of a
+// product in categoryID by a user with role, and false if none applies
+func MatchCommissionRule(rules []CommissionRule, role Role, categoryID int) (CommissionRule, bool) {
+	var best CommissionRule
+	found := false
+	for _, r := range rules {
+		if r.Role != "" && r.Role != role {
+			continue
+		}
+		if r.CategoryID != 0 && r.CategoryID != categoryID {
+			continue
+		}
+		if !found || r.specificity() > best.specificity() {
+			best, found = r, true
+		}
+	}
+	return best, found
+}
+
+// StaffPerformance summarises the sales made by one staff member in a period. Refunded
+// sales count towards Transactions and Refunds but not towards revenue, items or commission.
+type StaffPerformance struct {
+	UserID          int     `json:"user_id"` // Zero for sales made before attribution was recorded
+	Username        string  `json:"username"`
+	Role            Role    `json:"role,omitempty"`
+	Transactions    int     `json:"transactions"`
+	Revenue         float64 `json:"revenue"`
+	Items           int     `json:"items"`
+	Refunds         int     `json:"refunds"`
+	DiscountedSales int     `json:"discounted_sales"`
+	DiscountTotal   float64 `json:"discount_total"`
+	Commission      float64 `json:"commission"`
+}
+
+// completed returns the number of sales that were not refunded
+func (p StaffPerformance) completed() int {
+	return p.Transactions - p.Refunds
+}
+
+// AverageBasket returns the average revenue of a sale that was not refunded
+func (p StaffPerformance) AverageBasket() float64 {
+	if p.completed() <= 0 {
+		return 0
+	}
+	return p.Revenue / float64(p.completed())
+}
+
+// ItemsPerTransaction returns the average number of items in a sale that was not refunded
+func (p StaffPerformance) ItemsPerTransaction() float64 {
+	if p.completed() <= 0 {
+		return 0
+	}
+	return float64(p.Items) / float64(p.completed())
+}
+
+// RefundRate returns the percentage of sales that were refunded
+func (p StaffPerformance) RefundRate() float64 {
+	if p.Transactions == 0 {
+		return 0
+	}
+	return float64(p.Refunds) / float64(p.Transactions) * 100
+}
+
+// DiscountRate returns the percentage of sales that had a discount
+func (p StaffPerformance) DiscountRate() float64 {
+	if p.Transactions == 0 {
+		return 0
+	}
+	return float64(p.DiscountedSales) / float64(p.Transactions) * 100
+}
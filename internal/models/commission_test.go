@@ -0,0 +1,48 @@
+package models
+
+import "testing"
+
+func TestMatchCommissionRule(t *testing.T) {
+	rules := []CommissionRule{
+		{ID: 1, Rate: 1},
+		{ID: 2, Role: RoleCashier, Rate: 2},
+		{ID: 3, CategoryID: 5, Rate: 3},
+		{ID: 4, Role: RoleCashier, CategoryID: 5, Rate: 4},
+	}
+
+	tests := []struct {
+		role     Role
+		category int
+		want     int
+	}{
+		{RoleCashier, 5, 4},
+		{RoleManager, 5, 3},
+		{RoleCashier, 1, 2},
+		{RoleManager, 1, 1},
+	}
+	for _, tt := range tests {
+		rule, ok := MatchCommissionRule(rules, tt.role, tt.category)
+		if !ok || rule.ID != tt.want {
+			t.Errorf("MatchCommissionRule(%s, %d) = rule %d, want rule %d", tt.role, tt.category, rule.ID, tt.want)
+		}
+	}
+
+	if _, ok := MatchCommissionRule(rules[1:2], RoleManager, 1); ok {
+		t.Error("Expected no rule to match another role")
+	}
+}
+
+func TestStaffPerformanceRates(t *testing.T) {
+	p := StaffPerformance{Transactions: 5, Refunds: 1, Revenue: 100, Items: 10, DiscountedSales: 2}
+	if p.AverageBasket() != 25 || p.ItemsPerTransaction() != 2.5 {
+		t.Errorf("Expected an average basket of 25 with 2.5 items, got %.2f and %.2f", p.AverageBasket(), p.ItemsPerTransaction())
+	}
+	if p.RefundRate() != 20 || p.DiscountRate() != 40 {
+		t.Errorf("Expected a 20%% refund rate and 40%% discount rate, got %.1f and %.1f", p.RefundRate(), p.DiscountRate())
+	}
+
+	var empty StaffPerformance
+	if empty.AverageBasket() != 0 || empty.RefundRate() != 0 {
+		t.Error("Expected zero rates without transactions")
+	}
+}
@@ -19,6 +19,18 @@ type Customer struct {
 	PreferredProducts string    `json:"preferred_products"`
 	CreatedAt         time.Time `json:"created_at"`
 	UpdatedAt         time.Time `json:"updated_at"`
+
+	// Privacy and consent fields
+	EmailConsent   bool      `json:"email_consent"`
+	EmailConsentAt time.Time `json:"email_consent_at"`
+	SMSConsent     bool      `json:"sms_consent"`
+	SMSConsentAt   time.Time `json:"sms_consent_at"`
+	AnonymizedAt   time.Time `json:"anonymized_at"`
+}
+
+// IsAnonymized reports whether the customer's personal data has been erased
+func (c Customer) IsAnonymized() bool {
+	return !c.AnonymizedAt.IsZero()
 }
 
 // CustomerSummary provides a simplified view of customer data
@@ -53,6 +65,23 @@ type LoyaltyReward struct {
 	Active        bool    `json:"active"`
 }
 
+// DiscountFor returns the discount this reward gives on an amount, never more than the amount
+func (r LoyaltyReward) DiscountFor(amount float64) float64 {
+	if amount <= 0 {
+		return 0
+	}
+
+	discount := r.DiscountValue
+	if r.IsPercentage {
+		discount = amount * r.DiscountValue / 100
+	}
+
+	if discount > amount {
+		discount = amount
+	}
+	return discount
+}
+
 // CustomerSale links a sale to a customer
 type CustomerSale struct {
 	SaleID      int       `json:"sale_id"`
@@ -63,6 +92,35 @@ type CustomerSale struct {
 	CreatedAt    time.Time `json:"created_at"`
 }
 
+// CustomerRedemption records a loyalty reward redeemed by a customer
+type CustomerRedemption struct {
+	ID         int       `json:"id"`
+	RewardID   int       `json:"reward_id"`
+	RewardName string    `json:"reward_name"`
+	PointsUsed int       `json:"points_used"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+	ExpiryDate time.Time `json:"expiry_date"`
+	Used       bool      `json:"used"`
+	UsedSaleID int       `json:"used_sale_id,omitempty"`
+}
+
+// CustomerSensitiveField is a decrypted sensitive_data entry held for a customer
+type CustomerSensitiveField struct {
+	FieldName string `json:"field_name"`
+	Value     string `json:"value"`
+}
+
+// CustomerDataExport bundles everything held about a customer for a data access request
+type CustomerDataExport struct {
+	GeneratedAt   time.Time                `json:"generated_at"`
+	GeneratedBy   string                   `json:"generated_by"`
+	Profile       Customer                 `json:"profile"`
+	Sales         []Sale                   `json:"sales"`
+	PointsHistory []CustomerSale           `json:"points_history"`
+	Redemptions   []CustomerRedemption     `json:"redemptions"`
+	SensitiveData []CustomerSensitiveField `json:"sensitive_data"`
+}
+
 // CalculatePointsForPurchase determines how many loyalty points to award for a purchase
 func CalculatePointsForPurchase(amount float64, multiplier float64) int {
 	// Base calculation: $1 = 1 point, multiplied by tier multiplier
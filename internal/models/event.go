@@ -0,0 +1,54 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PermissionEventStream allows subscribing to the live event feed of the agent server.
+// Subscribers only receive the events their other permissions let them see.
+const PermissionEventStream = "event:stream"
+
+// Shift events, sent when a staff member clocks in or out
+const (
+	EventShiftStarted = "shift.started"
+	EventShiftEnded   = "shift.ended"
+)
+
+// EventTypes lists every event, in the order they are documented
+var EventTypes = []string{EventSaleCreated, EventRefundCreated, EventStockLow, EventCustomerUpdated, EventShiftStarted, EventShiftEnded}
+
+// eventPermissions is the permission needed to receive each event
+var eventPermissions = map[string]string{
+	EventSaleCreated:     "sale:read",
+	EventRefundCreated:   "sale:read",
+	EventStockLow:        "inventory:view",
+	EventCustomerUpdated: "customer:read",
+	EventShiftStarted:    PermissionTimeClockManage,
+	EventShiftEnded:      PermissionTimeClockManage,
+}
+
+// Event is a change published to the event log, from which it is streamed to live
+// subscribers and sent to webhooks. IDs increase, so a subscriber can resume after the
+// last event it received.
+type Event struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// EventPermission returns the permission needed to receive an event. Unknown events
+// need a permission nobody has, so they are never streamed by mistake.
+func EventPermission(eventType string) string {
+	if permission, ok := eventPermissions[eventType]; ok {
+		return permission
+	}
+	return "event:" + eventType
+}
+
+// IsEventType reports whether an event type exists
+func IsEventType(eventType string) bool {
+	_, ok := eventPermissions[eventType]
+	return ok
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// PermissionDefinition describes a permission that can be granted to a role
+type PermissionDefinition struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// PermissionRegistry is the canonical list of permissions understood by the system.
+// Every permission checked by the CLI or the agent API must be listed here.
+var PermissionRegistry = []PermissionDefinition{
+	{"product:read", "View products"},
+	{"product:create", "Add products"},
+	{"product:update", "Update products"},
+	{"product:delete", "Delete products"},
+	{"product:manage", "Manage products, categories, suppliers, locations and batches"},
+	{"inventory:view", "View inventory and stock levels"},
+	{"sale:read", "View sales"},
+	{"sale:create", "Record sales"},
+	{PermissionRefund, "Refund sales"},
+	{PermissionPriceOverride, "Override product prices at checkout"},
+	{PermissionDiscountOverride, "Apply discounts above the cashier limit"},
+	{"report:generate", "Generate reports"},
+	{PermissionTimeClockUse, "Clock in and out and view own timesheet"},
+	{PermissionTimeClockManage, "Correct staff time entries and view all timesheets"},
+	{"customer:read", "View customers"},
+	{"customer:create", "Add customers"},
+	{"customer:update", "Update customers, loyalty and segments"},
+	{"customer:delete", "Delete or anonymize customers"},
+	{"customer:export", "Export customer data"},
+	{"user:read", "View users"},
+	{"user:manage", "Manage users and staff"},
+	{"role:read", "View roles and their permissions"},
+	{"role:manage", "Create roles and change their permissions"},
+	{"apikey:manage", "Create and revoke API keys for integrations"},
+	{"webhook:manage", "Add and remove webhooks and replay their deliveries"},
+	{PermissionEventStream, "Subscribe to the live event feed of the agent server"},
+	{"setting:read", "View settings"},
+	{"setting:update", "Update settings"},
+	{"setting:export", "Export settings"},
+	{"setting:import", "Import settings"},
+	{"setting:backup", "Create backups"},
+	{"setting:restore", "Restore backups"},
+	{"setting:workflow:configure", "Configure automated workflows"},
+	{"audit:view", "View audit logs"},
+	{"audit:export", "Export audit logs"},
+	{"audit:purge", "Purge audit logs"},
+	{"sensitive:read", "View sensitive data"},
+	{"sensitive:write", "Store sensitive data"},
+	{"sensitive:delete", "Delete sensitive data"},
+	{"key:manage", "View the encryption keys, rotate them and encrypt the database"},
+}
+
+// DefaultRolePermissions are the permissions granted to the built-in roles when
+// the roles table is created. The admin role always has every permission.
+var DefaultRolePermissions = map[Role][]string{
+	RoleManager: {
+		"product:read", "product:create", "product:update", "product:manage",
+		"inventory:view", "sale:read", "sale:create", "report:generate",
+		PermissionRefund, PermissionPriceOverride, PermissionDiscountOverride,
+		PermissionTimeClockUse, PermissionTimeClockManage,
+		"customer:read", "customer:create", "customer:update",
+		"user:read", "role:read",
+		"setting:read", "setting:export", "setting:backup", "setting:workflow:configure",
+		PermissionEventStream,
+	},
+	RoleCashier: {
+		"product:read", "inventory:view", "sale:read", "sale:create",
+		"customer:read", "customer:create", PermissionTimeClockUse,
+		PermissionEventStream,
+	},
+}
+
+// IsRegisteredPermission reports whether a permission exists in the registry
+func IsRegisteredPermission(permission string) bool {
+	for _, p := range PermissionRegistry {
+		if p.Name == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleDefinition is a named set of permissions that can be assigned to users
+type RoleDefinition struct {
+	ID          int       `json:"id"`
+	Name        Role      `json:"name"`
+	Description string    `json:"description"`
+	System      bool      `json:"system"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// HasPermission checks whether the role grants a permission
+func (r *RoleDefinition) HasPermission(permission string) bool {
+	if r.Name == RoleAdmin {
+		return true
+	}
+	for _, p := range r.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeRoleName converts a role name such as "Shift Lead" to "shift-lead"
+func NormalizeRoleName(name string) Role {
+	fields := strings.Fields(strings.ToLower(name))
+	return Role(strings.Join(fields, "-"))
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// permissionCalls maps functions that take a permission to the index of the permission argument
+var permissionCalls = map[string]int{
+	"RequirePermission": 0,
+	"HasPermission":     1,
+	"authMiddleware":    1,
+}
+
+// permissionCheckDirs are the packages whose permission checks must use registered permissions
+var permissionCheckDirs = []string{"../../cmd/pos", "../assistant"}
+
+// TestPermissionRegistryCoversCommands checks that every permission referenced in
+// cmd/pos and the assistant is listed in PermissionRegistry
+func TestPermissionRegistryCoversCommands(t *testing.T) {
+	// Permission constants may be referenced as auth.X or models.X
+	constants := map[string]map[string]string{
+		"auth":   parseStringConstants(t, "../auth"),
+		"models": parseStringConstants(t, "."),
+	}
+
+	fset := token.NewFileSet()
+	checked := 0
+	for _, dir := range permissionCheckDirs {
+		pkgs, err := parser.ParseDir(fset, dir, nil, 0)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", dir, err)
+		}
+		checked += checkPermissionCalls(t, fset, pkgs, constants)
+	}
+
+	if checked == 0 {
+		t.Fatal("Expected to find permission checks in cmd/pos")
+	}
+}
+
+// checkPermissionCalls reports unregistered permissions passed to permission checks
+// and returns the number of checks found
+func checkPermissionCalls(t *testing.T, fset *token.FileSet, pkgs map[string]*ast.Package, constants map[string]map[string]string) int {
+	checked := 0
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			ast.Inspect(file, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+
+				var name string
+				switch fn := call.Fun.(type) {
+				case *ast.Ident:
+					name = fn.Name
+				case *ast.SelectorExpr:
+					name = fn.Sel.Name
+				}
+
+				index, ok := permissionCalls[name]
+				if !ok || index >= len(call.Args) {
+					return true
+				}
+
+				pos := fset.Position(call.Pos())
+				switch arg := call.Args[index].(type) {
+				case *ast.BasicLit:
+					permission, err := strconv.Unquote(arg.Value)
+					if err != nil {
+						t.Errorf("%s: invalid permission literal %s", pos, arg.Value)
+						return true
+					}
+					if !IsRegisteredPermission(permission) {
+						t.Errorf("%s: permission %q is not in the registry", pos, permission)
+					}
+					checked++
+				case *ast.SelectorExpr:
+					// Only package constants can be checked; fields such as a.Permission are dynamic
+					pkgName, isIdent := arg.X.(*ast.Ident)
+					if !isIdent || constants[pkgName.Name] == nil {
+						return true
+					}
+					permission, ok := constants[pkgName.Name][arg.Sel.Name]
+					if !ok {
+						t.Errorf("%s: cannot resolve permission constant %s", pos, arg.Sel.Name)
+						return true
+					}
+					if !IsRegisteredPermission(permission) {
+						t.Errorf("%s: permission %q (%s) is not in the registry", pos, permission, arg.Sel.Name)
+					}
+					checked++
+				}
+
+				return true
+			})
+		}
+	}
+
+	return checked
+}
+
+// TestDefaultRolePermissionsRegistered checks that the built-in roles only grant registered permissions
+func TestDefaultRolePermissionsRegistered(t *testing.T) {
+	for role, permissions := range DefaultRolePermissions {
+		for _, permission := range permissions {
+			if !IsRegisteredPermission(permission) {
+				t.Errorf("Role %s grants unregistered permission %q", role, permission)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range PermissionRegistry {
+		if seen[p.Name] {
+			t.Errorf("Permission %q is registered twice", p.Name)
+		}
+		seen[p.Name] = true
+	}
+}
+
+// parseStringConstants returns the string constants declared in a package directory
+func parseStringConstants(t *testing.T, dir string) map[string]string {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, filepath.Clean(dir), nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", dir, err)
+	}
+
+	constants := make(map[string]string)
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.CONST {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					value := spec.(*ast.ValueSpec)
+					for i, name := range value.Names {
+						if i >= len(value.Values) {
+							continue
+						}
+						if lit, ok := value.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+							constants[name.Name], _ = strconv.Unquote(lit.Value)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return constants
+}
@@ -46,6 +46,23 @@ type Sale struct {
         LoyaltyTier     string    `json:"loyalty_tier,omitempty"`
         RewardID        int       `json:"reward_id,omitempty"`
         RewardName      string    `json:"reward_name,omitempty"`
+        
+        // Supervisor approval and refund fields
+        PriceOverride   float64   `json:"price_override,omitempty"` // Unit price to charge instead of the product price
+        ApprovedBy      string    `json:"approved_by,omitempty"`
+        RefundedAt      time.Time `json:"refunded_at,omitempty"`
+        RefundedBy      string    `json:"refunded_by,omitempty"`
+        RefundReason    string    `json:"refund_reason,omitempty"`
+        
+        // Staff attribution fields
+        UserID          int       `json:"user_id,omitempty"`     // Cashier who made the sale
+        Username        string    `json:"username,omitempty"`    // For reporting
+        TerminalID      string    `json:"terminal_id,omitempty"` // Terminal the sale was made on
+}
+
+// IsRefunded reports whether the sale has been refunded
+func (s *Sale) IsRefunded() bool {
+        return !s.RefundedAt.IsZero()
 }
 
 // Validate checks if the sale data is valid
@@ -56,6 +73,9 @@ func (s *Sale) Validate() error {
         if s.Quantity <= 0 {
                 return ErrInvalidQuantity
         }
+        if s.PriceOverride < 0 {
+                return ErrInvalidPrice
+        }
         return nil
 }
 
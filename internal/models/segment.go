@@ -0,0 +1,178 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CustomerRFM holds recency/frequency/monetary metrics and scores for a customer
+type CustomerRFM struct {
+	CustomerID     int       `json:"customer_id"`
+	Name           string    `json:"name"`
+	Email          string    `json:"email"`
+	Phone          string    `json:"phone"`
+	Birthday       string    `json:"birthday"`
+	EmailConsent   bool      `json:"email_consent"`
+	SMSConsent     bool      `json:"sms_consent"`
+	LastPurchase   time.Time `json:"last_purchase"`
+	RecencyDays    int       `json:"recency_days"`
+	Frequency      int       `json:"frequency"`
+	Monetary       float64   `json:"monetary"`
+	RecencyScore   int       `json:"recency_score"`
+	FrequencyScore int       `json:"frequency_score"`
+	MonetaryScore  int       `json:"monetary_score"`
+}
+
+// HasPurchases reports whether the customer has made at least one purchase
+func (r CustomerRFM) HasPurchases() bool {
+	return r.Frequency > 0
+}
+
+// Score returns the combined RFM score, e.g. "545", or "000" for customers without purchases
+func (r CustomerRFM) Score() string {
+	return fmt.Sprintf("%d%d%d", r.RecencyScore, r.FrequencyScore, r.MonetaryScore)
+}
+
+// SegmentRules defines the conditions a customer must meet to belong to a segment.
+// Zero values mean the condition is not applied. Scores range from 1 (worst) to 5 (best).
+type SegmentRules struct {
+	MinRecencyScore      int     `json:"min_recency_score,omitempty"`
+	MaxRecencyScore      int     `json:"max_recency_score,omitempty"`
+	MinFrequencyScore    int     `json:"min_frequency_score,omitempty"`
+	MaxFrequencyScore    int     `json:"max_frequency_score,omitempty"`
+	MinMonetaryScore     int     `json:"min_monetary_score,omitempty"`
+	MaxMonetaryScore     int     `json:"max_monetary_score,omitempty"`
+	MinDaysSincePurchase int     `json:"min_days_since_purchase,omitempty"`
+	MaxDaysSincePurchase int     `json:"max_days_since_purchase,omitempty"`
+	MinOrders            int     `json:"min_orders,omitempty"`
+	MinSpend             float64 `json:"min_spend,omitempty"`
+	BirthdayThisMonth    bool    `json:"birthday_this_month,omitempty"`
+	BirthdayWithinDays   int     `json:"birthday_within_days,omitempty"`
+}
+
+// CustomerSegment is a named group of customers defined by rules
+type CustomerSegment struct {
+	ID          int          `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Rules       SegmentRules `json:"rules"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// Validate checks that the segment rules are consistent
+func (s *CustomerSegment) Validate() error {
+	if strings.TrimSpace(s.Name) == "" {
+		return ErrEmptyName
+	}
+
+	r := s.Rules
+	scores := []struct {
+		name     string
+		min, max int
+	}{
+		{"recency", r.MinRecencyScore, r.MaxRecencyScore},
+		{"frequency", r.MinFrequencyScore, r.MaxFrequencyScore},
+		{"monetary", r.MinMonetaryScore, r.MaxMonetaryScore},
+	}
+	for _, score := range scores {
+		if score.min < 0 || score.min > 5 || score.max < 0 || score.max > 5 {
+			return fmt.Errorf("%s score rules must be between 1 and 5", score.name)
+		}
+		if score.max > 0 && score.min > score.max {
+			return fmt.Errorf("minimum %s score cannot exceed maximum", score.name)
+		}
+	}
+
+	if r.MinDaysSincePurchase < 0 || r.MaxDaysSincePurchase < 0 || r.MinOrders < 0 || r.MinSpend < 0 || r.BirthdayWithinDays < 0 {
+		return fmt.Errorf("segment rule values cannot be negative")
+	}
+	if r.MaxDaysSincePurchase > 0 && r.MinDaysSincePurchase > r.MaxDaysSincePurchase {
+		return fmt.Errorf("minimum days since purchase cannot exceed maximum")
+	}
+
+	return nil
+}
+
+// usesPurchaseHistory reports whether any rule depends on the customer's purchases
+func (r SegmentRules) usesPurchaseHistory() bool {
+	return r.MinRecencyScore > 0 || r.MaxRecencyScore > 0 ||
+		r.MinFrequencyScore > 0 || r.MaxFrequencyScore > 0 ||
+		r.MinMonetaryScore > 0 || r.MaxMonetaryScore > 0 ||
+		r.MinDaysSincePurchase > 0 || r.MaxDaysSincePurchase > 0 ||
+		r.MinOrders > 0 || r.MinSpend > 0
+}
+
+// Matches reports whether a customer satisfies all of the segment rules
+func (r SegmentRules) Matches(c CustomerRFM, now time.Time) bool {
+	if r.usesPurchaseHistory() && !c.HasPurchases() {
+		return false
+	}
+
+	if !inScoreRange(c.RecencyScore, r.MinRecencyScore, r.MaxRecencyScore) ||
+		!inScoreRange(c.FrequencyScore, r.MinFrequencyScore, r.MaxFrequencyScore) ||
+		!inScoreRange(c.MonetaryScore, r.MinMonetaryScore, r.MaxMonetaryScore) {
+		return false
+	}
+
+	if r.MinDaysSincePurchase > 0 && c.RecencyDays < r.MinDaysSincePurchase {
+		return false
+	}
+	if r.MaxDaysSincePurchase > 0 && c.RecencyDays > r.MaxDaysSincePurchase {
+		return false
+	}
+	if r.MinOrders > 0 && c.Frequency < r.MinOrders {
+		return false
+	}
+	if r.MinSpend > 0 && c.Monetary < r.MinSpend {
+		return false
+	}
+
+	if r.BirthdayThisMonth || r.BirthdayWithinDays > 0 {
+		month, day, ok := ParseBirthday(c.Birthday)
+		if !ok {
+			return false
+		}
+		if r.BirthdayThisMonth && month != now.Month() {
+			return false
+		}
+		if r.BirthdayWithinDays > 0 && DaysUntilBirthday(month, day, now) > r.BirthdayWithinDays {
+			return false
+		}
+	}
+
+	return true
+}
+
+// inScoreRange checks a score against optional minimum and maximum bounds
+func inScoreRange(score, min, max int) bool {
+	if min > 0 && score < min {
+		return false
+	}
+	if max > 0 && score > max {
+		return false
+	}
+	return true
+}
+
+// ParseBirthday extracts the month and day from a birthday stored as YYYY-MM-DD or MM-DD
+func ParseBirthday(birthday string) (time.Month, int, bool) {
+	birthday = strings.TrimSpace(birthday)
+	for _, layout := range []string{"2006-01-02", "01-02"} {
+		if t, err := time.Parse(layout, birthday); err == nil {
+			return t.Month(), t.Day(), true
+		}
+	}
+	return 0, 0, false
+}
+
+// DaysUntilBirthday returns the number of days from now until the next occurrence of a birthday
+func DaysUntilBirthday(month time.Month, day int, now time.Time) int {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	next := time.Date(now.Year(), month, day, 0, 0, 0, 0, now.Location())
+	if next.Before(today) {
+		next = time.Date(now.Year()+1, month, day, 0, 0, 0, 0, now.Location())
+	}
+	return int(next.Sub(today).Hours() / 24)
+}
@@ -3,6 +3,8 @@ package models
 import (
         "encoding/json"
         "fmt"
+        "os"
+        "strings"
         "time"
 )
 
@@ -73,20 +75,281 @@ type SystemSettings struct {
         DateFormat           string `json:"date_format"`
         TimeFormat           string `json:"time_format"`
         DefaultOperatingMode string `json:"default_operating_mode"`
+        TerminalID           string `json:"terminal_id"` // Recorded on every sale, defaults to the host name
+        IdempotencyRetentionHours int `json:"idempotency_retention_hours"` // How long responses to idempotent requests are kept for replay
+}
+
+// DefaultIdempotencyRetentionHours is used when the retention is not configured
+const DefaultIdempotencyRetentionHours = 24
+
+// Terminal returns the ID recorded on sales made from this terminal
+func (s SystemSettings) Terminal() string {
+        if id := strings.TrimSpace(s.TerminalID); id != "" {
+                return id
+        }
+        if host, err := os.Hostname(); err == nil && host != "" {
+                return host
+        }
+        return "default"
+}
+
+// IdempotencyRetention returns how long a request with an idempotency key or client
+// reference is remembered, so that a retry within it is not applied twice
+func (s SystemSettings) IdempotencyRetention() time.Duration {
+        if s.IdempotencyRetentionHours <= 0 {
+                return DefaultIdempotencyRetentionHours * time.Hour
+        }
+        return time.Duration(s.IdempotencyRetentionHours) * time.Hour
+}
+
+// SecuritySettings contains access control configuration
+type SecuritySettings struct {
+        MaxDiscountPercent     float64 `json:"max_discount_percent"`     // Larger discounts need supervisor approval
+        ApprovalTimeoutMinutes int     `json:"approval_timeout_minutes"` // How long an approval token stays valid
+        IdleLockMinutes        int     `json:"idle_lock_minutes"`        // Idle time before the session locks, negative disables
+        MaxFailedLogins        int     `json:"max_failed_logins"`        // Failed logins before the account locks
+        LockoutMinutes         int     `json:"lockout_minutes"`          // Lockout after the limit, doubled on each further failure
+        PasswordMinLength      int     `json:"password_min_length"`      // Minimum password length
+        PasswordMinClasses     int     `json:"password_min_classes"`     // Character classes required: lower, upper, digit, symbol
+        PasswordHistory        int     `json:"password_history"`         // Previous passwords that cannot be reused, negative disables
+        PasswordMaxAgeDays     int     `json:"password_max_age_days"`    // Days before a password must be changed, zero disables
+        BreachedPasswordsFile  string  `json:"breached_passwords_file"`  // Local list of breached passwords, one per line or SHA-1 hashes
+        StaleAccountDays       int     `json:"stale_account_days"`       // Days without a login before an account is reported as stale
+        RequireTwoFactorRoles  string  `json:"require_2fa_roles"`        // Comma-separated roles that must use two-factor authentication
+        AccessTokenMinutes     int     `json:"access_token_minutes"`     // Lifetime of agent API access tokens
+        RefreshTokenDays       int     `json:"refresh_token_days"`       // Lifetime of agent API refresh tokens
+}
+
+// Default security values used when a setting is not configured
+const (
+        DefaultMaxDiscountPercent     = 20.0
+        DefaultApprovalTimeoutMinutes = 5
+        DefaultIdleLockMinutes        = 15
+        DefaultMaxFailedLogins        = 5
+        DefaultLockoutMinutes         = 15
+        DefaultPasswordMinLength      = 8
+        DefaultPasswordMinClasses     = 3
+        DefaultPasswordHistory        = 5
+        DefaultStaleAccountDays       = 90
+        DefaultBreachedPasswordsFile  = "./config/breached_passwords.txt"
+        DefaultAccessTokenMinutes     = 15
+        DefaultRefreshTokenDays       = 7
+
+        // MaxLockoutDuration caps the exponential lockout backoff
+        MaxLockoutDuration = 24 * time.Hour
+)
+
+// DiscountLimit returns the largest discount percentage allowed without approval
+func (s SecuritySettings) DiscountLimit() float64 {
+        if s.MaxDiscountPercent <= 0 {
+                return DefaultMaxDiscountPercent
+        }
+        return s.MaxDiscountPercent
+}
+
+// ApprovalTimeout returns how long an approval token stays valid
+func (s SecuritySettings) ApprovalTimeout() time.Duration {
+        if s.ApprovalTimeoutMinutes <= 0 {
+                return DefaultApprovalTimeoutMinutes * time.Minute
+        }
+        return time.Duration(s.ApprovalTimeoutMinutes) * time.Minute
+}
+
+// AccessTokenTTL returns how long an agent API access token is valid
+func (s SecuritySettings) AccessTokenTTL() time.Duration {
+        if s.AccessTokenMinutes <= 0 {
+                return DefaultAccessTokenMinutes * time.Minute
+        }
+        return time.Duration(s.AccessTokenMinutes) * time.Minute
+}
+
+// RefreshTokenTTL returns how long an agent API refresh token is valid
+func (s SecuritySettings) RefreshTokenTTL() time.Duration {
+        if s.RefreshTokenDays <= 0 {
+                return DefaultRefreshTokenDays * 24 * time.Hour
+        }
+        return time.Duration(s.RefreshTokenDays) * 24 * time.Hour
+}
+
+// IdleLock returns how long a session may be idle before it locks, or zero if idle locking is disabled
+func (s SecuritySettings) IdleLock() time.Duration {
+        if s.IdleLockMinutes < 0 {
+                return 0
+        }
+        if s.IdleLockMinutes == 0 {
+                return DefaultIdleLockMinutes * time.Minute
+        }
+        return time.Duration(s.IdleLockMinutes) * time.Minute
+}
+
+// FailedLoginLimit returns the number of failed logins that locks an account
+func (s SecuritySettings) FailedLoginLimit() int {
+        if s.MaxFailedLogins <= 0 {
+                return DefaultMaxFailedLogins
+        }
+        return s.MaxFailedLogins
+}
+
+// LockoutDuration returns how long an account is locked when it reaches the failed login limit
+func (s SecuritySettings) LockoutDuration() time.Duration {
+        if s.LockoutMinutes <= 0 {
+                return DefaultLockoutMinutes * time.Minute
+        }
+        return time.Duration(s.LockoutMinutes) * time.Minute
+}
+
+// LockoutFor returns how long to lock an account after the given number of consecutive
+// failed logins. Below the limit it returns zero; each failure past the limit doubles
+// the lockout, up to MaxLockoutDuration.
+func (s SecuritySettings) LockoutFor(failedAttempts int) time.Duration {
+        limit := s.FailedLoginLimit()
+        if failedAttempts < limit {
+                return 0
+        }
+
+        lockout := s.LockoutDuration()
+        for i := limit; i < failedAttempts && lockout < MaxLockoutDuration; i++ {
+                lockout *= 2
+        }
+        if lockout > MaxLockoutDuration {
+                return MaxLockoutDuration
+        }
+        return lockout
+}
+
+// MinPasswordLength returns the minimum password length
+func (s SecuritySettings) MinPasswordLength() int {
+        if s.PasswordMinLength <= 0 {
+                return DefaultPasswordMinLength
+        }
+        return s.PasswordMinLength
+}
+
+// MinPasswordClasses returns how many character classes a password must contain
+func (s SecuritySettings) MinPasswordClasses() int {
+        if s.PasswordMinClasses <= 0 {
+                return DefaultPasswordMinClasses
+        }
+        if s.PasswordMinClasses > 4 {
+                return 4
+        }
+        return s.PasswordMinClasses
+}
+
+// PasswordHistoryLimit returns how many previous passwords cannot be reused
+func (s SecuritySettings) PasswordHistoryLimit() int {
+        if s.PasswordHistory < 0 {
+                return 0
+        }
+        if s.PasswordHistory == 0 {
+                return DefaultPasswordHistory
+        }
+        return s.PasswordHistory
+}
+
+// PasswordMaxAge returns how long a password stays valid, or zero if passwords do not expire
+func (s SecuritySettings) PasswordMaxAge() time.Duration {
+        if s.PasswordMaxAgeDays <= 0 {
+                return 0
+        }
+        return time.Duration(s.PasswordMaxAgeDays) * 24 * time.Hour
+}
+
+// BreachListPath returns the path of the local breached password list
+func (s SecuritySettings) BreachListPath() string {
+        if s.BreachedPasswordsFile == "" {
+                return DefaultBreachedPasswordsFile
+        }
+        return s.BreachedPasswordsFile
+}
+
+// StaleAfter returns how long an account can go without a login before it is stale
+func (s SecuritySettings) StaleAfter() time.Duration {
+        if s.StaleAccountDays <= 0 {
+                return DefaultStaleAccountDays * 24 * time.Hour
+        }
+        return time.Duration(s.StaleAccountDays) * 24 * time.Hour
+}
+
+// RequiresTwoFactor reports whether users with the given role must use two-factor authentication
+func (s SecuritySettings) RequiresTwoFactor(role Role) bool {
+        for _, r := range strings.Split(s.RequireTwoFactorRoles, ",") {
+                if role != "" && NormalizeRoleName(r) == role {
+                        return true
+                }
+        }
+        return false
+}
+
+// LabourSettings contains the time clock and overtime rules
+type LabourSettings struct {
+        DailyOvertimeHours  float64 `json:"daily_overtime_hours"`  // Hours worked in a day before overtime, negative disables
+        WeeklyOvertimeHours float64 `json:"weekly_overtime_hours"` // Regular hours in a week before overtime, negative disables
+        WeekStartDay        string  `json:"week_start_day"`        // Day the overtime week starts, e.g. "monday"
+}
+
+// Default labour values used when a setting is not configured
+const (
+        DefaultDailyOvertimeHours  = 8.0
+        DefaultWeeklyOvertimeHours = 40.0
+        DefaultWeekStartDay        = "monday"
+)
+
+// DailyOvertime returns the time worked in a day before overtime, or zero if there is no daily limit
+func (s LabourSettings) DailyOvertime() time.Duration {
+        return overtimeLimit(s.DailyOvertimeHours, DefaultDailyOvertimeHours)
+}
+
+// WeeklyOvertime returns the regular time in a week before overtime, or zero if there is no weekly limit
+func (s LabourSettings) WeeklyOvertime() time.Duration {
+        return overtimeLimit(s.WeeklyOvertimeHours, DefaultWeeklyOvertimeHours)
+}
+
+func overtimeLimit(hours, defaultHours float64) time.Duration {
+        if hours < 0 {
+                return 0
+        }
+        if hours == 0 {
+                hours = defaultHours
+        }
+        return time.Duration(hours * float64(time.Hour))
+}
+
+// WeekStart returns the day the overtime week starts
+func (s LabourSettings) WeekStart() time.Weekday {
+        day := strings.ToLower(strings.TrimSpace(s.WeekStartDay))
+        if day == "" {
+                day = DefaultWeekStartDay
+        }
+        for d := time.Sunday; d <= time.Saturday; d++ {
+                if strings.ToLower(d.String()) == day {
+                        return d
+                }
+        }
+        return time.Monday
+}
+
+// StartOfWeek returns midnight at the start of the overtime week containing t
+func (s LabourSettings) StartOfWeek(t time.Time) time.Time {
+        y, m, d := t.Date()
+        offset := (int(t.Weekday()) - int(s.WeekStart()) + 7) % 7
+        return time.Date(y, m, d-offset, 0, 0, 0, 0, t.Location())
 }
 
 // Settings represents all POS settings
 type Settings struct {
-        ID              int             `json:"id"`
-        Store           StoreInfo       `json:"store"`
-        Tax             TaxSettings     `json:"tax"`
-        Product         ProductSettings `json:"product"`
-        Payment         PaymentSettings `json:"payment"`
-        Receipt         ReceiptSettings `json:"receipt"`
-        Backup          BackupSettings  `json:"backup"`
-        System          SystemSettings  `json:"system"`
-        LastUpdated     string          `json:"last_updated"`
-        LastUpdatedBy   string          `json:"last_updated_by,omitempty"`
+        ID              int              `json:"id"`
+        Store           StoreInfo        `json:"store"`
+        Tax             TaxSettings      `json:"tax"`
+        Product         ProductSettings  `json:"product"`
+        Payment         PaymentSettings  `json:"payment"`
+        Receipt         ReceiptSettings  `json:"receipt"`
+        Backup          BackupSettings   `json:"backup"`
+        System          SystemSettings   `json:"system"`
+        Security        SecuritySettings `json:"security"`
+        Labour          LabourSettings   `json:"labour"`
+        LastUpdated     string           `json:"last_updated"`
+        LastUpdatedBy   string           `json:"last_updated_by,omitempty"`
 }
 
 // Validate checks if the settings are valid
@@ -146,6 +409,26 @@ func NewDefaultSettings() Settings {
                         DateFormat:           "2006-01-02",
                         TimeFormat:           "15:04:05",
                         DefaultOperatingMode: "classic",
+                        IdempotencyRetentionHours: DefaultIdempotencyRetentionHours,
+                },
+                Security: SecuritySettings{
+                        MaxDiscountPercent:     DefaultMaxDiscountPercent,
+                        ApprovalTimeoutMinutes: DefaultApprovalTimeoutMinutes,
+                        IdleLockMinutes:        DefaultIdleLockMinutes,
+                        MaxFailedLogins:        DefaultMaxFailedLogins,
+                        LockoutMinutes:         DefaultLockoutMinutes,
+                        PasswordMinLength:      DefaultPasswordMinLength,
+                        PasswordMinClasses:     DefaultPasswordMinClasses,
+                        PasswordHistory:        DefaultPasswordHistory,
+                        BreachedPasswordsFile:  DefaultBreachedPasswordsFile,
+                        StaleAccountDays:       DefaultStaleAccountDays,
+                        AccessTokenMinutes:     DefaultAccessTokenMinutes,
+                        RefreshTokenDays:       DefaultRefreshTokenDays,
+                },
+                Labour: LabourSettings{
+                        DailyOvertimeHours:  DefaultDailyOvertimeHours,
+                        WeeklyOvertimeHours: DefaultWeeklyOvertimeHours,
+                        WeekStartDay:        DefaultWeekStartDay,
                 },
                 LastUpdated: now,
         }
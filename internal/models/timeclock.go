@@ -0,0 +1,180 @@
+package models
+
+import (
+	"sort"
+	"time"
+)
+
+// Time clock permissions
+const (
+	PermissionTimeClockUse    = "timeclock:use"
+	PermissionTimeClockManage = "timeclock:manage"
+)
+
+// TimeEntry is a shift worked by a staff member, from clock in to clock out
+type TimeEntry struct {
+	ID       int          `json:"id"`
+	UserID   int          `json:"user_id"`
+	Username string       `json:"username,omitempty"`
+	ClockIn  time.Time    `json:"clock_in"`
+	ClockOut time.Time    `json:"clock_out,omitempty"` // Zero while the shift is open
+	Breaks   []ShiftBreak `json:"breaks,omitempty"`
+	Notes    string       `json:"notes,omitempty"`
+	EditedBy string       `json:"edited_by,omitempty"` // Manager who last corrected the entry
+	EditedAt time.Time    `json:"edited_at,omitempty"`
+}
+
+// ShiftBreak is an unpaid break taken during a shift
+type ShiftBreak struct {
+	ID    int       `json:"id"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end,omitempty"` // Zero while the break is in progress
+}
+
+// IsOpen reports whether the staff member is still clocked in
+func (e TimeEntry) IsOpen() bool {
+	return e.ClockOut.IsZero()
+}
+
+// OnBreak reports whether the staff member is on a break
+func (e TimeEntry) OnBreak() bool {
+	return len(e.Breaks) > 0 && e.Breaks[len(e.Breaks)-1].End.IsZero()
+}
+
+// EndOr returns the clock out time, or now for an open shift
+func (e TimeEntry) EndOr(now time.Time) time.Time {
+	if e.IsOpen() {
+		return now
+	}
+	return e.ClockOut
+}
+
+// BreakTime returns the total time spent on breaks, counting a break in progress up to now
+func (e TimeEntry) BreakTime(now time.Time) time.Duration {
+	var total time.Duration
+	for _, b := range e.Breaks {
+		end := b.End
+		if end.IsZero() {
+			end = e.EndOr(now)
+		}
+		total += end.Sub(b.Start)
+	}
+	return total
+}
+
+// Worked returns the time worked in the shift, excluding breaks. Open shifts count up to now.
+func (e TimeEntry) Worked(now time.Time) time.Duration {
+	worked := e.EndOr(now).Sub(e.ClockIn) - e.BreakTime(now)
+	if worked < 0 {
+		return 0
+	}
+	return worked
+}
+
+// Overlaps reports whether two shifts overlap. An open shift extends indefinitely.
+func (e TimeEntry) Overlaps(other TimeEntry) bool {
+	startsBeforeOtherEnds := other.IsOpen() || e.ClockIn.Before(other.ClockOut)
+	endsAfterOtherStarts := e.IsOpen() || e.ClockOut.After(other.ClockIn)
+	return startsBeforeOtherEnds && endsAfterOtherStarts
+}
+
+// TimesheetDay is the time worked on one day, split into regular and overtime hours
+type TimesheetDay struct {
+	Date     time.Time     `json:"date"`
+	Shifts   int           `json:"shifts"`
+	Worked   time.Duration `json:"worked"`
+	Regular  time.Duration `json:"regular"`
+	Overtime time.Duration `json:"overtime"`
+}
+
+// Timesheet is a staff member's time worked over a period
+type Timesheet struct {
+	UserID   int            `json:"user_id"`
+	Username string         `json:"username"`
+	From     time.Time      `json:"from"`
+	To       time.Time      `json:"to"`
+	Days     []TimesheetDay `json:"days"`
+	Worked   time.Duration  `json:"worked"`
+	Regular  time.Duration  `json:"regular"`
+	Overtime time.Duration  `json:"overtime"`
+}
+
+// BuildTimesheet totals shifts by the day they started and applies the overtime rules:
+// hours over the daily limit are overtime, then regular hours over the weekly limit are
+// overtime too. Only days from from up to, but not including, to are reported, but
+// entries earlier in the week of from should be passed so the weekly limit is applied
+// correctly.
+func BuildTimesheet(entries []TimeEntry, rules LabourSettings, from, to, now time.Time) Timesheet {
+	sheet := Timesheet{From: from, To: to}
+
+	// Total the time worked per day
+	byDay := make(map[time.Time]*TimesheetDay)
+	for _, e := range entries {
+		y, m, d := e.ClockIn.In(from.Location()).Date()
+		date := time.Date(y, m, d, 0, 0, 0, 0, from.Location())
+		day, ok := byDay[date]
+		if !ok {
+			day = &TimesheetDay{Date: date}
+			byDay[date] = day
+		}
+		day.Shifts++
+		day.Worked += e.Worked(now)
+	}
+
+	days := make([]*TimesheetDay, 0, len(byDay))
+	for _, day := range byDay {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date.Before(days[j].Date) })
+
+	dailyLimit := rules.DailyOvertime()
+	weeklyLimit := rules.WeeklyOvertime()
+
+	var week time.Time
+	var weekRegular time.Duration
+	for _, day := range days {
+		if start := rules.StartOfWeek(day.Date); !start.Equal(week) {
+			week, weekRegular = start, 0
+		}
+
+		day.Regular = day.Worked
+		if dailyLimit > 0 && day.Regular > dailyLimit {
+			day.Regular = dailyLimit
+		}
+		if weeklyLimit > 0 && weekRegular+day.Regular > weeklyLimit {
+			day.Regular = weeklyLimit - weekRegular
+			if day.Regular < 0 {
+				day.Regular = 0
+			}
+		}
+		day.Overtime = day.Worked - day.Regular
+		weekRegular += day.Regular
+
+		if day.Date.Before(from) || !day.Date.Before(to) {
+			continue
+		}
+		sheet.Days = append(sheet.Days, *day)
+		sheet.Worked += day.Worked
+		sheet.Regular += day.Regular
+		sheet.Overtime += day.Overtime
+	}
+
+	return sheet
+}
+
+// LabourSales is the time a staff member worked in a period and the sales made during their shifts
+type LabourSales struct {
+	UserID       int           `json:"user_id"`
+	Username     string        `json:"username"`
+	Worked       time.Duration `json:"worked"`
+	Transactions int           `json:"transactions"`
+	Revenue      float64       `json:"revenue"`
+}
+
+// SalesPerHour returns the revenue per hour worked
+func (l LabourSales) SalesPerHour() float64 {
+	if l.Worked <= 0 {
+		return 0
+	}
+	return l.Revenue / l.Worked.Hours()
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// shift returns a closed shift on the given day of May 2024, which starts on a Wednesday
+func shift(day, startHour, endHour int) TimeEntry {
+	return TimeEntry{
+		ClockIn:  time.Date(2024, 5, day, startHour, 0, 0, 0, time.UTC),
+		ClockOut: time.Date(2024, 5, day, endHour, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestTimeEntryWorked(t *testing.T) {
+	e := shift(1, 9, 17)
+	e.Breaks = []ShiftBreak{{
+		Start: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+	}}
+	if got := e.Worked(time.Time{}); got != 7*time.Hour+30*time.Minute {
+		t.Errorf("Expected 7h30m worked, got %s", got)
+	}
+
+	// An open shift on a break counts up to the start of the break
+	open := TimeEntry{ClockIn: e.ClockIn, Breaks: []ShiftBreak{{Start: time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC)}}}
+	now := time.Date(2024, 5, 1, 11, 45, 0, 0, time.UTC)
+	if !open.OnBreak() || open.Worked(now) != 2*time.Hour {
+		t.Errorf("Expected 2h worked while on a break, got %s", open.Worked(now))
+	}
+
+	if !open.Overlaps(shift(2, 9, 10)) {
+		t.Error("Expected an open shift to overlap later shifts")
+	}
+	if shift(1, 9, 12).Overlaps(shift(1, 12, 15)) {
+		t.Error("Expected back to back shifts not to overlap")
+	}
+}
+
+func TestBuildTimesheet(t *testing.T) {
+	rules := LabourSettings{DailyOvertimeHours: 8, WeeklyOvertimeHours: 40, WeekStartDay: "monday"}
+
+	// Monday 29 April to Saturday 4 May: 10h on Monday, 9h Tuesday to Friday, 4h Saturday
+	entries := []TimeEntry{
+		{ClockIn: time.Date(2024, 4, 29, 8, 0, 0, 0, time.UTC), ClockOut: time.Date(2024, 4, 29, 18, 0, 0, 0, time.UTC)},
+		{ClockIn: time.Date(2024, 4, 30, 8, 0, 0, 0, time.UTC), ClockOut: time.Date(2024, 4, 30, 17, 0, 0, 0, time.UTC)},
+	}
+	for day := 1; day <= 3; day++ {
+		entries = append(entries, shift(day, 8, 17))
+	}
+	entries = append(entries, shift(4, 9, 13))
+
+	from := time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 7)
+	sheet := BuildTimesheet(entries, rules, from, to, time.Time{})
+
+	if len(sheet.Days) != 6 {
+		t.Fatalf("Expected 6 days, got %d", len(sheet.Days))
+	}
+	// 2h daily overtime on Monday and 1h on the next four days
+	if sheet.Days[0].Overtime != 2*time.Hour || sheet.Days[1].Overtime != time.Hour {
+		t.Errorf("Expected daily overtime, got %s and %s", sheet.Days[0].Overtime, sheet.Days[1].Overtime)
+	}
+	// 40 regular hours are reached on Friday, so all of Saturday is overtime
+	if sheet.Days[5].Regular != 0 || sheet.Days[5].Overtime != 4*time.Hour {
+		t.Errorf("Expected Saturday to be overtime, got %s regular and %s overtime", sheet.Days[5].Regular, sheet.Days[5].Overtime)
+	}
+	if sheet.Worked != 50*time.Hour || sheet.Regular != 40*time.Hour || sheet.Overtime != 10*time.Hour {
+		t.Errorf("Expected 50h worked, 40h regular and 10h overtime, got %s, %s and %s", sheet.Worked, sheet.Regular, sheet.Overtime)
+	}
+
+	// A period starting mid-week still counts the earlier days towards the weekly limit
+	sheet = BuildTimesheet(entries, rules, time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC), to, time.Time{})
+	if len(sheet.Days) != 1 || sheet.Overtime != 4*time.Hour {
+		t.Errorf("Expected only Saturday with 4h overtime, got %d days and %s overtime", len(sheet.Days), sheet.Overtime)
+	}
+
+	// Negative limits disable overtime
+	sheet = BuildTimesheet(entries, LabourSettings{DailyOvertimeHours: -1, WeeklyOvertimeHours: -1}, from, to, time.Time{})
+	if sheet.Overtime != 0 {
+		t.Errorf("Expected no overtime with the limits disabled, got %s", sheet.Overtime)
+	}
+}
@@ -33,32 +33,30 @@ type User struct {
         Department   string    `json:"department,omitempty"`
         Notes        string    `json:"notes,omitempty"`
         EmergencyContact string `json:"emergency_contact,omitempty"`
-}
-
-// HasPermission checks if the user has permission to perform an action
-func (u *User) HasPermission(permission string) bool {
-        switch permission {
-        case "user:manage":
-                return u.Role == RoleAdmin
-
-        case "report:generate":
-                return u.Role == RoleAdmin || u.Role == RoleManager
-
-        case "product:manage":
-                return u.Role == RoleAdmin || u.Role == RoleManager
 
-        case "sales:view":
-                return u.Role == RoleAdmin || u.Role == RoleManager || u.Role == RoleCashier
-
-        case "inventory:view":
-                return u.Role == RoleAdmin || u.Role == RoleManager || u.Role == RoleCashier
+        // Scopes limits the user to these permissions. It is set for requests made with an API key.
+        Scopes       []string  `json:"-"`
+}
 
-        case "sales:create":
-                return u.Role == RoleAdmin || u.Role == RoleManager || u.Role == RoleCashier
+// HasScope checks if a user limited to scopes may use a permission
+func (u *User) HasScope(permission string) bool {
+        for _, scope := range u.Scopes {
+                if scope == permission {
+                        return true
+                }
+        }
+        return false
+}
 
-        default:
-                return false
+// HasPermission checks if the user's role grants a permission using the default
+// grants of the built-in roles. Roles stored in the database, including custom
+// roles, are checked by auth.HasPermission.
+func (u *User) HasPermission(permission string) bool {
+        if u.Scopes != nil {
+                return u.HasScope(permission)
         }
+        role := RoleDefinition{Name: u.Role, Permissions: DefaultRolePermissions[u.Role]}
+        return role.HasPermission(permission)
 }
 
 // IsAdmin checks if the user is an administrator
@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// UserSecurity holds a user's quick login PIN, failed login, password change and
+// two-factor authentication state
+type UserSecurity struct {
+	UserID             int       `json:"user_id"`
+	PINHash            string    `json:"-"` // Never expose the PIN hash in JSON
+	FailedAttempts     int       `json:"failed_attempts"`
+	LastFailedAt       time.Time `json:"last_failed_at,omitempty"`
+	LockedUntil        time.Time `json:"locked_until,omitempty"`
+	MustChangePassword bool      `json:"must_change_password"`
+	PasswordChangedAt  time.Time `json:"password_changed_at,omitempty"`
+	TwoFactorEnabled   bool      `json:"two_factor_enabled"`
+	TokensRevokedAt    time.Time `json:"tokens_revoked_at,omitempty"` // API tokens issued before this are rejected
+}
+
+// TokenRevoked reports whether an API token issued at issuedAt has been revoked for the user.
+// Tokens carry their issue time in whole seconds, so those issued in the second of the
+// revocation are revoked too.
+func (s UserSecurity) TokenRevoked(issuedAt time.Time) bool {
+	return !s.TokensRevokedAt.IsZero() && issuedAt.Unix() <= s.TokensRevokedAt.Unix()
+}
+
+// TokenIssueTime returns the time a new API token for the user is issued at: now, or the
+// second after their tokens were revoked if that is later, so that a login right after
+// revoking all tokens is not revoked with them
+func (s UserSecurity) TokenIssueTime(now time.Time) time.Time {
+	if s.TokenRevoked(now) {
+		return s.TokensRevokedAt.Truncate(time.Second).Add(time.Second)
+	}
+	return now
+}
+
+// HasPIN reports whether the user has set a quick login PIN
+func (s UserSecurity) HasPIN() bool {
+	return s.PINHash != ""
+}
+
+// IsLocked reports whether the account is locked out at the given time
+func (s UserSecurity) IsLocked(now time.Time) bool {
+	return !s.LockedUntil.IsZero() && now.Before(s.LockedUntil)
+}
+
+// PasswordExpired reports whether the password is older than maxAge. Passwords that have
+// never been changed are aged from createdAt. A zero maxAge means passwords do not expire.
+func (s UserSecurity) PasswordExpired(maxAge time.Duration, createdAt, now time.Time) bool {
+	if maxAge <= 0 {
+		return false
+	}
+
+	changedAt := s.PasswordChangedAt
+	if changedAt.IsZero() {
+		changedAt = createdAt
+	}
+	return now.Sub(changedAt) > maxAge
+}
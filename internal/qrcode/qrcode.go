@@ -0,0 +1,216 @@
+// Package qrcode encodes short text, such as otpauth URIs, as QR codes that can be
+// shown in a terminal. It supports byte mode at error correction level M for
+// versions 1 to 10, which holds up to 213 bytes.
+package qrcode
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrTooLong is returned when the text does not fit in the largest supported version
+var ErrTooLong = errors.New("text is too long for a QR code")
+
+// Code is an encoded QR code. Modules[y][x] is true for dark modules.
+type Code struct {
+	Version int
+	Size    int
+	Modules [][]bool
+}
+
+// versionInfo describes the error correction blocks of a version at level M
+type versionInfo struct {
+	ecPerBlock int
+	blocks     []int // data codewords in each block
+	alignment  []int // alignment pattern centre coordinates
+}
+
+// versions lists versions 1 to 10 at error correction level M (ISO/IEC 18004 table 9)
+var versions = []versionInfo{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// dataCapacity returns the number of data codewords of a version
+func (v versionInfo) dataCapacity() int {
+	total := 0
+	for _, n := range v.blocks {
+		total += n
+	}
+	return total
+}
+
+// Encode encodes text as a QR code using the smallest version that fits
+func Encode(text string) (*Code, error) {
+	data := []byte(text)
+
+	for i, info := range versions {
+		version := i + 1
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 > info.dataCapacity()*8 {
+			continue
+		}
+
+		codewords := addErrorCorrection(encodeData(data, countBits, info.dataCapacity()), info)
+		return newCode(version, info, codewords), nil
+	}
+
+	return nil, ErrTooLong
+}
+
+// encodeData builds the data codewords: byte mode indicator, character count, data,
+// terminator and padding
+func encodeData(data []byte, countBits, capacity int) []byte {
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	bits.append(len(data), countBits)
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+
+	// Terminator of up to four zero bits, then pad to a whole byte
+	terminator := capacity*8 - bits.len()
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-bits.len()%8)%8)
+
+	codewords := bits.bytes()
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+	return codewords
+}
+
+// addErrorCorrection splits the data into blocks, computes the Reed-Solomon error
+// correction codewords of each block and interleaves the result
+func addErrorCorrection(data []byte, info versionInfo) []byte {
+	generator := rsGenerator(info.ecPerBlock)
+
+	var blocks, ecBlocks [][]byte
+	offset := 0
+	for _, n := range info.blocks {
+		block := data[offset : offset+n]
+		offset += n
+		blocks = append(blocks, block)
+		ecBlocks = append(ecBlocks, rsRemainder(block, generator))
+	}
+
+	var result []byte
+	for i := 0; i < info.blocks[len(info.blocks)-1]; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < info.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// newCode lays out the function patterns and codewords and applies the best mask
+func newCode(version int, info versionInfo, codewords []byte) *Code {
+	m := newMatrix(version*4 + 17)
+	m.drawFunctionPatterns(version, info)
+	m.drawCodewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		m.applyMask(mask)
+		m.drawFormatBits(mask)
+		if penalty := m.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		m.applyMask(mask) // masking twice undoes it
+	}
+
+	m.applyMask(best)
+	m.drawFormatBits(best)
+
+	return &Code{Version: version, Size: m.size, Modules: m.modules}
+}
+
+// String renders the code for a terminal using half block characters, two modules
+// per character cell, with a quiet zone around it. Dark modules are drawn as spaces
+// and light modules as blocks so the code reads correctly on a dark background;
+// invert swaps them for light backgrounds.
+func (c *Code) String() string {
+	return c.render(false)
+}
+
+// Inverted renders the code for a terminal with a light background
+func (c *Code) Inverted() string {
+	return c.render(true)
+}
+
+func (c *Code) render(invert bool) string {
+	const quiet = 2
+
+	light := func(x, y int) bool {
+		x -= quiet
+		y -= quiet
+		dark := x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.Modules[y][x]
+		return dark == invert
+	}
+
+	var sb strings.Builder
+	size := c.Size + 2*quiet
+	for y := 0; y < size; y += 2 {
+		for x := 0; x < size; x++ {
+			top, bottom := light(x, y), y+1 < size && light(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// bitBuffer accumulates bits most significant first
+type bitBuffer struct {
+	bits []bool
+}
+
+func (b *bitBuffer) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		b.bits = append(b.bits, (value>>uint(i))&1 == 1)
+	}
+}
+
+func (b *bitBuffer) len() int {
+	return len(b.bits)
+}
+
+func (b *bitBuffer) bytes() []byte {
+	result := make([]byte, (len(b.bits)+7)/8)
+	for i, bit := range b.bits {
+		if bit {
+			result[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return result
+}
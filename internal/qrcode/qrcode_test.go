@@ -0,0 +1,62 @@
+package qrcode
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// "HELLO WORLD" at version 1-M, from the worked example of the standard
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	got := rsRemainder(data, rsGenerator(len(want)))
+	if string(got) != string(want) {
+		t.Errorf("rsRemainder = %v, want %v", got, want)
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	format := map[int]int{
+		0: 0x5412, // 101010000010010
+		4: 0x45F9, // 100010111111001
+		7: 0x4AA0, // 100101010100000
+	}
+	for mask, want := range format {
+		if got := formatBits(mask); got != want {
+			t.Errorf("formatBits(%d) = %015b, want %015b", mask, got, want)
+		}
+	}
+
+	if got := versionBits(7); got != 0x07C94 {
+		t.Errorf("versionBits(7) = %018b, want %018b", got, 0x07C94)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	uri := "otpauth://totp/TermPOS:alice?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=TermPOS"
+	code, err := Encode(uri)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if code.Version != 5 || code.Size != 37 {
+		t.Errorf("Expected version 5 (37 modules), got version %d (%d modules)", code.Version, code.Size)
+	}
+
+	// The finder patterns are in place
+	for _, corner := range [][2]int{{0, 0}, {code.Size - 7, 0}, {0, code.Size - 7}} {
+		x, y := corner[0], corner[1]
+		if !code.Modules[y][x] || code.Modules[y+1][x+1] || !code.Modules[y+3][x+3] {
+			t.Errorf("Expected a finder pattern at (%d, %d)", x, y)
+		}
+	}
+
+	lines := strings.Split(strings.TrimRight(code.String(), "\n"), "\n")
+	if len(lines) != (code.Size+4+1)/2 {
+		t.Errorf("Expected %d lines, got %d", (code.Size+4+1)/2, len(lines))
+	}
+
+	if _, err := Encode(strings.Repeat("x", 214)); err != ErrTooLong {
+		t.Errorf("Expected ErrTooLong, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package security
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+var ErrNoDatabaseKey = errors.New("POS_DB_KEY or POS_DB_PASSPHRASE must be set to open an encrypted database")
+
+// Environment variables the database key is read from
+const (
+	databaseKeyEnv        = "POS_DB_KEY"
+	databasePassphraseEnv = "POS_DB_PASSPHRASE"
+)
+
+// SaltSize is the size of the salt keys are derived from a passphrase with
+const SaltSize = 16
+
+// scrypt parameters keys are derived from a passphrase with. Changing them makes data
+// encrypted with derived keys unreadable.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// DeriveKey derives a 32 byte key from a passphrase and a random salt with scrypt
+func DeriveKey(passphrase string, salt []byte) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase is empty")
+	}
+	if len(salt) < SaltSize {
+		return nil, fmt.Errorf("salt too short, must be at least %d bytes", SaltSize)
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return key, nil
+}
+
+// DatabaseKeyConfigured reports whether a key to encrypt the database with is configured
+func DatabaseKeyConfigured() bool {
+	return os.Getenv(databaseKeyEnv) != "" || os.Getenv(databasePassphraseEnv) != ""
+}
+
+// DatabaseKey returns the 32 byte key the database is encrypted with: POS_DB_KEY, base64
+// encoded, or a key derived from POS_DB_PASSPHRASE and the salt of the database
+func DatabaseKey(salt []byte) ([]byte, error) {
+	if encoded := os.Getenv(databaseKeyEnv); encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database key format: %w", err)
+		}
+		if len(key) < 32 {
+			return nil, fmt.Errorf("database key too short, must be at least 32 bytes when decoded")
+		}
+		return key[:32], nil
+	}
+	if passphrase := os.Getenv(databasePassphraseEnv); passphrase != "" {
+		return DeriveKey(passphrase, salt)
+	}
+	return nil, ErrNoDatabaseKey
+}
@@ -0,0 +1,48 @@
+package security
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestDatabaseKey(t *testing.T) {
+	t.Setenv("POS_DB_KEY", "")
+	t.Setenv("POS_DB_PASSPHRASE", "")
+	salt := bytes.Repeat([]byte{1}, SaltSize)
+
+	if DatabaseKeyConfigured() {
+		t.Error("Expected no database key to be configured")
+	}
+	if _, err := DatabaseKey(salt); !errors.Is(err, ErrNoDatabaseKey) {
+		t.Errorf("Expected ErrNoDatabaseKey, got %v", err)
+	}
+
+	// Keys derived from a passphrase depend on the salt
+	t.Setenv("POS_DB_PASSPHRASE", "correct horse battery staple")
+	key, err := DatabaseKey(salt)
+	if err != nil || len(key) != 32 {
+		t.Fatalf("Expected a 32 byte key, got %d bytes (%v)", len(key), err)
+	}
+	if again, _ := DatabaseKey(salt); !bytes.Equal(again, key) {
+		t.Error("Expected the same passphrase and salt to derive the same key")
+	}
+	if other, _ := DatabaseKey(bytes.Repeat([]byte{2}, SaltSize)); bytes.Equal(other, key) {
+		t.Error("Expected another salt to derive another key")
+	}
+	if _, err := DeriveKey("passphrase", []byte("short")); err == nil {
+		t.Error("Expected a short salt to be rejected")
+	}
+
+	// A key is used as it is, and takes precedence over the passphrase
+	raw := bytes.Repeat([]byte{9}, 32)
+	t.Setenv("POS_DB_KEY", base64.StdEncoding.EncodeToString(raw))
+	if key, err := DatabaseKey(salt); err != nil || !bytes.Equal(key, raw) {
+		t.Errorf("Expected POS_DB_KEY to be used, got %x (%v)", key, err)
+	}
+	t.Setenv("POS_DB_KEY", base64.StdEncoding.EncodeToString([]byte("short")))
+	if _, err := DatabaseKey(salt); err == nil {
+		t.Error("Expected a short key to be rejected")
+	}
+}
@@ -1,138 +1,342 @@
 package security
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"sync"
 )
 
 var (
-	// encryptionKey is used for encrypting sensitive data
+	ErrEphemeralKey = errors.New("POS_ENCRYPTION_KEY or POS_ENCRYPTION_KEY_FILE must be set, data is never encrypted with a temporary key")
+	ErrUnknownKey   = errors.New("data was encrypted with an unknown key")
+)
+
+// Environment variables the master key is read from
+const (
+	masterKeyEnv     = "POS_ENCRYPTION_KEY"
+	masterKeyFileEnv = "POS_ENCRYPTION_KEY_FILE"
+)
+
+// ciphertextPrefix starts every string encrypted with a data key, followed by the key ID
+// and a colon. Strings without it were encrypted with the master key by earlier versions.
+const ciphertextPrefix = "v1:"
+
+// sealedMagic starts every byte slice encrypted with a data key, followed by the length of
+// the key ID and the key ID
+var sealedMagic = []byte("TPK1")
+
+var (
+	// masterMu guards the master key, which is loaded the first time it is needed and
+	// again by every call to InitEncryption
+	masterMu     sync.RWMutex
+	masterLoaded bool
+
+	// encryptionKey is the master key, which wraps the data keys, or nil when no master
+	// key is configured
 	encryptionKey []byte
+
+	// masterKeySource describes where the master key was read from
+	masterKeySource string
 )
 
-// InitEncryption initializes the encryption subsystem
+// InitEncryption loads the master key, base64 encoded, from POS_ENCRYPTION_KEY or from the
+// file named by POS_ENCRYPTION_KEY_FILE. Without one nothing can be encrypted, and only
+// data that was not encrypted can be read.
 func InitEncryption() error {
-	// Check if we already have a key
-	if encryptionKey != nil && len(encryptionKey) >= 32 {
-		return nil
-	}
+	masterMu.Lock()
+	err := loadMasterKey()
+	masterMu.Unlock()
 
-	// Try to get key from environment variable
-	envKey := os.Getenv("POS_ENCRYPTION_KEY")
-	if envKey != "" {
-		// Decode the base64 encoded key
-		key, err := base64.StdEncoding.DecodeString(envKey)
-		if err != nil {
-			return fmt.Errorf("invalid encryption key format: %w", err)
-		}
+	// Data keys unwrapped with the previous master key are no longer trusted
+	keyMu.Lock()
+	resetKeyCache()
+	keyMu.Unlock()
 
-		// Ensure key is 32 bytes (256 bits)
-		if len(key) < 32 {
-			return fmt.Errorf("encryption key too short, must be at least 32 bytes when decoded")
-		}
+	return err
+}
+
+// loadMasterKey reads the master key from the environment, to be called with masterMu held
+func loadMasterKey() error {
+	encryptionKey, masterKeySource, masterLoaded = nil, "", true
 
-		encryptionKey = key[:32]
-		return nil
+	encoded, source := os.Getenv(masterKeyEnv), masterKeyEnv
+	if encoded == "" {
+		path := os.Getenv(masterKeyFileEnv)
+		if path == "" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read encryption key file: %w", err)
+		}
+		encoded, source = strings.TrimSpace(string(data)), path
 	}
 
-	// Generate a new key as fallback
-	key := make([]byte, 32) // AES-256
-	if _, err := io.ReadFull(rand.Reader, key); err != nil {
-		return fmt.Errorf("failed to generate encryption key: %w", err)
+	// Decode the base64 encoded key
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid encryption key format: %w", err)
 	}
 
-	encryptionKey = key
-	fmt.Println("Warning: Generated a temporary encryption key. Set POS_ENCRYPTION_KEY environment variable for persistent encryption.")
-	fmt.Printf("Generated key: %s\n", base64.StdEncoding.EncodeToString(key))
+	// Ensure key is 32 bytes (256 bits)
+	if len(key) < 32 {
+		return fmt.Errorf("encryption key too short, must be at least 32 bytes when decoded")
+	}
 
+	encryptionKey, masterKeySource = key[:32], source
 	return nil
 }
 
-// Encrypt encrypts plaintext using AES-GCM
-func Encrypt(plaintext string) (string, error) {
-	// Make sure encryption is initialized
-	if encryptionKey == nil {
-		if err := InitEncryption(); err != nil {
-			return "", fmt.Errorf("encryption not initialized: %w", err)
-		}
+// masterKey returns the master key and where it was read from, loading it the first time
+// it is needed. The key is nil when none is configured.
+func masterKey() ([]byte, string) {
+	masterMu.RLock()
+	if masterLoaded {
+		defer masterMu.RUnlock()
+		return encryptionKey, masterKeySource
 	}
+	masterMu.RUnlock()
 
-	// Convert plaintext to bytes
-	plaintextBytes := []byte(plaintext)
+	masterMu.Lock()
+	defer masterMu.Unlock()
+	if !masterLoaded {
+		// A key that fails to load is treated as none configured
+		loadMasterKey()
+	}
+	return encryptionKey, masterKeySource
+}
 
-	// Create a new AES cipher block
-	block, err := aes.NewCipher(encryptionKey)
-	if err != nil {
-		return "", fmt.Errorf("failed to create cipher block: %w", err)
+// requireMasterKey returns the master key, or ErrEphemeralKey when none is configured
+func requireMasterKey() ([]byte, error) {
+	key, _ := masterKey()
+	if key == nil {
+		return nil, ErrEphemeralKey
 	}
+	return key, nil
+}
 
-	// Create a new GCM mode cipher
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %w", err)
+// IsEphemeralKey reports whether no master key is configured, in which case nothing can
+// be encrypted
+func IsEphemeralKey() bool {
+	key, _ := masterKey()
+	return key == nil
+}
+
+// MasterKeySource returns where the master key was read from, the environment variable or
+// the key file, or "" when none is configured
+func MasterKeySource() string {
+	_, source := masterKey()
+	return source
+}
+
+// MasterKeyID returns the ID of the master key, derived from the key, or "" when none is
+// configured
+func MasterKeyID() string {
+	key, _ := masterKey()
+	if key == nil {
+		return ""
 	}
+	return keyID(key)
+}
 
-	// Create a nonce (Number used ONCE)
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", fmt.Errorf("failed to generate nonce: %w", err)
+// keyID derives a short ID from a key
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// BlindIndex returns a keyed hash of value, so encrypted values can be looked up by their
+// plaintext without being decrypted. It returns "" for an empty value or when no master
+// key is configured.
+func BlindIndex(value string) string {
+	key, _ := masterKey()
+	if value == "" || key == nil {
+		return ""
 	}
 
-	// Encrypt and append nonce
-	sealed := gcm.Seal(nonce, nonce, plaintextBytes, nil)
+	// The index key is derived from the master key, so it is never used for encryption
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte("termpos blind index"))
+
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Encrypt encrypts plaintext with the active data key using AES-GCM. The result names the
+// key, so it can still be decrypted after the key is rotated.
+func Encrypt(plaintext string) (string, error) {
+	key, err := activeDataKey()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(key.key, []byte(plaintext), []byte(key.ID))
+	if err != nil {
+		return "", err
+	}
 
 	// Encode as base64 for easier storage
-	encoded := base64.StdEncoding.EncodeToString(sealed)
-	return encoded, nil
+	return ciphertextPrefix + key.ID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
 }
 
-// Decrypt decrypts ciphertext using AES-GCM
+// Decrypt decrypts ciphertext encrypted with Encrypt, or with the master key by earlier
+// versions
 func Decrypt(ciphertext string) (string, error) {
-	// Make sure encryption is initialized
-	if encryptionKey == nil {
-		if err := InitEncryption(); err != nil {
-			return "", fmt.Errorf("encryption not initialized: %w", err)
-		}
+	id, encoded := CiphertextKeyID(ciphertext), ciphertext
+	if id != "" {
+		encoded = strings.TrimPrefix(ciphertext, ciphertextPrefix+id+":")
 	}
 
 	// Decode from base64
-	decoded, err := base64.StdEncoding.DecodeString(ciphertext)
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
 		return "", fmt.Errorf("failed to decode base64: %w", err)
 	}
 
+	var plaintextBytes []byte
+	if id == "" {
+		plaintextBytes, err = openWithMasterKey(decoded)
+	} else {
+		plaintextBytes, err = openWithDataKey(id, decoded)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintextBytes), nil
+}
+
+// CiphertextKeyID returns the ID of the data key a string was encrypted with, or "" when
+// it was encrypted with the master key by earlier versions
+func CiphertextKeyID(ciphertext string) string {
+	if !strings.HasPrefix(ciphertext, ciphertextPrefix) {
+		return ""
+	}
+	rest := ciphertext[len(ciphertextPrefix):]
+	i := strings.Index(rest, ":")
+	if i <= 0 {
+		return ""
+	}
+	return rest[:i]
+}
+
+// EncryptBytes encrypts data with the active data key using AES-GCM. The result starts
+// with the key ID, followed by the nonce and the ciphertext.
+func EncryptBytes(plaintext []byte) ([]byte, error) {
+	key, err := activeDataKey()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(key.key, plaintext, []byte(key.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append([]byte{}, sealedMagic...), byte(len(key.ID)))
+	header = append(header, key.ID...)
+	return append(header, sealed...), nil
+}
+
+// DecryptBytes decrypts data encrypted with EncryptBytes, or with the master key by
+// earlier versions
+func DecryptBytes(sealed []byte) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, sealedMagic) {
+		return openWithMasterKey(sealed)
+	}
+
+	rest := sealed[len(sealedMagic):]
+	if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	id := string(rest[1 : 1+int(rest[0])])
+	return openWithDataKey(id, rest[1+int(rest[0]):])
+}
+
+// openWithMasterKey decrypts data encrypted with the master key
+func openWithMasterKey(sealed []byte) ([]byte, error) {
+	key, err := requireMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	return open(key, sealed, nil)
+}
+
+// openWithDataKey decrypts data encrypted with the data key with the given ID
+func openWithDataKey(id string, sealed []byte) ([]byte, error) {
+	key, err := dataKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return open(key.key, sealed, []byte(id))
+}
+
+// newGCM returns an AES-GCM cipher with a key
+func newGCM(key []byte) (cipher.AEAD, error) {
 	// Create a new AES cipher block
-	block, err := aes.NewCipher(encryptionKey)
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to create cipher block: %w", err)
+		return nil, fmt.Errorf("failed to create cipher block: %w", err)
 	}
 
 	// Create a new GCM mode cipher
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %w", err)
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
+
+// seal encrypts data with a key, returning the nonce followed by the ciphertext.
+// additionalData is authenticated but not encrypted.
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a nonce (Number used ONCE)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	// Encrypt and prepend nonce
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts data encrypted with seal
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
 	}
 
 	// Extract nonce
 	nonceSize := gcm.NonceSize()
-	if len(decoded) < nonceSize {
-		return "", fmt.Errorf("ciphertext too short")
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("ciphertext too short")
 	}
 
-	nonce, ciphertextBytes := decoded[:nonceSize], decoded[nonceSize:]
+	nonce, ciphertext := sealed[:nonceSize], sealed[nonceSize:]
 
 	// Decrypt
-	plaintextBytes, err := gcm.Open(nil, nonce, ciphertextBytes, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt: %w", err)
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
 	}
 
-	return string(plaintextBytes), nil
+	return plaintext, nil
 }
 
 // GenerateRandomKey generates a new random encryption key
@@ -164,4 +368,4 @@ func VerifyPassword(password, hash string) (bool, error) {
 	}
 
 	return decrypted == password, nil
-}
\ No newline at end of file
+}
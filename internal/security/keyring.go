@@ -0,0 +1,305 @@
+package security
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrNoKeyStore = errors.New("no key store configured for data keys")
+
+// DataKey is a key data is encrypted with, stored wrapped by the master key. Retired keys
+// are kept, as data encrypted with them may still exist in archives and backups.
+type DataKey struct {
+	ID          string
+	WrappedKey  []byte
+	MasterKeyID string
+	CreatedAt   time.Time
+	RetiredAt   *time.Time
+}
+
+// Active reports whether data is encrypted with the key
+func (k DataKey) Active() bool {
+	return k.RetiredAt == nil
+}
+
+// KeyStore stores the data keys
+type KeyStore interface {
+	// DataKeys returns all data keys, active and retired
+	DataKeys() ([]DataKey, error)
+
+	// AddDataKey stores a new data key as the active key, retiring the previous one
+	AddDataKey(key DataKey) error
+}
+
+// unwrappedKey is a data key ready for use
+type unwrappedKey struct {
+	ID  string
+	key []byte
+}
+
+// activeKeyTTL is how long the active key is used before the key store is checked for a
+// newer one. Another process may rotate the data key, and a rotation only completes once
+// every process has picked up the new key: rows a process encrypts with the retired key in
+// the meantime are re-encrypted by 'pos keys rotate --resume'.
+var activeKeyTTL = 30 * time.Second
+
+var (
+	keyStore KeyStore
+
+	// keyCache holds the data keys already unwrapped, activeKeyID the ID of the active
+	// one, and activeKeyChecked when the key store was last checked for it
+	keyMu            sync.Mutex
+	keyCache         = map[string]unwrappedKey{}
+	activeKeyID      string
+	activeKeyChecked time.Time
+)
+
+// SetKeyStore sets where the data keys are stored
+func SetKeyStore(store KeyStore) {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	keyStore = store
+	resetKeyCache()
+}
+
+// resetKeyCache forgets the unwrapped data keys, to be called with keyMu held
+func resetKeyCache() {
+	keyCache = map[string]unwrappedKey{}
+	activeKeyID = ""
+	activeKeyChecked = time.Time{}
+}
+
+// ActiveKeyID returns the ID of the key data is encrypted with, creating the first data
+// key when there is none yet
+func ActiveKeyID() (string, error) {
+	key, err := activeDataKey()
+	if err != nil {
+		return "", err
+	}
+	return key.ID, nil
+}
+
+// RotateDataKey creates a new data key and makes it the active one. Data already
+// encrypted keeps its key until it is encrypted again.
+func RotateDataKey() (string, error) {
+	if IsEphemeralKey() {
+		return "", ErrEphemeralKey
+	}
+
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	if keyStore == nil {
+		return "", ErrNoKeyStore
+	}
+
+	key, err := newDataKey()
+	if err != nil {
+		return "", err
+	}
+	keyCache[key.ID] = key
+	activeKeyID, activeKeyChecked = key.ID, time.Now()
+	return key.ID, nil
+}
+
+// UnwrapDataKey checks that a data key can be unwrapped with the master key
+func UnwrapDataKey(key DataKey) error {
+	_, err := unwrap(key)
+	return err
+}
+
+// activeDataKey returns the key data is encrypted with, checking the key store for a key
+// another process rotated to once the cached one is older than activeKeyTTL
+func activeDataKey() (unwrappedKey, error) {
+	if IsEphemeralKey() {
+		return unwrappedKey{}, ErrEphemeralKey
+	}
+
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	if key, ok := keyCache[activeKeyID]; ok && time.Since(activeKeyChecked) < activeKeyTTL {
+		return key, nil
+	}
+	if keyStore == nil {
+		return unwrappedKey{}, ErrNoKeyStore
+	}
+
+	keys, err := keyStore.DataKeys()
+	if err != nil {
+		return unwrappedKey{}, fmt.Errorf("failed to load data keys: %w", err)
+	}
+	for _, stored := range keys {
+		if !stored.Active() {
+			continue
+		}
+		key, ok := keyCache[stored.ID]
+		if !ok {
+			if key, err = unwrap(stored); err != nil {
+				return unwrappedKey{}, err
+			}
+			keyCache[key.ID] = key
+		}
+		activeKeyID, activeKeyChecked = key.ID, time.Now()
+		return key, nil
+	}
+
+	// There is no data key yet
+	key, err := newDataKey()
+	if err != nil {
+		return unwrappedKey{}, err
+	}
+	keyCache[key.ID] = key
+	activeKeyID, activeKeyChecked = key.ID, time.Now()
+	return key, nil
+}
+
+// dataKey returns the data key with the given ID
+func dataKey(id string) (unwrappedKey, error) {
+	if IsEphemeralKey() {
+		return unwrappedKey{}, ErrEphemeralKey
+	}
+
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	if key, ok := keyCache[id]; ok {
+		return key, nil
+	}
+	if keyStore == nil {
+		return unwrappedKey{}, ErrNoKeyStore
+	}
+
+	keys, err := keyStore.DataKeys()
+	if err != nil {
+		return unwrappedKey{}, fmt.Errorf("failed to load data keys: %w", err)
+	}
+	for _, stored := range keys {
+		if stored.ID != id {
+			continue
+		}
+		key, err := unwrap(stored)
+		if err != nil {
+			return unwrappedKey{}, err
+		}
+		keyCache[key.ID] = key
+		return key, nil
+	}
+	return unwrappedKey{}, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+}
+
+// newDataKey generates a data key, wraps it with the master key and stores it as the
+// active key, to be called with keyMu held
+func newDataKey() (unwrappedKey, error) {
+	master, err := requireMasterKey()
+	if err != nil {
+		return unwrappedKey{}, err
+	}
+
+	raw := make([]byte, 32) // AES-256
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return unwrappedKey{}, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	// The ID is random rather than derived from the key, so it says nothing about it
+	idBytes := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, idBytes); err != nil {
+		return unwrappedKey{}, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	id := fmt.Sprintf("%x", idBytes)
+
+	// The ID is authenticated with the wrapped key, so keys cannot be swapped
+	wrapped, err := seal(master, raw, []byte(id))
+	if err != nil {
+		return unwrappedKey{}, err
+	}
+
+	stored := DataKey{
+		ID:          id,
+		WrappedKey:  wrapped,
+		MasterKeyID: keyID(master),
+		CreatedAt:   time.Now(),
+	}
+	if err := keyStore.AddDataKey(stored); err != nil {
+		return unwrappedKey{}, fmt.Errorf("failed to store data key: %w", err)
+	}
+	return unwrappedKey{ID: id, key: raw}, nil
+}
+
+// unwrap decrypts a data key with the master key
+func unwrap(stored DataKey) (unwrappedKey, error) {
+	master, err := requireMasterKey()
+	if err != nil {
+		return unwrappedKey{}, err
+	}
+	if stored.MasterKeyID != keyID(master) {
+		return unwrappedKey{}, fmt.Errorf("data key %s is wrapped by master key %s, but master key %s is configured", stored.ID, stored.MasterKeyID, keyID(master))
+	}
+
+	raw, err := open(master, stored.WrappedKey, []byte(stored.ID))
+	if err != nil {
+		return unwrappedKey{}, fmt.Errorf("failed to unwrap data key %s: %w", stored.ID, err)
+	}
+	return unwrappedKey{ID: stored.ID, key: raw}, nil
+}
+
+// envelopeMagic starts every byte slice encrypted with EncryptEnvelope, followed by the
+// length of the wrapped data key and the wrapped key
+var envelopeMagic = []byte("TPE1")
+
+// EncryptEnvelope encrypts data with a new data key and stores the key, wrapped by the
+// master key, with the ciphertext. Unlike EncryptBytes the result does not depend on the
+// key store, so it suits backups, which must be readable when the database is lost.
+func EncryptEnvelope(plaintext []byte) ([]byte, error) {
+	master, err := requireMasterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 32) // AES-256
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, err := seal(master, raw, envelopeMagic)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(raw, plaintext, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append([]byte{}, envelopeMagic...), byte(len(wrapped)))
+	header = append(header, wrapped...)
+	return append(header, sealed...), nil
+}
+
+// IsEnvelope reports whether data was encrypted with EncryptEnvelope
+func IsEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, envelopeMagic)
+}
+
+// DecryptEnvelope decrypts data encrypted with EncryptEnvelope
+func DecryptEnvelope(data []byte) ([]byte, error) {
+	if !IsEnvelope(data) {
+		return nil, errors.New("data is not an encrypted envelope")
+	}
+	master, err := requireMasterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	rest := data[len(envelopeMagic):]
+	if len(rest) < 1+int(rest[0]) {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	wrapped, sealed := rest[1:1+int(rest[0])], rest[1+int(rest[0]):]
+
+	raw, err := open(master, wrapped, envelopeMagic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key, the master key differs from the one the data was encrypted with: %w", err)
+	}
+	return open(raw, sealed, wrapped)
+}
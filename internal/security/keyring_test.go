@@ -0,0 +1,271 @@
+package security
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryKeyStore keeps data keys in memory
+type memoryKeyStore struct {
+	keys []DataKey
+}
+
+func (s *memoryKeyStore) DataKeys() ([]DataKey, error) {
+	return append([]DataKey{}, s.keys...), nil
+}
+
+func (s *memoryKeyStore) AddDataKey(key DataKey) error {
+	for i := range s.keys {
+		if s.keys[i].RetiredAt == nil {
+			retiredAt := key.CreatedAt
+			s.keys[i].RetiredAt = &retiredAt
+		}
+	}
+	s.keys = append(s.keys, key)
+	return nil
+}
+
+// setMasterKey configures a master key and a fresh key store for the test
+func setMasterKey(t *testing.T, fill byte) *memoryKeyStore {
+	t.Cleanup(func() {
+		InitEncryption()
+		SetKeyStore(nil)
+	})
+	t.Setenv("POS_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32)))
+	t.Setenv("POS_ENCRYPTION_KEY_FILE", "")
+	if err := InitEncryption(); err != nil {
+		t.Fatalf("InitEncryption failed: %v", err)
+	}
+
+	store := &memoryKeyStore{}
+	SetKeyStore(store)
+	return store
+}
+
+func TestEncryptionRefusesEphemeralKey(t *testing.T) {
+	setMasterKey(t, 1)
+	t.Setenv("POS_ENCRYPTION_KEY", "")
+	if err := InitEncryption(); err != nil {
+		t.Fatalf("InitEncryption failed: %v", err)
+	}
+
+	if !IsEphemeralKey() || MasterKeyID() != "" {
+		t.Error("Expected no master key to be configured")
+	}
+	if _, err := Encrypt("secret"); !errors.Is(err, ErrEphemeralKey) {
+		t.Errorf("Expected Encrypt to fail with ErrEphemeralKey, got %v", err)
+	}
+	if _, err := EncryptBytes([]byte("secret")); !errors.Is(err, ErrEphemeralKey) {
+		t.Errorf("Expected EncryptBytes to fail with ErrEphemeralKey, got %v", err)
+	}
+	if _, err := EncryptEnvelope([]byte("secret")); !errors.Is(err, ErrEphemeralKey) {
+		t.Errorf("Expected EncryptEnvelope to fail with ErrEphemeralKey, got %v", err)
+	}
+
+	t.Setenv("POS_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString([]byte("short")))
+	if err := InitEncryption(); err == nil || !IsEphemeralKey() {
+		t.Errorf("Expected a short key to be rejected, got %v", err)
+	}
+}
+
+func TestMasterKeyFile(t *testing.T) {
+	setMasterKey(t, 1)
+	want := MasterKeyID()
+
+	path := filepath.Join(t.TempDir(), "master.key")
+	if err := os.WriteFile(path, []byte(os.Getenv("POS_ENCRYPTION_KEY")+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	t.Setenv("POS_ENCRYPTION_KEY", "")
+	t.Setenv("POS_ENCRYPTION_KEY_FILE", path)
+	if err := InitEncryption(); err != nil {
+		t.Fatalf("InitEncryption failed: %v", err)
+	}
+	if MasterKeyID() != want || MasterKeySource() != path {
+		t.Errorf("Expected master key %s from %s, got %s from %s", want, path, MasterKeyID(), MasterKeySource())
+	}
+}
+
+func TestDataKeyRotation(t *testing.T) {
+	store := setMasterKey(t, 1)
+
+	ciphertext, err := Encrypt("4111 1111 1111 1111")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	sealed, err := EncryptBytes([]byte("archive"))
+	if err != nil {
+		t.Fatalf("EncryptBytes failed: %v", err)
+	}
+	if len(store.keys) != 1 || CiphertextKeyID(ciphertext) != store.keys[0].ID {
+		t.Fatalf("Expected the ciphertext to name the first data key, got %q with %+v", ciphertext, store.keys)
+	}
+	if store.keys[0].MasterKeyID != MasterKeyID() || bytes.Contains(store.keys[0].WrappedKey, []byte("4111")) {
+		t.Errorf("Expected the data key to be wrapped by the master key, got %+v", store.keys[0])
+	}
+
+	newID, err := RotateDataKey()
+	if err != nil {
+		t.Fatalf("RotateDataKey failed: %v", err)
+	}
+	if active, _ := ActiveKeyID(); active != newID || store.keys[0].Active() {
+		t.Errorf("Expected %s to replace %s, got %s", newID, store.keys[0].ID, active)
+	}
+
+	// Data encrypted with the retired key can still be read, after a restart too
+	SetKeyStore(store)
+	if plaintext, err := Decrypt(ciphertext); err != nil || plaintext != "4111 1111 1111 1111" {
+		t.Errorf("Expected to decrypt with the retired key, got %q (%v)", plaintext, err)
+	}
+	if plaintext, err := DecryptBytes(sealed); err != nil || string(plaintext) != "archive" {
+		t.Errorf("Expected to decrypt bytes with the retired key, got %q (%v)", plaintext, err)
+	}
+	rotated, _ := Encrypt("4111 1111 1111 1111")
+	if CiphertextKeyID(rotated) != newID {
+		t.Errorf("Expected new data to use %s, got %q", newID, rotated)
+	}
+
+	// The key ID is authenticated, so naming another key fails
+	forged := ciphertextPrefix + newID + ciphertext[len(ciphertextPrefix)+len(newID):]
+	if _, err := Decrypt(forged); err == nil {
+		t.Error("Expected a ciphertext naming the wrong key to fail")
+	}
+	if _, err := Decrypt(ciphertextPrefix + "deadbeef:" + base64.StdEncoding.EncodeToString([]byte("x"))); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+
+	// Another master key cannot unwrap the data keys
+	setMasterKey(t, 2)
+	SetKeyStore(store)
+	if _, err := Decrypt(ciphertext); err == nil {
+		t.Error("Expected decryption with another master key to fail")
+	}
+	if err := UnwrapDataKey(store.keys[0]); err == nil {
+		t.Error("Expected UnwrapDataKey to fail with another master key")
+	}
+}
+
+func TestActiveKeyRotatedByAnotherProcess(t *testing.T) {
+	setMasterKey(t, 1)
+	oldID, err := ActiveKeyID()
+	if err != nil {
+		t.Fatalf("ActiveKeyID failed: %v", err)
+	}
+
+	// Another process rotates the data key in the shared key store
+	keyMu.Lock()
+	cached := map[string]unwrappedKey{oldID: keyCache[oldID]}
+	keyMu.Unlock()
+	newID, err := RotateDataKey()
+	if err != nil {
+		t.Fatalf("RotateDataKey failed: %v", err)
+	}
+	keyMu.Lock()
+	keyCache, activeKeyID, activeKeyChecked = cached, oldID, time.Now()
+	keyMu.Unlock()
+
+	// This process keeps its cached key until it is due to be checked
+	encrypted, err := Encrypt("secret")
+	if err != nil || CiphertextKeyID(encrypted) != oldID {
+		t.Errorf("Expected the cached key %s to be used, got %s (%v)", oldID, CiphertextKeyID(encrypted), err)
+	}
+
+	keyMu.Lock()
+	activeKeyChecked = time.Now().Add(-activeKeyTTL)
+	keyMu.Unlock()
+	encrypted, err = Encrypt("secret")
+	if err != nil || CiphertextKeyID(encrypted) != newID {
+		t.Errorf("Expected the rotated key %s to be picked up, got %s (%v)", newID, CiphertextKeyID(encrypted), err)
+	}
+	if decrypted, err := Decrypt(encrypted); err != nil || decrypted != "secret" {
+		t.Errorf("Expected to decrypt with the rotated key, got %q (%v)", decrypted, err)
+	}
+}
+
+func TestLegacyCiphertext(t *testing.T) {
+	setMasterKey(t, 1)
+
+	// Earlier versions encrypted directly with the master key
+	master, _ := masterKey()
+	sealed, err := seal(master, []byte("legacy"), nil)
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+	if CiphertextKeyID(base64.StdEncoding.EncodeToString(sealed)) != "" {
+		t.Error("Expected a legacy ciphertext to name no data key")
+	}
+	if plaintext, err := Decrypt(base64.StdEncoding.EncodeToString(sealed)); err != nil || plaintext != "legacy" {
+		t.Errorf("Expected to decrypt a legacy string, got %q (%v)", plaintext, err)
+	}
+	if plaintext, err := DecryptBytes(sealed); err != nil || string(plaintext) != "legacy" {
+		t.Errorf("Expected to decrypt legacy bytes, got %q (%v)", plaintext, err)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	setMasterKey(t, 1)
+	SetKeyStore(nil)
+
+	if _, err := EncryptBytes([]byte("backup")); !errors.Is(err, ErrNoKeyStore) {
+		t.Errorf("Expected ErrNoKeyStore, got %v", err)
+	}
+
+	// Envelopes carry their own data key, so need no key store
+	sealed, err := EncryptEnvelope([]byte("backup"))
+	if err != nil {
+		t.Fatalf("EncryptEnvelope failed: %v", err)
+	}
+	if !IsEnvelope(sealed) || IsEnvelope([]byte("backup")) {
+		t.Error("Expected IsEnvelope to recognize envelopes only")
+	}
+	if plaintext, err := DecryptEnvelope(sealed); err != nil || string(plaintext) != "backup" {
+		t.Errorf("Expected to decrypt the envelope, got %q (%v)", plaintext, err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := DecryptEnvelope(sealed); err == nil {
+		t.Error("Expected a tampered envelope to fail")
+	}
+
+	setMasterKey(t, 2)
+	sealed[len(sealed)-1] ^= 1
+	if _, err := DecryptEnvelope(sealed); err == nil {
+		t.Error("Expected decryption with another master key to fail")
+	}
+}
+
+func TestInitEncryptionConcurrently(t *testing.T) {
+	setMasterKey(t, 1)
+	encrypted, err := Encrypt("secret")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	// Reloading the same master key while data is encrypted and decrypted must not race
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := InitEncryption(); err != nil {
+				t.Errorf("InitEncryption failed: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if decrypted, err := Decrypt(encrypted); err != nil || decrypted != "secret" {
+				t.Errorf("Expected to decrypt while the key is reloaded, got %q (%v)", decrypted, err)
+			}
+			if BlindIndex("secret") == "" || MasterKeyID() == "" {
+				t.Error("Expected the master key to stay configured")
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,104 @@
+package syslog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"termpos/internal/db"
+)
+
+// Forwarder sends the entries written to the audit log to a syslog receiver. It records
+// the last entry it sent under its name, so it resumes where it stopped after a restart.
+// An entry may be sent again if sending fails part way through a batch, never skipped.
+type Forwarder struct {
+	Name      string        // Name the position of the forwarder is recorded under
+	Facility  Facility      // Facility of the messages
+	Hostname  string        // Hostname of the messages
+	AppName   string        // Application name of the messages
+	Interval  time.Duration // How often the audit log is checked for new entries
+	BatchSize int           // Most entries read at once
+
+	writer *Writer
+	lastID int64
+}
+
+// NewForwarder returns a forwarder with the default settings sending to w
+func NewForwarder(name string, w *Writer) *Forwarder {
+	hostname, _ := os.Hostname()
+	return &Forwarder{
+		Name:      name,
+		Facility:  FacilityAuthPriv,
+		Hostname:  hostname,
+		AppName:   "termpos",
+		Interval:  time.Second,
+		BatchSize: 100,
+		writer:    w,
+	}
+}
+
+// Start makes the forwarder resume from the last entry it sent. A forwarder that never
+// ran starts from the current end of the log, or from its beginning if fromStart is set.
+func (f *Forwarder) Start(fromStart bool) error {
+	id, ok, err := db.AuditForwarderPosition(f.Name)
+	if err != nil {
+		return err
+	}
+	if !ok && !fromStart {
+		if id, err = db.LatestAuditLogID(); err != nil {
+			return err
+		}
+	}
+	f.lastID = id
+	return nil
+}
+
+// Forward sends the entries written since the last one sent, and returns how many it sent
+func (f *Forwarder) Forward() (int, error) {
+	sent := 0
+	for {
+		logs, err := db.AuditLogsAfter(f.lastID, f.BatchSize)
+		if err != nil {
+			return sent, err
+		}
+
+		for _, log := range logs {
+			msg := AuditMessage(log, f.Facility, f.Hostname, f.AppName)
+			msg.ProcID = strconv.Itoa(os.Getpid())
+			if err = f.writer.Send(msg); err != nil {
+				break
+			}
+			f.lastID = log.ID
+			sent++
+		}
+
+		if len(logs) > 0 {
+			if perr := db.SetAuditForwarderPosition(f.Name, f.lastID); perr != nil && err == nil {
+				err = perr
+			}
+		}
+		if err != nil || len(logs) < f.BatchSize {
+			return sent, err
+		}
+	}
+}
+
+// Run forwards new entries until the context is cancelled
+func (f *Forwarder) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := f.Forward(); err != nil {
+			fmt.Fprintf(os.Stderr, "syslog: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
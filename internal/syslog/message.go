@@ -0,0 +1,166 @@
+// Package syslog forwards the audit log to a syslog daemon or collector as RFC 5424
+// messages.
+package syslog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"termpos/internal/db"
+)
+
+// Facility is the syslog facility of a message
+type Facility int
+
+// Facilities audit messages are commonly sent with
+const (
+	FacilityAuth     Facility = 4
+	FacilityAuthPriv Facility = 10
+	FacilityLocal0   Facility = 16
+)
+
+// Severity is the syslog severity of a message
+type Severity int
+
+// Severities of audit messages
+const (
+	SeverityWarning Severity = 4
+	SeverityNotice  Severity = 5
+	SeverityInfo    Severity = 6
+)
+
+// nilValue stands for an empty header field or structured data
+const nilValue = "-"
+
+// auditSDID is the ID of the structured data element carrying the fields of an audit log
+// entry. 32473 is the private enterprise number reserved for documentation (RFC 5612).
+const auditSDID = "audit@32473"
+
+// Param is a parameter of a structured data element
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Element is a structured data element
+type Element struct {
+	ID     string
+	Params []Param
+}
+
+// Message is an RFC 5424 syslog message
+type Message struct {
+	Facility  Facility
+	Severity  Severity
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	Data      []Element
+	Text      string
+}
+
+// Format returns the message in the RFC 5424 format, without transport framing
+func (m Message) Format() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 ", int(m.Facility)*8+int(m.Severity))
+
+	if m.Timestamp.IsZero() {
+		b.WriteString(nilValue)
+	} else {
+		b.WriteString(m.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"))
+	}
+	for _, field := range []struct {
+		value string
+		max   int
+	}{{m.Hostname, 255}, {m.AppName, 48}, {m.ProcID, 128}, {m.MsgID, 32}} {
+		b.WriteByte(' ')
+		b.WriteString(headerField(field.value, field.max))
+	}
+
+	b.WriteByte(' ')
+	if len(m.Data) == 0 {
+		b.WriteString(nilValue)
+	}
+	for _, e := range m.Data {
+		b.WriteByte('[')
+		b.WriteString(headerField(e.ID, 32))
+		for _, p := range e.Params {
+			fmt.Fprintf(&b, " %s=\"%s\"", headerField(p.Name, 32), escapeParam(p.Value))
+		}
+		b.WriteByte(']')
+	}
+
+	if m.Text != "" {
+		b.WriteByte(' ')
+		b.WriteString(m.Text)
+	}
+	return []byte(b.String())
+}
+
+// headerField returns a header field of printable ASCII without spaces, or the nil value
+// if it is empty. Header fields cannot carry anything else, so other characters are
+// replaced.
+func headerField(value string, max int) string {
+	if value == "" {
+		return nilValue
+	}
+
+	field := []byte(value)
+	for i, c := range field {
+		if c < 33 || c > 126 || c == '=' || c == ']' || c == '"' {
+			field[i] = '_'
+		}
+	}
+	if len(field) > max {
+		field = field[:max]
+	}
+	return string(field)
+}
+
+// escapeParam escapes the characters that end a parameter value
+func escapeParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// severity returns the severity audit entries of an action are sent with
+func severity(action db.AuditAction) Severity {
+	switch action {
+	case db.ActionAccess, db.ActionLogin, db.ActionLogout:
+		return SeverityInfo
+	case db.ActionDelete, db.ActionPermissionMod, db.ActionUserMod:
+		return SeverityWarning
+	}
+	return SeverityNotice
+}
+
+// AuditMessage returns the message for an audit log entry. The fields of the entry are
+// sent as structured data, and its description as the message text.
+func AuditMessage(log db.AuditLog, facility Facility, hostname, appName string) Message {
+	params := []Param{{"id", strconv.FormatInt(log.ID, 10)}, {"user", log.Username}}
+	for _, p := range []Param{
+		{"resource_type", log.ResourceType},
+		{"resource_id", log.ResourceID},
+		{"approved_by", log.ApprovedBy},
+		{"ip", log.IPAddress},
+		{"hash", log.Hash},
+	} {
+		if p.Value != "" {
+			params = append(params, p)
+		}
+	}
+
+	return Message{
+		Facility:  facility,
+		Severity:  severity(log.Action),
+		Timestamp: log.Timestamp,
+		Hostname:  hostname,
+		AppName:   appName,
+		MsgID:     string(log.Action),
+		Data:      []Element{{ID: auditSDID, Params: params}},
+		Text:      log.Description,
+	}
+}
@@ -0,0 +1,104 @@
+package syslog
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"termpos/internal/db"
+)
+
+func TestAuditMessageFormat(t *testing.T) {
+	log := db.AuditLog{
+		ID:           42,
+		Timestamp:    time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC),
+		Username:     "alice",
+		Action:       db.ActionDelete,
+		ResourceType: "products",
+		ResourceID:   "7",
+		Description:  `Deleted "Milk [1L]"`,
+		ApprovedBy:   `bob"]`,
+		Hash:         "abc",
+	}
+
+	msg := AuditMessage(log, FacilityAuthPriv, "till 1", "termpos")
+	msg.ProcID = "99"
+	expected := `<84>1 2026-03-01T09:30:00.000000Z till_1 termpos 99 delete ` +
+		`[audit@32473 id="42" user="alice" resource_type="products" resource_id="7" approved_by="bob\"\]" hash="abc"] ` +
+		`Deleted "Milk [1L]"`
+	if got := string(msg.Format()); got != expected {
+		t.Errorf("Unexpected message\n got %s\nwant %s", got, expected)
+	}
+
+	// Empty fields are sent as the nil value
+	empty := Message{Facility: FacilityLocal0, Severity: SeverityInfo}
+	if got := string(empty.Format()); got != "<134>1 - - - - - -" {
+		t.Errorf("Unexpected empty message %q", got)
+	}
+}
+
+func TestForwarderSendsToLocalSocket(t *testing.T) {
+	if err := db.Initialize(":memory:"); err != nil {
+		t.Fatalf("Failed to initialize test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	path := filepath.Join(t.TempDir(), "log")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	receive := func() string {
+		t.Helper()
+		buf := make([]byte, 4096)
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := listener.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to receive a message: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	db.LogUserAction("admin", db.ActionLogin, "auth", "admin", "Written before the forwarder started")
+
+	w, err := Dial("unix://" + path)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer w.Close()
+
+	// A new forwarder starts from the end of the log
+	f := NewForwarder("test", w)
+	if err := f.Start(false); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+	db.LogUserAction("admin", db.ActionUpdate, "products", "1", "Changed price")
+	db.LogUserAction("admin", db.ActionDelete, "products", "2", "Deleted product")
+
+	if sent, err := f.Forward(); err != nil || sent != 2 {
+		t.Fatalf("Expected 2 messages to be sent, got %d (%v)", sent, err)
+	}
+	for _, expected := range []string{"<85>1 ", "<84>1 "} {
+		msg := receive()
+		if !strings.HasPrefix(msg, expected) || !strings.Contains(msg, " termpos ") {
+			t.Errorf("Expected a message starting %q, got %q", expected, msg)
+		}
+	}
+
+	// Another forwarder of the same name resumes after the last entry sent
+	db.LogUserAction("admin", db.ActionUpdate, "products", "1", "Changed stock")
+	resumed := NewForwarder("test", w)
+	if err := resumed.Start(true); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+	if sent, err := resumed.Forward(); err != nil || sent != 1 {
+		t.Fatalf("Expected 1 message to be sent, got %d (%v)", sent, err)
+	}
+	if msg := receive(); !strings.HasSuffix(msg, "Changed stock") {
+		t.Errorf("Expected the new entry, got %q", msg)
+	}
+}
@@ -0,0 +1,104 @@
+package syslog
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// dialTimeout is how long connecting to the receiver may take
+const dialTimeout = 10 * time.Second
+
+// Writer sends messages to a syslog receiver, reconnecting when the connection is lost
+type Writer struct {
+	network string
+	address string
+	conn    net.Conn
+}
+
+// Dial connects to a syslog receiver. The address is a URL: udp://host:514 or
+// tcp://host:601 for a collector, or unix:///dev/log, or a bare path, for the socket of
+// the local syslog daemon.
+func Dial(addr string) (*Writer, error) {
+	w := &Writer{}
+	switch {
+	case strings.HasPrefix(addr, "udp://"):
+		w.network, w.address = "udp", strings.TrimPrefix(addr, "udp://")
+	case strings.HasPrefix(addr, "tcp://"):
+		w.network, w.address = "tcp", strings.TrimPrefix(addr, "tcp://")
+	case strings.HasPrefix(addr, "unix://"):
+		w.network, w.address = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "/"):
+		w.network, w.address = "unix", addr
+	default:
+		return nil, fmt.Errorf("invalid syslog address %q, expected udp://host:port, tcp://host:port or unix:///path", addr)
+	}
+
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// connect opens the connection. Local syslog sockets are usually datagram sockets, so a
+// unix socket is tried as one before as a stream.
+func (w *Writer) connect() error {
+	var err error
+	if w.network == "unix" {
+		for _, network := range []string{"unixgram", "unix"} {
+			if w.conn, err = net.DialTimeout(network, w.address, dialTimeout); err == nil {
+				return nil
+			}
+		}
+	} else if w.conn, err = net.DialTimeout(w.network, w.address, dialTimeout); err == nil {
+		return nil
+	}
+	return fmt.Errorf("failed to connect to syslog at %s: %w", w.address, err)
+}
+
+// frame adds the framing of the transport to a message: TCP uses octet counting
+// (RFC 6587), stream sockets a newline, so newlines within the message become spaces, and
+// datagrams none
+func (w *Writer) frame(msg []byte) []byte {
+	switch w.conn.LocalAddr().Network() {
+	case "tcp":
+		return append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	case "unix":
+		return append(bytes.ReplaceAll(msg, []byte("\n"), []byte(" ")), '\n')
+	}
+	return msg
+}
+
+// Send sends a message, reconnecting once if the connection was lost
+func (w *Writer) Send(m Message) error {
+	msg := m.Format()
+	if w.conn != nil {
+		if _, err := w.conn.Write(w.frame(msg)); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+
+	if err := w.connect(); err != nil {
+		return err
+	}
+	if _, err := w.conn.Write(w.frame(msg)); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return fmt.Errorf("failed to send to syslog: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection
+func (w *Writer) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
@@ -0,0 +1,178 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// DefaultRetryConfig retries a delivery for about a day: after 30 seconds, then twice as
+// long each time up to an hour between attempts. Receivers that reject a delivery with a
+// client error other than 408 or 429 are not retried.
+var DefaultRetryConfig = db.RetryConfig{
+	MaxRetries:     30,
+	InitialDelay:   30 * time.Second,
+	MaxDelay:       time.Hour,
+	BackoffFactor:  2.0,
+	RetryableError: isRetryable,
+}
+
+// maxErrorBody limits how much of a failed response is kept as the delivery's last error
+const maxErrorBody = 512
+
+// Dispatcher sends due deliveries from the outbox, retrying failures with exponential
+// backoff. Deliveries that fail MaxRetries times become dead letters.
+type Dispatcher struct {
+	Client    *http.Client
+	Retry     db.RetryConfig
+	Interval  time.Duration // How often Run checks the outbox
+	BatchSize int           // How many deliveries are claimed at a time
+	Lease     time.Duration // How long a claimed delivery is hidden from other dispatchers
+}
+
+// NewDispatcher returns a dispatcher with the default settings
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		Client:    &http.Client{Timeout: 10 * time.Second},
+		Retry:     DefaultRetryConfig,
+		Interval:  5 * time.Second,
+		BatchSize: 50,
+		Lease:     time.Minute,
+	}
+}
+
+// deliveryError is a failed attempt to deliver an event. Status is the response's HTTP
+// status, or zero if the receiver could not be reached.
+type deliveryError struct {
+	Status  int
+	Message string
+}
+
+func (e *deliveryError) Error() string {
+	if e.Status == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("HTTP %d: %s", e.Status, e.Message)
+}
+
+// isRetryable reports whether a failed delivery may succeed if tried again
+func isRetryable(err error) bool {
+	var de *deliveryError
+	if !errors.As(err, &de) || de.Status == 0 {
+		return true
+	}
+	return de.Status >= http.StatusInternalServerError ||
+		de.Status == http.StatusRequestTimeout || de.Status == http.StatusTooManyRequests
+}
+
+// Run sends due deliveries until the context is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := d.DispatchDue(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "webhook: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DispatchDue sends every delivery that is due and returns how many were delivered
+func (d *Dispatcher) DispatchDue(ctx context.Context) (int, error) {
+	delivered := 0
+	webhooks := make(map[int]models.Webhook)
+
+	for ctx.Err() == nil {
+		deliveries, err := db.ClaimWebhookDeliveries(d.BatchSize, d.Lease)
+		if err != nil {
+			return delivered, err
+		}
+		if len(deliveries) == 0 {
+			break
+		}
+
+		for _, delivery := range deliveries {
+			webhook, ok := webhooks[delivery.WebhookID]
+			if !ok {
+				if webhook, err = db.GetWebhook(delivery.WebhookID); err != nil {
+					return delivered, err
+				}
+				webhooks[webhook.ID] = webhook
+			}
+
+			ok, err := d.Dispatch(ctx, webhook, delivery)
+			if err != nil {
+				return delivered, err
+			}
+			if ok {
+				delivered++
+			}
+		}
+
+		if len(deliveries) < d.BatchSize {
+			break
+		}
+	}
+	return delivered, nil
+}
+
+// Dispatch makes one attempt to send a delivery and records the outcome: delivered,
+// scheduled for a retry, or dead. It reports whether the delivery was accepted.
+func (d *Dispatcher) Dispatch(ctx context.Context, webhook models.Webhook, delivery models.WebhookDelivery) (bool, error) {
+	attempts := delivery.Attempts + 1
+	status, err := d.send(ctx, webhook, delivery)
+	if err == nil {
+		return true, db.MarkWebhookDelivered(delivery.ID, attempts, status)
+	}
+
+	if attempts >= d.Retry.MaxRetries || !d.Retry.RetryableError(err) {
+		return false, db.MarkWebhookDead(delivery.ID, attempts, status, err.Error())
+	}
+	return false, db.RetryWebhookDelivery(delivery.ID, attempts, status, err.Error(), time.Now().Add(d.Retry.Delay(attempts)))
+}
+
+// send posts a delivery's payload to its webhook and returns the response status. Any
+// 2xx response counts as delivered.
+func (d *Dispatcher) send(ctx context.Context, webhook models.Webhook, delivery models.WebhookDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, &deliveryError{Message: err.Error()}
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "termpos-webhook")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(delivery.ID))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, timestamp, payload))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, &deliveryError{Message: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return resp.StatusCode, &deliveryError{Status: resp.StatusCode, Message: string(bytes.TrimSpace(body))}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,241 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"termpos/internal/db"
+	"termpos/internal/models"
+)
+
+// receiver is a webhook receiver that records the deliveries it accepts
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	payloads []models.WebhookPayload
+	errors   []error
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	if err := Verify("whsec_test", r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader), body, time.Minute); err != nil {
+		rc.errors = append(rc.errors, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var payload models.WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		rc.errors = append(rc.errors, err)
+	}
+	if payload.Event != r.Header.Get(EventHeader) {
+		rc.errors = append(rc.errors, errors.New("event header does not match the payload"))
+	}
+
+	if rc.status != 0 && rc.status != http.StatusOK {
+		http.Error(w, "receiver is down", rc.status)
+		return
+	}
+	rc.payloads = append(rc.payloads, payload)
+}
+
+func (rc *receiver) setStatus(status int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.status = status
+}
+
+// setupWebhook creates an in-memory database with a product that is low on stock at 2
+// units, and a webhook for stock.low events sent to a local receiver
+func setupWebhook(t *testing.T) (*receiver, *Dispatcher, int) {
+	if err := db.Initialize(":memory:"); err != nil {
+		t.Fatalf("Failed to initialize test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	t.Cleanup(server.Close)
+
+	_, err := db.CreateWebhook(models.Webhook{
+		URL:       server.URL,
+		Secret:    "whsec_test",
+		Events:    []string{models.EventStockLow},
+		CreatedBy: "admin",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create webhook: %v", err)
+	}
+
+	productID, err := db.AddProduct(context.Background(), models.Product{Name: "Milk", Price: 1.2, Stock: 10, LowStockAlert: 2})
+	if err != nil {
+		t.Fatalf("Failed to add product: %v", err)
+	}
+
+	d := NewDispatcher()
+	d.Retry.InitialDelay = 0 // Retries are due at once
+	d.Retry.MaxRetries = 3
+	return rc, d, productID
+}
+
+// onlyDelivery returns the only delivery in the outbox
+func onlyDelivery(t *testing.T) models.WebhookDelivery {
+	t.Helper()
+	deliveries, err := db.ListWebhookDeliveries("", 10)
+	if err != nil {
+		t.Fatalf("Failed to list deliveries: %v", err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected 1 delivery, got %d", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+func TestDispatchDelivers(t *testing.T) {
+	rc, d, productID := setupWebhook(t)
+
+	// Only the change that takes the product to its alert level queues an event
+	for _, stock := range []int{5, 2, 1} {
+		if err := db.UpdateProductStock(context.Background(), productID, stock); err != nil {
+			t.Fatalf("Failed to update stock: %v", err)
+		}
+	}
+
+	delivered, err := d.DispatchDue(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to dispatch: %v", err)
+	}
+	if delivered != 1 || len(rc.payloads) != 1 {
+		t.Fatalf("Expected 1 delivery, got %d (%d received, errors %v)", delivered, len(rc.payloads), rc.errors)
+	}
+	if len(rc.errors) > 0 {
+		t.Errorf("Receiver rejected a delivery: %v", rc.errors)
+	}
+
+	payload := rc.payloads[0]
+	data := payload.Data.(map[string]interface{})
+	if payload.Event != models.EventStockLow || data["stock"] != float64(2) || data["name"] != "Milk" {
+		t.Errorf("Unexpected payload %+v", payload)
+	}
+
+	delivery := onlyDelivery(t)
+	if delivery.Status != models.DeliveryDelivered || delivery.Attempts != 1 || delivery.LastStatus != http.StatusOK {
+		t.Errorf("Expected the delivery to be delivered on the first attempt, got %+v", delivery)
+	}
+
+	// Nothing is sent twice
+	if delivered, _ := d.DispatchDue(context.Background()); delivered != 0 {
+		t.Errorf("Expected nothing left to deliver, got %d", delivered)
+	}
+}
+
+func TestDispatchRetriesAndDeadLetters(t *testing.T) {
+	rc, d, productID := setupWebhook(t)
+	rc.setStatus(http.StatusServiceUnavailable)
+
+	if err := db.UpdateProductStock(context.Background(), productID, 1); err != nil {
+		t.Fatalf("Failed to update stock: %v", err)
+	}
+
+	// Server errors are retried until MaxRetries attempts have failed
+	for attempt := 1; attempt <= d.Retry.MaxRetries; attempt++ {
+		if _, err := d.DispatchDue(context.Background()); err != nil {
+			t.Fatalf("Failed to dispatch: %v", err)
+		}
+		delivery := onlyDelivery(t)
+		if delivery.Attempts != attempt {
+			t.Fatalf("Expected %d attempts, got %d", attempt, delivery.Attempts)
+		}
+
+		expected := models.DeliveryPending
+		if attempt == d.Retry.MaxRetries {
+			expected = models.DeliveryDead
+		}
+		if delivery.Status != expected || delivery.LastStatus != http.StatusServiceUnavailable {
+			t.Fatalf("Expected a %s delivery after attempt %d, got %+v", expected, attempt, delivery)
+		}
+	}
+
+	dead, err := db.ListWebhookDeliveries(models.DeliveryDead, 10)
+	if err != nil || len(dead) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d (%v)", len(dead), err)
+	}
+
+	// A replayed dead letter is sent again once the receiver is back
+	rc.setStatus(http.StatusOK)
+	if err := db.ReplayWebhookDelivery(dead[0].ID); err != nil {
+		t.Fatalf("Failed to replay delivery: %v", err)
+	}
+	if err := db.ReplayWebhookDelivery(dead[0].ID); err != db.ErrDeliveryPending {
+		t.Errorf("Expected a pending delivery not to be replayed, got %v", err)
+	}
+	if delivered, err := d.DispatchDue(context.Background()); err != nil || delivered != 1 {
+		t.Fatalf("Expected the replayed delivery to be sent, got %d (%v)", delivered, err)
+	}
+	if delivery := onlyDelivery(t); delivery.Status != models.DeliveryDelivered {
+		t.Errorf("Expected the replayed delivery to be delivered, got %s", delivery.Status)
+	}
+}
+
+func TestDispatchClientErrorIsNotRetried(t *testing.T) {
+	rc, d, productID := setupWebhook(t)
+	rc.setStatus(http.StatusGone)
+
+	if err := db.UpdateProductStock(context.Background(), productID, 0); err != nil {
+		t.Fatalf("Failed to update stock: %v", err)
+	}
+	if _, err := d.DispatchDue(context.Background()); err != nil {
+		t.Fatalf("Failed to dispatch: %v", err)
+	}
+
+	delivery := onlyDelivery(t)
+	if delivery.Status != models.DeliveryDead || delivery.Attempts != 1 {
+		t.Errorf("Expected a 410 response to make the delivery dead at once, got %+v", delivery)
+	}
+}
+
+func TestOutboxFollowsTransaction(t *testing.T) {
+	setupWebhook(t)
+
+	// An event queued in a transaction that is rolled back is never sent
+	failure := errors.New("sale failed")
+	err := db.Transaction(func(tx *sql.Tx) error {
+		if err := db.PublishEventTx(tx, models.EventStockLow, models.StockLevel{ProductID: 1}); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("Expected the transaction to fail, got %v", err)
+	}
+
+	deliveries, err := db.ListWebhookDeliveries("", 10)
+	if err != nil {
+		t.Fatalf("Failed to list deliveries: %v", err)
+	}
+	if len(deliveries) != 0 {
+		t.Errorf("Expected no deliveries after a rollback, got %d", len(deliveries))
+	}
+
+	// Events nobody subscribed to are not queued
+	err = db.Transaction(func(tx *sql.Tx) error {
+		return db.PublishEventTx(tx, models.EventSaleCreated, models.Sale{ID: 1})
+	})
+	if err != nil {
+		t.Fatalf("Failed to queue event: %v", err)
+	}
+	if deliveries, _ := db.ListWebhookDeliveries("", 10); len(deliveries) != 0 {
+		t.Errorf("Expected no deliveries for an event without subscribers, got %d", len(deliveries))
+	}
+}
@@ -0,0 +1,60 @@
+// Package webhook sends the events queued in the webhook outbox to their receivers.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers sent with every delivery
+const (
+	EventHeader     = "X-POS-Event"
+	DeliveryHeader  = "X-POS-Delivery"
+	TimestampHeader = "X-POS-Timestamp"
+	SignatureHeader = "X-POS-Signature"
+)
+
+// signaturePrefix names the algorithm of a signature
+const signaturePrefix = "sha256="
+
+var (
+	ErrInvalidSignature = errors.New("webhook signature does not match")
+	ErrStaleSignature   = errors.New("webhook timestamp is outside the allowed tolerance")
+)
+
+// Sign returns the signature of a payload sent at a Unix timestamp: the hex HMAC-SHA256,
+// keyed with the webhook's secret, of the timestamp, a dot and the payload. Signing the
+// timestamp lets receivers reject replayed requests.
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and timestamp headers of a delivery, as a receiver would.
+// A tolerance of zero accepts any timestamp.
+func Verify(secret, timestamp, signature string, payload []byte, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !strings.HasPrefix(signature, signaturePrefix) ||
+		!hmac.Equal([]byte(signature), []byte(Sign(secret, ts, payload))) {
+		return ErrInvalidSignature
+	}
+
+	if tolerance > 0 {
+		age := time.Since(time.Unix(ts, 0))
+		if age > tolerance || age < -tolerance {
+			return ErrStaleSignature
+		}
+	}
+	return nil
+}
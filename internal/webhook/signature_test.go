@@ -0,0 +1,32 @@
+package webhook
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignature(t *testing.T) {
+	payload := []byte(`{"event":"sale.created"}`)
+	now := time.Now().Unix()
+	timestamp := strconv.FormatInt(now, 10)
+	signature := Sign("secret", now, payload)
+
+	if err := Verify("secret", timestamp, signature, payload, time.Minute); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	if err := Verify("other", timestamp, signature, payload, time.Minute); err != ErrInvalidSignature {
+		t.Errorf("Expected a signature with another secret to be invalid, got %v", err)
+	}
+	if err := Verify("secret", timestamp, signature, []byte(`{"event":"refund.created"}`), time.Minute); err != ErrInvalidSignature {
+		t.Errorf("Expected a signature of another payload to be invalid, got %v", err)
+	}
+	if err := Verify("secret", strconv.FormatInt(now+1, 10), signature, payload, time.Minute); err != ErrInvalidSignature {
+		t.Errorf("Expected the timestamp to be signed, got %v", err)
+	}
+
+	old := now - 3600
+	if err := Verify("secret", strconv.FormatInt(old, 10), Sign("secret", old, payload), payload, time.Minute); err != ErrStaleSignature {
+		t.Errorf("Expected an old timestamp to be refused, got %v", err)
+	}
+}